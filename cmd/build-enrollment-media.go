@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// enrollModes are the secure-boot-enroll modes of systemd-boot enrolling the keys of the
+// enrollment media
+var enrollModes = []string{"manual", "if-safe", "force"}
+
+// enrollmentKeysFiles are the keys the enrollment media enrolls, in all the formats it ships them
+var enrollmentKeysFiles = []string{"PK.auth", "PK.esl", "PK.der", "KEK.auth", "KEK.esl", "KEK.der", "db.auth", "db.esl", "db.der"}
+
+func NewBuildEnrollmentMediaCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "build-enrollment-media",
+		Short: "Build a media enrolling the Secure Boot keys into the firmware of the machines",
+		Long: "Build a media enrolling the Secure Boot keys into the firmware of the machines\n\n" +
+			"Creates a small ISO or USB image booting systemd-boot, which enrolls the PK, KEK and db of the\n" +
+			"keys dir into the firmware of the machines in setup mode, to provision a fleet with custom\n" +
+			"Secure Boot keys before installing the artifacts signed with them. The media ships the keys as\n" +
+			"signed updates, signature lists and certificates for the firmware enrolling them from files,\n" +
+			"KeyTool if given with --key-tool, and the instructions to enroll them, also written next to\n" +
+			"the artifacts. systemd-boot and KeyTool are signed with the db key when the keys dir has it, so\n" +
+			"the media keeps booting once Secure Boot is enabled.\n\n" +
+			"Write the img output to a USB drive with dd, or copy its files to a FAT32 formatted one for\n" +
+			"the firmware not booting unpartitioned drives.",
+		Example: "  enki build-enrollment-media --keys keys/ --output-type iso,img --key-tool /usr/share/efitools/efi/KeyTool.efi",
+		Args:    cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			keysDir, _ := cmd.Flags().GetString("keys")
+			if err := checkKeysFiles(keysDir, enrollmentKeysFiles, givenKeys(cmd.Flags(), "")); err != nil {
+				return err
+			}
+			outputTypes, _ := cmd.Flags().GetStringSlice("output-type")
+			for _, outputType := range outputTypes {
+				if !slices.Contains(constants.EnrollmentOutputTypes(), outputType) {
+					return failure.Errorf(failure.ErrInvalidConfig, "", "invalid output type %q, available types: %s", outputType, strings.Join(constants.EnrollmentOutputTypes(), ", "))
+				}
+			}
+			if enroll, _ := cmd.Flags().GetString("secure-boot-enroll"); !slices.Contains(enrollModes, enroll) {
+				return failure.Errorf(failure.ErrInvalidConfig, "", "invalid secure-boot-enroll %q, available modes: %s", enroll, strings.Join(enrollModes, ", "))
+			}
+			if engine, _ := cmd.Flags().GetString("iso-engine"); !slices.Contains(iso.Engines(), engine) {
+				return failure.Errorf(failure.ErrInvalidConfig, "", "invalid iso-engine %q, available engines: %s", engine, strings.Join(iso.Engines(), ", "))
+			}
+			if keyTool, _ := cmd.Flags().GetString("key-tool"); keyTool != "" {
+				if _, err := os.Stat(keyTool); err != nil {
+					return failure.Errorf(failure.ErrInvalidConfig, "", "key-tool file does not exist: %s", keyTool)
+				}
+			}
+			return nil
+		},
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			keysDir, _ := cmd.Flags().GetString("keys")
+			outputDir, _ := cmd.Flags().GetString("output-dir")
+			keysDir, removeKeys, err := withGivenKeys(keysDir, givenKeys(cmd.Flags(), ""))
+			if err != nil {
+				return err
+			}
+			defer removeKeys()
+
+			opts := action.EnrollmentMediaOptions{}
+			opts.Name, _ = cmd.Flags().GetString("name")
+			opts.OutputTypes, _ = cmd.Flags().GetStringSlice("output-type")
+			opts.Enroll, _ = cmd.Flags().GetString("secure-boot-enroll")
+			opts.KeyTool, _ = cmd.Flags().GetString("key-tool")
+			opts.IsoEngine, _ = cmd.Flags().GetString("iso-engine")
+			return action.NewEnrollmentMediaAction(cfg, keysDir, outputDir, opts).Run()
+		}),
+	}
+	c.Flags().StringP("keys", "k", "", "Directory with the Secure Boot keys to enroll, as created by enki genkey")
+	c.Flags().StringP("output-dir", "d", ".", "Output dir for the media and its instructions")
+	c.Flags().StringP("name", "n", "enrollment", "Base name of the artifacts")
+	c.Flags().StringSliceP("output-type", "t", []string{string(constants.IsoOutput)}, fmt.Sprintf("Artifact output type [%s]. img is a FAT image to write to USB drives. Can be repeated", strings.Join(constants.EnrollmentOutputTypes(), ", ")))
+	c.Flags().String("secure-boot-enroll", "force", fmt.Sprintf("The secure-boot-enroll option of systemd-boot on the media [%s]. force enrolls the keys after a countdown, manual from the boot menu only", strings.Join(enrollModes, ", ")))
+	c.Flags().String("key-tool", "", "Path to a KeyTool.efi binary to add to the media as a boot entry, to enroll the keys by hand")
+	c.Flags().String("iso-engine", iso.EngineXorriso, fmt.Sprintf("Tool used to create the ISO [%s]", strings.Join(iso.Engines(), ", ")))
+	addPrivateKeyFlags(c, "", "db-key")
+	_ = c.MarkFlagRequired("keys")
+	_ = c.MarkFlagDirname("keys")
+	_ = c.MarkFlagDirname("output-dir")
+	_ = c.MarkFlagFilename("key-tool", "efi")
+	_ = c.RegisterFlagCompletionFunc("output-type", completeValues(constants.EnrollmentOutputTypes()...))
+	_ = c.RegisterFlagCompletionFunc("secure-boot-enroll", completeValues(enrollModes...))
+	_ = c.RegisterFlagCompletionFunc("iso-engine", completeValues(iso.Engines()...))
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewBuildEnrollmentMediaCmd())
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+)
+
+var _ = Describe("BuildEnrollmentMedia", Label("build-enrollment-media", "cmd"), func() {
+	var root *cobra.Command
+	var keysDir string
+	BeforeEach(func() {
+		root = NewRootCmd()
+		root.AddCommand(NewBuildEnrollmentMediaCmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+		keysDir = GinkgoT().TempDir()
+		for _, file := range enrollmentKeysFiles {
+			Expect(os.WriteFile(filepath.Join(keysDir, file), nil, 0644)).To(Succeed())
+		}
+	})
+	It("Requires the keys to enroll", Label("flags"), func() {
+		Expect(os.Remove(filepath.Join(keysDir, "KEK.esl"))).To(Succeed())
+		_, _, err := executeCommandC(root, "build-enrollment-media", "--keys", keysDir)
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+		Expect(err.Error()).To(ContainSubstring("KEK.esl"))
+	})
+	It("Rejects invalid output types and enroll modes", Label("flags"), func() {
+		_, _, err := executeCommandC(root, "build-enrollment-media", "--keys", keysDir, "--output-type", "container")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring(`invalid output type "container"`))
+		_, _, err = executeCommandC(root, "build-enrollment-media", "--keys", keysDir, "--secure-boot-enroll", "off")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
@@ -1,12 +1,27 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+
 	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/autoinstall"
+	"github.com/kairos-io/enki/pkg/buildinfo"
 	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/encrypt"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/firmware"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/microcode"
+	"github.com/kairos-io/enki/pkg/upload"
 	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/vulnscan"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -19,15 +34,21 @@ func NewBuildISOCmd() *cobra.Command {
 		Long: "Build bootable installation media ISOs\n\n" +
 			"SOURCE - should be provided as uri in following format <sourceType>:<sourceName>\n" +
 			"    * <sourceType> - might be [\"dir\", \"file\", \"oci\", \"docker\"], as default is \"docker\"\n" +
-			"    * <sourceName> - is path to file or directory, image name with tag version",
+			"    * <sourceName> - is path to file or directory, image name with tag version\n" +
+			"    Pass - to read the image as a docker save archive from stdin, like\n" +
+			"    docker save IMAGE | enki build-iso -",
 		Args: cobra.MaximumNArgs(1),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			return CheckRoot()
 		},
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
 			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
 			if err != nil {
 				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				// Only the config templates fail the build, as they would end up unexpanded
+				if errors.Is(err, failure.ErrInvalidConfig) {
+					return err
+				}
 			}
 
 			flags := cmd.Flags()
@@ -41,17 +62,38 @@ func NewBuildISOCmd() *cobra.Command {
 				return err
 			}
 
-			if len(args) == 1 {
+			if cfg.OutDir == utils.Stdout {
+				if err := checkStdoutArtifact(map[string]bool{
+					"recovery": spec.Recovery, "zsync": spec.Zsync, "torrent": spec.Torrent, "upload": spec.Upload != "",
+				}); err != nil {
+					return failure.New(failure.ErrInvalidConfig, err, "")
+				}
+			}
+
+			var archive *image.Archive
+			if len(args) == 1 && args[0] == image.Stdin {
+				// The archive is only on disk for the build, external tools can't read it
+				if spec.VulnScan != "" || spec.VerifySourcePolicy != "" {
+					return failure.New(failure.ErrInvalidConfig, errors.New("vuln-scan and verify-source-policy can't be used when reading the source image from stdin"), "")
+				}
+				imgSource, stdinArchive, err := stdinSource(cfg)
+				if err != nil {
+					return err
+				}
+				archive = stdinArchive
+				defer archive.Remove()
+				spec.RootFS = []*v1.ImageSource{imgSource}
+			} else if len(args) == 1 {
 				imgSource, err := v1.NewSrcFromURI(args[0])
 				if err != nil {
 					cfg.Logger.Errorf("not a valid rootfs source image argument: %s", args[0])
-					return err
+					return failure.New(failure.ErrInvalidConfig, err, "")
 				}
 				spec.RootFS = []*v1.ImageSource{imgSource}
 			} else if len(spec.RootFS) == 0 {
 				errmsg := "rootfs source image for building ISO was not provided"
 				cfg.Logger.Errorf(errmsg)
-				return fmt.Errorf(errmsg)
+				return failure.New(failure.ErrInvalidConfig, errors.New(errmsg), "pass the source image as argument or set iso.rootfs in the config file")
 			}
 
 			// Repos and overlays can't be unmarshaled directly as they require
@@ -65,7 +107,7 @@ func NewBuildISOCmd() *cobra.Command {
 					spec.RootFS = append(spec.RootFS, v1.NewDirSrc(oRootfs))
 				} else {
 					cfg.Logger.Errorf("Invalid value for overlay-rootfs")
-					return fmt.Errorf("Invalid path '%s': %v", oRootfs, err)
+					return failure.Errorf(failure.ErrInvalidConfig, "", "Invalid path '%s': %v", oRootfs, err)
 				}
 			}
 			if oUEFI != "" {
@@ -73,7 +115,7 @@ func NewBuildISOCmd() *cobra.Command {
 					spec.UEFI = append(spec.UEFI, v1.NewDirSrc(oUEFI))
 				} else {
 					cfg.Logger.Errorf("Invalid value for overlay-uefi")
-					return fmt.Errorf("Invalid path '%s': %v", oUEFI, err)
+					return failure.Errorf(failure.ErrInvalidConfig, "", "Invalid path '%s': %v", oUEFI, err)
 				}
 			}
 			if oISO != "" {
@@ -81,30 +123,132 @@ func NewBuildISOCmd() *cobra.Command {
 					spec.Image = append(spec.Image, v1.NewDirSrc(oISO))
 				} else {
 					cfg.Logger.Errorf("Invalid value for overlay-iso")
-					return fmt.Errorf("Invalid path '%s': %v", oISO, err)
+					return failure.Errorf(failure.ErrInvalidConfig, "", "Invalid path '%s': %v", oISO, err)
+				}
+			}
+
+			// The archive read from stdin is not in any registry to pin it from
+			pinned := []*[]*v1.ImageSource{&spec.UEFI, &spec.Image}
+			if archive == nil {
+				pinned = append(pinned, &spec.RootFS)
+			} else if locked, _ := flags.GetBool("locked"); locked {
+				return failure.New(failure.ErrInvalidConfig, errors.New("locked can't be used when reading the source image from stdin"), "")
+			}
+			if err := applyLockfile(cfg, flags, viper.GetStringSlice("firmware-capsule"), pinned...); err != nil {
+				return err
+			}
+			if digest, _ := flags.GetString("source-digest"); digest != "" {
+				if len(spec.RootFS) != 1 {
+					return failure.New(failure.ErrInvalidConfig, errors.New("source-digest pins a single rootfs source image"), "")
+				}
+				if spec.RootFS[0], err = applySourceDigest(cfg, flags, spec.RootFS[0], archive); err != nil {
+					return err
 				}
 			}
 
-			buildISO := action.NewBuildISOAction(cfg, spec)
-			err = buildISO.ISORun()
+			if withInfo, _ := flags.GetBool("build-info"); withInfo {
+				cfg.BuildInfo = buildinfo.New(cfg.Runner, flags, viper.GetString("config-dir"))
+				addBuildSources(cfg, archive, spec.RootFS...)
+			}
+
+			err = recordBuild(cfg, cmd.Name(), spec.RootFS[0].String(), cfg.OutDir, func() error {
+				return action.NewBuildISOAction(cfg, spec).ISORun()
+			})
 			if err != nil {
 				cfg.Logger.Errorf(err.Error())
 				return err
 			}
 
 			return nil
-		},
+		}),
 	}
-	c.Flags().StringP("name", "n", "", "Basename of the generated ISO file")
-	c.Flags().StringP("output", "o", "", "Output directory (defaults to current directory)")
-	c.Flags().Bool("date", false, "Adds a date suffix into the generated ISO file")
+	c.Flags().StringP("name", "n", "", "Name of the generated files, replacing the one derived from the flavor, version and arch of the image")
+	c.Flags().StringP("output", "o", "", "Output directory (defaults to current directory), or - to write the ISO to stdout")
+	c.Flags().Bool("date", false, "Adds the build date to the name of the generated files")
+	c.Flags().String("name-template", "", "Go template of the name of the generated files, without extension, like {{.flavor}}-{{.version}}{{if .type}}-{{.type}}{{end}}. The image values, name, arch, date and the artifact type are available")
 	c.Flags().String("overlay-rootfs", "", "Path of the overlayed rootfs data")
 	c.Flags().String("overlay-uefi", "", "Path of the overlayed uefi data")
 	c.Flags().String("overlay-iso", "", "Path of the overlayed iso data")
-	c.Flags().String("label", "", "Label of the ISO volume")
+	c.Flags().String("label", "", "Label of the ISO volume, up to 32 letters, digits, dashes, dots and underscores")
+	c.Flags().String("max-size", "", "Fail if the generated ISO is bigger than this size, e.g. 700MiB for CDs")
+	c.Flags().String("json-result", "", "Write a machine readable JSON summary of the build, including the per stage timings, to this file")
+	c.Flags().StringSlice("prune", []string{}, fmt.Sprintf("Remove unneeded files from the rootfs using the given profiles [%s]", strings.Join(utils.PruneProfiles(), ", ")))
+	c.Flags().Bool("prune-dry-run", false, "Only report how much space the prune profiles would reclaim, without removing anything")
+	c.Flags().String("vuln-scan", "", fmt.Sprintf("Scan the rootfs source images for known vulnerabilities before building anything from them [%s]", strings.Join(vulnscan.Scanners(), ", ")))
+	c.Flags().String("fail-on-severity", "", fmt.Sprintf("Fail the build on vulnerabilities of this severity or higher [%s]. The high and critical ones are only reported if not set", strings.Join(vulnscan.Severities(), ", ")))
+	c.Flags().String("verify-source-policy", "", "Trust policy file the signatures of the source images are verified against with cosign or notation before building, refusing unsigned or tampered images. The SLSA provenance attestations it requires are chained into the build info. Tags are resolved to a digest once, the images are verified and built by that digest. Local dirs and files are not verified")
+	c.Flags().Bool("stream-rootfs", false, "Stream the rootfs image layers straight into the squashfs instead of extracting them first. Falls back to extracting when hooks, prune profiles or overlays are used.")
+	c.Flags().Bool("http-boot", false, "Optimize the rootfs squashfs for booting over HTTP range requests, using small zstd blocks")
+	c.Flags().Bool("progress", false, "Log the progress of the squashfs creation and of long copies. The squashfs progress requires squashfs-tools 4.6 or newer")
+	c.Flags().Bool("recovery", false, "Also write the rootfs squashfs next to the ISO, to be used as recovery image")
+	c.Flags().String("encrypt", "", fmt.Sprintf("Encrypt the ISO and recovery image for distribution [%s]. Decrypt them with the decrypt command", strings.Join(encrypt.Methods(), ", ")))
+	c.Flags().String("encrypt-key", "", "age recipient or recipients file, or AES-256 key file, used with encrypt. Files can be given as secret references like env://NAME or vault://PATH#FIELD")
+	c.Flags().String("upload", "", fmt.Sprintf("Upload the artifacts after the build, using the credentials of the aws, gcloud or az CLI [%s]", strings.Join(upload.Schemes(), ", ")))
+	c.Flags().Bool("torrent", false, "Generate a .torrent file next to the ISO and recovery image, and print their magnet links")
+	c.Flags().StringSlice("torrent-tracker", []string{}, "Tracker announce URL added to the torrents. Can be repeated.")
+	c.Flags().StringSlice("torrent-webseed", []string{}, "HTTP mirror added as web seed to the torrents, the file name is appended to URLs ending in /. Can be repeated.")
+	c.Flags().StringSlice("checksum", []string{utils.ChecksumSHA256}, fmt.Sprintf("Checksum files written next to the ISO and recovery image. The recovery image is hashed while written, the ISO is read once for all the algorithms after it is written [%s]", strings.Join(utils.ChecksumAlgorithms(), ", ")))
+	c.Flags().String("checksum-format", utils.ChecksumFormatHex, fmt.Sprintf("Format of the checksum files [%s]. multihash encodes the algorithm along with the digest", strings.Join(utils.ChecksumFormats(), ", ")))
+	c.Flags().Bool("build-info", true, "Embed the build provenance (enki version, source digests, flags, config dir commit) into the rootfs and the ISO")
+	c.Flags().Bool("zsync", false, "Generate a .zsync control file next to the ISO, so clients can download only the changed blocks")
+	addLockFlags(c)
+	addContainerizedFlags(c)
+	addWatchFlag(c, watchOptions{
+		inputs: []string{"overlay-rootfs", "overlay-uefi", "overlay-iso", "install-config", "rootfs-hook"},
+		narrow: func(flags *pflag.FlagSet, changed []string) map[string][]string {
+			// The recovery image is the rootfs, the ISO tree and the EFI image don't end up in it
+			for _, input := range changed {
+				if input != "overlay-uefi" && input != "overlay-iso" {
+					return nil
+				}
+			}
+			return map[string][]string{"recovery": {"false"}}
+		},
+	})
+	c.Flags().String("iso-engine", iso.EngineXorriso, fmt.Sprintf("Tool used to create the ISO [%s]. The native engine needs no external tools but can't make the ISO bootable from USB drives in BIOS mode", strings.Join(iso.Engines(), ", ")))
+	c.Flags().Bool("iso-rockridge", true, "Add Rock Ridge extensions to the ISO, with POSIX permissions, symlinks and long names")
+	c.Flags().Bool("iso-joliet", true, "Add Joliet extensions to the ISO, with long names for Windows")
+	c.Flags().Bool("iso-relocate-deep-dirs", false, "Relocate directories nested deeper than 8 levels, for firmware and installers that can't read them. Requires Rock Ridge")
+	c.Flags().Int("esp-headroom", 10, "Free space left in the EFI image, as a percentage of its contents")
+	c.Flags().String("esp-align", "4MiB", "Round the size of the EFI image up to a multiple of this size")
+	c.Flags().String("esp-size", "", "Fixed size of the EFI image, e.g. 32MiB. It is computed from its contents if not set")
+	c.Flags().String("esp-fat", utils.FatAuto, fmt.Sprintf("FAT variant of the EFI image [%s]. Some firmwares only boot FAT32 ESPs", strings.Join(utils.FatVariants(), ", ")))
+	c.Flags().String("esp-cluster-size", "", "Cluster size of the EFI image, e.g. 4KiB. Picked by mkfs.fat from the image size if not set")
+	c.Flags().String("esp-label", constants.EfiLabel, "Volume label of the EFI image, up to 11 characters")
+	c.Flags().String("install-device", "", "Make the ISO install unattended to this disk, e.g. /dev/sda")
+	c.Flags().Bool("install-reboot", false, "Make the ISO install unattended and reboot into the installed system once done")
+	c.Flags().String("install-config", "", fmt.Sprintf("Make the ISO install unattended with this cloud-config, embedded as %s at the root of the ISO. Its install section can set the whole install spec", autoinstall.FileName))
+	c.Flags().StringSlice("firmware-capsule", []string{}, fmt.Sprintf("LVFS firmware capsule (.cab) added to the %s dir of the ISO, and applied with fwupd on the first boot of the installed system. Can be repeated", firmware.Dir))
+	c.Flags().Bool("firmware-reboot", false, "Reboot the installed system once the firmware capsules are scheduled on its first boot, to apply them right away")
+	c.Flags().String("microcode", microcode.Auto, fmt.Sprintf("CPU microcode of the rootfs prepended to the initrd, for the kernel to load it early [%s]. auto takes the microcode of the vendors the rootfs ships it for, unless the initrd already loads it", strings.Join(microcode.Modes(), ", ")))
+	c.Flags().String("efi-shell", "", "Path to a UEFI shell binary to add to the ISO as an extra EFI boot menu entry")
+	c.Flags().String("memtest", "", "Path to a memtest86+ EFI binary to add to the ISO as an extra EFI boot menu entry")
+	c.Flags().Bool("legacy-only", false, "Build the smallest ISO booting only in legacy BIOS mode, with isolinux from the syslinux of the build host instead of grub, skipping the EFI image. Its boot entries are taken from the grub config of the ISO. For BIOS only provisioning environments")
+	c.Flags().Bool("grub-standalone", false, "Generate the EFI grub with all its modules and its config embedded, instead of copying the one of the rootfs, so it doesn't depend on the grub modules of the image and boots the same grub config as in BIOS mode. Requires grub-mkstandalone")
+	c.Flags().String("grub-keys", "", "Directory with the db.key and db.pem signing the standalone grub, for shim to boot it with Secure Boot once the db certificate is enrolled as MOK. Only with grub-standalone")
+	c.Flags().String("grub-sbat", "", "CSV of SBAT entries added to the .sbat section of the standalone grub, required by shim 15.3 and newer. Only with grub-standalone")
+	c.Flags().StringSlice("rootfs-hook", []string{}, "Script to run against the rootfs before packing it. It runs inside a sandbox where the rootfs is / and no other host path is visible, through qemu-user-static if the rootfs is of a foreign arch. Can be repeated.")
 	archType := newEnumFlag([]string{"x86_64", "arm64"}, "x86_64")
 	c.Flags().Bool("squash-no-compression", true, "Disable squashfs compression.")
 	c.Flags().VarP(archType, "arch", "a", "Arch to build the image for")
+	_ = c.MarkFlagDirname("output")
+	_ = c.MarkFlagDirname("overlay-rootfs")
+	_ = c.MarkFlagDirname("overlay-uefi")
+	_ = c.MarkFlagDirname("overlay-iso")
+	_ = c.MarkFlagFilename("install-config", "yaml", "yml")
+	_ = c.MarkFlagFilename("firmware-capsule", "cab")
+	_ = c.MarkFlagDirname("grub-keys")
+	_ = c.MarkFlagFilename("grub-sbat", "csv")
+	_ = c.RegisterFlagCompletionFunc("arch", completeValues(archType.Allowed...))
+	_ = c.RegisterFlagCompletionFunc("prune", completeValues(utils.PruneProfiles()...))
+	_ = c.RegisterFlagCompletionFunc("vuln-scan", completeValues(vulnscan.Scanners()...))
+	_ = c.RegisterFlagCompletionFunc("fail-on-severity", completeValues(vulnscan.Severities()...))
+	_ = c.RegisterFlagCompletionFunc("encrypt", completeValues(encrypt.Methods()...))
+	_ = c.RegisterFlagCompletionFunc("checksum", completeValues(utils.ChecksumAlgorithms()...))
+	_ = c.RegisterFlagCompletionFunc("checksum-format", completeValues(utils.ChecksumFormats()...))
+	_ = c.RegisterFlagCompletionFunc("iso-engine", completeValues(iso.Engines()...))
+	_ = c.RegisterFlagCompletionFunc("microcode", completeValues(microcode.Modes()...))
+	_ = c.RegisterFlagCompletionFunc("esp-fat", completeValues(utils.FatVariants()...))
 	return c
 }
 
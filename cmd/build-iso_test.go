@@ -46,6 +46,34 @@ var _ = Describe("BuildISO", Label("iso", "cmd"), func() {
 		Expect(err).ToNot(BeNil())
 		Expect(err.Error()).To(ContainSubstring("invalid image reference"))
 	})
+	It("Errors out on labels the live root can't be found by", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewBuildISOCmd())
+		_, _, err := executeCommandC(root, "build-iso", "some/image:latest", "--label", "KAIROS LIVE")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(`the ISO label "KAIROS LIVE" can only have letters`))
+	})
+	It("Errors out on grub keys without a standalone grub or without the db key", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewBuildISOCmd())
+		keysDir := GinkgoT().TempDir()
+		_, _, err := executeCommandC(root, "build-iso", "some/image:latest", "--grub-keys", keysDir)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("grub-keys and grub-sbat require grub-standalone"))
+
+		root = NewRootCmd()
+		root.AddCommand(NewBuildISOCmd())
+		_, _, err = executeCommandC(root, "build-iso", "some/image:latest", "--grub-standalone", "--grub-keys", keysDir)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("grub-keys directory does not contain db.key"))
+	})
+	It("Errors out on legacy only media with EFI tools", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewBuildISOCmd())
+		_, _, err := executeCommandC(root, "build-iso", "some/image:latest", "--legacy-only", "--grub-standalone")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("legacy-only media don't boot in UEFI mode"))
+	})
 	It("Errors out if overlay roofs path does not exist", Label("flags"), func() {
 		_, _, err := executeCommandC(
 			rootCmd, "build-iso", "system/cos", "--overlay-rootfs", "/nonexistingpath",
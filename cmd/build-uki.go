@@ -1,19 +1,101 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/audit"
+	"github.com/kairos-io/enki/pkg/autoinstall"
+	"github.com/kairos-io/enki/pkg/buildinfo"
 	"github.com/kairos-io/enki/pkg/config"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/encrypt"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/firmware"
+	"github.com/kairos-io/enki/pkg/flavor"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/microcode"
+	"github.com/kairos-io/enki/pkg/scan"
+	"github.com/kairos-io/enki/pkg/secret"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	"github.com/kairos-io/enki/pkg/signer"
+	"github.com/kairos-io/enki/pkg/trust"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/upload"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/vulnscan"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/twpayne/go-vfs"
 )
 
+// keysHint is the remediation of an incomplete keys directory
+const keysHint = "generate the secure boot keys with enki genkey and pass their directory with --keys"
+
+// keysFiles are the keys needed to sign the UKIs and to enroll them
+var keysFiles = []string{"db.der", "db.key", "db.auth", "KEK.der", "KEK.auth", "PK.der", "PK.auth", "tpm2-pcr-private.pem"}
+
+// mokKeysFiles are the keys needed with the shim-mok secureboot-mode: the db key, enrolled as
+// MOK, and the PCR policy key. The PK and KEK are not needed.
+var mokKeysFiles = []string{"db.der", "db.key", "db.pem", "tpm2-pcr-private.pem"}
+
+// checkKeysDir fails if keysDir lacks any of the keys needed to sign the UKIs and to enroll them,
+// but the given ones
+func checkKeysDir(keysDir string, given map[string]string) error {
+	return checkKeysFiles(keysDir, keysFiles, given)
+}
+
+// checkMokKeysDir fails if the keys dir lacks the db key, enrolled as MOK with the shim-mok
+// secureboot-mode, or the PCR policy key, but the given ones. The PK and KEK are not needed.
+func checkMokKeysDir(keysDir string, given map[string]string) error {
+	return checkKeysFiles(keysDir, mokKeysFiles, given)
+}
+
+// checkDetachedKeysDir is like checkKeysDir and checkMokKeysDir when the EFI binaries are signed
+// on another machine: the db key is not needed, nor the PCR policy key once the UKIs are built.
+// A signer signs the PCR policies too, so only the public PCR policy key is needed then.
+func checkDetachedKeysDir(keysDir string, mok, apply, signer bool, given map[string]string) error {
+	required := keysFiles
+	if mok {
+		required = mokKeysFiles
+	}
+	required = slices.DeleteFunc(slices.Clone(required), func(file string) bool {
+		return file == "db.key" || ((apply || signer) && file == "tpm2-pcr-private.pem")
+	})
+	if signer {
+		required = append(required, "tpm2-pcr-public.pem")
+	}
+	return checkKeysFiles(keysDir, required, given)
+}
+
+func checkKeysFiles(keysDir string, requiredFiles []string, given map[string]string) error {
+	if _, err := os.Stat(keysDir); err != nil {
+		return failure.Errorf(failure.ErrMissingKeys, keysHint, "keys directory does not exist: %s", keysDir)
+	}
+	if err := checkGivenKeys(given); err != nil {
+		return err
+	}
+	for _, file := range requiredFiles {
+		if _, ok := given[file]; ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(keysDir, file)); err != nil {
+			return failure.Errorf(failure.ErrMissingKeys, keysHint, "keys directory does not contain required file: %s", file)
+		}
+	}
+	return nil
+}
+
 // NewBuildUKICmd returns a new instance of the build-uki subcommand and appends it to
 // the root command.
 func NewBuildUKICmd() *cobra.Command {
@@ -23,7 +105,9 @@ func NewBuildUKICmd() *cobra.Command {
 		Long: "Build a UKI artifact from a container image\n\n" +
 			"SourceImage - should be provided as uri in following format <sourceType>:<sourceName>\n" +
 			"    * <sourceType> - might be [\"dir\", \"file\", \"oci\", \"docker\"], as default is \"docker\"\n" +
-			"    * <sourceName> - is path to file or directory, image name with tag version" +
+			"    * <sourceName> - is path to file or directory, image name with tag version\n" +
+			"    Pass - to read the image as a docker save archive from stdin, like\n" +
+			"    docker save IMAGE | enki build-uki - ...\n\n" +
 			"The following files are expected inside the keys directory:\n" +
 			"    - DB.crt\n" +
 			"    - DB.der\n" +
@@ -33,16 +117,28 @@ func NewBuildUKICmd() *cobra.Command {
 			"    - KEK.auth\n" +
 			"    - PK.der\n" +
 			"    - PK.auth\n" +
-			"    - tpm2-pcr-private.pem\n",
+			"    - tpm2-pcr-private.pem\n\n" +
+			"With --secureboot-mode shim-mok, for machines where custom PK and KEK can't be enrolled, the\n" +
+			"Microsoft signed shim boots systemd-boot instead, which is signed with the db key like the UKIs.\n" +
+			"The db certificate is shipped next to shim as " + constants.MokCertFile + ", to enroll\n" +
+			"it from MokManager on first boot. Only db.der, db.key, db.pem and tpm2-pcr-private.pem are\n" +
+			"needed then.\n\n" +
+			"With --signer, the signing service signs the PCR policies with the tpm2-pcr key too, so\n" +
+			"only tpm2-pcr-public.pem is needed, next to the db certificate, instead of db.key and\n" +
+			"tpm2-pcr-private.pem.\n\n" +
+			"With --boot-entry-type bls, the boot entries are Boot Loader Specification Type #1 entries\n" +
+			"instead of UKIs: a kernel signed with the db key and an initrd, shared by all the entries,\n" +
+			"with the cmdline in each loader entry. Only the kernel is verified by Secure Boot.\n\n" +
+			"The source image may ship defaults for the boot-branding, extend-cmdline, extra-cmdline and\n" +
+			"prune settings in /" + flavor.DefaultsFile + ", used unless given with flags or the\n" +
+			"config file.\n",
 		Args: cobra.ExactArgs(1),
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			artifact, err := cmd.Flags().GetString("output-type")
+		PreRunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			artifacts, err := cmd.Flags().GetStringSlice("output-type")
 			if err != nil {
 				return err
 			}
-			if artifact != string(constants.DefaultOutput) && artifact != string(constants.IsoOutput) && artifact != string(constants.ContainerOutput) {
-				return fmt.Errorf("invalid output type: %s", artifact)
-			}
+			withISO := slices.Contains(artifacts, string(constants.IsoOutput))
 
 			overlayRootfs, _ := cmd.Flags().GetString("overlay-rootfs")
 			if overlayRootfs != "" {
@@ -75,7 +171,7 @@ func NewBuildUKICmd() *cobra.Command {
 				}
 
 				// Check if we are setting a different artifact and overlay-iso is set
-				if artifact != string(constants.IsoOutput) {
+				if !withISO {
 					return fmt.Errorf("overlay-iso is only supported for iso artifacts")
 				}
 
@@ -86,26 +182,321 @@ func NewBuildUKICmd() *cobra.Command {
 				}
 			}
 
-			// Check if the keys directory exists
+			for _, flag := range []string{"efi-shell", "memtest"} {
+				if payload, _ := cmd.Flags().GetString(flag); payload != "" {
+					if _, err := os.Stat(payload); err != nil {
+						return fmt.Errorf("%s file does not exist: %s", flag, payload)
+					}
+				}
+			}
+
+			secureBootMode, _ := cmd.Flags().GetString("secureboot-mode")
+			if !slices.Contains(constants.GetSecureBootModes(), secureBootMode) {
+				return fmt.Errorf("invalid secureboot-mode %q, available modes: %s", secureBootMode, strings.Join(constants.GetSecureBootModes(), ", "))
+			}
+			for _, flag := range []string{"shim", "mok-manager"} {
+				if payload, _ := cmd.Flags().GetString(flag); payload != "" {
+					if secureBootMode != constants.SecureBootShimMok {
+						return fmt.Errorf("%s is only supported with the %s secureboot-mode", flag, constants.SecureBootShimMok)
+					}
+					if _, err := os.Stat(payload); err != nil {
+						return fmt.Errorf("%s file does not exist: %s", flag, payload)
+					}
+				}
+			}
+
+			if dbx, _ := cmd.Flags().GetString("dbx"); dbx != "" {
+				if secureBootMode == constants.SecureBootShimMok {
+					return fmt.Errorf("dbx is only enrolled with the %s secureboot-mode, the firmware keeps its own dbx with shim", constants.SecureBootCustomKeys)
+				}
+				if _, err := secureboot.ReadDBX(dbx); err != nil {
+					return err
+				}
+			}
+			for _, flag := range []string{"sbat-revocations", "sbat-policy"} {
+				if sbatLevel, _ := cmd.Flags().GetString(flag); sbatLevel != "" {
+					if _, err := secureboot.ReadSbatLevel(sbatLevel); err != nil {
+						return err
+					}
+				}
+			}
+			if sbat, _ := cmd.Flags().GetString("sbat"); sbat != "" {
+				if _, err := secureboot.ReadSbatEntries(sbat); err != nil {
+					return err
+				}
+			}
+			if tsa, _ := cmd.Flags().GetString("timestamp-url"); tsa != "" {
+				if err := secureboot.CheckTSA(tsa); err != nil {
+					return err
+				}
+			}
+
+			if err := checkBootEntryFlags(cmd.Flags()); err != nil {
+				return err
+			}
+			mediaType, _ := cmd.Flags().GetString("media-type")
+
+			installDevice, _ := cmd.Flags().GetString("install-device")
+			installReboot, _ := cmd.Flags().GetBool("install-reboot")
+			installConfig, _ := cmd.Flags().GetString("install-config")
+			install := autoinstall.Options{Device: installDevice, Reboot: installReboot, Config: installConfig}
+			if install.Enabled() {
+				if mediaType != constants.MediaInstaller || !withISO {
+					return fmt.Errorf("install-device, install-reboot and install-config are only supported for iso artifacts of the %s media-type", constants.MediaInstaller)
+				}
+				if err := install.Validate(vfs.OSFS); err != nil {
+					return err
+				}
+			}
+			capsules, _ := cmd.Flags().GetStringSlice("firmware-capsule")
+			firmwareReboot, _ := cmd.Flags().GetBool("firmware-reboot")
+			if fw := (firmware.Options{Capsules: capsules, Reboot: firmwareReboot}); fw.Enabled() || fw.Reboot {
+				if mediaType != constants.MediaInstaller || !withISO {
+					return fmt.Errorf("firmware-capsule and firmware-reboot are only supported for iso artifacts of the %s media-type", constants.MediaInstaller)
+				}
+				if err := fw.Validate(vfs.OSFS); err != nil {
+					return err
+				}
+			}
+
+			if engine, _ := cmd.Flags().GetString("iso-engine"); !slices.Contains(iso.Engines(), engine) {
+				return fmt.Errorf("invalid iso-engine %q, available engines: %s", engine, strings.Join(iso.Engines(), ", "))
+			}
+			if mode, _ := cmd.Flags().GetString("microcode"); !slices.Contains(microcode.Modes(), mode) {
+				return fmt.Errorf("invalid microcode %q, available modes: %s", mode, strings.Join(microcode.Modes(), ", "))
+			}
+
+			rockRidge, _ := cmd.Flags().GetBool("iso-rockridge")
+			if relocate, _ := cmd.Flags().GetBool("iso-relocate-deep-dirs"); relocate && !rockRidge {
+				return fmt.Errorf("iso-relocate-deep-dirs requires iso-rockridge")
+			}
+
+			withZsync, _ := cmd.Flags().GetBool("zsync")
+			if withZsync && !withISO {
+				return fmt.Errorf("zsync is only supported for iso artifacts")
+			}
+
+			if uri, _ := cmd.Flags().GetString("upload"); uri != "" {
+				if _, err := upload.ParseTarget(uri); err != nil {
+					return err
+				}
+				if !slices.ContainsFunc(artifacts, func(artifact string) bool { return artifact != string(constants.ContainerOutput) }) {
+					return fmt.Errorf("upload is not supported for container artifacts")
+				}
+			}
+
+			espHeadroom, _ := cmd.Flags().GetInt("esp-headroom")
+			espAlign, _ := cmd.Flags().GetString("esp-align")
+			espSize, _ := cmd.Flags().GetString("esp-size")
+			if _, err := utils.NewEspSizing(espHeadroom, espAlign, espSize); err != nil {
+				return err
+			}
+			espFat, _ := cmd.Flags().GetString("esp-fat")
+			espClusterSize, _ := cmd.Flags().GetString("esp-cluster-size")
+			espLabel, _ := cmd.Flags().GetString("esp-label")
+			if _, err := utils.NewFatOptions(espFat, espClusterSize, espLabel); err != nil {
+				return err
+			}
+
+			withContainer := slices.Contains(artifacts, string(constants.ContainerOutput))
+			containerImage, _ := cmd.Flags().GetString("container-image")
+			push, _ := cmd.Flags().GetBool("push")
+			containerLabels, _ := cmd.Flags().GetStringSlice("container-label")
+			if (containerImage != "" || push || len(containerLabels) > 0) && !withContainer {
+				return fmt.Errorf("container-image, container-label and push are only supported for container artifacts")
+			}
+			if containerImage != "" {
+				if _, err := name.ParseReference(containerImage); err != nil {
+					return fmt.Errorf("invalid container-image %q: %w", containerImage, err)
+				}
+			}
+			if push && containerImage == "" {
+				return fmt.Errorf("push requires a container-image with the registry to push to")
+			}
+			if allPlatforms, _ := cmd.Flags().GetBool("all-platforms"); allPlatforms && push {
+				return fmt.Errorf("push can't be used with all-platforms, every platform would push to the same container-image")
+			}
+			for _, label := range containerLabels {
+				if key, _, ok := strings.Cut(label, "="); !ok || key == "" {
+					return fmt.Errorf("invalid container-label %q, expected key=value", label)
+				}
+			}
+
+			bootEntryType, _ := cmd.Flags().GetString("boot-entry-type")
+			if sbat, _ := cmd.Flags().GetString("sbat"); sbat != "" && bootEntryType == constants.BootEntryBLS {
+				return fmt.Errorf("sbat is only added to UKIs, not to the kernels of the %s boot-entry-type", constants.BootEntryBLS)
+			}
+
+			if xbootldr, _ := cmd.Flags().GetBool("xbootldr"); xbootldr && !slices.Contains(artifacts, string(constants.EspDirOutput)) {
+				return fmt.Errorf("xbootldr is only supported for esp-dir artifacts")
+			}
+			if withTorrent, _ := cmd.Flags().GetBool("torrent"); withTorrent && !withISO {
+				return fmt.Errorf("torrent is only supported for iso artifacts")
+			}
+
+			if method, _ := cmd.Flags().GetString("encrypt"); method != "" {
+				if !slices.Contains(encrypt.Methods(), method) {
+					return fmt.Errorf("invalid encryption method %q, available methods: %s", method, strings.Join(encrypt.Methods(), ", "))
+				}
+				if !withISO {
+					return fmt.Errorf("encrypt is only supported for iso artifacts")
+				}
+				key, _ := cmd.Flags().GetString("encrypt-key")
+				if key == "" {
+					return fmt.Errorf("encrypt requires an encrypt-key")
+				}
+				if err := secret.Check(key); err != nil {
+					return err
+				}
+				if withZsync {
+					return fmt.Errorf("zsync can't be used with encrypted artifacts")
+				}
+			}
+
+			if outputDir, _ := cmd.Flags().GetString("output-dir"); outputDir == utils.Stdout {
+				if len(artifacts) != 1 || !slices.Contains([]string{string(constants.IsoOutput), string(constants.ContainerOutput)}, artifacts[0]) {
+					return fmt.Errorf("only a single iso or container artifact can be written to stdout")
+				}
+				options := map[string]bool{}
+				for _, flag := range []string{"zsync", "torrent", "push", "all-platforms"} {
+					options[flag], _ = cmd.Flags().GetBool(flag)
+				}
+				uri, _ := cmd.Flags().GetString("upload")
+				options["upload"] = uri != ""
+				if err := checkStdoutArtifact(options); err != nil {
+					return err
+				}
+			}
+
+			if args[0] == image.Stdin {
+				// The archive is only on disk for the build, external tools can't read it
+				for _, flag := range []string{"all-platforms", "vuln-scan", "verify-source-policy", "locked"} {
+					if cmd.Flags().Changed(flag) {
+						return fmt.Errorf("%s can't be used when reading the source image from stdin", flag)
+					}
+				}
+			}
+
+			if profiles, _ := cmd.Flags().GetStringSlice("prune"); len(profiles) > 0 {
+				if _, err := utils.GetPruneRules(profiles); err != nil {
+					return err
+				}
+			}
+
+			if spec, _ := cmd.Flags().GetString("scan"); spec != "" {
+				if _, err := scan.New(spec); err != nil {
+					return err
+				}
+			}
+			if policy, _ := cmd.Flags().GetString("scan-policy"); !slices.Contains(scan.Policies(), policy) {
+				return fmt.Errorf("invalid scan-policy %q, available policies: %s", policy, strings.Join(scan.Policies(), ", "))
+			}
+
+			checks, _ := cmd.Flags().GetStringSlice("audit")
+			if err := audit.ValidateChecks(checks); err != nil {
+				return err
+			}
+			if failOn, _ := cmd.Flags().GetString("audit-fail-on"); failOn != "" {
+				if _, err := audit.ParseSeverity(failOn); err != nil {
+					return fmt.Errorf("invalid audit-fail-on: %w", err)
+				}
+			}
+			if len(checks) == 0 {
+				for _, flag := range []string{"audit-fail-on", "audit-report"} {
+					if value, _ := cmd.Flags().GetString(flag); value != "" {
+						return fmt.Errorf("%s requires audit checks to run", flag)
+					}
+				}
+			}
+
+			vulnScanner, _ := cmd.Flags().GetString("vuln-scan")
+			if vulnScanner != "" {
+				if _, err := vulnscan.New(vulnScanner, nil); err != nil {
+					return err
+				}
+			}
+			if failOn, _ := cmd.Flags().GetString("fail-on-severity"); failOn != "" {
+				if _, err := vulnscan.ParseSeverity(failOn); err != nil {
+					return fmt.Errorf("invalid fail-on-severity: %w", err)
+				}
+				if vulnScanner == "" {
+					return fmt.Errorf("fail-on-severity requires a vuln-scan scanner")
+				}
+			}
+
+			if policy, _ := cmd.Flags().GetString("verify-source-policy"); policy != "" {
+				if _, err := trust.Load(vfs.OSFS, policy); err != nil {
+					return err
+				}
+			}
+
+			if maxSize, _ := cmd.Flags().GetString("max-size"); maxSize != "" {
+				if _, err := utils.ParseSize(maxSize); err != nil {
+					return fmt.Errorf("invalid max-size: %w", err)
+				}
+			}
+
+			emitRequests, _ := cmd.Flags().GetString("emit-sign-requests")
+			applySignatures, _ := cmd.Flags().GetString("apply-signatures")
+			signerURL, _ := cmd.Flags().GetString("signer")
+			if signerURL != "" {
+				if err := signer.Check(signerURL); err != nil {
+					return err
+				}
+				for _, flag := range []string{"signer-cert", "signer-key"} {
+					value, _ := cmd.Flags().GetString(flag)
+					if value == "" {
+						return fmt.Errorf("signer requires a signer-cert and signer-key client certificate")
+					}
+					if err := secret.Check(value); err != nil {
+						return fmt.Errorf("invalid %s: %w", flag, err)
+					}
+				}
+			}
+			if emitRequests != "" || applySignatures != "" {
+				if allPlatforms, _ := cmd.Flags().GetBool("all-platforms"); allPlatforms {
+					return fmt.Errorf("emit-sign-requests and apply-signatures can't be used with all-platforms")
+				}
+				if args[0] == image.Stdin {
+					return fmt.Errorf("emit-sign-requests and apply-signatures can't be used when reading the source image from stdin")
+				}
+			}
+			if outputDir, _ := cmd.Flags().GetString("output-dir"); emitRequests != "" && outputDir == utils.Stdout {
+				return fmt.Errorf("emit-sign-requests creates no artifact to write to stdout")
+			}
+			if applySignatures != "" {
+				if _, err := secureboot.ReadSignRequests(applySignatures); err != nil {
+					return err
+				}
+			}
+
 			keysDir, _ := cmd.Flags().GetString("keys")
-			_, err = os.Stat(keysDir)
-			if err != nil {
-				return fmt.Errorf("keys directory does not exist: %s", keysDir)
+			given := givenKeys(cmd.Flags(), "")
+			if emitRequests != "" || applySignatures != "" || signerURL != "" {
+				if err := checkDetachedKeysDir(keysDir, secureBootMode == constants.SecureBootShimMok, applySignatures != "", signerURL != "", given); err != nil {
+					return err
+				}
+				return CheckRoot()
 			}
-			// Check if the keys directory contains the required files
-			requiredFiles := []string{"db.der", "db.key", "db.auth", "KEK.der", "KEK.auth", "PK.der", "PK.auth", "tpm2-pcr-private.pem"}
-			for _, file := range requiredFiles {
-				_, err = os.Stat(filepath.Join(keysDir, file))
-				if err != nil {
-					return fmt.Errorf("keys directory does not contain required file: %s", file)
+			if secureBootMode == constants.SecureBootShimMok {
+				if err := checkMokKeysDir(keysDir, given); err != nil {
+					return err
 				}
+				return CheckRoot()
+			}
+			if err := checkKeysDir(keysDir, given); err != nil {
+				return err
 			}
 			return CheckRoot()
-		},
-		RunE: func(cmd *cobra.Command, args []string) error {
+		}),
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
 			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
 			if err != nil {
 				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				// Only the config templates fail the build, as they would end up unexpanded
+				if errors.Is(err, failure.ErrInvalidConfig) {
+					return err
+				}
 			}
 
 			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
@@ -117,45 +508,187 @@ func NewBuildUKICmd() *cobra.Command {
 				return err
 			}
 
-			imgSource, err := v1.NewSrcFromURI(args[0])
-			if err != nil {
+			var imgSource *v1.ImageSource
+			var archive *image.Archive
+			if args[0] == image.Stdin {
+				if imgSource, archive, err = stdinSource(cfg); err != nil {
+					return err
+				}
+				defer archive.Remove()
+			} else if imgSource, err = v1.NewSrcFromURI(args[0]); err != nil {
 				cfg.Logger.Errorf("not a valid rootfs source image argument: %s", args[0])
-				return err
+				return failure.New(failure.ErrInvalidConfig, err, "")
 			}
 
 			flags := cmd.Flags()
 			outputDir, _ := flags.GetString("output-dir")
 			keysDir, _ := flags.GetString("keys")
-			outputType, _ := flags.GetString("output-type")
-			a := action.NewBuildUKIAction(cfg, imgSource, outputDir, keysDir, outputType)
-			err = a.Run()
+			outputTypes, _ := flags.GetStringSlice("output-type")
+			// Tools run from the rootfs dir, relative paths can't depend on the working dir
+			if outputDir != utils.Stdout {
+				if outputDir, err = filepath.Abs(outputDir); err != nil {
+					return err
+				}
+			}
+			if keysDir, err = filepath.Abs(keysDir); err != nil {
+				return err
+			}
+			for _, flag := range []string{"emit-sign-requests", "apply-signatures"} {
+				if dir := viper.GetString(flag); dir != "" {
+					if dir, err = filepath.Abs(dir); err != nil {
+						return err
+					}
+					viper.Set(flag, dir)
+				}
+			}
+			keysDir, removeKeys, err := withGivenKeys(keysDir, givenKeys(flags, ""))
+			if err != nil {
+				return err
+			}
+			defer removeKeys()
+			// The archive read from stdin is not in any registry to pin it from
+			var sources []*v1.ImageSource
+			if archive == nil {
+				sources = append(sources, imgSource)
+			}
+			if err := applyLockfile(cfg, flags, lockedFiles(cfg.Fs, cfg.Arch), &sources); err != nil {
+				return err
+			}
+			if archive == nil {
+				imgSource = sources[0]
+			}
+			if imgSource, err = applySourceDigest(cfg, flags, imgSource, archive); err != nil {
+				return err
+			}
+			if viper.GetBool("all-platforms") {
+				return recordBuild(cfg, cmd.Name(), imgSource.String(), outputDir, func() error {
+					return buildUKIPlatforms(cfg, flags, imgSource, outputDir, keysDir, outputTypes)
+				})
+			}
+			if imgSource.IsDocker() && archive == nil {
+				if platforms, err := utils.ImagePlatforms(imgSource.Value()); err == nil && len(platforms) > 1 {
+					cfg.Logger.Infof("%s is a multi-arch image, building it for %s only. Use --all-platforms to build it for every platform", imgSource.Value(), cfg.Platform.String())
+				}
+			}
+			if viper.GetBool("build-info") {
+				cfg.BuildInfo = buildinfo.New(cfg.Runner, flags, viper.GetString("config-dir"))
+				addBuildSources(cfg, archive, imgSource)
+			}
+			err = recordBuild(cfg, cmd.Name(), imgSource.String(), outputDir, func() error {
+				return action.NewBuildUKIAction(cfg, imgSource, outputDir, keysDir, outputTypes).Run()
+			})
 			if err != nil {
 				cfg.Logger.Errorf(err.Error())
 				return err
 			}
 
 			return nil
-		},
+		}),
 	}
 
-	c.Flags().StringP("output-dir", "d", ".", "Output dir for artifact")
-	c.Flags().StringP("output-type", "t", string(constants.DefaultOutput), fmt.Sprintf("Artifact output type [%s]", strings.Join(constants.OutPutTypes(), ", ")))
+	c.Flags().StringP("output-dir", "d", ".", "Output dir for artifact, or - to write a single iso or container artifact to stdout")
 	c.Flags().StringP("overlay-rootfs", "o", "", "Dir with files to be applied to the system rootfs.\nAll the files under this dir will be copied into the rootfs of the uki respecting the directory structure under the dir.")
 	c.Flags().StringP("overlay-iso", "i", "", "Dir with files to be copied to the Iso rootfs.")
-	c.Flags().StringP("boot-branding", "", "Kairos", "Boot title branding")
+	c.Flags().Bool("xbootldr", false, fmt.Sprintf("Split the esp-dir artifacts per the Boot Loader Specification: systemd-boot, its config and the keys stay in the %s dir and the UKIs and their loader entries go to the %s dir, for an XBOOTLDR partition next to a small ESP. Only for esp-dir artifacts.", constants.EspDir, constants.XbootldrDir))
+	c.Flags().String("json-result", "", "Write a machine readable JSON summary of the build, including the per stage timings, to this file")
+	c.Flags().StringSlice("prune", []string{}, fmt.Sprintf("Remove unneeded files from the rootfs using the given profiles [%s]", strings.Join(utils.PruneProfiles(), ", ")))
+	c.Flags().Bool("prune-dry-run", false, "Only report how much space the prune profiles would reclaim, without removing anything")
+	c.Flags().String("scan", "", fmt.Sprintf("Scan the rootfs for malware before packing it, with %s or a scanner command the rootfs dir is appended to, exiting with 1 and printing one line per finding like clamscan. The result is recorded in the build info", scan.ClamAV))
+	c.Flags().String("scan-policy", scan.PolicyFail, fmt.Sprintf("What to do when the scan finds anything [%s]", strings.Join(scan.Policies(), ", ")))
+	c.Flags().StringSlice("audit", []string{}, fmt.Sprintf("Audit the rootfs with the given hardening checks [%s] before packing it. Can be repeated.", strings.Join(audit.Checks(), ", ")))
+	c.Flags().String("audit-fail-on", "", fmt.Sprintf("Fail the build on audit findings of this severity or higher [%s]. The findings are only reported if not set", strings.Join(audit.Severities(), ", ")))
+	c.Flags().String("audit-report", "", "Write the audit findings as JSON to this file")
+	c.Flags().String("vuln-scan", "", fmt.Sprintf("Scan the source image for known vulnerabilities before building anything from it [%s]", strings.Join(vulnscan.Scanners(), ", ")))
+	c.Flags().String("fail-on-severity", "", fmt.Sprintf("Fail the build on vulnerabilities of this severity or higher [%s]. The high and critical ones are only reported if not set", strings.Join(vulnscan.Severities(), ", ")))
+	c.Flags().String("verify-source-policy", "", "Trust policy file the signatures of the source images are verified against with cosign or notation before building, refusing unsigned or tampered images. The SLSA provenance attestations it requires are chained into the build info. Tags are resolved to a digest once, the images are verified and built by that digest. Local dirs and files are not verified")
+	c.Flags().Bool("zsync", false, "Generate a .zsync control file next to the ISO, so clients can download only the changed blocks. Only for iso artifacts.")
+	c.Flags().String("upload", "", fmt.Sprintf("Upload the artifacts after the build, using the credentials of the aws, gcloud or az CLI [%s]", strings.Join(upload.Schemes(), ", ")))
+	c.Flags().Bool("all-platforms", false, "Build the artifacts for every platform of a multi-arch source image at the same time, each one into a subdir of the output dir named after its arch. By default only the host platform is built")
+	addBootEntryFlags(c)
+	addLockFlags(c)
+	addContainerizedFlags(c)
+	addWatchFlag(c, watchOptions{
+		inputs: []string{"overlay-rootfs", "overlay-iso", "install-config", "rootfs-hook"},
+		bound:  c.Flags(),
+		narrow: func(flags *pflag.FlagSet, changed []string) map[string][]string {
+			// The overlay-iso files only end up in the ISO, the UKI and the other artifacts stay
+			// the same
+			outputTypes, _ := flags.GetStringSlice("output-type")
+			if slices.Equal(changed, []string{"overlay-iso"}) && slices.Contains(outputTypes, string(constants.IsoOutput)) {
+				return map[string][]string{"output-type": {string(constants.IsoOutput)}}
+			}
+			return nil
+		},
+	})
+	c.Flags().String("container-image", "", "Reference of the image created with the container output type, kairos_uki:VERSION by default")
+	c.Flags().Bool("push", false, "Push the container image to the registry of container-image, using the docker login or --registry-* credentials, instead of saving it as a tarball in the output dir")
+	c.Flags().StringSlice("container-label", []string{}, "Label added to the container image as key=value, overriding the default Kairos and OCI labels. Can be repeated.")
+	c.Flags().Bool("torrent", false, "Generate a .torrent file next to the ISO and print its magnet link. Only for iso artifacts.")
+	c.Flags().StringSlice("torrent-tracker", []string{}, "Tracker announce URL added to the torrent. Can be repeated.")
+	c.Flags().StringSlice("torrent-webseed", []string{}, "HTTP mirror added as web seed to the torrent, the file name is appended to URLs ending in /. Can be repeated.")
+	c.Flags().String("encrypt", "", fmt.Sprintf("Encrypt the ISO for distribution [%s]. Decrypt it with the decrypt command. Only for iso artifacts.", strings.Join(encrypt.Methods(), ", ")))
+	c.Flags().String("encrypt-key", "", "age recipient or recipients file, or AES-256 key file, used with encrypt. Files can be given as secret references like env://NAME or vault://PATH#FIELD")
+	c.Flags().String("iso-engine", iso.EngineXorriso, fmt.Sprintf("Tool used to create the ISO [%s]. The native engine needs no external tools but can't make the ISO bootable from USB drives in BIOS mode", strings.Join(iso.Engines(), ", ")))
+	c.Flags().Bool("iso-rockridge", true, "Add Rock Ridge extensions to the ISO, with POSIX permissions, symlinks and long names")
+	c.Flags().Bool("iso-joliet", false, "Add Joliet extensions to the ISO, with long names for Windows")
+	c.Flags().Bool("iso-relocate-deep-dirs", false, "Relocate directories nested deeper than 8 levels, for firmware and installers that can't read them. Requires Rock Ridge")
+	c.Flags().String("dbx", "", "dbx update to enroll along with the keys, as an authenticated variable like the DBXUpdate.bin files of the UEFI forum. The build fails if it revokes any of the shipped binaries")
+	c.Flags().String("sbat-revocations", "", fmt.Sprintf("SBAT revocation policy, a CSV of components and their minimum generation like the shim SbatLevel, shipped in the ESP as loader/%s. The build fails if it revokes any of the shipped binaries", constants.SbatLevelFile))
+	c.Flags().String("sbat-policy", "", "SBAT level, in the format of sbat-revocations, the shipped binaries are checked against without shipping it. The build fails if systemd-boot, the UKI stub, the EFI tools or the UKIs would be rejected by firmware applying it")
+	c.Flags().String("sbat", "", "CSV of SBAT entries added to the .sbat section of the UKIs, one component,generation,vendor,package,version,url line per component, e.g. to revoke the UKIs of a distro release later on")
+	c.Flags().String("timestamp-url", "", "URL of an RFC 3161 time-stamping authority adding trusted timestamps to the signatures of systemd-boot, the EFI tools and the UKIs, so they stay valid once the db certificate expires. Requires osslsigncode")
+	c.Flags().String("emit-sign-requests", "", "Dir to write the requests of the signatures of the EFI binaries to, rather than signing them, for the db key to stay on another machine like an offline one. The build stops there, kept in the dir to finish it with apply-signatures. The requests, in its requests dir, are signed with osslsigncode sign as logged. The PCR policy is still signed with the tpm2-pcr-private.pem of the keys. Requires osslsigncode 2.6 or newer")
+	c.Flags().String("apply-signatures", "", "Dir of the sign requests of an emit-sign-requests build, with their signatures next to them, to attach them to the EFI binaries and create the artifacts. Pass the same source image and flags as the emit-sign-requests build. The db key and tpm2-pcr-private.pem are not needed. Requires osslsigncode 2.6 or newer")
+	c.Flags().String("signer", "", "https URL of a signing service signing the EFI binaries with the db key, like one run by a central security team, so the build never sees the key. The digests are sent in a single batch to its /v1/sign endpoint over mutual TLS, along with the PCR policies of the UKIs for the service to sign with the tpm2-pcr key, whose tpm2-pcr-public.pem is needed in the keys instead. Requires osslsigncode 2.6 or newer")
+	c.Flags().String("signer-cert", "", "Client certificate, in PEM, authenticating the build to the signer, as a file or a secret reference like env://NAME, file://PATH or vault://PATH#FIELD")
+	c.Flags().String("signer-key", "", "Key of the signer-cert, in PEM, as a file or a secret reference like env://NAME, file://PATH or vault://PATH#FIELD")
+	c.Flags().String("install-device", "", "Disk the installer media installs to, e.g. /dev/sda. Only for iso artifacts of the installer media-type")
+	c.Flags().Bool("install-reboot", false, "Reboot into the installed system once the installer media is done. Only for iso artifacts of the installer media-type")
+	c.Flags().String("install-config", "", fmt.Sprintf("Cloud-config embedded as %s at the root of the ISO, its install section can set the whole install spec. Only for iso artifacts of the installer media-type", autoinstall.FileName))
+	c.Flags().StringSlice("firmware-capsule", []string{}, fmt.Sprintf("LVFS firmware capsule (.cab) added to the %s dir of the ISO, and applied with fwupd on the first boot of the installed system. Only for iso artifacts of the installer media-type. Can be repeated", firmware.Dir))
+	c.Flags().Bool("firmware-reboot", false, "Reboot the installed system once the firmware capsules are scheduled on its first boot, to apply them right away. Only for iso artifacts of the installer media-type")
+	c.Flags().StringSlice("rootfs-hook", []string{}, "Script to run against the rootfs before building the uki. It runs inside a sandbox where the rootfs is / and no other host path is visible, through qemu-user-static if the rootfs is of a foreign arch. Can be repeated.")
 	c.Flags().BoolP("include-version-in-config", "", false, "Include the OS version in the .config file")
 	c.Flags().BoolP("include-cmdline-in-config", "", false, "Include the cmdline in the .config file. Only the extra values are included.")
-	c.Flags().StringSliceP("extra-cmdline", "c", []string{}, "Add extra efi files with this cmdline for the default 'norole' artifacts. This creates efi files with the default cmdline and extra efi files with the default+provided cmdline.")
-	c.Flags().StringP("extend-cmdline", "x", "", "Extend the default cmdline for the default 'norole' artifacts. This creates efi files with the default+provided cmdline.")
-	c.Flags().StringSliceP("single-efi-cmdline", "s", []string{}, "Add one extra efi file with the default+provided cmdline. The syntax is '--single-efi-cmdline \"My Entry: cmdline,options,here\"'. The boot entry name is the text under which it appears in systemd-boot menu.")
 	c.Flags().StringP("keys", "k", "", "Directory with the signing keys")
-	c.Flags().StringP("default-entry", "e", "", "Default entry selected in the boot menu.\nSupported glob wildcard patterns are \"?\", \"*\", and \"[...]\".\nIf not selected, the default entry with install-mode is selected.")
 	c.Flags().Int64P("efi-size-warn", "", 1024, "EFI file size warning threshold in megabytes. Default is 1024.")
+	c.Flags().Bool("build-info", true, fmt.Sprintf("Embed the build provenance (enki version, source digest, flags, config dir commit) into the rootfs and the %s section of the EFI files", buildinfo.UKISection))
+	c.Flags().String("max-size", "", "Fail if any generated EFI file or ISO is bigger than this size, e.g. 4GiB for FAT limited ESPs")
+	c.Flags().Int("esp-headroom", 10, "Free space left in the EFI image of the ISO, as a percentage of its contents")
+	c.Flags().String("esp-align", "1MiB", "Round the size of the EFI image of the ISO up to a multiple of this size")
+	c.Flags().String("esp-size", "", "Fixed size of the EFI image of the ISO, e.g. 100MiB. It is computed from its contents if not set")
+	c.Flags().String("esp-fat", "32", fmt.Sprintf("FAT variant of the EFI image of the ISO [%s]. Some firmwares only boot FAT32 ESPs", strings.Join(utils.FatVariants(), ", ")))
+	c.Flags().String("esp-cluster-size", "", "Cluster size of the EFI image of the ISO, e.g. 4KiB. Picked by mkfs.fat from the image size if not set")
+	c.Flags().String("esp-label", "", "Volume label of the EFI image of the ISO, up to 11 characters")
+	c.Flags().String("secureboot-mode", constants.SecureBootCustomKeys, fmt.Sprintf("How the artifacts boot with Secure Boot [%s]. custom-keys enrolls the keys with systemd-boot, shim-mok boots through the Microsoft signed shim and the db key enrolled as MOK, for machines that can't enroll custom keys", strings.Join(constants.GetSecureBootModes(), ", ")))
+	c.Flags().String("shim", "", "Path to the Microsoft signed shim shipped with the shim-mok secureboot-mode. The one of the shim package of the build host is used by default")
+	c.Flags().String("mok-manager", "", "Path to the MokManager shipped with the shim-mok secureboot-mode. The one next to shim is used by default")
 	c.Flags().String("secure-boot-enroll", "if-safe", "The value of secure-boot-enroll option of systemd-boot. Possible values: off|manual|if-safe|force. Minimum systemd version: 253. Docs: https://manpages.debian.org/experimental/systemd-boot/loader.conf.5.en.html. !! Danger: this feature might soft-brick your device if used improperly !!")
 
+	addPrivateKeyFlags(c, "", "db-key", "pcr-key")
 	c.MarkFlagRequired("keys")
+	_ = c.MarkFlagDirname("keys")
+	_ = c.MarkFlagDirname("output-dir")
+	_ = c.MarkFlagDirname("overlay-rootfs")
+	_ = c.MarkFlagDirname("overlay-iso")
+	_ = c.MarkFlagDirname("emit-sign-requests")
+	_ = c.MarkFlagDirname("apply-signatures")
+	_ = c.MarkFlagFilename("install-config", "yaml", "yml")
+	_ = c.MarkFlagFilename("firmware-capsule", "cab")
+	_ = c.RegisterFlagCompletionFunc("prune", completeValues(utils.PruneProfiles()...))
+	_ = c.RegisterFlagCompletionFunc("scan-policy", completeValues(scan.Policies()...))
+	_ = c.RegisterFlagCompletionFunc("audit", completeValues(audit.Checks()...))
+	_ = c.RegisterFlagCompletionFunc("audit-fail-on", completeValues(audit.Severities()...))
+	_ = c.RegisterFlagCompletionFunc("vuln-scan", completeValues(vulnscan.Scanners()...))
+	_ = c.RegisterFlagCompletionFunc("fail-on-severity", completeValues(vulnscan.Severities()...))
+	_ = c.RegisterFlagCompletionFunc("encrypt", completeValues(encrypt.Methods()...))
+	_ = c.RegisterFlagCompletionFunc("iso-engine", completeValues(iso.Engines()...))
+	_ = c.RegisterFlagCompletionFunc("microcode", completeValues(microcode.Modes()...))
+	_ = c.RegisterFlagCompletionFunc("esp-fat", completeValues(utils.FatVariants()...))
+	_ = c.RegisterFlagCompletionFunc("secure-boot-enroll", completeValues("off", "manual", "if-safe", "force"))
+	_ = c.RegisterFlagCompletionFunc("secureboot-mode", completeValues(constants.GetSecureBootModes()...))
 	// Mark some flags as mutually exclusive
-	c.MarkFlagsMutuallyExclusive([]string{"extra-cmdline", "extend-cmdline"}...)
+	c.MarkFlagsMutuallyExclusive("emit-sign-requests", "apply-signatures", "signer")
 	viper.BindPFlags(c.Flags())
 	return c
 }
@@ -163,3 +696,119 @@ func NewBuildUKICmd() *cobra.Command {
 func init() {
 	rootCmd.AddCommand(NewBuildUKICmd())
 }
+
+// addBootEntryFlags adds the flags telling the boot entries and the artifacts build-uki creates
+func addBootEntryFlags(c *cobra.Command) {
+	c.Flags().String("name", "", "Name of the generated files, replacing the one derived from the flavor, version and arch of the image")
+	c.Flags().Bool("date", false, "Adds the build date to the name of the generated files")
+	c.Flags().String("name-template", "", "Go template of the name of the generated files, without extension, like {{.flavor}}-{{.version}}-{{.type}}. The image values, name, arch, date and the artifact type are available")
+	c.Flags().StringSliceP("output-type", "t", []string{string(constants.DefaultOutput)}, fmt.Sprintf("Artifact output type [%s]. Can be repeated to create several artifacts from a single build and signing pass. esp-dir writes the ESP tree into the esp dir of the output dir, esp-overlay writes it into the esp-overlay dir with systemd-boot out of the fallback path, to copy into the ESP of another OS like Windows, along with the steps to add its boot entry", strings.Join(constants.OutPutTypes(), ", ")))
+	c.Flags().String("boot-entry-type", constants.BootEntryUKI, fmt.Sprintf("Kind of boot entries per the Boot Loader Specification [%s]. uki boots each entry from a signed UKI (Type #2), bls from a signed kernel and an initrd shared by all the entries, with the cmdline in the loader entry (Type #1), for ESPs too small for a UKI per entry. The initrd and cmdline of bls entries are not covered by Secure Boot nor measured", strings.Join(constants.GetBootEntryTypes(), ", ")))
+	c.Flags().StringP("boot-branding", "", "Kairos", "Boot title branding")
+	c.Flags().StringSliceP("extra-cmdline", "c", []string{}, "Add extra efi files with this cmdline for the default 'norole' artifacts. This creates efi files with the default cmdline and extra efi files with the default+provided cmdline.")
+	c.Flags().StringP("extend-cmdline", "x", "", "Extend the default cmdline for the default 'norole' artifacts. This creates efi files with the default+provided cmdline.")
+	c.Flags().StringSliceP("single-efi-cmdline", "s", []string{}, "Add one extra efi file with the default+provided cmdline. The syntax is '--single-efi-cmdline \"My Entry: cmdline,options,here\"'. The boot entry name is the text under which it appears in systemd-boot menu.")
+	c.Flags().StringP("default-entry", "e", "", "Default entry selected in the boot menu.\nSupported glob wildcard patterns are \"?\", \"*\", and \"[...]\".\nIf not selected, the default entry of the media-type is selected.")
+	c.Flags().String("microcode", microcode.Auto, fmt.Sprintf("CPU microcode of the image prepended to the initrd of the UKIs, for the kernel to load it early [%s]. auto takes the microcode of the vendors the image ships it for", strings.Join(microcode.Modes(), ", ")))
+	c.Flags().String("efi-shell", "", "Path to a UEFI shell binary to add to the ESP as an extra boot entry. It gets signed with the db key")
+	c.Flags().String("memtest", "", "Path to a memtest86+ EFI binary to add to the ESP as an extra boot entry. It gets signed with the db key")
+	c.Flags().StringArray("efi-binary", []string{}, "Extra EFI binary to add to the ESP, like vendor diagnostics or KeyTool.efi, as 'PATH[,title=TITLE][,sign=false]'. It gets a boot entry with the title if given, and is signed with the db key unless sign=false, for binaries already signed by their vendor. Can be repeated, or listed in the manifest")
+	c.Flags().String("media-type", constants.MediaLive, fmt.Sprintf("What the default entry boots [%s]. installer installs the system unattended, live boots an interactive session to install from and recovery boots the recovery system", strings.Join(constants.GetMediaTypes(), ", ")))
+	c.Flags().Bool("recovery", false, "Also build a recovery UKI, booting the same image with the recovery-cmdline")
+	c.Flags().String("recovery-cmdline", constants.UkiCmdlineRecovery, "Cmdline of the recovery UKI, and of the default entry of the recovery media-type, appended to the default cmdline")
+	c.Flags().Bool("ab-layout", false, "Lay out the ESP like an installed system, with the UKIs and loader entries for each of the ab-roles instead of the installer ones")
+	c.Flags().StringSlice("ab-roles", constants.GetArtifactRoles(), fmt.Sprintf("Roles created with ab-layout [%s]. The active one is booted by default and passive is the fallback", strings.Join(constants.GetArtifactRoles(), ", ")))
+	_ = c.RegisterFlagCompletionFunc("output-type", completeValues(constants.OutPutTypes()...))
+	_ = c.RegisterFlagCompletionFunc("media-type", completeValues(constants.GetMediaTypes()...))
+	_ = c.RegisterFlagCompletionFunc("ab-roles", completeValues(constants.GetArtifactRoles()...))
+	_ = c.RegisterFlagCompletionFunc("boot-entry-type", completeValues(constants.GetBootEntryTypes()...))
+	c.MarkFlagsMutuallyExclusive("extra-cmdline", "extend-cmdline")
+}
+
+// checkBootEntryFlags fails on the invalid values of the flags of addBootEntryFlags
+func checkBootEntryFlags(flags *pflag.FlagSet) error {
+	artifacts, _ := flags.GetStringSlice("output-type")
+	for _, artifact := range artifacts {
+		if !slices.Contains(constants.OutPutTypes(), artifact) {
+			return fmt.Errorf("invalid output type: %s", artifact)
+		}
+	}
+
+	mediaType, _ := flags.GetString("media-type")
+	if !slices.Contains(constants.GetMediaTypes(), mediaType) {
+		return fmt.Errorf("invalid media-type %q, available types: %s", mediaType, strings.Join(constants.GetMediaTypes(), ", "))
+	}
+	if recovery, _ := flags.GetBool("recovery"); recovery && mediaType == constants.MediaRecovery {
+		return fmt.Errorf("recovery can't be used with the %s media-type, its default entry already boots the recovery system", constants.MediaRecovery)
+	}
+
+	if abLayout, _ := flags.GetBool("ab-layout"); abLayout {
+		roles, _ := flags.GetStringSlice("ab-roles")
+		if !slices.Contains(roles, constants.ActiveRole) {
+			return fmt.Errorf("ab-roles must include the %s role", constants.ActiveRole)
+		}
+		for _, role := range roles {
+			if !slices.Contains(constants.GetArtifactRoles(), role) {
+				return fmt.Errorf("invalid role %q in ab-roles, available roles: %s", role, strings.Join(constants.GetArtifactRoles(), ", "))
+			}
+		}
+	}
+
+	bootEntryType, _ := flags.GetString("boot-entry-type")
+	if !slices.Contains(constants.GetBootEntryTypes(), bootEntryType) {
+		return fmt.Errorf("invalid boot-entry-type %q, available types: %s", bootEntryType, strings.Join(constants.GetBootEntryTypes(), ", "))
+	}
+	return nil
+}
+
+// buildUKIPlatforms builds the artifacts for every platform of the multi-arch source image at
+// the same time, or one after the other in low memory mode, each one into a subdir of outputDir
+// named after its arch
+func buildUKIPlatforms(cfg *types.BuildConfig, flags *pflag.FlagSet, src *v1.ImageSource, outputDir, keysDir string, outputTypes []string) error {
+	if !src.IsDocker() {
+		return failure.Errorf(failure.ErrInvalidConfig, "pass a container image as source, or build without --all-platforms", "all-platforms requires a container image source, not %s", src.String())
+	}
+	platforms, err := utils.ImagePlatforms(src.Value())
+	if err != nil {
+		return err
+	}
+	if len(platforms) == 0 {
+		return failure.Errorf(failure.ErrInvalidConfig, "build it without --all-platforms", "%s is not a multi-arch image with linux platforms enki can build", src.Value())
+	}
+
+	errs := make([]error, len(platforms))
+	var wg sync.WaitGroup
+	for i, platform := range platforms {
+		platformCfg := *cfg
+		platformCfg.Arch = platform.Arch
+		platformCfg.Platform = platform
+		if cfg.JSONResult != "" {
+			ext := filepath.Ext(cfg.JSONResult)
+			platformCfg.JSONResult = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(cfg.JSONResult, ext), platform.Arch, ext)
+		}
+		if viper.GetBool("build-info") {
+			platformCfg.BuildInfo = buildinfo.New(cfg.Runner, flags, viper.GetString("config-dir"))
+			platformCfg.BuildInfo.AddSources(cfg.Logger, platform.String(), src)
+		}
+		cfg.Logger.Infof("Building %s for %s", src.Value(), platform.String())
+		a := action.NewBuildUKIAction(&platformCfg, src, filepath.Join(outputDir, platform.Arch), keysDir, outputTypes)
+		build := func(i int, platform *v1.Platform) {
+			if err := a.Run(); err != nil {
+				cfg.Logger.Errorf("Building for %s: %s", platform.String(), err)
+				errs[i] = fmt.Errorf("%s: %w", platform.String(), err)
+			}
+		}
+		// One at a time on small machines
+		if cfg.Limits.LowMemory {
+			build(i, platform)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, platform *v1.Platform) {
+			defer wg.Done()
+			build(i, platform)
+		}(i, platform)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,379 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("BuildUKI", Label("uki", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("Errors out if the A/B layout has no active role", Label("flags"), func() {
+		_, _, err := executeCommandC(
+			rootCmd, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--ab-layout", "--ab-roles", "passive,recovery",
+		)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("ab-roles must include the active role"))
+	})
+	It("Errors out on unknown A/B roles", Label("flags"), func() {
+		_, _, err := executeCommandC(
+			rootCmd, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--ab-layout", "--ab-roles", "active,spare",
+		)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(`invalid role "spare" in ab-roles`))
+	})
+	It("Classifies invalid flags as configuration errors", Label("flags"), func() {
+		_, _, err := executeCommandC(
+			rootCmd, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--max-size", "lots",
+		)
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(failure.ExitCode(err)).To(Equal(2))
+	})
+	It("Classifies a missing keys directory as missing keys", Label("flags"), func() {
+		_, _, err := executeCommandC(
+			rootCmd, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--ab-layout=false", "--max-size", "",
+		)
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+		Expect(failure.ExitCode(err)).To(Equal(6))
+		Expect(failure.Hint(err)).To(ContainSubstring("enki genkey"))
+	})
+	Describe("output types", func() {
+		var root *cobra.Command
+		BeforeEach(func() {
+			root = NewRootCmd()
+			root.AddCommand(NewBuildUKICmd())
+			root.SetOut(buf)
+			root.SetErr(buf)
+		})
+		It("Errors out on unknown output types", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "uki", "-t", "floppy",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("invalid output type: floppy"))
+		})
+		It("Accepts iso only options if any of the output types is iso", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "uki,esp-dir", "-t", "iso", "--zsync",
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+		})
+		It("Rejects iso only options without an iso output type", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "uki", "-t", "container", "--zsync",
+			)
+			Expect(err).To(MatchError(ContainSubstring("zsync is only supported for iso artifacts")))
+		})
+		It("Rejects unknown media types", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--media-type", "floppy",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("invalid media-type \"floppy\""))
+		})
+		It("Rejects unknown secureboot modes and shim options without shim", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--secureboot-mode", "none",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("invalid secureboot-mode \"none\""))
+			_, _, err = executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--secureboot-mode", "custom-keys", "--shim", "/nonexistingpath",
+			)
+			Expect(err).To(MatchError(ContainSubstring("shim is only supported with the shim-mok secureboot-mode")))
+		})
+		It("Rejects unknown boot entry types and sbat with bls entries", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--boot-entry-type", "type3",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("invalid boot-entry-type \"type3\""))
+
+			sbat := filepath.Join(GinkgoT().TempDir(), "sbat.csv")
+			Expect(os.WriteFile(sbat, []byte("kairos,1,Kairos,kairos,1,https://kairos.io\n"), 0644)).To(Succeed())
+			_, _, err = executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--boot-entry-type", "bls", "--sbat", sbat,
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("sbat is only added to UKIs"))
+		})
+		It("Only needs the db and PCR keys with shim", Label("flags"), func() {
+			keysDir := GinkgoT().TempDir()
+			for _, file := range []string{"db.der", "db.key", "tpm2-pcr-private.pem"} {
+				Expect(os.WriteFile(filepath.Join(keysDir, file), []byte(file), 0600)).To(Succeed())
+			}
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", keysDir, "--dbx", "", "--sbat-revocations", "", "--sbat", "", "--sbat-policy", "", "--secureboot-mode", "shim-mok",
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+			Expect(err.Error()).To(ContainSubstring("db.pem"))
+		})
+		It("Takes the private keys given apart from the keys dir", Label("flags"), func() {
+			keysDir := GinkgoT().TempDir()
+			for _, file := range []string{"db.der", "db.pem"} {
+				Expect(os.WriteFile(filepath.Join(keysDir, file), []byte(file), 0600)).To(Succeed())
+			}
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", keysDir, "--dbx", "", "--sbat-revocations", "", "--sbat", "", "--sbat-policy", "", "--secureboot-mode", "shim-mok",
+				"--db-key", "vault://secret/data/enki", "--pcr-key", "env://PCR_KEY",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("vault://PATH#FIELD"))
+
+			_, _, err = executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", keysDir, "--dbx", "", "--sbat-revocations", "", "--sbat", "", "--sbat-policy", "", "--secureboot-mode", "shim-mok",
+				"--db-key", "/nonexistingpath", "--pcr-key", "env://PCR_KEY",
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+			Expect(err.Error()).To(ContainSubstring("the key given for db.key does not exist"))
+		})
+		It("Doesn't need the db key to emit sign requests", Label("flags"), func() {
+			keysDir := GinkgoT().TempDir()
+			for _, file := range []string{"db.auth", "KEK.der", "KEK.auth", "PK.der", "PK.auth", "tpm2-pcr-private.pem"} {
+				Expect(os.WriteFile(filepath.Join(keysDir, file), []byte(file), 0600)).To(Succeed())
+			}
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", keysDir, "--dbx", "", "--sbat-revocations", "", "--sbat", "", "--sbat-policy", "",
+				"--emit-sign-requests", GinkgoT().TempDir(),
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+			Expect(err.Error()).To(ContainSubstring("db.der"))
+		})
+		It("Only needs the public PCR policy key with a signer", Label("flags"), func() {
+			keysDir := GinkgoT().TempDir()
+			for _, file := range []string{"db.der", "db.auth", "KEK.der", "KEK.auth", "PK.der", "PK.auth"} {
+				Expect(os.WriteFile(filepath.Join(keysDir, file), []byte(file), 0600)).To(Succeed())
+			}
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", keysDir, "--dbx", "", "--sbat-revocations", "", "--sbat", "", "--sbat-policy", "",
+				"--signer", "https://signer.internal", "--signer-cert", "ci.pem", "--signer-key", "ci.key",
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+			Expect(err.Error()).To(ContainSubstring("tpm2-pcr-public.pem"))
+			Expect(err.Error()).ToNot(ContainSubstring("tpm2-pcr-private.pem"))
+		})
+		It("Rejects sign requests for all the platforms", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--emit-sign-requests", GinkgoT().TempDir(), "--all-platforms",
+			)
+			Expect(err).To(MatchError(ContainSubstring("can't be used with all-platforms")))
+		})
+		It("Rejects applying signatures without sign requests", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--apply-signatures", GinkgoT().TempDir(),
+			)
+			Expect(err).To(MatchError(ContainSubstring("reading the sign requests")))
+		})
+		It("Requires a client certificate with the signer", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--signer", "http://signer.internal",
+			)
+			Expect(err).To(MatchError(ContainSubstring("https URL of a signing service")))
+			_, _, err = executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--signer", "https://signer.internal", "--signer-cert", "ci.pem",
+			)
+			Expect(err).To(MatchError(ContainSubstring("signer requires a signer-cert and signer-key")))
+		})
+		It("Rejects unknown scan policies", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "clamav", "--scan-policy", "ignore",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("invalid scan-policy \"ignore\""))
+		})
+		It("Rejects unknown audit checks", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--audit", "antivirus",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("unknown audit check \"antivirus\""))
+		})
+		It("Rejects unknown audit severities", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--audit", "setuid", "--audit-fail-on", "critical",
+			)
+			Expect(err).To(MatchError(ContainSubstring("invalid audit-fail-on")))
+		})
+		It("Rejects a severity to fail on without a vulnerability scanner", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--fail-on-severity", "critical",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("fail-on-severity requires a vuln-scan scanner"))
+		})
+		It("Rejects an invalid trust policy", Label("flags"), func() {
+			policy := filepath.Join(GinkgoT().TempDir(), "policy.yaml")
+			Expect(os.WriteFile(policy, []byte("rules:\n  - images: [\"quay.io/kairos/*\"]\n"), 0644)).To(Succeed())
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--verify-source-policy", policy,
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("rule 1 must verify with either cosign or notation"))
+		})
+		It("Rejects timestamp URLs other than http and https ones", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--timestamp-url", "timestamp.example.com",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("RFC 3161 time-stamping authority"))
+		})
+		It("Rejects invalid resource limits", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--ionice", "realtime",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("invalid ionice class \"realtime\""))
+		})
+		It("Rejects unknown workdir backends", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--workdir-backend", "auto,rootfs=ramdisk",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("invalid workdir backend \"ramdisk\""))
+		})
+		It("Rejects unknown layer store links", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--layer-store", "/var/lib/enki/layers", "--layer-store-link", "symlink",
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("symlink is not included in reflink,hardlink,copy"))
+		})
+		It("Rejects building every platform of the source image read from stdin", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "-", "--keys", "/nonexistingpath", "--scan", "", "--all-platforms",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("all-platforms can't be used when reading the source image from stdin"))
+		})
+		It("Rejects watching the source image read from stdin", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "-", "--keys", "/nonexistingpath", "--scan", "", "--watch",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("watch can't be used when reading the source image from stdin"))
+		})
+		It("Writes only a single artifact to stdout", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--output-dir", "-", "-t", "iso", "-t", "container",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("only a single iso or container artifact can be written to stdout"))
+		})
+		It("Rejects the extra files of the artifact when writing it to stdout", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--scan", "", "--output-dir", "-", "-t", "iso", "--zsync", "--torrent",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("torrent, zsync can't be used when writing the artifact to stdout"))
+		})
+		It("Rejects a recovery UKI on recovery media", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--media-type", "recovery", "--recovery",
+			)
+			Expect(err).To(MatchError(ContainSubstring("recovery can't be used with the recovery media-type")))
+		})
+		It("Rejects install options without installer iso artifacts", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "iso", "--install-device", "/dev/sda",
+			)
+			Expect(err).To(MatchError(ContainSubstring("only supported for iso artifacts of the installer media-type")))
+		})
+		It("Accepts install options for installer iso artifacts", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "iso", "--media-type", "installer",
+				"--install-device", "/dev/sda", "--install-reboot",
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+		})
+		It("Rejects firmware capsules without installer iso artifacts", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "iso", "--firmware-capsule", "/bios.cab",
+			)
+			Expect(err).To(MatchError(ContainSubstring("firmware-capsule and firmware-reboot are only supported for iso artifacts")))
+		})
+		It("Splits only esp-dir artifacts for an XBOOTLDR partition", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "uki", "--xbootldr",
+			)
+			Expect(err).To(MatchError(ContainSubstring("xbootldr is only supported for esp-dir artifacts")))
+			_, _, err = executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "esp-dir", "--xbootldr",
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+		})
+		It("Rejects revocations firmware and shim can't apply", Label("flags"), func() {
+			unsigned := filepath.Join(GinkgoT().TempDir(), "dbx.esl")
+			Expect(os.WriteFile(unsigned, []byte("not signed"), 0644)).To(Succeed())
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--dbx", unsigned,
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("not an authenticated variable"))
+			_, _, err = executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--dbx", "", "--sbat-revocations", "/nonexistingpath",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		})
+		It("Rejects malformed SBAT entries and policies", Label("flags"), func() {
+			entries := filepath.Join(GinkgoT().TempDir(), "sbat.csv")
+			Expect(os.WriteFile(entries, []byte("kairos,2\n"), 0644)).To(Succeed())
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--dbx", "", "--sbat-revocations", "", "--sbat", entries,
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("should have 6 fields"))
+			_, _, err = executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--dbx", "", "--sbat-revocations", "", "--sbat", "", "--sbat-policy", entries,
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("lacks the sbat line"))
+		})
+		It("Rejects container options without a container output type", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "uki", "--container-image", "registry.local/kairos/uki:v1",
+			)
+			Expect(err).To(MatchError(failure.ErrInvalidConfig))
+			Expect(err.Error()).To(ContainSubstring("only supported for container artifacts"))
+		})
+		It("Requires a container image to push to", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "container", "--push",
+			)
+			Expect(err).To(MatchError(ContainSubstring("push requires a container-image")))
+		})
+		It("Rejects malformed container labels", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "container", "--container-label", "novalue",
+			)
+			Expect(err).To(MatchError(ContainSubstring("invalid container-label \"novalue\"")))
+		})
+		It("Rejects pushing the images of all the platforms to one reference", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "container",
+				"--container-image", "registry.example.com/kairos/uki:v1", "--push", "--all-platforms",
+			)
+			Expect(err).To(MatchError(ContainSubstring("push can't be used with all-platforms")))
+		})
+		It("Accepts pushing the container output", Label("flags"), func() {
+			_, _, err := executeCommandC(
+				root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "-t", "container", "--push",
+				"--container-image", "registry.local/kairos/uki:v1", "--container-label", "org.opencontainers.image.vendor=acme",
+			)
+			Expect(err).To(MatchError(failure.ErrMissingKeys))
+		})
+	})
+})
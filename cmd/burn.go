@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kairos-io/enki/pkg/burn"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/wizard"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewBurnCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "burn ARTIFACT DEVICE",
+		Short: "Write an ISO or disk image to a USB drive and verify it",
+		Long: "Write an ISO or disk image to a USB drive and verify it\n\n" +
+			"The artifact is checked against the checksum files next to it, if any, written to the whole\n" +
+			"DEVICE and read back to check the device holds exactly what was written. Partitions, and\n" +
+			"disks with mounted filesystems, swap or LVM and LUKS volumes on them, are refused.",
+		Args: cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return CheckRoot()
+		},
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cobraCmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cobraCmd.Flags())
+			if err != nil {
+				return err
+			}
+			yes, _ := cobraCmd.Flags().GetBool("yes")
+			verify, _ := cobraCmd.Flags().GetBool("verify")
+			return runBurn(wizard.Terminal{}, cfg.Logger, args[0], args[1], yes, verify)
+		},
+	}
+	c.Flags().BoolP("yes", "y", false, "Don't ask for confirmation before erasing the device")
+	c.Flags().Bool("verify", true, "Read the device back once written to verify it")
+	return c
+}
+
+// runBurn checks the artifact and the device, asks before erasing the device unless yes is
+// set, and writes the artifact to it
+func runBurn(p wizard.Prompter, logger v1.Logger, artifact, device string, yes, verify bool) error {
+	info, err := os.Stat(artifact)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	dev, err := burn.OpenDevice(device)
+	if err != nil {
+		return err
+	}
+	if info.Size() > dev.Size {
+		return failure.Errorf(failure.ErrInvalidConfig, "", "%s needs %s but %s only has %s",
+			artifact, utils.FormatSize(info.Size()), device, utils.FormatSize(dev.Size))
+	}
+	checked, err := burn.CheckArtifact(artifact)
+	if err != nil {
+		return err
+	}
+	if len(checked) == 0 {
+		logger.Warnf("No checksum file next to %s, it can't be checked before writing it", artifact)
+	}
+	for _, algorithm := range checked {
+		logger.Infof("%s matches its %s checksum", artifact, algorithm)
+	}
+
+	if !dev.Removable {
+		logger.Warnf("%s is not a removable disk", dev.Path)
+	}
+	if !yes {
+		ok, err := p.Confirm(fmt.Sprintf("Erase everything on %s (%s) to write %s?", dev.Path, utils.FormatSize(dev.Size), artifact), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+
+	logger.Infof("Writing %s to %s", artifact, dev.Path)
+	checksum, err := burn.Write(artifact, dev.Path, utils.LogProgress(logger, "Writing"))
+	if err != nil {
+		return err
+	}
+	if !verify {
+		logger.Infof("Wrote %s to %s", artifact, dev.Path)
+		return nil
+	}
+	logger.Infof("Verifying %s", dev.Path)
+	if err = burn.Verify(dev.Path, info.Size(), checksum, utils.LogProgress(logger, "Verifying")); err != nil {
+		return err
+	}
+	logger.Infof("Wrote and verified %s on %s, it can be removed", artifact, dev.Path)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(NewBurnCmd())
+}
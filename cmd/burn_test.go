@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Burn", Label("burn", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	It("Refuses to write to anything but a block device", Label("flags"), func() {
+		dir := GinkgoT().TempDir()
+		artifact, device := filepath.Join(dir, "kairos.iso"), filepath.Join(dir, "disk.img")
+		Expect(os.WriteFile(artifact, []byte("iso"), 0644)).To(Succeed())
+		Expect(os.WriteFile(device, make([]byte, 1024), 0644)).To(Succeed())
+		_, _, err := executeCommandC(rootCmd, "burn", artifact, device, "--yes")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("is not a block device"))
+		Expect(os.ReadFile(device)).To(Equal(make([]byte, 1024)))
+	})
+	It("Requires the artifact and the device", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "burn", "kairos.iso")
+		Expect(err).To(MatchError(ContainSubstring("accepts 2 arg(s)")))
+	})
+})
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/enki/internal/version"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+// completionShells are the shells enki can generate completion scripts for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+func NewCompletionCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   fmt.Sprintf("completion [%s]", strings.Join(completionShells, "|")),
+		Short: "Generate the shell completion script",
+		Long: "Generate the shell completion script, with the descriptions of the flags and their values\n\n" +
+			"Load it in the current shell with:\n" +
+			"    bash: source <(enki completion bash)\n" +
+			"    zsh:  source <(enki completion zsh)\n" +
+			"    fish: enki completion fish | source",
+		Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs:             completionShells,
+		DisableFlagsInUseLine: true,
+		Annotations:           map[string]string{skipManifestCheck: "true"},
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			out := cobraCmd.OutOrStdout()
+			root := cobraCmd.Root()
+			switch args[0] {
+			case "bash":
+				return root.GenBashCompletionV2(out, true)
+			case "zsh":
+				return root.GenZshCompletion(out)
+			case "fish":
+				return root.GenFishCompletion(out, true)
+			}
+			return nil
+		},
+	}
+	return c
+}
+
+func NewManCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "man",
+		Short: "Generate the man pages of enki and all its commands",
+		Args:  cobra.NoArgs,
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			cobraCmd.SilenceUsage = true
+			dir, _ := cobraCmd.Flags().GetString("dir")
+			if err := os.MkdirAll(dir, constants.DirPerm); err != nil {
+				return err
+			}
+			header := &doc.GenManHeader{
+				Title:   "ENKI",
+				Section: "1",
+				Source:  fmt.Sprintf("enki %s", version.VERSION),
+				Manual:  "Enki Manual",
+			}
+			root := cobraCmd.Root()
+			// The auto generated footer changes on every run, the header date honors SOURCE_DATE_EPOCH
+			root.DisableAutoGenTag = true
+			return doc.GenManTree(root, header, dir)
+		},
+	}
+	c.Flags().StringP("dir", "d", ".", "Directory to write the man pages to")
+	return c
+}
+
+// completeValues returns a flag completion function offering the given values
+func completeValues(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(NewCompletionCmd())
+	rootCmd.AddCommand(NewManCmd())
+}
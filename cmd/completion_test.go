@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Completion and man", Label("completion", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	AfterEach(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		viper.Reset()
+	})
+	for _, shell := range completionShells {
+		shell := shell
+		It("generates the "+shell+" completion script", func() {
+			_, _, err := executeCommandC(rootCmd, "completion", shell)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf.String()).To(ContainSubstring("enki"))
+		})
+	}
+	It("rejects unknown shells", func() {
+		_, _, err := executeCommandC(rootCmd, "completion", "tcsh")
+		Expect(err).To(HaveOccurred())
+	})
+	It("completes the values of enumerated flags", func() {
+		_, _, err := executeCommandC(rootCmd, "__complete", "build-iso", "--checksum-format", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.String()).To(ContainSubstring("multihash"))
+	})
+	It("generates a man page per command", func() {
+		dir, err := os.MkdirTemp("", "enki-man")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		_, _, err = executeCommandC(rootCmd, "man", "--dir", dir)
+		Expect(err).ToNot(HaveOccurred())
+		page, err := os.ReadFile(filepath.Join(dir, "enki-build-iso.1"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(page)).To(ContainSubstring("checksum-format"))
+		Expect(filepath.Join(dir, "enki.1")).To(BeARegularFile())
+		Expect(filepath.Join(dir, "enki-build-uki.1")).To(BeARegularFile())
+	})
+})
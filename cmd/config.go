@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/manifest"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// renderFormats are the formats enki config render prints the manifest in
+var renderFormats = []string{"yaml", "json"}
+
+func NewConfigCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the build manifest",
+	}
+	c.AddCommand(NewConfigRenderCmd())
+	return c
+}
+
+func NewConfigRenderCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "render",
+		Short: "Print the effective build manifest",
+		Long: "Print the effective build manifest\n\n" +
+			"Prints the manifest.yaml of the config dir merged on top of the manifests it extends, with\n" +
+			"the settings given as ENKI_ environment variables and global flags on top. Manifests extend\n" +
+			"others with an extends key, naming a manifest or a list of them relative to their own dir,\n" +
+			"so a base profile with the keys, registry and branding can be shared by small overlays.\n" +
+			"The templates of the values are left as they are, they are expanded by the builds.",
+		Args: cobra.NoArgs,
+		RunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			settings := map[string]any{}
+			dir := viper.GetString("config-dir")
+			if dir == "" {
+				dir = "."
+			}
+			loaded, err := manifest.Load(filepath.Join(dir, manifest.FileName))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return failure.New(failure.ErrInvalidConfig, err, "check the manifest and the ones it extends")
+			}
+			if loaded != nil {
+				settings = loaded
+			}
+			given, err := manifestSchema(cmd.Root()).Settings(givenSetting(cmd.Flags()))
+			if err != nil {
+				return err
+			}
+			settings = manifest.Merge(settings, given)
+
+			format, _ := cmd.Flags().GetString("format")
+			var data []byte
+			if format == "json" {
+				data, err = json.MarshalIndent(settings, "", "  ")
+				data = append(data, '\n')
+			} else {
+				data, err = yaml.Marshal(settings)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(data))
+			return nil
+		}),
+	}
+	c.Flags().Var(newEnumFlag(renderFormats, "yaml"), "format", fmt.Sprintf("Format of the manifest [%s]", strings.Join(renderFormats, ", ")))
+	_ = c.RegisterFlagCompletionFunc("format", completeValues(renderFormats...))
+	return c
+}
+
+// givenSetting looks up the settings given as flags, or else as environment variables
+func givenSetting(flags *pflag.FlagSet) manifest.Lookup {
+	return func(path string) (string, bool) {
+		if f := flags.Lookup(path); f != nil && f.Changed {
+			if s, ok := f.Value.(pflag.SliceValue); ok {
+				return strings.Join(s.GetSlice(), ","), true
+			}
+			return f.Value.String(), true
+		}
+		return os.LookupEnv(config.EnvName(path))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(NewConfigCmd())
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Config", Label("config", "cmd"), func() {
+	var root *cobra.Command
+	var dir string
+	BeforeEach(func() {
+		root = NewRootCmd()
+		root.AddCommand(NewBuildUKICmd(), NewBuildISOCmd(), NewConfigCmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+		dir = GinkgoT().TempDir()
+		Expect(os.MkdirAll(filepath.Join(dir, "profiles"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "profiles", "base.yaml"), []byte("keys: /keys\nname: base\niso:\n  label: BASE\n  checksum: [sha512]\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte("extends: profiles/base.yaml\nname: product\niso:\n  label: PRODUCT\n"), 0644)).To(Succeed())
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+
+	It("builds with the manifests the manifest extends", func() {
+		cfg, err := config.ReadConfigBuild(dir, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Name).To(Equal("product"))
+		Expect(viper.GetString("keys")).To(Equal("/keys"))
+		spec, err := config.ReadBuildISO(cfg, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(spec.Label).To(Equal("PRODUCT"))
+		Expect(spec.Checksums).To(Equal([]string{"sha512"}))
+	})
+	It("renders the effective manifest", func() {
+		_, out, err := executeCommandC(root, "--config-dir", dir, "config", "render", "--format", "json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(MatchJSON(`{"keys": "/keys", "name": "product", "iso": {"label": "PRODUCT", "checksum": ["sha512"]}}`))
+
+		setenv("ENKI_ISO_ZSYNC", "true")
+		_, out, err = executeCommandC(root, "--config-dir", dir, "--nice", "5", "config", "render", "--format", "yaml")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(MatchYAML("keys: /keys\nname: product\nnice: 5\niso:\n  label: PRODUCT\n  checksum: [sha512]\n  zsync: true\n"))
+	})
+	It("fails on unknown settings of the extended manifests", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "profiles", "base.yaml"), []byte("kyes: /keys\n"), 0644)).To(Succeed())
+		_, _, err := executeCommandC(root, "--config-dir", dir, "config", "render")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring(`unknown field "kyes"`))
+	})
+})
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/containerized"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/mirror"
+	"github.com/kairos-io/enki/pkg/network"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// containerizedFlags are the flags of the host enki only, left out of the command run in the
+// builder container. The registry credentials are resolved on the host, into the docker config
+// mounted in the container. Watching runs the whole container again on every change.
+var containerizedFlags = append([]string{"containerized", "builder-image", "registry-anonymous", "watch"}, registryFlags...)
+
+// outputFlags are the flags naming the output dir of the build commands, the only host dirs the
+// builder container can write to
+var outputFlags = []string{"output", "output-dir"}
+
+// writtenFlags are the flags naming files the build writes, which are not mounted from the host,
+// they end up on the host only within the output dir
+var writtenFlags = []string{"log-file", "logfile", "transcript", "json-result", "history-file", "emit-sign-requests"}
+
+// sourceSchemes are the source types naming a host path
+var sourceSchemes = []string{"dir", "file", "oci", "ocifile"}
+
+// addContainerizedFlags adds --containerized to c, running it again inside the builder container
+// in place of its PreRunE and RunE, which run in the container instead
+func addContainerizedFlags(c *cobra.Command) {
+	c.Flags().Bool("containerized", false, "Run the build inside a disposable builder container with every tool it needs, with docker or podman. Only the output dir is writable from the container, the files and dirs named by the arguments, flags and config are mounted read-only")
+	c.Flags().String("builder-image", containerized.DefaultImage(), "Builder image the containerized build runs in")
+	preRun, run := c.PreRunE, c.RunE
+	c.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if containerize(cmd) || preRun == nil {
+			return nil
+		}
+		return preRun(cmd, args)
+	}
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		if containerize(cmd) {
+			return runContainerized(cmd, args)
+		}
+		return run(cmd, args)
+	}
+}
+
+// containerize tells if cmd is to run in the builder container, as opposed to running in it
+// already
+func containerize(cmd *cobra.Command) bool {
+	enabled, _ := cmd.Flags().GetBool("containerized")
+	return enabled && !containerized.Inside()
+}
+
+// runContainerized runs the command again inside the builder container, failing like it did
+func runContainerized(cmd *cobra.Command, args []string) error {
+	// The command in the container reports its own errors
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+
+	// The config file is read for the inputs it names, the build reads it again in the container
+	_, _ = config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+	engine, err := containerized.Engine()
+	if err != nil {
+		return failure.New(failure.ErrMissingDependency, err, "install docker or podman to run containerized builds")
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	image, _ := cmd.Flags().GetString("builder-image")
+	image = mirror.Image(image)
+	spec := containerized.Spec{
+		Image:       image,
+		Args:        containerized.StripArgs(os.Args[1:], []string{"containerized", "registry-anonymous"}, append([]string{"builder-image"}, registryFlags...)),
+		Workdir:     cwd,
+		Env:         append(append(containerEnv(), secretEnv(containerValues(cmd, args))...), network.ProxyVariables()...),
+		Credentials: containerized.Credentials(),
+	}
+	for _, name := range outputFlags {
+		if f := cmd.Flags().Lookup(name); f != nil && f.Value.String() != "" && f.Value.String() != "-" {
+			dir, err := filepath.Abs(f.Value.String())
+			if err != nil {
+				return err
+			}
+			// Created beforehand so it is owned by the user rather than by the container engine
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			spec.Outputs = append(spec.Outputs, dir)
+		}
+	}
+	spec.Inputs = containerInputs(cmd, args)
+
+	c := exec.Command(engine, spec.EngineArgs()...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = c.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if kind := failure.Kind(exitErr.ExitCode()); kind != nil {
+			return failure.New(kind, err, "")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("running the builder container %s: %w", image, err)
+	}
+	return nil
+}
+
+// containerEnv returns the environment variables configuring enki, but the ones of the host enki
+// only
+func containerEnv() []string {
+	skip := map[string]bool{}
+	for _, name := range containerizedFlags {
+		skip[config.EnvName(name)] = true
+	}
+	var env []string
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, config.EnvPrefix+"_") && !skip[name] {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+// containerValues returns the values of the arguments, flags and settings of cmd, but the ones
+// of the host enki only and the outputs
+func containerValues(cmd *cobra.Command, args []string) []string {
+	skip := func(name string) bool {
+		return slices.Contains(containerizedFlags, name) || slices.Contains(outputFlags, name) || slices.Contains(writtenFlags, name)
+	}
+	values := append([]string{}, args...)
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if skip(f.Name) {
+			return
+		}
+		if s, ok := f.Value.(pflag.SliceValue); ok {
+			values = append(values, s.GetSlice()...)
+			return
+		}
+		values = append(values, f.Value.String())
+	})
+	for _, key := range viper.AllKeys() {
+		if skip(key) {
+			continue
+		}
+		switch v := viper.Get(key).(type) {
+		case string:
+			values = append(values, v)
+		case []string:
+			values = append(values, v...)
+		case []any:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					values = append(values, s)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// containerInputs returns the existing host files and dirs named by the arguments, flags and
+// settings of cmd, the inputs the build reads
+func containerInputs(cmd *cobra.Command, args []string) []string {
+	seen := map[string]bool{}
+	var inputs []string
+	for _, value := range containerValues(cmd, args) {
+		if scheme, path, ok := strings.Cut(value, ":"); ok && slices.Contains(sourceSchemes, scheme) {
+			value = path
+		}
+		if value == "" || value == "-" {
+			continue
+		}
+		path, err := filepath.Abs(value)
+		if err != nil || path == "/" || seen[path] {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		seen[path] = true
+		inputs = append(inputs, path)
+	}
+	return inputs
+}
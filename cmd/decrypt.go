@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/encrypt"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewDecryptCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "decrypt ARTIFACT",
+		Short: "Decrypt an artifact encrypted with --encrypt",
+		Long: "Decrypt an artifact encrypted with --encrypt\n\n" +
+			"The encryption method is detected from the artifact. The key is the age identity file\n" +
+			"for age encrypted artifacts, or the AES-256 key file for aes-gcm encrypted ones.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cobraCmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cobraCmd.Flags())
+			if err != nil {
+				return err
+			}
+			artifact := args[0]
+			key, _ := cobraCmd.Flags().GetString("key")
+			output, _ := cobraCmd.Flags().GetString("output")
+			if output == "" {
+				if !strings.HasSuffix(artifact, encrypt.Extension) {
+					return failure.Errorf(failure.ErrInvalidConfig, "", "can't guess the output name of %s, set it with --output", artifact)
+				}
+				output = strings.TrimSuffix(artifact, encrypt.Extension)
+			}
+
+			in, err := os.Open(artifact)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			out, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			err = encrypt.Decrypt(key, out, in)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(output)
+				return failure.Errorf(failure.ErrVerification, "check that the key matches the one the artifact was encrypted with and that the artifact is complete", "decrypting %s: %w", artifact, err)
+			}
+			cfg.Logger.Infof("Decrypted %s to %s", artifact, output)
+			return nil
+		},
+	}
+	c.Flags().StringP("key", "k", "", "age identity file or AES-256 key file, or a secret reference to one like env://NAME, file://PATH or vault://PATH#FIELD")
+	c.Flags().StringP("output", "o", "", "Where to write the decrypted artifact, defaults to the artifact name without the .enc extension")
+	_ = c.MarkFlagRequired("key")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewDecryptCmd())
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewDepsCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "deps",
+		Short: "Manage the external tools enki runs",
+	}
+	c.AddCommand(NewDepsInstallCmd())
+	return c
+}
+
+func NewDepsInstallCmd() *cobra.Command {
+	var names []string
+	for _, d := range deps.All() {
+		names = append(names, d.Name)
+	}
+	c := &cobra.Command{
+		Use:   "install [TOOL...]",
+		Short: "Install the missing external tools",
+		Long: "Install the missing external tools\n\n" +
+			"Installs the given tools, or the ones every build needs, that are not in the PATH yet. They\n" +
+			"are installed with the package manager of the distro, told by /etc/os-release, on Debian,\n" +
+			"Ubuntu, Fedora, RHEL and their derivatives, openSUSE, Arch and Alpine. The tools distros\n" +
+			"don't package, like cosign or trivy, are downloaded as static builds checked against the\n" +
+			"sha256 pinned in enki into the toolcache, which comes first in the PATH of enki. The ones\n" +
+			"with no sha256 pinned for the arch of the host are to be installed by hand.\n\n" +
+			"Tools: " + strings.Join(names, ", "),
+		ValidArgs: names,
+		PreRunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			for _, arg := range args {
+				if _, ok := deps.Lookup(arg); !ok {
+					return fmt.Errorf("unknown tool %q, available tools: %s", arg, strings.Join(names, ", "))
+				}
+			}
+			if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+				return nil
+			}
+			return CheckRoot()
+		}),
+		RunE: classified(failure.ErrMissingDependency, func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			cmd.SilenceUsage = true
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			var tools []deps.Dependency
+			for _, d := range deps.All() {
+				if slices.Contains(args, d.Name) || slices.Contains(args, d.Binary) || (len(args) == 0 && d.Required) {
+					tools = append(tools, d)
+				}
+			}
+			distro, err := deps.DetectDistro(cfg.Fs)
+			if err != nil {
+				cfg.Logger.Warnf("Could not detect the distro, only static builds can be installed: %s", err)
+			} else if distro.Manager == "" {
+				cfg.Logger.Warnf("The %s distro is not supported, only static builds can be installed", distro.ID)
+			}
+			toolcache := viper.GetString("toolcache")
+
+			var packages []string
+			var static, manual []deps.Dependency
+			for _, d := range tools {
+				if _, err := exec.LookPath(d.Binary); err == nil {
+					continue
+				}
+				switch pkg := d.Packages[distro.Manager]; {
+				case pkg != "":
+					if !slices.Contains(packages, pkg) {
+						packages = append(packages, pkg)
+					}
+				case d.Static.Pinned() && toolcache != "":
+					static = append(static, d)
+				default:
+					manual = append(manual, d)
+				}
+			}
+			if len(packages)+len(static)+len(manual) == 0 {
+				cfg.Logger.Infof("Every tool is installed")
+				return nil
+			}
+
+			for _, args := range deps.InstallCommands(distro.Manager, packages) {
+				cfg.Logger.Infof("Running %s", strings.Join(args, " "))
+				if dryRun {
+					continue
+				}
+				if out, err := cfg.Runner.Run(args[0], args[1:]...); err != nil {
+					return failure.Errorf(failure.ErrMissingDependency, "check the package sources of the distro", "running %s: %w\n%s", args[0], err, string(out))
+				}
+			}
+			for _, d := range static {
+				cfg.Logger.Infof("Installing %s %s into %s from %s", d.Name, d.Static.Version, toolcache, d.Static.AssetURL())
+				if dryRun {
+					continue
+				}
+				if err := d.Static.Install(toolcache, filepath.Base(d.Binary)); err != nil {
+					return failure.New(failure.ErrMissingDependency, fmt.Errorf("installing %s: %w", d.Name, err), "check the network access to the release downloads, or "+deps.Hint(d.Binary))
+				}
+			}
+			if len(manual) > 0 {
+				var hints []string
+				for _, d := range manual {
+					hints = append(hints, fmt.Sprintf("%s: install %s", d.Name, d.Install))
+				}
+				return failure.Errorf(failure.ErrMissingDependency, strings.Join(hints, "; "), "can't install %d of the tools on this host", len(manual))
+			}
+			return nil
+		}),
+	}
+	c.Flags().Bool("dry-run", false, "Only print what would be installed")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewDepsCmd())
+}
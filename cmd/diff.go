@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewDiffCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "diff OLD NEW",
+		Short: "Report what changed between two artifacts",
+		Long: "Report what changed between two artifacts\n\n" +
+			"Compares two ISOs, squashfs or FAT images, EFI binaries like UKIs, or ESP dirs like the uki and\n" +
+			"esp-dir outputs, unpacked like enki extract does: the files added, removed or changed in the ISO,\n" +
+			"in its ESP and in its rootfs squashfs, the sections, cmdlines and signing certificates of the EFI\n" +
+			"binaries and the size of the artifacts. Useful to review a release or to find out what changed\n" +
+			"since the last build.",
+		Args: cobra.ExactArgs(2),
+		RunE: classified(failure.ErrVerification, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			diff, err := action.NewDiffAction(cfg).Run(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			logDiff(cfg.Logger, diff)
+			if jsonResult, _ := cmd.Flags().GetString("json-result"); jsonResult != "" {
+				data, err := json.MarshalIndent(diff, "", "  ")
+				if err != nil {
+					return err
+				}
+				if err = os.WriteFile(jsonResult, append(data, '\n'), 0644); err != nil {
+					return err
+				}
+			}
+			if failOnChange, _ := cmd.Flags().GetBool("fail-on-change"); failOnChange && diff.Changed() {
+				return failure.Errorf(failure.ErrVerification, "", "%s and %s differ", args[0], args[1])
+			}
+			return nil
+		}),
+	}
+	c.Flags().String("json-result", "", "Write the changes as JSON to this file")
+	c.Flags().Bool("fail-on-change", false, "Fail if the artifacts differ, like to check that a build is reproducible")
+	return c
+}
+
+// logDiff prints the size of the artifacts and the changes between them as tables
+func logDiff(logger v1.Logger, diff action.Diff) {
+	logger.Infof("%s: %s", diff.Old, utils.FormatSize(diff.OldSize))
+	logger.Infof("%s: %s (%s)", diff.New, utils.FormatSize(diff.NewSize), sizeDelta(diff.NewSize-diff.OldSize))
+	if !diff.Changed() {
+		logger.Info("No changes")
+		return
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	if len(diff.Files) > 0 {
+		fmt.Fprintln(w, "CHANGE\tPATH\tSIZE")
+		for _, f := range diff.Files {
+			var size string
+			switch f.Change {
+			case action.ChangeAdded:
+				size = utils.FormatSize(f.NewSize)
+			case action.ChangeRemoved:
+				size = utils.FormatSize(f.OldSize)
+			default:
+				size = fmt.Sprintf("%s -> %s (%s)", utils.FormatSize(f.OldSize), utils.FormatSize(f.NewSize), sizeDelta(f.NewSize-f.OldSize))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", f.Change, f.Path, size)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, changes := range []struct {
+		title   string
+		changes []action.ValueChange
+	}{{"CMDLINE", diff.Cmdline}, {"SIGNED BY", diff.Signatures}} {
+		if len(changes.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "PATH\tOLD %s\tNEW %s\n", changes.title, changes.title)
+		for _, c := range changes.changes {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", c.Path, orNone(c.Old), orNone(c.New))
+		}
+		fmt.Fprintln(w)
+	}
+	_ = w.Flush()
+	for _, line := range bytes.Split(bytes.TrimRight(buf.Bytes(), "\n"), []byte("\n")) {
+		logger.Info(string(line))
+	}
+}
+
+// sizeDelta returns the size difference with its sign
+func sizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + utils.FormatSize(-delta)
+	}
+	return "+" + utils.FormatSize(delta)
+}
+
+// orNone returns the value on a single line, or - if empty
+func orNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(value, "\n", "; ")
+}
+
+func init() {
+	rootCmd.AddCommand(NewDiffCmd())
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Diff", Label("diff", "cmd"), func() {
+	var buf *bytes.Buffer
+	var root = NewRootCmd()
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+		root = NewRootCmd()
+		root.AddCommand(NewDiffCmd())
+	})
+	It("Requires two artifacts", Label("flags"), func() {
+		_, _, err := executeCommandC(root, "diff", "old.iso")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("accepts 2 arg(s), received 1"))
+	})
+	It("Fails on changes with fail-on-change", Label("flags"), func() {
+		dir := GinkgoT().TempDir()
+		for name, content := range map[string]string{"old": "timeout 5\n", "new": "timeout 10\n"} {
+			Expect(os.MkdirAll(filepath.Join(dir, name, "loader"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, name, "loader", "loader.conf"), []byte(content), 0644)).To(Succeed())
+		}
+		result := filepath.Join(dir, "diff.json")
+		_, _, err := executeCommandC(root, "diff", filepath.Join(dir, "old"), filepath.Join(dir, "new"), "--fail-on-change", "--json-result", result)
+		Expect(err).To(MatchError(failure.ErrVerification))
+		Expect(os.ReadFile(result)).To(ContainSubstring(`"path": "esp:/loader/loader.conf"`))
+	})
+})
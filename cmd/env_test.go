@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// setenv sets an environment variable for the rest of the spec
+func setenv(key, value string) {
+	Expect(os.Setenv(key, value)).To(Succeed())
+	DeferCleanup(os.Unsetenv, key)
+}
+
+var _ = Describe("Environment", Label("env", "cmd"), func() {
+	var root *cobra.Command
+	BeforeEach(func() {
+		// A fresh tree, flags set by other specs would take precedence over the env
+		root = NewRootCmd()
+		root.AddCommand(NewBuildUKICmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("sets required flags from the environment", func() {
+		setenv("ENKI_KEYS", "/keys-from-env")
+		_, _, err := executeCommandC(root, "build-uki", "some/image:latest")
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+		Expect(err.Error()).To(ContainSubstring("/keys-from-env"))
+	})
+	It("prefers the flags over the environment", func() {
+		setenv("ENKI_KEYS", "/keys-from-env")
+		_, _, err := executeCommandC(root, "build-uki", "some/image:latest", "--keys", "/keys-from-flag")
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+		Expect(err.Error()).To(ContainSubstring("/keys-from-flag"))
+	})
+	It("reports invalid values as configuration errors", func() {
+		setenv("ENKI_EFI_SIZE_WARN", "lots")
+		_, _, err := executeCommandC(root, "build-uki", "some/image:latest", "--keys", "/keys")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("ENKI_EFI_SIZE_WARN"))
+	})
+	It("sets nested manifest keys from the environment", func() {
+		dir, err := os.MkdirTemp("", "enki-env")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		manifest := "name: from-file\niso:\n  label: FROMFILE\n  checksum: [sha512]\n"
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte(manifest), 0644)).To(Succeed())
+		setenv("ENKI_ISO_LABEL", "FROMENV")
+		setenv("ENKI_ISO_CHECKSUM", "sha256,blake3")
+		setenv("ENKI_NAME", "from-env")
+
+		cfg, err := config.ReadConfigBuild(dir, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Name).To(Equal("from-env"))
+		spec, err := config.ReadBuildISO(cfg, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(spec.Label).To(Equal("FROMENV"))
+		Expect(spec.Checksums).To(Equal([]string{"sha256", "blake3"}))
+		Expect(spec.GrubEntry).ToNot(BeEmpty())
+	})
+})
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/estimate"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewEstimateCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "estimate IMAGE",
+		Short: "Estimate the size of the artifacts built from an image before building them",
+		Long: "Estimate the size of the artifacts built from an image before building them\n\n" +
+			"Extracts the image and reports the size of its rootfs, of the squashfs of build-iso with each\n" +
+			"compression, of a UKI of build-uki and of the EFI image holding it, along with the free space\n" +
+			"both commands need for their work area and artifacts, to size the CI runners and the ESPs.\n" +
+			"The compressed sizes are extrapolated from a sample of the rootfs, see --sample.\n\n" +
+			"IMAGE is given like the source image of the build commands.",
+		Example: "  enki estimate quay.io/kairos/fedora:38-core-amd64-generic-v3.0.0 --json-result estimate.json",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			if sample, _ := cmd.Flags().GetString("sample"); sample != "" {
+				if _, err := utils.ParseSize(sample); err != nil {
+					return fmt.Errorf("invalid sample: %w", err)
+				}
+			}
+			if headroom, _ := cmd.Flags().GetInt("esp-headroom"); headroom < 0 {
+				return fmt.Errorf("invalid esp-headroom %d, it can't be negative", headroom)
+			}
+			if _, err := v1.NewSrcFromURI(args[0]); err != nil {
+				return fmt.Errorf("not a valid source image %s: %w", args[0], err)
+			}
+			return nil
+		}),
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			img, _ := v1.NewSrcFromURI(args[0])
+			opts := action.EstimateOptions{}
+			if sample, _ := cmd.Flags().GetString("sample"); sample != "" {
+				opts.Sample, _ = utils.ParseSize(sample)
+			}
+			opts.EspHeadroom, _ = cmd.Flags().GetInt("esp-headroom")
+			est, err := action.NewEstimateAction(cfg, img, opts).Run()
+			if err != nil {
+				return err
+			}
+			logEstimate(cfg.Logger, est)
+			if jsonResult, _ := cmd.Flags().GetString("json-result"); jsonResult != "" {
+				data, err := json.MarshalIndent(est, "", "  ")
+				if err != nil {
+					return err
+				}
+				if err = os.WriteFile(jsonResult, append(data, '\n'), 0644); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+	c.Flags().String("sample", "256MiB", "How much of the rootfs to compress to estimate the compressed sizes, all of it if empty. Bigger samples are more accurate but slower")
+	c.Flags().Int("esp-headroom", 10, "Free space left in the EFI image, as a percentage of its contents, like the esp-headroom of the build commands")
+	c.Flags().String("json-result", "", "Write the estimate as JSON to this file")
+	return c
+}
+
+// logEstimate prints the estimated sizes as a table
+func logEstimate(logger v1.Logger, est *action.Estimate) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ARTIFACT\tSIZE")
+	fmt.Fprintf(w, "rootfs\t%s\n", utils.FormatSize(est.Rootfs))
+	fmt.Fprintf(w, "kernel\t%s\n", utils.FormatSize(est.Kernel))
+	fmt.Fprintf(w, "initrd\t%s\n", utils.FormatSize(est.Initrd))
+	for _, compression := range estimate.Compressions() {
+		fmt.Fprintf(w, "squashfs (%s)\t%s\n", compression, utils.FormatSize(est.Squashfs[compression]))
+	}
+	fmt.Fprintf(w, "uki\t%s\n", utils.FormatSize(est.UKI))
+	fmt.Fprintf(w, "esp\t%s\n", utils.FormatSize(est.ESP))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "COMMAND\tSCRATCH SPACE")
+	for _, command := range []string{"build-iso", "build-uki"} {
+		fmt.Fprintf(w, "%s\t%s\n", command, utils.FormatSize(est.Scratch[command]))
+	}
+	_ = w.Flush()
+	for _, line := range bytes.Split(bytes.TrimRight(buf.Bytes(), "\n"), []byte("\n")) {
+		logger.Info(string(line))
+	}
+	if est.Sampled < 1 {
+		logger.Infof("The compressed sizes are extrapolated from %.0f%% of the rootfs", est.Sampled*100)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(NewEstimateCmd())
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"bytes"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Estimate", Label("estimate", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	It("Refuses invalid samples", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewEstimateCmd())
+		_, _, err := executeCommandC(root, "estimate", "quay.io/kairos/core:latest", "--sample", "lots")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err).To(MatchError(ContainSubstring("invalid sample")))
+	})
+	It("Refuses negative esp headrooms", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewEstimateCmd())
+		_, _, err := executeCommandC(root, "estimate", "quay.io/kairos/core:latest", "--esp-headroom", "-1")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
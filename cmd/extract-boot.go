@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewExtractBootCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "extract-boot IMAGE",
+		Short: "Extract the kernel and initrd of an image without building an artifact",
+		Long: "Extract the kernel and initrd of an image without building an artifact\n\n" +
+			"Writes the kernel of the image to --kernel and its initrd to --initrd, for netbooting them or\n" +
+			"debugging the initrd. The default kernel is the one the builds boot, another one installed in the\n" +
+			"image is picked with --kernel-version.\n\n" +
+			"IMAGE is given like the source image of the build commands.",
+		Example: "  enki extract-boot quay.io/kairos/fedora:38-core-amd64-generic-v3.0.0 --kernel out/vmlinuz --initrd out/initrd",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			kernel, _ := cmd.Flags().GetString("kernel")
+			initrd, _ := cmd.Flags().GetString("initrd")
+			if kernel == "" && initrd == "" {
+				return fmt.Errorf("nothing to extract, pass --kernel, --initrd or both")
+			}
+			if kernel != "" && kernel == initrd {
+				return fmt.Errorf("the kernel and the initrd can't be both written to %s", kernel)
+			}
+			if _, err := v1.NewSrcFromURI(args[0]); err != nil {
+				return fmt.Errorf("not a valid source image %s: %w", args[0], err)
+			}
+			return nil
+		}),
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			img, _ := v1.NewSrcFromURI(args[0])
+			opts := action.ExtractBootOptions{}
+			opts.Kernel, _ = cmd.Flags().GetString("kernel")
+			opts.Initrd, _ = cmd.Flags().GetString("initrd")
+			opts.KernelVersion, _ = cmd.Flags().GetString("kernel-version")
+			return action.NewExtractBootAction(cfg, img, opts).Run()
+		}),
+	}
+	c.Flags().String("kernel", "", "Write the kernel to this file")
+	c.Flags().String("initrd", "", "Write the initrd to this file")
+	c.Flags().String("kernel-version", "", "Version of the kernel to extract, like 6.5.0-1-generic, the default one of the image if empty")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewExtractBootCmd())
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"bytes"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ExtractBoot", Label("extract-boot", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	It("Needs an output", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewExtractBootCmd())
+		_, _, err := executeCommandC(root, "extract-boot", "quay.io/kairos/core:latest")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err).To(MatchError(ContainSubstring("nothing to extract")))
+	})
+	It("Refuses writing the kernel and the initrd to the same file", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewExtractBootCmd())
+		_, _, err := executeCommandC(root, "extract-boot", "quay.io/kairos/core:latest", "--kernel", "out/boot", "--initrd", "out/boot")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
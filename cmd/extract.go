@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewExtractCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "extract ARTIFACT DIR",
+		Short: "Unpack an artifact into a dir to inspect or patch it",
+		Long: "Unpack an artifact into a dir to inspect or patch it\n\n" +
+			"ISOs are extracted into DIR/iso, along with the files of their ESP image into DIR/esp and the\n" +
+			"ones of their rootfs squashfs into DIR/rootfs. Squashfs and FAT images are extracted as they\n" +
+			"are, and every section of EFI binaries like UKIs, such as the kernel, initrd and cmdline, is\n" +
+			"written to a file named after it. The kind of the artifact is told from its contents.",
+		Args: cobra.ExactArgs(2),
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return action.NewExtractAction(cfg).Run(args[0], args[1])
+		}),
+	}
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewExtractCmd())
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Extract", Label("extract", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	It("Refuses artifacts of unknown kinds", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewExtractCmd())
+		dir := GinkgoT().TempDir()
+		artifact := filepath.Join(dir, "disk.raw")
+		Expect(os.WriteFile(artifact, []byte("raw"), 0644)).To(Succeed())
+		_, _, err := executeCommandC(root, "extract", artifact, filepath.Join(dir, "out"))
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
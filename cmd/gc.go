@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/history"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewGCCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "gc",
+		Short: "Prune the workdirs and temporary files left behind by interrupted builds",
+		Long: "Prune the workdirs and temporary files left behind by interrupted builds\n\n" +
+			"The builds are recorded in the build history, see --history-file, along with the workdir\n" +
+			"holding their temporary files and the dirs of their work areas in the tmpfs-dir and disk-dir.\n" +
+			"Those of the builds that are not running anymore are removed, the ones of running builds are\n" +
+			"never touched. The other temporary files of enki older than --older-than are removed too, in\n" +
+			"the temp dir, the tmpfs-dir and the disk-dir. With --max-size the oldest temporary files are\n" +
+			"removed too until the rest fit in it. Artifacts are never removed.",
+		Args: cobra.NoArgs,
+		PreRunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			if maxSize, _ := cmd.Flags().GetString("max-size"); maxSize != "" {
+				if _, err := utils.ParseSize(maxSize); err != nil {
+					return fmt.Errorf("invalid max-size: %w", err)
+				}
+			}
+			if olderThan, _ := cmd.Flags().GetDuration("older-than"); olderThan < 0 {
+				return fmt.Errorf("invalid older-than %s, it must be positive", olderThan)
+			}
+			return nil
+		}),
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cobraCmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cobraCmd.Flags())
+			if err != nil {
+				return err
+			}
+			flags := cobraCmd.Flags()
+			// The work areas on tmpfs and disk are left behind next to the other temporary files
+			opts := history.GCOptions{TempDirs: []string{os.TempDir(), viper.GetString("tmpfs-dir"), viper.GetString("disk-dir")}}
+			opts.OlderThan, _ = flags.GetDuration("older-than")
+			opts.DryRun, _ = flags.GetBool("dry-run")
+			if maxSize, _ := flags.GetString("max-size"); maxSize != "" {
+				opts.MaxSize, _ = utils.ParseSize(maxSize)
+			}
+			var db *history.DB
+			if path := viper.GetString("history-file"); path != "" {
+				db = history.Open(cfg.Fs, path)
+			} else {
+				cfg.Logger.Warnf("The build history is disabled, only the temporary files of enki are pruned")
+			}
+
+			removed, err := history.GC(cfg.Fs, db, opts)
+			if err != nil {
+				return failure.New(failure.ErrBuild, err, "check the permissions of the temp dir and the build history")
+			}
+			verb := "Removed"
+			if opts.DryRun {
+				verb = "Would remove"
+			}
+			var total int64
+			for _, l := range removed {
+				from := "age " + time.Since(l.ModTime).Round(time.Minute).String()
+				if l.Build != "" {
+					from = "interrupted build " + l.Build
+				}
+				cfg.Logger.Infof("%s %s (%s, %s)", verb, l.Path, utils.FormatSize(l.Size), from)
+				total += l.Size
+			}
+			cfg.Logger.Infof("%s %d leftovers, %s", verb, len(removed), utils.FormatSize(total))
+			return nil
+		},
+	}
+	c.Flags().Duration("older-than", 24*time.Hour, "Age of the temporary files of enki to remove, the workdirs of interrupted builds are removed whatever their age")
+	c.Flags().String("max-size", "", "Remove the oldest temporary files of enki until the rest take less than this size, like 10GiB")
+	c.Flags().Bool("dry-run", false, "Only list what would be removed")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewGCCmd())
+}
@@ -127,6 +127,15 @@ func NewGenkeyCmd() *cobra.Command {
 				l.Errorf("Error generating tpm2-pcr-private.pem: %s", string(out))
 				return err
 			}
+			// The public key is all the builds signed with a signer need
+			cmd = exec.Command(
+				"openssl", "rsa", "-in", tpmPrivate, "-pubout", "-out", filepath.Join(output, "tpm2-pcr-public.pem"),
+			)
+			out, err = cmd.CombinedOutput()
+			if err != nil {
+				l.Errorf("Error generating tpm2-pcr-public.pem: %s", string(out))
+				return err
+			}
 			return nil
 		},
 	}
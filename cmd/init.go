@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/wizard"
+	"github.com/spf13/cobra"
+	"github.com/twpayne/go-vfs"
+)
+
+func NewInitCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "init",
+		Short: "Create a build manifest interactively",
+		Long: "Create a build manifest interactively\n\n" +
+			"Walks through choosing the artifact, source image, arch, Secure Boot keys and cmdline, then\n" +
+			"writes the manifest.yaml into --dir and prints the commands building it, which can be run right away.",
+		Args: cobra.NoArgs,
+		// Writes a new manifest, whatever the one of the config dir holds
+		Annotations: map[string]string{skipManifestCheck: "true"},
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			cobraCmd.SilenceUsage = true
+			dir, _ := cobraCmd.Flags().GetString("dir")
+			run, _ := cobraCmd.Flags().GetBool("run")
+			return runInit(wizard.Terminal{}, cobraCmd, dir, run)
+		},
+	}
+	c.Flags().StringP("dir", "d", ".", "Config dir to write the manifest.yaml into")
+	c.Flags().Bool("run", false, "Run the build without asking once the manifest is written")
+	_ = c.MarkFlagDirname("dir")
+	return c
+}
+
+// runInit runs the wizard with the given prompter, writes the manifest and runs the build if
+// wanted
+func runInit(p wizard.Prompter, cobraCmd *cobra.Command, dir string, run bool) error {
+	manifest := filepath.Join(dir, wizard.ManifestName)
+	if _, err := os.Stat(manifest); err == nil {
+		overwrite, err := p.Confirm(fmt.Sprintf("%s already exists, overwrite it?", manifest), false)
+		if err != nil || !overwrite {
+			return err
+		}
+	}
+	answers, err := wizard.Ask(p)
+	if err != nil {
+		return err
+	}
+	if _, err = answers.WriteManifest(vfs.OSFS, dir); err != nil {
+		return err
+	}
+	out := cobraCmd.OutOrStdout()
+	fmt.Fprintf(out, "Wrote %s, build it with:\n", manifest)
+	cmds := answers.Commands(dir)
+	for _, args := range cmds {
+		fmt.Fprintf(out, "  enki %s\n", strings.Join(args, " "))
+	}
+	if !run {
+		if run, err = p.Confirm("Run the build now?", false); err != nil || !run {
+			return err
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for _, args := range cmds {
+		cmd := exec.Command(self, args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, out, cobraCmd.ErrOrStderr()
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("running enki %s: %w", strings.Join(args, " "), err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(NewInitCmd())
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/lock"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// lockedFileKeys are the settings of the host files pinned by the lockfile
+var lockedFileKeys = []string{"shim", "mok-manager", "efi-shell", "memtest", "dbx"}
+
+// lockedFiles returns the host files of the config and flags to pin, along with the firmware
+// capsules and the UKI stub and systemd-boot of arch found on the host
+func lockedFiles(fs v1.FS, arch string) []string {
+	var files []string
+	for _, key := range lockedFileKeys {
+		if path := viper.GetString(key); path != "" {
+			files = append(files, path)
+		}
+	}
+	efiFiles, _ := action.EfiFiles(arch)
+	for _, path := range efiFiles {
+		if exists, _ := utils.Exists(fs, path); exists {
+			files = append(files, path)
+		}
+	}
+	return append(files, viper.GetStringSlice("firmware-capsule")...)
+}
+
+// lockfilePath returns the lockfile of --lockfile, the one in the config dir by default
+func lockfilePath(flags *pflag.FlagSet) string {
+	if path, _ := flags.GetString("lockfile"); path != "" {
+		return path
+	}
+	return filepath.Join(viper.GetString("config-dir"), lock.FileName)
+}
+
+// addLockFlags adds the flags building from the inputs pinned by the lockfile
+func addLockFlags(c *cobra.Command) {
+	c.Flags().String("lockfile", "", "Lockfile pinning the digests of the source images and host files, "+lock.FileName+" in the config dir by default. It is used if it exists, see enki lock")
+	c.Flags().Bool("locked", false, "Fail unless every source image and host file is pinned by the lockfile")
+	c.Flags().String("source-digest", "", "Digest the source image is pinned to, like sha256:HEX as printed by crane digest. The build fails if its reference resolves to another digest, like a tag moved to another image. The host files, like the UKI stub and systemd-boot, are pinned by the lockfile instead")
+}
+
+// applySourceDigest pins the source image to --source-digest, if given, failing if the image
+// changed since. The archive read from stdin is checked against it instead.
+func applySourceDigest(cfg *types.BuildConfig, flags *pflag.FlagSet, src *v1.ImageSource, archive *image.Archive) (*v1.ImageSource, error) {
+	digest, _ := flags.GetString("source-digest")
+	if digest == "" {
+		return src, nil
+	}
+	if archive != nil {
+		current, err := archive.Digest()
+		if err != nil {
+			return nil, err
+		}
+		return src, lock.CheckDigest(src.Value(), current, digest)
+	}
+	return lock.PinDigest(cfg.Logger, lock.ResolveRemote, src, digest)
+}
+
+// applyLockfile pins the container image sources to the digests of the lockfile, in place, and
+// checks the host files against it. Builds without a lockfile are left as they are unless
+// --locked is set.
+func applyLockfile(cfg *types.BuildConfig, flags *pflag.FlagSet, files []string, sources ...*[]*v1.ImageSource) error {
+	path := lockfilePath(flags)
+	locked, _ := flags.GetBool("locked")
+	if !lock.Exists(cfg.Fs, path) {
+		if locked {
+			return failure.Errorf(failure.ErrVerification, "generate it with enki lock", "locked requires a lockfile, %s doesn't exist", path)
+		}
+		return nil
+	}
+	l, err := lock.Read(cfg.Fs, path)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "generate it again with enki lock")
+	}
+	for _, list := range sources {
+		for i, src := range *list {
+			if (*list)[i], err = l.Pin(cfg.Logger, src, locked); err != nil {
+				return err
+			}
+		}
+	}
+	for _, file := range files {
+		if err := l.Verify(cfg.Fs, cfg.Logger, file, locked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewLockCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "lock [SOURCE...]",
+		Short: "Pin the digests of the source images and host files of the builds in a lockfile",
+		Long: "Pin the digests of the source images and host files of the builds in a lockfile\n\n" +
+			"The given source images, the iso sources of the config file and the images already in the\n" +
+			"lockfile are pinned to the current digest of their manifest. The shim, mok-manager, efi-shell,\n" +
+			"memtest and dbx files and the firmware capsules of the config file, and the UKI stub and\n" +
+			"systemd-boot of the host for the arch of the build, are pinned to the digest of their contents.\n\n" +
+			"build-uki and build-iso use the pinned digests of the images and fail if any pinned file\n" +
+			"changed, so the config file and its lockfile build from the same inputs later on. Run lock\n" +
+			"again to update the lockfile.\n\n" +
+			"The tools run from the host, like ukify or xorriso, are not pinned. The static builds enki\n" +
+			"deps install downloads are checked against the sha256 pinned in enki instead.",
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			cmd.SilenceUsage = true
+			spec, err := config.ReadBuildISO(cfg, cmd.Flags())
+			if err != nil {
+				return err
+			}
+			var images []string
+			for _, arg := range args {
+				src, err := v1.NewSrcFromURI(arg)
+				if err != nil {
+					return failure.New(failure.ErrInvalidConfig, err, "")
+				}
+				if !src.IsDocker() {
+					return failure.Errorf(failure.ErrInvalidConfig, "", "only container images can be pinned, not %s", src.String())
+				}
+				images = append(images, src.Value())
+			}
+			for _, sources := range [][]*v1.ImageSource{spec.RootFS, spec.UEFI, spec.Image} {
+				for _, src := range sources {
+					if src.IsDocker() {
+						images = append(images, src.Value())
+					}
+				}
+			}
+
+			path := lockfilePath(cmd.Flags())
+			l, err := lock.Read(cfg.Fs, path)
+			if errors.Is(err, os.ErrNotExist) {
+				l, err = &lock.Lockfile{}, nil
+			}
+			if err != nil {
+				return failure.New(failure.ErrInvalidConfig, err, "remove it to generate it again")
+			}
+			if err := l.Update(cfg.Fs, lock.ResolveRemote, images, lockedFiles(cfg.Fs, cfg.Arch)); err != nil {
+				return err
+			}
+			if err := l.Write(cfg.Fs, path); err != nil {
+				return err
+			}
+			cfg.Logger.Infof("Pinned %d images and %d files in %s", len(l.Images), len(l.Files), path)
+			return nil
+		}),
+	}
+	c.Flags().String("lockfile", "", "Lockfile to update, "+lock.FileName+" in the config dir by default")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewLockCmd())
+}
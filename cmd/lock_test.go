@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/kairos-io/enki/pkg/constants"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Lock", Label("lock", "cmd"), func() {
+	It("Pins the UKI stub and systemd-boot of the host for the arch of the build", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			constants.UkiSystemdBootStubx86: "stub",
+			constants.UkiSystemdBootx86:     "systemd-boot",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		Expect(lockedFiles(fs, "amd64")).To(ContainElements(constants.UkiSystemdBootStubx86, constants.UkiSystemdBootx86))
+		// The files missing on the host are not pinned
+		files := lockedFiles(fs, "arm64")
+		Expect(files).ToNot(ContainElement(constants.UkiSystemdBootStubArm))
+		Expect(files).ToNot(ContainElement(constants.UkiSystemdBootx86))
+	})
+})
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/mirror"
+	"github.com/kairos-io/enki/pkg/network"
+	"github.com/kairos-io/enki/pkg/registry"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// addNetworkFlags adds the global flags telling how to reach the network, on top of the proxies
+// of the environment
+func addNetworkFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringSlice("ca-cert", []string{}, "PEM file of a CA trusted on top of the ones of the system for the pulls, pushes and downloads, like the one of a TLS intercepting proxy. The tools enki runs trust it too. Can be repeated.")
+	cmd.PersistentFlags().StringSlice("insecure-registry", []string{}, "Registry, with an optional port like registry.local:5000, reached without verifying its certificate, or over plain HTTP if it doesn't answer over HTTPS. Can be repeated.")
+	cmd.PersistentFlags().StringSlice("mirrors", []string{}, "Mirror the images and downloads are fetched from, as FROM=TO with FROM the prefix of the image references or URLs to replace with TO, like quay.io/kairos=registry.internal/kairos or https://github.com=https://artifacts.internal/github. The longest matching prefix wins. Can be repeated.")
+	for _, flag := range []string{"ca-cert", "insecure-registry", "mirrors"} {
+		_ = viper.BindPFlag(flag, cmd.PersistentFlags().Lookup(flag))
+	}
+	_ = cmd.RegisterFlagCompletionFunc("insecure-registry", cobra.NoFileCompletions)
+	_ = cmd.RegisterFlagCompletionFunc("mirrors", cobra.NoFileCompletions)
+}
+
+// restoreNetwork restores the HTTP clients configured by useNetwork
+var restoreNetwork = func() {}
+
+// useNetwork configures the HTTP clients of enki and of the tools it runs with the CAs, the
+// insecure registries and the mirrors of the global flags, until the command is done
+func useNetwork() error {
+	mirrors, err := mirror.Parse(viper.GetStringSlice("mirrors"))
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	insecure := viper.GetStringSlice("insecure-registry")
+	restore, err := network.Use(network.Config{CACerts: viper.GetStringSlice("ca-cert"), InsecureHosts: insecure})
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "give the --ca-cert as PEM files and the --insecure-registry as HOST or HOST:PORT")
+	}
+	restoreNetwork()
+	registry.UseInsecure(insecure)
+	mirror.Use(mirrors)
+	restoreNetwork = func() {
+		restore()
+		registry.UseInsecure(nil)
+		mirror.Use(nil)
+		restoreNetwork = func() {}
+	}
+	return nil
+}
+
+func init() {
+	cobra.OnFinalize(func() { restoreNetwork() })
+}
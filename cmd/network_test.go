@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/network"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Network", Label("network", "cmd"), func() {
+	var root *cobra.Command
+	BeforeEach(func() {
+		root = NewRootCmd()
+		root.AddCommand(NewVersionCmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("rejects CA files holding no certificate", func() {
+		ca := filepath.Join(GinkgoT().TempDir(), "ca.pem")
+		Expect(os.WriteFile(ca, []byte("not a certificate"), 0644)).To(Succeed())
+		_, _, err := executeCommandC(root, "--ca-cert", ca, "version")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("no PEM certificate"))
+	})
+	It("rejects malformed mirrors", func() {
+		_, _, err := executeCommandC(root, "--mirrors", "registry.internal/kairos", "version")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("invalid mirror"))
+	})
+	It("lets the tools it runs trust the CAs while running", func() {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		defer server.Close()
+		ca := filepath.Join(GinkgoT().TempDir(), "ca.pem")
+		Expect(os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)).To(Succeed())
+		setenv(network.CABundleEnv, "")
+		var bundle string
+		root.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+			bundle = os.Getenv(network.CABundleEnv)
+		}
+		_, _, err := executeCommandC(root, "--ca-cert", ca, "version")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bundle).To(HaveSuffix("ca-bundle.pem"))
+		Expect(os.Getenv(network.CABundleEnv)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// previewFormats are the formats enki preview-entries prints the entries in
+var previewFormats = []string{"table", "json", "yaml"}
+
+func NewPreviewEntriesCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "preview-entries",
+		Short: "Print the boot entries and artifacts build-uki would create",
+		Long: "Print the boot entries and artifacts build-uki would create\n\n" +
+			"Takes the boot entry and naming flags of build-uki, along with the manifest of the config dir,\n" +
+			"and prints the entries of the boot menu with their titles, cmdlines, UKIs and loader entries,\n" +
+			"the one selected by default and the artifacts of the output dir, without building anything.\n" +
+			"The source image is not pulled: its release values, used by the templates of the cmdlines,\n" +
+			"titles and names, are only the ones given with --set.",
+		Example: "  enki preview-entries --media-type installer -s \"Debug: rd.debug\" --format json",
+		Args:    cobra.NoArgs,
+		PreRunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			return checkBootEntryFlags(cmd.Flags())
+		}),
+		RunE: classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			// Bound when running only, not to take the settings over from build-uki
+			_ = viper.BindPFlags(cmd.Flags())
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			outputTypes := viper.GetStringSlice("output-type")
+			preview, err := action.NewBuildUKIAction(cfg, nil, "", "", outputTypes).Preview()
+			if err != nil {
+				return err
+			}
+			if !slices.ContainsFunc(preview.Entries, func(e action.EntryPreview) bool { return e.Default }) {
+				cfg.Logger.Warnf("No entry matches the default entry %s, systemd-boot would select the first one", preview.DefaultEntry)
+			}
+
+			out := cmd.OutOrStdout()
+			switch format, _ := cmd.Flags().GetString("format"); format {
+			case "json":
+				data, err := json.MarshalIndent(preview, "", "  ")
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(out, string(data))
+				return err
+			case "yaml":
+				data, err := yaml.Marshal(preview)
+				if err != nil {
+					return err
+				}
+				_, err = out.Write(data)
+				return err
+			}
+			printPreview(out, preview)
+			return nil
+		}),
+	}
+	addBootEntryFlags(c)
+	c.Flags().Var(newEnumFlag(previewFormats, "table"), "format", fmt.Sprintf("Format of the preview [%s]", strings.Join(previewFormats, ", ")))
+	_ = c.RegisterFlagCompletionFunc("format", completeValues(previewFormats...))
+	return c
+}
+
+// printPreview prints the entries and the artifacts of the preview as tables
+func printPreview(out io.Writer, preview *action.UKIPreview) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEFAULT\tTITLE\tCMDLINE\tEFI\tCONF")
+	for _, e := range preview.Entries {
+		def := ""
+		if e.Default {
+			def = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", def, e.Title, orNone(e.Cmdline), e.EFI, e.Conf)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "TYPE\tOUTPUT")
+	for _, o := range preview.Outputs {
+		fmt.Fprintf(w, "%s\t%s\n", o.Type, o.Path)
+	}
+	_ = w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(NewPreviewEntriesCmd())
+}
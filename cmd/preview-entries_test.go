@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("PreviewEntries", Label("preview-entries", "cmd"), func() {
+	var root *cobra.Command
+	var out *bytes.Buffer
+	var dir string
+	BeforeEach(func() {
+		out = new(bytes.Buffer)
+		root = NewRootCmd()
+		root.AddCommand(NewBuildUKICmd(), NewPreviewEntriesCmd())
+		root.SetOut(out)
+		root.SetErr(new(bytes.Buffer))
+		dir = GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte("boot-branding: \"{{.flavor}} OS\"\nname: product\n"), 0644)).To(Succeed())
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("previews the entries and artifacts of the manifest and flags", func() {
+		_, _, err := executeCommandC(root, "--config-dir", dir, "--set", "flavor=ubuntu", "preview-entries",
+			"--single-efi-cmdline", "Debug: rd.debug", "--recovery", "--output-type", "iso,esp-dir", "--format", "json")
+		Expect(err).ToNot(HaveOccurred())
+		var preview action.UKIPreview
+		Expect(json.Unmarshal(out.Bytes(), &preview)).To(Succeed())
+		Expect(preview.DefaultEntry).To(Equal("norole.conf"))
+		Expect(preview.Entries).To(HaveLen(3))
+		Expect(preview.Entries[0].Title).To(Equal("ubuntu OS"))
+		Expect(preview.Entries[0].EFI).To(Equal("EFI/kairos/norole.efi"))
+		Expect(preview.Entries[0].Default).To(BeTrue())
+		Expect(preview.Entries[1].Title).To(Equal("ubuntu OS (Debug)"))
+		Expect(preview.Entries[1].Cmdline).To(HaveSuffix(" rd.debug"))
+		Expect(preview.Entries[1].Conf).To(Equal("loader/entries/Debug.conf"))
+		Expect(preview.Entries[2].Title).To(Equal("ubuntu OS recovery"))
+		Expect(preview.Outputs).To(Equal([]action.OutputPreview{{Type: "iso", Path: "product-uki.iso"}, {Type: "esp-dir", Path: "esp"}}))
+	})
+	It("previews the extra EFI binaries of the manifest with a title", func() {
+		keyTool := filepath.Join(dir, "KeyTool.efi")
+		Expect(os.WriteFile(keyTool, []byte("efi"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "diag.efi"), []byte("efi"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte("boot-branding: Kairos\nefi-binary:\n  - "+keyTool+",title=Key Tool\n  - "+filepath.Join(dir, "diag.efi")+",sign=false\n"), 0644)).To(Succeed())
+		_, _, err := executeCommandC(root, "--config-dir", dir, "preview-entries", "--format", "json")
+		Expect(err).ToNot(HaveOccurred())
+		var preview action.UKIPreview
+		Expect(json.Unmarshal(out.Bytes(), &preview)).To(Succeed())
+		Expect(preview.Entries).To(HaveLen(2))
+		Expect(preview.Entries[1]).To(Equal(action.EntryPreview{Title: "Key Tool", EFI: "EFI/tools/KeyTool.efi", Conf: "loader/entries/KeyTool.conf"}))
+	})
+	It("fails on missing extra EFI binaries", func() {
+		_, _, err := executeCommandC(root, "--config-dir", dir, "--set", "flavor=ubuntu", "preview-entries", "--efi-binary", filepath.Join(dir, "missing.efi"))
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("missing.efi"))
+	})
+	It("fails on the templates missing release values", func() {
+		_, _, err := executeCommandC(root, "--config-dir", dir, "preview-entries")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("boot-branding"))
+	})
+	It("rejects invalid boot entry flags", Label("flags"), func() {
+		_, _, err := executeCommandC(root, "preview-entries", "--media-type", "floppy")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring(`invalid media-type "floppy"`))
+	})
+})
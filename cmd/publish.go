@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/publish"
+	"github.com/kairos-io/enki/pkg/secret"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewPublishCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "publish",
+		Short: "Publish the artifacts of a build",
+	}
+	c.AddCommand(NewPublishGitHubCmd())
+	return c
+}
+
+func NewPublishGitHubCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "github",
+		Short: "Upload the artifacts, checksums and SBOMs of a build to a GitHub release",
+		Long: "Upload the artifacts, checksums and SBOMs of a build to a GitHub release\n\n" +
+			"The release of the tag is created if missing, and assets with the same name are replaced.\n" +
+			"The token is read from --token, or from the GITHUB_TOKEN or GH_TOKEN environment variables.\n" +
+			"Give --token as a secret reference like env://NAME or vault://PATH#FIELD, a token given as is\n" +
+			"shows in the process list.",
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			repo, _ := cmd.Flags().GetString("repo")
+			if owner, name, ok := strings.Cut(repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+				return failure.Errorf(failure.ErrInvalidConfig, "", "invalid repo %q, expected org/name", repo)
+			}
+			if token, _ := cmd.Flags().GetString("token"); token != "" {
+				if err := secret.Check(token); err != nil {
+					return failure.New(failure.ErrInvalidConfig, err, secretsHint)
+				}
+			}
+			return nil
+		},
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cobraCmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cobraCmd.Flags())
+			if err != nil {
+				return err
+			}
+			flags := cobraCmd.Flags()
+			repo, _ := flags.GetString("repo")
+			tag, _ := flags.GetString("tag")
+			dir, _ := flags.GetString("dir")
+			apiURL, _ := flags.GetString("api-url")
+			draft, _ := flags.GetBool("draft")
+			prerelease, _ := flags.GetBool("prerelease")
+			token, _ := flags.GetString("token")
+			if secret.IsRef(token) {
+				resolved, err := secret.Resolve(token)
+				if err != nil {
+					return failure.New(failure.ErrInvalidConfig, err, secretsHint)
+				}
+				token = strings.TrimSpace(string(resolved))
+			}
+			for _, env := range []string{"GITHUB_TOKEN", "GH_TOKEN"} {
+				if token == "" {
+					token = os.Getenv(env)
+				}
+			}
+			if token == "" {
+				return failure.New(failure.ErrInvalidConfig, errors.New("no GitHub token"), "set --token or the GITHUB_TOKEN environment variable")
+			}
+
+			files, err := publish.Artifacts(dir)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return fmt.Errorf("no artifacts found in %s", dir)
+			}
+
+			gh := publish.GitHub{APIURL: apiURL, Token: token, Logger: cfg.Logger}
+			release, err := gh.Publish(repo, tag, files, publish.ReleaseOptions{Draft: draft, Prerelease: prerelease})
+			if err != nil {
+				return err
+			}
+			cfg.Logger.Infof("Published %d artifacts to %s", len(files), release.HTMLURL)
+			return nil
+		},
+	}
+	c.Flags().String("repo", "", "GitHub repository, as org/name")
+	c.Flags().String("tag", "", "Tag of the release, e.g. v3.0.0")
+	c.Flags().StringP("dir", "d", ".", "Directory with the build artifacts")
+	c.Flags().String("token", "", "GitHub token allowed to create releases, as a secret reference like env://NAME, file://PATH or vault://PATH#FIELD")
+	c.Flags().String("api-url", publish.DefaultGitHubAPI, "GitHub API endpoint, for GitHub Enterprise servers")
+	c.Flags().Bool("draft", false, "Create the release as a draft, if it doesn't exist")
+	c.Flags().Bool("prerelease", false, "Mark the release as a prerelease, if it doesn't exist")
+	_ = c.MarkFlagRequired("repo")
+	_ = c.MarkFlagRequired("tag")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewPublishCmd())
+}
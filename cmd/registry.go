@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/registry"
+	"github.com/kairos-io/enki/pkg/secret"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// registryFlags are the global flags telling how to authenticate to the registries. They are
+// resolved on the host into the docker config mounted in the builder container.
+var registryFlags = []string{"registry-credentials", "registry", "registry-username", "registry-password", "registry-token", "registry-credential-helper"}
+
+// addRegistryFlags adds the global flags telling how to authenticate to the registries and how
+// to retry their requests
+func addRegistryFlags(cmd *cobra.Command) {
+	refs := fmt.Sprintf("env://NAME, file://PATH or vault://PATH#FIELD with %s and %s set", secret.VaultAddrEnv, secret.VaultTokenEnv)
+	cmd.PersistentFlags().StringSlice("registry-credentials", []string{}, fmt.Sprintf("Registry credentials on top of the docker login ones, as a secret reference to a docker config.json or as HOST=REF with REF a secret reference to USER:PASSWORD. The references are like %s. Can be repeated.", refs))
+	cmd.PersistentFlags().String("registry", registry.DefaultRegistry, "Registry the --registry-username, --registry-password and --registry-token log in to")
+	cmd.PersistentFlags().String("registry-username", "", "Username to log in to the --registry with, in place of docker login")
+	cmd.PersistentFlags().String("registry-password", "", fmt.Sprintf("Password of the --registry-username, preferably as a secret reference like %s so it doesn't show in the process list", refs))
+	cmd.PersistentFlags().String("registry-token", "", fmt.Sprintf("Bearer token to log in to the --registry with, in place of a username and password, preferably as a secret reference like %s", refs))
+	cmd.PersistentFlags().StringSlice("registry-credential-helper", []string{}, fmt.Sprintf("Docker credential helper getting the credentials of a registry, as HOST=HELPER with HELPER one of %s, for the Amazon, Google and Azure registries, or the suffix of any docker-credential- binary in the PATH. Can be repeated.", strings.Join(registry.Helpers(), ", ")))
+	cmd.PersistentFlags().Bool("registry-anonymous", false, "Pull anonymously, ignoring the docker login credentials of the host")
+	cmd.PersistentFlags().Int("registry-retries", registry.DefaultRetries, "How many times the requests rate limited by the registries are retried, waiting as long as they ask or else backing off exponentially")
+	for _, flag := range append(registryFlags, "registry-anonymous", "registry-retries") {
+		_ = viper.BindPFlag(flag, cmd.PersistentFlags().Lookup(flag))
+	}
+	_ = cmd.RegisterFlagCompletionFunc("registry-credential-helper", cobra.NoFileCompletions)
+}
+
+// registryAuth returns how to authenticate to the registries, out of the global flags
+func registryAuth() registry.Auth {
+	return registry.Auth{
+		Credentials: viper.GetStringSlice("registry-credentials"),
+		Login: registry.Login{
+			Registry: viper.GetString("registry"),
+			Username: viper.GetString("registry-username"),
+			Password: viper.GetString("registry-password"),
+			Token:    viper.GetString("registry-token"),
+		},
+		Helpers:   viper.GetStringSlice("registry-credential-helper"),
+		Anonymous: viper.GetBool("registry-anonymous"),
+	}
+}
+
+// restoreRegistryConfig removes the private docker config of useRegistryAuth, if any
+var restoreRegistryConfig = func() {}
+
+// useRegistryAuth points the registry clients of enki and of the tools it runs to a private docker
+// config with the registry credentials of the global flags, on top of the ones of the host unless
+// pulling anonymously. It is removed once the command is done.
+func useRegistryAuth() error {
+	if viper.GetInt("registry-retries") < 0 {
+		return failure.Errorf(failure.ErrInvalidConfig, "", "--registry-retries can't be negative")
+	}
+	registry.UseRetries(viper.GetInt("registry-retries"))
+	auth := registryAuth()
+	if auth.Empty() {
+		return nil
+	}
+	if err := auth.Check(); err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, secretsHint)
+	}
+	if missing := auth.MissingHelpers(); len(missing) > 0 {
+		return failure.New(failure.ErrMissingDependency, errors.New(missing[0]+" not found"), deps.Hint(missing[0]))
+	}
+	dir, cleanup, err := auth.DockerConfig()
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, secretsHint)
+	}
+	restoreRegistryConfig()
+	previous, had := os.LookupEnv(secret.DockerConfigEnv)
+	_ = os.Setenv(secret.DockerConfigEnv, dir)
+	restoreRegistryConfig = func() {
+		if had {
+			_ = os.Setenv(secret.DockerConfigEnv, previous)
+		} else {
+			_ = os.Unsetenv(secret.DockerConfigEnv)
+		}
+		cleanup()
+		restoreRegistryConfig = func() {}
+	}
+	return nil
+}
+
+func init() {
+	cobra.OnFinalize(func() { restoreRegistryConfig() })
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secret"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Registry", Label("registry", "cmd"), func() {
+	var root *cobra.Command
+	BeforeEach(func() {
+		root = NewRootCmd()
+		root.AddCommand(NewVersionCmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+		setenv("HOME", GinkgoT().TempDir())
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("rejects a registry username without a password", func() {
+		_, _, err := executeCommandC(root, "--registry-username", "robot", "version")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+	It("fails on missing credential helpers", func() {
+		setenv("PATH", GinkgoT().TempDir())
+		_, _, err := executeCommandC(root, "--registry-credential-helper", "123456789012.dkr.ecr.eu-west-1.amazonaws.com=ecr", "version")
+		Expect(err).To(MatchError(failure.ErrMissingDependency))
+		Expect(failure.Hint(err)).To(ContainSubstring("enki deps install docker-credential-ecr-login"))
+	})
+	It("logs in with the credentials given in the environment", func() {
+		setenv("ENKI_REGISTRY_USERNAME", "robot")
+		setenv("ENKI_REGISTRY_PASSWORD", "env://ENKI_TEST_PASSWORD")
+		setenv("ENKI_TEST_PASSWORD", "s3cret")
+		var config []byte
+		root.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+			config, _ = os.ReadFile(filepath.Join(os.Getenv(secret.DockerConfigEnv), "config.json"))
+		}
+		_, _, err := executeCommandC(root, "version")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(config)).To(ContainSubstring(authn.DefaultAuthKey))
+	})
+})
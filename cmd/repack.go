@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewRepackCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "repack DIR ARTIFACT",
+		Short: "Build an artifact again out of a dir unpacked by enki extract",
+		Long: "Build an artifact again out of a dir unpacked by enki extract\n\n" +
+			"Packs DIR, once patched, into ARTIFACT, which must not exist yet, told which kind it is by\n" +
+			"its extension: .iso for ISOs out of DIR/iso, with DIR/esp as their ESP image and DIR/rootfs as\n" +
+			"their rootfs squashfs, .squashfs for squashfs images, .img for FAT images and .efi for UKIs\n" +
+			"built out of the files of their sections with the systemd stub of the host. With --keys the\n" +
+			"EFI binaries and the PCR policies of the UKIs are signed again, like enki resign does.",
+		Args: cobra.ExactArgs(2),
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			keysDir, _ := cmd.Flags().GetString("keys")
+			label, _ := cmd.Flags().GetString("label")
+			return action.NewRepackAction(cfg, keysDir, label).Run(args[0], args[1])
+		}),
+	}
+	c.Flags().StringP("keys", "k", "", "Directory with the keys signing the EFI binaries again. They keep their signatures if not set, which the patched ones no longer match")
+	c.Flags().String("label", "", "Label of the ISO volume. Defaults to the one the grub config looks for, or the one of the UKI ISOs")
+	_ = c.MarkFlagDirname("keys")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewRepackCmd())
+}
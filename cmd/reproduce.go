@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/lock"
+	"github.com/kairos-io/enki/pkg/manifest"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// reproducibleCommands are the builds which can be pinned by a lockfile, with the flag of their
+// outputs
+var reproducibleCommands = map[string]string{
+	"build-iso": "output",
+	"build-uki": "output-dir",
+}
+
+func NewReproduceCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "reproduce --manifest MANIFEST --expect CHECKSUMS -- COMMAND SOURCE [FLAGS]",
+		Short: "Rebuild an artifact and check it is identical to the expected one",
+		Long: "Rebuild an artifact and check it is identical to the expected one\n\n" +
+			"Runs the build command given after -- with the manifest and the lockfile pinning its sources,\n" +
+			"like a release build, and compares the artifacts bit for bit with the checksums of the release,\n" +
+			"as written next to them or by sha256sum. It fails on the first artifact that differs, reporting\n" +
+			"the first file of it that differs from the original one when --original has the released\n" +
+			"artifacts. The build must be run with the same flags and SOURCE_DATE_EPOCH as the original one,\n" +
+			"the dir of the manifest is its config dir.",
+		Example: "  enki reproduce --manifest release/manifest.yaml --expect kairos.iso.sha256 -- build-iso oci:kairos:v3 --name kairos",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("requires the build command and its source after --, got %d arg(s)", len(args))
+			}
+			if _, ok := reproducibleCommands[args[0]]; !ok {
+				return fmt.Errorf("can't reproduce %s, only %s", args[0], strings.Join(mapKeys(reproducibleCommands), " and "))
+			}
+			return nil
+		},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			build, _, err := cmd.Root().Find(args[:1])
+			if err != nil {
+				return err
+			}
+			for _, name := range []string{"config-dir", "lockfile", reproducibleCommands[args[0]]} {
+				if setsFlag(build, args[1:], name) {
+					return failure.Errorf(failure.ErrInvalidConfig, "the rebuild uses the manifest dir, the lockfile and the rebuild dir of enki reproduce", "--%s can't be given to the rebuild", name)
+				}
+			}
+			lockfile, _ := cmd.Flags().GetString("lockfile")
+			if lockfile == "" {
+				manifestPath, _ := cmd.Flags().GetString("manifest")
+				lockfile = filepath.Join(filepath.Dir(manifestPath), lock.FileName)
+			}
+			if _, err = os.Stat(lockfile); err != nil {
+				return failure.New(failure.ErrInvalidConfig, fmt.Errorf("the rebuild must be pinned by a lockfile: %w", err), "create it with enki lock along with the original build, or give it with --lockfile")
+			}
+			return cmd.Flags().Set("lockfile", lockfile)
+		},
+		RunE: classified(failure.ErrVerification, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			expect, _ := cmd.Flags().GetStringSlice("expect")
+			expected, err := action.ReadChecksums(expect...)
+			if err != nil {
+				return failure.New(failure.ErrInvalidConfig, err, "")
+			}
+
+			manifestPath, _ := cmd.Flags().GetString("manifest")
+			configDir, cleanup, err := manifestConfigDir(manifestPath)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+
+			rebuildDir, _ := cmd.Flags().GetString("rebuild-dir")
+			if rebuildDir == "" {
+				if rebuildDir, err = os.MkdirTemp("", "enki-reproduce-"); err != nil {
+					return err
+				}
+			} else if err = os.MkdirAll(rebuildDir, 0755); err != nil {
+				return err
+			}
+
+			self, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			lockfile, _ := cmd.Flags().GetString("lockfile")
+			build := append([]string{"--config-dir", configDir, args[0], "--locked", "--lockfile", lockfile, "--" + reproducibleCommands[args[0]], rebuildDir}, args[1:]...)
+			cfg.Logger.Infof("Rebuilding with enki %s", strings.Join(build, " "))
+			rebuild := exec.Command(self, build...)
+			rebuild.Stdout, rebuild.Stderr = cmd.OutOrStdout(), cmd.ErrOrStderr()
+			if err = rebuild.Run(); err != nil {
+				return failure.New(failure.ErrBuild, fmt.Errorf("rebuilding: %w", err), "")
+			}
+
+			original, _ := cmd.Flags().GetString("original")
+			divergence, err := action.NewReproduceAction(cfg).Compare(rebuildDir, original, expected)
+			if err != nil {
+				return err
+			}
+			if divergence != nil {
+				return failure.Errorf(failure.ErrVerification, "the rebuild is kept in "+rebuildDir+", compare it with enki diff", "not reproducible: %s", divergence)
+			}
+			cfg.Logger.Infof("The rebuild matches the %d expected artifacts", len(expected))
+			if !cmd.Flags().Changed("rebuild-dir") {
+				return os.RemoveAll(rebuildDir)
+			}
+			return nil
+		}),
+	}
+	c.Flags().String("manifest", "", "Manifest of the original build, its dir is the config dir of the rebuild")
+	c.Flags().StringSlice("expect", []string{}, "Checksum files of the original artifacts, with a checksum and a file name per line. The algorithm is their extension, sha256 by default")
+	c.Flags().String("lockfile", "", "Lockfile pinning the sources of the original build, "+lock.FileName+" next to the manifest by default")
+	c.Flags().String("original", "", "Dir of the original artifacts, to report the first file differing in the artifact that doesn't match")
+	c.Flags().String("rebuild-dir", "", "Dir to rebuild into, kept afterwards. A temporary dir by default, removed unless the rebuild differs")
+	_ = c.MarkFlagRequired("manifest")
+	_ = c.MarkFlagRequired("expect")
+	_ = c.MarkFlagFilename("manifest", "yaml", "yml")
+	_ = c.MarkFlagDirname("original")
+	_ = c.MarkFlagDirname("rebuild-dir")
+	return c
+}
+
+// manifestConfigDir returns the config dir building with the manifest at path, which is its dir
+// if it's named like the manifests of config dirs. Otherwise it's a dir next to it with a manifest
+// extending it, in the same git checkout so the build info records the same manifest commit.
+func manifestConfigDir(path string) (string, func(), error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", nil, failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if filepath.Base(abs) == manifest.FileName {
+		return filepath.Dir(abs), func() {}, nil
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(abs), ".enki-reproduce-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	if err = os.WriteFile(filepath.Join(dir, manifest.FileName), []byte("extends: "+filepath.Join("..", filepath.Base(abs))+"\n"), 0644); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// setsFlag tells if the args of the command set the named flag, by its name or shorthand
+func setsFlag(c *cobra.Command, args []string, name string) bool {
+	f := c.Flags().Lookup(name)
+	if f == nil {
+		f = c.InheritedFlags().Lookup(name)
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if arg == "--"+name || strings.HasPrefix(arg, "--"+name+"=") {
+			return true
+		}
+		if f != nil && f.Shorthand != "" && strings.HasPrefix(arg, "-"+f.Shorthand) && !strings.HasPrefix(arg, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+// mapKeys returns the sorted keys of the map
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func init() {
+	rootCmd.AddCommand(NewReproduceCmd())
+}
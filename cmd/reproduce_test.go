@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reproduce", Label("reproduce", "cmd"), func() {
+	var buf *bytes.Buffer
+	var root = NewRootCmd()
+	var dir string
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+		root = NewRootCmd()
+		root.AddCommand(NewReproduceCmd(), NewBuildISOCmd())
+		dir = GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "build.yaml"), []byte("name: kairos\n"), 0644)).To(Succeed())
+	})
+	It("Requires a build command with a source", Label("flags"), func() {
+		_, _, err := executeCommandC(root, "reproduce", "--manifest", filepath.Join(dir, "build.yaml"), "--expect", "SHA256SUMS", "--", "build-iso")
+		Expect(err).To(MatchError(ContainSubstring("requires the build command and its source")))
+	})
+	It("Only reproduces the builds pinned by lockfiles", Label("flags"), func() {
+		_, _, err := executeCommandC(root, "reproduce", "--manifest", filepath.Join(dir, "build.yaml"), "--expect", "SHA256SUMS", "--", "diff", "old.iso", "new.iso")
+		Expect(err).To(MatchError(ContainSubstring("can't reproduce diff, only build-iso and build-uki")))
+	})
+	It("Rejects the output of the original build", Label("flags"), func() {
+		_, _, err := executeCommandC(root, "reproduce", "--manifest", filepath.Join(dir, "build.yaml"), "--expect", "SHA256SUMS", "--", "build-iso", "oci:kairos:latest", "-o", "/build")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("--output can't be given to the rebuild"))
+	})
+	It("Requires the lockfile", Label("flags"), func() {
+		_, _, err := executeCommandC(root, "reproduce", "--manifest", filepath.Join(dir, "build.yaml"), "--expect", "SHA256SUMS", "--", "build-iso", "oci:kairos:latest")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("must be pinned by a lockfile"))
+	})
+})
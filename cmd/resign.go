@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewResignCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "resign ARTIFACT",
+		Short: "Sign already built UKI artifacts again with other keys",
+		Long: "Sign already built UKI artifacts again with other keys\n\n" +
+			"Re-signs systemd-boot, the EFI tools and the UKIs of the artifact, along with the PCR policy of\n" +
+			"the UKIs, and replaces the Secure Boot keys enrolled by systemd-boot with the new ones, without\n" +
+			"rebuilding anything from the container image. ARTIFACT is an ISO or a single EFI binary built by\n" +
+			"build-uki, or the dir of its uki or esp-dir output. The result is written to the output dir\n" +
+			"under the same name. Artifacts built with the shim-mok secureboot-mode keep the Microsoft\n" +
+			"signature of shim and MokManager, and ship the new db certificate as the MOK to enroll.\n\n" +
+			"To rotate the keys of machines already enrolled, pass the keys they were enrolled with as\n" +
+			"--previous-keys. The artifact is then signed with both keys and its UKIs unlock disks enrolled\n" +
+			"with either PCR policy key, the db it enrolls trusts both keys, and the output dir gets a\n" +
+			"db-append.auth update adding the new db certificates to the machines enrolled with the\n" +
+			"previous keys. Use enki signatures to follow which artifacts are signed with which keys.\n\n" +
+			"--sbat patches the .sbat section of the UKIs with the given entries, replacing the ones of the\n" +
+			"same components, e.g. to bump their generation after revoking older builds.",
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			keysDir, _ := cmd.Flags().GetString("keys")
+			given := givenKeys(cmd.Flags(), "")
+			if err := checkKeysDir(keysDir, given); err != nil {
+				return err
+			}
+			if sbat, _ := cmd.Flags().GetString("sbat"); sbat != "" {
+				if _, err := secureboot.ReadSbatEntries(sbat); err != nil {
+					return failure.New(failure.ErrInvalidConfig, err, "")
+				}
+			}
+			if tsa, _ := cmd.Flags().GetString("timestamp-url"); tsa != "" {
+				if err := secureboot.CheckTSA(tsa); err != nil {
+					return failure.New(failure.ErrInvalidConfig, err, "")
+				}
+			}
+			previousKeys, _ := cmd.Flags().GetString("previous-keys")
+			if previousKeys == "" {
+				return nil
+			}
+			previousGiven := givenKeys(cmd.Flags(), "previous-")
+			if err := checkGivenKeys(previousGiven); err != nil {
+				return err
+			}
+			if err := checkRotationKeys(keysDir, given); err != nil {
+				return err
+			}
+			return checkRotationKeys(previousKeys, previousGiven)
+		},
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			keysDir, _ := cmd.Flags().GetString("keys")
+			previousKeys, _ := cmd.Flags().GetString("previous-keys")
+			sbat, _ := cmd.Flags().GetString("sbat")
+			outputDir, _ := cmd.Flags().GetString("output-dir")
+			tsa, _ := cmd.Flags().GetString("timestamp-url")
+			keysDir, removeKeys, err := withGivenKeys(keysDir, givenKeys(cmd.Flags(), ""))
+			if err != nil {
+				return err
+			}
+			defer removeKeys()
+			if previousKeys != "" {
+				var removePrevious func()
+				if previousKeys, removePrevious, err = withGivenKeys(previousKeys, givenKeys(cmd.Flags(), "previous-")); err != nil {
+					return err
+				}
+				defer removePrevious()
+			}
+			return action.NewResignAction(cfg, keysDir, previousKeys, sbat, tsa, outputDir).Run(args[0])
+		}),
+	}
+	c.Flags().StringP("keys", "k", "", "Directory with the new signing keys")
+	c.Flags().String("previous-keys", "", "Directory with the keys being rotated from, to sign the artifact with both keys")
+	c.Flags().String("sbat", "", "CSV file with SBAT entries to set in the .sbat section of the UKIs")
+	c.Flags().String("timestamp-url", "", "URL of an RFC 3161 time-stamping authority adding trusted timestamps to the new signatures. Requires osslsigncode")
+	c.Flags().StringP("output-dir", "d", ".", "Output dir for the resigned artifact")
+	addPrivateKeyFlags(c, "", "db-key", "kek-key", "pcr-key")
+	addPrivateKeyFlags(c, "previous-", "db-key", "kek-key", "pcr-key")
+	addContainerizedFlags(c)
+	_ = c.MarkFlagRequired("keys")
+	_ = c.MarkFlagDirname("keys")
+	_ = c.MarkFlagDirname("previous-keys")
+	_ = c.MarkFlagDirname("output-dir")
+	return c
+}
+
+// checkRotationKeys fails if the keys dir lacks any of the files to rotate from or to its keys,
+// but the given ones
+func checkRotationKeys(keysDir string, given map[string]string) error {
+	for _, file := range secureboot.RotationFiles {
+		if _, ok := given[file]; ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(keysDir, file)); err != nil {
+			return failure.Errorf(failure.ErrMissingKeys, keysHint, "keys directory %s does not contain the file needed to rotate keys: %s", keysDir, file)
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(NewResignCmd())
+}
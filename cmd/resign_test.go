@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resign", Label("resign", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	It("Requires the new keys", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "resign", "kairos.iso", "--keys", "/nonexistingpath")
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+		Expect(failure.Hint(err)).To(ContainSubstring("enki genkey"))
+	})
+	It("Requires the keys to rotate from", Label("flags"), func() {
+		keysDir := GinkgoT().TempDir()
+		for _, file := range []string{"db.der", "db.key", "db.auth", "KEK.der", "KEK.auth", "PK.der", "PK.auth", "tpm2-pcr-private.pem"} {
+			Expect(os.WriteFile(filepath.Join(keysDir, file), nil, 0644)).To(Succeed())
+		}
+		root := NewRootCmd()
+		root.AddCommand(NewResignCmd())
+		_, _, err := executeCommandC(root, "resign", "kairos.iso", "--keys", keysDir, "--previous-keys", GinkgoT().TempDir())
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+		Expect(err.Error()).To(ContainSubstring("db.pem"))
+	})
+	It("Mounts the inputs of containerized builds read-only", Label("flags"), func() {
+		dir := GinkgoT().TempDir()
+		keysDir, artifact, outputDir := filepath.Join(dir, "keys"), filepath.Join(dir, "kairos.iso"), filepath.Join(dir, "out")
+		Expect(os.Mkdir(keysDir, 0755)).To(Succeed())
+		Expect(os.Mkdir(outputDir, 0755)).To(Succeed())
+		Expect(os.WriteFile(artifact, nil, 0644)).To(Succeed())
+		c := NewResignCmd()
+		Expect(c.ParseFlags([]string{"--keys", keysDir, "--output-dir", outputDir, "--containerized", "--sbat", filepath.Join(dir, "missing.csv")})).To(Succeed())
+		inputs := containerInputs(c, []string{artifact})
+		Expect(inputs).To(ContainElements(keysDir, artifact))
+		Expect(inputs).ToNot(ContainElement(outputDir))
+		Expect(inputs).ToNot(ContainElement(filepath.Join(dir, "missing.csv")))
+	})
+})
@@ -4,10 +4,26 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
+	"github.com/kairos-io/enki/pkg/buildinfo"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/history"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/layerstore"
+	"github.com/kairos-io/enki/pkg/limits"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/remote"
+	"github.com/kairos-io/enki/pkg/templating"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/workdir"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -17,20 +33,109 @@ func NewRootCmd() *cobra.Command {
 		Short: "enki",
 	}
 	cmd.PersistentFlags().Bool("debug", false, "Enable debug output")
+	cmd.PersistentFlags().String("log-level", "", fmt.Sprintf("Lowest level of the logs written [%s]. info by default, debug with --debug or --debug-modules", strings.Join(logging.Levels(), ", ")))
+	cmd.PersistentFlags().StringSlice("debug-modules", []string{}, fmt.Sprintf("Only write the debug logs of these modules [%s], like sign to debug the signing without the logs of the image extraction. Enables debug output", strings.Join(logging.Modules(), ", ")))
 	cmd.PersistentFlags().String("config-dir", "/etc/elemental", "Set config dir (default is /etc/elemental)")
-	cmd.PersistentFlags().String("logfile", "", "Set logfile")
+	cmd.PersistentFlags().String("log-file", "", "File the logs are appended to, along with the output. The secrets are redacted from it like from the output")
+	cmd.PersistentFlags().String("logfile", "", "Same as log-file, kept for compatibility")
+	cmd.PersistentFlags().String("transcript", "", "File every external command run is appended to as JSON lines, with its arguments, environment, duration, exit code and the end of its output, to reproduce and audit the build step by step. The commands are added to the JSON result too")
 	cmd.PersistentFlags().Bool("quiet", false, "Do not output to stdout")
+	cmd.PersistentFlags().StringSlice("set", []string{}, "Value for the Go templates of the config, cmdlines and boot titles as key=value, used as {{.key}}. The source image values like {{.flavor}} and {{.version}} and {{.arch}} are set by default. Can be repeated.")
+	cmd.PersistentFlags().Int("nice", 0, "Niceness of the heavy external tools, like mksquashfs and xorriso, from 1 to 19 so builds leave CPU time to the other processes of shared machines")
+	cmd.PersistentFlags().String("ionice", "", fmt.Sprintf("IO scheduling class of the heavy external tools [%s], best-effort takes a level from 0 to 7 like best-effort:7", strings.Join(limits.IOClasses(), ", ")))
+	cmd.PersistentFlags().Int("processors", 0, "Maximum number of threads of mksquashfs, all the CPUs by default")
+	cmd.PersistentFlags().String("memory-limit", "", "Soft memory limit of enki itself, like 2GiB. The external tools are not limited by it")
+	cmd.PersistentFlags().Bool("low-memory", false, "Keep the memory of the build down so it completes on small machines, like 2GB CI runners: mksquashfs runs single threaded with a 256M cache, files are copied and platforms built one at a time and enki is limited to 512MiB. The processors and memory-limit given are kept")
+	cmd.PersistentFlags().StringSlice("remote", []string{}, fmt.Sprintf("Run the tools of a step on another host as STEP=TARGET, like sign=ssh://builder@signer to sign on a secured host holding the keys or squashfs=exec:docker exec -i builder for a privileged sidecar. The steps are %s, the targets ssh://[USER@]HOST[:PORT] or exec:COMMAND. The paths of the build must be the same on the target, like with a shared volume", strings.Join(remote.Steps(), ", ")))
+	cmd.PersistentFlags().String("history-file", history.DefaultPath, "File recording the builds and their workdirs, to prune the leftovers of interrupted ones with enki gc. Empty disables it")
+	cmd.PersistentFlags().StringSlice("workdir-backend", []string{}, fmt.Sprintf("Where the work areas of the build live [%s], for every stage or per stage as STAGE=BACKEND like auto,rootfs=disk. The stages are %s. temp uses the temp dir as it is, auto uses tmpfs for the stages fitting in half of the available RAM and disk for the others", strings.Join(workdir.Backends(), ", "), strings.Join(workdir.Stages(), ", ")))
+	cmd.PersistentFlags().String("tmpfs-dir", workdir.DefaultTmpfsDir, "Dir on tmpfs holding the tmpfs work areas")
+	cmd.PersistentFlags().String("disk-dir", workdir.DefaultDiskDir, "Dir on disk holding the disk work areas")
+	cmd.PersistentFlags().String("toolcache", deps.DefaultToolcache, "Dir of the static builds installed by enki deps install, preferred to the tools in the PATH. Empty disables it")
+	cmd.PersistentFlags().String("layer-store", "", "Dir storing the extracted layers of the source images, so the builds sharing layers, like the flavors of a release, extract them once. Empty disables it")
+	cmd.PersistentFlags().Bool("layer-store-overlay", false, "Mount the rootfs of the builds as an overlayfs over the rootfs of the source image in the layer store, so the hooks and prunes only write their changes. Falls back to copying the rootfs with reflinks without overlayfs, like in rootless builds")
+	cmd.PersistentFlags().Var(newEnumFlag(layerstore.Links(), layerstore.LinkReflink), "layer-store-link", fmt.Sprintf("How the stored layers are materialized into the workdirs [%s]. reflink falls back to copying on filesystems without reflinks, hardlink is only safe for builds not modifying the files of the image in place, like with overlays or hooks", strings.Join(layerstore.Links(), ", ")))
 	_ = viper.BindPFlag("debug", cmd.PersistentFlags().Lookup("debug"))
 	_ = viper.BindPFlag("config-dir", cmd.PersistentFlags().Lookup("config-dir"))
 	_ = viper.BindPFlag("logfile", cmd.PersistentFlags().Lookup("logfile"))
 	_ = viper.BindPFlag("quiet", cmd.PersistentFlags().Lookup("quiet"))
+	_ = viper.BindPFlag("set", cmd.PersistentFlags().Lookup("set"))
+	for _, flag := range []string{"log-level", "debug-modules", "log-file", "transcript", "nice", "ionice", "processors", "memory-limit", "low-memory", "remote", "history-file", "workdir-backend", "tmpfs-dir", "disk-dir", "toolcache", "layer-store", "layer-store-link", "layer-store-overlay"} {
+		_ = viper.BindPFlag(flag, cmd.PersistentFlags().Lookup(flag))
+	}
+	addRegistryFlags(cmd)
+	addNetworkFlags(cmd)
+	_ = cmd.RegisterFlagCompletionFunc("log-level", completeValues(logging.Levels()...))
+	_ = cmd.RegisterFlagCompletionFunc("debug-modules", completeValues(logging.Modules()...))
+	_ = cmd.RegisterFlagCompletionFunc("ionice", completeValues(limits.IOClasses()...))
+	_ = cmd.RegisterFlagCompletionFunc("remote", completeValues(remote.Steps()...))
+	_ = cmd.RegisterFlagCompletionFunc("workdir-backend", completeValues(workdir.Backends()...))
+	_ = cmd.RegisterFlagCompletionFunc("layer-store-link", completeValues(layerstore.Links()...))
 
 	if viper.GetBool("debug") {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
+	cmd.PersistentPreRunE = classified(failure.ErrInvalidConfig, func(cmd *cobra.Command, args []string) error {
+		if err := applyEnv(cmd); err != nil {
+			return err
+		}
+		if _, err := templating.ParseSet(viper.GetStringSlice("set")); err != nil {
+			return err
+		}
+		if _, err := config.ReadLogging(); err != nil {
+			return err
+		}
+		if _, err := config.ReadLimits(); err != nil {
+			return err
+		}
+		if _, err := config.ReadRemote(); err != nil {
+			return err
+		}
+		if _, err := config.ReadWorkdir(); err != nil {
+			return err
+		}
+		deps.UseToolcache(viper.GetString("toolcache"))
+		if err := layerstore.Use(viper.GetString("layer-store"), viper.GetString("layer-store-link")); err != nil {
+			return err
+		}
+		layerstore.UseOverlay(viper.GetBool("layer-store-overlay"))
+		if err := checkManifest(cmd); err != nil {
+			return err
+		}
+		if err := useNetwork(); err != nil {
+			return err
+		}
+		if err := useRegistryAuth(); err != nil {
+			return err
+		}
+		// Cobra checks these after PreRunE, the flags can only be checked once set from the env
+		if err := cmd.ValidateRequiredFlags(); err != nil {
+			return err
+		}
+		return cmd.ValidateFlagGroups()
+	})
 	return cmd
 }
 
+// applyEnv sets the flags of cmd not given in the command line from their environment
+// variable, see config.EnvPrefix. Viper's own env binding can't be used for flags, as the
+// commands read most of them from the flag set directly.
+func applyEnv(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		env := config.EnvName(f.Name)
+		if value, ok := os.LookupEnv(env); ok {
+			if setErr := cmd.Flags().Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value of %s: %w", env, setErr)
+			}
+		}
+	})
+	return err
+}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = NewRootCmd()
 
@@ -38,20 +143,96 @@ var rootCmd = NewRootCmd()
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 
+	// Cobra runs the persistent hooks once the flags, arguments and subcommand are valid, so any
+	// error before that is a usage error
+	valid := false
+	preRun := rootCmd.PersistentPreRunE
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		valid = true
+		return preRun(cmd, args)
+	}
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		if !valid {
+			err = failure.Classify(failure.ErrInvalidConfig, err)
+		}
+		if hint := failure.Hint(err); hint != "" {
+			fmt.Fprintf(os.Stderr, "Hint: %s\n", hint)
+		}
+		os.Exit(failure.ExitCode(err))
+	}
+}
+
+// classified returns fn with the errors it returns classified as the given kind, unless they
+// already have a more specific one. It wraps PreRunE and RunE functions.
+func classified(kind error, fn func(*cobra.Command, []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		return failure.Classify(kind, fn(cmd, args))
 	}
 }
 
 // CheckRoot is a helper to return on PreRunE, so we can add it to commands that require root
 func CheckRoot() error {
 	if os.Geteuid() != 0 {
-		return errors.New("this command requires root privileges")
+		return failure.New(failure.ErrPermission, errors.New("this command requires root privileges"), "run it as root or with sudo")
+	}
+	return nil
+}
+
+// checkStdoutArtifact fails if any of the given options is enabled, as they write other files
+// than the single artifact streamed to stdout
+func checkStdoutArtifact(options map[string]bool) error {
+	var enabled []string
+	for option, on := range options {
+		if on {
+			enabled = append(enabled, option)
+		}
+	}
+	sort.Strings(enabled)
+	if len(enabled) > 0 {
+		return fmt.Errorf("%s can't be used when writing the artifact to stdout", strings.Join(enabled, ", "))
 	}
 	return nil
 }
 
+// stdinSource spools the docker save archive piped into stdin and makes cfg extract its image in
+// place of the returned source. The spooled archive must be removed once the build is done.
+func stdinSource(cfg *types.BuildConfig) (*v1.ImageSource, *image.Archive, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return nil, nil, failure.New(failure.ErrInvalidConfig, errors.New("no source archive piped into stdin"), "pipe the image into enki, like docker save IMAGE | enki build-uki -")
+	}
+	cfg.Logger.Infof("Reading the source image archive from stdin")
+	archive, err := image.SpoolArchive(os.Stdin)
+	if err != nil {
+		return nil, nil, failure.New(failure.ErrInvalidConfig, err, "pipe the output of docker save into enki")
+	}
+	src, err := v1.NewSrcFromURI(archive.Ref)
+	if err != nil {
+		archive.Remove()
+		return nil, nil, failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	cfg.ImageExtractor = image.ArchiveExtractor{Archive: archive, Next: cfg.ImageExtractor}
+	return src, archive, nil
+}
+
+// addBuildSources records the sources in the build info of cfg. The image of the archive read
+// from stdin, if any, can't be fetched again so its digest is computed from the archive.
+func addBuildSources(cfg *types.BuildConfig, archive *image.Archive, sources ...*v1.ImageSource) {
+	for _, src := range sources {
+		if archive == nil || src.Value() != archive.Ref {
+			cfg.BuildInfo.AddSources(cfg.Logger, cfg.Platform.String(), src)
+			continue
+		}
+		s := buildinfo.Source{URI: "stdin:" + archive.Ref}
+		digest, err := archive.Digest()
+		if err != nil {
+			cfg.Logger.Warnf("Could not compute the digest of the source archive for the build info: %v", err)
+		}
+		s.Digest = digest
+		cfg.BuildInfo.Sources = append(cfg.BuildInfo.Sources, s)
+	}
+}
+
 type enum struct {
 	Allowed []string
 	Value   string
@@ -77,6 +258,11 @@ func (a *enum) Set(p string) error {
 	return nil
 }
 
+// AllowedValues returns the values the flag accepts, listed in the manifest schema
+func (a *enum) AllowedValues() []string {
+	return a.Allowed
+}
+
 func (a *enum) Type() string {
 	return "string"
 }
@@ -88,3 +274,36 @@ func newEnumFlag(allowed []string, d string) *enum {
 		Value:   d,
 	}
 }
+
+// recordBuild runs build recording it in the build history, unless disabled. Builds are not
+// failed by a history that can't be written.
+func recordBuild(cfg *types.BuildConfig, command, source, outputDir string, build func() error) error {
+	path := viper.GetString("history-file")
+	if path == "" {
+		return build()
+	}
+	b, err := history.Begin(history.Open(cfg.Fs, path), command, source, outputDir)
+	if err != nil {
+		cfg.Logger.Warnf("Not recording the build in the history: %v", err)
+		return build()
+	}
+	// The work areas on tmpfs and disk are placed in dirs of the build, so enki gc spares them
+	// while it runs
+	placement := cfg.Workdirs
+	if cfg.Workdirs, err = b.Place(placement); err != nil {
+		cfg.Workdirs = placement
+		cfg.Logger.Warnf("Not recording the work areas of the build in the history: %v", err)
+	}
+	cfg.Outputs = b.Outputs()
+	err = build()
+	cfg.Workdirs, cfg.Outputs = placement, nil
+	if finishErr := b.Finish(err); finishErr != nil {
+		cfg.Logger.Warnf("Could not record the build in the history: %v", finishErr)
+	}
+	return err
+}
+
+func init() {
+	// The overlays of the rootfs are left mounted by the builds that failed before releasing them
+	cobra.OnFinalize(func() { _ = layerstore.ReleaseAll() })
+}
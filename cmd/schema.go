@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/manifest"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// skipManifestCheck annotates the commands that run with any manifest, as they don't read it
+const skipManifestCheck = "enki.skip-manifest-check"
+
+func NewSchemaCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the build manifest",
+		Long: "Print the JSON Schema of the build manifest\n\n" +
+			"The manifest.yaml of the config dir is checked against it before every build, unknown\n" +
+			"settings fail the build. The schema is versioned, it is published as " + manifest.ID() + "\n" +
+			"which editors pick up from a $schema key or a yaml-language-server comment in the manifest.",
+		Args:        cobra.NoArgs,
+		Annotations: map[string]string{skipManifestCheck: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			data, err := json.MarshalIndent(manifestSchema(cmd.Root()), "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		},
+	}
+	return c
+}
+
+// manifestSchema returns the schema of the manifest read by the build commands of root. The top
+// level settings are the global flags, the flags of build-uki and the fields of the build config,
+// the iso section the fields of the build-iso config.
+func manifestSchema(root *cobra.Command) *manifest.Schema {
+	s := manifest.New()
+	var uki, iso *cobra.Command
+	for _, c := range root.Commands() {
+		switch c.Name() {
+		case "build-uki":
+			uki = c
+		case "build-iso":
+			iso = c
+		}
+	}
+	s.AddFlags(root.PersistentFlags(), "config-dir")
+	isoFlags := root.PersistentFlags()
+	if iso != nil {
+		isoFlags = iso.Flags()
+	}
+	s.AddStruct(types.BuildConfig{}, isoFlags)
+	if uki != nil {
+		// The flags of the host enki only, the builder container never reads them
+		s.AddFlags(uki.Flags(), containerizedFlags...)
+	}
+	section := manifest.Object("Settings of build-iso")
+	section.AddStruct(types.LiveISO{}, isoFlags)
+	s.Properties["iso"] = section
+	return s
+}
+
+// checkManifest fails on the settings of the manifest in the config dir enki doesn't know, which
+// would be ignored otherwise
+func checkManifest(cmd *cobra.Command) error {
+	// The help command of cobra can't be annotated, it is made when enki runs
+	if cmd.Annotations[skipManifestCheck] != "" || cmd.Name() == "help" {
+		return nil
+	}
+	dir := viper.GetString("config-dir")
+	if dir == "" {
+		dir = "."
+	}
+	path := filepath.Join(dir, manifest.FileName)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	settings, err := manifest.Load(path)
+	if err == nil {
+		err = manifestSchema(cmd.Root()).Check(settings)
+	}
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, fmt.Errorf("%s: %w", path, err), "check the manifest against the schema printed by enki schema")
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(NewSchemaCmd())
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/manifest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Schema", Label("schema", "cmd"), func() {
+	var root *cobra.Command
+	var dir string
+	BeforeEach(func() {
+		root = NewRootCmd()
+		root.AddCommand(NewBuildUKICmd(), NewBuildISOCmd(), NewSchemaCmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+		dir = GinkgoT().TempDir()
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	writeManifest := func(content string) {
+		Expect(os.WriteFile(filepath.Join(dir, manifest.FileName), []byte(content), 0644)).To(Succeed())
+	}
+
+	It("prints the published schema", func() {
+		published, err := os.ReadFile(filepath.Join("..", "schema", "manifest.v1.json"))
+		Expect(err).ToNot(HaveOccurred())
+		_, out, err := executeCommandC(root, "schema")
+		Expect(err).ToNot(HaveOccurred())
+		// Regenerate it with enki schema > schema/manifest.v1.json when adding settings
+		Expect(out).To(MatchJSON(published))
+
+		var schema manifest.Schema
+		Expect(json.Unmarshal(published, &schema)).To(Succeed())
+		Expect(schema.ID).To(Equal(manifest.ID()))
+		Expect(schema.Properties).To(HaveKey("extend-cmdline"))
+		Expect(schema.Properties).To(HaveKey("name"))
+		Expect(schema.Properties).ToNot(HaveKey("containerized"))
+		Expect(schema.Properties["iso"].Properties).To(HaveKey("rootfs"))
+	})
+	It("fails the builds on unknown settings of the manifest", func() {
+		writeManifest("name: kairos\nextend-cmdlin: quiet\niso:\n  lable: KAIROS\n")
+		_, _, err := executeCommandC(root, "--config-dir", dir, "build-uki", "some/image:latest", "--keys", "/nonexistingpath")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("unknown fields in the manifest: extend-cmdlin, iso.lable"))
+	})
+	It("prints the schema with any manifest", func() {
+		writeManifest("extend-cmdlin: quiet\n")
+		_, out, err := executeCommandC(root, "--config-dir", dir, "schema")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(ContainSubstring(manifest.Draft))
+	})
+})
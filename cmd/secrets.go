@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secret"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// secretsHint is the remediation of the secrets that can't be resolved
+var secretsHint = fmt.Sprintf("check the secret references, like env://NAME, file://PATH or vault://PATH#FIELD with %s and %s set for vault", secret.VaultAddrEnv, secret.VaultTokenEnv)
+
+// privateKeys are the files of a keys dir holding private keys, by the flag giving them apart
+// from the keys dir
+var privateKeys = map[string]string{
+	"db-key":  "db.key",
+	"kek-key": "KEK.key",
+	"pcr-key": "tpm2-pcr-private.pem",
+}
+
+// addPrivateKeyFlags adds the flags giving the private keys of the keys dir named by the flag
+// prefix+"keys" apart from it, so they can be kept in a secret store
+func addPrivateKeyFlags(c *cobra.Command, prefix string, flags ...string) {
+	for _, name := range flags {
+		c.Flags().String(prefix+name, "", fmt.Sprintf("Private key used in place of the %s of the %skeys dir, as a secret reference like env://NAME, file://PATH or vault://PATH#FIELD, or as a path", privateKeys[name], prefix))
+	}
+}
+
+// givenKeys returns the private keys given apart from the keys dir named by the flag prefix+"keys",
+// by their file in the keys dir
+func givenKeys(flags *pflag.FlagSet, prefix string) map[string]string {
+	given := map[string]string{}
+	for name, file := range privateKeys {
+		if value, _ := flags.GetString(prefix + name); value != "" {
+			given[file] = value
+		}
+	}
+	return given
+}
+
+// checkGivenKeys fails on malformed secret references of the given keys
+func checkGivenKeys(given map[string]string) error {
+	for file, value := range given {
+		if err := secret.Check(value); err != nil {
+			return failure.New(failure.ErrInvalidConfig, fmt.Errorf("%s: %w", file, err), secretsHint)
+		}
+		if !secret.IsRef(value) {
+			if _, err := os.Stat(value); err != nil {
+				return failure.Errorf(failure.ErrMissingKeys, keysHint, "the key given for %s does not exist: %s", file, value)
+			}
+		}
+	}
+	return nil
+}
+
+// withGivenKeys returns keysDir with the given keys in place of its own ones, resolved into a
+// private copy of it if any is given. The copy must be removed with the returned function.
+func withGivenKeys(keysDir string, given map[string]string) (string, func(), error) {
+	if len(given) == 0 {
+		return keysDir, func() {}, nil
+	}
+	dir, cleanup, err := secret.Overlay(keysDir, given)
+	if err != nil {
+		return "", nil, failure.New(failure.ErrMissingKeys, err, secretsHint)
+	}
+	return dir, cleanup, nil
+}
+
+// secretEnv returns the names of the environment variables the secret references among values
+// are read from, along with the Vault client ones when any reads from Vault. They are passed to
+// the builder container by name, so their values don't show in its command line.
+func secretEnv(values []string) []string {
+	var names []string
+	add := func(name string) {
+		if _, ok := os.LookupEnv(name); ok && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, value := range values {
+		// HOST=REF registry credentials
+		if _, ref, ok := strings.Cut(value, "="); ok && secret.IsRef(ref) {
+			value = ref
+		}
+		switch {
+		case strings.HasPrefix(value, secret.SchemeEnv+"://"):
+			add(strings.TrimPrefix(value, secret.SchemeEnv+"://"))
+		case strings.HasPrefix(value, secret.SchemeVault+"://"):
+			add(secret.VaultAddrEnv)
+			add(secret.VaultTokenEnv)
+			add(secret.VaultNamespaceEnv)
+		}
+	}
+	return names
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secret"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Secrets", Label("secrets", "cmd"), func() {
+	var root *cobra.Command
+	BeforeEach(func() {
+		root = NewRootCmd()
+		root.AddCommand(NewVersionCmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+		setenv("HOME", GinkgoT().TempDir())
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("rejects registry credentials given as is", func() {
+		_, _, err := executeCommandC(root, "--registry-credentials", "quay.io=robot:token", "version")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("invalid registry credentials"))
+	})
+	It("uses a private docker config with the registry credentials while running", func() {
+		setenv("ENKI_TEST_QUAY", "robot:token")
+		var during string
+		root.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+			during = os.Getenv(secret.DockerConfigEnv)
+		}
+		_, _, err := executeCommandC(root, "--registry-credentials", "quay.io=env://ENKI_TEST_QUAY", "version")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(during).ToNot(BeEmpty())
+		// Removed once done
+		Expect(during).ToNot(BeADirectory())
+		Expect(os.Getenv(secret.DockerConfigEnv)).To(BeEmpty())
+	})
+	It("passes the variables the secrets are read from to the builder container", func() {
+		setenv("ENKI_TEST_DB_KEY", "key")
+		setenv(secret.VaultAddrEnv, "https://vault.example.com")
+		Expect(secretEnv([]string{"env://ENKI_TEST_DB_KEY", "quay.io=env://ENKI_TEST_DB_KEY", "env://ENKI_TEST_MISSING", "vault://kv/enki#db.key", "/keys"})).To(Equal([]string{"ENKI_TEST_DB_KEY", secret.VaultAddrEnv}))
+	})
+})
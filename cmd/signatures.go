@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewSignaturesCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "signatures DIR",
+		Short: "Report which keys signed the EFI binaries of the artifacts in a dir",
+		Long: "Report which keys signed the EFI binaries of the artifacts in a dir\n\n" +
+			"Lists the Secure Boot signatures of the EFI binaries in DIR, on their own, in esp-dir outputs\n" +
+			"and in the ESP of UKI ISOs, naming the keys dir passed with --keys each signature verifies\n" +
+			"with. When rotating keys, it tells which artifacts still need to be resigned with enki resign.",
+		Args: cobra.ExactArgs(1),
+		RunE: classified(failure.ErrVerification, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			keysDirs, _ := cmd.Flags().GetStringSlice("keys")
+			a, err := action.NewSignaturesAction(cfg, keysDirs)
+			if err != nil {
+				return err
+			}
+			binaries, err := a.Run(args[0])
+			if err != nil {
+				return err
+			}
+			logSignatures(cfg.Logger, binaries)
+			if jsonResult, _ := cmd.Flags().GetString("json-result"); jsonResult != "" {
+				data, err := json.MarshalIndent(binaries, "", "  ")
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(jsonResult, append(data, '\n'), 0644)
+			}
+			return nil
+		}),
+	}
+	c.Flags().StringSliceP("keys", "k", []string{}, "Directory with keys to look for in the signatures, like the previous and the new ones. Can be repeated.")
+	c.Flags().String("json-result", "", "Write the signatures of every binary as JSON to this file")
+	_ = c.MarkFlagDirname("keys")
+	return c
+}
+
+// logSignatures prints the binaries as a table, along with the keys signing them or the
+// subject of the signing certificate if it's none of the known keys
+func logSignatures(logger v1.Logger, binaries []action.SignedBinary) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ARTIFACT\tBINARY\tSIGNED BY")
+	for _, b := range binaries {
+		var signers []string
+		for _, s := range b.Signatures {
+			if s.Key != "" {
+				signers = append(signers, s.Key)
+			} else {
+				signers = append(signers, fmt.Sprintf("unknown key (%s)", s.Subject))
+			}
+		}
+		if len(signers) == 0 {
+			signers = []string{"unsigned"}
+		}
+		path := b.Path
+		if path == "" {
+			path = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", b.Artifact, path, strings.Join(signers, ", "))
+	}
+	_ = w.Flush()
+	for _, line := range bytes.Split(bytes.TrimRight(buf.Bytes(), "\n"), []byte("\n")) {
+		logger.Info(string(line))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(NewSignaturesCmd())
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"bytes"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signatures", Label("signatures", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	It("Requires the db certificate of the keys", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewSignaturesCmd())
+		_, _, err := executeCommandC(root, "signatures", GinkgoT().TempDir(), "--keys", "/nonexistingpath")
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+	})
+})
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Templates", Label("templates", "cmd"), func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "enki-templates")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	writeManifest := func(manifest string) {
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte(manifest), 0644)).To(Succeed())
+	}
+
+	It("rejects set values that aren't key=value", func() {
+		root := NewRootCmd()
+		root.AddCommand(NewBuildUKICmd())
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+		_, _, err := executeCommandC(root, "build-uki", "some/image:latest", "--keys", "/nonexistingpath", "--set", "flavor")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("expected key=value"))
+	})
+	It("expands the manifest with the set values and the arch", func() {
+		writeManifest("arch: amd64\nname: kairos-{{.flavor}}-{{.arch}}\nextend-cmdline: \"{{.flavor}}\"\niso:\n  label: \"{{.flavor | upper}}\"\n  rootfs: [\"oci:quay.io/kairos/{{.flavor}}:latest\"]\n")
+		viper.Set("set", []string{"flavor=ubuntu"})
+
+		cfg, err := config.ReadConfigBuild(dir, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Name).To(Equal("kairos-ubuntu-amd64"))
+		// Left for build-uki, once the source values are known
+		Expect(viper.GetString("extend-cmdline")).To(Equal("{{.flavor}}"))
+
+		spec, err := config.ReadBuildISO(cfg, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(spec.Label).To(Equal("UBUNTU"))
+		Expect(spec.RootFS).To(HaveLen(1))
+		Expect(spec.RootFS[0].Value()).To(Equal("quay.io/kairos/ubuntu:latest"))
+	})
+	It("fails on values missing from the templates", func() {
+		writeManifest("name: kairos-{{.model}}\n")
+		_, err := config.ReadConfigBuild(dir, nil)
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("name"))
+		Expect(failure.Hint(err)).To(ContainSubstring("--set"))
+	})
+})
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/fixture"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewTestdataCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "testdata DIR",
+		Short: "Generate tiny artifacts for the tests of the tools consuming the enki ones",
+		Long: "Generate tiny artifacts for the tests of the tools consuming the enki ones\n\n" +
+			"Creates a live ISO with the kernel, initrd and rootfs squashfs at the paths of the build-iso\n" +
+			"ones, a UKI with the sections of the build-uki ones, and a 1MiB rootfs squashfs, along with\n" +
+			"the certificate of the test key signing the UKI. They are created without any of the tools\n" +
+			"of the build commands and are the same bytes on every run, so tests can generate them on the\n" +
+			"fly. None of them boots, and the test key must never be enrolled.\n\n" +
+			"The Go tests can call the fixture package directly instead.",
+		Example: "  enki testdata testdata/ --type kairos.efi",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			types, _ := cmd.Flags().GetStringSlice("type")
+			for _, t := range types {
+				if !slices.Contains(fixture.Names(), t) {
+					return failure.Errorf(failure.ErrInvalidConfig, "", "invalid type %q, available types: %s", t, strings.Join(fixture.Names(), ", "))
+				}
+			}
+			return nil
+		},
+		RunE: classified(failure.ErrBuild, func(cmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+			types, _ := cmd.Flags().GetStringSlice("type")
+			paths, err := fixture.Write(args[0], types...)
+			if err != nil {
+				return err
+			}
+			for _, path := range paths {
+				cfg.Logger.Infof("Created %s", path)
+			}
+			return nil
+		}),
+	}
+	c.Flags().StringSlice("type", []string{}, "Only create these artifacts, all of them if none is given. Can be repeated: "+strings.Join(fixture.Names(), ", "))
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewTestdataCmd())
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/fixture"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Testdata", Label("testdata", "cmd"), func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+	})
+	It("Refuses unknown types", Label("flags"), func() {
+		root := NewRootCmd()
+		root.AddCommand(NewTestdataCmd())
+		_, _, err := executeCommandC(root, "testdata", GinkgoT().TempDir(), "--type", "disk.raw")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err).To(MatchError(ContainSubstring(`invalid type "disk.raw"`)))
+	})
+	It("Creates the given types only", func() {
+		dir := GinkgoT().TempDir()
+		root := NewRootCmd()
+		root.AddCommand(NewTestdataCmd())
+		_, _, err := executeCommandC(root, "testdata", dir, "--type", fixture.UKI)
+		Expect(err).ToNot(HaveOccurred())
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		Expect(names).To(ConsistOf(fixture.UKI, fixture.Cert))
+		Expect(filepath.Join(dir, fixture.Squashfs)).ToNot(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewVerifyCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "verify ISO...",
+		Short: "Verify built ISOs boot from multi-ISO boot tools like Ventoy",
+		Long: "Verify built ISOs boot from multi-ISO boot tools like Ventoy\n\n" +
+			"Multi-ISO boot tools boot the ISO file from a USB drive holding several ones instead of from\n" +
+			"a device of its own. The ISO label must be usable to find the live root, the grub config must\n" +
+			"look for that label and " + iso.LoopbackCfg + " must tell the kernel which ISO file to loop mount.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cobraCmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cobraCmd.Flags())
+			if err != nil {
+				return err
+			}
+			var failed []string
+			for _, artifact := range args {
+				problems, err := iso.VerifyMultiboot(artifact)
+				if err != nil {
+					return err
+				}
+				for _, problem := range problems {
+					cfg.Logger.Warnf("%s: %s", artifact, problem)
+				}
+				if len(problems) > 0 {
+					failed = append(failed, artifact)
+					continue
+				}
+				cfg.Logger.Infof("%s boots from multi-ISO boot tools", artifact)
+			}
+			if len(failed) > 0 {
+				return failure.Errorf(failure.ErrVerification, "rebuild the ISO with enki build-iso, which writes "+iso.LoopbackCfg+", and a label of up to 32 letters, digits, dashes, dots and underscores",
+					"%d of %d ISOs won't boot reliably from multi-ISO boot tools: %v", len(failed), len(args), failed)
+			}
+			return nil
+		},
+	}
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewVerifyCmd())
+}
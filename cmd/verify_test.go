@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/iso"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verify", Label("verify", "cmd"), func() {
+	var buf *bytes.Buffer
+	var isoFile string
+	BeforeEach(func() {
+		buf = new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+		root := GinkgoT().TempDir()
+		Expect(os.MkdirAll(filepath.Join(root, "boot", "grub2"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(root, "boot", "grub2", "grub.cfg"), []byte("menuentry Kairos {\n  linux /boot/kernel root=live:CDLABEL=COS_LIVE\n}\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(root, "boot", "uefi.img"), make([]byte, 64*1024), 0644)).To(Succeed())
+		isoFile = filepath.Join(GinkgoT().TempDir(), "kairos.iso")
+		Expect(iso.Native{}.Create(iso.Options{Root: root, Output: isoFile, VolumeID: "COS_LIVE", EFIImage: "boot/uefi.img", RockRidge: true})).To(Succeed())
+	})
+	It("Fails ISOs multi-ISO boot tools can't boot", Label("multiboot"), func() {
+		_, _, err := executeCommandC(rootCmd, "verify", isoFile)
+		Expect(err).To(MatchError(failure.ErrVerification))
+		Expect(failure.ExitCode(err)).To(Equal(10))
+	})
+	It("Requires an ISO", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "verify")
+		Expect(err).To(MatchError(ContainSubstring("requires at least 1 arg")))
+	})
+})
@@ -11,6 +11,8 @@ func NewVersionCmd() *cobra.Command {
 		Use:   "version",
 		Short: "Print enki version",
 		Args:  cobra.NoArgs,
+		// Prints the version with any manifest
+		Annotations: map[string]string{skipManifestCheck: "true"},
 		RunE: func(cobraCmd *cobra.Command, args []string) error {
 			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
 			cobraCmd.SilenceUsage = true
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/manifest"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/watch"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// watchOptions tell addWatchFlag what the command reads and what each input affects
+type watchOptions struct {
+	// inputs are the flags or settings naming the files and dirs watched along with the manifest
+	inputs []string
+	// bound are the flags of the command bound to viper when it is created, bound again on every
+	// build as viper is reset
+	bound *pflag.FlagSet
+	// narrow returns the flags restricting a build to the artifacts affected when only the given
+	// inputs changed, or nil to build all the artifacts again
+	narrow func(flags *pflag.FlagSet, changed []string) map[string][]string
+}
+
+// addWatchFlag adds --watch to c, running its RunE again every time the manifest or the files and
+// dirs named by the inputs flags or settings change. Streamed sources and artifacts can't be
+// watched, as they are read and written once. Changes to the manifest build all the artifacts
+// again, the other inputs may only build the artifacts they affect.
+func addWatchFlag(c *cobra.Command, opts watchOptions) {
+	c.Flags().Bool("watch", false, "Keep running and build again every time the manifest, the overlays, the install config or the hooks change, until interrupted. Fast with a layer store, as the source image is not extracted again. The changes to the manifest build all the artifacts again, the changes to the other files only the artifacts they end up in")
+	preRun, run := c.PreRunE, c.RunE
+	c.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if enabled, _ := cmd.Flags().GetBool("watch"); enabled {
+			if len(args) == 1 && args[0] == image.Stdin {
+				return failure.Errorf(failure.ErrInvalidConfig, "pass the source image by reference or path", "watch can't be used when reading the source image from stdin")
+			}
+			for _, name := range outputFlags {
+				if output, _ := cmd.Flags().GetString(name); output == utils.Stdout {
+					return failure.Errorf(failure.ErrInvalidConfig, "write the artifacts to an output dir", "watch can't be used when writing the artifacts to stdout")
+				}
+			}
+		}
+		if preRun == nil {
+			return nil
+		}
+		return preRun(cmd, args)
+	}
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		if enabled, _ := cmd.Flags().GetBool("watch"); !enabled {
+			return run(cmd, args)
+		}
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		logger := config.ReadLogger(viper.GetString("config-dir"), cmd.Flags())
+		watched := watchedInputs(cmd.Flags(), opts.inputs)
+		return watch.Run(ctx, logger, watchedPaths(watched, opts.inputs), func(changed []string) error {
+			// The builds merge the manifest and expand the templates into viper, the settings
+			// removed from the manifest would stay and the templates would not be expanded again
+			resetConfig(cmd, opts.bound)
+			var narrowed map[string][]string
+			inputs := changedInputs(watched, changed)
+			if inputs != nil && opts.narrow != nil {
+				narrowed = opts.narrow(cmd.Flags(), inputs)
+			}
+			restore, err := setFlags(cmd.Flags(), narrowed)
+			if err != nil {
+				return err
+			}
+			defer restore()
+			if narrowed != nil {
+				logger.Infof("Only %s changed, building again the artifacts they end up in", strings.Join(inputs, ", "))
+			}
+			return run(cmd, args)
+		})
+	}
+}
+
+// resetConfig drops the settings of the previous build from viper and binds the global flags
+// and the bound ones again
+func resetConfig(cmd *cobra.Command, bound *pflag.FlagSet) {
+	viper.Reset()
+	_ = viper.BindPFlags(cmd.Root().PersistentFlags())
+	if bound != nil {
+		_ = viper.BindPFlags(bound)
+	}
+}
+
+// setFlags sets the flags to the given values as if given in the command line, and returns a func
+// setting them back as they were
+func setFlags(flags *pflag.FlagSet, values map[string][]string) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for _, r := range restores {
+			r()
+		}
+	}
+	for name, value := range values {
+		f := flags.Lookup(name)
+		if f == nil {
+			restore()
+			return nil, fmt.Errorf("unknown flag %s", name)
+		}
+		changed := f.Changed
+		if s, ok := f.Value.(pflag.SliceValue); ok {
+			previous := s.GetSlice()
+			restores = append(restores, func() { _ = s.Replace(previous); f.Changed = changed })
+			_ = s.Replace(value)
+		} else {
+			previous := f.Value.String()
+			restores = append(restores, func() { _ = f.Value.Set(previous); f.Changed = changed })
+			if err := f.Value.Set(strings.Join(value, ",")); err != nil {
+				restore()
+				return nil, err
+			}
+		}
+		f.Changed = true
+	}
+	return restore, nil
+}
+
+// watchedInputs returns the absolute paths of the inputs given by flags or by the manifest, by
+// input name, and the ones of the manifest and the ones it extends with no name
+func watchedInputs(flags *pflag.FlagSet, inputs []string) map[string][]string {
+	path := filepath.Join(viper.GetString("config-dir"), manifest.FileName)
+	watched := map[string][]string{"": manifest.Files(path)}
+	settings, _ := manifest.Load(path)
+	for _, name := range inputs {
+		var values []string
+		if f := flags.Lookup(name); f != nil && f.Changed {
+			if s, ok := f.Value.(pflag.SliceValue); ok {
+				values = s.GetSlice()
+			} else {
+				values = []string{f.Value.String()}
+			}
+		} else {
+			switch v := settings[name].(type) {
+			case string:
+				values = []string{v}
+			case []any:
+				for _, item := range v {
+					if s, ok := item.(string); ok {
+						values = append(values, s)
+					}
+				}
+			}
+		}
+		for _, value := range values {
+			if value == "" {
+				continue
+			}
+			if abs, err := filepath.Abs(value); err == nil {
+				watched[name] = append(watched[name], abs)
+			}
+		}
+	}
+	return watched
+}
+
+// watchedPaths returns the paths of the watched inputs, the manifests first
+func watchedPaths(watched map[string][]string, inputs []string) []string {
+	paths := watched[""]
+	for _, name := range inputs {
+		paths = append(paths, watched[name]...)
+	}
+	return paths
+}
+
+// changedInputs returns the sorted names of the inputs holding the changed files, or nil if the
+// manifests changed or everything must be built
+func changedInputs(watched map[string][]string, changed []string) []string {
+	if changed == nil {
+		return nil
+	}
+	names := map[string]bool{}
+	for _, file := range changed {
+		// A file may be in several inputs, like an overlay within another one
+		owned := false
+		for name, paths := range watched {
+			for _, path := range paths {
+				if file != path && !strings.HasPrefix(file, path+string(filepath.Separator)) {
+					continue
+				}
+				if name == "" {
+					return nil
+				}
+				names[name] = true
+				owned = true
+			}
+		}
+		if !owned {
+			return nil
+		}
+	}
+	inputs := make([]string, 0, len(names))
+	for name := range names {
+		inputs = append(inputs, name)
+	}
+	sort.Strings(inputs)
+	return inputs
+}
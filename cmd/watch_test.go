@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/manifest"
+	"github.com/kairos-io/enki/pkg/watch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Watch", Label("watch", "cmd"), func() {
+	type build struct {
+		name     string
+		label    string
+		recovery bool
+	}
+	var dir string
+	var builds chan build
+	var cancel context.CancelFunc
+	var done chan error
+
+	writeManifest := func(content string) {
+		Expect(os.WriteFile(filepath.Join(dir, manifest.FileName), []byte(content), 0644)).To(Succeed())
+	}
+	start := func(args ...string) {
+		// Named like build-uki so the manifest is checked against its flags
+		cmd := &cobra.Command{
+			Use: "build-uki",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+				if err != nil {
+					return err
+				}
+				recovery, _ := cmd.Flags().GetBool("recovery")
+				builds <- build{name: cfg.Name, label: viper.GetString("label"), recovery: recovery}
+				return nil
+			},
+		}
+		cmd.Flags().String("label", "", "")
+		cmd.Flags().Bool("recovery", false, "")
+		cmd.Flags().String("overlay-iso", "", "")
+		addWatchFlag(cmd, watchOptions{
+			inputs: []string{"overlay-iso"},
+			narrow: func(flags *pflag.FlagSet, changed []string) map[string][]string {
+				return map[string][]string{"recovery": {"false"}}
+			},
+		})
+		root := NewRootCmd()
+		root.AddCommand(cmd)
+		root.SetOut(new(bytes.Buffer))
+		root.SetErr(new(bytes.Buffer))
+		root.SetArgs(append([]string{"build-uki", "--config-dir", dir, "--quiet", "--watch"}, args...))
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() {
+			done <- root.ExecuteContext(ctx)
+		}()
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		builds = make(chan build, 10)
+		watch.Debounce = 50 * time.Millisecond
+		Expect(os.MkdirAll(filepath.Join(dir, "overlay"), 0755)).To(Succeed())
+	})
+	AfterEach(func() {
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+		viper.Reset()
+	})
+
+	It("reads the manifest again on every build", func() {
+		writeManifest("arch: amd64\nname: kairos-{{ .arch }}\nlabel: beta\n")
+		start()
+		Eventually(builds).Should(Receive(Equal(build{name: "kairos-amd64", label: "beta"})))
+
+		// The removed settings are gone and the templates are expanded again
+		writeManifest("arch: amd64\nname: edge-{{ .arch }}\n")
+		Eventually(builds).Should(Receive(Equal(build{name: "edge-amd64"})))
+
+		writeManifest("name: final\nlabel: stable\n")
+		Eventually(builds).Should(Receive(Equal(build{name: "final", label: "stable"})))
+	})
+
+	It("only builds the artifacts affected by the changed inputs", func() {
+		writeManifest("name: kairos\n")
+		start("--recovery", "--overlay-iso", filepath.Join(dir, "overlay"))
+		Eventually(builds).Should(Receive(Equal(build{name: "kairos", recovery: true})))
+
+		Expect(os.WriteFile(filepath.Join(dir, "overlay", "motd"), []byte("hi"), 0644)).To(Succeed())
+		Eventually(builds).Should(Receive(Equal(build{name: "kairos", recovery: false})))
+
+		// The manifest affects every artifact
+		writeManifest("name: edge\n")
+		Eventually(builds).Should(Receive(Equal(build{name: "edge", recovery: true})))
+	})
+})
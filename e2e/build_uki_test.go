@@ -21,7 +21,7 @@ var _ = Describe("build-uki", func() {
 		kairosVersion := "v2.5.0"
 		resultDir, err = os.MkdirTemp("", "enki-build-uki-test-")
 		Expect(err).ToNot(HaveOccurred())
-		resultFile = filepath.Join(resultDir, fmt.Sprintf("kairos_%s.iso", kairosVersion))
+		resultFile = filepath.Join(resultDir, fmt.Sprintf("kairos-fedora-38-core-amd64-generic-%s-uki.iso", kairosVersion))
 
 		currentDir, err := os.Getwd()
 		Expect(err).ToNot(HaveOccurred())
@@ -2,12 +2,16 @@ package main
 
 import (
 	"github.com/kairos-io/enki/cmd"
+	"github.com/kairos-io/enki/pkg/sandbox"
 	"log"
 	"os"
 	"os/signal"
 )
 
 func main() {
+	// When re-executed as the sandbox helper this never returns
+	sandbox.Init()
+
 	// Allow catching SIGINT to exit soon
 	go func() {
 		sigchan := make(chan os.Signal)
@@ -0,0 +1,339 @@
+package action
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/workdir"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+)
+
+// enrollmentKeys are the keys the enrollment media enrolls
+var enrollmentKeys = []string{"PK", "KEK", "db"}
+
+// EnrollmentInstructionsFile is the name of the instructions at the root of the enrollment media,
+// also written next to its artifacts
+const EnrollmentInstructionsFile = "ENROLL.txt"
+
+// enrollmentKeysDir is the dir of the media with the keys to enroll from the firmware setup or
+// with KeyTool
+const enrollmentKeysDir = "keys"
+
+// EnrollmentMediaOptions are the settings of the enrollment media
+type EnrollmentMediaOptions struct {
+	// Name is the base name of the artifacts
+	Name string
+	// OutputTypes are the artifacts to create, out of constants.EnrollmentOutputTypes
+	OutputTypes []string
+	// Enroll is the secure-boot-enroll option of systemd-boot: force enrolls the keys after a
+	// countdown, manual only from the boot menu
+	Enroll string
+	// KeyTool is the KeyTool.efi binary added as a boot entry, to enroll the keys by hand
+	KeyTool string
+	// IsoEngine creates the ISO, see iso.Engines
+	IsoEngine string
+}
+
+// EnrollmentMediaAction builds a small bootable media enrolling the Secure Boot keys of a keys dir
+// into the firmware of the machines booting it in setup mode, to provision a fleet with custom keys
+type EnrollmentMediaAction struct {
+	logger        v1.Logger
+	runner        v1.Runner
+	arch          string
+	workdir       string
+	keysDirectory string
+	outputDir     string
+	opts          EnrollmentMediaOptions
+}
+
+func NewEnrollmentMediaAction(cfg *types.BuildConfig, keysDirectory, outputDir string, opts EnrollmentMediaOptions) *EnrollmentMediaAction {
+	return &EnrollmentMediaAction{
+		logger:        logging.Module(cfg.Logger, logging.Sign),
+		runner:        cfg.Runner,
+		arch:          cfg.Arch,
+		workdir:       cfg.Workdirs[workdir.Media],
+		keysDirectory: keysDirectory,
+		outputDir:     outputDir,
+		opts:          opts,
+	}
+}
+
+// Run writes the enrollment media to the output dir, along with its instructions
+func (e *EnrollmentMediaAction) Run() error {
+	if err := e.checkDeps(); err != nil {
+		return err
+	}
+	instructions, err := e.Instructions()
+	if err != nil {
+		return err
+	}
+	sourceDir, err := os.MkdirTemp(e.workdir, "enki-enrollment-media-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(sourceDir)
+	if err = os.MkdirAll(e.outputDir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	loader, err := e.bootloader()
+	if err != nil {
+		return err
+	}
+	if e.signed() {
+		e.logger.Infof("Signing %s with the db key, so the media keeps booting once Secure Boot is enabled", loader)
+	}
+	if err = e.sign(loader, filepath.Join(sourceDir, e.fallbackName())); err != nil {
+		return err
+	}
+	conf := fmt.Sprintf("timeout 10\nsecure-boot-enroll %s\n", e.opts.Enroll)
+	if err = os.WriteFile(filepath.Join(sourceDir, "loader.conf"), []byte(conf), 0644); err != nil {
+		return err
+	}
+	if e.opts.KeyTool != "" {
+		if err = e.sign(e.opts.KeyTool, filepath.Join(sourceDir, filepath.Base(e.opts.KeyTool))); err != nil {
+			return err
+		}
+		entry := fmt.Sprintf("title KeyTool\nefi /%s/%s\n", constants.EfiToolsDir, filepath.Base(e.opts.KeyTool))
+		if err = os.WriteFile(filepath.Join(sourceDir, "keytool.conf"), []byte(entry), 0644); err != nil {
+			return err
+		}
+	}
+	if err = os.WriteFile(filepath.Join(sourceDir, EnrollmentInstructionsFile), []byte(instructions), 0644); err != nil {
+		return err
+	}
+
+	filesMap := e.Files(sourceDir)
+	for _, outputType := range e.opts.OutputTypes {
+		switch outputType {
+		case string(constants.IsoOutput):
+			err = e.createISO(sourceDir, filesMap)
+		case constants.EnrollmentImgOutput:
+			err = e.createImg(filepath.Join(e.outputDir, e.opts.Name+".img"), filesMap)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	instructionsPath := filepath.Join(e.outputDir, e.opts.Name+".txt")
+	if err = os.WriteFile(instructionsPath, []byte(instructions), 0644); err != nil {
+		return err
+	}
+	e.logger.Infof("Wrote the enrollment media to %s, see %s to enroll the keys with it", e.outputDir, instructionsPath)
+	return nil
+}
+
+// Files returns the files of the media, keyed by their dir on it, out of the ones prepared in
+// sourceDir and of the keys dir
+func (e *EnrollmentMediaAction) Files(sourceDir string) map[string][]string {
+	data := map[string][]string{
+		"EFI":              {},
+		"EFI/BOOT":         {filepath.Join(sourceDir, e.fallbackName())},
+		"loader":           {filepath.Join(sourceDir, "loader.conf")},
+		"loader/keys":      {},
+		"loader/keys/auto": {},
+		enrollmentKeysDir:  {},
+		"":                 {filepath.Join(sourceDir, EnrollmentInstructionsFile)},
+	}
+	for _, key := range enrollmentKeys {
+		data["loader/keys/auto"] = append(data["loader/keys/auto"], filepath.Join(e.keysDirectory, key+".auth"))
+		for _, ext := range []string{".auth", ".esl", ".der"} {
+			data[enrollmentKeysDir] = append(data[enrollmentKeysDir], filepath.Join(e.keysDirectory, key+ext))
+		}
+	}
+	if e.opts.KeyTool != "" {
+		data[constants.EfiToolsDir] = []string{filepath.Join(sourceDir, filepath.Base(e.opts.KeyTool))}
+		data["loader/entries"] = []string{filepath.Join(sourceDir, "keytool.conf")}
+	}
+	return data
+}
+
+// Instructions returns how to enroll the keys with the media, listing the certificates it enrolls
+func (e *EnrollmentMediaAction) Instructions() (string, error) {
+	var b strings.Builder
+	b.WriteString("Secure Boot key enrollment media\n\n")
+	b.WriteString("This media enrolls the following Secure Boot keys into the firmware of the machines it boots:\n\n")
+	for _, key := range enrollmentKeys {
+		data, err := os.ReadFile(filepath.Join(e.keysDirectory, key+".der"))
+		if err != nil {
+			return "", failure.New(failure.ErrMissingKeys, err, "generate the secure boot keys with enki genkey and pass their directory with --keys")
+		}
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return "", failure.New(failure.ErrMissingKeys, fmt.Errorf("reading %s.der: %w", key, err), "")
+		}
+		for _, cert := range certs {
+			fmt.Fprintf(&b, "  %-4s %s, expires %s\n", key, cert.Subject, cert.NotAfter.Format("2006-01-02"))
+		}
+	}
+	b.WriteString("\nTo enroll them:\n\n")
+	b.WriteString("1. Put the firmware in setup mode: in its setup, clear the Secure Boot keys or delete the\n")
+	b.WriteString("   Platform Key (PK), usually under a custom or expert Secure Boot mode.\n")
+	switch e.opts.Enroll {
+	case "force":
+		b.WriteString("2. Boot this media. systemd-boot enrolls the keys after a countdown and reboots.\n")
+	default:
+		b.WriteString("2. Boot this media and select the \"Enroll Secure Boot keys: auto\" entry of the boot menu.\n")
+	}
+	b.WriteString("3. Enable Secure Boot in the firmware setup if it isn't yet, and check that the machine\n")
+	b.WriteString("   boots the artifacts signed with the keys.\n\n")
+	if e.opts.KeyTool != "" {
+		b.WriteString("To enroll them by hand, boot the KeyTool entry of the boot menu and in Edit Keys replace the\n")
+		fmt.Fprintf(&b, "db, then the KEK and last the PK with the .auth files of the %s dir of this media.\n\n", enrollmentKeysDir)
+	}
+	fmt.Fprintf(&b, "Firmware enrolling the keys from files can use the ones of the %s dir of this media, as signed\n", enrollmentKeysDir)
+	b.WriteString("updates (.auth), signature lists (.esl) or certificates (.der). Enroll the PK last, it takes\n")
+	b.WriteString("the firmware out of setup mode.\n\n")
+	b.WriteString("The keys the firmware held before are lost: the machines only boot the binaries signed with the\n")
+	b.WriteString("db key above, and with the Microsoft certificates only if enki genkey included them.\n")
+	return b.String(), nil
+}
+
+// checkDeps fails if the tools creating the media or the files it needs are missing
+func (e *EnrollmentMediaAction) checkDeps() error {
+	neededBinaries := []string{"mkfs.msdos", "mmd", "mcopy"}
+	if e.signed() {
+		neededBinaries = append(neededBinaries, "sbsign")
+	}
+	if e.opts.IsoEngine == iso.EngineXorriso && slices.Contains(e.opts.OutputTypes, string(constants.IsoOutput)) {
+		neededBinaries = append(neededBinaries, "xorriso")
+	}
+	for _, b := range neededBinaries {
+		if _, err := exec.LookPath(b); err != nil {
+			return failure.New(failure.ErrMissingDependency, err, deps.Hint(b))
+		}
+	}
+	loader, err := e.bootloader()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(loader); err != nil {
+		return failure.New(failure.ErrMissingDependency, err, "install systemd-boot, packaged as systemd-boot-efi on Debian and Ubuntu")
+	}
+	for _, key := range enrollmentKeys {
+		for _, ext := range []string{".auth", ".esl", ".der"} {
+			if _, err = os.Stat(filepath.Join(e.keysDirectory, key+ext)); err != nil {
+				return failure.Errorf(failure.ErrMissingKeys, "generate the secure boot keys with enki genkey and pass their directory with --keys", "keys directory does not contain required file: %s", key+ext)
+			}
+		}
+	}
+	return nil
+}
+
+// bootloader returns the systemd-boot binary of the arch
+func (e *EnrollmentMediaAction) bootloader() (string, error) {
+	switch {
+	case utils.IsAmd64(e.arch):
+		return constants.UkiSystemdBootx86, nil
+	case utils.IsArm64(e.arch):
+		return constants.UkiSystemdBootArm, nil
+	}
+	return "", fmt.Errorf("unsupported arch: %s", e.arch)
+}
+
+// fallbackName is the name of systemd-boot on the media, at the fallback path the firmware boots
+func (e *EnrollmentMediaAction) fallbackName() string {
+	if utils.IsArm64(e.arch) {
+		return constants.EfiFallbackNameArm
+	}
+	return constants.EfiFallbackNamex86
+}
+
+// signed tells if the EFI binaries of the media get signed with the db key, when the keys dir has
+// it. The firmware boots them unsigned in setup mode anyway.
+func (e *EnrollmentMediaAction) signed() bool {
+	_, err := os.Stat(filepath.Join(e.keysDirectory, "db.key"))
+	return err == nil
+}
+
+// sign writes the EFI binary at source to target, signed with the db key if the keys dir has it
+func (e *EnrollmentMediaAction) sign(source, target string) error {
+	if !e.signed() {
+		return utils.CopyFile(vfs.OSFS, source, target)
+	}
+	out, err := e.runner.Run("sbsign",
+		"--key", filepath.Join(e.keysDirectory, "db.key"),
+		"--cert", filepath.Join(e.keysDirectory, "db.pem"),
+		"--output", target,
+		source,
+	)
+	if err != nil {
+		return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running sbsign for %s: %w\n%s", source, err, string(out))
+	}
+	return nil
+}
+
+// createImg writes the FAT image with the files of the media to imgFile
+func (e *EnrollmentMediaAction) createImg(imgFile string, filesMap map[string][]string) error {
+	sizing, err := utils.NewEspSizing(10, "1MiB", "")
+	if err != nil {
+		return err
+	}
+	fat, err := utils.NewFatOptions("32", "", constants.EnrollmentIsoLabel)
+	if err != nil {
+		return err
+	}
+	fat.ApplyTo(&sizing)
+	size, err := espSize(filesMap, sizing)
+	if err != nil {
+		return err
+	}
+	e.logger.Infof("Creating %s with size %s", imgFile, utils.FormatSize(size))
+	if err = createImgWithSize(imgFile, size); err != nil {
+		return err
+	}
+	if err = createImgDirs(imgFile, filesMap, fat); err != nil {
+		return err
+	}
+	return copyFilesToImg(imgFile, filesMap)
+}
+
+// createISO writes the ISO booting the FAT image of the media in UEFI mode, with the
+// instructions and the keys readable from its root too
+func (e *EnrollmentMediaAction) createISO(sourceDir string, filesMap map[string][]string) error {
+	isoDir, err := os.MkdirTemp(e.workdir, "enki-enrollment-iso-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(isoDir)
+	if err = e.createImg(filepath.Join(isoDir, constants.UkiIsoEfiImage), filesMap); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Join(isoDir, enrollmentKeysDir), constants.DirPerm); err != nil {
+		return err
+	}
+	for dir, files := range map[string][]string{"": filesMap[""], enrollmentKeysDir: filesMap[enrollmentKeysDir]} {
+		for _, f := range files {
+			if err = utils.CopyFile(vfs.OSFS, f, filepath.Join(isoDir, dir, filepath.Base(f))); err != nil {
+				return err
+			}
+		}
+	}
+
+	engine, err := iso.NewEngine(e.opts.IsoEngine, e.runner)
+	if err != nil {
+		return err
+	}
+	output := filepath.Join(e.outputDir, e.opts.Name+".iso")
+	e.logger.Infof("Creating %s with the %s engine", output, e.opts.IsoEngine)
+	return engine.Create(iso.Options{
+		Root:     isoDir,
+		Output:   output,
+		VolumeID: constants.EnrollmentIsoLabel,
+		EFIImage: constants.UkiIsoEfiImage,
+		Joliet:   true,
+	})
+}
@@ -2,31 +2,58 @@ package action
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/kairos-io/enki/internal/version"
+	"github.com/kairos-io/enki/pkg/autoinstall"
+	"github.com/kairos-io/enki/pkg/buildinfo"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/encrypt"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/firmware"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/layerstore"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/microcode"
+	"github.com/kairos-io/enki/pkg/naming"
+	"github.com/kairos-io/enki/pkg/report"
+	"github.com/kairos-io/enki/pkg/sandbox"
+	"github.com/kairos-io/enki/pkg/templating"
+	"github.com/kairos-io/enki/pkg/torrent"
 	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/upload"
 	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/workdir"
+	"github.com/kairos-io/enki/pkg/zsync"
 	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	sdk "github.com/kairos-io/kairos-sdk/utils"
+	"github.com/spf13/viper"
 )
 
 type BuildISOAction struct {
-	cfg  *types.BuildConfig
-	spec *types.LiveISO
-	e    *elemental.Elemental
+	cfg    *types.BuildConfig
+	spec   *types.LiveISO
+	e      *elemental.Elemental
+	report *report.Report
+	// namer names the artifacts once the rootfs is prepared
+	namer *naming.Namer
 }
 
 type BuildISOActionOption func(a *BuildISOAction)
 
 func NewBuildISOAction(cfg *types.BuildConfig, spec *types.LiveISO, opts ...BuildISOActionOption) *BuildISOAction {
 	b := &BuildISOAction{
-		cfg:  cfg,
-		e:    elemental.NewElemental(&cfg.Config),
-		spec: spec,
+		cfg:    cfg,
+		e:      elemental.NewElemental(&cfg.Config),
+		spec:   spec,
+		report: report.New(cfg.Workdirs.Dirs()...),
 	}
 	for _, opt := range opts {
 		opt(b)
@@ -36,10 +63,12 @@ func NewBuildISOAction(cfg *types.BuildConfig, spec *types.LiveISO, opts ...Buil
 
 // ISORun will install the system from a given configuration
 func (b *BuildISOAction) ISORun() (err error) {
+	defer func() { b.finishReport(err) }()
 	cleanup := sdk.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
-	isoTmpDir, err := utils.TempDir(b.cfg.Fs, "", "enki-iso")
+	// The rootfs, uefi and iso dirs share the work area of the rootfs stage
+	isoTmpDir, err := utils.TempDir(b.cfg.Fs, b.cfg.Workdirs[workdir.Rootfs], "enki-iso")
 	if err != nil {
 		return err
 	}
@@ -50,6 +79,8 @@ func (b *BuildISOAction) ISORun() (err error) {
 	if err != nil {
 		return err
 	}
+	// The rootfs may be an overlay over the layer store, which must not be removed through it
+	cleanup.Push(func() error { return layerstore.Release(rootDir) })
 
 	uefiDir := filepath.Join(isoTmpDir, "uefi")
 	err = utils.MkdirAll(b.cfg.Fs, uefiDir, constants.DirPerm)
@@ -63,6 +94,12 @@ func (b *BuildISOAction) ISORun() (err error) {
 		return err
 	}
 
+	// The artifact is streamed from a temporary output dir, so it is only written to disk once
+	stdout := b.cfg.OutDir == utils.Stdout
+	if stdout {
+		b.cfg.OutDir = filepath.Join(isoTmpDir, "output")
+	}
+
 	if b.cfg.OutDir != "" {
 		err = utils.MkdirAll(b.cfg.Fs, b.cfg.OutDir, constants.DirPerm)
 		if err != nil {
@@ -71,20 +108,59 @@ func (b *BuildISOAction) ISORun() (err error) {
 		}
 	}
 
-	b.cfg.Logger.Infof("Preparing squashfs root...")
-	err = b.applySources(rootDir, b.spec.RootFS...)
-	if err != nil {
-		b.cfg.Logger.Errorf("Failed installing OS packages: %v", err)
-		return err
+	var stop func()
+	if b.spec.VerifySourcePolicy != "" {
+		stop = b.report.Start("source verification")
+		verified, err := verifySources(b.cfg.Logger, b.cfg.Runner, b.cfg.Fs, b.cfg.BuildInfo, b.spec.VerifySourcePolicy, b.spec.RootFS...)
+		stop()
+		if err != nil {
+			return err
+		}
+		b.spec.RootFS = verified
 	}
-	err = utils.CreateDirStructure(b.cfg.Fs, rootDir)
+	if b.spec.VulnScan != "" {
+		stop = b.report.Start("vulnerability scan")
+		err = scanVulnerabilities(b.cfg.Logger, b.cfg.Runner, b.spec.VulnScan, b.spec.FailOnSeverity, b.spec.RootFS...)
+		stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	var streamed bool
+	if b.spec.StreamRootfs {
+		if reason := b.streamUnsupported(); reason != "" {
+			b.cfg.Logger.Warnf("Can't stream the rootfs into the squashfs, %s. Falling back to extracting it", reason)
+		} else {
+			streamed = true
+		}
+	}
+
+	if streamed {
+		b.cfg.Logger.Infof("Streaming rootfs into squashfs...")
+		stop = b.report.Start("stream rootfs")
+		err = b.streamRootfs(rootDir, filepath.Join(isoDir, constants.IsoRootFile))
+		stop()
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed streaming rootfs: %v", err)
+			return err
+		}
+	} else {
+		err = b.prepareRootfs(rootDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.namer, err = b.newNamer(rootDir)
 	if err != nil {
-		b.cfg.Logger.Errorf("Failed creating root directory structure: %v", err)
 		return err
 	}
 
 	b.cfg.Logger.Infof("Preparing ISO image root tree...")
+	stop = b.report.Start("extract iso image")
 	err = b.applySources(isoDir, b.spec.Image...)
+	stop()
 	if err != nil {
 		b.cfg.Logger.Errorf("Failed installing ISO image packages: %v", err)
 		return err
@@ -96,16 +172,362 @@ func (b *BuildISOAction) ISORun() (err error) {
 		return err
 	}
 
+	if b.spec.AutoInstall().Enabled() {
+		configFile, err := autoinstall.Write(b.cfg.Fs, isoDir, b.spec.AutoInstall())
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed writing the install config: %v", err)
+			return err
+		}
+		b.cfg.Logger.Infof("Embedded the unattended install config in %s", configFile)
+	}
+	if b.spec.Firmware().Enabled() {
+		configFile, err := firmware.Write(b.cfg.Fs, isoDir, b.spec.Firmware())
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed adding the firmware capsules: %v", err)
+			return err
+		}
+		b.cfg.Logger.Infof("Added %d firmware capsules, applied on the first boot of the installed system by %s", len(b.spec.FirmwareCapsules), configFile)
+	}
+
+	if !streamed {
+		b.cfg.Logger.Info("Creating squashfs...")
+		stop = b.report.Start("create squashfs")
+		err = utils.CreateSquashFSWithProgress(b.cfg.Runner, b.cfg.Logger, rootDir, filepath.Join(isoDir, constants.IsoRootFile), b.squashfsOptions(), b.progress("Creating squashfs"))
+		stop()
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed creating squashfs: %v", err)
+			return err
+		}
+	}
+
+	if b.cfg.BuildInfo != nil {
+		err = b.cfg.BuildInfo.WriteFile(b.cfg.Fs, filepath.Join(isoDir, buildinfo.FileName))
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed writing build info: %v", err)
+			return err
+		}
+	}
+
+	// Artifacts to encrypt and distribute once they are all built
+	var artifacts []string
+	if b.spec.Recovery {
+		recoveryFile, err := b.writeRecovery(isoDir)
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed writing recovery image: %v", err)
+			return err
+		}
+		artifacts = append(artifacts, recoveryFile)
+	}
+
 	b.cfg.Logger.Infof("Creating ISO image...")
-	err = b.burnISO(isoDir)
+	stop = b.report.Start("create iso")
+	isoFile, err := b.burnISO(isoDir)
+	stop()
 	if err != nil {
 		b.cfg.Logger.Errorf("Failed creating ISO image: %v", err)
 		return err
 	}
 
+	if b.spec.Zsync {
+		controlFile, err := zsync.WriteFile(b.cfg.Fs, isoFile)
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed creating zsync control file: %v", err)
+			return err
+		}
+		b.cfg.Logger.Infof("Created zsync control file %s", controlFile)
+	}
+
+	if b.spec.MaxSize != "" {
+		maxSize, _ := utils.ParseSize(b.spec.MaxSize)
+		err = utils.CheckArtifactSize(b.cfg.Fs, isoFile, maxSize, rootDir)
+		if err != nil {
+			b.cfg.Logger.Errorf("ISO image exceeds its size budget: %v", err)
+			return err
+		}
+	}
+
+	artifacts = append(artifacts, isoFile)
+	if b.spec.Encrypt != "" {
+		stop = b.report.Start("encrypt")
+		for i, artifact := range artifacts {
+			artifacts[i], err = encrypt.EncryptFile(b.cfg.Fs, b.spec.Encrypt, b.spec.EncryptKey, artifact)
+			if err != nil {
+				stop()
+				b.cfg.Logger.Errorf("Failed encrypting artifact: %v", err)
+				return err
+			}
+			b.cfg.Logger.Infof("Encrypted %s with %s", artifacts[i], b.spec.Encrypt)
+		}
+		stop()
+	}
+
+	if b.spec.Torrent {
+		stop = b.report.Start("torrent")
+		for _, artifact := range artifacts {
+			torrentFile, magnet, err := torrent.WriteFile(b.cfg.Fs, artifact, torrent.Options{
+				Trackers:     b.spec.TorrentTrackers,
+				WebSeeds:     b.spec.TorrentWebSeeds,
+				CreatedBy:    fmt.Sprintf("enki %s", version.GetVersion()),
+				CreationDate: time.Now(),
+			})
+			if err != nil {
+				stop()
+				b.cfg.Logger.Errorf("Failed creating torrent: %v", err)
+				return err
+			}
+			b.cfg.Logger.Infof("Created torrent %s, magnet link: %s", torrentFile, magnet)
+		}
+		stop()
+	}
+
+	// The artifact written to stdout is streamed from a temporary dir, it is not kept
+	if !stdout {
+		b.cfg.Outputs.Add(b.artifactFiles(artifacts)...)
+	}
+
+	if b.spec.Upload != "" {
+		stop = b.report.Start("upload")
+		err = b.uploadArtifacts(artifacts)
+		stop()
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed uploading artifacts: %v", err)
+			return err
+		}
+	}
+
+	if stdout {
+		b.cfg.Logger.Infof("Writing %s to stdout", filepath.Base(artifacts[len(artifacts)-1]))
+		stop = b.report.Start("stream")
+		err = utils.StreamFile(b.cfg.Fs, artifacts[len(artifacts)-1], os.Stdout)
+		stop()
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed writing to stdout: %v", err)
+			return err
+		}
+	}
+
 	return err
 }
 
+// uploadArtifacts uploads the given artifacts along with their checksum, zsync and torrent files
+func (b BuildISOAction) uploadArtifacts(artifacts []string) error {
+	target, err := upload.ParseTarget(b.spec.Upload)
+	if err != nil {
+		return err
+	}
+	var files []upload.Artifact
+	for _, f := range b.artifactFiles(artifacts) {
+		files = append(files, upload.Artifact{Path: f, Name: filepath.Base(f)})
+	}
+	return upload.Upload(b.cfg.Runner, target, files)
+}
+
+// artifactFiles returns the given artifacts along with the checksum, zsync and torrent files
+// written next to them
+func (b BuildISOAction) artifactFiles(artifacts []string) []string {
+	var files []string
+	for _, artifact := range artifacts {
+		// Checksums and zsync control files are computed before encrypting
+		plain := strings.TrimSuffix(artifact, encrypt.Extension)
+		candidates := []string{artifact, plain + zsync.Extension, artifact + torrent.Extension}
+		for _, algorithm := range b.spec.Checksums {
+			candidates = append(candidates, plain+"."+algorithm)
+		}
+		for _, f := range candidates {
+			if exists, _ := utils.Exists(b.cfg.Fs, f); exists {
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
+
+// prepareRootfs extracts the rootfs sources into rootDir and applies the hooks and prune rules to it
+func (b *BuildISOAction) prepareRootfs(rootDir string) error {
+	b.cfg.Logger.Infof("Preparing squashfs root...")
+	stop := b.report.Start("extract rootfs")
+	err := b.applySources(rootDir, b.spec.RootFS...)
+	stop()
+	if err != nil {
+		b.cfg.Logger.Errorf("Failed installing OS packages: %v", err)
+		return err
+	}
+	err = utils.CreateDirStructure(b.cfg.Fs, rootDir)
+	if err != nil {
+		b.cfg.Logger.Errorf("Failed creating root directory structure: %v", err)
+		return err
+	}
+
+	if b.cfg.BuildInfo != nil {
+		err = b.cfg.BuildInfo.WriteFile(b.cfg.Fs, filepath.Join(rootDir, buildinfo.RootfsPath))
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed writing build info: %v", err)
+			return err
+		}
+	}
+
+	if len(b.spec.Hooks) > 0 {
+		b.cfg.Logger.Infof("Running rootfs hooks...")
+		stop = b.report.Start("rootfs hooks")
+		err = sandbox.RunHooks(b.cfg.Logger, rootDir, b.cfg.Arch, b.spec.Hooks)
+		stop()
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed running rootfs hooks: %v", err)
+			return err
+		}
+	}
+
+	if len(b.spec.Prune) > 0 {
+		b.cfg.Logger.Infof("Pruning rootfs...")
+		rules, err := utils.GetPruneRules(b.spec.Prune)
+		if err != nil {
+			return err
+		}
+		stop = b.report.Start("prune rootfs")
+		results, err := utils.PruneRootfs(b.cfg.Fs, rootDir, rules, b.spec.PruneDryRun)
+		stop()
+		if err != nil {
+			b.cfg.Logger.Errorf("Failed pruning rootfs: %v", err)
+			return err
+		}
+		utils.LogPruneResults(b.cfg.Logger, results, b.spec.PruneDryRun)
+	}
+
+	if b.spec.MaxSize != "" {
+		return b.estimateSize(rootDir)
+	}
+	return nil
+}
+
+// squashfsOptions returns the mksquashfs options for the rootfs
+func (b BuildISOAction) squashfsOptions() []string {
+	if b.spec.HTTPBoot {
+		return constants.GetHTTPBootSquashfsOptions()
+	}
+	return constants.GetDefaultSquashfsOptions()
+}
+
+// streamUnsupported returns why the rootfs can't be streamed, or an empty string if it can
+func (b BuildISOAction) streamUnsupported() string {
+	switch {
+	case len(b.spec.RootFS) != 1:
+		return "it is composed of several sources"
+	case !b.spec.RootFS[0].IsDocker():
+		return "it is not a container image"
+	case len(b.spec.Hooks) > 0:
+		return "rootfs hooks need a real directory"
+	case len(b.spec.Prune) > 0:
+		return "prune profiles need a real directory"
+	}
+	return ""
+}
+
+// streamRootfs packs the rootfs image straight into the squashfs at dest without extracting
+// it. Only the files needed to build the boot media are written into rootDir.
+func (b BuildISOAction) streamRootfs(rootDir, dest string) error {
+	getImage := image.GetImage
+	// The image read from stdin is not in any registry
+	if extractor, ok := b.cfg.ImageExtractor.(image.ArchiveExtractor); ok {
+		getImage = extractor.GetImage
+	}
+	img, err := getImage(b.spec.RootFS[0].Value(), b.cfg.Platform.String())
+	if err != nil {
+		return err
+	}
+	capture := []string{"boot", "etc/os-release", "etc/kairos-release", "usr/lib/os-release"}
+	var fallbacks []image.Fallback
+	// Legacy only media don't need the EFI bootloader
+	if !b.spec.LegacyOnly {
+		shimFiles := sdk.GetEfiShimFiles(b.cfg.Arch)
+		grubFiles := sdk.GetEfiGrubFiles(b.cfg.Arch)
+		capture = append(capture, shimFiles...)
+		capture = append(capture, grubFiles...)
+		fallbacks = append(fallbacks,
+			image.Fallback{Paths: shimFiles, Source: b.fallbackShim(), Dest: shimFiles[0]},
+			image.Fallback{Paths: grubFiles, Source: fallbackGrub, Dest: grubFiles[0]},
+		)
+	}
+	if b.cfg.BuildInfo != nil {
+		// Written next to the capture dir, so it doesn't end up in the ISO root
+		infoFile := filepath.Join(filepath.Dir(rootDir), buildinfo.FileName)
+		if err = b.cfg.BuildInfo.WriteFile(b.cfg.Fs, infoFile); err != nil {
+			return err
+		}
+		fallbacks = append(fallbacks, image.Fallback{Source: infoFile, Dest: buildinfo.RootfsPath})
+	}
+
+	return image.StreamToSquashFS(b.cfg.Runner, img, dest, b.squashfsOptions(), image.StreamOptions{
+		CaptureDir: rootDir,
+		Capture:    image.PathFilter(capture...),
+		// Same layout utils.CreateDirStructure ensures for extracted rootfs
+		Dirs: []image.Dir{
+			{Path: "/run", Mode: constants.DirPerm}, {Path: "/dev", Mode: constants.DirPerm},
+			{Path: "/boot", Mode: constants.DirPerm}, {Path: "/usr/local", Mode: constants.DirPerm},
+			{Path: "/oem", Mode: constants.DirPerm}, {Path: "/proc", Mode: constants.NoWriteDirPerm},
+			{Path: "/sys", Mode: constants.NoWriteDirPerm}, {Path: "/tmp", Mode: constants.TempDirPerm},
+		},
+		// The squashfs can't be modified once streamed, so the fallback bootloader files that
+		// copyShim and copyGrub would add to the rootfs have to be added to the stream instead
+		Fallbacks: fallbacks,
+	})
+}
+
+// finishReport prints the per stage breakdown of the build and writes the JSON result if requested
+func (b *BuildISOAction) finishReport(buildErr error) {
+	if layerstore.Enabled() {
+		b.report.AddCache(layerstore.Usage())
+	}
+	b.report.AddCommands(b.cfg.Transcript.Commands()...)
+	b.report.Log(b.cfg.Logger)
+	if b.cfg.JSONResult != "" {
+		if err := b.report.WriteJSON(b.cfg.Fs, b.cfg.JSONResult, buildErr); err != nil {
+			b.cfg.Logger.Errorf("Failed writing JSON result to %s: %v", b.cfg.JSONResult, err)
+		}
+	}
+}
+
+// estimateSize fails early if the rootfs is unlikely to fit in the configured max-size once
+// packed, before spending the time in mksquashfs and xorriso. The squashfs is compressed, so we
+// can only guess the final size until the ISO has been created, which is checked again.
+func (b BuildISOAction) estimateSize(rootDir string) error {
+	maxSize, err := utils.ParseSize(b.spec.MaxSize)
+	if err != nil {
+		return err
+	}
+	rootfsSize, err := utils.DirSize(b.cfg.Fs, rootDir)
+	if err != nil {
+		return err
+	}
+	// Squashfs with the default compression usually halves the rootfs
+	estimation := rootfsSize / 2
+	b.cfg.Logger.Infof("Estimated ISO size: %s (max-size %s)", utils.FormatSize(estimation), utils.FormatSize(maxSize))
+	if estimation > maxSize {
+		return utils.SizeBudgetError(b.cfg.Fs, "Estimated ISO size", estimation, maxSize, rootDir)
+	}
+	return nil
+}
+
+// copyInitrd copies the initrd of the rootfs at rootDir to target, prepending the microcode of the
+// rootfs unless the initrd already loads it
+func (b BuildISOAction) copyInitrd(rootDir, initrd, target string) error {
+	archive, vendors, err := microcode.Archive(b.cfg.Fs, rootDir, b.spec.Microcode, b.cfg.Arch)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "install the microcode packages in the image, or pass --microcode auto or none")
+	}
+	if len(archive) > 0 {
+		loaded, err := microcode.Loaded(b.cfg.Fs, initrd)
+		if err != nil {
+			return err
+		}
+		if !loaded {
+			b.log(logging.ISO).Infof("Prepending the %s microcode to the initrd", strings.Join(vendors, " and "))
+			return microcode.Prepend(b.cfg.Fs, initrd, target, archive)
+		}
+		b.log(logging.ISO).Infof("The initrd already loads the microcode, leaving it alone")
+	}
+	return utils.CopyFile(b.cfg.Fs, initrd, target)
+}
+
 func (b BuildISOAction) prepareISORoot(isoDir string, rootDir string, uefiDir string) error {
 	kernel, initrd, err := b.e.FindKernelInitrd(rootDir)
 	if err != nil {
@@ -117,31 +539,88 @@ func (b BuildISOAction) prepareISORoot(isoDir string, rootDir string, uefiDir st
 		return err
 	}
 	//TODO document boot/kernel and boot/initrd expectation in bootloader config
-	b.cfg.Logger.Debugf("Copying Kernel file %s to iso root tree", kernel)
+	b.log(logging.ISO).Debugf("Copying Kernel file %s to iso root tree", kernel)
 	err = utils.CopyFile(b.cfg.Fs, kernel, filepath.Join(isoDir, constants.IsoKernelPath))
 	if err != nil {
 		return err
 	}
 
-	b.cfg.Logger.Debugf("Copying initrd file %s to iso root tree", initrd)
-	err = utils.CopyFile(b.cfg.Fs, initrd, filepath.Join(isoDir, constants.IsoInitrdPath))
+	b.log(logging.ISO).Debugf("Copying initrd file %s to iso root tree", initrd)
+	err = b.copyInitrd(rootDir, initrd, filepath.Join(isoDir, constants.IsoInitrdPath))
 	if err != nil {
 		return err
 	}
 
+	if b.spec.LegacyOnly {
+		b.cfg.Logger.Info("Adding isolinux...")
+		return b.createIsolinux(isoDir)
+	}
+
 	b.cfg.Logger.Info("Creating EFI image...")
+	stop := b.report.Start("create efi image")
 	err = b.createEFI(rootDir, isoDir)
+	stop()
 	if err != nil {
 		return err
 	}
 
-	b.cfg.Logger.Info("Creating squashfs...")
-	err = utils.CreateSquashFS(b.cfg.Runner, b.cfg.Logger, rootDir, filepath.Join(isoDir, constants.IsoRootFile), constants.GetDefaultSquashfsOptions())
+	err = b.addEfiTools(isoDir)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return b.writeLoopbackCfg(isoDir)
+}
+
+// writeLoopbackCfg adds the grub config multi-ISO boot tools, like Ventoy, source to boot the
+// ISO file from a drive holding several ones. It is derived from the live grub.cfg, if any.
+func (b BuildISOAction) writeLoopbackCfg(isoDir string) error {
+	grubCfg := filepath.Join(isoDir, constants.GrubPrefixDir, constants.GrubCfg)
+	data, err := b.cfg.Fs.ReadFile(grubCfg)
+	if err != nil {
+		b.cfg.Logger.Warnf("No %s in the ISO image sources, the ISO won't boot from multi-ISO boot tools", filepath.Join(constants.GrubPrefixDir, constants.GrubCfg))
+		return nil
+	}
+	loopbackCfg := filepath.Join(isoDir, iso.LoopbackCfg)
+	if exists, _ := utils.Exists(b.cfg.Fs, loopbackCfg); exists {
+		b.cfg.Logger.Debugf("Keeping the %s of the ISO image sources", iso.LoopbackCfg)
+		return nil
+	}
+	err = utils.MkdirAll(b.cfg.Fs, filepath.Dir(loopbackCfg), constants.DirPerm)
+	if err != nil {
+		return err
+	}
+	return b.cfg.Fs.WriteFile(loopbackCfg, []byte(iso.LoopbackConfig(string(data))), constants.FilePerm)
+}
+
+// addEfiTools copies the optional EFI payloads into the ISO and adds a grub menu entry for each
+func (b BuildISOAction) addEfiTools(isoDir string) error {
+	tools := utils.GetEfiTools(b.spec.EFIShell, b.spec.Memtest, b.cfg.Arch)
+	if len(tools) == 0 {
+		return nil
+	}
+	grubCfg := filepath.Join(isoDir, constants.GrubPrefixDir, constants.GrubCfg)
+	if exists, _ := utils.Exists(b.cfg.Fs, grubCfg); !exists {
+		return fmt.Errorf("can't add the EFI tools boot entries, %s not found in the ISO image sources", filepath.Join(constants.GrubPrefixDir, constants.GrubCfg))
+	}
+	err := utils.MkdirAll(b.cfg.Fs, filepath.Join(isoDir, constants.EfiToolsDir), constants.DirPerm)
+	if err != nil {
+		return err
+	}
+	var entries string
+	for _, tool := range tools {
+		b.cfg.Logger.Infof("Adding %s to the ISO", tool.Title)
+		err = utils.CopyFile(b.cfg.Fs, tool.Source, filepath.Join(isoDir, constants.EfiToolsDir, tool.FileName))
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", tool.Source, err)
+		}
+		entries += fmt.Sprintf(constants.GrubEfiToolEntry, tool.Title, constants.EfiToolsDir, tool.FileName)
+	}
+	data, err := b.cfg.Fs.ReadFile(grubCfg)
+	if err != nil {
+		return err
+	}
+	return b.cfg.Fs.WriteFile(grubCfg, append(data, []byte(entries)...), constants.FilePerm)
 }
 
 // createEFI creates the EFI image that is used for booting
@@ -153,7 +632,7 @@ func (b BuildISOAction) createEFI(rootdir string, isoDir string) error {
 
 	// rootfs /efi dir
 	img := filepath.Join(isoDir, constants.IsoEFIPath)
-	temp, _ := utils.TempDir(b.cfg.Fs, "", "enki-iso")
+	temp, _ := utils.TempDir(b.cfg.Fs, b.cfg.Workdirs[workdir.Media], "enki-iso")
 	err = utils.MkdirAll(b.cfg.Fs, filepath.Join(temp, constants.EfiBootPath), constants.DirPerm)
 	if err != nil {
 		b.cfg.Logger.Errorf("Failed creating temp efi dir: %v", err)
@@ -170,7 +649,11 @@ func (b BuildISOAction) createEFI(rootdir string, isoDir string) error {
 		return err
 	}
 
-	err = b.copyGrub(temp, rootdir)
+	if b.spec.GrubStandalone {
+		err = b.createStandaloneGrub(temp)
+	} else {
+		err = b.copyGrub(temp, rootdir)
+	}
 	if err != nil {
 		return err
 	}
@@ -207,24 +690,26 @@ func (b BuildISOAction) createEFI(rootdir string, isoDir string) error {
 	}
 
 	// Calculate EFI image size based on artifacts
-	efiSize, err := utils.DirSize(b.cfg.Fs, temp)
+	sizing, err := utils.NewEspSizing(b.spec.EspHeadroom, b.spec.EspAlign, b.spec.EspSize)
 	if err != nil {
 		return err
 	}
-	// align efiSize to the next 4MB slot
-	align := int64(4 * 1024 * 1024)
-	efiSizeMB := (efiSize/align*align + align) / (1024 * 1024)
+	fat, err := utils.NewFatOptions(b.spec.EspFat, b.spec.EspClusterSize, b.spec.EspLabel)
+	if err != nil {
+		return err
+	}
+	fat.ApplyTo(&sizing)
+	efiSize, err := utils.DirEspSize(b.cfg.Fs, temp, sizing)
+	if err != nil {
+		return err
+	}
+	b.cfg.Logger.Infof("Creating EFI image of %s", utils.FormatSize(efiSize))
 	// Create the actual efi image
-	err = b.e.CreateFileSystemImage(&v1.Image{
-		File:  img,
-		Size:  uint(efiSizeMB),
-		FS:    constants.EfiFs,
-		Label: constants.EfiLabel,
-	})
+	err = utils.CreateFatImage(b.cfg.Fs, b.cfg.Runner, img, efiSize, fat)
 	if err != nil {
 		return err
 	}
-	b.cfg.Logger.Debugf("EFI image created at %s", img)
+	b.log(logging.EFI).Debugf("EFI image created at %s", img)
 	// copy the files from the temporal efi dir into the EFI image
 	files, err := b.cfg.Fs.ReadDir(temp)
 	if err != nil {
@@ -233,7 +718,7 @@ func (b BuildISOAction) createEFI(rootdir string, isoDir string) error {
 
 	for _, f := range files {
 		// This copies the efi files into the efi img used for the boot
-		b.cfg.Logger.Debugf("Copying %s to %s", filepath.Join(temp, f.Name()), img)
+		b.log(logging.EFI).Debugf("Copying %s to %s", filepath.Join(temp, f.Name()), img)
 		_, err = b.cfg.Runner.Run("mcopy", "-s", "-i", img, filepath.Join(temp, f.Name()), "::")
 		if err != nil {
 			b.cfg.Logger.Errorf("Failed copying %s to %s: %v", filepath.Join(temp, f.Name()), img, err)
@@ -248,7 +733,7 @@ func (b BuildISOAction) createEFI(rootdir string, isoDir string) error {
 // tempdir is the temp dir where the EFI image is generated from
 // rootdir is the rootfs where the shim files are searched for
 func (b BuildISOAction) copyShim(tempdir, rootdir string) error {
-	var fallBackShim string
+	fallBackShim := b.fallbackShim()
 	var err error
 	// Get possible shim file paths
 	shimFiles := sdk.GetEfiShimFiles(b.cfg.Arch)
@@ -257,10 +742,8 @@ func (b BuildISOAction) copyShim(tempdir, rootdir string) error {
 	switch b.cfg.Arch {
 	case constants.ArchAmd64, constants.Archx86:
 		shimDest = filepath.Join(tempdir, constants.ShimEfiDest)
-		fallBackShim = filepath.Join("/efi", constants.EfiBootPath, "bootx64.efi")
 	case constants.ArchArm64:
 		shimDest = filepath.Join(tempdir, constants.ShimEfiArmDest)
-		fallBackShim = filepath.Join("/efi", constants.EfiBootPath, "bootaa64.efi")
 	default:
 		err = fmt.Errorf("not supported architecture: %v", b.cfg.Arch)
 	}
@@ -268,10 +751,10 @@ func (b BuildISOAction) copyShim(tempdir, rootdir string) error {
 	for _, f := range shimFiles {
 		_, err := b.cfg.Fs.Stat(filepath.Join(rootdir, f))
 		if err != nil {
-			b.cfg.Logger.Debugf("skip copying %s: not found", filepath.Join(rootdir, f))
+			b.log(logging.EFI).Debugf("skip copying %s: not found", filepath.Join(rootdir, f))
 			continue
 		}
-		b.cfg.Logger.Debugf("Copying %s to %s", filepath.Join(rootdir, f), shimDest)
+		b.log(logging.EFI).Debugf("Copying %s to %s", filepath.Join(rootdir, f), shimDest)
 		err = utils.CopyFile(
 			b.cfg.Fs,
 			filepath.Join(rootdir, f),
@@ -293,10 +776,10 @@ func (b BuildISOAction) copyShim(tempdir, rootdir string) error {
 			shimDest,
 		)
 		if err != nil {
-			b.cfg.Logger.Debugf("List of shim files searched for in %s: %s", rootdir, shimFiles)
+			b.log(logging.EFI).Debugf("List of shim files searched for in %s: %s", rootdir, shimFiles)
 			return fmt.Errorf("could not find any shim file to copy")
 		}
-		b.cfg.Logger.Debugf("Using fallback shim file %s", fallBackShim)
+		b.log(logging.EFI).Debugf("Using fallback shim file %s", fallBackShim)
 		// Also copy the shim.efi file into the rootfs so the installer can find it. Side effect of
 		// alpine not providing shim/grub.efi and we not providing it from packages anymore
 		_ = utils.MkdirAll(b.cfg.Fs, filepath.Join(rootdir, filepath.Dir(shimFiles[0])), constants.DirPerm)
@@ -306,19 +789,30 @@ func (b BuildISOAction) copyShim(tempdir, rootdir string) error {
 			filepath.Join(rootdir, shimFiles[0]),
 		)
 		if err != nil {
-			b.cfg.Logger.Debugf("Could not copy fallback shim into rootfs from %s to %s", fallBackShim, filepath.Join(rootdir, shimFiles[0]))
+			b.log(logging.EFI).Debugf("Could not copy fallback shim into rootfs from %s to %s", fallBackShim, filepath.Join(rootdir, shimFiles[0]))
 			return fmt.Errorf("could not copy fallback shim into rootfs from %s to %s", fallBackShim, filepath.Join(rootdir, shimFiles[0]))
 		}
 	}
 	return err
 }
 
+// fallbackShim returns the shim file shipped by osbuilder, used when the rootfs provides none
+func (b BuildISOAction) fallbackShim() string {
+	if b.cfg.Arch == constants.ArchArm64 {
+		return filepath.Join("/efi", constants.EfiBootPath, "bootaa64.efi")
+	}
+	return filepath.Join("/efi", constants.EfiBootPath, "bootx64.efi")
+}
+
+// fallbackGrub is the grub file shipped by osbuilder, used when the rootfs provides none
+var fallbackGrub = filepath.Join("/efi", constants.EfiBootPath, "grub.efi")
+
 // copyGrub copies the shim files into the EFI partition
 // tempdir is the temp dir where the EFI image is generated from
 // rootdir is the rootfs where the shim files are searched for
 func (b BuildISOAction) copyGrub(tempdir, rootdir string) error {
 	// this is shipped usually with osbuilder and the files come from livecd/grub2-efi-artifacts
-	var fallBackGrub = filepath.Join("/efi", constants.EfiBootPath, "grub.efi")
+	var fallBackGrub = fallbackGrub
 	var err error
 	// Get possible grub file paths
 	grubFiles := sdk.GetEfiGrubFiles(b.cfg.Arch)
@@ -326,12 +820,12 @@ func (b BuildISOAction) copyGrub(tempdir, rootdir string) error {
 	for _, f := range grubFiles {
 		stat, err := b.cfg.Fs.Stat(filepath.Join(rootdir, f))
 		if err != nil {
-			b.cfg.Logger.Debugf("skip copying %s: not found", filepath.Join(rootdir, f))
+			b.log(logging.EFI).Debugf("skip copying %s: not found", filepath.Join(rootdir, f))
 			continue
 		}
 		// Same name as the source, shim looks for that name. We need to remove the .signed suffix
 		nameDest := filepath.Join(tempdir, "EFI/BOOT", cleanupGrubName(stat.Name()))
-		b.cfg.Logger.Debugf("Copying %s to %s", filepath.Join(rootdir, f), nameDest)
+		b.log(logging.EFI).Debugf("Copying %s to %s", filepath.Join(rootdir, f), nameDest)
 
 		err = utils.CopyFile(
 			b.cfg.Fs,
@@ -354,10 +848,10 @@ func (b BuildISOAction) copyGrub(tempdir, rootdir string) error {
 			filepath.Join(tempdir, "EFI/BOOT/grub.efi"),
 		)
 		if err != nil {
-			b.cfg.Logger.Debugf("List of grub files searched for: %s", grubFiles)
+			b.log(logging.EFI).Debugf("List of grub files searched for: %s", grubFiles)
 			return fmt.Errorf("could not find any grub efi file to copy")
 		}
-		b.cfg.Logger.Debugf("Using fallback grub file %s", fallBackGrub)
+		b.log(logging.EFI).Debugf("Using fallback grub file %s", fallBackGrub)
 		// Also copy the grub.efi file into the rootfs so the installer can find it. Side effect of
 		// alpine not providing shim/grub.efi and we not providing it from packages anymore
 		utils.MkdirAll(b.cfg.Fs, filepath.Join(rootdir, filepath.Dir(grubFiles[0])), constants.DirPerm)
@@ -367,64 +861,278 @@ func (b BuildISOAction) copyGrub(tempdir, rootdir string) error {
 			filepath.Join(rootdir, grubFiles[0]),
 		)
 		if err != nil {
-			b.cfg.Logger.Debugf("Could not copy fallback grub into rootfs from %s to %s", fallBackGrub, filepath.Join(rootdir, grubFiles[0]))
+			b.log(logging.EFI).Debugf("Could not copy fallback grub into rootfs from %s to %s", fallBackGrub, filepath.Join(rootdir, grubFiles[0]))
 			return fmt.Errorf("could not copy fallback shim into rootfs from %s to %s", fallBackGrub, filepath.Join(rootdir, grubFiles[0]))
 		}
 	}
 	return err
 }
 
-func (b BuildISOAction) burnISO(root string) error {
-	cmd := "xorriso"
-	var outputFile string
-	var isoFileName string
+// createStandaloneGrub generates the grub shim loads into the EFI partition tree at tempdir,
+// with all its modules and its config embedded in a memdisk, instead of copying the one of the
+// rootfs. It boots the grub config of the ISO like the BIOS grub does, without loading anything
+// else from the ISO. It is signed with the db key of grub-keys, if given.
+func (b BuildISOAction) createStandaloneGrub(tempdir string) error {
+	var format, name string
+	switch b.cfg.Arch {
+	case constants.ArchAmd64, constants.Archx86:
+		format, name = "x86_64-efi", constants.ShimLoaderNamex86
+	case constants.ArchArm64:
+		format, name = "arm64-efi", constants.ShimLoaderNameArm
+	default:
+		return fmt.Errorf("not supported architecture: %v", b.cfg.Arch)
+	}
+	cfgFile := filepath.Join(tempdir, "grub-standalone.cfg")
+	if err := b.cfg.Fs.WriteFile(cfgFile, []byte(constants.GrubStandaloneCfg), constants.FilePerm); err != nil {
+		return err
+	}
+	defer b.cfg.Fs.Remove(cfgFile)
 
-	if b.cfg.Date {
-		currTime := time.Now()
-		isoFileName = fmt.Sprintf("%s.%s.iso", b.cfg.Name, currTime.Format("20060102"))
-	} else {
-		isoFileName = fmt.Sprintf("%s.iso", b.cfg.Name)
+	dest := filepath.Join(tempdir, constants.EfiBootPath, name)
+	output := dest
+	if b.spec.GrubKeys != "" {
+		output = dest + ".unsigned"
+		defer b.cfg.Fs.Remove(output)
+	}
+	args := []string{"--format", format, "--output", output, "--locales="}
+	if b.spec.GrubSbat != "" {
+		args = append(args, "--sbat", b.spec.GrubSbat)
+	}
+	args = append(args, "boot/grub/grub.cfg="+cfgFile)
+	b.cfg.Logger.Infof("Generating the standalone grub %s", name)
+	mkstandalone := grubMkstandalone()
+	out, err := b.cfg.Runner.Run(mkstandalone, args...)
+	if err != nil {
+		return fmt.Errorf("running %s: %w\n%s", mkstandalone, err, string(out))
+	}
+	if b.spec.GrubKeys == "" {
+		return nil
 	}
 
-	outputFile = isoFileName
-	if b.cfg.OutDir != "" {
-		outputFile = filepath.Join(b.cfg.OutDir, outputFile)
+	b.cfg.Logger.Infof("Signing the standalone grub with the db key of %s", b.spec.GrubKeys)
+	out, err = b.cfg.Runner.Run("sbsign",
+		"--key", filepath.Join(b.spec.GrubKeys, "db.key"),
+		"--cert", filepath.Join(b.spec.GrubKeys, "db.pem"),
+		"--output", dest,
+		output,
+	)
+	if err != nil {
+		return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running sbsign for %s: %w\n%s", name, err, string(out))
+	}
+	return nil
+}
+
+// grubMkstandalone returns the grub-mkstandalone of the host, named grub2-mkstandalone by Fedora
+// and openSUSE
+func grubMkstandalone() string {
+	if _, err := exec.LookPath("grub2-mkstandalone"); err == nil {
+		return "grub2-mkstandalone"
 	}
+	return "grub-mkstandalone"
+}
+
+// isolinuxDirs are where the distros install the BIOS isolinux files of syslinux
+var isolinuxDirs = []string{"/usr/lib/ISOLINUX", "/usr/lib/syslinux/modules/bios", "/usr/lib/syslinux/bios", "/usr/share/syslinux"}
+
+// createIsolinux adds isolinux from the syslinux of the build host to the ISO root, along with
+// its config booting the cmdlines of the live grub config, for legacy only media
+func (b BuildISOAction) createIsolinux(isoDir string) error {
+	if !utils.IsAmd64(b.cfg.Arch) {
+		return failure.Errorf(failure.ErrInvalidConfig, "build x86_64 images for legacy only media", "isolinux doesn't support %s", b.cfg.Arch)
+	}
+	if err := utils.MkdirAll(b.cfg.Fs, filepath.Join(isoDir, constants.IsolinuxDir), constants.DirPerm); err != nil {
+		return err
+	}
+	for _, target := range []string{constants.IsolinuxBootFile, constants.IsolinuxMBR, filepath.Join(constants.IsolinuxDir, "ldlinux.c32")} {
+		var source string
+		for _, dir := range isolinuxDirs {
+			if exists, _ := utils.Exists(b.cfg.Fs, filepath.Join(dir, filepath.Base(target))); exists {
+				source = filepath.Join(dir, filepath.Base(target))
+				break
+			}
+		}
+		if source == "" {
+			return failure.Errorf(failure.ErrMissingDependency, "install syslinux, and isolinux on Debian and Ubuntu",
+				"could not find %s in %s", filepath.Base(target), strings.Join(isolinuxDirs, ", "))
+		}
+		b.log(logging.ISO).Debugf("Copying %s to %s", source, target)
+		if err := utils.CopyFile(b.cfg.Fs, source, filepath.Join(isoDir, target)); err != nil {
+			return err
+		}
+	}
+	grubCfg, _ := b.cfg.Fs.ReadFile(filepath.Join(isoDir, constants.GrubPrefixDir, constants.GrubCfg))
+	cfg := iso.IsolinuxConfig(string(grubCfg), b.spec.Label)
+	return b.cfg.Fs.WriteFile(filepath.Join(isoDir, constants.IsolinuxDir, constants.IsolinuxCfg), []byte(cfg), constants.FilePerm)
+}
+
+// burnISO creates the ISO image from the given root tree and returns the path to it
+func (b BuildISOAction) burnISO(root string) (string, error) {
+	outputFile := b.outputFile("", "iso")
 
 	if exists, _ := utils.Exists(b.cfg.Fs, outputFile); exists {
 		b.cfg.Logger.Warnf("Overwriting already existing %s", outputFile)
 		err := b.cfg.Fs.Remove(outputFile)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	args := []string{
-		"-volid", b.spec.Label, "-joliet", "on", "-padding", "0",
-		"-outdev", outputFile, "-map", root, "/", "-chmod", "0755", "--",
+	engine, err := iso.NewEngine(b.spec.ISOEngine, b.cfg.Runner)
+	if err != nil {
+		return "", err
 	}
-	args = append(args, constants.GetXorrisoBooloaderArgs(root)...)
-
-	out, err := b.cfg.Runner.Run(cmd, args...)
-	b.cfg.Logger.Debugf("Xorriso: %s", string(out))
+	opts := iso.Options{
+		Root:             root,
+		Output:           outputFile,
+		VolumeID:         b.spec.Label,
+		BIOSBootImage:    constants.IsoBootFile,
+		HybridMBR:        constants.IsoHybridMBR,
+		BootCatalog:      constants.IsoBootCatalog,
+		EFIImage:         constants.IsoEFIPath,
+		RockRidge:        b.spec.RockRidge,
+		Joliet:           b.spec.Joliet,
+		RelocateDeepDirs: b.spec.RelocateDeepDirs,
+	}
+	if b.spec.LegacyOnly {
+		opts.BIOSBootImage = constants.IsolinuxBootFile
+		opts.HybridMBR = constants.IsolinuxMBR
+		opts.BootCatalog = constants.IsolinuxBootCatalog
+		opts.EFIImage = ""
+		opts.Isolinux = true
+	}
+	err = engine.Create(opts)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	checksum, err := utils.CalcFileChecksum(b.cfg.Fs, outputFile)
+	// The ISO engines can't be hashed while they write: the native writer fills the volume
+	// descriptors in last and xorriso writes the file on its own. The image is read once for
+	// all the algorithms instead.
+	sums, err := utils.CalcFileChecksums(b.cfg.Fs, outputFile, b.spec.Checksums...)
 	if err != nil {
-		return fmt.Errorf("checksum computation failed: %w", err)
+		return "", fmt.Errorf("checksum computation failed: %w", err)
+	}
+	if err = b.writeChecksums(outputFile, sums); err != nil {
+		return "", err
 	}
-	err = b.cfg.Fs.WriteFile(fmt.Sprintf("%s.sha256", outputFile), []byte(fmt.Sprintf("%s %s\n", checksum, isoFileName)), 0644)
+	return outputFile, nil
+}
+
+// newNamer returns the namer of the artifacts of the image in rootDir
+func (b BuildISOAction) newNamer(rootDir string) (*naming.Namer, error) {
+	set, err := templating.ParseSet(viper.GetStringSlice("set"))
 	if err != nil {
-		return fmt.Errorf("cannot write checksum file: %w", err)
+		return nil, failure.New(failure.ErrInvalidConfig, err, "give the --set values as key=value")
+	}
+	opts := naming.Options{Name: b.cfg.Name, Arch: b.cfg.Arch, Template: b.cfg.NameTemplate, Set: set}
+	if b.cfg.Date {
+		opts.Date = time.Now()
+		if b.cfg.BuildInfo != nil {
+			opts.Date = b.cfg.BuildInfo.BuildDate
+		}
+	}
+	namer := naming.New(b.cfg.Logger, b.cfg.Fs, rootDir, opts)
+	if _, err = namer.Name("", "iso"); err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "check the name and name-template settings")
 	}
+	return namer, nil
+}
 
+// outputFile returns the path of the artifact of the given type and extension in the output dir
+func (b BuildISOAction) outputFile(artifactType, ext string) string {
+	// The names were checked when creating the namer
+	name, _ := b.namer.Name(artifactType, ext)
+	if b.cfg.OutDir != "" {
+		return filepath.Join(b.cfg.OutDir, name)
+	}
+	return name
+}
+
+// writeChecksums writes a checksum file of the given artifact next to it for each configured
+// algorithm, named after the algorithm
+func (b BuildISOAction) writeChecksums(file string, sums *utils.ChecksumWriter) error {
+	for _, algorithm := range b.spec.Checksums {
+		checksum, err := sums.Sum(algorithm, b.spec.ChecksumFormat)
+		if err != nil {
+			return fmt.Errorf("checksum computation failed: %w", err)
+		}
+		err = b.cfg.Fs.WriteFile(fmt.Sprintf("%s.%s", file, algorithm), []byte(fmt.Sprintf("%s %s\n", checksum, filepath.Base(file))), 0644)
+		if err != nil {
+			return fmt.Errorf("cannot write checksum file: %w", err)
+		}
+		b.cfg.Logger.Infof("%s checksum of %s: %s", algorithm, filepath.Base(file), checksum)
+	}
 	return nil
 }
 
+// writeRecovery copies the rootfs squashfs of the ISO into the output dir. It is the same image
+// the installer puts on the recovery partition, so it can be used to upgrade the recovery system.
+func (b BuildISOAction) writeRecovery(isoDir string) (string, error) {
+	recoveryFile := b.outputFile(naming.TypeRecovery, "squashfs")
+	b.cfg.Logger.Infof("Writing the recovery image to %s", recoveryFile)
+	sums, err := b.copyWithChecksums(filepath.Join(isoDir, constants.IsoRootFile), recoveryFile)
+	if err != nil {
+		return "", err
+	}
+	return recoveryFile, b.writeChecksums(recoveryFile, sums)
+}
+
+// log returns the logger tagging the logs with the module
+func (b BuildISOAction) log(module string) v1.Logger {
+	return logging.Module(b.cfg.Logger, module)
+}
+
+// progress returns the progress callback of the named operation, nil unless progress is enabled
+func (b BuildISOAction) progress(name string) utils.ProgressFunc {
+	if !b.spec.Progress {
+		return nil
+	}
+	return utils.LogProgress(b.cfg.Logger, name)
+}
+
+// copyWithChecksums copies source to target computing the checksums of the copy on the way
+func (b BuildISOAction) copyWithChecksums(source, target string) (*utils.ChecksumWriter, error) {
+	in, err := b.cfg.Fs.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	out, err := b.cfg.Fs.Create(target)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := utils.NewChecksumWriter(utils.NewProgressWriter(out, info.Size(), b.progress(fmt.Sprintf("Writing %s", filepath.Base(target)))), b.spec.Checksums...)
+	if err == nil {
+		_, err = io.Copy(sums, in)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = b.cfg.Fs.Remove(target)
+		return nil, err
+	}
+	return sums, nil
+}
+
 func (b BuildISOAction) applySources(target string, sources ...*v1.ImageSource) error {
 	for _, src := range sources {
+		if src.IsDir() {
+			// Copied natively rather than with rsync, keeping xattrs and copying concurrently
+			err := utils.CopyTree(b.cfg.Fs, src.Value(), target, utils.CopyOptions{
+				Exclude:  constants.GetDirSourceExcludes(),
+				Progress: b.progress(fmt.Sprintf("Copying %s", src.Value())),
+				Workers:  b.cfg.Limits.Workers(),
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		_, err := b.e.DumpSource(target, src)
 		if err != nil {
 			return err
@@ -0,0 +1,135 @@
+package action
+
+import (
+	"path"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/espmerge"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/templating"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/spf13/viper"
+)
+
+// EntryPreview is a boot entry of the menu build-uki creates
+type EntryPreview struct {
+	Title string `json:"title" yaml:"title"`
+	// Cmdline is the kernel cmdline of the entry, empty for the EFI tools
+	Cmdline string `json:"cmdline,omitempty" yaml:"cmdline,omitempty"`
+	// EFI is the binary the entry boots, relative to the ESP. The entries of the bls
+	// boot-entry-type all boot the same kernel.
+	EFI string `json:"efi" yaml:"efi"`
+	// Conf is the loader entry, relative to the ESP
+	Conf    string `json:"conf" yaml:"conf"`
+	Default bool   `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// OutputPreview is an artifact build-uki creates
+type OutputPreview struct {
+	Type string `json:"type" yaml:"type"`
+	// Path is the file or dir of the artifact, relative to the output dir
+	Path string `json:"path" yaml:"path"`
+}
+
+// UKIPreview is what build-uki creates with the given settings, to review the boot menu without
+// building it
+type UKIPreview struct {
+	Entries []EntryPreview `json:"entries" yaml:"entries"`
+	// DefaultEntry is the loader entry selected by default, which may be a glob pattern given with
+	// default-entry
+	DefaultEntry string          `json:"default_entry" yaml:"default-entry"`
+	Outputs      []OutputPreview `json:"outputs" yaml:"outputs"`
+}
+
+// Preview returns the boot entries and the artifacts the build would create, without pulling the
+// source image. Its release values, used by the templates and the names of the artifacts, are
+// only the ones given with --set, and the defaults the source image may ship are not applied.
+func (b *BuildUKIAction) Preview() (*UKIPreview, error) {
+	if err := b.expandSettings(templating.Vars{}); err != nil {
+		return nil, err
+	}
+	if err := b.setNamer(""); err != nil {
+		return nil, err
+	}
+	if err := b.checkEfiTools(); err != nil {
+		return nil, err
+	}
+	entries := b.bootEntries()
+	if err := utils.CheckBootEntries(entries); err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "give each single-efi-cmdline a title, or use different cmdlines")
+	}
+
+	preview := &UKIPreview{DefaultEntry: b.defaultEntry()}
+	roles := b.abRoles()
+	for _, entry := range entries {
+		if len(roles) == 0 || !strings.HasPrefix(entry.FileName, constants.ArtifactBaseName) {
+			preview.addEntry(entry, b.blsRole(entry))
+			continue
+		}
+		// Laid out like createABLayout does
+		for _, role := range roles {
+			roleEntry := entry
+			roleEntry.FileName = roleName(entry.FileName, role)
+			roleEntry.Title = roleTitle(entry.Title, role)
+			preview.addEntry(roleEntry, role)
+		}
+	}
+	for _, tool := range b.efiTools() {
+		if tool.Title == "" {
+			continue
+		}
+		preview.Entries = append(preview.Entries, EntryPreview{
+			Title: tool.Title,
+			EFI:   path.Join(constants.EfiToolsDir, tool.FileName),
+			Conf:  path.Join("loader/entries", strings.TrimSuffix(tool.FileName, ".efi")+".conf"),
+		})
+	}
+	for i, entry := range preview.Entries {
+		if matched, _ := path.Match(preview.DefaultEntry, path.Base(entry.Conf)); matched {
+			preview.Entries[i].Default = true
+			break
+		}
+	}
+
+	for _, outputType := range b.outputTypes {
+		output := OutputPreview{Type: outputType}
+		switch outputType {
+		case string(constants.IsoOutput):
+			output.Path = b.isoName()
+		case string(constants.ContainerOutput):
+			output.Path = b.artifactName("tar")
+			if viper.GetBool("push") {
+				output.Path = viper.GetString("container-image")
+			}
+		case string(constants.DefaultOutput):
+			output.Path = "."
+		case string(constants.EspDirOutput):
+			output.Path = constants.EspDir
+		case string(constants.EspOverlayOutput):
+			output.Path = espmerge.Dir
+		}
+		preview.Outputs = append(preview.Outputs, output)
+		// The UKIs and their entries go to their own dir for an XBOOTLDR partition
+		if outputType == string(constants.EspDirOutput) && viper.GetBool("xbootldr") {
+			preview.Outputs = append(preview.Outputs, OutputPreview{Type: outputType, Path: constants.XbootldrDir})
+		}
+	}
+	return preview, nil
+}
+
+// addEntry adds the loader entry of entry, booting its UKI or with the bls boot-entry-type the
+// kernel of role
+func (p *UKIPreview) addEntry(entry utils.BootEntry, role string) {
+	efi := path.Join("EFI/kairos", entry.EfiName())
+	if bootEntryBLS() {
+		kernel, _ := blsFiles(role)
+		efi = path.Join("EFI/kairos", kernel)
+	}
+	p.Entries = append(p.Entries, EntryPreview{
+		Title:   entry.Title,
+		Cmdline: entry.Cmdline,
+		EFI:     efi,
+		Conf:    path.Join("loader/entries", entry.ConfName()),
+	})
+}
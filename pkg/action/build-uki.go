@@ -4,18 +4,56 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
-
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/kairos-io/enki/internal/version"
+	"github.com/kairos-io/enki/pkg/audit"
+	"github.com/kairos-io/enki/pkg/autoinstall"
+	"github.com/kairos-io/enki/pkg/buildinfo"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/encrypt"
+	"github.com/kairos-io/enki/pkg/espmerge"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/firmware"
+	"github.com/kairos-io/enki/pkg/flavor"
+	"github.com/kairos-io/enki/pkg/history"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/layerstore"
+	"github.com/kairos-io/enki/pkg/lock"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/microcode"
+	"github.com/kairos-io/enki/pkg/naming"
+	"github.com/kairos-io/enki/pkg/report"
+	"github.com/kairos-io/enki/pkg/sandbox"
+	"github.com/kairos-io/enki/pkg/scan"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	"github.com/kairos-io/enki/pkg/signer"
+	"github.com/kairos-io/enki/pkg/templating"
+	"github.com/kairos-io/enki/pkg/torrent"
+	"github.com/kairos-io/enki/pkg/transcript"
+	"github.com/kairos-io/enki/pkg/trust"
+	"github.com/kairos-io/enki/pkg/upload"
+	"github.com/kairos-io/enki/pkg/vulnscan"
+	"github.com/kairos-io/enki/pkg/workdir"
+	"github.com/kairos-io/enki/pkg/zsync"
 	"github.com/klauspost/compress/zstd"
 	"github.com/sanity-io/litter"
 	"github.com/spf13/viper"
+	"github.com/twpayne/go-vfs"
 	"github.com/u-root/u-root/pkg/cpio"
 	"golang.org/x/exp/maps"
 
@@ -23,6 +61,7 @@ import (
 	"github.com/kairos-io/enki/pkg/utils"
 	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdk "github.com/kairos-io/kairos-sdk/utils"
 )
 
 type BuildUKIAction struct {
@@ -31,33 +70,128 @@ type BuildUKIAction struct {
 	outputDir     string
 	keysDirectory string
 	logger        v1.Logger
-	outputType    string
+	runner        v1.Runner
+	outputTypes   []string
 	version       string
 	arch          string
+	jsonResult    string
+	buildInfo     *buildinfo.Info
+	report        *report.Report
+	// transcript records the external commands of the build, for the JSON result
+	transcript *transcript.Recorder
+	// outputs records the artifacts written to the output dir, for the build history
+	outputs *history.Outputs
+	// workdirs is where the work area of each stage lives
+	workdirs workdir.Placement
+	// settings has the cmdline and boot entry settings, with their templates expanded
+	settings *viper.Viper
+	// defaults are the settings of the source image defaults not given with flags or the config
+	// file, see flavor.Defaults
+	defaults map[string]any
+	// namer names the artifacts once the source values are known
+	namer *naming.Namer
+	// getImage returns the source image to extract, see extractImage
+	getImage func(imageRef, platformRef string) (gcrv1.Image, error)
+	platform string
+	cosign   bool
+	// signRequests are the signatures requested from the machine holding the db key, when the
+	// EFI binaries are not signed by the build itself
+	signRequests *secureboot.SignRequests
+	// signer is the signing service signing the requests, they are emitted if nil
+	signer *signer.Client
 }
 
-func NewBuildUKIAction(cfg *types.BuildConfig, img *v1.ImageSource, outputDir, keysDirectory, outputType string) *BuildUKIAction {
+func NewBuildUKIAction(cfg *types.BuildConfig, img *v1.ImageSource, outputDir, keysDirectory string, outputTypes []string) *BuildUKIAction {
 	b := &BuildUKIAction{
 		logger:        cfg.Logger,
+		runner:        cfg.Runner,
 		img:           img,
 		e:             elemental.NewElemental(&cfg.Config),
 		outputDir:     outputDir,
 		keysDirectory: keysDirectory,
-		outputType:    outputType,
+		outputTypes:   outputTypes,
 		arch:          cfg.Arch,
+		jsonResult:    cfg.JSONResult,
+		buildInfo:     cfg.BuildInfo,
+		report:        report.New(cfg.Workdirs.Dirs()...),
+		transcript:    cfg.Transcript,
+		outputs:       cfg.Outputs,
+		workdirs:      cfg.Workdirs,
+		settings:      viper.GetViper(),
+		getImage:      image.GetImage,
+		platform:      cfg.Platform.String(),
+		cosign:        cfg.Cosign,
+	}
+	// The image read from stdin is not in any registry
+	if extractor, ok := cfg.ImageExtractor.(image.ArchiveExtractor); ok {
+		b.getImage = extractor.GetImage
 	}
 	b.logger.Debugf("BuildUKIAction: %+v", litter.Sdump(b))
 	return b
 }
 
-func (b *BuildUKIAction) Run() error {
-	err := b.checkDeps()
+func (b *BuildUKIAction) Run() (err error) {
+	defer func() { b.finishReport(err) }()
+	err = b.checkDeps()
 	if err != nil {
 		return err
 	}
+	if err = b.checkEfiTools(); err != nil {
+		return err
+	}
+	// The artifact is streamed from a temporary output dir, so it is only written to disk once
+	stdout := b.outputDir == utils.Stdout
+	if stdout {
+		if b.outputDir, err = os.MkdirTemp("", "enki-build-uki-output-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(b.outputDir)
+		// Nothing is kept in the temporary output dir
+		b.outputs = nil
+	}
+	if dir := viper.GetString("apply-signatures"); dir != "" {
+		return b.applySignatures(dir, stdout)
+	}
+	if dir := viper.GetString("emit-sign-requests"); dir != "" {
+		if b.signRequests, err = secureboot.NewSignRequests(dir, b.img.String()); err != nil {
+			return failure.New(failure.ErrInvalidConfig, err, "pass a new dir to emit the sign requests to")
+		}
+	} else if uri := viper.GetString("signer"); uri != "" {
+		if b.signer, err = signer.New(uri, viper.GetString("signer-cert"), viper.GetString("signer-key")); err != nil {
+			return failure.New(failure.ErrInvalidConfig, err, signerHint)
+		}
+		dir, err := os.MkdirTemp("", "enki-sign-requests-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if b.signRequests, err = secureboot.NewSignRequests(dir, b.img.String()); err != nil {
+			return err
+		}
+	}
+	if policy := viper.GetString("verify-source-policy"); policy != "" {
+		stop := b.report.Start("source verification")
+		verified, err := verifySources(b.logger, b.runner, vfs.OSFS, b.buildInfo, policy, b.img)
+		stop()
+		if err != nil {
+			return err
+		}
+		b.img = verified[0]
+	}
+	if err = b.checkStubsSbat(); err != nil {
+		return err
+	}
+	if name := viper.GetString("vuln-scan"); name != "" {
+		stop := b.report.Start("vulnerability scan")
+		err = scanVulnerabilities(b.logger, b.runner, name, viper.GetString("fail-on-severity"), b.img)
+		stop()
+		if err != nil {
+			return err
+		}
+	}
 	// artifactsTempDir Is where we copy the kernel and initramfs files
 	// So only artifacts that are needed to build the efi, so we dont pollute the sourceDir
-	artifactsTempDir, err := os.MkdirTemp("", "enki-build-uki-artifacts-")
+	artifactsTempDir, err := os.MkdirTemp(b.workdirs[workdir.Artifacts], "enki-build-uki-artifacts-")
 	if err != nil {
 		return err
 	}
@@ -66,23 +200,77 @@ func (b *BuildUKIAction) Run() error {
 	// Source dir is the directory where we extract the image
 	// It should only contain the image files and whatever changes we add or remove like creating dir or removing leftover
 	// lets not pollute it
+	stop := b.report.Start("extract image")
 	sourceDir, err := b.extractImage()
+	stop()
+	defer func() {
+		// The rootfs may be an overlay over the layer store, which must not be removed through it
+		if err := layerstore.Release(sourceDir); err != nil {
+			b.logger.Errorf("releasing the rootfs overlay: %s", err)
+		}
+		_ = os.RemoveAll(sourceDir)
+	}()
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(sourceDir)
 
 	if viper.GetString("overlay-rootfs") != "" {
 		b.logger.Infof("Adding files from %s to rootfs", viper.GetString("overlay-rootfs"))
-		overlay, err := v1.NewSrcFromURI(fmt.Sprintf("dir:%s", viper.GetString("overlay-rootfs")))
+		stop = b.report.Start("overlay rootfs")
+		err = utils.CopyTree(vfs.OSFS, viper.GetString("overlay-rootfs"), sourceDir, utils.CopyOptions{Exclude: constants.GetDirSourceExcludes()})
+		stop()
+
 		if err != nil {
-			b.logger.Errorf("error creating overlay image: %s", err)
+			b.logger.Errorf("error copying overlay image: %s", err)
 			return err
 		}
-		_, err = b.e.DumpSource(sourceDir, overlay)
+	}
 
+	if hooks := viper.GetStringSlice("rootfs-hook"); len(hooks) > 0 {
+		b.logger.Info("Running rootfs hooks")
+		stop = b.report.Start("rootfs hooks")
+		err = sandbox.RunHooks(b.logger, sourceDir, b.arch, hooks)
+		stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := b.readDefaults(sourceDir); err != nil {
+		return err
+	}
+
+	if profiles := b.pruneProfiles(); len(profiles) > 0 {
+		b.logger.Info("Pruning the rootfs")
+		rules, err := utils.GetPruneRules(profiles)
+		if err != nil {
+			return err
+		}
+		dryRun := viper.GetBool("prune-dry-run")
+		stop = b.report.Start("prune rootfs")
+		results, err := utils.PruneRootfs(vfs.OSFS, sourceDir, rules, dryRun)
+		stop()
+		if err != nil {
+			return err
+		}
+		utils.LogPruneResults(b.logger, results, dryRun)
+	}
+
+	if spec := viper.GetString("scan"); spec != "" {
+		stop = b.report.Start("scan rootfs")
+		err = b.scanRootfs(sourceDir, spec)
+		stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	if checks := viper.GetStringSlice("audit"); len(checks) > 0 {
+		b.logger.Info("Auditing the rootfs")
+		stop = b.report.Start("audit rootfs")
+		err = b.auditRootfs(sourceDir, checks)
+		stop()
 		if err != nil {
-			b.logger.Errorf("error copying overlay image: %s", err)
 			return err
 		}
 	}
@@ -94,11 +282,25 @@ func (b *BuildUKIAction) Run() error {
 	}
 	b.version = kairosVersion
 
+	if err := b.expandTemplates(sourceDir); err != nil {
+		return err
+	}
+	if err := b.setNamer(sourceDir); err != nil {
+		return err
+	}
+
 	b.logger.Info("Creating additional directories in the rootfs")
 	if err := b.setupDirectoriesAndFiles(sourceDir); err != nil {
 		return err
 	}
 
+	if b.buildInfo != nil {
+		b.logger.Info("Writing build info")
+		if err := b.writeBuildInfo(sourceDir, artifactsTempDir); err != nil {
+			return err
+		}
+	}
+
 	b.logger.Info("Copying kernel")
 	if err := b.copyKernel(sourceDir, artifactsTempDir); err != nil {
 		return err
@@ -108,22 +310,62 @@ func (b *BuildUKIAction) Run() error {
 	b.cleanSource(sourceDir)
 
 	b.logger.Info("Creating an initramfs file")
-	if err := b.createInitramfs(sourceDir, artifactsTempDir); err != nil {
+	stop = b.report.Start("create initramfs")
+	err = b.createInitramfs(sourceDir, artifactsTempDir)
+	stop()
+	if err != nil {
 		return err
 	}
 
-	entries := append(utils.GetUkiCmdline(), utils.GetUkiSingleCmdlines(b.logger)...)
-	for _, entry := range entries {
-		b.logger.Info(fmt.Sprintf("Running ukify for cmdline: %s: %s", entry.Title, entry.Cmdline))
+	if err := b.estimateSize(sourceDir, artifactsTempDir); err != nil {
+		return err
+	}
 
-		b.logger.Infof("Generating: " + entry.FileName + ".efi")
-		if err := b.ukify(sourceDir, artifactsTempDir, entry.Cmdline, entry.FileName+".efi"); err != nil {
-			return err
+	entries := b.bootEntries()
+	if err := utils.CheckBootEntries(entries); err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "give each single-efi-cmdline a title, or use different cmdlines")
+	}
+	for _, entry := range entries {
+		warnings, err := utils.CheckCmdline(entry, viper.GetString("media-type"))
+		if err != nil {
+			return failure.New(failure.ErrInvalidConfig, err, "check the extend-cmdline, extra-cmdline, single-efi-cmdline and recovery-cmdline values")
+		}
+		for _, warning := range warnings {
+			b.logger.Warnf("%s", warning)
 		}
-		b.logger.Info("Creating kairos and loader conf files")
-		if err := b.createConfFiles(sourceDir, entry.Cmdline, entry.Title, entry.FileName); err != nil {
+	}
+	if bootEntryBLS() {
+		stop = b.report.Start("boot entries")
+		err = b.createBLSFiles(sourceDir, artifactsTempDir, entries)
+		stop()
+		if err != nil {
 			return err
 		}
+	} else {
+		stop = b.report.Start("ukify")
+		defer stop()
+		for _, entry := range entries {
+			b.logger.Info(fmt.Sprintf("Running ukify for cmdline: %s: %s", entry.Title, entry.Cmdline))
+
+			b.logger.Infof("Generating: " + entry.EfiName())
+			if err := b.ukify(sourceDir, artifactsTempDir, entry.Cmdline, entry.EfiName()); err != nil {
+				return err
+			}
+			b.logger.Info("Creating kairos and loader conf files")
+			if err := b.createConfFiles(sourceDir, entry, constants.ArtifactBaseName); err != nil {
+				return err
+			}
+		}
+
+		stop()
+	}
+
+	if err := b.createABLayout(sourceDir, entries); err != nil {
+		return err
+	}
+
+	if err := b.createToolConfFiles(sourceDir); err != nil {
+		return err
 	}
 
 	err = b.createSystemdConf(sourceDir)
@@ -132,195 +374,631 @@ func (b *BuildUKIAction) Run() error {
 	}
 
 	b.logger.Info("Signing artifacts")
-	if err := b.sbSign(sourceDir); err != nil {
+	stop = b.report.Start("sign")
+	err = b.sbSign(sourceDir)
+	stop()
+	if err != nil {
 		return err
 	}
 
-	switch b.outputType {
-	case string(constants.IsoOutput):
-		err = b.createISO(sourceDir)
-		b.logger.Infof("Done building %s at: %s", b.outputType, b.outputDir)
-	case string(constants.ContainerOutput):
-		// First create the files
-		err = b.createArtifact(sourceDir)
-		if err != nil {
+	// The outputs are created once the signatures are applied
+	if b.signer != nil {
+		if err := b.signWithSigner(sourceDir); err != nil {
 			return err
 		}
-		// Then build the image
+	} else if b.signRequests != nil {
+		return b.emitSignRequests(sourceDir)
+	}
+	return b.createOutputs(sourceDir, stdout)
+}
 
-		err = b.createContainer(b.outputDir, kairosVersion)
+// createOutputs creates the artifacts of every output type out of the signed files of
+// sourceDir, uploading them and streaming the one written to stdout
+func (b *BuildUKIAction) createOutputs(sourceDir string, stdout bool) (err error) {
+	if err := b.addRevocations(sourceDir); err != nil {
+		return err
+	}
+
+	// All the outputs are created from the same signed files
+	for _, outputType := range b.outputTypes {
+		stop := b.report.Start(fmt.Sprintf("create %s", outputType))
+		err = b.createOutput(sourceDir, outputType)
+		stop()
 		if err != nil {
 			return err
 		}
-		//Then remove the output dir files as we dont need them, the container has been loaded
-		err = b.removeUkiFiles()
+	}
+
+	if b.outputs != nil {
+		files, err := b.outputFiles(sourceDir)
 		if err != nil {
 			return err
 		}
-	case string(constants.DefaultOutput):
-		err = b.createArtifact(sourceDir)
-		if err != nil {
-			return err
+		for _, f := range files {
+			b.outputs.Add(f.Path)
 		}
-		b.logger.Infof("Done building %s at: %s", b.outputType, b.outputDir)
 	}
 
-	return err
-}
+	if err == nil && viper.GetString("upload") != "" {
+		stop := b.report.Start("upload")
+		err = b.uploadArtifacts(sourceDir)
+		stop()
+	}
 
-// createSystemdConf creates the generic conf that systemd-boot uses
-func (b *BuildUKIAction) createSystemdConf(sourceDir string) error {
-	var finalEfiConf string
-	entry := viper.GetString("default-entry")
-	if entry != "" {
-		if !strings.HasSuffix(entry, ".conf") {
-			finalEfiConf = strings.TrimSuffix(entry, " ") + ".conf"
-		} else {
-			finalEfiConf = entry
+	if err == nil && stdout {
+		artifact := filepath.Join(b.outputDir, b.artifactName("tar"))
+		if b.outputTypes[0] == string(constants.IsoOutput) {
+			artifact = filepath.Join(b.outputDir, b.isoName())
+			if viper.GetString("encrypt") != "" {
+				artifact += encrypt.Extension
+			}
 		}
-
-	} else {
-		// Get the generic efi file that we produce from the default cmdline
-		// This is the one name that has nothing added, just the version
-		finalEfiConf = utils.NameFromCmdline(constants.ArtifactBaseName, constants.UkiCmdline+" "+constants.UkiCmdlineInstall) + ".conf"
+		b.logger.Infof("Writing %s to stdout", filepath.Base(artifact))
+		stop := b.report.Start("stream")
+		err = utils.StreamFile(vfs.OSFS, artifact, os.Stdout)
+		stop()
 	}
 
-	secureBootEnroll := viper.GetString("secure-boot-enroll")
-	// Set that as default selection for booting
-	data := fmt.Sprintf("default %s\ntimeout 5\nconsole-mode max\neditor no\nsecure-boot-enroll %s\n", finalEfiConf, secureBootEnroll)
-	err := os.WriteFile(filepath.Join(sourceDir, "loader.conf"), []byte(data), os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("creating the loader.conf file: %s", err)
-	}
-	return nil
+	return err
 }
 
-func (b *BuildUKIAction) extractImage() (string, error) {
-	tmpDir, err := os.MkdirTemp("", "enki-build-uki-")
+// scanRootfs scans the rootfs with the scanner of spec and records the result in the build info.
+// Findings fail the build unless the scan-policy is warn.
+func (b *BuildUKIAction) scanRootfs(sourceDir, spec string) error {
+	scanner, err := scan.New(spec)
 	if err != nil {
-		return tmpDir, err
+		return failure.New(failure.ErrInvalidConfig, err, "")
 	}
-
-	// By default MkdirTemp creates the dir with 0700 permissions, this results in an unusable system because all other users cannot access the sockets.
-	err = os.Chmod(tmpDir, 0755)
+	b.logger.Infof("Scanning the rootfs with %s", spec)
+	result, err := scanner.Run(sourceDir)
 	if err != nil {
-		return tmpDir, err
+		return err
+	}
+	if b.buildInfo != nil {
+		b.buildInfo.Scan = result
 	}
+	if result.Clean() {
+		b.logger.Info("The rootfs scan found nothing")
+		return nil
+	}
+	for _, finding := range result.Findings {
+		b.logger.Warnf("Scan finding: %s", finding)
+	}
+	if viper.GetString("scan-policy") == scan.PolicyWarn {
+		return nil
+	}
+	return failure.Errorf(failure.ErrVerification, "remove the flagged files from the image, or pass --scan-policy warn if they are false positives",
+		"the rootfs scan found %d infected files", len(result.Findings))
+}
 
-	_, err = b.e.DumpSource(tmpDir, b.img)
+// resolveDigest returns the digest of the manifest of a container image, replaced in tests
+var resolveDigest lock.Resolver = lock.ResolveRemote
 
-	return tmpDir, err
+// verifySources verifies the signatures of the container image sources against the trust policy
+// in policyPath before building anything from them, and records their provenance attestations in
+// info. Dirs and files are the content of the builder itself and are not verified. Each image is
+// resolved to its digest once, the signature of that digest is the one verified, and the sources
+// returned are pinned to it so the build extracts the very image verified, even if its tag moves.
+func verifySources(logger v1.Logger, runner v1.Runner, fs v1.FS, info *buildinfo.Info, policyPath string, sources ...*v1.ImageSource) ([]*v1.ImageSource, error) {
+	policy, err := trust.Load(fs, policyPath)
+	if err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	for _, binary := range policy.Binaries() {
+		if _, err := exec.LookPath(binary); err != nil {
+			return nil, failure.New(failure.ErrMissingDependency, err, deps.Hint(binary))
+		}
+	}
+	verified := slices.Clone(sources)
+	for i, src := range sources {
+		if !src.IsDocker() {
+			logger.Warnf("%s is not a container image, building it without verifying its signature", src.String())
+			continue
+		}
+		ref, err := pinnedRef(src.Value())
+		if err != nil {
+			return nil, failure.New(failure.ErrVerification, err, "check the source image exists and its registry is reachable")
+		}
+		verified[i] = v1.NewDockerSrc(ref)
+		result, err := policy.Verify(runner, ref)
+		if err != nil {
+			return nil, failure.New(failure.ErrVerification, err, "build from an image signed as the trust policy requires")
+		}
+		if result.Verifier == "" {
+			logger.Warnf("%s matches no rule of the trust policy, building it without verifying its signature", src.Value())
+			continue
+		}
+		logger.Infof("Verified the %s signature of %s as %s", result.Verifier, src.Value(), ref)
+		if p := result.Provenance; p != nil {
+			logger.Infof("Verified the provenance of %s, built by %s", src.Value(), p.Builder)
+			if info != nil {
+				info.AddProvenance(src.String(), p)
+			}
+		}
+	}
+	return verified, nil
 }
 
-func (b *BuildUKIAction) checkDeps() error {
-	neededBinaries := []string{
-		"/usr/lib/systemd/ukify",
-		"sbsign",
-		"dd",
-		"mkfs.msdos",
-		"mmd",
-		"mcopy",
-		"xorriso",
+// pinnedRef returns the image ref pinned to the digest it currently resolves to, as is if it is
+// pinned already
+func pinnedRef(ref string) (string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := r.(name.Digest); ok {
+		return ref, nil
 	}
+	digest, err := resolveDigest(ref)
+	if err != nil {
+		return "", err
+	}
+	return r.Context().Digest(digest).String(), nil
+}
 
-	for _, b := range neededBinaries {
-		_, err := exec.LookPath(b)
+// scanVulnerabilities scans the source images with the named vulnerability scanner before
+// anything is built from them. Vulnerabilities of the failOn severity or higher fail the build,
+// they are only logged if failOn is empty.
+func scanVulnerabilities(logger v1.Logger, runner v1.Runner, name, failOn string, sources ...*v1.ImageSource) error {
+	scanner, err := vulnscan.New(name, runner)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	if _, err := exec.LookPath(scanner.Binary()); err != nil {
+		return failure.New(failure.ErrMissingDependency, err, deps.Hint(scanner.Binary()))
+	}
+	threshold := vulnscan.SeverityHigh
+	if failOn != "" {
+		if threshold, err = vulnscan.ParseSeverity(failOn); err != nil {
+			return failure.New(failure.ErrInvalidConfig, err, "")
+		}
+	}
+	var failing []vulnscan.Vulnerability
+	for _, src := range sources {
+		logger.Infof("Scanning %s for vulnerabilities with %s", src.String(), name)
+		vulns, err := scanner.Scan(src)
 		if err != nil {
 			return err
 		}
+		found := vulnscan.AtLeast(vulns, threshold)
+		for _, v := range found {
+			logger.Warnf("Vulnerability in %s: %s", src.String(), v)
+		}
+		logger.Infof("Found %d vulnerabilities in %s, %d of %s severity or higher", len(vulns), src.String(), len(found), threshold)
+		failing = append(failing, found...)
+	}
+	if failOn != "" && len(failing) > 0 {
+		return failure.Errorf(failure.ErrVerification, "update the vulnerable packages of the source image, or raise fail-on-severity",
+			"found %d vulnerabilities of %s severity or higher in the source images, the first one: %s", len(failing), threshold, failing[0])
 	}
+	return nil
+}
 
-	neededFiles, err := b.getEfiNeededFiles()
+// auditRootfs runs the audit checks over the rootfs and writes the findings to the audit-report.
+// Findings of the audit-fail-on severity or higher fail the build.
+func (b *BuildUKIAction) auditRootfs(sourceDir string, checks []string) error {
+	findings, err := audit.Run(vfs.OSFS, sourceDir, checks)
 	if err != nil {
 		return err
 	}
+	audit.LogFindings(b.logger, findings)
+	if reportFile := viper.GetString("audit-report"); reportFile != "" {
+		if err = audit.WriteReport(vfs.OSFS, reportFile, findings); err != nil {
+			return err
+		}
+		b.logger.Infof("Audit report written to %s", reportFile)
+	}
+	failOn := viper.GetString("audit-fail-on")
+	if failOn == "" {
+		return nil
+	}
+	severity, err := audit.ParseSeverity(failOn)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	if failing := audit.AtLeast(findings, severity); len(failing) > 0 {
+		return failure.Errorf(failure.ErrVerification, "fix the findings in the image, or raise audit-fail-on",
+			"the rootfs audit found %d findings of %s severity or higher, the first one: %s: %s", len(failing), severity, failing[0].Path, failing[0].Message)
+	}
+	return nil
+}
 
-	for _, b := range neededFiles {
-		_, err := os.Stat(b)
+// createOutput creates the artifact of the given output type from the signed files in sourceDir
+func (b *BuildUKIAction) createOutput(sourceDir, outputType string) error {
+	switch outputType {
+	case string(constants.IsoOutput):
+		if err := b.createISO(sourceDir); err != nil {
+			return err
+		}
+		b.logger.Infof("Done building %s at: %s", outputType, filepath.Join(b.outputDir, b.isoName()))
+	case string(constants.ContainerOutput):
+		return b.createContainer(sourceDir, b.version)
+	case string(constants.DefaultOutput):
+		if err := b.createArtifact(sourceDir, b.outputDir); err != nil {
+			return err
+		}
+		b.logger.Infof("Done building %s at: %s", outputType, b.outputDir)
+	case string(constants.EspDirOutput):
+		trees, err := b.espDirTrees(sourceDir)
 		if err != nil {
 			return err
 		}
+		for dir, filesMap := range trees {
+			if err := b.copyImageFiles(filesMap, filepath.Join(b.outputDir, dir)); err != nil {
+				return err
+			}
+			b.logger.Infof("Done building %s at: %s", outputType, filepath.Join(b.outputDir, dir))
+		}
+	case string(constants.EspOverlayOutput):
+		if err := b.createEspOverlay(sourceDir); err != nil {
+			return err
+		}
+		b.logger.Infof("Done building %s at: %s", outputType, filepath.Join(b.outputDir, espmerge.Dir))
+	default:
+		return fmt.Errorf("invalid output type: %s", outputType)
 	}
-
 	return nil
 }
 
-func (b *BuildUKIAction) setupDirectoriesAndFiles(tmpDir string) error {
-	if err := os.Symlink("/usr/bin/immucore", filepath.Join(tmpDir, "init")); err != nil {
-		return fmt.Errorf("error creating symlink: %w", err)
+// createEspOverlay writes the ESP files, with the boot loader out of the fallback path, to copy
+// into an existing ESP, along with the instructions to add the firmware boot entry booting them
+func (b *BuildUKIAction) createEspOverlay(sourceDir string) error {
+	filesMap, err := b.imageFiles(sourceDir)
+	if err != nil {
+		return err
 	}
-
-	// able to mount oem under here if found
-	if err := os.MkdirAll(filepath.Join(tmpDir, "oem"), os.ModeDir); err != nil {
-		return fmt.Errorf("error creating /oem dir: %w", err)
+	overlay := espmerge.Overlay(filesMap)
+	if err = b.copyImageFiles(overlay, filepath.Join(b.outputDir, espmerge.Dir)); err != nil {
+		return err
 	}
-
-	// mount the esp under here if found
-	if err := os.MkdirAll(filepath.Join(tmpDir, "efi"), os.ModeDir); err != nil {
-		return fmt.Errorf("error creating /oem dir: %w", err)
+	var files []string
+	for dir, sources := range overlay {
+		for _, f := range sources {
+			files = append(files, path.Join(dir, filepath.Base(f)))
+		}
 	}
-
-	// for install/upgrade they copy stuff there
-	if err := os.MkdirAll(filepath.Join(tmpDir, "usr/local/cloud-config"), os.ModeDir); err != nil {
-		return fmt.Errorf("error creating /oem dir: %w", err)
+	loader := path.Join(espmerge.LoaderDir, filepath.Base(filesMap["EFI/BOOT"][0]))
+	instructions := espmerge.NewInstructions(b.settings.GetString("boot-branding"), loader, files)
+	if err = instructions.Write(filepath.Join(b.outputDir, espmerge.InstructionsFile)); err != nil {
+		return err
+	}
+	b.logger.Infof("Copy %s into the ESP and add its boot entry, as described in %s", filepath.Join(b.outputDir, espmerge.Dir), filepath.Join(b.outputDir, espmerge.InstructionsFile))
+	b.logger.Infof("From Linux, with the disk and partition number of the ESP: %s", strings.Join(instructions.Efibootmgr, " "))
+	b.logger.Infof("From Windows, with the identifier bcdedit /copy prints: %s", strings.Join(bcdeditCommands(instructions.Bcdedit), " && "))
+	if !shimMok() && viper.GetString("secure-boot-enroll") != "off" {
+		b.logger.Warnf("systemd-boot enrolls the keys on machines in setup mode, Windows only boots afterwards if they include the Microsoft certificates")
 	}
-
 	return nil
 }
 
-// createInitramfs creates a compressed initramfs file (cpio format, gzipped).
-// The resulting file is named "initrd" and is saved inthe sourceDir.
-func (b *BuildUKIAction) createInitramfs(sourceDir, artifactsTempDir string) error {
-	format := "newc"
-	archiver, err := cpio.Format(format)
-	if err != nil {
-		return fmt.Errorf("format %q not supported: %w", format, err)
+// bcdeditCommands joins the args of each bcdedit command
+func bcdeditCommands(commands [][]string) []string {
+	var joined []string
+	for _, args := range commands {
+		joined = append(joined, strings.Join(args, " "))
 	}
+	return joined
+}
 
-	cpioFileName := filepath.Join(artifactsTempDir, "initramfs.cpio")
-	cpioFile, err := os.Create(cpioFileName)
+// uploadArtifacts uploads the ISO and the ESP files of the created outputs to the upload target
+func (b *BuildUKIAction) uploadArtifacts(sourceDir string) error {
+	target, err := upload.ParseTarget(viper.GetString("upload"))
 	if err != nil {
-		return fmt.Errorf("creating cpio file: %w", err)
+		return err
 	}
-	defer cpioFile.Close()
-
-	rw := archiver.Writer(cpioFile)
-	cr := cpio.NewRecorder()
-
-	// List of directories to exclude
-	excludeDirs := map[string]bool{
-		"sys":  true,
-		"run":  true,
-		"dev":  true,
-		"tmp":  true,
-		"proc": true,
+	files, err := b.outputFiles(sourceDir)
+	if err != nil {
+		return err
 	}
+	return upload.Upload(b.runner, target, files)
+}
 
-	if err = os.Chdir(sourceDir); err != nil {
-		return fmt.Errorf("changing to %s directory: %w", sourceDir, err)
+// outputFiles returns the ISO and the ESP files of the created outputs in the output dir
+func (b *BuildUKIAction) outputFiles(sourceDir string) ([]upload.Artifact, error) {
+	var files []upload.Artifact
+	for _, outputType := range b.outputTypes {
+		switch outputType {
+		case string(constants.IsoOutput):
+			artifact := filepath.Join(b.outputDir, b.isoName())
+			for _, f := range []string{artifact, artifact + zsync.Extension, artifact + encrypt.Extension, artifact + encrypt.Extension + torrent.Extension, artifact + torrent.Extension} {
+				if _, err := os.Stat(f); err == nil {
+					files = append(files, upload.Artifact{Path: f, Name: filepath.Base(f)})
+				}
+			}
+		case string(constants.DefaultOutput), string(constants.EspDirOutput), string(constants.EspOverlayOutput):
+			trees := map[string]map[string][]string{}
+			var err error
+			switch outputType {
+			case string(constants.EspDirOutput):
+				trees, err = b.espDirTrees(sourceDir)
+			case string(constants.EspOverlayOutput):
+				var filesMap map[string][]string
+				filesMap, err = b.imageFiles(sourceDir)
+				trees[espmerge.Dir] = espmerge.Overlay(filesMap)
+				files = append(files, upload.Artifact{Path: filepath.Join(b.outputDir, espmerge.InstructionsFile), Name: espmerge.InstructionsFile})
+			default:
+				trees[""], err = b.imageFiles(sourceDir)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for prefix, filesMap := range trees {
+				for dir, sources := range filesMap {
+					for _, f := range sources {
+						name := filepath.Join(prefix, dir, filepath.Base(f))
+						files = append(files, upload.Artifact{Path: filepath.Join(b.outputDir, name), Name: name})
+					}
+				}
+			}
+		}
 	}
+	return files, nil
+}
 
-	// Walk through the source directory and add files to the cpio archive
-	err = filepath.Walk(".", func(filePath string, fileInfo os.FileInfo, err error) error {
-		if err != nil {
+// setNamer sets the namer of the artifacts from the release values of the image in sourceDir
+func (b *BuildUKIAction) setNamer(sourceDir string) error {
+	set, err := templating.ParseSet(viper.GetStringSlice("set"))
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "give the --set values as key=value")
+	}
+	opts := naming.Options{Name: viper.GetString("name"), Arch: b.arch, Template: viper.GetString(naming.TemplateKey), Set: set}
+	if viper.GetBool("date") {
+		opts.Date = time.Now()
+		if b.buildInfo != nil {
+			opts.Date = b.buildInfo.BuildDate
+		}
+	}
+	if sourceDir != "" {
+		b.namer = naming.New(b.logger, vfs.OSFS, sourceDir, opts)
+	} else {
+		// Previews name the artifacts with the --set values only, the image is not pulled
+		b.namer = naming.FromRelease(templating.Vars{}, opts)
+	}
+	if _, err = b.namer.Name(naming.TypeUKI, "iso"); err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "check the name and name-template settings")
+	}
+	return nil
+}
+
+// artifactName returns the file name of the artifact with the given extension
+func (b *BuildUKIAction) artifactName(ext string) string {
+	// The names were checked when setting the namer
+	name, _ := b.namer.Name(naming.TypeUKI, ext)
+	return name
+}
+
+// isoName returns the file name of the ISO artifact
+func (b *BuildUKIAction) isoName() string {
+	return b.artifactName("iso")
+}
+
+// finishReport prints the per stage breakdown of the build and writes the JSON result if requested
+func (b *BuildUKIAction) finishReport(buildErr error) {
+	if layerstore.Enabled() {
+		b.report.AddCache(layerstore.Usage())
+	}
+	b.report.AddCommands(b.transcript.Commands()...)
+	b.report.Log(b.logger)
+	if b.jsonResult != "" {
+		if err := b.report.WriteJSON(vfs.OSFS, b.jsonResult, buildErr); err != nil {
+			b.logger.Errorf("Failed writing JSON result to %s: %v", b.jsonResult, err)
+		}
+	}
+}
+
+// createSystemdConf creates the generic conf that systemd-boot uses
+func (b *BuildUKIAction) createSystemdConf(sourceDir string) error {
+	finalEfiConf := b.defaultEntry()
+	secureBootEnroll := viper.GetString("secure-boot-enroll")
+	if shimMok() {
+		// There are no keys to enroll, shim trusts the MOK instead
+		secureBootEnroll = "off"
+	}
+	// Set that as default selection for booting
+	data := fmt.Sprintf("default %s\ntimeout 5\nconsole-mode max\neditor no\nsecure-boot-enroll %s\n", finalEfiConf, secureBootEnroll)
+	err := os.WriteFile(filepath.Join(sourceDir, "loader.conf"), []byte(data), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("creating the loader.conf file: %s", err)
+	}
+	return nil
+}
+
+// defaultEntry returns the loader entry selected by default in the boot menu, which may be a
+// glob pattern given with default-entry
+func (b *BuildUKIAction) defaultEntry() string {
+	entry := b.settings.GetString("default-entry")
+	if entry != "" {
+		if !strings.HasSuffix(entry, ".conf") {
+			return strings.TrimSuffix(entry, " ") + ".conf"
+		}
+		return entry
+	}
+	// Boot the entry of the default cmdline of the media-type, or the extended one
+	for _, e := range b.bootEntries() {
+		if e.Default {
+			// With an A/B layout the installer entries are gone, boot the active system instead
+			if len(b.abRoles()) > 0 {
+				return roleName(e.FileName, constants.ActiveRole) + ".conf"
+			}
+			return e.ConfName()
+		}
+	}
+	return ""
+}
+
+func (b *BuildUKIAction) extractImage() (string, error) {
+	tmpDir, err := os.MkdirTemp(b.workdirs[workdir.Rootfs], "enki-build-uki-")
+	if err != nil {
+		return tmpDir, err
+	}
+
+	// By default MkdirTemp creates the dir with 0700 permissions, this results in an unusable system because all other users cannot access the sockets.
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		return tmpDir, err
+	}
+
+	// The initrds of the image are dropped by cleanSource, as the rootfs becomes the initrd of the
+	// UKI, so container images are extracted without them. Cosign verification is done by
+	// DumpSource only, and the layer store materializes whole layers.
+	if !b.img.IsDocker() || b.cosign || layerstore.Enabled() {
+		_, err = b.e.DumpSource(tmpDir, b.img)
+		return tmpDir, err
+	}
+	img, err := b.getImage(b.img.Value(), b.platform)
+	if err != nil {
+		return tmpDir, err
+	}
+	return tmpDir, image.ExtractWithout(img, tmpDir, imageInitrd)
+}
+
+// imageInitrd tells if the rootfs path is an initrd of the image, built by its distro for booting
+// the rootfs from disk rather than as the initrd of the UKI
+func imageInitrd(path string) bool {
+	dir, name := filepath.Split(path)
+	return dir == "boot/" && (strings.HasPrefix(name, "initrd") || strings.HasPrefix(name, "initramfs"))
+}
+
+func (b *BuildUKIAction) checkDeps() error {
+	neededBinaries := []string{
+		"sbsign",
+		"dd",
+		"mkfs.msdos",
+		"mmd",
+		"mcopy",
+	}
+	if !bootEntryBLS() {
+		neededBinaries = append(neededBinaries, "/usr/lib/systemd/ukify")
+	}
+	if viper.GetString("iso-engine") == iso.EngineXorriso && slices.Contains(b.outputTypes, string(constants.IsoOutput)) {
+		neededBinaries = append(neededBinaries, "xorriso")
+	}
+	if uri := viper.GetString("upload"); uri != "" {
+		target, err := upload.ParseTarget(uri)
+		if err != nil {
+			return err
+		}
+		neededBinaries = append(neededBinaries, target.Command())
+	}
+	if viper.GetString("timestamp-url") != "" {
+		neededBinaries = append(neededBinaries, secureboot.TimestampTool)
+	}
+	if viper.GetString("emit-sign-requests") != "" || viper.GetString("apply-signatures") != "" || viper.GetString("signer") != "" {
+		neededBinaries = append(neededBinaries, secureboot.DetachedSignTool)
+	}
+	if spec := viper.GetString("scan"); spec != "" {
+		scanner, err := scan.New(spec)
+		if err != nil {
+			return failure.New(failure.ErrInvalidConfig, err, "")
+		}
+		neededBinaries = append(neededBinaries, scanner.Binary())
+	}
+
+	for _, b := range neededBinaries {
+		_, err := exec.LookPath(b)
+		if err != nil {
+			return failure.New(failure.ErrMissingDependency, err, deps.Hint(b))
+		}
+	}
+
+	neededFiles, err := b.getEfiNeededFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range neededFiles {
+		_, err := os.Stat(b)
+		if err != nil {
+			return failure.New(failure.ErrMissingDependency, err, "install systemd-boot, packaged as systemd-boot-efi on Debian and Ubuntu")
+		}
+	}
+
+	if shimMok() {
+		if _, err := b.shimFiles(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *BuildUKIAction) setupDirectoriesAndFiles(tmpDir string) error {
+	if err := os.Symlink("/usr/bin/immucore", filepath.Join(tmpDir, "init")); err != nil {
+		return fmt.Errorf("error creating symlink: %w", err)
+	}
+
+	// able to mount oem under here if found
+	if err := os.MkdirAll(filepath.Join(tmpDir, "oem"), os.ModeDir); err != nil {
+		return fmt.Errorf("error creating /oem dir: %w", err)
+	}
+
+	// mount the esp under here if found
+	if err := os.MkdirAll(filepath.Join(tmpDir, "efi"), os.ModeDir); err != nil {
+		return fmt.Errorf("error creating /oem dir: %w", err)
+	}
+
+	// for install/upgrade they copy stuff there
+	if err := os.MkdirAll(filepath.Join(tmpDir, "usr/local/cloud-config"), os.ModeDir); err != nil {
+		return fmt.Errorf("error creating /oem dir: %w", err)
+	}
+
+	return nil
+}
+
+// createInitramfs creates a compressed initramfs file (cpio format, gzipped).
+// The resulting file is named "initrd" and is saved inthe sourceDir.
+func (b *BuildUKIAction) createInitramfs(sourceDir, artifactsTempDir string) error {
+	format := "newc"
+	archiver, err := cpio.Format(format)
+	if err != nil {
+		return fmt.Errorf("format %q not supported: %w", format, err)
+	}
+
+	cpioFileName := filepath.Join(artifactsTempDir, "initramfs.cpio")
+	cpioFile, err := os.Create(cpioFileName)
+	if err != nil {
+		return fmt.Errorf("creating cpio file: %w", err)
+	}
+	defer cpioFile.Close()
+
+	rw := archiver.Writer(cpioFile)
+	cr := cpio.NewRecorder()
+
+	// List of directories to exclude
+	excludeDirs := map[string]bool{
+		"sys":  true,
+		"run":  true,
+		"dev":  true,
+		"tmp":  true,
+		"proc": true,
+	}
+
+	// Walk through the source directory and add files to the cpio archive, named relative to it.
+	// The working dir is left alone, builds for other platforms may be running.
+	err = filepath.Walk(sourceDir, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sourceDir, filePath)
+		if err != nil {
 			return err
 		}
 
 		// Check if the current directory should be excluded
-		if fileInfo.IsDir() && excludeDirs[filePath] {
+		if fileInfo.IsDir() && excludeDirs[relPath] {
 			return filepath.SkipDir
 		}
 
-		if strings.Contains(filePath, "initramfs.cpio") {
+		if strings.Contains(relPath, "initramfs.cpio") {
 			return nil
 		}
 
 		rec, err := cr.GetRecord(filePath)
 		if err != nil {
-			return fmt.Errorf("getting record of %q failed: %w", filePath, err)
+			return fmt.Errorf("getting record of %q failed: %w", relPath, err)
 		}
 
-		rec.Name = strings.TrimPrefix(rec.Name, sourceDir)
+		rec.Name = relPath
 		if err := rw.WriteRecord(rec); err != nil {
 			return fmt.Errorf("writing record %q failed: %w", filePath, err)
 		}
@@ -335,9 +1013,27 @@ func (b *BuildUKIAction) createInitramfs(sourceDir, artifactsTempDir string) err
 		return fmt.Errorf("error writing trailer record: %w", err)
 	}
 
-	if err := ZstdFile(cpioFileName, filepath.Join(artifactsTempDir, "initrd")); err != nil {
+	// The kernel only loads the microcode from an uncompressed archive at the start of the initrd
+	archive, vendors, err := microcode.Archive(vfs.OSFS, sourceDir, viper.GetString("microcode"), b.arch)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "install the microcode packages in the image, or pass --microcode auto or none")
+	}
+	initrd := filepath.Join(artifactsTempDir, "initrd")
+	if len(archive) > 0 {
+		initrd = filepath.Join(artifactsTempDir, "initrd.zst")
+	}
+	if err := ZstdFile(cpioFileName, initrd); err != nil {
 		return err
 	}
+	if len(archive) > 0 {
+		b.logger.Infof("Prepending the %s microcode to the initrd", strings.Join(vendors, " and "))
+		if err := microcode.Prepend(vfs.OSFS, initrd, filepath.Join(artifactsTempDir, "initrd"), archive); err != nil {
+			return err
+		}
+		if err := os.Remove(initrd); err != nil {
+			return err
+		}
+	}
 
 	if err := os.RemoveAll(cpioFileName); err != nil {
 		return fmt.Errorf("error deleting cpio file: %w", err)
@@ -357,127 +1053,725 @@ func (b *BuildUKIAction) copyKernel(sourceDir, targetDir string) error {
 	if err != nil {
 		return err
 	}
-	defer sourceFile.Close()
+	defer sourceFile.Close()
+
+	destinationFile, err := os.Create(filepath.Join(targetDir, "vmlinuz"))
+	if err != nil {
+		return err
+	}
+	defer destinationFile.Close()
+	b.logger.Infof("Copying kernel from: %s to: %s", sourceFile.Name(), destinationFile.Name())
+	_, err = io.Copy(destinationFile, sourceFile)
+
+	return err
+}
+
+// writeBuildInfo stores the build info in the rootfs, and in artifactsTempDir for the UKI section
+func (b *BuildUKIAction) writeBuildInfo(sourceDir, artifactsTempDir string) error {
+	if err := b.buildInfo.WriteFile(vfs.OSFS, filepath.Join(sourceDir, buildinfo.RootfsPath)); err != nil {
+		return fmt.Errorf("writing build info: %w", err)
+	}
+	if err := b.buildInfo.WriteFile(vfs.OSFS, filepath.Join(artifactsTempDir, buildinfo.FileName)); err != nil {
+		return fmt.Errorf("writing build info: %w", err)
+	}
+	return nil
+}
+
+func (b *BuildUKIAction) ukify(sourceDir, artifactsTempDir, cmdline, finalEfiName string) error {
+	stubFile, err := b.getEfiStub()
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--linux", filepath.Join(artifactsTempDir, "vmlinuz"),
+		"--initrd", filepath.Join(artifactsTempDir, "initrd"),
+		"--cmdline", cmdline,
+		"--os-release", fmt.Sprintf("@%s", "etc/os-release"),
+		"--stub", stubFile,
+		"--measure",
+		"--output", finalEfiName,
+	}
+	if b.signer != nil {
+		// The signer signs the PCR policies once the UKI is built, only their public key is here
+		args = append(args, "--pcrpkey", filepath.Join(b.keysDirectory, pcrPublicKey))
+	} else {
+		// The sign requests only cover the EFI binaries, the PCR policies are signed here
+		args = append(args, "--pcr-private-key", filepath.Join(b.keysDirectory, "tpm2-pcr-private.pem"))
+	}
+	if b.signRequests == nil {
+		args = append(args,
+			"--secureboot-private-key", filepath.Join(b.keysDirectory, "db.key"),
+			"--secureboot-certificate", filepath.Join(b.keysDirectory, "db.pem"),
+		)
+	}
+	if sbat := viper.GetString("sbat"); sbat != "" {
+		// ukify runs from the rootfs dir
+		path, err := filepath.Abs(sbat)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--sbat", "@"+path)
+	}
+	if b.buildInfo != nil {
+		args = append(args, "--section", fmt.Sprintf("%s:@%s", buildinfo.UKISection, filepath.Join(artifactsTempDir, buildinfo.FileName)))
+	}
+	if err = b.runUkify(sourceDir, args); err != nil {
+		return err
+	}
+	if b.signer != nil {
+		if err = b.signPCRPolicies(sourceDir, artifactsTempDir, finalEfiName, args); err != nil {
+			return err
+		}
+	}
+
+	if b.signRequests != nil {
+		if err := b.signRequests.Add(b.runner, sourceDir, filepath.Join(sourceDir, finalEfiName)); err != nil {
+			return err
+		}
+	} else if err := b.timestamp(filepath.Join(sourceDir, finalEfiName)); err != nil {
+		return err
+	}
+
+	// check size of the efi file
+	fi, err := os.Stat(filepath.Join(sourceDir, finalEfiName))
+	if err != nil {
+		return fmt.Errorf("getting file info for %s: %w", finalEfiName, err)
+	}
+	if sizeLimit := viper.GetInt64("efi-size-warn"); fi.Size() > sizeLimit*1024*1024 {
+		b.logger.Warnf("EFI file %s is larger than %d bytes", finalEfiName, sizeLimit)
+	}
+
+	if maxSize, _ := utils.ParseSize(viper.GetString("max-size")); maxSize > 0 {
+		return utils.CheckArtifactSize(vfs.OSFS, filepath.Join(sourceDir, finalEfiName), maxSize, sourceDir)
+	}
+
+	return nil
+}
+
+// runUkify builds the UKI with ukify, from the rootfs dir the os-release and the output are
+// relative to
+func (b *BuildUKIAction) runUkify(sourceDir string, args []string) error {
+	cmd := exec.Command("/usr/lib/systemd/ukify", append(args, "build")...)
+	cmd.Dir = sourceDir
+	out, err := b.runner.RunCmd(cmd)
+	if err != nil {
+		return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running ukify: %w\n%s", err, string(out))
+	}
+	logging.Module(b.logger, logging.EFI).Debugf("ukify output: %s", string(out))
+	return nil
+}
+
+// signPCRPolicies has the signing service sign the PCR policies of the UKI ukify built with args,
+// and builds it again with their signatures in its .pcrsig section, as ukify does with the PCR
+// key. The section is not measured, the policies stay the same.
+func (b *BuildUKIAction) signPCRPolicies(sourceDir, artifactsTempDir, finalEfiName string, args []string) error {
+	sections, err := peSections(filepath.Join(sourceDir, finalEfiName))
+	if err != nil {
+		return err
+	}
+	measured := map[string]string{}
+	for _, name := range secureboot.MeasuredSections {
+		data, ok := sections[name]
+		if !ok {
+			continue
+		}
+		measured[name] = filepath.Join(artifactsTempDir, "measure"+name)
+		if err = os.WriteFile(measured[name], data, 0644); err != nil {
+			return err
+		}
+	}
+	policies, err := secureboot.PCRPolicies(b.runner, measured, secureboot.Phases)
+	if err != nil {
+		return err
+	}
+	publicKey, err := os.ReadFile(filepath.Join(b.keysDirectory, pcrPublicKey))
+	if err != nil {
+		return failure.New(failure.ErrMissingKeys, err, pcrPublicKeyHint)
+	}
+
+	b.logger.Infof("Signing %d PCR policies of %s with %s", len(policies), finalEfiName, viper.GetString("signer"))
+	batch := make([]signer.Request, len(policies))
+	for i, policy := range policies {
+		batch[i] = signer.Request{Kind: signer.KindPCRPolicy, Key: signer.KeyPCR, Data: policy.Digest}
+	}
+	stop := b.report.Start("signer")
+	signatures, err := b.signer.Sign(batch)
+	stop()
+	if err != nil {
+		return failure.New(failure.ErrUnsignedStub, err, signerHint)
+	}
+	pcrsig, err := secureboot.PCRSig(publicKey, policies, signatures)
+	if err != nil {
+		return failure.New(failure.ErrMissingKeys, err, pcrPublicKeyHint)
+	}
+	file := filepath.Join(artifactsTempDir, "pcrsig.json")
+	if err = os.WriteFile(file, pcrsig, 0644); err != nil {
+		return err
+	}
+	return b.runUkify(sourceDir, append(args, "--section", ".pcrsig:@"+file))
+}
+
+// estimateSize fails early if the efi files are not going to fit in the configured max-size.
+// The efi file is mostly the kernel plus the initrd, so we can tell before signing anything.
+func (b *BuildUKIAction) estimateSize(sourceDir, artifactsTempDir string) error {
+	if viper.GetString("max-size") == "" {
+		return nil
+	}
+	maxSize, err := utils.ParseSize(viper.GetString("max-size"))
+	if err != nil {
+		return err
+	}
+	estimation, err := utils.DirSize(vfs.OSFS, artifactsTempDir)
+	if err != nil {
+		return err
+	}
+	b.logger.Infof("Estimated EFI file size: %s (max-size %s)", utils.FormatSize(estimation), utils.FormatSize(maxSize))
+	if estimation > maxSize {
+		return utils.SizeBudgetError(vfs.OSFS, "Estimated EFI file size", estimation, maxSize, sourceDir)
+	}
+	return nil
+}
+
+// signingHint is the remediation of sbsign and ukify failing to sign
+const signingHint = "check that db.key and db.pem in the keys directory are a matching, readable key pair, as generated by enki genkey"
+
+// signerHint is the remediation of the signing service failing to sign
+const signerHint = "check that the signer is reachable and trusts the signer-cert client certificate to sign with the db and tpm2-pcr keys"
+
+// pcrPublicKey is the public key of tpm2-pcr-private.pem in the keys dir, embedded in the UKIs
+// when the PCR policies are signed by the signer
+const pcrPublicKey = "tpm2-pcr-public.pem"
+
+// pcrPublicKeyHint is the remediation of a missing or invalid pcrPublicKey
+const pcrPublicKeyHint = "generate the keys with enki genkey, or the public key with openssl rsa -pubout out of the tpm2-pcr-private.pem the signer holds"
+
+// timestampHint is the remediation of the time-stamping authority failing to timestamp
+const timestampHint = "check that the timestamp-url is a reachable RFC 3161 time-stamping authority"
+
+// TODO: the efi file should come from the downloaded image, not from the
+// enki running OS.
+func (b *BuildUKIAction) sbSign(sourceDir string) error {
+	var systemdBoot string
+	var outputEfi string
+	if utils.IsAmd64(b.arch) {
+		systemdBoot = constants.UkiSystemdBootx86
+		outputEfi = constants.EfiFallbackNamex86
+	} else if utils.IsArm64(b.arch) {
+		systemdBoot = constants.UkiSystemdBootArm
+		outputEfi = constants.EfiFallbackNameArm
+	} else {
+		return fmt.Errorf("unsupported arch: %s", b.arch)
+	}
+
+	if shimMok() {
+		// shim boots from the fallback path and loads systemd-boot in place of grub, once the
+		// db key is enrolled as MOK
+		shim, err := b.shimFiles()
+		if err != nil {
+			return err
+		}
+		for source, target := range map[string]string{
+			shim.shim:                                outputEfi,
+			shim.mokManager:                          shim.mokManagerName,
+			filepath.Join(b.keysDirectory, "db.der"): constants.MokCertFile,
+		} {
+			if err = utils.CopyFile(vfs.OSFS, source, filepath.Join(sourceDir, target)); err != nil {
+				return err
+			}
+		}
+		outputEfi = shim.loaderName
+	}
+
+	out, err := b.sbsign(sourceDir, systemdBoot, outputEfi)
+	if err != nil {
+		return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running sbsign: %w\n%s", err, string(out))
+	}
+	if err = b.timestamp(filepath.Join(sourceDir, outputEfi)); err != nil {
+		return err
+	}
+
+	// The extra EFI payloads need to be signed as well to boot with secure boot enabled, but for
+	// the ones signed by their vendor
+	for _, tool := range b.efiTools() {
+		if tool.Presigned {
+			b.logger.Infof("Adding %s with its own signature", tool.Source)
+			if err = utils.CopyFile(vfs.OSFS, tool.Source, filepath.Join(sourceDir, tool.FileName)); err != nil {
+				return err
+			}
+			continue
+		}
+		b.logger.Infof("Signing %s", tool.Source)
+		out, err = b.sbsign(sourceDir, tool.Source, tool.FileName)
+		if err != nil {
+			return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running sbsign for %s: %w\n%s", tool.Source, err, string(out))
+		}
+		if err = b.timestamp(filepath.Join(sourceDir, tool.FileName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sbsign signs the EFI binary at source with the db key into the target path of sourceDir, or
+// copies it there unsigned and requests its signature when emitting the sign requests
+func (b *BuildUKIAction) sbsign(sourceDir, source, target string) ([]byte, error) {
+	output := filepath.Join(sourceDir, target)
+	if b.signRequests != nil {
+		if err := utils.CopyFile(vfs.OSFS, source, output); err != nil {
+			return nil, err
+		}
+		return nil, b.signRequests.Add(b.runner, sourceDir, output)
+	}
+	return b.runner.Run("sbsign",
+		"--key", filepath.Join(b.keysDirectory, "db.key"),
+		"--cert", filepath.Join(b.keysDirectory, "db.pem"),
+		"--output", output,
+		source,
+	)
+}
+
+// emitSignRequests keeps the build, with the EFI binaries of sourceDir unsigned, along with the
+// requests of their signatures, to finish it with apply-signatures once signed
+func (b *BuildUKIAction) emitSignRequests(sourceDir string) error {
+	dir := viper.GetString("emit-sign-requests")
+	stop := b.report.Start("sign requests")
+	defer stop()
+	if err := utils.CopyTree(vfs.OSFS, sourceDir, filepath.Join(dir, secureboot.SignRequestsTree), utils.CopyOptions{}); err != nil {
+		return err
+	}
+	if err := b.signRequests.Write(); err != nil {
+		return err
+	}
+	b.logger.Infof("Wrote %d sign requests to %s", len(b.signRequests.Requests), dir)
+	for _, r := range b.signRequests.Requests {
+		b.logger.Infof("  %s", strings.Join(r.SignCommand("db.key", "db.pem"), " "))
+	}
+	b.logger.Infof("Sign them from %s on the machine holding the db key as above, then finish the build with --apply-signatures %s", dir, dir)
+	return nil
+}
+
+// applySignatures finishes the build kept with the sign requests in dir, attaching their
+// signatures to its EFI binaries and creating the outputs out of it
+func (b *BuildUKIAction) applySignatures(dir string, stdout bool) error {
+	requests, err := secureboot.ReadSignRequests(dir)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "pass the dir the sign requests were emitted to with emit-sign-requests")
+	}
+	if requests.Source != b.img.String() {
+		return failure.Errorf(failure.ErrInvalidConfig, "build with the source image the sign requests were emitted for", "the sign requests of %s are for %s, not %s", dir, requests.Source, b.img.String())
+	}
+	sourceDir, err := os.MkdirTemp(b.workdirs[workdir.Rootfs], "enki-build-uki-signed-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(sourceDir)
+	if err = utils.CopyTree(vfs.OSFS, filepath.Join(dir, secureboot.SignRequestsTree), sourceDir, utils.CopyOptions{}); err != nil {
+		return err
+	}
+
+	b.logger.Infof("Applying %d signatures from %s", len(requests.Requests), dir)
+	if err = b.attachSignatures(requests, sourceDir); err != nil {
+		return err
+	}
+
+	if b.version, err = findKairosVersion(sourceDir); err != nil {
+		return err
+	}
+	if err = b.expandTemplates(sourceDir); err != nil {
+		return err
+	}
+	if err = b.setNamer(sourceDir); err != nil {
+		return err
+	}
+	return b.createOutputs(sourceDir, stdout)
+}
+
+// signWithSigner has the signing service sign the requests of the EFI binaries of sourceDir, in
+// a single batch, and attaches the signatures
+func (b *BuildUKIAction) signWithSigner(sourceDir string) error {
+	requests := b.signRequests
+	// The binaries are signed from now on, so they are timestamped
+	b.signRequests = nil
+	b.logger.Infof("Signing %d EFI binaries with %s", len(requests.Requests), viper.GetString("signer"))
+	stop := b.report.Start("signer")
+	err := requests.SignWith(func(data [][]byte) ([][]byte, error) {
+		batch := make([]signer.Request, len(data))
+		for i := range data {
+			batch[i] = signer.Request{Kind: signer.KindAuthenticode, Key: signer.KeyDB, Data: data[i]}
+		}
+		return b.signer.Sign(batch)
+	})
+	stop()
+	if err != nil {
+		return failure.New(failure.ErrUnsignedStub, err, signerHint)
+	}
+	return b.attachSignatures(requests, sourceDir)
+}
+
+// attachSignatures attaches the signatures of the requests to the EFI binaries of sourceDir and
+// timestamps them
+func (b *BuildUKIAction) attachSignatures(requests *secureboot.SignRequests, sourceDir string) error {
+	stop := b.report.Start("apply signatures")
+	err := requests.Attach(b.runner, sourceDir)
+	stop()
+	if err != nil {
+		return failure.New(failure.ErrUnsignedStub, err, "check that the signatures are the ones of the sign requests, made with the db key")
+	}
+	for _, r := range requests.Requests {
+		if err = b.timestamp(filepath.Join(sourceDir, filepath.FromSlash(r.File))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timestamp adds an RFC 3161 timestamp from the timestamp-url to the signature of the signed
+// EFI binary at path, so it stays valid once the db certificate expires
+func (b *BuildUKIAction) timestamp(path string) error {
+	tsa := viper.GetString("timestamp-url")
+	// The requested signatures are timestamped once applied
+	if tsa == "" || b.signRequests != nil {
+		return nil
+	}
+	b.logger.Infof("Timestamping %s", filepath.Base(path))
+	if err := secureboot.Timestamp(b.runner, tsa, path); err != nil {
+		return failure.New(failure.ErrUnsignedStub, err, timestampHint)
+	}
+	return nil
+}
+
+// sbatLevel returns the SBAT level the shipped binaries must meet, out of both the SBAT
+// revocations to ship and the SBAT policy, nil if there is neither
+func sbatLevel() (secureboot.SbatLevel, error) {
+	var level secureboot.SbatLevel
+	for _, key := range []string{"sbat-revocations", "sbat-policy"} {
+		if path := viper.GetString(key); path != "" {
+			l, err := secureboot.ReadSbatLevel(path)
+			if err != nil {
+				return nil, failure.New(failure.ErrInvalidConfig, err, "")
+			}
+			level = level.Merge(l)
+		}
+	}
+	return level, nil
+}
+
+// checkStubsSbat fails early if the SBAT level rejects the systemd-boot and stub binaries of
+// the build host or the EFI tools, as every artifact shipping them would be rejected
+func (b *BuildUKIAction) checkStubsSbat() error {
+	level, err := sbatLevel()
+	if err != nil || level == nil {
+		return err
+	}
+	files, err := b.getEfiNeededFiles()
+	if err != nil {
+		return err
+	}
+	for _, tool := range b.efiTools() {
+		files = append(files, tool.Source)
+	}
+	if shimMok() {
+		shim, err := b.shimFiles()
+		if err != nil {
+			return err
+		}
+		files = append(files, shim.shim, shim.mokManager)
+	}
+	for _, file := range files {
+		reasons, err := secureboot.CheckRevoked(file, nil, level)
+		if err != nil {
+			return err
+		}
+		if len(reasons) > 0 {
+			return failure.Errorf(failure.ErrVerification, "update systemd-boot, shim and the EFI tools on the build host to releases with newer SBAT generations",
+				"%s would be rejected by up to date firmware: %s", file, strings.Join(reasons, ", "))
+		}
+	}
+	return nil
+}
+
+// addRevocations copies the dbx update and the SBAT revocations to ship into sourceDir, and
+// fails if they, or the SBAT policy, revoke any of the signed binaries, as the media would
+// not boot
+func (b *BuildUKIAction) addRevocations(sourceDir string) error {
+	dbxFile, sbatFile := viper.GetString("dbx"), viper.GetString("sbat-revocations")
+	level, err := sbatLevel()
+	if err != nil {
+		return err
+	}
+	if dbxFile == "" && level == nil {
+		return nil
+	}
+	var dbx signature.SignatureDatabase
+	if dbxFile != "" {
+		if dbx, err = secureboot.ReadDBX(dbxFile); err != nil {
+			return failure.New(failure.ErrInvalidConfig, err, "")
+		}
+		if err = utils.CopyFile(vfs.OSFS, dbxFile, filepath.Join(sourceDir, constants.DbxFile)); err != nil {
+			return err
+		}
+	}
+	if sbatFile != "" {
+		if err = utils.CopyFile(vfs.OSFS, sbatFile, filepath.Join(sourceDir, constants.SbatLevelFile)); err != nil {
+			return err
+		}
+	}
 
-	destinationFile, err := os.Create(filepath.Join(targetDir, "vmlinuz"))
+	b.logger.Info("Checking the signed binaries against the revocations")
+	filesMap, err := b.imageFiles(sourceDir)
 	if err != nil {
 		return err
 	}
-	defer destinationFile.Close()
-	b.logger.Infof("Copying kernel from: %s to: %s", sourceFile.Name(), destinationFile.Name())
-	_, err = io.Copy(destinationFile, sourceFile)
+	for _, files := range filesMap {
+		for _, file := range files {
+			if !strings.EqualFold(filepath.Ext(file), ".efi") {
+				continue
+			}
+			reasons, err := secureboot.CheckRevoked(file, dbx, level)
+			if err != nil {
+				return err
+			}
+			if len(reasons) > 0 {
+				return failure.Errorf(failure.ErrVerification, "build from an image with fixed binaries, or ship older revocations until it is available",
+					"%s is revoked by the revocations to ship: %s", filepath.Base(file), strings.Join(reasons, ", "))
+			}
+		}
+	}
+	return nil
+}
 
-	return err
+// bootEntries returns all the UKIs to build, each with its own cmdline
+func (b *BuildUKIAction) bootEntries() []utils.BootEntry {
+	return utils.GetUkiBootEntries(b.settings, b.logger)
 }
 
-func (b *BuildUKIAction) ukify(sourceDir, artifactsTempDir, cmdline, finalEfiName string) error {
-	// Normally that's still the current dir but just making sure.
-	if err := os.Chdir(sourceDir); err != nil {
-		return fmt.Errorf("changing to %s directory: %w", sourceDir, err)
+// abRoles returns the roles the norole artifacts are laid out as, or nothing without an A/B layout.
+// A dedicated recovery UKI takes the place of the recovery copy of the norole artifacts.
+func (b *BuildUKIAction) abRoles() []string {
+	if !viper.GetBool("ab-layout") {
+		return nil
 	}
-
-	stubFile, err := b.getEfiStub()
-	if err != nil {
-		return err
+	roles := viper.GetStringSlice("ab-roles")
+	if viper.GetBool("recovery") {
+		roles = slices.DeleteFunc(slices.Clone(roles), func(role string) bool { return role == constants.RecoveryRole })
 	}
+	return roles
+}
 
-	cmd := exec.Command("/usr/lib/systemd/ukify",
-		"--linux", filepath.Join(artifactsTempDir, "vmlinuz"),
-		"--initrd", filepath.Join(artifactsTempDir, "initrd"),
-		"--cmdline", cmdline,
-		"--os-release", fmt.Sprintf("@%s", "etc/os-release"),
-		"--stub", stubFile,
-		"--secureboot-private-key", filepath.Join(b.keysDirectory, "db.key"),
-		"--secureboot-certificate", filepath.Join(b.keysDirectory, "db.pem"),
-		"--pcr-private-key", filepath.Join(b.keysDirectory, "tpm2-pcr-private.pem"),
-		"--measure",
-		"--output", finalEfiName,
-		"build",
-	)
+// roleName replaces the norole prefix of an artifact name with the given role
+func roleName(name, role string) string {
+	return role + strings.TrimPrefix(name, constants.ArtifactBaseName)
+}
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("running ukify: %w\n%s", err, string(out))
+// roleTitle returns the boot menu title of an entry for the given role
+func roleTitle(title, role string) string {
+	switch role {
+	case constants.ActiveRole:
+		return title
+	case "passive":
+		return fmt.Sprintf("%s (fallback)", title)
+	default:
+		return fmt.Sprintf("%s %s", title, role)
 	}
+}
 
-	b.logger.Debugf("ukify output: %s", string(out))
-
-	// check size of the efi file
-	fi, err := os.Stat(finalEfiName)
-	if err != nil {
-		return fmt.Errorf("getting file info for %s: %w", finalEfiName, err)
+// createABLayout lays out the norole artifacts as an installed system has them, the same way
+// kairos-agent does on install: each UKI and its loader entry is copied once per role and the
+// norole ones are dropped. The UKIs are already signed so the copies don't need signing again.
+func (b *BuildUKIAction) createABLayout(sourceDir string, entries []utils.BootEntry) error {
+	roles := b.abRoles()
+	if len(roles) == 0 {
+		return nil
 	}
-	if sizeLimit := viper.GetInt64("efi-size-warn"); fi.Size() > sizeLimit*1024*1024 {
-		b.logger.Warnf("EFI file %s is larger than %d bytes", finalEfiName, sizeLimit)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.FileName, constants.ArtifactBaseName) {
+			continue
+		}
+		for _, role := range roles {
+			roleEntry := entry
+			roleEntry.FileName = roleName(entry.FileName, role)
+			roleEntry.Title = roleTitle(entry.Title, role)
+			b.logger.Infof("Creating the %s artifacts from %s", role, entry.FileName)
+			if !bootEntryBLS() {
+				if err := utils.CopyFile(vfs.OSFS, filepath.Join(sourceDir, entry.EfiName()), filepath.Join(sourceDir, roleEntry.EfiName())); err != nil {
+					return err
+				}
+			}
+			if err := b.createConfFiles(sourceDir, roleEntry, role); err != nil {
+				return err
+			}
+		}
+		names := []string{entry.ConfName()}
+		if !bootEntryBLS() {
+			names = append(names, entry.EfiName())
+		}
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(sourceDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	if !bootEntryBLS() {
+		return nil
+	}
+	// The entries of each role boot their own copy of the kernel and initrd, which are replaced
+	// on upgrades. The other entries boot the ones of the active system.
+	kernel, initrd := blsFiles(constants.ArtifactBaseName)
+	for _, name := range []string{kernel, initrd} {
+		for _, role := range roles {
+			if err := utils.CopyFile(vfs.OSFS, filepath.Join(sourceDir, name), filepath.Join(sourceDir, roleName(name, role))); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(filepath.Join(sourceDir, name)); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-// TODO: the efi file should come from the downloaded image, not from the
-// enki running OS.
-func (b *BuildUKIAction) sbSign(sourceDir string) error {
-	var systemdBoot string
-	var outputEfi string
-	if utils.IsAmd64(b.arch) {
-		systemdBoot = constants.UkiSystemdBootx86
-		outputEfi = constants.EfiFallbackNamex86
-	} else if utils.IsArm64(b.arch) {
-		systemdBoot = constants.UkiSystemdBootArm
-		outputEfi = constants.EfiFallbackNameArm
-	} else {
-		return fmt.Errorf("unsupported arch: %s", b.arch)
+// espEntries returns the names of the UKIs, and their loader entries, as they end up in the ESP
+func (b *BuildUKIAction) espEntries() []string {
+	var names []string
+	roles := b.abRoles()
+	for _, entry := range b.bootEntries() {
+		if len(roles) == 0 || !strings.HasPrefix(entry.FileName, constants.ArtifactBaseName) {
+			names = append(names, entry.FileName)
+			continue
+		}
+		for _, role := range roles {
+			names = append(names, roleName(entry.FileName, role))
+		}
 	}
+	return names
+}
 
-	cmd := exec.Command("sbsign",
-		"--key", filepath.Join(b.keysDirectory, "db.key"),
-		"--cert", filepath.Join(b.keysDirectory, "db.pem"),
-		"--output", filepath.Join(sourceDir, outputEfi),
-		systemdBoot,
-	)
+// efiTools returns the optional EFI payloads to add to the ESP, the extra EFI binaries last
+func (b *BuildUKIAction) efiTools() []utils.EfiTool {
+	tools := utils.GetEfiTools(viper.GetString("efi-shell"), viper.GetString("memtest"), b.arch)
+	// They were checked by checkEfiTools
+	extra, _ := utils.ParseEfiBinaries(viper.GetStringSlice("efi-binary"), tools...)
+	return append(tools, extra...)
+}
 
-	out, err := cmd.CombinedOutput()
+// checkEfiTools fails on invalid extra EFI binaries, given with the flags or in the manifest
+func (b *BuildUKIAction) checkEfiTools() error {
+	const hint = "give the extra EFI binaries as PATH[,title=TITLE][,sign=false]"
+	tools := utils.GetEfiTools(viper.GetString("efi-shell"), viper.GetString("memtest"), b.arch)
+	extra, err := utils.ParseEfiBinaries(viper.GetStringSlice("efi-binary"), tools...)
 	if err != nil {
-		return fmt.Errorf("running sbsign: %w\n%s", err, string(out))
+		return failure.New(failure.ErrInvalidConfig, err, hint)
+	}
+	for _, tool := range extra {
+		if _, err = os.Stat(tool.Source); err != nil {
+			return failure.New(failure.ErrInvalidConfig, fmt.Errorf("EFI binary %s: %w", tool.Source, err), hint)
+		}
 	}
 	return nil
 }
 
-func (b *BuildUKIAction) createConfFiles(sourceDir, cmdline, title, finalEfiName string) error {
-	// This is stored in the config
-	var extraCmdline string
-	// For the config title we get only the extra cmdline we added, no replacement of spaces with underscores needed
-	extraCmdline = strings.TrimSpace(strings.TrimPrefix(cmdline, constants.UkiCmdline))
-	// For the default install entry, do not add anything on the config
-	if extraCmdline == constants.UkiCmdlineInstall {
-		extraCmdline = ""
+// createToolConfFiles creates the loader entries for the optional EFI payloads
+func (b *BuildUKIAction) createToolConfFiles(sourceDir string) error {
+	for _, tool := range b.efiTools() {
+		if tool.Title == "" {
+			continue
+		}
+		b.logger.Infof("Creating the boot entry for %s", tool.Title)
+		configData := fmt.Sprintf("title %s\nefi /%s/%s\n", tool.Title, constants.EfiToolsDir, tool.FileName)
+		confFile := filepath.Join(sourceDir, strings.TrimSuffix(tool.FileName, ".efi")+".conf")
+		if err := os.WriteFile(confFile, []byte(configData), os.ModePerm); err != nil {
+			return fmt.Errorf("creating the %s file: %w", filepath.Base(confFile), err)
+		}
 	}
-	b.logger.Infof("Creating the %s.conf file", finalEfiName)
+	return nil
+}
+
+// createConfFiles creates the loader entry of entry, booting its UKI, or with the bls
+// boot-entry-type the kernel and initrd of role with the cmdline of entry
+func (b *BuildUKIAction) createConfFiles(sourceDir string, entry utils.BootEntry, role string) error {
+	b.logger.Infof("Creating the %s file", entry.ConfName())
 
 	// You can add entries into the config files, they will be ignored by systemd-boot
 	// So we store the cmdline in a key cmdline for easy tracking of what was added to the uki cmdline
 
-	configData := fmt.Sprintf("title %s\nefi /EFI/kairos/%s.efi\n", title, finalEfiName)
+	configData := fmt.Sprintf("title %s\nefi /EFI/kairos/%s\n", entry.Title, entry.EfiName())
+	if bootEntryBLS() {
+		kernel, initrd := blsFiles(role)
+		configData = fmt.Sprintf("title %s\nlinux /EFI/kairos/%s\ninitrd /EFI/kairos/%s\noptions %s\n", entry.Title, kernel, initrd, entry.Cmdline)
+	}
 
 	if viper.GetBool("include-version-in-config") {
 		configData = fmt.Sprintf("%sversion %s\n", configData, b.version)
 	}
 
 	if viper.GetBool("include-cmdline-in-config") {
-		configData = fmt.Sprintf("%scmdline %s\n", configData, strings.Trim(extraCmdline, " "))
+		configData = fmt.Sprintf("%scmdline %s\n", configData, entry.Extra)
 	}
 
-	err := os.WriteFile(filepath.Join(sourceDir, finalEfiName+".conf"), []byte(configData), os.ModePerm)
+	err := os.WriteFile(filepath.Join(sourceDir, entry.ConfName()), []byte(configData), os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("creating the %s.conf file", finalEfiName)
+		return fmt.Errorf("creating the %s file", entry.ConfName())
+	}
+
+	return nil
+}
+
+// bootEntryBLS tells if the entries boot a kernel and initrd of their own (BLS Type #1) instead
+// of a UKI (BLS Type #2)
+func bootEntryBLS() bool {
+	return viper.GetString("boot-entry-type") == constants.BootEntryBLS
+}
+
+// blsFiles returns the names of the kernel and initrd the Type #1 entries of role boot
+func blsFiles(role string) (kernel, initrd string) {
+	return role + ".vmlinuz", role + ".initrd"
+}
+
+// blsRole returns the role of the kernel and initrd the Type #1 entry boots. The norole entries
+// get the ones of each role with an A/B layout, the other entries the ones of the active system.
+func (b *BuildUKIAction) blsRole(entry utils.BootEntry) string {
+	if len(b.abRoles()) == 0 || strings.HasPrefix(entry.FileName, constants.ArtifactBaseName) {
+		return constants.ArtifactBaseName
 	}
+	return constants.ActiveRole
+}
 
+// createBLSFiles writes the kernel, signed with the db key, and the initrd shared by all the
+// entries into sourceDir, along with the Type #1 loader entries booting them with their cmdline.
+// Unlike the UKIs, the initrd and the cmdline are not signed nor measured.
+func (b *BuildUKIAction) createBLSFiles(sourceDir, artifactsTempDir string, entries []utils.BootEntry) error {
+	kernel, initrd := blsFiles(constants.ArtifactBaseName)
+	b.logger.Infof("Signing the kernel as %s", kernel)
+	out, err := b.sbsign(sourceDir, filepath.Join(artifactsTempDir, "vmlinuz"), kernel)
+	if err != nil {
+		return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running sbsign for the kernel: %w\n%s", err, string(out))
+	}
+	if err = b.timestamp(filepath.Join(sourceDir, kernel)); err != nil {
+		return err
+	}
+	if err = utils.CopyFile(vfs.OSFS, filepath.Join(artifactsTempDir, "initrd"), filepath.Join(sourceDir, initrd)); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = b.createConfFiles(sourceDir, entry, b.blsRole(entry)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// blsRoles returns the roles the kernel and initrd of the Type #1 entries are laid out for
+func (b *BuildUKIAction) blsRoles() []string {
+	if roles := b.abRoles(); len(roles) > 0 {
+		return roles
+	}
+	return []string{constants.ArtifactBaseName}
+}
+
 func (b *BuildUKIAction) createISO(sourceDir string) error {
 	// isoDir is where we generate the img file. We pass this dir to xorriso.
-	isoDir, err := os.MkdirTemp("", "enki-iso-dir-")
+	isoDir, err := os.MkdirTemp(b.workdirs[workdir.Media], "enki-iso-dir-")
 	if err != nil {
 		return err
 	}
@@ -489,15 +1783,22 @@ func (b *BuildUKIAction) createISO(sourceDir string) error {
 	}
 
 	b.logger.Info("Calculating the size of the img file")
-	artifactSize, err := sumFileSizes(filesMap)
+	sizing, err := utils.NewEspSizing(viper.GetInt("esp-headroom"), viper.GetString("esp-align"), viper.GetString("esp-size"))
+	if err != nil {
+		return err
+	}
+	fat, err := utils.NewFatOptions(viper.GetString("esp-fat"), viper.GetString("esp-cluster-size"), viper.GetString("esp-label"))
+	if err != nil {
+		return err
+	}
+	fat.ApplyTo(&sizing)
+	imgSize, err := espSize(filesMap, sizing)
 	if err != nil {
 		return err
 	}
 
-	// Create just the size we need + 50MB just in case
-	imgSize := artifactSize + 50
-	imgFile := filepath.Join(isoDir, "efiboot.img")
-	b.logger.Info(fmt.Sprintf("Creating the img file with size: %dMb", imgSize))
+	imgFile := filepath.Join(isoDir, constants.UkiIsoEfiImage)
+	b.logger.Info(fmt.Sprintf("Creating the img file with size: %s", utils.FormatSize(imgSize)))
 	if err = createImgWithSize(imgFile, imgSize); err != nil {
 		return err
 	}
@@ -506,7 +1807,7 @@ func (b *BuildUKIAction) createISO(sourceDir string) error {
 	b.logger.Info(fmt.Sprintf("Created image: %s", imgFile))
 
 	b.logger.Info("Creating directories in the img file")
-	if err := createImgDirs(imgFile, filesMap); err != nil {
+	if err := createImgDirs(imgFile, filesMap, fat); err != nil {
 		return err
 	}
 
@@ -517,75 +1818,215 @@ func (b *BuildUKIAction) createISO(sourceDir string) error {
 
 	if viper.GetString("overlay-iso") != "" {
 		b.logger.Infof("Adding files from %s to iso", viper.GetString("overlay-iso"))
-		overlay, err := v1.NewSrcFromURI(fmt.Sprintf("dir:%s", viper.GetString("overlay-iso")))
+		err := utils.CopyTree(vfs.OSFS, viper.GetString("overlay-iso"), isoDir, utils.CopyOptions{Exclude: constants.GetDirSourceExcludes()})
+
 		if err != nil {
-			b.logger.Errorf("error creating overlay image: %s", err)
+			b.logger.Errorf("error copying overlay image: %s", err)
 			return err
 		}
-		_, err = b.e.DumpSource(isoDir, overlay)
 
+	}
+
+	install := autoinstall.Options{
+		Device: viper.GetString("install-device"),
+		Reboot: viper.GetBool("install-reboot"),
+		Config: viper.GetString("install-config"),
+	}
+	if install.Enabled() {
+		configFile, err := autoinstall.Write(vfs.OSFS, isoDir, install)
 		if err != nil {
-			b.logger.Errorf("error copying overlay image: %s", err)
 			return err
 		}
-
+		b.logger.Infof("Embedded the unattended install config in %s", configFile)
+	}
+	fw := firmware.Options{Capsules: viper.GetStringSlice("firmware-capsule"), Reboot: viper.GetBool("firmware-reboot")}
+	if fw.Enabled() {
+		configFile, err := firmware.Write(vfs.OSFS, isoDir, fw)
+		if err != nil {
+			return err
+		}
+		b.logger.Infof("Added %d firmware capsules, applied on the first boot of the installed system by %s", len(fw.Capsules), configFile)
 	}
 
-	isoName := fmt.Sprintf("kairos_%s.iso", b.version)
+	isoName := b.isoName()
 
-	b.logger.Info("Creating the iso files with xorriso")
-	cmd := exec.Command("xorriso", "-as", "mkisofs", "-V", "UKI_ISO_INSTALL", "-isohybrid-gpt-basdat",
-		"-e", filepath.Base(imgFile), "-no-emul-boot", "-o", filepath.Join(b.outputDir, isoName), isoDir)
-	out, err := cmd.CombinedOutput()
+	engine, err := iso.NewEngine(viper.GetString("iso-engine"), b.runner)
+	if err != nil {
+		return err
+	}
+	b.logger.Infof("Creating the iso file with the %s engine", viper.GetString("iso-engine"))
+	err = engine.Create(iso.Options{
+		Root:             isoDir,
+		Output:           filepath.Join(b.outputDir, isoName),
+		VolumeID:         constants.UkiIsoLabel,
+		EFIImage:         filepath.Base(imgFile),
+		RockRidge:        viper.GetBool("iso-rockridge"),
+		Joliet:           viper.GetBool("iso-joliet"),
+		RelocateDeepDirs: viper.GetBool("iso-relocate-deep-dirs"),
+	})
 	if err != nil {
-		return fmt.Errorf("error creating iso file: %w\n%s", err, string(out))
+		return err
+	}
+
+	if viper.GetBool("zsync") {
+		controlFile, err := zsync.WriteFile(vfs.OSFS, filepath.Join(b.outputDir, isoName))
+		if err != nil {
+			return fmt.Errorf("error creating zsync file: %w", err)
+		}
+		b.logger.Infof("Created zsync control file %s", controlFile)
+	}
+
+	if maxSize, _ := utils.ParseSize(viper.GetString("max-size")); maxSize > 0 {
+		if err = utils.CheckArtifactSize(vfs.OSFS, filepath.Join(b.outputDir, isoName), maxSize, sourceDir); err != nil {
+			return err
+		}
+	}
+
+	artifact := filepath.Join(b.outputDir, isoName)
+	if method := viper.GetString("encrypt"); method != "" {
+		artifact, err = encrypt.EncryptFile(vfs.OSFS, method, viper.GetString("encrypt-key"), artifact)
+		if err != nil {
+			return err
+		}
+		b.logger.Infof("Encrypted %s with %s", artifact, method)
+	}
+
+	if viper.GetBool("torrent") {
+		torrentFile, magnet, err := torrent.WriteFile(vfs.OSFS, artifact, torrent.Options{
+			Trackers:     viper.GetStringSlice("torrent-tracker"),
+			WebSeeds:     viper.GetStringSlice("torrent-webseed"),
+			CreatedBy:    fmt.Sprintf("enki %s", version.GetVersion()),
+			CreationDate: time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("error creating torrent: %w", err)
+		}
+		b.logger.Infof("Created torrent %s, magnet link: %s", torrentFile, magnet)
 	}
 
 	return nil
 }
 
+// createContainer wraps the ESP files into a container image, keeping the ESP layout at its root
+// so Kairos can upgrade trusted boot systems from it. The image is pushed when the push flag is
+// set, or saved as a tarball in the output dir otherwise.
 func (b *BuildUKIAction) createContainer(sourceDir, version string) error {
-	temp, err := os.CreateTemp("", "image.tar")
+	// The image only holds the ESP files, which may not be all that is in the output dir
+	espDir, err := os.MkdirTemp(b.workdirs[workdir.Media], "enki-uki-container-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(espDir)
+	if err = b.createArtifact(sourceDir, espDir); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(b.workdirs[workdir.Media], "image.tar")
 	if err != nil {
 		return err
 	}
-	// Create tarball from sourceDir
-	err = utils.Tar(sourceDir, temp)
+	// Create tarball from the ESP files
+	err = utils.Tar(espDir, temp)
 	if err != nil {
 		return err
 	}
 	_ = temp.Close()
 	defer os.RemoveAll(temp.Name())
-	finalImage := filepath.Join(b.outputDir, fmt.Sprintf("kairos_uki_%s.tar", version))
-	// TODO: get the arch from the running system or by flag? Config.Arch has this value on it
-	arch := "amd64"
-	os := "linux"
+	arch, err := utils.ArchToGolangArch(b.arch)
+	if err != nil {
+		return fmt.Errorf("unsupported arch: %s", b.arch)
+	}
+	imageName := viper.GetString("container-image")
+	if imageName == "" {
+		imageName = fmt.Sprintf("kairos_uki:%s", version)
+	}
+	labels, err := b.imageLabels(version, arch)
+	if err != nil {
+		return err
+	}
+	if viper.GetBool("push") {
+		pushed, err := utils.PushImage(b.logger, temp.Name(), imageName, arch, "linux", labels)
+		if err != nil {
+			return err
+		}
+		b.logger.Infof("Done building %s at: %s", constants.ContainerOutput, pushed)
+		return nil
+	}
+	finalImage := filepath.Join(b.outputDir, b.artifactName("tar"))
 	// Build imageTar from normal tar
-	err = utils.CreateTar(b.logger, temp.Name(), finalImage, fmt.Sprintf("kairos_uki:%s", version), arch, os)
+	err = utils.CreateTar(b.logger, temp.Name(), finalImage, imageName, arch, "linux", labels)
 	if err != nil {
 		return err
 	}
-	b.logger.Infof("Done building %s at: %s", b.outputType, finalImage)
+	b.outputs.Add(finalImage)
+	b.logger.Infof("Done building %s at: %s", constants.ContainerOutput, finalImage)
 
 	return err
 }
 
-// Create artifact just outputs the files from the sourceDir to the outputDir
+// imageLabels returns the labels of the container image, the ones given with container-label
+// override the default ones
+func (b *BuildUKIAction) imageLabels(version, arch string) (map[string]string, error) {
+	labels := map[string]string{
+		"org.opencontainers.image.title":   "kairos-uki",
+		"org.opencontainers.image.version": version,
+		"io.kairos.artifact":               string(constants.DefaultOutput),
+		"io.kairos.version":                version,
+		"io.kairos.arch":                   arch,
+	}
+	if b.buildInfo != nil {
+		labels["org.opencontainers.image.created"] = b.buildInfo.BuildDate.UTC().Format(time.RFC3339)
+		if len(b.buildInfo.Sources) > 0 {
+			labels["org.opencontainers.image.base.name"] = b.buildInfo.Sources[0].URI
+			if b.buildInfo.Sources[0].Digest != "" {
+				labels["org.opencontainers.image.base.digest"] = b.buildInfo.Sources[0].Digest
+			}
+		}
+	}
+	for _, label := range viper.GetStringSlice("container-label") {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid container label %q, expected key=value", label)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// Create artifact just outputs the files from the sourceDir to the targetDir
 // Maintains the same structure as the sourceDir which is the final structure we want
-func (b *BuildUKIAction) createArtifact(sourceDir string) error {
+func (b *BuildUKIAction) createArtifact(sourceDir, targetDir string) error {
 	filesMap, err := b.imageFiles(sourceDir)
 	if err != nil {
 		return err
 	}
+	return b.copyImageFiles(filesMap, targetDir)
+}
+
+// espDirTrees returns the files of the esp-dir output keyed by the dir of the output dir they
+// go to. With xbootldr the UKIs and their entries go to their own dir for an XBOOTLDR partition.
+func (b *BuildUKIAction) espDirTrees(sourceDir string) (map[string]map[string][]string, error) {
+	filesMap, err := b.imageFiles(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	if !viper.GetBool("xbootldr") {
+		return map[string]map[string][]string{constants.EspDir: filesMap}, nil
+	}
+	esp, xbootldr := utils.SplitXbootldr(filesMap)
+	return map[string]map[string][]string{constants.EspDir: esp, constants.XbootldrDir: xbootldr}, nil
+}
+
+// copyImageFiles copies the files of filesMap into their dirs under targetDir
+func (b *BuildUKIAction) copyImageFiles(filesMap map[string][]string, targetDir string) error {
 	for dir, files := range filesMap {
-		b.logger.Debugf(fmt.Sprintf("creating dir %s", filepath.Join(b.outputDir, dir)))
-		err = os.MkdirAll(filepath.Join(b.outputDir, dir), os.ModeDir|os.ModePerm)
+		b.logger.Debugf(fmt.Sprintf("creating dir %s", filepath.Join(targetDir, dir)))
+		err := os.MkdirAll(filepath.Join(targetDir, dir), os.ModeDir|os.ModePerm)
 		if err != nil {
 			b.logger.Errorf("creating dir %s: %s", dir, err)
 			return err
 		}
 		for _, f := range files {
-			b.logger.Debugf(fmt.Sprintf("copying %s to %s", f, filepath.Join(b.outputDir, dir, filepath.Base(f))))
+			b.logger.Debugf(fmt.Sprintf("copying %s to %s", f, filepath.Join(targetDir, dir, filepath.Base(f))))
 			source, err := os.Open(f)
 			if err != nil {
 				b.logger.Errorf("opening file %s: %s", f, err)
@@ -598,15 +2039,15 @@ func (b *BuildUKIAction) createArtifact(sourceDir string) error {
 				}
 			}(source)
 
-			destination, err := os.Create(filepath.Join(b.outputDir, dir, filepath.Base(f)))
+			destination, err := os.Create(filepath.Join(targetDir, dir, filepath.Base(f)))
 			if err != nil {
-				b.logger.Errorf("creating file %s: %s", filepath.Join(b.outputDir, dir, filepath.Base(f)), err)
+				b.logger.Errorf("creating file %s: %s", filepath.Join(targetDir, dir, filepath.Base(f)), err)
 				return err
 			}
 			defer func(destination *os.File) {
 				err := destination.Close()
 				if err != nil {
-					b.logger.Errorf("closing file %s: %s", filepath.Join(b.outputDir, dir, filepath.Base(f)), err)
+					b.logger.Errorf("closing file %s: %s", filepath.Join(targetDir, dir, filepath.Base(f)), err)
 				}
 			}(destination)
 			_, err = io.Copy(destination, source)
@@ -638,35 +2079,99 @@ func (b *BuildUKIAction) imageFiles(sourceDir string) (map[string][]string, erro
 			filepath.Join(b.keysDirectory, "KEK.auth"),
 			filepath.Join(b.keysDirectory, "db.auth")},
 	}
+	if viper.GetString("dbx") != "" {
+		data["loader/keys/auto"] = append(data["loader/keys/auto"], filepath.Join(sourceDir, constants.DbxFile))
+	}
+	if shimMok() {
+		shim, err := b.shimFiles()
+		if err != nil {
+			return nil, err
+		}
+		data["EFI/BOOT"] = append(data["EFI/BOOT"],
+			filepath.Join(sourceDir, shim.loaderName),
+			filepath.Join(sourceDir, shim.mokManagerName),
+			filepath.Join(sourceDir, constants.MokCertFile),
+		)
+		// The firmware keeps its keys, systemd-boot has nothing to enroll
+		delete(data, "loader/keys")
+		delete(data, "loader/keys/auto")
+	}
+	if viper.GetString("sbat-revocations") != "" {
+		data["loader"] = append(data["loader"], filepath.Join(sourceDir, constants.SbatLevelFile))
+	}
 	// Add the kairos efi files and the loader conf files for each cmdline
-	entries := append(utils.GetUkiCmdline(), utils.GetUkiSingleCmdlines(b.logger)...)
-	for _, entry := range entries {
-		data["EFI/kairos"] = append(data["EFI/kairos"], filepath.Join(sourceDir, entry.FileName+".efi"))
-		data["loader/entries"] = append(data["loader/entries"], filepath.Join(sourceDir, entry.FileName+".conf"))
+	for _, name := range b.espEntries() {
+		if !bootEntryBLS() {
+			data["EFI/kairos"] = append(data["EFI/kairos"], filepath.Join(sourceDir, name+".efi"))
+		}
+		data["loader/entries"] = append(data["loader/entries"], filepath.Join(sourceDir, name+".conf"))
+	}
+	if bootEntryBLS() {
+		for _, role := range b.blsRoles() {
+			kernel, initrd := blsFiles(role)
+			data["EFI/kairos"] = append(data["EFI/kairos"], filepath.Join(sourceDir, kernel), filepath.Join(sourceDir, initrd))
+		}
+	}
+	for _, tool := range b.efiTools() {
+		data[constants.EfiToolsDir] = append(data[constants.EfiToolsDir], filepath.Join(sourceDir, tool.FileName))
+		if tool.Title != "" {
+			data["loader/entries"] = append(data["loader/entries"], filepath.Join(sourceDir, strings.TrimSuffix(tool.FileName, ".efi")+".conf"))
+		}
 	}
 	b.logger.Debug(fmt.Sprintf("data: %s", litter.Sdump(data)))
 	return data, nil
 }
 
-// removeUkiFiles removes all the files and directories inside the output directory that match our filesMap
-// so this should only remove the generated intermediate artifacts that we use to build the container
-func (b *BuildUKIAction) removeUkiFiles() error {
-	filesMap, _ := b.imageFiles(b.outputDir)
-	for dir, files := range filesMap {
-		for _, f := range files {
-			err := os.Remove(filepath.Join(b.outputDir, dir, filepath.Base(f)))
-			if err != nil {
-				return err
+// shimMok tells if the artifacts boot through shim, trusting the db key once enrolled as MOK,
+// instead of enrolling the keys
+func shimMok() bool {
+	return viper.GetString("secureboot-mode") == constants.SecureBootShimMok
+}
+
+// shimFiles are the files shipped along with systemd-boot with the shim-mok secureboot-mode
+type shimFiles struct {
+	// shim and mokManager are the Microsoft signed binaries of the build host
+	shim, mokManager string
+	// loaderName and mokManagerName are the names shim loads systemd-boot and MokManager with
+	loaderName, mokManagerName string
+}
+
+// shimFiles returns the shim and MokManager binaries given with --shim and --mok-manager, or
+// the ones installed by the shim package of the build host
+func (b *BuildUKIAction) shimFiles() (shimFiles, error) {
+	var files shimFiles
+	var arch string
+	if utils.IsAmd64(b.arch) {
+		files, arch = shimFiles{loaderName: constants.ShimLoaderNamex86, mokManagerName: constants.MokManagerNamex86}, constants.ArchAmd64
+	} else if utils.IsArm64(b.arch) {
+		files, arch = shimFiles{loaderName: constants.ShimLoaderNameArm, mokManagerName: constants.MokManagerNameArm}, constants.ArchArm64
+	} else {
+		return files, fmt.Errorf("unsupported arch: %s", b.arch)
+	}
+	files.shim = viper.GetString("shim")
+	if files.shim == "" {
+		for _, f := range sdk.GetEfiShimFiles(arch) {
+			if _, err := os.Stat(f); err == nil {
+				files.shim = f
+				break
 			}
 		}
 	}
-	for dir := range filesMap {
-		err := os.RemoveAll(filepath.Join(b.outputDir, dir))
-		if err != nil {
-			return err
+	files.mokManager = viper.GetString("mok-manager")
+	if files.mokManager == "" && files.shim != "" {
+		// Distros install MokManager next to shim, SUSE under its own name
+		for _, name := range []string{files.mokManagerName, "MokManager.efi"} {
+			if _, err := os.Stat(filepath.Join(filepath.Dir(files.shim), name)); err == nil {
+				files.mokManager = filepath.Join(filepath.Dir(files.shim), name)
+				break
+			}
 		}
 	}
-	return nil
+	if files.shim == "" || files.mokManager == "" {
+		return files, failure.Errorf(failure.ErrMissingDependency, "install shim, packaged as shim-signed on Debian and Ubuntu, or pass them with --shim and --mok-manager",
+			"the Microsoft signed shim and MokManager were not found on the build host")
+	}
+	return files, nil
 }
 
 func (b *BuildUKIAction) getEfiStub() (string, error) {
@@ -680,18 +2185,24 @@ func (b *BuildUKIAction) getEfiStub() (string, error) {
 }
 
 func (b *BuildUKIAction) getEfiNeededFiles() ([]string, error) {
-	if utils.IsAmd64(b.arch) {
+	return EfiFiles(b.arch)
+}
+
+// EfiFiles returns the UKI stub and the systemd-boot of the host the builds for arch embed and
+// sign, pinned by the lockfile like the other host files
+func EfiFiles(arch string) ([]string, error) {
+	if utils.IsAmd64(arch) {
 		return []string{
 			constants.UkiSystemdBootStubx86,
 			constants.UkiSystemdBootx86,
 		}, nil
-	} else if utils.IsArm64(b.arch) {
+	} else if utils.IsArm64(arch) {
 		return []string{
 			constants.UkiSystemdBootStubArm,
 			constants.UkiSystemdBootArm,
 		}, nil
 	} else {
-		return nil, fmt.Errorf("unsupported arch: %s", b.arch)
+		return nil, fmt.Errorf("unsupported arch: %s", arch)
 	}
 }
 
@@ -767,6 +2278,81 @@ func ZstdFile(sourcePath, targetPath string) error {
 	return nil
 }
 
+// expandTemplates expands the templates of the cmdline and boot entry settings with the release
+// values of the source image and its arch, overridden by the --set values
+func (b *BuildUKIAction) expandTemplates(sourceDir string) error {
+	vars, err := templating.FromRelease(vfs.OSFS, sourceDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := vars["version"]; !ok {
+		vars["version"] = b.version
+	}
+	return b.expandSettings(vars)
+}
+
+// expandSettings expands the templates of the cmdline and boot entry settings with the release
+// values vars, the arch and the --set values. They are expanded into a copy of the settings, as
+// builds for other platforms may be expanding their own.
+func (b *BuildUKIAction) expandSettings(vars templating.Vars) error {
+	const hint = "check the templates of the cmdlines and boot titles, missing values can be given with --set key=value"
+	vars = vars.Merge(templating.Vars{"arch": b.arch})
+	set, err := templating.ParseSet(viper.GetStringSlice("set"))
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, hint)
+	}
+	vars = vars.Merge(set)
+
+	settings := viper.New()
+	for _, key := range viper.AllKeys() {
+		settings.Set(key, viper.Get(key))
+	}
+	for key, value := range b.defaults {
+		settings.Set(key, value)
+	}
+	for _, key := range constants.GetSourceTemplateKeys() {
+		value := settings.Get(key)
+		expanded, err := templating.ExpandValue(value, vars)
+		if err != nil {
+			return failure.Errorf(failure.ErrInvalidConfig, hint, "%s: %s", key, err)
+		}
+		if !reflect.DeepEqual(value, expanded) {
+			b.logger.Debugf("Expanded %s to %v", key, expanded)
+			settings.Set(key, expanded)
+		}
+	}
+	b.settings = settings
+	return nil
+}
+
+// readDefaults reads the build defaults of the source image in sourceDir, keeping the settings
+// not given with flags or the config file
+func (b *BuildUKIAction) readDefaults(sourceDir string) error {
+	defaults, err := flavor.Read(vfs.OSFS, sourceDir)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "fix the defaults of the source image, or override them with a rootfs-hook")
+	}
+	b.defaults = map[string]any{}
+	for key, value := range defaults.Settings() {
+		if viper.IsSet(key) {
+			b.logger.Debugf("Ignoring the %s of the source image defaults, it is already set", key)
+			continue
+		}
+		b.logger.Infof("Using the %s of the source image defaults: %v", key, value)
+		b.defaults[key] = value
+	}
+	return nil
+}
+
+// pruneProfiles returns the prune profiles of the build, the ones of the source image defaults
+// unless given with flags or the config file
+func (b *BuildUKIAction) pruneProfiles() []string {
+	if profiles, ok := b.defaults["prune"].([]string); ok {
+		return profiles
+	}
+	return viper.GetStringSlice("prune")
+}
+
 func findKairosVersion(sourceDir string) (string, error) {
 	osReleaseBytes, err := os.ReadFile(filepath.Join(sourceDir, "etc", "os-release"))
 	if err != nil {
@@ -783,39 +2369,41 @@ func findKairosVersion(sourceDir string) (string, error) {
 	return match[1], nil
 }
 
+// createImgWithSize creates the img file with the given size in bytes
 func createImgWithSize(imgFile string, size int64) error {
-	cmd := exec.Command("dd",
-		"if=/dev/zero", fmt.Sprintf("of=%s", imgFile),
-		"bs=1M", fmt.Sprintf("count=%d", size),
-	)
-
-	out, err := cmd.CombinedOutput()
+	f, err := os.Create(imgFile)
 	if err != nil {
-		return fmt.Errorf("creating the img file: %w\n%s", err, out)
+		return fmt.Errorf("creating the img file: %w", err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		return fmt.Errorf("creating the img file: %w", err)
 	}
 
 	return nil
 }
 
-func sumFileSizes(filesMap map[string][]string) (int64, error) {
-	total := int64(0)
-	for _, files := range maps.Values(filesMap) {
+// espSize returns the size of the img file holding the files of filesMap
+func espSize(filesMap map[string][]string, sizing utils.EspSizing) (int64, error) {
+	dirs := map[string]bool{}
+	var sizes []int64
+	for dir, files := range filesMap {
+		for d := filepath.Clean(dir); d != "." && d != "/"; d = filepath.Dir(d) {
+			dirs[d] = true
+		}
 		for _, f := range files {
 			fileInfo, err := os.Stat(f)
 			if err != nil {
-				return total, fmt.Errorf("finding file info for file %s: %w", f, err)
+				return 0, fmt.Errorf("finding file info for file %s: %w", f, err)
 			}
-			total += fileInfo.Size()
+			sizes = append(sizes, fileInfo.Size())
 		}
 	}
-
-	totalInMB := int64(math.Round(float64(total) / (1024 * 1024)))
-
-	return totalInMB, nil
+	return utils.EspSize(sizing, len(dirs), sizes...)
 }
 
-func createImgDirs(imgFile string, filesMap map[string][]string) error {
-	cmd := exec.Command("mkfs.msdos", "-F", "32", imgFile)
+func createImgDirs(imgFile string, filesMap map[string][]string, fat utils.FatOptions) error {
+	cmd := exec.Command("mkfs.msdos", append(fat.MkfsArgs(), imgFile)...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("formating the img file to fat: %w\n%s", err, string(out))
@@ -824,6 +2412,10 @@ func createImgDirs(imgFile string, filesMap map[string][]string) error {
 	dirs := maps.Keys(filesMap)
 	sort.Strings(dirs) // Make sure we create outer dirs first
 	for _, dir := range dirs {
+		// The root dir is created by mkfs
+		if dir == "" {
+			continue
+		}
 		// Dirs in MSDOS are marked with ::DIR
 		cmd := exec.Command("mmd", "-i", imgFile, fmt.Sprintf("::%s", dir))
 		out, err := cmd.CombinedOutput()
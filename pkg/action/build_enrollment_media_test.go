@@ -0,0 +1,64 @@
+package action
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EnrollmentMediaAction", Label("enrollment-media"), func() {
+	var keysDir string
+	BeforeEach(func() {
+		keysDir = GinkgoT().TempDir()
+		for _, keyType := range []string{"PK", "KEK", "db"} {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			notAfter := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+			template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fleet-" + keyType}, NotBefore: time.Now(), NotAfter: notAfter}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(keysDir, keyType+".der"), der, 0644)).To(Succeed())
+		}
+	})
+
+	It("lays out systemd-boot, the keys to enroll and KeyTool", func() {
+		cfg := config.NewBuildConfig()
+		cfg.Arch = constants.ArchAmd64
+		e := NewEnrollmentMediaAction(cfg, keysDir, "", EnrollmentMediaOptions{KeyTool: "/usr/share/efitools/efi/KeyTool.efi"})
+		files := e.Files("/src")
+		Expect(files["EFI/BOOT"]).To(Equal([]string{"/src/BOOTX64.EFI"}))
+		Expect(files["loader/keys/auto"]).To(Equal([]string{
+			filepath.Join(keysDir, "PK.auth"), filepath.Join(keysDir, "KEK.auth"), filepath.Join(keysDir, "db.auth"),
+		}))
+		Expect(files["keys"]).To(ContainElements(filepath.Join(keysDir, "db.esl"), filepath.Join(keysDir, "PK.der")))
+		Expect(files[constants.EfiToolsDir]).To(Equal([]string{"/src/KeyTool.efi"}))
+		Expect(files["loader/entries"]).To(Equal([]string{"/src/keytool.conf"}))
+		Expect(files[""]).To(Equal([]string{"/src/" + EnrollmentInstructionsFile}))
+	})
+
+	It("lists the certificates it enrolls in the instructions", func() {
+		e := NewEnrollmentMediaAction(config.NewBuildConfig(), keysDir, "", EnrollmentMediaOptions{Enroll: "manual"})
+		instructions, err := e.Instructions()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instructions).To(ContainSubstring("  PK   CN=fleet-PK, expires 2030-01-02\n  KEK  CN=fleet-KEK, expires 2030-01-02\n  db   CN=fleet-db, expires 2030-01-02\n"))
+		Expect(instructions).To(ContainSubstring(`select the "Enroll Secure Boot keys: auto" entry`))
+		Expect(instructions).ToNot(ContainSubstring("KeyTool"))
+	})
+
+	It("needs the certificates of the keys", func() {
+		Expect(os.Remove(filepath.Join(keysDir, "KEK.der"))).To(Succeed())
+		_, err := NewEnrollmentMediaAction(config.NewBuildConfig(), keysDir, "", EnrollmentMediaOptions{}).Instructions()
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+	})
+})
@@ -18,13 +18,18 @@ package action_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/buildinfo"
 	"github.com/kairos-io/enki/pkg/config"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/history"
 	"github.com/kairos-io/enki/pkg/types"
 	"github.com/kairos-io/enki/pkg/utils"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
@@ -80,6 +85,7 @@ var _ = Describe("BuildISOAction", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 
 			cfg.Date = false
+			cfg.Name = "elemental"
 			cfg.OutDir = tmpDir
 
 			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
@@ -123,6 +129,369 @@ var _ = Describe("BuildISOAction", func() {
 
 			Expect(err).ShouldNot(HaveOccurred())
 		})
+		It("Writes the recovery image next to the ISO", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.Recovery = true
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			burnISO := runner.SideEffect
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				if command == "mksquashfs" {
+					return []byte{}, fs.WriteFile(args[1], []byte("squashed rootfs"), constants.FilePerm)
+				}
+				return burnISO(command, args...)
+			}
+
+			cfg.Outputs = &history.Outputs{}
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err = buildISO.ISORun()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(cfg.Outputs.Paths()).To(ConsistOf(
+				filepath.Join(cfg.OutDir, "elemental-recovery.squashfs"),
+				filepath.Join(cfg.OutDir, "elemental-recovery.squashfs.sha256"),
+				filepath.Join(cfg.OutDir, "elemental.iso"),
+				filepath.Join(cfg.OutDir, "elemental.iso.sha256"),
+			))
+
+			recovery, err := fs.ReadFile(filepath.Join(cfg.OutDir, "elemental-recovery.squashfs"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(recovery)).To(Equal("squashed rootfs"))
+			checksum, err := fs.ReadFile(filepath.Join(cfg.OutDir, "elemental-recovery.squashfs.sha256"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(checksum)).To(HaveSuffix(" elemental-recovery.squashfs\n"))
+		})
+		It("Writes a checksum file per algorithm", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.Recovery = true
+			iso.Checksums = []string{utils.ChecksumSHA512, utils.ChecksumBLAKE3}
+			iso.ChecksumFormat = utils.ChecksumFormatMultihash
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			burnISO := runner.SideEffect
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				if command == "mksquashfs" {
+					return []byte{}, fs.WriteFile(args[1], []byte("squashed rootfs"), constants.FilePerm)
+				}
+				return burnISO(command, args...)
+			}
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err = buildISO.ISORun()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			for _, artifact := range []string{"elemental.iso", "elemental-recovery.squashfs"} {
+				Expect(utils.Exists(fs, filepath.Join(cfg.OutDir, artifact+".sha256"))).To(BeFalse())
+				sha512, err := fs.ReadFile(filepath.Join(cfg.OutDir, artifact+".sha512"))
+				Expect(err).ShouldNot(HaveOccurred())
+				// sha2-512 multihash prefix, code 0x13 and 64 bytes length
+				Expect(string(sha512)).To(HavePrefix("1340"))
+				blake3, err := fs.ReadFile(filepath.Join(cfg.OutDir, artifact+".blake3"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(blake3)).To(HavePrefix("1e20"))
+				Expect(string(blake3)).To(HaveSuffix(" " + artifact + "\n"))
+			}
+		})
+		It("Embeds the build info into the rootfs and the ISO", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			cfg.BuildInfo = &buildinfo.Info{EnkiVersion: "v0.0.1", Sources: []buildinfo.Source{{URI: rootSrc.String()}}}
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// The temporary trees are gone once the build finishes, check them while packing
+			var inRootfs, inISO bool
+			burnISO := runner.SideEffect
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				switch command {
+				case "mksquashfs":
+					inRootfs, _ = utils.Exists(fs, filepath.Join(args[0], buildinfo.RootfsPath))
+				case "xorriso":
+					inISO, _ = utils.Exists(fs, filepath.Join("/tmp/enki-iso/iso", buildinfo.FileName))
+				}
+				return burnISO(command, args...)
+			}
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err = buildISO.ISORun()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(inRootfs).To(BeTrue())
+			Expect(inISO).To(BeTrue())
+		})
+		It("Uploads the ISO and its checksum", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.Upload = "s3://bucket/kairos"
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err = buildISO.ISORun()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{
+				{"aws", "s3", "cp", "--only-show-errors", filepath.Join(cfg.OutDir, "elemental.iso"), "s3://bucket/kairos/elemental.iso"},
+				{"aws", "s3", "cp", "--only-show-errors", filepath.Join(cfg.OutDir, "elemental.iso.sha256"), "s3://bucket/kairos/elemental.iso.sha256"},
+			})).To(Succeed())
+		})
+		It("Fails if the ISO exceeds the max size", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.MaxSize = "10"
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err = buildISO.ISORun()
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("exceeds the max size"))
+		})
+		It("Fails before packing the rootfs if its estimation exceeds the max size", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.MaxSize = "1KiB"
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			Expect(utils.MkdirAll(fs, bootDir, constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(bootDir, "vmlinuz"), make([]byte, 4096), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(bootDir, "initrd"), make([]byte, 4096), constants.FilePerm)).To(Succeed())
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err := buildISO.ISORun()
+			Expect(err).To(MatchError(failure.ErrSizeBudget))
+			Expect(err.Error()).To(ContainSubstring("Estimated ISO size"))
+			Expect(runner.IncludesCmds([][]string{{"mksquashfs"}})).ToNot(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"xorriso"}})).ToNot(Succeed())
+		})
+		It("Writes the per stage report into the JSON result", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			cfg.JSONResult = "/result.json"
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err = buildISO.ISORun()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			data, err := fs.ReadFile("/result.json")
+			Expect(err).ShouldNot(HaveOccurred())
+			var result struct {
+				Success bool `json:"success"`
+				Stages  []struct {
+					Name string `json:"name"`
+				} `json:"stages"`
+			}
+			Expect(json.Unmarshal(data, &result)).To(Succeed())
+			Expect(result.Success).To(BeTrue())
+			var names []string
+			for _, s := range result.Stages {
+				names = append(names, s.Name)
+			}
+			Expect(names).To(ContainElements("extract rootfs", "create squashfs", "create iso"))
+		})
+
+		It("Adds the EFI tools to the ISO grub menu", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.EFIShell = "/host/Shell.efi"
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+			// grub.cfg comes from the ISO image sources
+			grubDir := filepath.Join("/tmp/enki-iso/iso", constants.GrubPrefixDir)
+			Expect(utils.MkdirAll(fs, grubDir, constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(grubDir, constants.GrubCfg), []byte("menuentry kairos {}\n"), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/host", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/host/Shell.efi", []byte("shell"), constants.FilePerm)).To(Succeed())
+
+			var grubCfg []byte
+			burnISO := runner.SideEffect
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				// Capture the ISO tree before it gets removed
+				if command == "xorriso" {
+					grubCfg, _ = fs.ReadFile(filepath.Join(grubDir, constants.GrubCfg))
+					shell, err := fs.ReadFile(filepath.Join("/tmp/enki-iso/iso", constants.EfiToolsDir, "shellx64.efi"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(shell)).To(Equal("shell"))
+				}
+				return burnISO(command, args...)
+			}
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			err = buildISO.ISORun()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(grubCfg)).To(ContainSubstring("menuentry kairos {}"))
+			Expect(string(grubCfg)).To(ContainSubstring(`menuentry "UEFI Shell" --class efi`))
+			Expect(string(grubCfg)).To(ContainSubstring("chainloader /EFI/tools/shellx64.efi"))
+		})
+
+		It("Generates a signed standalone grub with the embedded config", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.GrubStandalone = true
+			iso.GrubKeys = "/keys"
+			iso.GrubSbat = "/host/sbat.csv"
+
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			// No grub in the rootfs, only shim
+			err = utils.MkdirAll(fs, filepath.Join(bootDir, "efi", "EFI", "fedora"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "shim.efi"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var mkstandalone []string
+			var embedded []byte
+			burnISO := runner.SideEffect
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				if strings.HasSuffix(command, "mkstandalone") {
+					mkstandalone = args
+					cfgFile := strings.TrimPrefix(args[len(args)-1], "boot/grub/grub.cfg=")
+					embedded, _ = fs.ReadFile(cfgFile)
+				}
+				return burnISO(command, args...)
+			}
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			Expect(buildISO.ISORun()).To(Succeed())
+			Expect(mkstandalone).To(ContainElements("x86_64-efi", "--sbat", "/host/sbat.csv"))
+			Expect(string(embedded)).To(Equal(constants.GrubStandaloneCfg))
+			Expect(string(embedded)).ToNot(ContainSubstring("set prefix"))
+			Expect(runner.MatchMilestones([][]string{
+				{"sbsign", "--key", "/keys/db.key", "--cert", "/keys/db.pem"},
+			})).To(Succeed())
+		})
+
+		It("Builds a legacy only ISO with isolinux", func() {
+			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
+			iso.RootFS = []*v1.ImageSource{rootSrc}
+			iso.LegacyOnly = true
+
+			// No EFI bootloader in the rootfs
+			bootDir := filepath.Join("/tmp/enki-iso/rootfs", "boot")
+			err := utils.MkdirAll(fs, bootDir, constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "vmlinuz"))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create(filepath.Join(bootDir, "initrd"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.MkdirAll(fs, "/usr/lib/ISOLINUX", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/usr/lib/syslinux/modules/bios", constants.DirPerm)).To(Succeed())
+			for _, file := range []string{"/usr/lib/ISOLINUX/isolinux.bin", "/usr/lib/ISOLINUX/isohdpfx.bin", "/usr/lib/syslinux/modules/bios/ldlinux.c32"} {
+				Expect(fs.WriteFile(file, []byte(filepath.Base(file)), constants.FilePerm)).To(Succeed())
+			}
+
+			var isolinuxCfg []byte
+			burnISO := runner.SideEffect
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				if command == "xorriso" {
+					isolinuxCfg, _ = fs.ReadFile(filepath.Join("/tmp/enki-iso/iso", constants.IsolinuxDir, constants.IsolinuxCfg))
+					ldlinux, err := fs.ReadFile(filepath.Join("/tmp/enki-iso/iso", constants.IsolinuxDir, "ldlinux.c32"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(ldlinux)).To(Equal("ldlinux.c32"))
+				}
+				return burnISO(command, args...)
+			}
+
+			buildISO := action.NewBuildISOAction(cfg, iso)
+			Expect(buildISO.ISORun()).To(Succeed())
+			Expect(string(isolinuxCfg)).To(ContainSubstring("APPEND cdroot root=live:CDLABEL=" + constants.ISOLabel))
+			Expect(runner.IncludesCmds([][]string{{"xorriso", "-as", "mkisofs", "-V", constants.ISOLabel, "-b", constants.IsolinuxBootFile}})).To(Succeed())
+			// No EFI image
+			Expect(runner.IncludesCmds([][]string{{"mcopy"}})).ToNot(Succeed())
+		})
+
 		It("Fails if kernel or initrd is not found in rootfs", func() {
 			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
 			iso.RootFS = []*v1.ImageSource{rootSrc}
@@ -0,0 +1,76 @@
+package action
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs"
+)
+
+var _ = Describe("verifySources", Label("verify", "trust"), func() {
+	const digest = "sha256:0d5ef3bb1c5bd8e8bbdf79c9c6d6e6f74acfe0f05b06d8a70f9dcfee8c0d3c67"
+	var runner *v1mock.FakeRunner
+	var policy string
+	var resolved []string
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		dir := GinkgoT().TempDir()
+		// Only looked up in the PATH, the runner is fake
+		Expect(os.WriteFile(filepath.Join(dir, "notation"), []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+		GinkgoT().Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		policy = filepath.Join(dir, "policy.yaml")
+		Expect(os.WriteFile(policy, []byte("rules:\n  - images: [\"quay.io/kairos/*\"]\n    notation: {}\n"), 0644)).To(Succeed())
+		resolved = nil
+		orig := resolveDigest
+		resolveDigest = func(ref string) (string, error) {
+			resolved = append(resolved, ref)
+			return digest, nil
+		}
+		DeferCleanup(func() { resolveDigest = orig })
+	})
+
+	It("verifies the digest the tags resolve to and pins the sources to it", func() {
+		pinned := "quay.io/kairos/fedora@sha256:4b1c6b0f6e7a4f8a3a0f0f3d6e36cbd7c2b2f9e3cf3b0f0ea8f8ab1f0e5e4a1f"
+		sources := []*v1.ImageSource{
+			v1.NewDockerSrc("quay.io/kairos/ubuntu:24.04"),
+			v1.NewDockerSrc(pinned),
+			v1.NewDirSrc("/overlay"),
+		}
+		verified, err := verifySources(v1.NewNullLogger(), runner, vfs.OSFS, nil, policy, sources...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolved).To(Equal([]string{"quay.io/kairos/ubuntu:24.04"}))
+		Expect(runner.CmdsMatch([][]string{
+			{"notation", "verify", "quay.io/kairos/ubuntu@" + digest},
+			{"notation", "verify", pinned},
+		})).To(Succeed())
+		Expect(verified).To(HaveLen(3))
+		Expect(verified[0].Value()).To(Equal("quay.io/kairos/ubuntu@" + digest))
+		Expect(verified[1].Value()).To(Equal(pinned))
+		Expect(verified[2]).To(Equal(sources[2]))
+		// The given sources are left as they are
+		Expect(sources[0].Value()).To(Equal("quay.io/kairos/ubuntu:24.04"))
+	})
+
+	It("fails without verifying if the tag can't be resolved", func() {
+		resolveDigest = func(ref string) (string, error) {
+			return "", errors.New("manifest unknown")
+		}
+		_, err := verifySources(v1.NewNullLogger(), runner, vfs.OSFS, nil, policy, v1.NewDockerSrc("quay.io/kairos/ubuntu:24.04"))
+		Expect(err).To(MatchError(failure.ErrVerification))
+		Expect(err).To(MatchError(ContainSubstring("manifest unknown")))
+		Expect(runner.IncludesCmds([][]string{{"notation"}})).ToNot(Succeed())
+	})
+
+	It("fails on images not signed as the policy requires", func() {
+		runner.ReturnError = errors.New("signature verification failed")
+		_, err := verifySources(v1.NewNullLogger(), runner, vfs.OSFS, nil, policy, v1.NewDockerSrc("quay.io/kairos/ubuntu:24.04"))
+		Expect(err).To(MatchError(failure.ErrVerification))
+	})
+})
@@ -0,0 +1,317 @@
+package action
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+)
+
+// The changes of the files between two artifacts
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "changed"
+)
+
+// Where the files compared are, prefixing their paths
+const (
+	// diffISO are the files of the ISO filesystem
+	diffISO = "iso:"
+	// diffESP are the files of the ESP image of the UKI ISOs, or of the ESP dirs
+	diffESP = "esp:"
+	// diffRootfs are the files of the rootfs squashfs of the ISOs
+	diffRootfs = "rootfs:"
+	// diffUKI are the sections of a single EFI binary
+	diffUKI = "uki"
+)
+
+// FileChange is a file added, removed or changed between two artifacts. Its path is prefixed by
+// where it is: iso: for the files of the ISO, esp: for the ones of its ESP image, of a FAT image or
+// of an ESP dir and rootfs: for the ones of its rootfs squashfs or of a squashfs image. The
+// sections of the EFI binaries follow their path, like esp:/EFI/BOOT/BOOTX64.EFI:.linux, or
+// uki:.linux for a single EFI binary.
+type FileChange struct {
+	Path      string `json:"path"`
+	Change    string `json:"change"`
+	OldSize   int64  `json:"old_size"`
+	NewSize   int64  `json:"new_size"`
+	OldSHA256 string `json:"old_sha256,omitempty"`
+	NewSHA256 string `json:"new_sha256,omitempty"`
+}
+
+// ValueChange is a value of the artifacts that changed, like the cmdline of an EFI binary, empty
+// on the side missing it
+type ValueChange struct {
+	Path string `json:"path"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// Diff is what changed between two artifacts
+type Diff struct {
+	Old     string        `json:"old"`
+	New     string        `json:"new"`
+	OldSize int64         `json:"old_size"`
+	NewSize int64         `json:"new_size"`
+	Files   []FileChange  `json:"files,omitempty"`
+	Cmdline []ValueChange `json:"cmdline,omitempty"`
+	// Signatures are the subjects of the certificates signing the EFI binaries
+	Signatures []ValueChange `json:"signatures,omitempty"`
+}
+
+// Changed tells if the contents of the artifacts differ
+func (d Diff) Changed() bool {
+	return len(d.Files) > 0 || len(d.Cmdline) > 0 || len(d.Signatures) > 0
+}
+
+// DiffAction reports what changed between two artifacts, like two releases or the last two
+// builds: the files of the ISO, of its ESP and of its rootfs, the sections, cmdlines and
+// signatures of the EFI binaries and the sizes
+type DiffAction struct {
+	logger v1.Logger
+	runner v1.Runner
+}
+
+func NewDiffAction(cfg *types.BuildConfig) *DiffAction {
+	return &DiffAction{logger: cfg.Logger, runner: cfg.Runner}
+}
+
+// contents are the files, cmdlines and signatures of an artifact, by their path
+type contents struct {
+	size       int64
+	files      map[string]fileSum
+	cmdline    map[string]string
+	signatures map[string]string
+}
+
+type fileSum struct {
+	size   int64
+	sha256 string
+}
+
+// Run returns what changed from the old artifact to the new one. Artifacts are ISOs, squashfs and
+// FAT images, single EFI binaries like UKIs, or ESP dirs like the uki and esp-dir outputs.
+func (d *DiffAction) Run(from, to string) (Diff, error) {
+	tmpDir, err := os.MkdirTemp("", "enki-diff-")
+	if err != nil {
+		return Diff{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	a, err := d.read(from, filepath.Join(tmpDir, "old"))
+	if err != nil {
+		return Diff{}, err
+	}
+	b, err := d.read(to, filepath.Join(tmpDir, "new"))
+	if err != nil {
+		return Diff{}, err
+	}
+	diff := Diff{Old: from, New: to, OldSize: a.size, NewSize: b.size}
+	for _, path := range keys(a.files, b.files) {
+		before, inOld := a.files[path]
+		after, inNew := b.files[path]
+		change := FileChange{Path: path, OldSize: before.size, NewSize: after.size, OldSHA256: before.sha256, NewSHA256: after.sha256}
+		switch {
+		case !inOld:
+			change.Change = ChangeAdded
+		case !inNew:
+			change.Change = ChangeRemoved
+		case before != after:
+			change.Change = ChangeModified
+		default:
+			continue
+		}
+		diff.Files = append(diff.Files, change)
+	}
+	diff.Cmdline = valueChanges(a.cmdline, b.cmdline)
+	diff.Signatures = valueChanges(a.signatures, b.signatures)
+	return diff, nil
+}
+
+// read returns the contents of the artifact, extracting it into workDir
+func (d *DiffAction) read(artifact, workDir string) (*contents, error) {
+	info, err := os.Stat(artifact)
+	if err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	d.logger.Infof("Reading %s", artifact)
+	c := &contents{files: map[string]fileSum{}, cmdline: map[string]string{}, signatures: map[string]string{}}
+	// ESP dirs, like the uki and esp-dir outputs
+	if info.IsDir() {
+		if c.size, err = utils.DirSize(vfs.OSFS, artifact); err != nil {
+			return nil, err
+		}
+		return c, c.addTree(diffESP, artifact, true)
+	}
+	c.size = info.Size()
+	kind, err := artifactKind(artifact)
+	if err != nil {
+		return nil, err
+	}
+	if kind == artifactEFI {
+		return c, c.addEFI(diffUKI, artifact)
+	}
+	extract := &ExtractAction{logger: d.logger, runner: d.runner}
+	if err = extract.extract(kind, artifact, workDir); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case artifactISO:
+		err = c.addISO(workDir)
+	case artifactSquashfs:
+		err = c.addTree(diffRootfs, workDir, false)
+	case artifactFAT:
+		err = c.addTree(diffESP, workDir, true)
+	}
+	return c, err
+}
+
+// addISO adds the files of the ISO extracted into dir, along with the ones of its ESP image and
+// of its rootfs squashfs, and the cmdlines of its grub config
+func (c *contents) addISO(dir string) error {
+	isoDir := filepath.Join(dir, extractedISO)
+	if err := c.addTree(diffISO, isoDir, false); err != nil {
+		return err
+	}
+	grubCfg := filepath.Join(constants.GrubPrefixDir, constants.GrubCfg)
+	if data, err := os.ReadFile(filepath.Join(isoDir, grubCfg)); err == nil {
+		var cmdlines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && (fields[0] == "linux" || fields[0] == "linuxefi") {
+				cmdlines = append(cmdlines, strings.Join(fields[2:], " "))
+			}
+		}
+		c.cmdline[diffISO+grubCfg] = strings.Join(cmdlines, "\n")
+	}
+	for _, tree := range []struct {
+		prefix, dir string
+		efi         bool
+	}{{diffESP, extractedESP, true}, {diffRootfs, extractedRootfs, false}} {
+		if _, err := os.Stat(filepath.Join(dir, tree.dir)); err != nil {
+			continue
+		}
+		if err := c.addTree(tree.prefix, filepath.Join(dir, tree.dir), tree.efi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTree adds the regular files and symlinks of dir, the symlinks summed by their target. The
+// EFI binaries are read too if efi is set.
+func (c *contents) addTree(prefix, dir string, efi bool) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := prefix + "/" + filepath.ToSlash(rel)
+		switch {
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			c.files[name] = sumBytes([]byte(target))
+		case entry.Type().IsRegular():
+			sum, err := sumFile(path)
+			if err != nil {
+				return err
+			}
+			c.files[name] = sum
+			if efi && strings.EqualFold(filepath.Ext(path), ".efi") {
+				return c.addEFI(name, path)
+			}
+		}
+		return nil
+	})
+}
+
+// addEFI adds the sections, cmdline and signatures of the EFI binary at path
+func (c *contents) addEFI(name, path string) error {
+	sections, err := peSections(path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	for section, data := range sections {
+		c.files[name+":"+section] = sumBytes(data)
+		if section == ".cmdline" {
+			c.cmdline[name] = strings.TrimRight(string(data), "\x00\n ")
+		}
+	}
+	signatures, err := secureboot.Signatures(path, nil)
+	if err != nil {
+		return err
+	}
+	var subjects []string
+	for _, s := range signatures {
+		subjects = append(subjects, s.Subject)
+	}
+	c.signatures[name] = strings.Join(subjects, "\n")
+	return nil
+}
+
+// valueChanges returns the values changed between from and to
+func valueChanges(from, to map[string]string) []ValueChange {
+	var changes []ValueChange
+	for _, path := range keys(from, to) {
+		if from[path] != to[path] {
+			changes = append(changes, ValueChange{Path: path, Old: from[path], New: to[path]})
+		}
+	}
+	return changes
+}
+
+// keys returns the keys of both maps, sorted
+func keys[V any](a, b map[string]V) []string {
+	seen := map[string]bool{}
+	for k := range a {
+		seen[k] = true
+	}
+	for k := range b {
+		seen[k] = true
+	}
+	sorted := make([]string, 0, len(seen))
+	for k := range seen {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func sumFile(path string) (fileSum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileSum{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fileSum{}, err
+	}
+	return fileSum{size: size, sha256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func sumBytes(data []byte) fileSum {
+	sum := sha256.Sum256(data)
+	return fileSum{size: int64(len(data)), sha256: hex.EncodeToString(sum[:])}
+}
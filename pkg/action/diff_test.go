@@ -0,0 +1,85 @@
+package action
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DiffAction", Label("diff"), func() {
+	var dir string
+	sections := []string{".osrel", ".cmdline", ".linux"}
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("reports the changed sections, cmdline and signatures of EFI binaries", func() {
+		from, to := filepath.Join(dir, "old.efi"), filepath.Join(dir, "new.efi")
+		Expect(os.WriteFile(from, fakePE(sections, map[string]string{".osrel": "ID=kairos", ".cmdline": "console=tty1", ".linux": "kernel"}), 0644)).To(Succeed())
+		Expect(os.WriteFile(to, fakePE(sections, map[string]string{".osrel": "ID=kairos", ".cmdline": "console=ttyS0", ".linux": "kernel"}), 0644)).To(Succeed())
+		keysDir := GinkgoT().TempDir()
+		writeRotationKeys(keysDir, "release")
+		kp, err := secureboot.LoadKeyPair(keysDir, "db")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(secureboot.AppendSignature(to, kp)).To(Succeed())
+
+		diff, err := NewDiffAction(config.NewBuildConfig()).Run(from, to)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Changed()).To(BeTrue())
+		Expect(diff.NewSize).To(BeNumerically(">", diff.OldSize))
+		Expect(diff.Files).To(HaveLen(1))
+		Expect(diff.Files[0].Path).To(Equal("uki:.cmdline"))
+		Expect(diff.Files[0].Change).To(Equal(ChangeModified))
+		Expect(diff.Files[0].NewSize - diff.Files[0].OldSize).To(BeEquivalentTo(1))
+		Expect(diff.Cmdline).To(Equal([]ValueChange{{Path: "uki", Old: "console=tty1", New: "console=ttyS0"}}))
+		Expect(diff.Signatures).To(Equal([]ValueChange{{Path: "uki", New: "CN=release-db"}}))
+	})
+
+	It("reports the files added, removed and changed in ESP dirs", func() {
+		from, to := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+		for _, esp := range []string{from, to} {
+			Expect(os.MkdirAll(filepath.Join(esp, "EFI", "BOOT"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(esp, "loader", "entries"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(esp, "EFI", "BOOT", "BOOTX64.EFI"), fakePE([]string{".text"}, map[string]string{".text": "boot"}), 0644)).To(Succeed())
+		}
+		Expect(os.WriteFile(filepath.Join(from, "loader", "loader.conf"), []byte("timeout 5\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(to, "loader", "loader.conf"), []byte("timeout 10\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(from, "loader", "entries", "recovery.conf"), []byte("title recovery\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(to, "loader", "entries", "active.conf"), []byte("title active\n"), 0644)).To(Succeed())
+
+		diff, err := NewDiffAction(config.NewBuildConfig()).Run(from, to)
+		Expect(err).ToNot(HaveOccurred())
+		var changes []string
+		for _, f := range diff.Files {
+			changes = append(changes, f.Change+" "+f.Path)
+		}
+		Expect(changes).To(Equal([]string{
+			"added esp:/loader/entries/active.conf",
+			"removed esp:/loader/entries/recovery.conf",
+			"changed esp:/loader/loader.conf",
+		}))
+		Expect(diff.Cmdline).To(BeEmpty())
+		Expect(diff.Signatures).To(BeEmpty())
+		Expect(diff.NewSize - diff.OldSize).To(BeEquivalentTo(-1))
+	})
+
+	It("reports no changes between the same artifacts", func() {
+		uki := filepath.Join(dir, "uki.efi")
+		Expect(os.WriteFile(uki, fakePE(sections, map[string]string{".cmdline": "console=tty1"}), 0644)).To(Succeed())
+		diff, err := NewDiffAction(config.NewBuildConfig()).Run(uki, uki)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Changed()).To(BeFalse())
+	})
+
+	It("refuses artifacts of unknown kinds", func() {
+		img := filepath.Join(dir, "disk.raw")
+		Expect(os.WriteFile(img, []byte("raw"), 0644)).To(Succeed())
+		_, err := NewDiffAction(config.NewBuildConfig()).Run(img, img)
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
@@ -0,0 +1,130 @@
+package action
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/estimate"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/workdir"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// Estimate is what the builds from an image would create and need, in bytes
+type Estimate struct {
+	Image  string `json:"image"`
+	Rootfs int64  `json:"rootfs"`
+	Kernel int64  `json:"kernel"`
+	Initrd int64  `json:"initrd"`
+	// Squashfs is the rootfs squashfs of build-iso with each compression, gzip by default
+	Squashfs map[string]int64 `json:"squashfs"`
+	// UKI is a UKI of build-uki, its kernel and its zstd compressed initrd made of the rootfs
+	UKI int64 `json:"uki"`
+	// ESP is the EFI image of the build-uki ISOs with a single UKI
+	ESP int64 `json:"esp"`
+	// Scratch is the free space build-iso and build-uki need for their work area and artifacts
+	Scratch map[string]int64 `json:"scratch"`
+	// Sampled is the fraction of the rootfs compressed to estimate the compressed sizes
+	Sampled float64 `json:"sampled"`
+}
+
+// EstimateOptions tune the estimate
+type EstimateOptions struct {
+	// Sample is how much of the rootfs to compress, all of it if 0
+	Sample int64
+	// EspHeadroom is the free space left in the EFI image, as a percentage of its contents
+	EspHeadroom int
+}
+
+// EstimateAction guesses the size of the artifacts built from an image, and of the space needed
+// to build them, before any build is started
+type EstimateAction struct {
+	cfg  *types.BuildConfig
+	img  *v1.ImageSource
+	opts EstimateOptions
+}
+
+func NewEstimateAction(cfg *types.BuildConfig, img *v1.ImageSource, opts EstimateOptions) *EstimateAction {
+	return &EstimateAction{cfg: cfg, img: img, opts: opts}
+}
+
+// Run extracts the image and estimates the sizes from its rootfs. The compressed sizes are
+// extrapolated from the compressed sample of the rootfs, they are usually within a few percents
+// of the real ones.
+func (e *EstimateAction) Run() (*Estimate, error) {
+	rootDir, err := utils.TempDir(e.cfg.Fs, e.cfg.Workdirs[workdir.Rootfs], "enki-estimate")
+	if err != nil {
+		return nil, err
+	}
+	defer e.cfg.Fs.RemoveAll(rootDir)
+	e.cfg.Logger.Infof("Extracting %s", e.img.String())
+	el := elemental.NewElemental(&e.cfg.Config)
+	if _, err = el.DumpSource(rootDir, e.img); err != nil {
+		return nil, err
+	}
+
+	est := &Estimate{Image: e.img.String(), Squashfs: map[string]int64{}, Scratch: map[string]int64{}}
+	if est.Rootfs, err = utils.DirSize(e.cfg.Fs, rootDir); err != nil {
+		return nil, err
+	}
+	kernel, initrd, err := el.FindKernelInitrd(rootDir)
+	if err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "pass an image with a kernel and an initrd, like the Kairos ones")
+	}
+	if est.Kernel, err = utils.DirSize(e.cfg.Fs, kernel); err != nil {
+		return nil, err
+	}
+	if est.Initrd, err = utils.DirSize(e.cfg.Fs, initrd); err != nil {
+		return nil, err
+	}
+
+	sample := est.Rootfs
+	if e.opts.Sample > 0 && e.opts.Sample < sample {
+		sample = e.opts.Sample
+	}
+	est.Sampled = float64(sample) / float64(max(est.Rootfs, 1))
+	e.cfg.Logger.Infof("Compressing %s of the %s rootfs", utils.FormatSize(sample), utils.FormatSize(est.Rootfs))
+	ratios, err := estimate.Compress(e.cfg.Fs, rootDir, est.Rootfs, e.opts.Sample)
+	if err != nil {
+		return nil, err
+	}
+	for _, compression := range estimate.Compressions() {
+		est.Squashfs[compression] = ratios.Of(compression, est.Rootfs)
+	}
+	// The initrd of the image is dropped from the rootfs, which becomes the initrd of the UKI
+	ukiInitrd := ratios.Of(estimate.Zstd, est.Rootfs-est.Initrd)
+	est.UKI = est.Kernel + ukiInitrd
+
+	sizing, err := utils.NewEspSizing(e.opts.EspHeadroom, "", "")
+	if err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	// systemd-boot, the UKI, its loader entry and the loader config, in the EFI, EFI/BOOT,
+	// EFI/kairos, loader and loader/entries dirs
+	files := []int64{est.UKI, fatEntrySize, fatEntrySize}
+	entries, _ := e.cfg.Fs.ReadDir(filepath.Join(rootDir, "usr/lib/systemd/boot/efi"))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "systemd-boot") {
+			files = append(files, entry.Size())
+			break
+		}
+	}
+	if est.ESP, err = utils.EspSize(sizing, 5, files...); err != nil {
+		return nil, err
+	}
+
+	// build-iso extracts the rootfs and creates the squashfs, which is copied into the ISO along
+	// with the kernel and the initrd
+	squashfs := est.Squashfs[estimate.Gzip]
+	est.Scratch["build-iso"] = est.Rootfs + squashfs + squashfs + est.Kernel + est.Initrd
+	// build-uki extracts the rootfs and creates the initrd and the UKI from it, which ends up in
+	// the EFI image of the ISO, itself copied into the ISO
+	est.Scratch["build-uki"] = est.Rootfs + ukiInitrd + est.UKI + 2*est.ESP
+	return est, nil
+}
+
+// fatEntrySize is the size of the small config files of the ESP, a cluster at most
+const fatEntrySize = 512
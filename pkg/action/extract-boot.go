@@ -0,0 +1,91 @@
+package action
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/workdir"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// ExtractBootOptions tell where to write the boot files of the image
+type ExtractBootOptions struct {
+	// Kernel and Initrd are the paths to write the kernel and the initrd to, skipped if empty
+	Kernel string
+	Initrd string
+	// KernelVersion picks the kernel of the image, the default one the builds boot if empty
+	KernelVersion string
+}
+
+// ExtractBootAction pulls the kernel and the initrd out of an image, without building anything
+// else, for netbooting them or debugging the initrd
+type ExtractBootAction struct {
+	cfg  *types.BuildConfig
+	img  *v1.ImageSource
+	opts ExtractBootOptions
+}
+
+func NewExtractBootAction(cfg *types.BuildConfig, img *v1.ImageSource, opts ExtractBootOptions) *ExtractBootAction {
+	return &ExtractBootAction{cfg: cfg, img: img, opts: opts}
+}
+
+// Run extracts the image and copies its kernel and initrd to the outputs
+func (e *ExtractBootAction) Run() error {
+	rootDir, err := utils.TempDir(e.cfg.Fs, e.cfg.Workdirs[workdir.Rootfs], "enki-extract-boot")
+	if err != nil {
+		return err
+	}
+	defer e.cfg.Fs.RemoveAll(rootDir)
+	e.cfg.Logger.Infof("Extracting %s", e.img.String())
+	el := elemental.NewElemental(&e.cfg.Config)
+	if _, err = el.DumpSource(rootDir, e.img); err != nil {
+		return err
+	}
+
+	kernel, initrd, err := e.findKernelInitrd(rootDir)
+	if err != nil {
+		return err
+	}
+	for _, out := range []struct{ source, target string }{{kernel, e.opts.Kernel}, {initrd, e.opts.Initrd}} {
+		if out.target == "" {
+			continue
+		}
+		e.cfg.Logger.Infof("Copying %s to %s", strings.TrimPrefix(out.source, rootDir), out.target)
+		if err = utils.MkdirAll(e.cfg.Fs, filepath.Dir(out.target), constants.DirPerm); err != nil {
+			return err
+		}
+		if err = utils.CopyFile(e.cfg.Fs, out.source, out.target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findKernelInitrd returns the kernel and the initrd of the requested version in the rootfs,
+// the ones the builds pick if none is requested
+func (e *ExtractBootAction) findKernelInitrd(rootDir string) (kernel, initrd string, err error) {
+	versions, err := utils.KernelVersions(e.cfg.Fs, rootDir)
+	if err != nil {
+		return "", "", err
+	}
+	if e.opts.KernelVersion != "" {
+		kernel, initrd, err = utils.FindVersionedKernelInitrd(e.cfg.Fs, rootDir, e.opts.KernelVersion)
+		if err != nil {
+			return "", "", failure.New(failure.ErrInvalidConfig, err, "pass one of the kernel versions of the image, or none for the default one")
+		}
+		return kernel, initrd, nil
+	}
+	if len(versions) > 1 {
+		e.cfg.Logger.Infof("The image has the kernels %s, extracting the default one", strings.Join(versions, ", "))
+	}
+	kernel, initrd, err = elemental.NewElemental(&e.cfg.Config).FindKernelInitrd(rootDir)
+	if err != nil {
+		return "", "", failure.New(failure.ErrInvalidConfig, err, "pass an image with a kernel and an initrd, like the Kairos ones")
+	}
+	return kernel, initrd, nil
+}
@@ -0,0 +1,193 @@
+package action
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/types"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// The kinds of artifacts that can be extracted, told apart by their contents
+const (
+	artifactISO      = "ISO"
+	artifactSquashfs = "squashfs"
+	artifactFAT      = "FAT image"
+	artifactEFI      = "EFI binary"
+)
+
+// The dirs the ISOs are extracted into
+const (
+	// extractedISO holds the files of the ISO filesystem
+	extractedISO = "iso"
+	// extractedESP holds the files of the ESP image of the UKI ISOs
+	extractedESP = "esp"
+	// extractedRootfs holds the files of the rootfs squashfs of the ISOs
+	extractedRootfs = "rootfs"
+)
+
+// ExtractAction unpacks artifacts into a dir tree, to inspect or patch them
+type ExtractAction struct {
+	logger v1.Logger
+	runner v1.Runner
+}
+
+func NewExtractAction(cfg *types.BuildConfig) *ExtractAction {
+	return &ExtractAction{logger: cfg.Logger, runner: cfg.Runner}
+}
+
+// Run unpacks the artifact into dir, which must be empty. ISOs are extracted into an iso dir, along
+// with their ESP image into esp and their rootfs squashfs into rootfs. Squashfs and FAT images are
+// extracted as they are, and every section of the EFI binaries, like the kernel, initrd and cmdline
+// of the UKIs, is written to a file named after it.
+func (e *ExtractAction) Run(artifact, dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return failure.Errorf(failure.ErrInvalidConfig, "extract into a new or empty dir", "%s is not empty", dir)
+	}
+	kind, err := artifactKind(artifact)
+	if err != nil {
+		return err
+	}
+	e.logger.Infof("Extracting the %s %s into %s", kind, artifact, dir)
+	return e.extract(kind, artifact, dir)
+}
+
+// extract unpacks the artifact of the given kind into dir
+func (e *ExtractAction) extract(kind, artifact, dir string) error {
+	switch kind {
+	case artifactISO:
+		return e.extractISO(artifact, dir)
+	case artifactSquashfs:
+		return e.extractSquashfs(artifact, dir)
+	case artifactFAT:
+		if err := lookPath("mcopy"); err != nil {
+			return err
+		}
+		return extractFAT(e.runner, artifact, dir)
+	case artifactEFI:
+		return extractEFI(artifact, dir)
+	}
+	return failure.Errorf(failure.ErrInvalidConfig, "pass an ISO, squashfs, FAT image or EFI binary", "can't tell which kind of artifact %s is", artifact)
+}
+
+// extractISO extracts the files of the ISO, along with the ones of its ESP image and of its rootfs
+// squashfs
+func (e *ExtractAction) extractISO(artifact, dir string) error {
+	if err := lookPath("xorriso"); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	isoDir := filepath.Join(dir, extractedISO)
+	out, err := e.runner.Run("xorriso", "-osirrox", "on", "-indev", artifact, "-extract", "/", isoDir)
+	if err != nil {
+		return fmt.Errorf("extracting %s: %w\n%s", artifact, err, string(out))
+	}
+	// xorriso extracts the files read-only, like they are in the ISO, which can't be patched nor
+	// removed from their dirs then
+	err = filepath.WalkDir(isoDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.Type()&fs.ModeSymlink != 0 {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, info.Mode().Perm()|0200)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(isoDir, constants.UkiIsoEfiImage)); err == nil {
+		if err = e.extract(artifactFAT, filepath.Join(isoDir, constants.UkiIsoEfiImage), filepath.Join(dir, extractedESP)); err != nil {
+			return err
+		}
+	}
+	if _, err = os.Stat(filepath.Join(isoDir, constants.IsoRootFile)); err == nil {
+		if err = e.extractSquashfs(filepath.Join(isoDir, constants.IsoRootFile), filepath.Join(dir, extractedRootfs)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractSquashfs extracts the files of the squashfs image into dir
+func (e *ExtractAction) extractSquashfs(img, dir string) error {
+	if err := lookPath("unsquashfs"); err != nil {
+		return err
+	}
+	out, err := e.runner.Run("unsquashfs", "-f", "-d", dir, img)
+	if err != nil {
+		return fmt.Errorf("extracting the files of %s: %w\n%s", filepath.Base(img), err, string(out))
+	}
+	return nil
+}
+
+// extractEFI writes every section of the EFI binary to a file of dir named after it, without
+// its leading dot
+func extractEFI(binary, dir string) error {
+	sections, err := peSections(binary)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", binary, err)
+	}
+	if err = os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	for section, data := range sections {
+		name := strings.TrimPrefix(section, ".")
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			continue
+		}
+		if err = os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artifactKind tells which kind of artifact the file at path is from its magic numbers, empty if
+// it's none of the known ones
+func artifactKind(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	defer f.Close()
+	// The ISO9660 volume descriptors start after the 32KiB of the system area
+	header := make([]byte, 0x8006)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+	switch {
+	case len(header) >= 0x8006 && string(header[0x8001:0x8006]) == "CD001":
+		return artifactISO, nil
+	case bytes.HasPrefix(header, []byte("hsqs")):
+		return artifactSquashfs, nil
+	case bytes.HasPrefix(header, []byte("MZ")):
+		return artifactEFI, nil
+	case len(header) >= 512 && header[510] == 0x55 && header[511] == 0xaa &&
+		(bytes.HasPrefix(header[0x36:], []byte("FAT")) || bytes.HasPrefix(header[0x52:], []byte("FAT"))):
+		return artifactFAT, nil
+	}
+	return "", nil
+}
+
+// lookPath fails if binary is not in the PATH, hinting how to install it
+func lookPath(binary string) error {
+	if _, err := exec.LookPath(binary); err != nil {
+		return failure.New(failure.ErrMissingDependency, err, deps.Hint(binary))
+	}
+	return nil
+}
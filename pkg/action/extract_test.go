@@ -0,0 +1,54 @@
+package action
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ExtractAction", Label("extract"), func() {
+	var dir string
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("writes the sections of EFI binaries to files", func() {
+		uki := filepath.Join(dir, "uki.efi")
+		Expect(os.WriteFile(uki, fakePE([]string{".osrel", ".cmdline", ".linux"}, map[string]string{".osrel": "ID=kairos", ".cmdline": "console=tty1", ".linux": "kernel"}), 0644)).To(Succeed())
+		out := filepath.Join(dir, "out")
+		Expect(NewExtractAction(config.NewBuildConfig()).Run(uki, out)).To(Succeed())
+		for name, content := range map[string]string{"osrel": "ID=kairos", "cmdline": "console=tty1", "linux": "kernel"} {
+			Expect(os.ReadFile(filepath.Join(out, name))).To(BeEquivalentTo(content))
+		}
+	})
+
+	It("refuses dirs that are not empty", func() {
+		uki := filepath.Join(dir, "uki.efi")
+		Expect(os.WriteFile(uki, fakePE([]string{".linux"}, map[string]string{".linux": "kernel"}), 0644)).To(Succeed())
+		err := NewExtractAction(config.NewBuildConfig()).Run(uki, dir)
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+
+	It("tells the kinds of artifacts from their contents", func() {
+		iso := make([]byte, 0x8800)
+		copy(iso[0x8001:], "CD001")
+		fat := make([]byte, 512)
+		copy(fat[0x52:], "FAT32   ")
+		fat[510], fat[511] = 0x55, 0xaa
+		for kind, data := range map[string][]byte{
+			artifactISO:      iso,
+			artifactSquashfs: []byte("hsqs\x00\x00"),
+			artifactFAT:      fat,
+			artifactEFI:      fakePE([]string{".text"}, map[string]string{".text": "boot"}),
+			"":               []byte("raw"),
+		} {
+			path := filepath.Join(dir, "artifact")
+			Expect(os.WriteFile(path, data, 0644)).To(Succeed())
+			Expect(artifactKind(path)).To(Equal(kind))
+		}
+	})
+})
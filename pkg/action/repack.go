@@ -0,0 +1,296 @@
+package action
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/buildinfo"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+)
+
+// The ESP images are sized and formatted like the defaults of build-uki
+const (
+	repackEspHeadroom = 10
+	repackEspAlign    = "1MiB"
+	repackEspFat      = "32"
+)
+
+// cdLabel is the label the grub config of the live ISOs finds the live root by
+var cdLabel = regexp.MustCompile(`CDLABEL=([^\s"']+)`)
+
+// RepackAction builds an artifact again out of a tree unpacked by ExtractAction once patched,
+// signing its EFI binaries again if given the keys
+type RepackAction struct {
+	logger v1.Logger
+	runner v1.Runner
+	// keysDirectory has the keys signing the EFI binaries again, they are kept as they are if empty
+	keysDirectory string
+	// label is the volume label of the ISOs, found out from the grub config if empty
+	label string
+}
+
+func NewRepackAction(cfg *types.BuildConfig, keysDirectory, label string) *RepackAction {
+	return &RepackAction{logger: cfg.Logger, runner: cfg.Runner, keysDirectory: keysDirectory, label: label}
+}
+
+// Run packs dir into the artifact, which must not exist, told which kind it is by its extension:
+// .iso for ISOs out of the iso, esp and rootfs dirs, .squashfs or .sfs for squashfs images, .img
+// for FAT images and .efi for UKIs built out of the files of their sections.
+func (r *RepackAction) Run(dir, artifact string) error {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return failure.Errorf(failure.ErrInvalidConfig, "pass the dir enki extract unpacked the artifact into", "%s is not a dir", dir)
+	}
+	if _, err := os.Stat(artifact); err == nil {
+		return failure.Errorf(failure.ErrInvalidConfig, "pass the path of a new artifact", "%s already exists, it is not overwritten", artifact)
+	}
+	var kind string
+	switch strings.ToLower(filepath.Ext(artifact)) {
+	case ".iso":
+		kind = artifactISO
+	case ".squashfs", ".sfs":
+		kind = artifactSquashfs
+	case ".img":
+		kind = artifactFAT
+	case ".efi":
+		kind = artifactEFI
+	default:
+		return failure.Errorf(failure.ErrInvalidConfig, "name the artifact .iso, .squashfs, .img or .efi", "can't tell which kind of artifact %s is", artifact)
+	}
+	if err := r.checkDeps(kind); err != nil {
+		return err
+	}
+	r.logger.Infof("Repacking %s into the %s %s", dir, kind, artifact)
+	var err error
+	switch kind {
+	case artifactISO:
+		err = r.repackISO(dir, artifact)
+	case artifactSquashfs:
+		err = r.repackSquashfs(dir, artifact)
+	case artifactFAT:
+		err = r.repackFAT(dir, artifact)
+	case artifactEFI:
+		err = r.repackEFI(dir, artifact)
+	}
+	if err != nil {
+		_ = os.Remove(artifact)
+		return err
+	}
+	r.logger.Infof("Repacked %s", artifact)
+	return nil
+}
+
+// checkDeps fails if any of the tools to pack the kind of artifact is missing
+func (r *RepackAction) checkDeps(kind string) error {
+	binaries := map[string][]string{
+		artifactISO:      {"xorriso", "mksquashfs", "mkfs.msdos", "mmd", "mcopy"},
+		artifactSquashfs: {"mksquashfs"},
+		artifactFAT:      {"mkfs.msdos", "mmd", "mcopy"},
+		artifactEFI:      {"/usr/lib/systemd/ukify"},
+	}[kind]
+	if r.keysDirectory != "" {
+		binaries = append(binaries, "/usr/lib/systemd/ukify", "sbsign", "sbattach", "objcopy")
+	}
+	for _, b := range binaries {
+		if err := lookPath(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repackISO packs the iso dir into the ISO, along with the esp dir as its ESP image and the
+// rootfs dir as its rootfs squashfs. The ISO boots like the ones of build-iso if it has their
+// BIOS boot image, or isolinux for legacy only ones, like the ones of build-uki otherwise.
+func (r *RepackAction) repackISO(dir, artifact string) error {
+	isoDir := filepath.Join(dir, extractedISO)
+	if _, err := os.Stat(isoDir); err != nil {
+		return failure.Errorf(failure.ErrInvalidConfig, "extract the ISO with enki extract", "%s has no %s dir", dir, extractedISO)
+	}
+	// Staged next to the artifact, where the files can be reflinked
+	tmpDir, err := os.MkdirTemp(filepath.Dir(artifact), ".repack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	root := filepath.Join(tmpDir, extractedISO)
+	if err = utils.CopyTree(vfs.OSFS, isoDir, root, utils.CopyOptions{}); err != nil {
+		return err
+	}
+
+	for _, image := range []struct {
+		dir, file string
+		pack      func(dir, file string) error
+	}{
+		{extractedESP, constants.UkiIsoEfiImage, r.repackFAT},
+		{extractedRootfs, constants.IsoRootFile, r.repackSquashfs},
+	} {
+		if _, err = os.Stat(filepath.Join(dir, image.dir)); err != nil {
+			continue
+		}
+		file := filepath.Join(root, image.file)
+		if err = os.RemoveAll(file); err != nil {
+			return err
+		}
+		if err = image.pack(filepath.Join(dir, image.dir), file); err != nil {
+			return err
+		}
+	}
+
+	opts := iso.Options{Root: root, Output: artifact, VolumeID: r.isoLabel(root), RockRidge: true, Joliet: true}
+	if _, err = os.Stat(filepath.Join(root, constants.IsolinuxBootFile)); err == nil {
+		opts.BIOSBootImage = constants.IsolinuxBootFile
+		opts.HybridMBR = constants.IsolinuxMBR
+		opts.BootCatalog = constants.IsolinuxBootCatalog
+		opts.Isolinux = true
+	} else if _, err = os.Stat(filepath.Join(root, constants.IsoBootFile)); err == nil {
+		opts.BIOSBootImage = constants.IsoBootFile
+		opts.HybridMBR = constants.IsoHybridMBR
+		opts.BootCatalog = constants.IsoBootCatalog
+		opts.EFIImage = constants.IsoEFIPath
+	} else {
+		opts.EFIImage = constants.UkiIsoEfiImage
+	}
+	engine, err := iso.NewEngine(iso.EngineXorriso, r.runner)
+	if err != nil {
+		return err
+	}
+	return engine.Create(opts)
+}
+
+// isoLabel returns the label of the ISO out of the tree at root: the given one, the one the grub
+// or isolinux config looks for, or the one of the UKI ISOs
+func (r *RepackAction) isoLabel(root string) string {
+	if r.label != "" {
+		return r.label
+	}
+	for _, cfg := range []string{filepath.Join(constants.GrubPrefixDir, constants.GrubCfg), filepath.Join(constants.IsolinuxDir, constants.IsolinuxCfg)} {
+		data, err := os.ReadFile(filepath.Join(root, cfg))
+		if match := cdLabel.FindSubmatch(data); err == nil && match != nil {
+			return string(match[1])
+		}
+	}
+	return constants.UkiIsoLabel
+}
+
+// repackSquashfs packs dir into the squashfs image file
+func (r *RepackAction) repackSquashfs(dir, file string) error {
+	return utils.CreateSquashFS(r.runner, r.logger, dir, file, constants.GetDefaultSquashfsOptions())
+}
+
+// repackFAT packs dir into the FAT image file, signing its EFI binaries again first if given
+// the keys
+func (r *RepackAction) repackFAT(dir, file string) error {
+	if r.keysDirectory != "" {
+		tmpDir, err := os.MkdirTemp("", "enki-repack-esp-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		signed := filepath.Join(tmpDir, "esp")
+		if err = utils.CopyTree(vfs.OSFS, dir, signed, utils.CopyOptions{}); err != nil {
+			return err
+		}
+		if err = r.resigner().resignTree(signed); err != nil {
+			return err
+		}
+		dir = signed
+	}
+
+	// The files by the dir of the image they go to, every dir but the root one is created
+	filesMap := map[string][]string{}
+	dirs := map[string][]string{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := "/" + filepath.ToSlash(rel)
+		if entry.IsDir() {
+			dirs[target] = nil
+			return nil
+		}
+		filesMap[filepath.Dir(target)] = append(filesMap[filepath.Dir(target)], path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for d := range dirs {
+		if _, ok := filesMap[d]; !ok {
+			filesMap[d] = nil
+		}
+	}
+
+	sizing, err := utils.NewEspSizing(repackEspHeadroom, repackEspAlign, "")
+	if err != nil {
+		return err
+	}
+	fat, err := utils.NewFatOptions(repackEspFat, "", "")
+	if err != nil {
+		return err
+	}
+	fat.ApplyTo(&sizing)
+	size, err := espSize(filesMap, sizing)
+	if err != nil {
+		return err
+	}
+	if err = createImgWithSize(file, size); err != nil {
+		return err
+	}
+	if err = createImgDirs(file, dirs, fat); err != nil {
+		return err
+	}
+	return copyFilesToImg(file, filesMap)
+}
+
+// repackEFI builds the UKI out of the files of the sections in dir with the stub of the host,
+// signing it if given the keys. The sections of the stub itself are left out.
+func (r *RepackAction) repackEFI(dir, file string) error {
+	var args []string
+	for _, section := range ukiSections {
+		path := filepath.Join(dir, strings.TrimPrefix(section.name, "."))
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if section.file {
+			args = append(args, section.option, path)
+		} else {
+			args = append(args, section.option, "@"+path)
+		}
+	}
+	if len(args) == 0 {
+		return failure.Errorf(failure.ErrInvalidConfig, "extract the UKI with enki extract", "%s has none of the sections of a UKI", dir)
+	}
+	path := filepath.Join(dir, strings.TrimPrefix(buildinfo.UKISection, "."))
+	if _, err := os.Stat(path); err == nil {
+		args = append(args, "--section", fmt.Sprintf("%s:@%s", buildinfo.UKISection, path))
+	}
+	args = append(args, "--output", file, "build")
+	out, err := r.runner.Run("/usr/lib/systemd/ukify", args...)
+	if err != nil {
+		return fmt.Errorf("running ukify for %s: %w\n%s", file, err, string(out))
+	}
+	if r.keysDirectory == "" {
+		return nil
+	}
+	return r.resigner().resignEfi(file)
+}
+
+// resigner returns the action signing the EFI binaries with the keys
+func (r *RepackAction) resigner() *ResignAction {
+	return &ResignAction{logger: logging.Module(r.logger, logging.Sign), runner: r.runner, keysDirectory: r.keysDirectory}
+}
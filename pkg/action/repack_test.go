@@ -0,0 +1,41 @@
+package action
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RepackAction", Label("repack"), func() {
+	var dir string
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("doesn't overwrite artifacts", func() {
+		artifact := filepath.Join(dir, "kairos.iso")
+		Expect(os.WriteFile(artifact, []byte("iso"), 0644)).To(Succeed())
+		err := NewRepackAction(config.NewBuildConfig(), "", "").Run(dir, artifact)
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(os.ReadFile(artifact)).To(BeEquivalentTo("iso"))
+	})
+
+	It("refuses artifacts of unknown kinds", func() {
+		err := NewRepackAction(config.NewBuildConfig(), "", "").Run(dir, filepath.Join(dir, "disk.raw"))
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+
+	It("labels the ISOs like the grub config looks for them", func() {
+		Expect(os.MkdirAll(filepath.Join(dir, constants.GrubPrefixDir), 0755)).To(Succeed())
+		r := NewRepackAction(config.NewBuildConfig(), "", "")
+		Expect(r.isoLabel(dir)).To(Equal(constants.UkiIsoLabel))
+		Expect(os.WriteFile(filepath.Join(dir, constants.GrubPrefixDir, constants.GrubCfg), []byte("linux /boot/kernel root=live:CDLABEL=KAIROS rd.live.dir=/\n"), 0644)).To(Succeed())
+		Expect(r.isoLabel(dir)).To(Equal("KAIROS"))
+		Expect(NewRepackAction(config.NewBuildConfig(), "", "PATCHED").isoLabel(dir)).To(Equal("PATCHED"))
+	})
+})
@@ -0,0 +1,184 @@
+package action
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+)
+
+// ExpectedChecksum is the checksum an artifact of a build is expected to have
+type ExpectedChecksum struct {
+	// Name is the name of the artifact, relative to the outputs of the build
+	Name      string
+	Algorithm string
+	Sum       string
+}
+
+// ReadChecksums reads the expected checksums of the files at paths, in the format of sha256sum
+// and of the checksum files enki writes next to the artifacts: a checksum and a file name per
+// line. The algorithm is the extension of the file, like .sha512, or sha256 if it's not one.
+func ReadChecksums(paths ...string) ([]ExpectedChecksum, error) {
+	var checksums []ExpectedChecksum
+	for _, path := range paths {
+		algorithm := strings.TrimPrefix(filepath.Ext(path), ".")
+		if !slices.Contains(utils.ChecksumAlgorithms(), algorithm) {
+			algorithm = utils.ChecksumSHA256
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			sum, name, found := strings.Cut(text, " ")
+			// sha256sum marks the files read in binary mode with a *
+			name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+			if !found || name == "" {
+				f.Close()
+				return nil, fmt.Errorf("invalid checksum at %s:%d, expected a checksum and a file name", path, line)
+			}
+			checksums = append(checksums, ExpectedChecksum{Name: filepath.FromSlash(name), Algorithm: algorithm, Sum: strings.ToLower(sum)})
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	if len(checksums) == 0 {
+		return nil, fmt.Errorf("no checksums in %s", strings.Join(paths, ", "))
+	}
+	return checksums, nil
+}
+
+// Divergence is the first artifact of a rebuild differing from the expected one
+type Divergence struct {
+	Artifact string
+	Expected string
+	// Actual is the checksum of the rebuilt artifact, empty if the rebuild lacks it
+	Actual string
+	// File is the first file of the artifact differing from the original one, like
+	// rootfs:/etc/os-release, when the original is known and enki diff can read it
+	File string
+}
+
+func (d *Divergence) String() string {
+	switch {
+	case d.Actual == "":
+		return fmt.Sprintf("the rebuild has no %s", d.Artifact)
+	case d.File != "":
+		return fmt.Sprintf("%s differs from the expected one, first at %s", d.Artifact, d.File)
+	}
+	return fmt.Sprintf("%s differs from the expected one, its checksum is %s rather than %s", d.Artifact, d.Actual, d.Expected)
+}
+
+// ReproduceAction checks that a rebuild matches the expected artifacts bit for bit
+type ReproduceAction struct {
+	logger v1.Logger
+	diff   *DiffAction
+}
+
+func NewReproduceAction(cfg *types.BuildConfig) *ReproduceAction {
+	return &ReproduceAction{logger: cfg.Logger, diff: NewDiffAction(cfg)}
+}
+
+// Compare returns the first artifact rebuilt in dir not matching its expected checksum, in the
+// order of the checksums, or nil if all match. The artifacts missing at their name in dir are
+// looked up by their base name, checksum files only list those. With the original artifacts in
+// originalDir, the divergence reports the first file of the artifact differing from the original.
+func (r *ReproduceAction) Compare(dir, originalDir string, expected []ExpectedChecksum) (*Divergence, error) {
+	for _, e := range expected {
+		path, err := findArtifact(dir, e.Name)
+		if err != nil {
+			return nil, err
+		}
+		if path == "" {
+			return &Divergence{Artifact: e.Name, Expected: e.Sum}, nil
+		}
+		c, err := utils.CalcFileChecksums(vfs.OSFS, path, e.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		// Checksums are either plain digests or multihashes, see --checksum-format
+		sum, err := c.Sum(e.Algorithm, utils.ChecksumFormatHex)
+		if err != nil {
+			return nil, err
+		}
+		multihash, err := c.Sum(e.Algorithm, utils.ChecksumFormatMultihash)
+		if err != nil {
+			return nil, err
+		}
+		if e.Sum == sum || e.Sum == multihash {
+			r.logger.Infof("%s matches its %s checksum", e.Name, e.Algorithm)
+			continue
+		}
+		divergence := &Divergence{Artifact: e.Name, Expected: e.Sum, Actual: sum}
+		if originalDir != "" {
+			divergence.File = r.firstChange(filepath.Join(originalDir, e.Name), path)
+		}
+		return divergence, nil
+	}
+	return nil, nil
+}
+
+// firstChange returns the first file differing between the original artifact and the rebuilt
+// one, or nothing if it can't tell. Failing to read the artifacts is only logged, not all of
+// them are understood by enki diff.
+func (r *ReproduceAction) firstChange(original, rebuilt string) string {
+	if _, err := os.Stat(original); err != nil {
+		r.logger.Warnf("Could not find the original %s to compare with: %v", filepath.Base(original), err)
+		return ""
+	}
+	diff, err := r.diff.Run(original, rebuilt)
+	if err != nil {
+		r.logger.Warnf("Could not compare %s with the original one: %v", filepath.Base(rebuilt), err)
+		return ""
+	}
+	switch {
+	case len(diff.Files) > 0:
+		return diff.Files[0].Path
+	case len(diff.Cmdline) > 0:
+		return diff.Cmdline[0].Path
+	case len(diff.Signatures) > 0:
+		return diff.Signatures[0].Path
+	}
+	return ""
+}
+
+// findArtifact returns the path of the artifact named name in dir, or its first file with the
+// same base name, or nothing if there is none
+func findArtifact(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		return path, nil
+	}
+	found := ""
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && d.Name() == filepath.Base(name) {
+			found = p
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	return found, nil
+}
@@ -0,0 +1,77 @@
+package action
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReproduceAction", Label("reproduce"), func() {
+	var dir string
+	sections := []string{".osrel", ".cmdline", ".linux"}
+	sum := func(path string) string {
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		s := sha256.Sum256(data)
+		return hex.EncodeToString(s[:])
+	}
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		for _, d := range []string{"original", "rebuild/amd64"} {
+			Expect(os.MkdirAll(filepath.Join(dir, d), 0755)).To(Succeed())
+		}
+	})
+
+	It("reads the checksum files written next to the artifacts and by sha256sum", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "kairos.iso.sha512"), []byte("ABCD kairos.iso\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte("# release\n0123  kairos.efi\n4567 *amd64/kairos.iso\n\n"), 0644)).To(Succeed())
+		checksums, err := ReadChecksums(filepath.Join(dir, "kairos.iso.sha512"), filepath.Join(dir, "SHA256SUMS"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(checksums).To(Equal([]ExpectedChecksum{
+			{Name: "kairos.iso", Algorithm: "sha512", Sum: "abcd"},
+			{Name: "kairos.efi", Algorithm: "sha256", Sum: "0123"},
+			{Name: filepath.Join("amd64", "kairos.iso"), Algorithm: "sha256", Sum: "4567"},
+		}))
+
+		Expect(os.WriteFile(filepath.Join(dir, "empty.sha256"), []byte("\n"), 0644)).To(Succeed())
+		_, err = ReadChecksums(filepath.Join(dir, "empty.sha256"))
+		Expect(err).To(MatchError(ContainSubstring("no checksums")))
+		Expect(os.WriteFile(filepath.Join(dir, "invalid.sha256"), []byte("0123\n"), 0644)).To(Succeed())
+		_, err = ReadChecksums(filepath.Join(dir, "invalid.sha256"))
+		Expect(err).To(MatchError(ContainSubstring("invalid.sha256:1")))
+	})
+
+	It("matches the rebuilt artifacts, looking them up by their base name", func() {
+		artifact := filepath.Join(dir, "rebuild", "amd64", "kairos.efi")
+		Expect(os.WriteFile(artifact, fakePE(sections, map[string]string{".osrel": "ID=kairos", ".cmdline": "console=tty1", ".linux": "kernel"}), 0644)).To(Succeed())
+
+		divergence, err := NewReproduceAction(config.NewBuildConfig()).Compare(filepath.Join(dir, "rebuild"), "", []ExpectedChecksum{{Name: "kairos.efi", Algorithm: "sha256", Sum: sum(artifact)}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(divergence).To(BeNil())
+	})
+
+	It("reports the missing artifacts", func() {
+		divergence, err := NewReproduceAction(config.NewBuildConfig()).Compare(filepath.Join(dir, "rebuild"), "", []ExpectedChecksum{{Name: "kairos.iso", Algorithm: "sha256", Sum: "0123"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(divergence.String()).To(Equal("the rebuild has no kairos.iso"))
+	})
+
+	It("reports the first file differing from the original artifact", func() {
+		original := filepath.Join(dir, "original", "kairos.efi")
+		Expect(os.WriteFile(original, fakePE(sections, map[string]string{".osrel": "ID=kairos", ".cmdline": "console=tty1", ".linux": "kernel"}), 0644)).To(Succeed())
+		rebuilt := filepath.Join(dir, "rebuild", "kairos.efi")
+		Expect(os.WriteFile(rebuilt, fakePE(sections, map[string]string{".osrel": "ID=kairos", ".cmdline": "console=tty1", ".linux": "kernel2"}), 0644)).To(Succeed())
+
+		expected := []ExpectedChecksum{{Name: "kairos.efi", Algorithm: "sha256", Sum: sum(original)}}
+		divergence, err := NewReproduceAction(config.NewBuildConfig()).Compare(filepath.Join(dir, "rebuild"), filepath.Join(dir, "original"), expected)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(divergence.Actual).To(Equal(sum(rebuilt)))
+		Expect(divergence.File).To(Equal("uki:.linux"))
+		Expect(divergence.String()).To(Equal("kairos.efi differs from the expected one, first at uki:.linux"))
+	})
+})
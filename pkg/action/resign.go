@@ -0,0 +1,523 @@
+package action
+
+import (
+	"debug/pe"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/buildinfo"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+)
+
+// ukiSections are the sections ukify adds to the stub, with the ukify build option setting each.
+// The .pcrsig and .pcrpkey ones are left out, they are computed again from the new keys.
+var ukiSections = []struct {
+	name, option string
+	// file is set for the options taking a file, the other ones take the contents, or a file
+	// prefixed with @
+	file bool
+	// value is set for the options only taking the contents, like --uname
+	value bool
+}{
+	{".linux", "--linux", true, false},
+	{".initrd", "--initrd", true, false},
+	{".cmdline", "--cmdline", false, false},
+	{".osrel", "--os-release", false, false},
+	{".uname", "--uname", false, true},
+	{".splash", "--splash", true, false},
+	{".dtb", "--devicetree", true, false},
+}
+
+// pcrSections are the sections holding the PCR policy of the UKI, signed with the old keys
+var pcrSections = []string{".pcrsig", ".pcrpkey"}
+
+// dbAppendFile is where the db update for the machines enrolled with the previous keys is
+// written, in the output dir
+const dbAppendFile = "db-append.auth"
+
+// ResignAction signs the EFI binaries and PCR policies of an already built artifact again with
+// other keys, keeping the kernel, initrd and everything else they boot byte for byte
+type ResignAction struct {
+	logger        v1.Logger
+	runner        v1.Runner
+	keysDirectory string
+	// previousKeys is the keys dir being rotated from, if set the artifact is signed with
+	// both keys and enrolls a db trusting both
+	previousKeys string
+	// sbat is a file with SBAT entries patched into the .sbat section of the UKIs, replacing
+	// the entries of the same components
+	sbat string
+	// tsa is the URL of the time-stamping authority timestamping the new signatures, if set
+	tsa       string
+	outputDir string
+}
+
+func NewResignAction(cfg *types.BuildConfig, keysDirectory, previousKeys, sbat, tsa, outputDir string) *ResignAction {
+	return &ResignAction{
+		logger:        logging.Module(cfg.Logger, logging.Sign),
+		runner:        cfg.Runner,
+		keysDirectory: keysDirectory,
+		previousKeys:  previousKeys,
+		sbat:          sbat,
+		tsa:           tsa,
+		outputDir:     outputDir,
+	}
+}
+
+// Run writes the artifact signed with the new keys to the output dir, under the same name.
+// Artifacts are the UKI ISOs, ESP dirs like the uki and esp-dir outputs, or single EFI binaries.
+func (r *ResignAction) Run(artifact string) error {
+	info, err := os.Stat(artifact)
+	if err != nil {
+		return failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	output := filepath.Join(r.outputDir, filepath.Base(filepath.Clean(artifact)))
+	if same, _ := sameFile(artifact, output); same {
+		return failure.Errorf(failure.ErrInvalidConfig, "pass another --output-dir", "resigning %s would overwrite it", artifact)
+	}
+	if err = r.checkDeps(artifact, info.IsDir()); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(r.outputDir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if err = utils.CopyTree(vfs.OSFS, artifact, output, utils.CopyOptions{}); err != nil {
+			return err
+		}
+		err = r.resignTree(output)
+	case strings.EqualFold(filepath.Ext(artifact), ".iso"):
+		err = r.resignISO(artifact, output)
+	case strings.EqualFold(filepath.Ext(artifact), ".efi"):
+		if err = utils.CopyFile(vfs.OSFS, artifact, output); err != nil {
+			return err
+		}
+		err = r.resignEfi(output)
+	default:
+		return failure.Errorf(failure.ErrInvalidConfig, "", "don't know how to resign %s, it is neither an ISO, an EFI binary nor an ESP dir", artifact)
+	}
+	if err != nil {
+		return err
+	}
+	r.logger.Infof("Resigned %s to %s", artifact, output)
+	if r.previousKeys != "" {
+		return r.writeDBAppend()
+	}
+	return nil
+}
+
+// writeDBAppend writes the update adding the new db certificates to the db of the machines
+// enrolled with the previous keys, so they keep booting the artifacts signed only with the
+// new keys once the rotation is over
+func (r *ResignAction) writeDBAppend() error {
+	update, err := secureboot.DBAppend(r.previousKeys, r.keysDirectory)
+	if err != nil {
+		return failure.New(failure.ErrMissingKeys, err, "")
+	}
+	if update == nil {
+		r.logger.Infof("The db of %s already trusts the new keys", r.previousKeys)
+		return nil
+	}
+	path := filepath.Join(r.outputDir, dbAppendFile)
+	if err = os.WriteFile(path, update, 0644); err != nil {
+		return err
+	}
+	r.logger.Infof("Wrote %s, append it to the db of the machines enrolled with the previous keys, e.g. with efi-updatevar -a -f %s db", path, dbAppendFile)
+	return nil
+}
+
+// checkDeps fails if any of the tools to resign the artifact is missing
+func (r *ResignAction) checkDeps(artifact string, dir bool) error {
+	neededBinaries := []string{"/usr/lib/systemd/ukify", "sbsign", "sbattach", "objcopy"}
+	if !dir && strings.EqualFold(filepath.Ext(artifact), ".iso") {
+		neededBinaries = append(neededBinaries, "xorriso", "mcopy")
+	}
+	if r.tsa != "" {
+		neededBinaries = append(neededBinaries, secureboot.TimestampTool)
+	}
+	for _, b := range neededBinaries {
+		if _, err := exec.LookPath(b); err != nil {
+			return failure.New(failure.ErrMissingDependency, err, deps.Hint(b))
+		}
+	}
+	return nil
+}
+
+// resignISO resigns the ESP image of a UKI ISO and writes the ISO to output with the new image
+// in place of the old one, keeping its boot setup, label and other files
+func (r *ResignAction) resignISO(artifact, output string) error {
+	tmpDir, err := os.MkdirTemp("", "enki-resign-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	img, espDir, err := extractESP(r.runner, artifact, tmpDir)
+	if err != nil {
+		return err
+	}
+	if err = r.resignTree(espDir); err != nil {
+		return err
+	}
+	// Write back every file, the signed binaries keep their names and the image keeps its
+	// headroom, so they fit where the old ones were
+	err = filepath.Walk(espDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(espDir, path)
+		if out, err := r.runner.Run("mcopy", "-o", "-i", img, path, "::/"+filepath.ToSlash(rel)); err != nil {
+			return failure.Errorf(failure.ErrSizeBudget, "rebuild the ISO with enki build-uki and a bigger --esp-headroom",
+				"writing %s back to %s: %w\n%s", rel, constants.UkiIsoEfiImage, err, string(out))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out, err := r.runner.Run("xorriso", "-indev", artifact, "-outdev", output, "-boot_image", "any", "replay",
+		"-update", img, "/"+constants.UkiIsoEfiImage)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w\n%s", output, err, string(out))
+	}
+	return nil
+}
+
+// extractESP extracts the ESP image of a UKI ISO into tmpDir, and the files of the image
+// into a dir of tmpDir. It returns the paths of both.
+func extractESP(runner v1.Runner, artifact, tmpDir string) (img, espDir string, err error) {
+	img = filepath.Join(tmpDir, constants.UkiIsoEfiImage)
+	out, err := runner.Run("xorriso", "-osirrox", "on", "-indev", artifact, "-extract", "/"+constants.UkiIsoEfiImage, img)
+	if err != nil {
+		return "", "", fmt.Errorf("extracting %s from %s: %w\n%s", constants.UkiIsoEfiImage, artifact, err, string(out))
+	}
+	// xorriso extracts the files read-only, like they are in the ISO
+	if err = os.Chmod(img, 0644); err != nil {
+		return "", "", err
+	}
+	espDir = filepath.Join(tmpDir, "esp")
+	if err = extractFAT(runner, img, espDir); err != nil {
+		return "", "", err
+	}
+	return img, espDir, nil
+}
+
+// extractFAT extracts the files of the FAT image img into dir
+func extractFAT(runner v1.Runner, img, dir string) error {
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	if out, err := runner.Run("mcopy", "-s", "-n", "-i", img, "::*", dir); err != nil {
+		return fmt.Errorf("extracting the files of %s: %w\n%s", filepath.Base(img), err, string(out))
+	}
+	return nil
+}
+
+// resignTree resigns all the EFI binaries in dir and replaces the Secure Boot keys enrolled
+// by systemd-boot with the new ones. When rotating keys the db enrolled trusts the previous
+// keys too.
+func (r *ResignAction) resignTree(dir string) error {
+	var binaries []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".efi") {
+			binaries = append(binaries, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(binaries) == 0 {
+		return failure.Errorf(failure.ErrInvalidConfig, "", "no EFI binaries found in %s", dir)
+	}
+	// Trees of the shim-mok secureboot-mode boot through shim, which along with MokManager
+	// keeps its Microsoft signature. The MOK to enroll becomes the new db certificate.
+	mokCert := filepath.Join(dir, "EFI", "BOOT", constants.MokCertFile)
+	_, err = os.Stat(mokCert)
+	shimLayout := err == nil
+	for _, binary := range binaries {
+		if shimLayout && isShimBinary(dir, binary) {
+			r.logger.Infof("Keeping the signature of %s", binary)
+			continue
+		}
+		if err = r.resignEfi(binary); err != nil {
+			return err
+		}
+	}
+	if shimLayout {
+		r.logger.Debugf("Replacing the MOK to enroll %s", constants.MokCertFile)
+		if err = utils.CopyFile(vfs.OSFS, filepath.Join(r.keysDirectory, "db.der"), mokCert); err != nil {
+			return failure.New(failure.ErrMissingKeys, err, "generate the keys with enki genkey")
+		}
+	}
+
+	autoKeys := filepath.Join(dir, "loader", "keys", "auto")
+	entries, err := os.ReadDir(autoKeys)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var transitionAuth, transitionESL []byte
+	if r.previousKeys != "" {
+		if transitionAuth, transitionESL, err = secureboot.TransitionDB(r.previousKeys, r.keysDirectory); err != nil {
+			return failure.New(failure.ErrMissingKeys, err, "")
+		}
+	}
+	for _, entry := range entries {
+		target := filepath.Join(autoKeys, entry.Name())
+		switch {
+		case transitionAuth != nil && entry.Name() == "db.auth":
+			r.logger.Debugf("Replacing the enrolled key db.auth with the one trusting the previous keys too")
+			if err = os.WriteFile(target, transitionAuth, 0644); err != nil {
+				return err
+			}
+			continue
+		case transitionESL != nil && entry.Name() == "db.esl":
+			if err = os.WriteFile(target, transitionESL, 0644); err != nil {
+				return err
+			}
+			continue
+		}
+		newKey := filepath.Join(r.keysDirectory, entry.Name())
+		_, err := os.Stat(newKey)
+		if err != nil && entry.Name() == constants.DbxFile {
+			// Revocations like the UEFI forum ones are not tied to the keys
+			r.logger.Debugf("Keeping the enrolled %s", entry.Name())
+			continue
+		}
+		if err != nil {
+			return failure.Errorf(failure.ErrMissingKeys, "generate the keys with enki genkey",
+				"the keys directory lacks %s, which replaces the enrolled %s", entry.Name(), filepath.Join("loader", "keys", "auto", entry.Name()))
+		}
+		r.logger.Debugf("Replacing the enrolled key %s", entry.Name())
+		if err = utils.CopyFile(vfs.OSFS, newKey, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isShimBinary tells if the binary in the tree at dir is shim or MokManager, next to the MOK
+// certificate in the fallback path
+func isShimBinary(dir, binary string) bool {
+	if filepath.Dir(binary) != filepath.Join(dir, "EFI", "BOOT") {
+		return false
+	}
+	name := strings.ToLower(filepath.Base(binary))
+	return strings.HasPrefix(name, "boot") || strings.HasPrefix(name, "mm") || name == "mokmanager.efi"
+}
+
+// resignEfi signs the EFI binary at path in place. UKIs are built again by ukify out of their
+// own sections, so the PCR policy is signed with the new key too. When rotating keys the
+// binary and the PCR policy are signed with the previous keys as well.
+func (r *ResignAction) resignEfi(path string) error {
+	if err := r.signEfi(path); err != nil {
+		return err
+	}
+	if r.previousKeys == "" {
+		return nil
+	}
+	previous, err := secureboot.LoadKeyPair(r.previousKeys, "db")
+	if err != nil {
+		return failure.New(failure.ErrMissingKeys, err, "")
+	}
+	if err = secureboot.AppendSignature(path, previous); err != nil {
+		return failure.New(failure.ErrUnsignedStub, err, "")
+	}
+	return nil
+}
+
+// signEfi signs the EFI binary at path in place with the new keys
+func (r *ResignAction) signEfi(path string) error {
+	tmpDir, err := os.MkdirTemp("", "enki-resign-efi-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	unsigned := filepath.Join(tmpDir, filepath.Base(path))
+	if err = utils.CopyFile(vfs.OSFS, path, unsigned); err != nil {
+		return err
+	}
+	// Binaries which are not signed make sbattach fail, they are fine as they are
+	if out, err := r.runner.Run("sbattach", "--remove", unsigned); err != nil {
+		r.logger.Debugf("Not removing the signature of %s: %s", path, string(out))
+	}
+
+	sections, err := peSections(unsigned)
+	if err != nil {
+		return failure.Errorf(failure.ErrInvalidConfig, "", "%s is not an EFI binary: %w", path, err)
+	}
+	if _, ok := sections[".linux"]; !ok {
+		r.logger.Infof("Signing %s", path)
+		out, err := r.runner.Run("sbsign",
+			"--key", filepath.Join(r.keysDirectory, "db.key"),
+			"--cert", filepath.Join(r.keysDirectory, "db.pem"),
+			"--output", path,
+			unsigned,
+		)
+		if err != nil {
+			return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running sbsign for %s: %w\n%s", path, err, string(out))
+		}
+		return r.timestamp(path)
+	}
+
+	r.logger.Infof("Signing %s and its PCR policy", path)
+	args := []string{}
+	remove := []string{}
+	for _, section := range ukiSections {
+		data, ok := sections[section.name]
+		if !ok {
+			continue
+		}
+		remove = append(remove, "--remove-section", section.name)
+		if section.value {
+			// ukify writes the value as it is, without the padding of the section
+			args = append(args, section.option, strings.TrimRight(string(data), "\x00\n"))
+			continue
+		}
+		file := filepath.Join(tmpDir, strings.TrimPrefix(section.name, "."))
+		if err = os.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+		if section.file {
+			args = append(args, section.option, file)
+		} else {
+			args = append(args, section.option, "@"+file)
+		}
+	}
+	if data, ok := sections[buildinfo.UKISection]; ok {
+		file := filepath.Join(tmpDir, buildinfo.FileName)
+		if err = os.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+		remove = append(remove, "--remove-section", buildinfo.UKISection)
+		args = append(args, "--section", fmt.Sprintf("%s:@%s", buildinfo.UKISection, file))
+	}
+	for _, section := range pcrSections {
+		if _, ok := sections[section]; ok {
+			remove = append(remove, "--remove-section", section)
+		}
+	}
+	if r.sbat != "" {
+		entries, err := os.ReadFile(r.sbat)
+		if err != nil {
+			return err
+		}
+		// ukify merges the .sbat section of the stub with the given one, so the stub goes
+		// without it to replace its entries
+		file := filepath.Join(tmpDir, "sbat.csv")
+		if err = os.WriteFile(file, secureboot.PatchSbat(sections[".sbat"], entries), 0644); err != nil {
+			return err
+		}
+		if _, ok := sections[".sbat"]; ok {
+			remove = append(remove, "--remove-section", ".sbat")
+		}
+		args = append(args, "--sbat", "@"+file)
+	}
+
+	// The stub is what is left of the UKI without the sections ukify adds
+	stub := filepath.Join(tmpDir, "stub.efi")
+	out, err := r.runner.Run("objcopy", append(remove, unsigned, stub)...)
+	if err != nil {
+		return fmt.Errorf("extracting the stub of %s: %w\n%s", path, err, string(out))
+	}
+	args = append(args,
+		"--stub", stub,
+		"--secureboot-private-key", filepath.Join(r.keysDirectory, "db.key"),
+		"--secureboot-certificate", filepath.Join(r.keysDirectory, "db.pem"),
+		"--pcr-private-key", filepath.Join(r.keysDirectory, "tpm2-pcr-private.pem"),
+	)
+	if r.previousKeys != "" {
+		// The policy is signed with both keys, so disks enrolled with either one unlock. ukify
+		// only embeds the public key of a single private key, the new one is embedded so disks
+		// enrolled from now on use it.
+		public, err := secureboot.PublicKeyPEM(filepath.Join(r.keysDirectory, "tpm2-pcr-private.pem"))
+		if err != nil {
+			return failure.New(failure.ErrMissingKeys, err, "")
+		}
+		pcrpkey := filepath.Join(tmpDir, "tpm2-pcr-public.pem")
+		if err = os.WriteFile(pcrpkey, public, 0644); err != nil {
+			return err
+		}
+		args = append(args,
+			"--pcr-private-key", filepath.Join(r.previousKeys, "tpm2-pcr-private.pem"),
+			"--pcrpkey", pcrpkey,
+		)
+	}
+	args = append(args,
+		"--measure",
+		"--output", path,
+		"build",
+	)
+	out, err = r.runner.Run("/usr/lib/systemd/ukify", args...)
+	if err != nil {
+		return failure.Errorf(failure.ErrUnsignedStub, signingHint, "running ukify for %s: %w\n%s", path, err, string(out))
+	}
+	r.logger.Debugf("ukify output: %s", string(out))
+	return r.timestamp(path)
+}
+
+// timestamp adds an RFC 3161 timestamp from the time-stamping authority to the new signature of
+// the EFI binary at path, if set. It runs before the previous keys sign it, so the signature
+// made with the new keys, the one that outlives the rotation, is the timestamped one.
+func (r *ResignAction) timestamp(path string) error {
+	if r.tsa == "" {
+		return nil
+	}
+	if err := secureboot.Timestamp(r.runner, r.tsa, path); err != nil {
+		return failure.New(failure.ErrUnsignedStub, err, timestampHint)
+	}
+	return nil
+}
+
+// peSections returns the contents of the sections of the PE binary at path, without the
+// padding to the file alignment
+func peSections(path string) (map[string][]byte, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sections := map[string][]byte{}
+	for _, section := range f.Sections {
+		data, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("reading section %s: %w", section.Name, err)
+		}
+		if section.VirtualSize > 0 && int(section.VirtualSize) < len(data) {
+			data = data[:section.VirtualSize]
+		}
+		sections[section.Name] = data
+	}
+	return sections, nil
+}
+
+// sameFile tells if a and b are the same file, following symlinks
+func sameFile(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(infoA, infoB), nil
+}
@@ -0,0 +1,234 @@
+package action
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/kairos-io/enki/pkg/buildinfo"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakePE returns a minimal PE binary with the given sections, enough for debug/pe to read them
+// and to sign it
+func fakePE(names []string, contents map[string]string) []byte {
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	opt := pe.OptionalHeader64{Magic: 0x20b, FileAlignment: 0x200, SectionAlignment: 0x1000, NumberOfRvaAndSizes: 16}
+	offset := uint32(buf.Len() + binary.Size(pe.FileHeader{}) + binary.Size(opt) + 40*len(names))
+	opt.SizeOfHeaders = offset
+	_ = binary.Write(&buf, binary.LittleEndian, pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_AMD64, NumberOfSections: uint16(len(names)), SizeOfOptionalHeader: uint16(binary.Size(opt))})
+	_ = binary.Write(&buf, binary.LittleEndian, opt)
+	for _, name := range names {
+		header := pe.SectionHeader32{
+			VirtualSize:      uint32(len(contents[name])),
+			SizeOfRawData:    uint32(len(contents[name])),
+			PointerToRawData: offset,
+		}
+		copy(header.Name[:], name)
+		_ = binary.Write(&buf, binary.LittleEndian, header)
+		offset += header.SizeOfRawData
+	}
+	for _, name := range names {
+		buf.WriteString(contents[name])
+	}
+	return buf.Bytes()
+}
+
+// writeRotationKeys writes the keys rotating keys needs into dir, like enki genkey does
+func writeRotationKeys(dir, name string) {
+	for _, keyType := range []string{"db", "KEK", "tpm2-pcr-private"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		if keyType == "tpm2-pcr-private" {
+			Expect(os.WriteFile(filepath.Join(dir, keyType+".pem"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+			continue
+		}
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name + "-" + keyType}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, keyType+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, keyType+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)).To(Succeed())
+		if keyType == "db" {
+			db := signature.NewSignatureDatabase()
+			Expect(db.Append(signature.CERT_X509_GUID, util.EFIGUID{}, der)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "db.esl"), db.Bytes(), 0644)).To(Succeed())
+		}
+	}
+}
+
+var _ = Describe("ResignAction", Label("resign"), func() {
+	var runner *v1mock.FakeRunner
+	var r *ResignAction
+	var dir, keysDir string
+	var ukifyArgs []string
+	var cmdline string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		keysDir = GinkgoT().TempDir()
+		for _, key := range []string{"db.key", "db.pem", "tpm2-pcr-private.pem", "PK.auth", "db.auth"} {
+			Expect(os.WriteFile(filepath.Join(keysDir, key), []byte("new "+key), 0644)).To(Succeed())
+		}
+		ukifyArgs, cmdline = nil, ""
+		runner = v1mock.NewFakeRunner()
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			if strings.HasSuffix(command, "ukify") {
+				ukifyArgs = args
+				for i, arg := range args {
+					if arg == "--cmdline" {
+						data, err := os.ReadFile(strings.TrimPrefix(args[i+1], "@"))
+						Expect(err).ToNot(HaveOccurred())
+						cmdline = string(data)
+					}
+				}
+			}
+			return nil, nil
+		}
+		r = &ResignAction{logger: v1.NewNullLogger(), runner: runner, keysDirectory: keysDir, outputDir: GinkgoT().TempDir()}
+
+		Expect(os.MkdirAll(filepath.Join(dir, "EFI", "BOOT"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(dir, "EFI", "kairos"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(dir, "loader", "keys", "auto"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "EFI", "BOOT", "BOOTX64.EFI"), fakePE([]string{".text"}, map[string]string{".text": "boot"}), 0644)).To(Succeed())
+		uki := fakePE(
+			[]string{".text", ".osrel", ".cmdline", ".uname", ".linux", ".initrd", ".pcrsig", ".pcrpkey", buildinfo.UKISection},
+			map[string]string{".text": "stub", ".osrel": "ID=kairos", ".cmdline": "console=tty1 rd.immucore.uki", ".uname": "6.5.0-1-generic\x00", ".linux": "kernel", ".initrd": "initrd",
+				".pcrsig": "{}", ".pcrpkey": "old key", buildinfo.UKISection: "{}"},
+		)
+		Expect(os.WriteFile(filepath.Join(dir, "EFI", "kairos", "norole.efi"), uki, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "loader", "keys", "auto", "PK.auth"), []byte("old PK.auth"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "loader", "keys", "auto", "dbx.auth"), []byte("forum dbx.auth"), 0644)).To(Succeed())
+	})
+
+	It("signs systemd-boot and rebuilds the UKIs out of their own sections", func() {
+		Expect(r.resignTree(dir)).To(Succeed())
+		Expect(runner.MatchMilestones([][]string{
+			{"sbattach", "--remove"},
+			{"sbsign", "--key", filepath.Join(keysDir, "db.key"), "--cert", filepath.Join(keysDir, "db.pem"), "--output", filepath.Join(dir, "EFI", "BOOT", "BOOTX64.EFI")},
+			{"sbattach", "--remove"},
+			{"objcopy", "--remove-section", ".linux", "--remove-section", ".initrd", "--remove-section", ".cmdline", "--remove-section", ".osrel",
+				"--remove-section", ".uname", "--remove-section", buildinfo.UKISection, "--remove-section", ".pcrsig", "--remove-section", ".pcrpkey"},
+			{"/usr/lib/systemd/ukify", "--linux"},
+		})).To(Succeed())
+		Expect(cmdline).To(Equal("console=tty1 rd.immucore.uki"))
+		Expect(ukifyArgs).To(ContainElements("--pcr-private-key", filepath.Join(keysDir, "tpm2-pcr-private.pem"), "--measure", "--output", filepath.Join(dir, "EFI", "kairos", "norole.efi"), "build"))
+		Expect(ukifyArgs).To(ContainElement(HavePrefix(buildinfo.UKISection + ":@")))
+		// ukify takes the release of the kernel as it is, not from a file
+		Expect(ukifyArgs).To(ContainElements("--uname", "6.5.0-1-generic"))
+		Expect(os.ReadFile(filepath.Join(dir, "loader", "keys", "auto", "PK.auth"))).To(Equal([]byte("new PK.auth")))
+		Expect(os.ReadFile(filepath.Join(dir, "loader", "keys", "auto", "dbx.auth"))).To(Equal([]byte("forum dbx.auth")))
+	})
+
+	It("needs every enrolled key in the new keys", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "loader", "keys", "auto", "KEK.auth"), []byte("old KEK.auth"), 0644)).To(Succeed())
+		err := r.resignTree(dir)
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+		Expect(err.Error()).To(ContainSubstring("lacks KEK.auth"))
+	})
+
+	It("refuses trees without EFI binaries", func() {
+		Expect(r.resignTree(GinkgoT().TempDir())).To(MatchError(ContainSubstring("no EFI binaries found")))
+	})
+
+	It("signs with the previous keys too when rotating them", func() {
+		previousKeys := GinkgoT().TempDir()
+		writeRotationKeys(previousKeys, "previous")
+		writeRotationKeys(keysDir, "new")
+		r.previousKeys = previousKeys
+		Expect(os.WriteFile(filepath.Join(dir, "loader", "keys", "auto", "db.auth"), []byte("old db.auth"), 0644)).To(Succeed())
+
+		Expect(r.resignTree(dir)).To(Succeed())
+		Expect(ukifyArgs).To(ContainElements(
+			"--pcr-private-key", filepath.Join(keysDir, "tpm2-pcr-private.pem"),
+			"--pcr-private-key", filepath.Join(previousKeys, "tpm2-pcr-private.pem"),
+			"--pcrpkey",
+		))
+		previous, err := secureboot.LoadKeyPair(previousKeys, "db")
+		Expect(err).ToNot(HaveOccurred())
+		known := map[string]*x509.Certificate{previousKeys: previous.Cert}
+		for _, binary := range []string{filepath.Join("EFI", "BOOT", "BOOTX64.EFI"), filepath.Join("EFI", "kairos", "norole.efi")} {
+			Expect(secureboot.Signatures(filepath.Join(dir, binary), known)).To(ContainElement(HaveField("Key", previousKeys)))
+		}
+		_, esl, err := secureboot.TransitionDB(previousKeys, keysDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(filepath.Join(dir, "loader", "keys", "auto", "db.auth"))).To(HaveSuffix(string(esl)))
+
+		Expect(r.writeDBAppend()).To(Succeed())
+		Expect(filepath.Join(r.outputDir, dbAppendFile)).To(BeARegularFile())
+	})
+
+	It("patches the SBAT entries of the UKIs", func() {
+		uki := fakePE(
+			[]string{".text", ".sbat", ".linux"},
+			map[string]string{".text": "stub", ".sbat": "sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\nsystemd-stub,1,The systemd Developers,systemd,255,https://systemd.io/\n", ".linux": "kernel"},
+		)
+		Expect(os.WriteFile(filepath.Join(dir, "EFI", "kairos", "norole.efi"), uki, 0644)).To(Succeed())
+		r.sbat = filepath.Join(GinkgoT().TempDir(), "sbat.csv")
+		Expect(os.WriteFile(r.sbat, []byte("kairos,2,Kairos,kairos,v3.0.0,https://kairos.io\n"), 0644)).To(Succeed())
+		var sbat string
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			for i, arg := range args {
+				if arg == "--sbat" {
+					data, err := os.ReadFile(strings.TrimPrefix(args[i+1], "@"))
+					Expect(err).ToNot(HaveOccurred())
+					sbat = string(data)
+				}
+			}
+			return nil, nil
+		}
+
+		Expect(r.resignTree(dir)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"objcopy", "--remove-section", ".linux", "--remove-section", ".sbat"},
+		})).To(Succeed())
+		Expect(sbat).To(HaveSuffix("systemd-stub,1,The systemd Developers,systemd,255,https://systemd.io/\nkairos,2,Kairos,kairos,v3.0.0,https://kairos.io\n"))
+	})
+
+	It("keeps the signature of shim and replaces the MOK to enroll", func() {
+		for _, file := range []string{"grubx64.efi", "mmx64.efi"} {
+			Expect(os.WriteFile(filepath.Join(dir, "EFI", "BOOT", file), fakePE([]string{".text"}, map[string]string{".text": file}), 0644)).To(Succeed())
+		}
+		Expect(os.WriteFile(filepath.Join(dir, "EFI", "BOOT", constants.MokCertFile), []byte("old db.der"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(keysDir, "db.der"), []byte("new db.der"), 0644)).To(Succeed())
+
+		Expect(r.resignTree(dir)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"sbsign", "--key", filepath.Join(keysDir, "db.key"), "--cert", filepath.Join(keysDir, "db.pem"), "--output", filepath.Join(dir, "EFI", "BOOT", "grubx64.efi")},
+		})).To(Succeed())
+		for _, file := range []string{"BOOTX64.EFI", "mmx64.efi"} {
+			Expect(runner.IncludesCmds([][]string{{"sbsign", "--key", filepath.Join(keysDir, "db.key"), "--cert", filepath.Join(keysDir, "db.pem"), "--output", filepath.Join(dir, "EFI", "BOOT", file)}})).ToNot(Succeed())
+		}
+		Expect(os.ReadFile(filepath.Join(dir, "EFI", "BOOT", constants.MokCertFile))).To(Equal([]byte("new db.der")))
+	})
+
+	It("refuses to overwrite the artifact", func() {
+		r.outputDir = filepath.Join(dir, "EFI", "kairos")
+		err := r.Run(filepath.Join(dir, "EFI", "kairos", "norole.efi"))
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
@@ -0,0 +1,114 @@
+package action
+
+import (
+	"crypto/x509"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/kairos-io/enki/pkg/deps"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	"github.com/kairos-io/enki/pkg/types"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// SignedBinary is an EFI binary of an artifact along with its signatures
+type SignedBinary struct {
+	// Artifact is the ISO holding the binary, or the binary itself
+	Artifact string `json:"artifact"`
+	// Path is where the binary is in the ESP of the ISO, empty for binaries on their own
+	Path       string                 `json:"path,omitempty"`
+	Signatures []secureboot.Signature `json:"signatures"`
+}
+
+// SignaturesAction tells which keys signed the EFI binaries of the artifacts in a dir, to
+// follow which ones are still to resign when rotating keys
+type SignaturesAction struct {
+	logger v1.Logger
+	runner v1.Runner
+	// keys are the db certificates of the keys dirs, by the dir they were read from
+	keys map[string]*x509.Certificate
+}
+
+func NewSignaturesAction(cfg *types.BuildConfig, keysDirectories []string) (*SignaturesAction, error) {
+	keys := map[string]*x509.Certificate{}
+	for _, dir := range keysDirectories {
+		cert, err := util.ReadCertFromFile(filepath.Join(dir, "db.pem"))
+		if err != nil {
+			return nil, failure.Errorf(failure.ErrMissingKeys, "", "reading the db certificate of %s: %w", dir, err)
+		}
+		keys[dir] = cert
+	}
+	return &SignaturesAction{logger: logging.Module(cfg.Logger, logging.Sign), runner: cfg.Runner, keys: keys}, nil
+}
+
+// Run returns the signatures of the EFI binaries on their own and in the ISOs found in dir
+func (s *SignaturesAction) Run(dir string) ([]SignedBinary, error) {
+	var binaries []SignedBinary
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		switch {
+		case strings.EqualFold(filepath.Ext(path), ".efi"):
+			signatures, err := secureboot.Signatures(path, s.keys)
+			if err != nil {
+				return err
+			}
+			binaries = append(binaries, SignedBinary{Artifact: path, Signatures: signatures})
+		case strings.EqualFold(filepath.Ext(path), ".iso"):
+			inISO, err := s.isoSignatures(path)
+			if err != nil {
+				return err
+			}
+			binaries = append(binaries, inISO...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(binaries) == 0 {
+		return nil, failure.Errorf(failure.ErrInvalidConfig, "", "no EFI binaries nor ISOs found in %s", dir)
+	}
+	return binaries, nil
+}
+
+// isoSignatures returns the signatures of the EFI binaries in the ESP image of the ISO. ISOs
+// without one, like the ones of build-iso, have no binaries for the firmware to check.
+func (s *SignaturesAction) isoSignatures(artifact string) ([]SignedBinary, error) {
+	for _, b := range []string{"xorriso", "mcopy"} {
+		if _, err := exec.LookPath(b); err != nil {
+			return nil, failure.New(failure.ErrMissingDependency, err, deps.Hint(b))
+		}
+	}
+	tmpDir, err := os.MkdirTemp("", "enki-signatures-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, espDir, err := extractESP(s.runner, artifact, tmpDir)
+	if err != nil {
+		s.logger.Debugf("Skipping %s: %v", artifact, err)
+		return nil, nil
+	}
+	var binaries []SignedBinary
+	err = filepath.Walk(espDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".efi") {
+			return err
+		}
+		signatures, err := secureboot.Signatures(path, s.keys)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(espDir, path)
+		binaries = append(binaries, SignedBinary{Artifact: artifact, Path: "/" + filepath.ToSlash(rel), Signatures: signatures})
+		return nil
+	})
+	return binaries, err
+}
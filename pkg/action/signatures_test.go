@@ -0,0 +1,49 @@
+package action
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SignaturesAction", Label("signatures"), func() {
+	var dir, keysDir string
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		keysDir = GinkgoT().TempDir()
+		writeRotationKeys(keysDir, "new")
+		Expect(os.MkdirAll(filepath.Join(dir, "esp", "EFI", "BOOT"), 0755)).To(Succeed())
+		for _, binary := range []string{"unsigned.efi", filepath.Join("esp", "EFI", "BOOT", "BOOTX64.EFI")} {
+			Expect(os.WriteFile(filepath.Join(dir, binary), fakePE([]string{".text"}, map[string]string{".text": "boot"}), 0644)).To(Succeed())
+		}
+		kp, err := secureboot.LoadKeyPair(keysDir, "db")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(secureboot.AppendSignature(filepath.Join(dir, "esp", "EFI", "BOOT", "BOOTX64.EFI"), kp)).To(Succeed())
+	})
+
+	It("tells which keys signed the binaries", func() {
+		a, err := NewSignaturesAction(config.NewBuildConfig(), []string{keysDir})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a.Run(dir)).To(Equal([]SignedBinary{
+			{Artifact: filepath.Join(dir, "esp", "EFI", "BOOT", "BOOTX64.EFI"), Signatures: []secureboot.Signature{{Subject: "CN=new-db", Key: keysDir}}},
+			{Artifact: filepath.Join(dir, "unsigned.efi")},
+		}))
+	})
+
+	It("needs the db certificate of the keys", func() {
+		_, err := NewSignaturesAction(config.NewBuildConfig(), []string{GinkgoT().TempDir()})
+		Expect(err).To(MatchError(failure.ErrMissingKeys))
+	})
+
+	It("refuses dirs without artifacts", func() {
+		a, err := NewSignaturesAction(config.NewBuildConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = a.Run(GinkgoT().TempDir())
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
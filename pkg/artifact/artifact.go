@@ -0,0 +1,142 @@
+// Package artifact reads the artifacts built by enki from Go programs, without extracting them
+// nor running any tool: the files of the ISOs, of their rootfs squashfs and of the ESP image of
+// the UKI ISOs, and the sections and Secure Boot signatures of the UKIs.
+//
+// The squashfs images compressed with zstd can't be read yet, build them with another
+// compression to introspect them.
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// File is a file or dir of an artifact
+type File struct {
+	// Path is the absolute path of the file in the artifact
+	Path string `json:"path"`
+	// Size is the size of the file, 0 for dirs
+	Size int64 `json:"size"`
+	Dir  bool  `json:"dir,omitempty"`
+}
+
+// tree is a filesystem listing its dirs
+type tree interface {
+	// readDir returns the entries of the dir at the clean absolute path p
+	readDir(p string) ([]File, error)
+}
+
+// walk returns the files under the dir at p, sorted by path, dirs included
+func walk(t tree, p string) ([]File, error) {
+	entries, err := t.readDir(p)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, entry := range entries {
+		files = append(files, entry)
+		if entry.Dir {
+			sub, err := walk(t, entry.Path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// lookup returns the file at p, wrapping fs.ErrNotExist if there is none
+func lookup(t tree, p string) (File, error) {
+	p = clean(p)
+	if p == "/" {
+		return File{Path: p, Dir: true}, nil
+	}
+	entries, err := t.readDir(path.Dir(p))
+	if err != nil {
+		return File{}, errNotExist(p)
+	}
+	for _, entry := range entries {
+		if entry.Path == p {
+			return entry, nil
+		}
+	}
+	return File{}, errNotExist(p)
+}
+
+// errNotExist tells there is no file at p, wrapping fs.ErrNotExist
+func errNotExist(p string) error {
+	return fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+}
+
+// clean returns p as an absolute slash separated path
+func clean(p string) string {
+	return path.Clean("/" + strings.ReplaceAll(p, `\`, "/"))
+}
+
+// fromInfos returns the entries of the dir at p listed by the go-diskfs filesystems
+func fromInfos(p string, infos []os.FileInfo) []File {
+	files := make([]File, 0, len(infos))
+	for _, info := range infos {
+		if info.Name() == "." || info.Name() == ".." {
+			continue
+		}
+		f := File{Path: path.Join(p, info.Name()), Dir: info.IsDir()}
+		if !f.Dir {
+			f.Size = info.Size()
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// section is the part of r holding a filesystem embedded in another one, read as a file on its
+// own by the go-diskfs readers, which can't write into it
+type section struct {
+	r    io.ReaderAt
+	off  int64
+	size int64
+	pos  int64
+}
+
+func (s *section) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if left := s.size - off; int64(len(p)) > left {
+		n, err := s.r.ReadAt(p[:left], s.off+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return s.r.ReadAt(p, s.off+off)
+}
+
+func (s *section) WriteAt([]byte, int64) (int, error) {
+	return 0, errors.New("the artifacts are opened read-only")
+}
+
+func (s *section) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seeking before the start of the file")
+	}
+	s.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,207 @@
+package artifact_test
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"github.com/kairos-io/enki/pkg/artifact"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/fixture"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Artifacts", Label("artifact"), func() {
+	var dir string
+	var uki []byte
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		_, err := fixture.Write(dir)
+		Expect(err).ToNot(HaveOccurred())
+		uki, err = os.ReadFile(filepath.Join(dir, fixture.UKI))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("ISO", func() {
+		It("lists and reads the files of the ISO", func() {
+			iso, err := artifact.OpenISO(filepath.Join(dir, fixture.ISO))
+			Expect(err).ToNot(HaveOccurred())
+			defer iso.Close()
+			Expect(iso.Label()).To(Equal(constants.ISOLabel))
+			files, err := iso.Files()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(ContainElements(
+				artifact.File{Path: "/boot", Dir: true},
+				HaveField("Path", constants.IsoKernelPath),
+				HaveField("Path", "/"+constants.IsoRootFile),
+			))
+			kernel, err := iso.ReadFile(constants.IsoKernelPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(kernel)).To(HavePrefix("enki fixture kernel"))
+			_, err = iso.ReadFile("/boot/missing")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+			_, err = iso.ESP()
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+		It("reads the rootfs squashfs in place", func() {
+			iso, err := artifact.OpenISO(filepath.Join(dir, fixture.ISO))
+			Expect(err).ToNot(HaveOccurred())
+			defer iso.Close()
+			rootfs, err := iso.Rootfs()
+			Expect(err).ToNot(HaveOccurred())
+			release, err := rootfs.ReadFile("/etc/os-release")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(release)).To(Equal(fixture.OSRelease))
+		})
+	})
+
+	Describe("Squashfs", func() {
+		It("lists and reads the files of the squashfs", func() {
+			s, err := artifact.OpenSquashfs(filepath.Join(dir, fixture.Squashfs))
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			files, err := s.Files()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(ContainElements(
+				artifact.File{Path: "/etc", Dir: true},
+				artifact.File{Path: "/etc/os-release", Size: int64(len(fixture.OSRelease))},
+				artifact.File{Path: "/usr/share/enki/fixture.bin", Size: fixture.RootfsSize},
+			))
+			_, err = s.ReadFile("/etc")
+			Expect(err).To(MatchError(ContainSubstring("is a dir")))
+			_, err = s.ReadFile("/etc/missing")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+	})
+
+	Describe("UKI", func() {
+		It("reads the sections of the UKI", func() {
+			u, err := artifact.OpenUKI(filepath.Join(dir, fixture.UKI))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(u.Sections()).To(Equal([]string{".osrel", ".cmdline", ".uname", ".linux", ".initrd"}))
+			Expect(u.Cmdline()).To(Equal(fixture.Cmdline))
+			Expect(u.OSRelease()).To(Equal(fixture.OSRelease))
+			Expect(u.Uname()).ToNot(BeEmpty())
+			_, err = u.Section(".splash")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+		It("verifies the signatures of the UKI", func() {
+			u, err := artifact.ParseUKI(uki)
+			Expect(err).ToNot(HaveOccurred())
+			_, cert, err := fixture.KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(u.Verify(cert)).To(BeTrue())
+			sigs, err := u.Signatures(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sigs).To(HaveLen(1))
+			Expect(sigs[0].Subject).To(ContainSubstring("enki fixture db"))
+
+			// Any change to the signed contents breaks the signature
+			tampered := append([]byte{}, uki...)
+			tampered[len(tampered)/4] ^= 0xff
+			u, err = artifact.ParseUKI(tampered)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(u.Verify(cert)).To(BeFalse())
+		})
+	})
+
+	Describe("ESP", func() {
+		It("reads the UKIs of a FAT32 image", func() {
+			img := filepath.Join(dir, "esp.img")
+			f, err := os.Create(img)
+			Expect(err).ToNot(HaveOccurred())
+			size := int64(64 * 1024 * 1024)
+			Expect(f.Truncate(size)).To(Succeed())
+			fat, err := fat32.Create(f, size, 0, 512, "ESP")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fat.Mkdir("/EFI/Linux")).To(Succeed())
+			w, err := fat.OpenFile("/EFI/Linux/kairos-fixture.efi", os.O_CREATE|os.O_RDWR)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = w.Write(uki)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			esp, err := artifact.OpenESP(img)
+			Expect(err).ToNot(HaveOccurred())
+			defer esp.Close()
+			files, err := esp.Files()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(ContainElement(artifact.File{Path: "/EFI/Linux/kairos-fixture.efi", Size: int64(len(uki))}))
+			ukis, err := esp.UKIs()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ukis).To(HaveKey("/EFI/Linux/kairos-fixture.efi"))
+			Expect(ukis["/EFI/Linux/kairos-fixture.efi"].Cmdline()).To(Equal(fixture.Cmdline))
+		})
+		It("reads the files of a FAT12 image regardless of their case", func() {
+			img := filepath.Join(dir, "esp.img")
+			Expect(os.WriteFile(img, fat12(uki), 0644)).To(Succeed())
+			esp, err := artifact.OpenESP(img)
+			Expect(err).ToNot(HaveOccurred())
+			defer esp.Close()
+			files, err := esp.Files()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(Equal([]artifact.File{
+				{Path: "/EFI", Dir: true},
+				{Path: "/EFI/kairos.efi", Size: int64(len(uki))},
+			}))
+			data, err := esp.ReadFile("/efi/KAIROS.EFI")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal(uki))
+			_, err = esp.ReadFile("/EFI/missing.efi")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+	})
+})
+
+// fat12 returns a FAT12 image with 512 bytes clusters holding data in EFI/kairos.efi, whose 8.3
+// name is flagged lowercase like Windows NT does
+func fat12(data []byte) []byte {
+	const sector, sectors, rootEntries = 512, 256, 16
+	img := make([]byte, sector*sectors)
+	le := binary.LittleEndian
+	le.PutUint16(img[11:], sector)
+	img[13] = 1 // sectors per cluster
+	le.PutUint16(img[14:], 1)
+	img[16] = 1 // allocation tables
+	le.PutUint16(img[17:], rootEntries)
+	le.PutUint16(img[19:], sectors)
+	le.PutUint16(img[22:], 1)
+	img[510], img[511] = 0x55, 0xaa
+
+	table := img[sector : 2*sector]
+	set := func(cluster, next uint16) {
+		offset := cluster + cluster/2
+		if cluster%2 == 1 {
+			table[offset] = table[offset]&0x0f | byte(next<<4)
+			table[offset+1] = byte(next >> 4)
+		} else {
+			table[offset] = byte(next)
+			table[offset+1] = table[offset+1]&0xf0 | byte(next>>8)&0x0f
+		}
+	}
+	entry := func(e []byte, name string, attr, lower byte, cluster uint16, size int) {
+		copy(e, name)
+		e[11], e[12] = attr, lower
+		le.PutUint16(e[26:], cluster)
+		le.PutUint32(e[28:], uint32(size))
+	}
+	root := img[2*sector:]
+	dataStart := 2*sector + rootEntries*32
+	cluster := func(n uint16) []byte { return img[dataStart+int(n-2)*sector:] }
+
+	entry(root, "EFI        ", 0x10, 0, 2, 0)
+	set(2, 0xfff)
+	entry(cluster(2), ".          ", 0x10, 0, 2, 0)
+	entry(cluster(2)[32:], "..         ", 0x10, 0, 0, 0)
+	entry(cluster(2)[64:], "KAIROS  EFI", 0x20, 0x18, 3, len(data))
+	n := uint16((len(data) + sector - 1) / sector)
+	for i := uint16(0); i < n; i++ {
+		copy(cluster(3+i), data[int(i)*sector:min(int(i+1)*sector, len(data))])
+		set(3+i, 3+i+1)
+	}
+	set(3+n-1, 0xfff)
+	return img
+}
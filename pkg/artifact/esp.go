@@ -0,0 +1,96 @@
+package artifact
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ESP is the FAT image of an EFI system partition, like the ESP image of the UKI ISOs or the img
+// output of build-enrollment-media
+type ESP struct {
+	// f is the image file when opened on its own, closed along with the ESP
+	f  *os.File
+	fs *fat
+}
+
+// OpenESP opens the FAT image at path, which must be closed once done
+func OpenESP(path string) (*ESP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	e, err := readESP(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	e.f = f
+	return e, nil
+}
+
+// readESP reads the FAT filesystem of r
+func readESP(r io.ReaderAt) (*ESP, error) {
+	fs, err := readFAT(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ESP{fs: fs}, nil
+}
+
+// Close closes the image file. The ESP of an ISO is closed along with the ISO.
+func (e *ESP) Close() error {
+	if e.f == nil {
+		return nil
+	}
+	return e.f.Close()
+}
+
+// Files returns the files and dirs of the ESP, by path
+func (e *ESP) Files() ([]File, error) {
+	return walk(e.fs, "/")
+}
+
+// ReadFile returns the contents of the file at path in the ESP, whose names are matched
+// regardless of their case like the firmware does
+func (e *ESP) ReadFile(path string) ([]byte, error) {
+	return e.fs.readFile(clean(path))
+}
+
+// UKI returns the UKI at path in the ESP
+func (e *ESP) UKI(path string) (*UKI, error) {
+	data, err := e.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	u, err := ParseUKI(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return u, nil
+}
+
+// UKIs returns the UKIs of the ESP by path, the EFI binaries with a kernel. The bootloaders and
+// the other EFI binaries are left out.
+func (e *ESP) UKIs() (map[string]*UKI, error) {
+	files, err := e.Files()
+	if err != nil {
+		return nil, err
+	}
+	ukis := map[string]*UKI{}
+	for _, f := range files {
+		if f.Dir || !strings.EqualFold(filepath.Ext(f.Path), ".efi") {
+			continue
+		}
+		u, err := e.UKI(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := u.sections[linuxSection]; ok {
+			ukis[f.Path] = u
+		}
+	}
+	return ukis, nil
+}
@@ -0,0 +1,299 @@
+package artifact
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// fat is a read-only FAT12, FAT16 or FAT32 filesystem, the go-diskfs one only reads FAT32 while
+// mkfs.fat formats the small ESPs as FAT12 or FAT16
+type fat struct {
+	r    io.ReaderAt
+	bits int
+	// clusters is the amount of data clusters, numbered from 2
+	clusters    uint32
+	clusterSize int64
+	// dataStart is the offset of the first data cluster
+	dataStart int64
+	// rootStart and rootSize locate the fixed root dir of FAT12 and FAT16
+	rootStart, rootSize int64
+	// rootCluster is the first cluster of the root dir of FAT32
+	rootCluster uint32
+	// table is the first file allocation table
+	table []byte
+}
+
+// Directory entry attributes
+const (
+	fatAttrVolumeID = 0x08
+	fatAttrDir      = 0x10
+	fatAttrLongName = 0x0f
+)
+
+// readFAT reads the boot sector and the allocation table of the FAT filesystem of r
+func readFAT(r io.ReaderAt) (*fat, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, fmt.Errorf("reading the boot sector: %w", err)
+	}
+	if boot[510] != 0x55 || boot[511] != 0xaa {
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+	le := binary.LittleEndian
+	sector := int64(le.Uint16(boot[11:]))
+	perCluster := int64(boot[13])
+	reserved := int64(le.Uint16(boot[14:]))
+	tables := int64(boot[16])
+	rootEntries := int64(le.Uint16(boot[17:]))
+	total := int64(le.Uint16(boot[19:]))
+	if total == 0 {
+		total = int64(le.Uint32(boot[32:]))
+	}
+	tableSize := int64(le.Uint16(boot[22:]))
+	if tableSize == 0 {
+		tableSize = int64(le.Uint32(boot[36:]))
+	}
+	if sector == 0 || perCluster == 0 || tables == 0 || tableSize == 0 {
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+
+	f := &fat{r: r, clusterSize: sector * perCluster}
+	rootSectors := (rootEntries*32 + sector - 1) / sector
+	f.rootStart = (reserved + tables*tableSize) * sector
+	f.rootSize = rootEntries * 32
+	f.dataStart = f.rootStart + rootSectors*sector
+	f.clusters = uint32((total*sector - f.dataStart) / f.clusterSize)
+	switch {
+	case f.clusters < 4085:
+		f.bits = 12
+	case f.clusters < 65525:
+		f.bits = 16
+	default:
+		f.bits = 32
+		f.rootCluster = le.Uint32(boot[44:])
+	}
+	f.table = make([]byte, tableSize*sector)
+	if _, err := r.ReadAt(f.table, reserved*sector); err != nil {
+		return nil, fmt.Errorf("reading the allocation table: %w", err)
+	}
+	return f, nil
+}
+
+// next returns the cluster following cluster in its chain, 0 at the end of it
+func (f *fat) next(cluster uint32) uint32 {
+	var next, end uint32
+	switch f.bits {
+	case 12:
+		offset := cluster + cluster/2
+		if int(offset)+2 > len(f.table) {
+			return 0
+		}
+		next = uint32(binary.LittleEndian.Uint16(f.table[offset:]))
+		if cluster%2 == 1 {
+			next >>= 4
+		}
+		next, end = next&0xfff, 0xff8
+	case 16:
+		if int(cluster)*2+2 > len(f.table) {
+			return 0
+		}
+		next, end = uint32(binary.LittleEndian.Uint16(f.table[cluster*2:])), 0xfff8
+	default:
+		if int(cluster)*4+4 > len(f.table) {
+			return 0
+		}
+		next, end = binary.LittleEndian.Uint32(f.table[cluster*4:])&0x0fffffff, 0x0ffffff8
+	}
+	if next < 2 || next >= end || next-2 >= f.clusters {
+		return 0
+	}
+	return next
+}
+
+// read returns size bytes of the cluster chain starting at first, all of it if size is negative
+func (f *fat) read(first uint32, size int64) ([]byte, error) {
+	var data []byte
+	// A chain can't be longer than the clusters, unless the table loops
+	for cluster, n := first, uint32(0); cluster >= 2 && (size < 0 || int64(len(data)) < size); cluster, n = f.next(cluster), n+1 {
+		if n >= f.clusters {
+			return nil, fmt.Errorf("the chain of cluster %d loops", first)
+		}
+		buf := make([]byte, f.clusterSize)
+		if _, err := f.r.ReadAt(buf, f.dataStart+int64(cluster-2)*f.clusterSize); err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(data, buf...)
+	}
+	if size >= 0 {
+		if int64(len(data)) < size {
+			return nil, fmt.Errorf("the chain of cluster %d is shorter than the file", first)
+		}
+		data = data[:size]
+	}
+	return data, nil
+}
+
+// fatEntry is a file or dir of a FAT dir
+type fatEntry struct {
+	File
+	cluster uint32
+}
+
+// entries returns the files and dirs of the dir at p, its entries being at first, or in the
+// root dir if first is 0
+func (f *fat) entries(p string, first uint32) ([]fatEntry, error) {
+	var data []byte
+	var err error
+	switch {
+	case first != 0:
+		data, err = f.read(first, -1)
+	case f.bits == 32:
+		data, err = f.read(f.rootCluster, -1)
+	default:
+		data = make([]byte, f.rootSize)
+		_, err = f.r.ReadAt(data, f.rootStart)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", p, err)
+	}
+
+	var entries []fatEntry
+	// long is the long name spread across the entries preceding the short one, last part first
+	var long []uint16
+	for offset := 0; offset+32 <= len(data); offset += 32 {
+		e := data[offset : offset+32]
+		attr := e[11]
+		switch {
+		case e[0] == 0:
+			return entries, nil
+		case e[0] == 0xe5:
+			long = nil
+			continue
+		case attr == fatAttrLongName:
+			var part []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					part = append(part, binary.LittleEndian.Uint16(e[i:]))
+				}
+			}
+			if e[0]&0x40 != 0 {
+				long = nil
+			}
+			long = append(part, long...)
+			continue
+		case attr&fatAttrVolumeID != 0:
+			long = nil
+			continue
+		}
+
+		name := shortName(e)
+		if len(long) > 0 {
+			end := 0
+			for end < len(long) && long[end] != 0 && long[end] != 0xffff {
+				end++
+			}
+			name = string(utf16.Decode(long[:end]))
+			long = nil
+		}
+		if name == "." || name == ".." {
+			continue
+		}
+		cluster := uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+		entries = append(entries, fatEntry{
+			File: File{
+				Path: path.Join(p, name),
+				Size: int64(binary.LittleEndian.Uint32(e[28:])),
+				Dir:  attr&fatAttrDir != 0,
+			},
+			cluster: cluster,
+		})
+	}
+	return entries, nil
+}
+
+// shortName returns the 8.3 name of the dir entry, lowercased as flagged by Windows NT
+func shortName(e []byte) string {
+	base := strings.TrimRight(string(e[0:8]), " ")
+	ext := strings.TrimRight(string(e[8:11]), " ")
+	// 0x05 stands for a leading 0xe5, which marks deleted entries
+	if strings.HasPrefix(base, "\x05") {
+		base = "\xe5" + base[1:]
+	}
+	if e[12]&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if e[12]&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// find returns the entry at the clean absolute path p, ignoring the case of the names like FAT
+// does
+func (f *fat) find(p string) (fatEntry, error) {
+	entry := fatEntry{File: File{Path: "/", Dir: true}}
+	if p == "/" {
+		return entry, nil
+	}
+	for _, name := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		if !entry.Dir {
+			return fatEntry{}, fmt.Errorf("%s is not a dir", entry.Path)
+		}
+		entries, err := f.entries(entry.Path, entry.cluster)
+		if err != nil {
+			return fatEntry{}, err
+		}
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(path.Base(e.Path), name) {
+				entry, found = e, true
+				break
+			}
+		}
+		if !found {
+			return fatEntry{}, errNotExist(p)
+		}
+	}
+	return entry, nil
+}
+
+func (f *fat) readDir(p string) ([]File, error) {
+	dir, err := f.find(p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.Dir {
+		return nil, fmt.Errorf("%s is not a dir", dir.Path)
+	}
+	entries, err := f.entries(dir.Path, dir.cluster)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]File, 0, len(entries))
+	for _, e := range entries {
+		files = append(files, e.File)
+	}
+	return files, nil
+}
+
+// readFile returns the contents of the file at the clean absolute path p
+func (f *fat) readFile(p string) ([]byte, error) {
+	entry, err := f.find(p)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Dir {
+		return nil, fmt.Errorf("%s is a dir", entry.Path)
+	}
+	if entry.Size == 0 {
+		return []byte{}, nil
+	}
+	return f.read(entry.cluster, entry.Size)
+}
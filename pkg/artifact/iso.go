@@ -0,0 +1,121 @@
+package artifact
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/kairos-io/enki/pkg/constants"
+)
+
+// isoSector is the size of the ISO9660 logical blocks, the files are located in
+const isoSector = 2048
+
+// ISO is an ISO of build-iso or build-uki
+type ISO struct {
+	f  *os.File
+	fs *iso9660.FileSystem
+}
+
+// OpenISO opens the ISO at path, which must be closed once done
+func OpenISO(path string) (*ISO, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fs, err := iso9660.Read(f, info.Size(), 0, isoSector)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return &ISO{f: f, fs: fs}, nil
+}
+
+// Close closes the ISO file, along with the squashfs and ESP read from it
+func (i *ISO) Close() error {
+	return i.f.Close()
+}
+
+// Label returns the volume ID of the ISO
+func (i *ISO) Label() string {
+	return strings.TrimSpace(i.fs.Label())
+}
+
+// Files returns the files and dirs of the ISO, by path
+func (i *ISO) Files() ([]File, error) {
+	return walk(i, "/")
+}
+
+// ReadFile returns the contents of the file at path in the ISO
+func (i *ISO) ReadFile(path string) ([]byte, error) {
+	f, err := i.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Rootfs returns the rootfs squashfs of the live ISOs of build-iso, read in place
+func (i *ISO) Rootfs() (*Squashfs, error) {
+	r, err := i.embedded(constants.IsoRootFile)
+	if err != nil {
+		return nil, err
+	}
+	return readSquashfs(r)
+}
+
+// ESP returns the ESP image of the ISOs of build-uki, holding the UKIs, read in place
+func (i *ISO) ESP() (*ESP, error) {
+	r, err := i.embedded(constants.UkiIsoEfiImage)
+	if err != nil {
+		return nil, err
+	}
+	return readESP(r)
+}
+
+// embedded returns the part of the ISO file holding the file at path, the ISO9660 files being
+// contiguous
+func (i *ISO) embedded(path string) (*section, error) {
+	entry, err := lookup(i, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := i.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return &section{r: i.f, off: int64(f.Location()) * isoSector, size: entry.Size}, nil
+}
+
+// open opens the file at path for reading
+func (i *ISO) open(path string) (*iso9660.File, error) {
+	entry, err := lookup(i, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Dir {
+		return nil, fmt.Errorf("%s is a dir", entry.Path)
+	}
+	f, err := i.fs.OpenFile(entry.Path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*iso9660.File), nil
+}
+
+func (i *ISO) readDir(p string) ([]File, error) {
+	infos, err := i.fs.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	return fromInfos(p, infos), nil
+}
@@ -0,0 +1,83 @@
+package artifact
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+	"github.com/diskfs/go-diskfs/util"
+)
+
+// Squashfs is a rootfs squashfs image, on its own or in a live ISO
+type Squashfs struct {
+	// f is the image file when opened on its own, closed along with the squashfs
+	f  *os.File
+	fs *squashfs.FileSystem
+}
+
+// OpenSquashfs opens the squashfs image at path, which must be closed once done
+func OpenSquashfs(path string) (*Squashfs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := readSquashfs(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	s.f = f
+	return s, nil
+}
+
+// readSquashfs reads the squashfs image of file
+func readSquashfs(file util.File) (*Squashfs, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := squashfs.Read(file, size, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Squashfs{fs: fs}, nil
+}
+
+// Close closes the image file. The squashfs of an ISO is closed along with the ISO.
+func (s *Squashfs) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// Files returns the files and dirs of the squashfs, by path
+func (s *Squashfs) Files() ([]File, error) {
+	return walk(s, "/")
+}
+
+// ReadFile returns the contents of the file at path in the squashfs
+func (s *Squashfs) ReadFile(path string) ([]byte, error) {
+	entry, err := lookup(s, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Dir {
+		return nil, fmt.Errorf("%s is a dir", entry.Path)
+	}
+	f, err := s.fs.OpenFile(entry.Path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (s *Squashfs) readDir(p string) ([]File, error) {
+	infos, err := s.fs.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	return fromInfos(p, infos), nil
+}
@@ -0,0 +1,124 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/x509"
+	"debug/pe"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/kairos-io/enki/pkg/secureboot"
+)
+
+// The sections ukify adds to the stub
+const (
+	linuxSection   = ".linux"
+	cmdlineSection = ".cmdline"
+	osrelSection   = ".osrel"
+	unameSection   = ".uname"
+)
+
+// UKI is a unified kernel image of build-uki, or any other EFI binary
+type UKI struct {
+	// names are the names of the sections, in the order of the binary
+	names    []string
+	sections map[string][]byte
+	binary   *authenticode.PECOFFBinary
+}
+
+// OpenUKI reads the UKI at path
+func OpenUKI(path string) (*UKI, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	u, err := ParseUKI(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return u, nil
+}
+
+// ParseUKI reads the UKI from its contents
+func ParseUKI(data []byte) (*UKI, error) {
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	u := &UKI{sections: map[string][]byte{}}
+	for _, section := range f.Sections {
+		contents, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("reading section %s: %w", section.Name, err)
+		}
+		// Without the padding to the file alignment
+		if section.VirtualSize > 0 && int(section.VirtualSize) < len(contents) {
+			contents = contents[:section.VirtualSize]
+		}
+		u.names = append(u.names, section.Name)
+		u.sections[section.Name] = contents
+	}
+	if u.binary, err = authenticode.Parse(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Sections returns the names of the sections of the UKI, in their order in the binary
+func (u *UKI) Sections() []string {
+	return append([]string{}, u.names...)
+}
+
+// Section returns the contents of the section of the UKI named name, like .linux or .initrd,
+// wrapping fs.ErrNotExist if it has none
+func (u *UKI) Section(name string) ([]byte, error) {
+	data, ok := u.sections[name]
+	if !ok {
+		return nil, errNotExist(name)
+	}
+	return data, nil
+}
+
+// Cmdline returns the kernel cmdline embedded in the UKI, empty if it has none
+func (u *UKI) Cmdline() string {
+	return u.text(cmdlineSection)
+}
+
+// Uname returns the release of the kernel of the UKI, empty if it's not recorded
+func (u *UKI) Uname() string {
+	return u.text(unameSection)
+}
+
+// OSRelease returns the os-release of the image the UKI was built from, empty if it has none
+func (u *UKI) OSRelease() string {
+	return string(bytes.TrimRight(u.sections[osrelSection], "\x00"))
+}
+
+// text returns the single line text section named name
+func (u *UKI) text(name string) string {
+	return strings.TrimSpace(string(bytes.TrimRight(u.sections[name], "\x00")))
+}
+
+// Signatures returns the Secure Boot signatures of the UKI, each one naming the known
+// certificate it verifies with, if any
+func (u *UKI) Signatures(known map[string]*x509.Certificate) ([]secureboot.Signature, error) {
+	return secureboot.BinarySignatures(u.binary, known)
+}
+
+// Verify tells if one of the signatures of the UKI verifies with the certificate, like the db
+// certificate the firmware checks it with
+func (u *UKI) Verify(cert *x509.Certificate) (bool, error) {
+	signatures, err := u.Signatures(map[string]*x509.Certificate{"cert": cert})
+	if err != nil {
+		return false, err
+	}
+	for _, s := range signatures {
+		if s.Key != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,308 @@
+// Package audit checks the rootfs of a build against hardening rules in the spirit of the CIS
+// benchmarks and DISA STIGs, like world writable files or ssh password logins, and reports the
+// findings along with their severity.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+)
+
+// Severity of a finding, from an inventory entry to a finding to fix before shipping
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+)
+
+var severityNames = []string{"info", "low", "medium", "high"}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+// MarshalJSON renders the severity by its name
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Severities returns the names of the severities, from the lowest to the highest
+func Severities() []string {
+	return append([]string{}, severityNames...)
+}
+
+// ParseSeverity returns the severity of the given name
+func ParseSeverity(name string) (Severity, error) {
+	for i, n := range severityNames {
+		if n == name {
+			return Severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q, available severities: %s", name, strings.Join(severityNames, ", "))
+}
+
+// Finding is something a check flagged in the rootfs
+type Finding struct {
+	Check    string   `json:"check"`
+	Severity Severity `json:"severity"`
+	// Path is the flagged file, as an absolute path of the rootfs
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// check inspects the rootfs for a single hardening rule
+type check func(fs v1.FS, rootfs string) ([]Finding, error)
+
+var checks = map[string]check{
+	"world-writable":  worldWritable,
+	"setuid":          setuid,
+	"ssh-config":      sshConfig,
+	"password-hashes": passwordHashes,
+}
+
+// Checks returns the names of the available checks
+func Checks() []string {
+	var names []string
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateChecks fails if any of the names is not an available check
+func ValidateChecks(names []string) error {
+	for _, name := range names {
+		if _, ok := checks[name]; !ok {
+			return fmt.Errorf("unknown audit check %q, available checks: %s", name, strings.Join(Checks(), ", "))
+		}
+	}
+	return nil
+}
+
+// Run runs the named checks over rootfs and returns their findings, the most severe first
+func Run(fs v1.FS, rootfs string, names []string) ([]Finding, error) {
+	if err := ValidateChecks(names); err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, name := range names {
+		found, err := checks[name](fs, rootfs)
+		if err != nil {
+			return nil, fmt.Errorf("running the %s audit check: %w", name, err)
+		}
+		for i := range found {
+			found[i].Check = name
+		}
+		findings = append(findings, found...)
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+	return findings, nil
+}
+
+// AtLeast returns the findings of the given severity or higher
+func AtLeast(findings []Finding, severity Severity) []Finding {
+	var result []Finding
+	for _, f := range findings {
+		if f.Severity >= severity {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// WriteReport writes the findings as JSON into path, along with how many there are of each
+// severity
+func WriteReport(fs v1.FS, path string, findings []Finding) error {
+	report := struct {
+		Counts   map[string]int `json:"counts"`
+		Findings []Finding      `json:"findings"`
+	}{Counts: map[string]int{}, Findings: findings}
+	for _, name := range severityNames {
+		report.Counts[name] = 0
+	}
+	for _, f := range findings {
+		report.Counts[f.Severity.String()]++
+	}
+	if report.Findings == nil {
+		report.Findings = []Finding{}
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// LogFindings prints the findings, the info ones only in debug mode as they are an inventory
+func LogFindings(logger v1.Logger, findings []Finding) {
+	counts := map[Severity]int{}
+	for _, f := range findings {
+		counts[f.Severity]++
+		if f.Severity == SeverityInfo {
+			logger.Debugf("Audit %s: %s: %s", f.Check, f.Path, f.Message)
+			continue
+		}
+		logger.Warnf("Audit %s [%s]: %s: %s", f.Check, f.Severity, f.Path, f.Message)
+	}
+	logger.Infof("Audit findings: %d high, %d medium, %d low, %d info", counts[SeverityHigh], counts[SeverityMedium], counts[SeverityLow], counts[SeverityInfo])
+}
+
+// walk calls fn with the rootfs path and the info of every file of rootfs, symlinks included
+func walk(fs v1.FS, rootfs string, fn func(path string, info os.FileInfo)) error {
+	return vfs.Walk(fs, rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		fn(filepath.Join("/", rel), info)
+		return nil
+	})
+}
+
+// worldWritable flags the files anyone can write, and the dirs anyone can write without the
+// sticky bit keeping them from removing the files of others
+func worldWritable(fs v1.FS, rootfs string) ([]Finding, error) {
+	var findings []Finding
+	err := walk(fs, rootfs, func(path string, info os.FileInfo) {
+		mode := info.Mode()
+		if mode&os.ModeSymlink != 0 || mode.Perm()&0002 == 0 {
+			return
+		}
+		switch {
+		case mode.IsRegular():
+			findings = append(findings, Finding{Severity: SeverityMedium, Path: path, Message: fmt.Sprintf("file is world writable (%s)", mode.Perm())})
+		case mode.IsDir() && mode&os.ModeSticky == 0:
+			findings = append(findings, Finding{Severity: SeverityMedium, Path: path, Message: fmt.Sprintf("dir is world writable without the sticky bit (%s)", mode.Perm())})
+		}
+	})
+	return findings, err
+}
+
+// setuid lists the setuid and setgid binaries, to review the ones the image ships
+func setuid(fs v1.FS, rootfs string) ([]Finding, error) {
+	var findings []Finding
+	err := walk(fs, rootfs, func(path string, info os.FileInfo) {
+		mode := info.Mode()
+		if !mode.IsRegular() {
+			return
+		}
+		if mode&os.ModeSetuid != 0 {
+			findings = append(findings, Finding{Severity: SeverityInfo, Path: path, Message: "setuid binary"})
+		}
+		if mode&os.ModeSetgid != 0 {
+			findings = append(findings, Finding{Severity: SeverityInfo, Path: path, Message: "setgid binary"})
+		}
+	})
+	return findings, err
+}
+
+// sshSettings are the sshd settings flagged when enabled, with why
+var sshSettings = []struct {
+	keyword  string
+	severity Severity
+	message  string
+}{
+	{"permitrootlogin", SeverityHigh, "PermitRootLogin yes lets root log in with a password"},
+	{"permitemptypasswords", SeverityHigh, "PermitEmptyPasswords yes lets accounts without a password log in"},
+	{"passwordauthentication", SeverityMedium, "PasswordAuthentication yes allows brute forcing passwords, prefer keys"},
+	{"x11forwarding", SeverityLow, "X11Forwarding yes exposes the X11 display of clients"},
+}
+
+// sshConfig flags the insecure settings of the sshd config. As sshd takes the first value of
+// each setting, the drop-ins are read before the main config, which includes them first on
+// the distros shipping them.
+func sshConfig(fs v1.FS, rootfs string) ([]Finding, error) {
+	main := filepath.Join(rootfs, "etc", "ssh", "sshd_config")
+	if _, err := fs.Stat(main); err != nil {
+		return nil, nil
+	}
+	var dropIns []string
+	dropInDir := filepath.Join(rootfs, "etc", "ssh", "sshd_config.d")
+	entries, err := fs.ReadDir(dropInDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".conf") {
+			dropIns = append(dropIns, filepath.Join(dropInDir, entry.Name()))
+		}
+	}
+	sort.Strings(dropIns)
+	settings := map[string]string{}
+	origin := map[string]string{}
+	for _, file := range append(dropIns, main) {
+		data, err := fs.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			keyword := strings.ToLower(fields[0])
+			// Settings under a Match block only apply to some connections
+			if keyword == "match" {
+				break
+			}
+			if _, ok := settings[keyword]; !ok {
+				settings[keyword] = strings.ToLower(fields[1])
+				rel, _ := filepath.Rel(rootfs, file)
+				origin[keyword] = filepath.Join("/", rel)
+			}
+		}
+	}
+	var findings []Finding
+	for _, s := range sshSettings {
+		if settings[s.keyword] == "yes" {
+			findings = append(findings, Finding{Severity: s.severity, Path: origin[s.keyword], Message: s.message})
+		}
+	}
+	return findings, nil
+}
+
+// passwordHashes flags the accounts with a password hash, or an empty password, baked into
+// the image instead of set on first boot
+func passwordHashes(fs v1.FS, rootfs string) ([]Finding, error) {
+	data, err := fs.ReadFile(filepath.Join(rootfs, "etc", "shadow"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || fields[0] == "" {
+			continue
+		}
+		user, hash := fields[0], fields[1]
+		switch {
+		case hash == "":
+			findings = append(findings, Finding{Severity: SeverityHigh, Path: "/etc/shadow", Message: fmt.Sprintf("%s has an empty password", user)})
+		case !strings.HasPrefix(hash, "!") && !strings.HasPrefix(hash, "*"):
+			findings = append(findings, Finding{Severity: SeverityHigh, Path: "/etc/shadow", Message: fmt.Sprintf("%s has a password hash set in the image", user)})
+		}
+	}
+	return findings, nil
+}
@@ -0,0 +1,69 @@
+package audit_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/audit"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs"
+)
+
+var _ = Describe("Audit", Label("audit"), func() {
+	var rootfs string
+	BeforeEach(func() {
+		rootfs = GinkgoT().TempDir()
+		for _, dir := range []string{"etc/ssh/sshd_config.d", "usr/bin", "tmp", "var/shared"} {
+			Expect(os.MkdirAll(filepath.Join(rootfs, dir), 0755)).To(Succeed())
+		}
+		Expect(os.WriteFile(filepath.Join(rootfs, "usr", "bin", "sudo"), []byte("sudo"), 0755)).To(Succeed())
+		Expect(os.Chmod(filepath.Join(rootfs, "usr", "bin", "sudo"), 0755|os.ModeSetuid)).To(Succeed())
+		Expect(os.Chmod(filepath.Join(rootfs, "tmp"), 0777|os.ModeSticky)).To(Succeed())
+		Expect(os.Chmod(filepath.Join(rootfs, "var", "shared"), 0777)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(rootfs, "etc", "ssh", "sshd_config"), []byte("Include /etc/ssh/sshd_config.d/*.conf\nPermitRootLogin yes\nPasswordAuthentication yes\nMatch User admin\n  PermitEmptyPasswords yes\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(rootfs, "etc", "ssh", "sshd_config.d", "10-kairos.conf"), []byte("# hardened\nPermitRootLogin no\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(rootfs, "etc", "shadow"), []byte("root:!:19000::::::\nkairos:$6$salt$hash:19000:0:99999:7:::\nguest::19000::::::\n"), 0600)).To(Succeed())
+	})
+
+	It("reports the findings of the checks, the most severe first", func() {
+		findings, err := audit.Run(vfs.OSFS, rootfs, audit.Checks())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(findings).To(Equal([]audit.Finding{
+			{Check: "password-hashes", Severity: audit.SeverityHigh, Path: "/etc/shadow", Message: "kairos has a password hash set in the image"},
+			{Check: "password-hashes", Severity: audit.SeverityHigh, Path: "/etc/shadow", Message: "guest has an empty password"},
+			{Check: "ssh-config", Severity: audit.SeverityMedium, Path: "/etc/ssh/sshd_config", Message: "PasswordAuthentication yes allows brute forcing passwords, prefer keys"},
+			{Check: "world-writable", Severity: audit.SeverityMedium, Path: "/var/shared", Message: "dir is world writable without the sticky bit (-rwxrwxrwx)"},
+			{Check: "setuid", Severity: audit.SeverityInfo, Path: "/usr/bin/sudo", Message: "setuid binary"},
+		}))
+		Expect(audit.AtLeast(findings, audit.SeverityHigh)).To(HaveLen(2))
+	})
+
+	It("runs only the given checks", func() {
+		findings, err := audit.Run(vfs.OSFS, rootfs, []string{"setuid"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(findings).To(HaveLen(1))
+
+		_, err = audit.Run(vfs.OSFS, rootfs, []string{"antivirus"})
+		Expect(err).To(MatchError(ContainSubstring("unknown audit check \"antivirus\"")))
+		_, err = audit.ParseSeverity("critical")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("writes the findings report", func() {
+		findings, err := audit.Run(vfs.OSFS, rootfs, []string{"password-hashes"})
+		Expect(err).ToNot(HaveOccurred())
+		path := filepath.Join(GinkgoT().TempDir(), "audit.json")
+		Expect(audit.WriteReport(vfs.OSFS, path, findings)).To(Succeed())
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		var report struct {
+			Counts   map[string]int   `json:"counts"`
+			Findings []map[string]any `json:"findings"`
+		}
+		Expect(json.Unmarshal(data, &report)).To(Succeed())
+		Expect(report.Counts).To(Equal(map[string]int{"high": 2, "medium": 0, "low": 0, "info": 0}))
+		Expect(report.Findings[0]).To(HaveKeyWithValue("severity", "high"))
+	})
+})
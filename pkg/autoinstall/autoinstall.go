@@ -0,0 +1,92 @@
+// Package autoinstall writes the cloud-config that makes installer media install the system
+// unattended, so it doesn't have to be provided by other means.
+package autoinstall
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the cloud-config written to the root of the ISO. kairos-agent reads it from
+// there as the ISO is mounted on one of its config scan dirs, /run/initramfs/live.
+const FileName = "config.yaml"
+
+// header marks the file as a cloud-config, kairos-agent ignores yaml files without it
+const header = "#cloud-config\n"
+
+// Options are the install settings baked into the media
+type Options struct {
+	// Device is the disk to install to, kairos-agent picks the biggest one if empty
+	Device string
+	// Reboot reboots into the installed system once done
+	Reboot bool
+	// Config is a cloud-config file with the install spec, or any other config, to embed. The
+	// other options take precedence over its install section.
+	Config string
+}
+
+// Enabled returns true if any install option is set
+func (o Options) Enabled() bool {
+	return o.Device != "" || o.Reboot || o.Config != ""
+}
+
+// Validate checks the config file is a cloud-config kairos-agent can read
+func (o Options) Validate(fs v1.FS) error {
+	_, err := o.CloudConfig(fs)
+	return err
+}
+
+// CloudConfig returns the cloud-config enabling the automatic install with the options
+func (o Options) CloudConfig(fs v1.FS) ([]byte, error) {
+	cfg := map[string]any{}
+	if o.Config != "" {
+		data, err := fs.ReadFile(o.Config)
+		if err != nil {
+			return nil, fmt.Errorf("reading install-config: %w", err)
+		}
+		if err = yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid install-config %s: %w", o.Config, err)
+		}
+		if cfg == nil {
+			cfg = map[string]any{}
+		}
+	}
+	install := map[string]any{}
+	if section, ok := cfg["install"]; ok && section != nil {
+		if install, ok = section.(map[string]any); !ok {
+			return nil, fmt.Errorf("invalid install-config %s: the install section must be a map", o.Config)
+		}
+	}
+	install["auto"] = true
+	if o.Device != "" {
+		install["device"] = o.Device
+	}
+	if o.Reboot {
+		install["reboot"] = true
+	}
+	cfg["install"] = install
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(header), data...), nil
+}
+
+// Write writes the cloud-config into the root of the ISO tree in dir, returning its path
+func Write(fs v1.FS, dir string, o Options) (string, error) {
+	data, err := o.CloudConfig(fs)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, FileName)
+	if existing, err := fs.ReadFile(path); err == nil && !bytes.Equal(existing, data) {
+		return "", fmt.Errorf("%s already exists in the ISO, embed it through the install-config instead", FileName)
+	}
+	return path, fs.WriteFile(path, data, constants.FilePerm)
+}
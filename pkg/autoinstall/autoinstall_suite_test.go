@@ -0,0 +1,13 @@
+package autoinstall_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestAutoinstall(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Autoinstall test suite")
+}
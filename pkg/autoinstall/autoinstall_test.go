@@ -0,0 +1,73 @@
+package autoinstall_test
+
+import (
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/autoinstall"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Autoinstall", Label("autoinstall"), func() {
+	It("enables the automatic install with the given options", func() {
+		opts := autoinstall.Options{Device: "/dev/vda", Reboot: true}
+		Expect(opts.Enabled()).To(BeTrue())
+		Expect(autoinstall.Options{}.Enabled()).To(BeFalse())
+
+		data, err := opts.CloudConfig(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.HasPrefix(string(data), "#cloud-config\n")).To(BeTrue())
+		var cfg map[string]any
+		Expect(yaml.Unmarshal(data, &cfg)).To(Succeed())
+		Expect(cfg).To(Equal(map[string]any{
+			"install": map[string]any{"auto": true, "device": "/dev/vda", "reboot": true},
+		}))
+	})
+
+	It("merges the options over the install spec of the config", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/install.yaml": "#cloud-config\ninstall:\n  device: /dev/sda\n  grub-entry-name: Acme\nusers:\n- name: kairos\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		opts := autoinstall.Options{Device: "/dev/nvme0n1", Config: "/install.yaml"}
+		Expect(fs.Mkdir("/iso", 0o755)).To(Succeed())
+		path, err := autoinstall.Write(fs, "/iso", opts)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(path).To(Equal("/iso/" + autoinstall.FileName))
+
+		data, err := fs.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		var cfg map[string]any
+		Expect(yaml.Unmarshal(data, &cfg)).To(Succeed())
+		Expect(cfg["install"]).To(Equal(map[string]any{"auto": true, "device": "/dev/nvme0n1", "grub-entry-name": "Acme"}))
+		Expect(cfg["users"]).To(HaveLen(1))
+	})
+
+	It("rejects configs it can't merge into", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/list.yaml":    "- a\n- b\n",
+			"/install.yaml": "install: /dev/sda\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		Expect(autoinstall.Options{Config: "/missing.yaml"}.Validate(fs)).To(MatchError(ContainSubstring("reading install-config")))
+		Expect(autoinstall.Options{Config: "/list.yaml"}.Validate(fs)).To(MatchError(ContainSubstring("invalid install-config")))
+		Expect(autoinstall.Options{Config: "/install.yaml"}.Validate(fs)).To(MatchError(ContainSubstring("must be a map")))
+	})
+
+	It("doesn't overwrite a different config in the ISO", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/iso/config.yaml": "#cloud-config\nhostname: foo\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		_, err = autoinstall.Write(fs, "/iso", autoinstall.Options{Reboot: true})
+		Expect(err).To(MatchError(ContainSubstring("already exists")))
+	})
+})
@@ -0,0 +1,164 @@
+// Package buildinfo records how an artifact was built, so a running system can report the enki
+// version, sources and options it came from.
+package buildinfo
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/enki/internal/version"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/mirror"
+	"github.com/kairos-io/enki/pkg/scan"
+	"github.com/kairos-io/enki/pkg/trust"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdk "github.com/kairos-io/kairos-sdk/utils"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// RootfsPath is where the build info is stored in the rootfs
+	RootfsPath = "/etc/kairos/build-info.yaml"
+	// FileName is the name of the build info file at the root of ISOs
+	FileName = "build-info.yaml"
+	// UKISection is the PE section of UKIs holding the build info
+	UKISection = ".bldinfo"
+)
+
+// Source is an image the artifact was built from
+type Source struct {
+	URI string `yaml:"uri"`
+	// Digest of the image manifest, only known for container images
+	Digest string `yaml:"digest,omitempty"`
+	// Provenance is the verified provenance attestation of the image, chaining its own build
+	// into the one of the artifact
+	Provenance *trust.Provenance `yaml:"provenance,omitempty"`
+}
+
+// Info is the provenance of an artifact
+type Info struct {
+	EnkiVersion string   `yaml:"enki-version"`
+	EnkiCommit  string   `yaml:"enki-commit,omitempty"`
+	Sources     []Source `yaml:"sources,omitempty"`
+	// Flags are the command line flags set for the build
+	Flags map[string]string `yaml:"flags,omitempty"`
+	// ManifestCommit is the git commit of the config dir, if it is a git checkout
+	ManifestCommit string `yaml:"manifest-commit,omitempty"`
+	// BuildDate is the start of the build, or SOURCE_DATE_EPOCH for reproducible builds
+	BuildDate time.Time `yaml:"build-date"`
+	// Scan is the result of the malware scan of the rootfs, if it was scanned
+	Scan *scan.Result `yaml:"scan,omitempty"`
+}
+
+// localFlags are the flags only naming paths of the build host, like where the outputs and logs
+// are written, or only checking the inputs. They don't change the artifacts, recording them would
+// make rebuilds differ.
+var localFlags = map[string]bool{
+	"config-dir":   true,
+	"history-file": true,
+	"json-result":  true,
+	"locked":       true,
+	"lockfile":     true,
+	"log-file":     true,
+	"logfile":      true,
+	"output":       true,
+	"output-dir":   true,
+	"transcript":   true,
+}
+
+// New collects the build info of the current enki invocation. The flags set on the command
+// line are recorded as given, but for the ones not changing the artifacts.
+func New(runner v1.Runner, flags *pflag.FlagSet, configDir string) *Info {
+	info := &Info{
+		EnkiVersion: version.Get().Version,
+		EnkiCommit:  version.Get().GitCommit,
+		Flags:       map[string]string{},
+		BuildDate:   buildDate(),
+	}
+	if flags != nil {
+		flags.Visit(func(f *pflag.Flag) {
+			if localFlags[f.Name] {
+				return
+			}
+			info.Flags[f.Name] = f.Value.String()
+		})
+	}
+	if configDir != "" {
+		if _, err := os.Stat(configDir); err == nil {
+			out, err := runner.Run("git", "-C", configDir, "rev-parse", "HEAD")
+			if err == nil {
+				info.ManifestCommit = strings.TrimSpace(string(out))
+			}
+		}
+	}
+	return info
+}
+
+// buildDate honors SOURCE_DATE_EPOCH so the build info doesn't break reproducible builds
+func buildDate() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		if secs, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			return time.Unix(secs, 0).UTC()
+		}
+	}
+	return time.Now().UTC()
+}
+
+// AddSources records the given sources. The digest of container images is resolved on a
+// best effort basis, failing to resolve it is only logged.
+func (i *Info) AddSources(logger v1.Logger, platform string, sources ...*v1.ImageSource) {
+	for _, src := range sources {
+		s := Source{URI: src.String()}
+		if src.IsDocker() {
+			digest, err := imageDigest(src.Value(), platform)
+			if err != nil {
+				logger.Warnf("Could not resolve the digest of %s for the build info: %v", src.Value(), err)
+			}
+			s.Digest = digest
+		}
+		i.Sources = append(i.Sources, s)
+	}
+}
+
+func imageDigest(ref, platform string) (string, error) {
+	img, err := sdk.GetImage(mirror.Image(ref), platform)
+	if err != nil {
+		return "", err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// AddProvenance records the verified provenance attestation of the source with the given URI
+func (i *Info) AddProvenance(uri string, provenance *trust.Provenance) {
+	for n := range i.Sources {
+		if i.Sources[n].URI == uri {
+			i.Sources[n].Provenance = provenance
+		}
+	}
+}
+
+// YAML returns the build info document
+func (i *Info) YAML() ([]byte, error) {
+	return yaml.Marshal(i)
+}
+
+// WriteFile writes the build info document into path, creating its parent directories
+func (i *Info) WriteFile(fs v1.FS, path string) error {
+	data, err := i.YAML()
+	if err != nil {
+		return err
+	}
+	if err = utils.MkdirAll(fs, filepath.Dir(path), constants.DirPerm); err != nil {
+		return err
+	}
+	return fs.WriteFile(path, data, constants.FilePerm)
+}
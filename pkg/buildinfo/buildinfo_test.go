@@ -0,0 +1,72 @@
+package buildinfo_test
+
+import (
+	"time"
+
+	"github.com/kairos-io/enki/pkg/buildinfo"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+	"github.com/twpayne/go-vfs/vfst"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("BuildInfo", Label("buildinfo"), func() {
+	var runner *v1mock.FakeRunner
+	var flags *pflag.FlagSet
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		runner.SetLogger(v1.NewNullLogger())
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			if command == "git" {
+				return []byte("0123456789abcdef\n"), nil
+			}
+			return []byte{}, nil
+		}
+		flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.String("name", "", "")
+		flags.Bool("zsync", false, "")
+		flags.String("output", "", "")
+		Expect(flags.Parse([]string{"--name", "kairos", "--output", "/tmp/build"})).To(Succeed())
+	})
+
+	It("records the changed flags but the host paths, and the config dir commit", func() {
+		info := buildinfo.New(runner, flags, GinkgoT().TempDir())
+		Expect(info.Flags).To(Equal(map[string]string{"name": "kairos"}))
+		Expect(info.ManifestCommit).To(Equal("0123456789abcdef"))
+		Expect(info.EnkiVersion).ToNot(BeEmpty())
+	})
+
+	It("skips the commit if there is no config dir", func() {
+		info := buildinfo.New(runner, flags, "/nonexistent")
+		Expect(info.ManifestCommit).To(BeEmpty())
+		Expect(runner.IncludesCmds([][]string{{"git"}})).ToNot(Succeed())
+	})
+
+	It("uses SOURCE_DATE_EPOCH as build date", func() {
+		GinkgoT().Setenv("SOURCE_DATE_EPOCH", "1700000000")
+		info := buildinfo.New(runner, flags, "")
+		Expect(info.BuildDate).To(Equal(time.Unix(1700000000, 0).UTC()))
+	})
+
+	It("writes the build info document", func() {
+		fs, cleanup, err := vfst.NewTestFS(nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		info := buildinfo.New(runner, flags, "")
+		info.AddSources(v1.NewNullLogger(), "linux/amd64", v1.NewDirSrc("/rootfs"))
+		Expect(info.WriteFile(fs, buildinfo.RootfsPath)).To(Succeed())
+
+		data, err := fs.ReadFile(buildinfo.RootfsPath)
+		Expect(err).ToNot(HaveOccurred())
+		var doc map[string]any
+		Expect(yaml.Unmarshal(data, &doc)).To(Succeed())
+		Expect(doc).To(HaveKeyWithValue("flags", map[string]any{"name": "kairos"}))
+		Expect(doc).To(HaveKeyWithValue("sources", []any{map[string]any{"uri": "dir:///rootfs"}}))
+		Expect(doc).To(HaveKey("build-date"))
+	})
+})
@@ -0,0 +1,237 @@
+// Package burn writes artifacts to block devices, like USB sticks, and reads them back to
+// verify them, refusing the devices the running system uses.
+package burn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/twpayne/go-vfs"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// procDir and sysDir are where the kernel exposes the mounts and the block devices
+	procDir = "/proc"
+	sysDir  = "/sys"
+)
+
+// Device is a whole disk artifacts can be written to
+type Device struct {
+	// Path is the device node, with symlinks like the /dev/disk/by-id ones resolved
+	Path string
+	// Size is the capacity of the disk in bytes
+	Size int64
+	// Removable is set for disks the kernel reports as removable media
+	Removable bool
+}
+
+// Name returns the kernel name of the device, like sdb
+func (d Device) Name() string {
+	return filepath.Base(d.Path)
+}
+
+// OpenDevice returns the disk at path if it is safe to overwrite: a whole block device with no
+// mounted filesystem, active swap or device mapper target on it, which rules out the disks the
+// running system lives on.
+func OpenDevice(path string) (*Device, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "")
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return nil, failure.Errorf(failure.ErrInvalidConfig, "list the disks with lsblk", "%s is not a block device", path)
+	}
+	dev := &Device{Path: resolved}
+	block := filepath.Join(sysDir, "class", "block", dev.Name())
+	if _, err := os.Stat(filepath.Join(block, "partition")); err == nil {
+		return nil, failure.Errorf(failure.ErrInvalidConfig, "pass the whole disk, the artifact brings its own partition table",
+			"%s is a partition", path)
+	}
+	sectors, err := readSysInt(filepath.Join(block, "size"))
+	if err != nil {
+		return nil, fmt.Errorf("reading the size of %s: %w", path, err)
+	}
+	// The size is always in 512 bytes sectors, whatever the sector size of the disk
+	dev.Size = sectors * 512
+	removable, _ := readSysInt(filepath.Join(block, "removable"))
+	dev.Removable = removable == 1
+
+	if err := dev.checkUnused(); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+// checkUnused fails if the disk or any of its partitions is mounted, used as swap or held by
+// a device mapper target, like LVM or LUKS
+func (d *Device) checkUnused() error {
+	mounts, err := os.Open(filepath.Join(procDir, "self", "mounts"))
+	if err != nil {
+		return err
+	}
+	defer mounts.Close()
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !d.owns(fields[0]) {
+			continue
+		}
+		if fields[1] == "/" {
+			return failure.Errorf(failure.ErrInvalidConfig, "", "%s holds the root filesystem of the running system", d.Path)
+		}
+		return failure.Errorf(failure.ErrInvalidConfig, "unmount it first, e.g. with umount "+fields[1],
+			"%s is mounted at %s", fields[0], fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if swaps, err := os.ReadFile(filepath.Join(procDir, "swaps")); err == nil {
+		for _, line := range strings.Split(string(swaps), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && d.owns(fields[0]) {
+				return failure.Errorf(failure.ErrInvalidConfig, "disable it first with swapoff "+fields[0], "%s is used as swap", fields[0])
+			}
+		}
+	}
+
+	blocks := []string{filepath.Join(sysDir, "class", "block", d.Name())}
+	partitions, _ := filepath.Glob(filepath.Join(blocks[0], d.Name()+"*", "partition"))
+	for _, partition := range partitions {
+		blocks = append(blocks, filepath.Dir(partition))
+	}
+	for _, block := range blocks {
+		if holders, _ := os.ReadDir(filepath.Join(block, "holders")); len(holders) > 0 {
+			return failure.Errorf(failure.ErrInvalidConfig, "close the LVM volumes or LUKS mappings on it first",
+				"%s is used by the device mapper target %s", filepath.Join("/dev", filepath.Base(block)), holders[0].Name())
+		}
+	}
+	return nil
+}
+
+// owns tells if the device node source is the disk or one of its partitions
+func (d *Device) owns(source string) bool {
+	if !strings.HasPrefix(source, "/dev/") {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(source); err == nil {
+		source = resolved
+	}
+	if source == d.Path {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(sysDir, "class", "block", d.Name(), filepath.Base(source), "partition"))
+	return err == nil
+}
+
+// Write copies the artifact at src to the start of device, syncing it before returning, and
+// returns the sha256 checksum of what was written
+func Write(src, device string, progress utils.ProgressFunc) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	// O_EXCL makes opening a block device fail while the kernel uses it, like when mounted
+	out, err := os.OpenFile(device, os.O_WRONLY|unix.O_EXCL, 0)
+	if err != nil {
+		return "", fmt.Errorf("opening %s: %w", device, err)
+	}
+	defer out.Close()
+
+	sums, err := utils.NewChecksumWriter(utils.NewProgressWriter(out, info.Size(), progress), utils.ChecksumSHA256)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(sums, in); err != nil {
+		return "", fmt.Errorf("writing %s: %w", device, err)
+	}
+	if err = out.Sync(); err != nil {
+		return "", fmt.Errorf("syncing %s: %w", device, err)
+	}
+	return sums.Sum(utils.ChecksumSHA256, utils.ChecksumFormatHex)
+}
+
+// Verify reads back the first size bytes of device and fails if their sha256 checksum isn't
+// checksum. The cached pages of the device are dropped first, so the data is read from the
+// device rather than from what was just written to memory.
+func Verify(device string, size int64, checksum string, progress utils.ProgressFunc) error {
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_ = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+
+	sums, err := utils.NewChecksumWriter(nil, utils.ChecksumSHA256)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(utils.NewProgressWriter(sums, size, progress), io.LimitReader(f, size))
+	if err != nil {
+		return fmt.Errorf("reading back %s: %w", device, err)
+	}
+	got, err := sums.Sum(utils.ChecksumSHA256, utils.ChecksumFormatHex)
+	if err != nil {
+		return err
+	}
+	if n != size || got != checksum {
+		return failure.Errorf(failure.ErrVerification, "the device may be faulty or fake about its capacity, try another one",
+			"%s doesn't read back what was written: sha256 %s, expected %s", device, got, checksum)
+	}
+	return nil
+}
+
+// CheckArtifact fails if the artifact doesn't match the checksum files enki wrote next to it,
+// if any, so a corrupted download isn't written. It returns the algorithms checked.
+func CheckArtifact(artifact string) ([]string, error) {
+	wants := map[string]string{}
+	var algorithms []string
+	for _, algorithm := range utils.ChecksumAlgorithms() {
+		data, err := os.ReadFile(artifact + "." + algorithm)
+		if err != nil {
+			continue
+		}
+		wants[algorithm], _, _ = strings.Cut(strings.TrimSpace(string(data)), " ")
+		algorithms = append(algorithms, algorithm)
+	}
+	if len(algorithms) == 0 {
+		return nil, nil
+	}
+	sums, err := utils.CalcFileChecksums(vfs.OSFS, artifact, algorithms...)
+	if err != nil {
+		return nil, err
+	}
+	for _, algorithm := range algorithms {
+		hex, _ := sums.Sum(algorithm, utils.ChecksumFormatHex)
+		multihash, _ := sums.Sum(algorithm, utils.ChecksumFormatMultihash)
+		if want := wants[algorithm]; want != hex && want != multihash {
+			return nil, failure.Errorf(failure.ErrVerification, "download it again", "%s doesn't match its %s checksum file", artifact, algorithm)
+		}
+	}
+	return algorithms, nil
+}
+
+// readSysInt reads a sysfs attribute holding an integer
+func readSysInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
@@ -0,0 +1,13 @@
+package burn
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestBurn(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Burn test suite")
+}
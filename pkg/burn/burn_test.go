@@ -0,0 +1,106 @@
+package burn
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Burn", Label("burn"), func() {
+	var dir, artifact, device string
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		artifact = filepath.Join(dir, "kairos.iso")
+		device = filepath.Join(dir, "sdz")
+		data := make([]byte, 3<<20)
+		_, err := rand.Read(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(artifact, data, 0644)).To(Succeed())
+		Expect(os.WriteFile(device, make([]byte, 4<<20), 0644)).To(Succeed())
+	})
+
+	It("writes the artifact and reads it back", func() {
+		var written int64
+		checksum, err := Write(artifact, device, func(done, total int64) { written = done })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(Equal(int64(3 << 20)))
+		Expect(Verify(device, 3<<20, checksum, nil)).To(Succeed())
+	})
+
+	It("fails if the device doesn't hold what was written", func() {
+		checksum, err := Write(artifact, device, nil)
+		Expect(err).ToNot(HaveOccurred())
+		f, err := os.OpenFile(device, os.O_WRONLY, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteAt([]byte("corrupted"), 1<<20)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		err = Verify(device, 3<<20, checksum, nil)
+		Expect(err).To(MatchError(failure.ErrVerification))
+		Expect(err.Error()).To(ContainSubstring("doesn't read back what was written"))
+	})
+
+	It("checks the artifact against its checksum files", func() {
+		checked, err := CheckArtifact(artifact)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(checked).To(BeEmpty())
+
+		checksum, err := Write(artifact, device, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(artifact+".sha256", []byte(checksum+" kairos.iso\n"), 0644)).To(Succeed())
+		checked, err = CheckArtifact(artifact)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(checked).To(Equal([]string{"sha256"}))
+
+		Expect(os.WriteFile(artifact+".sha256", []byte("0123 kairos.iso\n"), 0644)).To(Succeed())
+		_, err = CheckArtifact(artifact)
+		Expect(err).To(MatchError(failure.ErrVerification))
+	})
+
+	It("refuses anything but block devices", func() {
+		_, err := OpenDevice(device)
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		Expect(err.Error()).To(ContainSubstring("is not a block device"))
+	})
+
+	Describe("checkUnused", func() {
+		var dev *Device
+		BeforeEach(func() {
+			origProc, origSys := procDir, sysDir
+			procDir, sysDir = filepath.Join(dir, "proc"), filepath.Join(dir, "sys")
+			DeferCleanup(func() { procDir, sysDir = origProc, origSys })
+			Expect(os.MkdirAll(filepath.Join(procDir, "self"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(sysDir, "class", "block", "sdz", "sdz1"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(sysDir, "class", "block", "sdz", "sdz1", "partition"), []byte("1\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(procDir, "self", "mounts"), []byte("/dev/sda2 / ext4 rw 0 0\nproc /proc proc rw 0 0\n"), 0644)).To(Succeed())
+			dev = &Device{Path: "/dev/sdz"}
+		})
+		mount := func(line string) {
+			Expect(os.WriteFile(filepath.Join(procDir, "self", "mounts"), []byte("/dev/sda2 / ext4 rw 0 0\n"+line+"\n"), 0644)).To(Succeed())
+		}
+
+		It("accepts unused disks", func() {
+			Expect(dev.checkUnused()).To(Succeed())
+		})
+		It("refuses disks with mounted partitions", func() {
+			mount("/dev/sdz1 /run/media/usb vfat rw 0 0")
+			Expect(dev.checkUnused()).To(MatchError(ContainSubstring("/dev/sdz1 is mounted at /run/media/usb")))
+		})
+		It("refuses the disk of the running system", func() {
+			mount("/dev/sdz1 / ext4 rw 0 0")
+			Expect(dev.checkUnused()).To(MatchError(ContainSubstring("holds the root filesystem of the running system")))
+		})
+		It("refuses disks used as swap", func() {
+			Expect(os.WriteFile(filepath.Join(procDir, "swaps"), []byte("Filename Type Size Used Priority\n/dev/sdz1 partition 1024 0 -2\n"), 0644)).To(Succeed())
+			Expect(dev.checkUnused()).To(MatchError(ContainSubstring("/dev/sdz1 is used as swap")))
+		})
+		It("refuses disks held by device mapper targets", func() {
+			Expect(os.MkdirAll(filepath.Join(sysDir, "class", "block", "sdz", "sdz1", "holders", "dm-0"), 0755)).To(Succeed())
+			Expect(dev.checkUnused()).To(MatchError(ContainSubstring("/dev/sdz1 is used by the device mapper target dm-0")))
+		})
+	})
+})
@@ -1,16 +1,32 @@
 package config
 
 import (
+	"errors"
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 
 	"github.com/kairos-io/enki/internal/version"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/image"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/layerstore"
+	"github.com/kairos-io/enki/pkg/limits"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/manifest"
+	"github.com/kairos-io/enki/pkg/microcode"
+	"github.com/kairos-io/enki/pkg/mirror"
+	"github.com/kairos-io/enki/pkg/naming"
+	"github.com/kairos-io/enki/pkg/registry"
+	"github.com/kairos-io/enki/pkg/remote"
+	"github.com/kairos-io/enki/pkg/transcript"
 	"github.com/kairos-io/enki/pkg/types"
 	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/workdir"
 	"github.com/kairos-io/kairos-agent/v2/pkg/cloudinit"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/http"
@@ -98,63 +114,183 @@ func ReadConfigBuild(configDir string, flags *pflag.FlagSet) (*types.BuildConfig
 	// TODO: Why didn't we set an ImageExtractor?
 	// How is build-iso used? What does it set it to and where? (the viper config below?)
 	cfg := NewBuildConfig(
-		WithImageExtractor(v1.OCIImageExtractor{}),
+		WithImageExtractor(mirror.Extractor{Next: registry.Extractor{Next: image.EstargzExtractor{Next: layerstore.Extractor{Next: v1.OCIImageExtractor{}}}, Logger: logger}, Logger: logger}),
 		WithLogger(logger),
 	)
 
-	configLogger(cfg.Logger, cfg.Fs)
-
-	viper.AddConfigPath(configDir)
-	viper.SetConfigType("yaml")
-	viper.SetConfigName("manifest.yaml")
-	// If a config file is found, read it in.
-	_ = viper.MergeInConfig()
+	// If a manifest is found, read it in along with the ones it extends
+	settings, err := manifest.Load(filepath.Join(configDir, manifest.FileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, failure.New(failure.ErrInvalidConfig, err, "check the manifest and the ones it extends")
+	}
+	if settings != nil {
+		_ = viper.MergeConfigMap(settings)
+	}
+	bindEnv(viper.GetViper(), "", cfg)
 
 	// Bind buildconfig flags
 	bindGivenFlags(viper.GetViper(), flags)
 
+	// Once the flags are bound, as the logs go to stderr if the artifact is streamed to stdout
+	configLogger(cfg.Logger, cfg.Fs)
+	cfg.Logger.Infof("Starting enki version %s", version.GetVersion())
+	if cfg.Logger.GetLevel() == logrus.DebugLevel {
+		cfg.Logger.Debugf("%+v\n", version.Get())
+	}
+
+	buildLimits, err := ReadLimits()
+	if err != nil {
+		return cfg, failure.New(failure.ErrInvalidConfig, err, "check the resource limits of the build")
+	}
+	buildLimits.SetMemoryLimit()
+	if path := viper.GetString("transcript"); path != "" {
+		if cfg.Transcript, err = transcript.New(path); err != nil {
+			return cfg, failure.New(failure.ErrInvalidConfig, err, "check the transcript file can be written")
+		}
+	}
+	targets, err := ReadRemote()
+	if err != nil {
+		return cfg, failure.New(failure.ErrInvalidConfig, err, "check the remote targets of the build")
+	}
+	// The commands are recorded as run, wrapped by nice and ionice or by the remote targets. The
+	// remote ones are not niced locally.
+	cfg.Runner = remote.Wrap(limits.Wrap(transcript.Wrap(cfg.Runner, cfg.Transcript), buildLimits), targets)
+	cfg.Limits = buildLimits
+
+	workdirs, err := ReadWorkdir()
+	if err != nil {
+		return cfg, failure.New(failure.ErrInvalidConfig, err, "check the workdir-backend of the build")
+	}
+	res, err := workdir.Detect()
+	if err != nil {
+		cfg.Logger.Debugf("Could not detect the available memory, auto work areas go on disk: %s", err)
+	}
+	cfg.Workdirs = workdirs.Place(res)
+	for _, stage := range workdir.Stages() {
+		if dir := cfg.Workdirs[stage]; dir != "" {
+			cfg.Logger.Infof("Using %s for the %s work area", dir, stage)
+		}
+	}
+
+	// The cmdlines and boot titles of build-uki, and the artifact names, are expanded once the
+	// source values are known
+	arch := viper.GetString("arch")
+	if arch == "" {
+		arch = cfg.Arch
+	}
+	vars, err := templateVars(arch)
+	if err == nil {
+		err = expandTemplates(viper.GetViper(), vars, append(constants.GetSourceTemplateKeys(), naming.TemplateKey)...)
+	}
+	if err != nil {
+		return cfg, err
+	}
+
 	// unmarshal all the vars into the config object
-	err := viper.Unmarshal(cfg, setDecoder, decodeHook)
+	err = viper.Unmarshal(cfg, setDecoder, decodeHook)
 	if err != nil {
 		cfg.Logger.Warnf("error unmarshalling config: %s", err)
 	}
 
 	err = cfg.Sanitize()
-	cfg.Logger.Debugf("Full config loaded: %s", litter.Sdump(cfg))
+	logging.Module(cfg.Logger, logging.Config).Debugf("Full config loaded: %s", litter.Sdump(cfg))
 	return cfg, err
 }
 
+// ReadLogger returns a logger set like the one of the builds, by the flags and the manifest in
+// configDir, for the commands logging around the builds they run
+func ReadLogger(configDir string, flags *pflag.FlagSet) v1.Logger {
+	if configDir == "" {
+		configDir = "."
+	}
+	if settings, _ := manifest.Load(filepath.Join(configDir, manifest.FileName)); settings != nil {
+		_ = viper.MergeConfigMap(settings)
+	}
+	bindGivenFlags(viper.GetViper(), flags)
+	logger := v1.NewLogger()
+	configLogger(logger, vfs.OSFS)
+	return logger
+}
+
+// ReadLimits returns the resource limits of the build, set with --nice, --ionice, --processors,
+// --memory-limit and --low-memory or in the config file
+func ReadLimits() (limits.Limits, error) {
+	l, err := limits.Parse(viper.GetInt("nice"), viper.GetString("ionice"), viper.GetInt("processors"), viper.GetString("memory-limit"))
+	if err == nil && viper.GetBool("low-memory") {
+		l = l.ForLowMemory()
+	}
+	return l, err
+}
+
+// ReadLogging returns which logs are written, set with --log-level, --debug and --debug-modules
+// or in the config file
+func ReadLogging() (logging.Options, error) {
+	return logging.Parse(viper.GetString("log-level"), viper.GetBool("debug"), viper.GetStringSlice("debug-modules"))
+}
+
+// ReadRemote returns where the steps run remotely, set with --remote or in the config file
+func ReadRemote() (remote.Targets, error) {
+	return remote.Parse(viper.GetStringSlice("remote"))
+}
+
+// ReadWorkdir returns where the work areas of the build live, set with --workdir-backend,
+// --tmpfs-dir and --disk-dir or in the config file
+func ReadWorkdir() (workdir.Config, error) {
+	return workdir.Parse(viper.GetStringSlice("workdir-backend"), viper.GetString("tmpfs-dir"), viper.GetString("disk-dir"))
+}
+
 func ReadBuildISO(b *types.BuildConfig, flags *pflag.FlagSet) (*types.LiveISO, error) {
 	iso := NewISO()
 	vp := viper.Sub("iso")
 	if vp == nil {
 		vp = viper.New()
 	}
+	bindEnv(vp, "iso", iso)
 	// Bind build-iso cmd flags
 	bindGivenFlags(vp, flags)
 
-	err := vp.Unmarshal(iso, setDecoder, decodeHook)
+	vars, err := templateVars(b.Arch)
+	if err == nil {
+		err = expandTemplates(vp, vars, naming.TemplateKey)
+	}
+	if err != nil {
+		return iso, err
+	}
+
+	err = vp.Unmarshal(iso, setDecoder, decodeHook)
 	if err != nil {
 		b.Logger.Warnf("error unmarshalling LiveISO: %s", err)
 	}
 	err = iso.Sanitize()
-	b.Logger.Debugf("Loaded LiveISO: %s", litter.Sdump(iso))
-	return iso, err
+	logging.Module(b.Logger, logging.Config).Debugf("Loaded LiveISO: %s", litter.Sdump(iso))
+	if err != nil {
+		return iso, failure.New(failure.ErrInvalidConfig, err, "check the build-iso flags and the iso section of the config file")
+	}
+	return iso, nil
 }
 
 func NewISO() *types.LiveISO {
 	return &types.LiveISO{
-		Label:     constants.ISOLabel,
-		GrubEntry: constants.GrubDefEntry,
-		UEFI:      []*v1.ImageSource{},
-		Image:     []*v1.ImageSource{},
+		Label:          constants.ISOLabel,
+		GrubEntry:      constants.GrubDefEntry,
+		ISOEngine:      iso.EngineXorriso,
+		RockRidge:      true,
+		Joliet:         true,
+		Checksums:      []string{utils.ChecksumSHA256},
+		ChecksumFormat: utils.ChecksumFormatHex,
+		EspHeadroom:    10,
+		EspAlign:       "4MiB",
+		EspFat:         utils.FatAuto,
+		EspLabel:       constants.EfiLabel,
+		Microcode:      microcode.Auto,
+		UEFI:           []*v1.ImageSource{},
+		Image:          []*v1.ImageSource{},
 	}
 }
 
 func NewBuildConfig(opts ...GenericOptions) *types.BuildConfig {
 	b := &types.BuildConfig{
 		Config: *NewConfig(opts...),
-		Name:   constants.BuildImgName,
 	}
 	return b
 }
@@ -206,13 +342,11 @@ func NewConfig(opts ...GenericOptions) *config.Config {
 }
 
 func configLogger(log v1.Logger, vfs v1.FS) {
-	// Set debug level
-	if viper.GetBool("debug") {
-		log.SetLevel(v1.DebugLevel())
-	}
+	// Set the level and the debugged modules, they were checked by the root command
+	opts, _ := ReadLogging()
 
 	// Set formatter so both file and stdout format are equal
-	log.SetFormatter(&logrus.TextFormatter{
+	opts.Apply(log, &logrus.TextFormatter{
 		ForceColors:      true,
 		DisableColors:    false,
 		DisableTimestamp: false,
@@ -220,7 +354,10 @@ func configLogger(log v1.Logger, vfs v1.FS) {
 	})
 
 	// Logfile
-	logfile := viper.GetString("logfile")
+	logfile := viper.GetString("log-file")
+	if logfile == "" {
+		logfile = viper.GetString("logfile")
+	}
 	if logfile != "" {
 		o, err := vfs.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, fs.ModePerm)
 
@@ -229,20 +366,25 @@ func configLogger(log v1.Logger, vfs v1.FS) {
 		}
 
 		// else set it to both stdout and the file
-		mw := io.MultiWriter(os.Stdout, o)
+		mw := io.MultiWriter(logOutput(), o)
 		log.SetOutput(mw)
 	} else { // no logfile
 		if viper.GetBool("quiet") { // quiet is enabled so discard all logging
 			log.SetOutput(io.Discard)
 		} else { // default to stdout
-			log.SetOutput(os.Stdout)
+			log.SetOutput(logOutput())
 		}
 	}
+}
 
-	log.Infof("Starting enki version %s", version.GetVersion())
-	if log.GetLevel() == logrus.DebugLevel {
-		log.Debugf("%+v\n", version.Get())
+// logOutput returns stdout, or stderr if the artifact is streamed to stdout
+func logOutput() io.Writer {
+	for _, key := range []string{"output", "output-dir"} {
+		if viper.GetString(key) == utils.Stdout {
+			return os.Stderr
+		}
 	}
+	return os.Stdout
 }
 
 // BindGivenFlags binds to viper only passed flags, ignoring any non provided flag
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix prefixes the environment variables configuring enki.
+//
+// Every setting can be given, from lowest to highest precedence, in the manifest.yaml of the
+// config dir, as environment variable or as command line flag. Flags are set from the variable
+// named after them, ENKI_MAX_SIZE sets --max-size, and manifest keys from the variable named
+// after their path, ENKI_ISO_LABEL sets the label of the iso section.
+const EnvPrefix = "ENKI"
+
+var envReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// EnvName returns the environment variable setting the given flag or manifest key
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(envReplacer.Replace(key))
+}
+
+// bindEnv binds the keys of v, a struct decoded with mapstructure, to their environment
+// variables. section is the path of vp within the manifest, empty for the root of it.
+func bindEnv(vp *viper.Viper, section string, v any) {
+	if section != "" {
+		section += "."
+	}
+	bindEnvFields(vp, "", section, reflect.TypeOf(v))
+}
+
+// bindEnvFields binds the fields of t under the key prefix of vp, whose variables are named
+// after section plus the key
+func bindEnvFields(vp *viper.Viper, prefix, section string, t reflect.Type) {
+	t = indirect(t)
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if opts == "squash" {
+			bindEnvFields(vp, prefix, section, field.Type)
+			continue
+		}
+		// Only tagged fields are settings, the rest are runtime objects like the logger
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		key := prefix + name
+		if hasSettings(field.Type) {
+			bindEnvFields(vp, key+".", section, field.Type)
+			continue
+		}
+		_ = vp.BindEnv(key, EnvName(section+key))
+	}
+}
+
+// hasSettings returns true for structs with their own mapstructure keys, as opposed to values
+// like image sources that are decoded from a single value
+func hasSettings(t reflect.Type) bool {
+	t = indirect(t)
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := t.Field(i).Tag.Lookup("mapstructure"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
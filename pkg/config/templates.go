@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/templating"
+	"github.com/spf13/viper"
+)
+
+// templateHint is the hint of the errors expanding the templates of the config
+const templateHint = "check the templates of the config, missing values can be given with --set key=value"
+
+// templateVars returns the values the config templates are expanded with, the --set ones on top
+// of the arch. The source image isn't extracted yet, so its values aren't available.
+func templateVars(arch string) (templating.Vars, error) {
+	set, err := templating.ParseSet(viper.GetStringSlice("set"))
+	if err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, err, "give the --set values as key=value")
+	}
+	return templating.Vars{"arch": arch}.Merge(set), nil
+}
+
+// expandTemplates expands the templates of the top level string settings of vp, except the
+// skipped ones
+func expandTemplates(vp *viper.Viper, vars templating.Vars, skip ...string) error {
+	for _, key := range vp.AllKeys() {
+		// Setting nested keys would hide their siblings from viper.Sub
+		if strings.Contains(key, ".") || slices.Contains(skip, key) {
+			continue
+		}
+		value := vp.Get(key)
+		expanded, err := templating.ExpandValue(value, vars)
+		if err != nil {
+			return failure.New(failure.ErrInvalidConfig, fmt.Errorf("%s: %w", key, err), templateHint)
+		}
+		if !reflect.DeepEqual(value, expanded) {
+			vp.Set(key, expanded)
+		}
+	}
+	return nil
+}
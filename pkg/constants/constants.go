@@ -11,9 +11,44 @@ type UkiOutput string
 const IsoOutput UkiOutput = "iso"
 const ContainerOutput UkiOutput = "container"
 const DefaultOutput UkiOutput = "uki"
+const EspDirOutput UkiOutput = "esp-dir"
+
+// EspOverlayOutput writes the ESP files to copy into an existing ESP, like the one of a Windows
+// install, without taking over its fallback path
+const EspOverlayOutput UkiOutput = "esp-overlay"
+
+// EspDir is the dir of the output dir the esp-dir output is written to
+const EspDir = "esp"
+
+// UkiIsoEfiImage is the FAT image holding the ESP files at the root of the UKI ISOs
+const UkiIsoEfiImage = "efiboot.img"
+
+// UkiIsoLabel is the volume label of the UKI ISOs
+const UkiIsoLabel = "UKI_ISO_INSTALL"
+
+// XbootldrDir is the dir of the output dir the esp-dir output writes the XBOOTLDR partition
+// tree to, when split from the ESP
+const XbootldrDir = "xbootldr"
+
+// DbxFile is the dbx update systemd-boot enrolls along with the keys of loader/keys/auto
+const DbxFile = "dbx.auth"
+
+// SbatLevelFile is the SBAT revocation policy shipped in the loader dir of the ESP
+const SbatLevelFile = "sbat-level.csv"
+
+// EnrollmentImgOutput is the FAT image of the key enrollment media, to write to USB drives
+const EnrollmentImgOutput = "img"
+
+// EnrollmentIsoLabel is the volume label of the key enrollment ISOs
+const EnrollmentIsoLabel = "ENKI_KEYS"
+
+// EnrollmentOutputTypes returns the artifacts build-enrollment-media can create
+func EnrollmentOutputTypes() []string {
+	return []string{string(IsoOutput), EnrollmentImgOutput}
+}
 
 func OutPutTypes() []string {
-	return []string{string(IsoOutput), string(ContainerOutput), string(DefaultOutput)}
+	return []string{string(IsoOutput), string(ContainerOutput), string(DefaultOutput), string(EspDirOutput), string(EspOverlayOutput)}
 }
 
 const (
@@ -24,7 +59,6 @@ const (
 	EfiFs          = "vfat"
 	IsoRootFile    = "rootfs.squashfs"
 	IsoEFIPath     = "/boot/uefi.img"
-	BuildImgName   = "elemental"
 	EfiBootPath    = "/EFI/BOOT"
 	ShimEfiDest    = EfiBootPath + "/bootx64.efi"
 	ShimEfiArmDest = EfiBootPath + "/bootaa64.efi"
@@ -33,11 +67,25 @@ const (
 	GrubEfiCfg     = "search --no-floppy --file --set=root " + IsoKernelPath +
 		"\nset prefix=($root)" + GrubPrefixDir +
 		"\nconfigfile $prefix/" + GrubCfg
+	// GrubStandaloneCfg is embedded in the memdisk of the standalone grub. The prefix stays in the
+	// memdisk, so the modules are loaded from there instead of from the ISO.
+	GrubStandaloneCfg = "search --no-floppy --file --set=root " + IsoKernelPath +
+		"\nconfigfile ($root)" + GrubPrefixDir + "/" + GrubCfg
 
 	IsoHybridMBR   = "/boot/x86_64/loader/boot_hybrid.img"
 	IsoBootCatalog = "/boot/x86_64/boot.catalog"
 	IsoBootFile    = "/boot/x86_64/loader/eltorito.img"
 
+	// The isolinux files of the legacy only ISOs, from the syslinux of the build host
+	IsolinuxDir         = "/isolinux"
+	IsolinuxBootFile    = IsolinuxDir + "/isolinux.bin"
+	IsolinuxBootCatalog = IsolinuxDir + "/boot.cat"
+	IsolinuxMBR         = IsolinuxDir + "/isohdpfx.bin"
+	IsolinuxCfg         = "isolinux.cfg"
+	// IsolinuxCmdline boots the live system of the ISO labeled with the given label, when the ISO
+	// has no grub.cfg to take the cmdlines from
+	IsolinuxCmdline = "cdroot root=live:CDLABEL=%s rd.live.dir=/ rd.live.squashimg=" + IsoRootFile + " console=tty1 console=ttyS0 rd.cos.disable install-mode"
+
 	// These paths are arbitrary but coupled to grub.cfg
 	IsoKernelPath = "/boot/kernel"
 	IsoInitrdPath = "/boot/initrd"
@@ -63,14 +111,96 @@ const (
 	EfiFallbackNamex86 = "BOOTX64.EFI"
 	EfiFallbackNameArm = "BOOTAA64.EFI"
 
+	// SecureBootCustomKeys enrolls the keys of the keys dir with systemd-boot, replacing the
+	// ones of the firmware
+	SecureBootCustomKeys = "custom-keys"
+	// SecureBootShimMok boots systemd-boot through the Microsoft signed shim, which trusts the
+	// db key of the keys dir once it is enrolled as MOK
+	SecureBootShimMok = "shim-mok"
+	// ShimLoaderNamex86 and ShimLoaderNameArm are the second stage shim boots, systemd-boot
+	// takes the place of grub
+	ShimLoaderNamex86 = "grubx64.efi"
+	ShimLoaderNameArm = "grubaa64.efi"
+	// MokManagerNamex86 and MokManagerNameArm are the names shim looks for MokManager with
+	MokManagerNamex86 = "mmx64.efi"
+	MokManagerNameArm = "mmaa64.efi"
+	// MokCertFile is the db certificate to enroll as MOK from MokManager, next to shim
+	MokCertFile = "ENROLL_THIS_KEY_IN_MOKMANAGER.cer"
+
+	// BootEntryUKI boots every entry from a UKI, a single signed EFI binary (BLS Type #2)
+	BootEntryUKI = "uki"
+	// BootEntryBLS boots every entry from a kernel and initrd shared by all of them, with the
+	// cmdline in the loader entry (BLS Type #1)
+	BootEntryBLS = "bls"
+
 	ArtifactBaseName = "norole"
+	// ActiveRole is the role every A/B layout has, the one booted by default
+	ActiveRole = "active"
+	// RecoveryRole is the role of the artifacts booting the recovery system
+	RecoveryRole = "recovery"
+	// UkiCmdlineRecovery makes immucore boot the recovery system
+	UkiCmdlineRecovery = "recovery-mode"
+	// UkiCmdlineAutoInstall makes kairos-agent install the system unattended on boot
+	UkiCmdlineAutoInstall = "install.auto=true"
+
+	// MediaLive boots an interactive live session the system can be installed from
+	MediaLive = "live"
+	// MediaInstaller installs the system unattended on boot
+	MediaInstaller = "installer"
+	// MediaRecovery boots the recovery system
+	MediaRecovery = "recovery"
+
+	// EfiToolsDir is where optional EFI payloads, like a UEFI shell, are stored in the ESP
+	EfiToolsDir = "EFI/tools"
+	// GrubEfiToolEntry is the grub menu entry chainloading an EFI payload, only possible on EFI
+	GrubEfiToolEntry = "\nif [ \"${grub_platform}\" = \"efi\" ]; then\n  menuentry \"%s\" --class efi {\n    chainloader /%s/%s\n  }\nfi\n"
 )
 
+// GetArtifactRoles returns the roles kairos-agent installs the norole artifacts as. The boot
+// state is detected from the name of the selected loader entry, so these are the entry prefixes.
+func GetArtifactRoles() []string {
+	return []string{ActiveRole, "passive", RecoveryRole}
+}
+
+// GetMediaTypes returns the media types build-uki can create, each with its own default cmdline
+func GetMediaTypes() []string {
+	return []string{MediaInstaller, MediaLive, MediaRecovery}
+}
+
+// GetSecureBootModes returns the ways the artifacts of build-uki can boot with Secure Boot
+func GetSecureBootModes() []string {
+	return []string{SecureBootCustomKeys, SecureBootShimMok}
+}
+
+// GetBootEntryTypes returns the kinds of boot entries build-uki can generate, per the Boot
+// Loader Specification
+func GetBootEntryTypes() []string {
+	return []string{BootEntryUKI, BootEntryBLS}
+}
+
+// GetSourceTemplateKeys returns the build-uki settings expanded once the source image is
+// extracted, as their templates can use its release values like {{.flavor}}
+func GetSourceTemplateKeys() []string {
+	return []string{"boot-branding", "default-entry", "extend-cmdline", "extra-cmdline", "single-efi-cmdline", "recovery-cmdline"}
+}
+
+// GetDirSourceExcludes returns the paths skipped when copying directory sources, the same ones
+// the elemental installer skips
+func GetDirSourceExcludes() []string {
+	return []string{"/mnt", "/proc", "/sys", "/dev", "/tmp", "/host", "/run"}
+}
+
 // GetDefaultSquashfsOptions returns the default options to use when creating a squashfs
 func GetDefaultSquashfsOptions() []string {
 	return []string{"-b", "1024k"}
 }
 
+// GetHTTPBootSquashfsOptions returns the options to create a squashfs meant to be read over
+// HTTP range requests. Smaller zstd blocks keep every read close to the data actually needed.
+func GetHTTPBootSquashfsOptions() []string {
+	return []string{"-comp", "zstd", "-b", "128k", "-Xcompression-level", "19"}
+}
+
 func GetXorrisoBooloaderArgs(root string) []string {
 	args := []string{
 		"-boot_image", "grub", fmt.Sprintf("bin_path=%s", IsoBootFile),
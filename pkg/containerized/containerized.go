@@ -0,0 +1,161 @@
+// Package containerized runs enki commands again inside a disposable builder container, which
+// ships every external tool the builds need, so machines with only docker or podman can build.
+// Only the output dirs of the build are writable from the container, the inputs it reads are
+// mounted read-only at the same paths.
+package containerized
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/enki/internal/version"
+)
+
+const (
+	// ImageRepo is the repository of the builder images, tagged like the enki releases
+	ImageRepo = "quay.io/kairos/enki-tools"
+	// insideEnv is set in the builder container, so enki doesn't run itself again there
+	insideEnv = "_ENKI_CONTAINERIZED"
+	// credentialsMount is where the registry credentials of the host are mounted
+	credentialsMount = "/root/.docker/config.json"
+)
+
+// DefaultImage returns the builder image of the running enki version, so the build runs with
+// the same enki and the tools it was released with
+func DefaultImage() string {
+	return ImageRepo + ":" + version.GetVersion()
+}
+
+// Engines returns the container engines builds can run with, by preference
+func Engines() []string {
+	return []string{"docker", "podman"}
+}
+
+// Engine returns the first container engine in the PATH
+func Engine() (string, error) {
+	var err error
+	for _, engine := range Engines() {
+		if _, err = exec.LookPath(engine); err == nil {
+			return engine, nil
+		}
+	}
+	return "", err
+}
+
+// Inside tells if enki runs in the builder container
+func Inside() bool {
+	return os.Getenv(insideEnv) != ""
+}
+
+// Spec is an enki command to run in the builder container
+type Spec struct {
+	Image string
+	// Args are the arguments of enki
+	Args []string
+	// Workdir is the working dir of the command, relative paths resolve as on the host as the
+	// inputs and outputs are mounted at the same paths
+	Workdir string
+	// Outputs are the host dirs mounted read-write
+	Outputs []string
+	// Inputs are the host files and dirs mounted read-only, the ones within outputs are left out
+	Inputs []string
+	// Env are the NAME=value variables set in the container, or the NAME of the ones passed on
+	// from the environment, which don't show in the command line of the container engine then
+	Env []string
+	// Credentials is the docker config file holding the registry credentials of the host, if any
+	Credentials string
+}
+
+// EngineArgs returns the arguments of docker or podman running the spec
+func (s Spec) EngineArgs() []string {
+	args := []string{"run", "--rm", "-i", "-e", insideEnv + "=1"}
+	for _, env := range s.Env {
+		args = append(args, "-e", env)
+	}
+	if s.Workdir != "" {
+		args = append(args, "-w", s.Workdir)
+	}
+	for _, dir := range s.Outputs {
+		args = append(args, "-v", dir+":"+dir)
+	}
+	for _, path := range mountedInputs(s.Inputs, s.Outputs) {
+		args = append(args, "-v", path+":"+path+":ro")
+	}
+	if s.Credentials != "" {
+		args = append(args, "-v", s.Credentials+":"+credentialsMount+":ro")
+	}
+	return append(append(args, s.Image), s.Args...)
+}
+
+// mountedInputs returns the inputs not within the outputs or other inputs, sorted
+func mountedInputs(inputs, outputs []string) []string {
+	sorted := append([]string{}, inputs...)
+	sort.Strings(sorted)
+	var mounted []string
+	for _, path := range sorted {
+		if within(path, outputs) || within(path, mounted) {
+			continue
+		}
+		mounted = append(mounted, path)
+	}
+	return mounted
+}
+
+// within tells if path is any of the dirs or below them
+func within(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Credentials returns the docker config file of the host, empty if there is none
+func Credentials() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	path := filepath.Join(dir, "config.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// StripArgs returns args without the given flags and their values, given either as
+// --flag value, --flag=value or as a bare boolean --flag
+func StripArgs(args []string, boolFlags, valueFlags []string) []string {
+	var stripped []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(stripped, args[i:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if !strings.HasPrefix(arg, "--") {
+			stripped = append(stripped, arg)
+			continue
+		}
+		if slices.Contains(boolFlags, name) {
+			continue
+		}
+		if slices.Contains(valueFlags, name) {
+			if !hasValue {
+				i++
+			}
+			continue
+		}
+		stripped = append(stripped, arg)
+	}
+	return stripped
+}
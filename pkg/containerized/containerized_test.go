@@ -0,0 +1,40 @@
+package containerized_test
+
+import (
+	"github.com/kairos-io/enki/pkg/containerized"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Containerized", Label("containerized"), func() {
+	It("mounts only the outputs writable", func() {
+		spec := containerized.Spec{
+			Image:       "quay.io/kairos/enki-tools:v1.0.0",
+			Args:        []string{"build-uki", "dir:/src/rootfs", "--keys", "/src/keys", "-d", "/out"},
+			Workdir:     "/src",
+			Outputs:     []string{"/out"},
+			Inputs:      []string{"/src/rootfs", "/src/keys/db.key", "/src/keys", "/out/previous.iso"},
+			Env:         []string{"ENKI_MAX_SIZE=1GiB"},
+			Credentials: "/home/user/.docker/config.json",
+		}
+		Expect(spec.EngineArgs()).To(Equal([]string{
+			"run", "--rm", "-i", "-e", "_ENKI_CONTAINERIZED=1", "-e", "ENKI_MAX_SIZE=1GiB", "-w", "/src",
+			"-v", "/out:/out",
+			"-v", "/src/keys:/src/keys:ro",
+			"-v", "/src/rootfs:/src/rootfs:ro",
+			"-v", "/home/user/.docker/config.json:/root/.docker/config.json:ro",
+			"quay.io/kairos/enki-tools:v1.0.0", "build-uki", "dir:/src/rootfs", "--keys", "/src/keys", "-d", "/out",
+		}))
+	})
+
+	It("strips the flags of the host enki", func() {
+		Expect(containerized.StripArgs(
+			[]string{"build-iso", "--containerized", "--builder-image", "builder:v1", "image:latest", "--builder-image=builder:v2", "--name", "kairos", "--", "--containerized"},
+			[]string{"containerized"}, []string{"builder-image"},
+		)).To(Equal([]string{"build-iso", "image:latest", "--name", "kairos", "--", "--containerized"}))
+	})
+
+	It("defaults to the builder image of the running version", func() {
+		Expect(containerized.DefaultImage()).To(HavePrefix(containerized.ImageRepo + ":"))
+	})
+})
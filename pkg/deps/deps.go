@@ -0,0 +1,201 @@
+// Package deps describes the external tools enki runs, the packages providing them on each
+// distro and the static builds of the ones distros don't package, so missing tools can be
+// reported with how to install them, or installed with enki deps install.
+package deps
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// Package managers of the supported distros
+const (
+	Apt    = "apt"
+	Dnf    = "dnf"
+	Zypper = "zypper"
+	Pacman = "pacman"
+	Apk    = "apk"
+)
+
+// Dependency is an external tool enki runs
+type Dependency struct {
+	// Name is the name of the tool for enki deps install
+	Name string
+	// Binary is the executable looked up in the PATH, or its absolute path
+	Binary string
+	// Install tells how to install it by hand
+	Install string
+	// Packages are the package providing it for each package manager
+	Packages map[string]string
+	// Static is the static build installed into the toolcache where no package provides it
+	Static *Static
+	// Required is set for the tools every build needs, the others are only needed by some options
+	Required bool
+}
+
+// all are the dependencies, the required ones first
+var all = []Dependency{
+	{Name: "ukify", Binary: "/usr/lib/systemd/ukify", Install: "systemd-ukify, systemd 253 or newer is required", Required: true,
+		Packages: map[string]string{Apt: "systemd-ukify", Dnf: "systemd-ukify", Zypper: "systemd-experimental", Pacman: "systemd-ukify"}},
+	{Name: "sbsign", Binary: "sbsign", Install: "sbsigntools", Required: true,
+		Packages: map[string]string{Apt: "sbsigntool", Dnf: "sbsigntools", Zypper: "sbsigntools", Pacman: "sbsigntools"}},
+	{Name: "sbattach", Binary: "sbattach", Install: "sbsigntools", Required: true,
+		Packages: map[string]string{Apt: "sbsigntool", Dnf: "sbsigntools", Zypper: "sbsigntools", Pacman: "sbsigntools"}},
+	{Name: "objcopy", Binary: "objcopy", Install: "binutils", Required: true,
+		Packages: everywhere("binutils")},
+	{Name: "dd", Binary: "dd", Install: "coreutils", Required: true,
+		Packages: everywhere("coreutils")},
+	{Name: "mkfs.msdos", Binary: "mkfs.msdos", Install: "dosfstools", Required: true,
+		Packages: everywhere("dosfstools")},
+	{Name: "mmd", Binary: "mmd", Install: "mtools", Required: true,
+		Packages: everywhere("mtools")},
+	{Name: "mcopy", Binary: "mcopy", Install: "mtools", Required: true,
+		Packages: everywhere("mtools")},
+	{Name: "xorriso", Binary: "xorriso", Install: "xorriso, or use --iso-engine native", Required: true,
+		Packages: everywhere("xorriso")},
+	{Name: "mksquashfs", Binary: "mksquashfs", Install: "squashfs-tools", Required: true,
+		Packages: everywhere("squashfs-tools")},
+	{Name: "openssl", Binary: "openssl", Install: "openssl", Required: true,
+		Packages: everywhere("openssl")},
+	{Name: "clamscan", Binary: "clamscan", Install: "clamav and fetch its signatures with freshclam",
+		Packages: map[string]string{Apt: "clamav", Dnf: "clamav", Zypper: "clamav", Pacman: "clamav", Apk: "clamav"}},
+	{Name: "osslsigncode", Binary: "osslsigncode", Install: "osslsigncode 2.0 or newer",
+		Packages: map[string]string{Apt: "osslsigncode", Dnf: "osslsigncode", Zypper: "osslsigncode", Apk: "osslsigncode"}},
+	{Name: "unsquashfs", Binary: "unsquashfs", Install: "squashfs-tools",
+		Packages: everywhere("squashfs-tools")},
+	{Name: "grub-mkstandalone", Binary: "grub-mkstandalone", Install: "grub with the EFI modules of the target arch",
+		Packages: map[string]string{Apt: "grub-efi-amd64-bin", Pacman: "grub", Apk: "grub-efi"}},
+	{Name: "grub2-mkstandalone", Binary: "grub2-mkstandalone", Install: "grub2 with the EFI modules of the target arch",
+		Packages: map[string]string{Dnf: "grub2-tools-extra", Zypper: "grub2-x86_64-efi"}},
+	{Name: "grype", Binary: "grype", Install: "grype from https://github.com/anchore/grype", Static: grype},
+	{Name: "trivy", Binary: "trivy", Install: "trivy from https://github.com/aquasecurity/trivy", Static: trivy},
+	{Name: "cosign", Binary: "cosign", Install: "cosign from https://github.com/sigstore/cosign", Static: cosign},
+	{Name: "notation", Binary: "notation", Install: "notation from https://github.com/notaryproject/notation", Static: notation},
+	{Name: "aws", Binary: "aws", Install: "the AWS CLI"},
+	{Name: "gcloud", Binary: "gcloud", Install: "the Google Cloud CLI"},
+	{Name: "az", Binary: "az", Install: "the Azure CLI"},
+	{Name: "docker-credential-ecr-login", Binary: "docker-credential-ecr-login", Install: "the Amazon ECR credential helper",
+		Packages: map[string]string{Apt: "amazon-ecr-credential-helper", Dnf: "amazon-ecr-credential-helper", Apk: "docker-credential-ecr-login"}},
+	{Name: "docker-credential-gcr", Binary: "docker-credential-gcr", Install: "docker-credential-gcr from https://github.com/GoogleCloudPlatform/docker-credential-gcr"},
+	{Name: "docker-credential-acr-env", Binary: "docker-credential-acr-env", Install: "docker-credential-acr-env from https://github.com/chrismellard/docker-credential-acr-env"},
+}
+
+// everywhere returns pkg as the package of every package manager
+func everywhere(pkg string) map[string]string {
+	return map[string]string{Apt: pkg, Dnf: pkg, Zypper: pkg, Pacman: pkg, Apk: pkg}
+}
+
+// All returns the dependencies, the required ones first
+func All() []Dependency {
+	return slices.Clone(all)
+}
+
+// Lookup returns the dependency with the given name or binary
+func Lookup(name string) (Dependency, bool) {
+	for _, d := range all {
+		if d.Name == name || d.Binary == name {
+			return d, true
+		}
+	}
+	return Dependency{}, false
+}
+
+// Installable tells if enki deps install can install the dependency with the package manager
+func (d Dependency) Installable(manager string) bool {
+	return d.Packages[manager] != "" || d.Static.Pinned()
+}
+
+// Hint returns how to install the binary, the remediation of it missing
+func Hint(binary string) string {
+	d, ok := Lookup(binary)
+	if !ok {
+		return fmt.Sprintf("install %s and make sure it is in the PATH", binary)
+	}
+	if len(d.Packages) == 0 && !d.Static.Pinned() {
+		return fmt.Sprintf("install %s", d.Install)
+	}
+	return fmt.Sprintf("install %s, or run enki deps install %s", d.Install, d.Name)
+}
+
+// Distro is the distro of the host, as told by its os-release
+type Distro struct {
+	ID string
+	// Like are the distros it derives from
+	Like []string
+	// Manager is the package manager of the distro, empty if it is not supported
+	Manager string
+}
+
+// managers are the package manager of each distro id
+var managers = map[string]string{
+	"debian":    Apt,
+	"ubuntu":    Apt,
+	"fedora":    Dnf,
+	"rhel":      Dnf,
+	"centos":    Dnf,
+	"rocky":     Dnf,
+	"almalinux": Dnf,
+	"opensuse":  Zypper,
+	"suse":      Zypper,
+	"sles":      Zypper,
+	"arch":      Pacman,
+	"alpine":    Apk,
+}
+
+// DetectDistro returns the distro of the host, out of /etc/os-release
+func DetectDistro(fs v1.FS) (Distro, error) {
+	data, err := fs.ReadFile("/etc/os-release")
+	if err != nil {
+		return Distro{}, err
+	}
+	var d Distro
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			d.ID = value
+		case "ID_LIKE":
+			d.Like = strings.Fields(value)
+		}
+	}
+	for _, id := range append([]string{d.ID}, d.Like...) {
+		// openSUSE ids are like opensuse-tumbleweed or opensuse-leap
+		id, _, _ = strings.Cut(id, "-")
+		if manager, ok := managers[id]; ok {
+			d.Manager = manager
+			break
+		}
+	}
+	return d, nil
+}
+
+// InstallCommands returns the commands installing the given packages with the package manager,
+// refreshing its package lists first where it needs it
+func InstallCommands(manager string, packages []string) [][]string {
+	if len(packages) == 0 {
+		return nil
+	}
+	switch manager {
+	case Apt:
+		return [][]string{{"apt-get", "update"}, append([]string{"apt-get", "install", "-y", "--no-install-recommends"}, packages...)}
+	case Dnf:
+		return [][]string{append([]string{"dnf", "install", "-y"}, packages...)}
+	case Zypper:
+		return [][]string{append([]string{"zypper", "--non-interactive", "install"}, packages...)}
+	case Pacman:
+		return [][]string{append([]string{"pacman", "-Sy", "--noconfirm", "--needed"}, packages...)}
+	case Apk:
+		return [][]string{append([]string{"apk", "add", "--no-cache"}, packages...)}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package deps_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDeps(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Deps test suite")
+}
@@ -0,0 +1,160 @@
+package deps_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/kairos-io/enki/pkg/deps"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+// tarball returns a .tar.gz archive with the given file in a subdir
+func tarball(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	Expect(tw.WriteHeader(&tar.Header{Name: "release/" + name, Mode: 0755, Size: int64(len(data)), Typeflag: tar.TypeReg})).To(Succeed())
+	_, err := tw.Write(data)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(tw.Close()).To(Succeed())
+	Expect(gz.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+var _ = Describe("Deps", Label("deps"), func() {
+	It("tells how to install the missing tools", func() {
+		Expect(deps.Hint("sbsign")).To(Equal("install sbsigntools, or run enki deps install sbsign"))
+		Expect(deps.Hint("/usr/lib/systemd/ukify")).To(ContainSubstring("enki deps install ukify"))
+		Expect(deps.Hint("aws")).To(Equal("install the AWS CLI"))
+		Expect(deps.Hint("frobnicate")).To(Equal("install frobnicate and make sure it is in the PATH"))
+	})
+
+	It("looks up the tools by name or binary", func() {
+		d, ok := deps.Lookup("/usr/lib/systemd/ukify")
+		Expect(ok).To(BeTrue())
+		Expect(d.Name).To(Equal("ukify"))
+		Expect(d.Required).To(BeTrue())
+		_, ok = deps.Lookup("frobnicate")
+		Expect(ok).To(BeFalse())
+
+		// Static builds are only installed for the arches with a pinned sha256
+		d = deps.Dependency{Name: "tool", Static: &deps.Static{SHA256: map[string]string{runtime.GOARCH: "00"}}}
+		Expect(d.Installable("")).To(BeTrue())
+		d.Static.SHA256 = map[string]string{"riscv": "00"}
+		Expect(d.Installable("")).To(BeFalse())
+		d, _ = deps.Lookup("gcloud")
+		Expect(d.Installable(deps.Apt)).To(BeFalse())
+	})
+
+	It("detects the package manager of the distro", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/etc/os-release": "NAME=\"openSUSE Tumbleweed\"\nID=\"opensuse-tumbleweed\"\nID_LIKE=\"opensuse suse\"\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		distro, err := deps.DetectDistro(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(distro).To(Equal(deps.Distro{ID: "opensuse-tumbleweed", Like: []string{"opensuse", "suse"}, Manager: deps.Zypper}))
+
+		// Derivatives are told by the distros they are like
+		Expect(fs.WriteFile("/etc/os-release", []byte("ID=pop\nID_LIKE=\"ubuntu debian\"\n"), 0644)).To(Succeed())
+		distro, err = deps.DetectDistro(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(distro.Manager).To(Equal(deps.Apt))
+
+		Expect(fs.WriteFile("/etc/os-release", []byte("ID=nixos\n"), 0644)).To(Succeed())
+		distro, err = deps.DetectDistro(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(distro.Manager).To(BeEmpty())
+
+		Expect(fs.Remove("/etc/os-release")).To(Succeed())
+		_, err = deps.DetectDistro(fs)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("installs the packages with the package manager", func() {
+		Expect(deps.InstallCommands(deps.Apt, []string{"mtools", "xorriso"})).To(Equal([][]string{
+			{"apt-get", "update"},
+			{"apt-get", "install", "-y", "--no-install-recommends", "mtools", "xorriso"},
+		}))
+		Expect(deps.InstallCommands(deps.Dnf, []string{"mtools"})).To(Equal([][]string{{"dnf", "install", "-y", "mtools"}}))
+		Expect(deps.InstallCommands(deps.Apt, nil)).To(BeEmpty())
+		Expect(deps.InstallCommands("", []string{"mtools"})).To(BeEmpty())
+	})
+
+	Describe("static builds", func() {
+		var server *httptest.Server
+		var files map[string][]byte
+		var dir string
+		binary := []byte("#!/bin/sh\necho tool\n")
+
+		BeforeEach(func() {
+			files = map[string][]byte{}
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, ok := files[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = w.Write(data)
+			}))
+			dir = filepath.Join(GinkgoT().TempDir(), "tools")
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("installs the binary of the archive checked against its pinned sha256", func() {
+			archive := tarball("tool", binary)
+			sum := sha256.Sum256(archive)
+			asset := fmt.Sprintf("tool_1.0.0_linux_%s.tar.gz", runtime.GOARCH)
+			files["/v1.0.0/"+asset] = archive
+			// A checksums file next to the asset is not trusted
+			files["/v1.0.0/checksums.txt"] = []byte(fmt.Sprintf("0000  %s\n", asset))
+			s := &deps.Static{
+				Version: "1.0.0",
+				URL:     server.URL + "/v{version}",
+				Asset:   "tool_{version}_linux_{arch}.tar.gz",
+				SHA256:  map[string]string{runtime.GOARCH: hex.EncodeToString(sum[:])},
+				Member:  "tool",
+			}
+			Expect(s.AssetURL()).To(Equal(server.URL + "/v1.0.0/" + asset))
+			Expect(s.Install(dir, "tool")).To(Succeed())
+			data, err := os.ReadFile(filepath.Join(dir, "tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal(binary))
+		})
+
+		It("refuses builds not matching their pinned sha256", func() {
+			files["/tool"] = binary
+			s := &deps.Static{Version: "1.0.0", URL: server.URL, Asset: "tool", SHA256: map[string]string{runtime.GOARCH: "0000"}}
+			Expect(s.Install(dir, "tool")).To(MatchError(ContainSubstring("sha256 of tool doesn't match the pinned one")))
+			Expect(filepath.Join(dir, "tool")).ToNot(BeAnExistingFile())
+
+			s.SHA256 = nil
+			Expect(s.Install(dir, "tool")).To(MatchError(ContainSubstring("no sha256 of tool is pinned")))
+		})
+	})
+
+	It("puts the toolcache first in the PATH", func() {
+		DeferCleanup(os.Setenv, "PATH", os.Getenv("PATH"))
+		Expect(os.Setenv("PATH", "/usr/bin:/bin")).To(Succeed())
+		deps.UseToolcache("/var/lib/enki/tools")
+		deps.UseToolcache("/var/lib/enki/tools")
+		Expect(os.Getenv("PATH")).To(Equal("/var/lib/enki/tools:/usr/bin:/bin"))
+		deps.UseToolcache("")
+		Expect(os.Getenv("PATH")).To(Equal("/var/lib/enki/tools:/usr/bin:/bin"))
+	})
+})
@@ -0,0 +1,169 @@
+package deps
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/mirror"
+)
+
+// DefaultToolcache is where the static builds are installed by default
+const DefaultToolcache = "/var/lib/enki/tools"
+
+// Static is a static build of a tool, checked against the sha256 pinned along with its version
+// rather than against a checksums file downloaded from the same, maybe mirrored, place
+type Static struct {
+	Version string
+	// URL is the dir of the release assets
+	URL string
+	// Asset is the name of the build
+	Asset string
+	// SHA256 are the hex sha256 of the asset of each GOARCH. The arches without one are not
+	// downloaded, their tool is installed by hand.
+	SHA256 map[string]string
+	// Arches are the names of the GOARCH values in the asset names, GOARCH itself if missing
+	Arches map[string]string
+	// Member is the binary within the asset, for .tar.gz assets, empty for bare binaries
+	Member string
+}
+
+// The sha256 of the assets are pinned from the checksums of the release when bumping the version
+var (
+	grype = &Static{
+		Version: "0.74.7",
+		URL:     "https://github.com/anchore/grype/releases/download/v{version}",
+		Asset:   "grype_{version}_linux_{arch}.tar.gz",
+		Member:  "grype",
+	}
+	trivy = &Static{
+		Version: "0.49.1",
+		URL:     "https://github.com/aquasecurity/trivy/releases/download/v{version}",
+		Asset:   "trivy_{version}_Linux-{arch}.tar.gz",
+		Arches:  map[string]string{"amd64": "64bit", "arm64": "ARM64"},
+		Member:  "trivy",
+	}
+	cosign = &Static{
+		Version: "2.2.3",
+		URL:     "https://github.com/sigstore/cosign/releases/download/v{version}",
+		Asset:   "cosign-linux-{arch}",
+	}
+	notation = &Static{
+		Version: "1.1.0",
+		URL:     "https://github.com/notaryproject/notation/releases/download/v{version}",
+		Asset:   "notation_{version}_linux_{arch}.tar.gz",
+		Member:  "notation",
+	}
+)
+
+// client downloads the static builds, bounded so a stalled mirror doesn't hang the install
+var client = &http.Client{Timeout: 10 * time.Minute}
+
+// expand returns s with the version and the name of arch in it
+func (s *Static) expand(value, arch string) string {
+	if name, ok := s.Arches[arch]; ok {
+		arch = name
+	}
+	return strings.NewReplacer("{version}", s.Version, "{arch}", arch).Replace(value)
+}
+
+// AssetURL returns the URL of the build for the running arch
+func (s *Static) AssetURL() string {
+	return s.expand(s.URL+"/"+s.Asset, runtime.GOARCH)
+}
+
+// Pinned tells if the build for the running arch has a pinned sha256, and so can be installed
+func (s *Static) Pinned() bool {
+	return s != nil && s.SHA256[runtime.GOARCH] != ""
+}
+
+// Install downloads the build for the running arch, checks it against its pinned sha256 and
+// installs it as dir/binary
+func (s *Static) Install(dir, binary string) error {
+	asset := s.expand(s.Asset, runtime.GOARCH)
+	want, ok := s.SHA256[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("no sha256 of %s is pinned for %s", asset, runtime.GOARCH)
+	}
+	data, err := fetch(s.AssetURL())
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != want {
+		return fmt.Errorf("the sha256 of %s doesn't match the pinned one", asset)
+	}
+	if s.Member != "" {
+		if data, err = extract(data, s.Member); err != nil {
+			return fmt.Errorf("extracting %s from %s: %w", s.Member, asset, err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Written aside first, so an interrupted install doesn't leave a broken binary in the PATH
+	tmp := filepath.Join(dir, "."+binary)
+	if err := os.WriteFile(tmp, data, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, binary))
+}
+
+// fetch returns the contents of url
+func fetch(url string) ([]byte, error) {
+	url = mirror.URL(url)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// extract returns the contents of the file named member, at any depth, of a .tar.gz archive
+func extract(data []byte, member string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %s in the archive", member)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Base(hdr.Name) == member {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// UseToolcache puts the toolcache dir first in the PATH, so the static builds installed there
+// are preferred to the tools of the host
+func UseToolcache(dir string) {
+	if dir == "" {
+		return
+	}
+	path := os.Getenv("PATH")
+	for _, entry := range filepath.SplitList(path) {
+		if entry == dir {
+			return
+		}
+	}
+	_ = os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+}
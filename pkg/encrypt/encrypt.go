@@ -0,0 +1,260 @@
+// Package encrypt protects artifacts distributed over untrusted channels, either with age
+// recipients or with a pre-shared AES-256 key. Encrypted files are self describing, so they
+// can be decrypted without knowing which method was used.
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/kairos-io/enki/pkg/secret"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// MethodAge encrypts for one or more age recipients
+	MethodAge = "age"
+	// MethodAESGCM encrypts with a 256 bits key shared out of band
+	MethodAESGCM = "aes-gcm"
+	// Extension is appended to the name of encrypted artifacts
+	Extension = ".enc"
+
+	// aesMagic starts every AES-GCM encrypted file
+	aesMagic = "enki-aes-gcm-v1\n"
+	// ageMagic starts every age encrypted file
+	ageMagic = "age-encryption.org/v1"
+	// chunkSize is the plaintext size of each AES-GCM sealed chunk, so big artifacts can be
+	// streamed instead of being loaded in memory
+	chunkSize = 64 * 1024
+	// noncePrefixSize is the random part of the chunk nonces, the rest is the chunk counter
+	noncePrefixSize = 8
+)
+
+// Methods returns the supported encryption methods
+func Methods() []string {
+	return []string{MethodAge, MethodAESGCM}
+}
+
+// Encrypt reads r and writes it encrypted into w. For age the key is a recipient or a file
+// with one recipient per line, for AES-GCM it is a file with the hex encoded or raw key. Files
+// can be given as secret references too.
+func Encrypt(method, key string, w io.Writer, r io.Reader) error {
+	switch method {
+	case MethodAge:
+		recipients, err := ageRecipients(key)
+		if err != nil {
+			return err
+		}
+		ew, err := age.Encrypt(w, recipients...)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(ew, r); err != nil {
+			return err
+		}
+		return ew.Close()
+	case MethodAESGCM:
+		aead, err := aesKey(key)
+		if err != nil {
+			return err
+		}
+		return sealChunks(aead, w, r)
+	}
+	return fmt.Errorf("unknown encryption method %q, available methods: %s", method, strings.Join(Methods(), ", "))
+}
+
+// Decrypt reads the encrypted r and writes the plaintext into w. The method is detected from
+// the file header, the key is an age identity file or the AES-GCM key file.
+func Decrypt(key string, w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(ageMagic))
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(header, []byte(ageMagic)):
+		data, err := secret.Read(key)
+		if err != nil {
+			return err
+		}
+		identities, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("parsing age identities from %s: %w", key, err)
+		}
+		dr, err := age.Decrypt(br, identities...)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, dr)
+		return err
+	case bytes.HasPrefix(header, []byte(aesMagic)):
+		aead, err := aesKey(key)
+		if err != nil {
+			return err
+		}
+		return openChunks(aead, w, br)
+	}
+	return errors.New("not an encrypted artifact")
+}
+
+// EncryptFile encrypts the given artifact into artifact+Extension and removes the plain one.
+// It returns the path of the encrypted artifact.
+func EncryptFile(fs v1.FS, method, key, artifact string) (string, error) {
+	in, err := fs.Open(artifact)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	encrypted := artifact + Extension
+	out, err := fs.Create(encrypted)
+	if err != nil {
+		return "", err
+	}
+	err = Encrypt(method, key, out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(encrypted)
+		return "", fmt.Errorf("encrypting %s: %w", artifact, err)
+	}
+	return encrypted, fs.Remove(artifact)
+}
+
+// ageRecipients parses key as an age recipient, or as a file listing them
+func ageRecipients(key string) ([]age.Recipient, error) {
+	if strings.HasPrefix(key, "age1") {
+		r, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	}
+	data, err := secret.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	recipients, err := age.ParseRecipients(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing age recipients from %s: %w", key, err)
+	}
+	return recipients, nil
+}
+
+// aesKey reads a 256 bits key from the given file or secret reference, either raw or hex encoded
+func aesKey(path string) (cipher.AEAD, error) {
+	data, err := secret.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	key := data
+	if trimmed := strings.TrimSpace(string(data)); len(trimmed) == 64 {
+		if key, err = hex.DecodeString(trimmed); err != nil {
+			return nil, fmt.Errorf("decoding hex key from %s: %w", path, err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the key in %s must be 32 bytes, or 64 hex characters", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce of the given chunk
+func nonce(prefix []byte, counter uint32) []byte {
+	n := make([]byte, noncePrefixSize+4)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixSize:], counter)
+	return n
+}
+
+// finalChunk is the additional data of the last chunk, so truncated files fail to decrypt
+var finalChunk = []byte{1}
+
+// sealChunks writes the header followed by r sealed in chunks of chunkSize
+func sealChunks(aead cipher.AEAD, w io.Writer, r io.Reader) error {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(aesMagic); err != nil {
+		return err
+	}
+	if _, err := bw.Write(prefix); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, chunkSize)
+	buf := make([]byte, chunkSize)
+	var out []byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// Peek to know if this is the last chunk before sealing it
+		_, peekErr := br.Peek(1)
+		var ad []byte
+		if peekErr == io.EOF {
+			ad = finalChunk
+		}
+		out = aead.Seal(out[:0], nonce(prefix, counter), buf[:n], ad)
+		if _, err = bw.Write(out); err != nil {
+			return err
+		}
+		if ad != nil {
+			return bw.Flush()
+		}
+		if counter == ^uint32(0) {
+			return errors.New("artifact too big to encrypt")
+		}
+	}
+}
+
+// openChunks verifies the header and writes the opened chunks of r into w
+func openChunks(aead cipher.AEAD, w io.Writer, r *bufio.Reader) error {
+	header := make([]byte, len(aesMagic)+noncePrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	prefix := header[len(aesMagic):]
+
+	sealedSize := chunkSize + aead.Overhead()
+	buf := make([]byte, sealedSize)
+	var out []byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := r.Peek(1)
+		var ad []byte
+		if peekErr == io.EOF {
+			ad = finalChunk
+		}
+		out, err = aead.Open(out[:0], nonce(prefix, counter), buf[:n], ad)
+		if err != nil {
+			return fmt.Errorf("decrypting chunk %d, wrong key or corrupted artifact: %w", counter, err)
+		}
+		if _, err = w.Write(out); err != nil {
+			return err
+		}
+		if ad != nil {
+			return nil
+		}
+	}
+}
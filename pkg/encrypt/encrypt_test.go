@@ -0,0 +1,92 @@
+package encrypt_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/kairos-io/enki/pkg/encrypt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encrypt", Label("encrypt"), func() {
+	var dir string
+	var plain []byte
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		// A few chunks plus a partial one
+		plain = make([]byte, 3*64*1024+123)
+		_, err := rand.Read(plain)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	Describe("aes-gcm", func() {
+		var keyFile string
+
+		BeforeEach(func() {
+			key := make([]byte, 32)
+			_, err := rand.Read(key)
+			Expect(err).ShouldNot(HaveOccurred())
+			keyFile = filepath.Join(dir, "key")
+			Expect(os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600)).To(Succeed())
+		})
+		It("decrypts what it encrypts", func() {
+			for _, data := range [][]byte{plain, {}, plain[:64*1024]} {
+				var encrypted, decrypted bytes.Buffer
+				Expect(encrypt.Encrypt(encrypt.MethodAESGCM, keyFile, &encrypted, bytes.NewReader(data))).To(Succeed())
+				Expect(encrypt.Decrypt(keyFile, &decrypted, &encrypted)).To(Succeed())
+				Expect(decrypted.Bytes()).To(Equal(data))
+			}
+		})
+		It("reads the key from secret references", func() {
+			key, err := os.ReadFile(keyFile)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(os.Setenv("ENKI_TEST_AES_KEY", string(key))).To(Succeed())
+			DeferCleanup(os.Unsetenv, "ENKI_TEST_AES_KEY")
+			var encrypted, decrypted bytes.Buffer
+			Expect(encrypt.Encrypt(encrypt.MethodAESGCM, "env://ENKI_TEST_AES_KEY", &encrypted, bytes.NewReader(plain))).To(Succeed())
+			Expect(encrypt.Decrypt("file://"+keyFile, &decrypted, &encrypted)).To(Succeed())
+			Expect(decrypted.Bytes()).To(Equal(plain))
+		})
+		It("fails on truncated artifacts", func() {
+			var encrypted, decrypted bytes.Buffer
+			Expect(encrypt.Encrypt(encrypt.MethodAESGCM, keyFile, &encrypted, bytes.NewReader(plain))).To(Succeed())
+			truncated := encrypted.Bytes()[:encrypted.Len()-123-16]
+			Expect(encrypt.Decrypt(keyFile, &decrypted, bytes.NewReader(truncated))).ToNot(Succeed())
+		})
+		It("fails with the wrong key", func() {
+			var encrypted, decrypted bytes.Buffer
+			Expect(encrypt.Encrypt(encrypt.MethodAESGCM, keyFile, &encrypted, bytes.NewReader(plain))).To(Succeed())
+			otherKey := filepath.Join(dir, "other")
+			Expect(os.WriteFile(otherKey, make([]byte, 32), 0600)).To(Succeed())
+			Expect(encrypt.Decrypt(otherKey, &decrypted, &encrypted)).ToNot(Succeed())
+		})
+		It("rejects keys of the wrong size", func() {
+			Expect(os.WriteFile(keyFile, []byte("short"), 0600)).To(Succeed())
+			Expect(encrypt.Encrypt(encrypt.MethodAESGCM, keyFile, &bytes.Buffer{}, bytes.NewReader(plain))).ToNot(Succeed())
+		})
+	})
+
+	Describe("age", func() {
+		It("decrypts what it encrypts for a recipient", func() {
+			identity, err := age.GenerateX25519Identity()
+			Expect(err).ShouldNot(HaveOccurred())
+			identityFile := filepath.Join(dir, "identity")
+			Expect(os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)).To(Succeed())
+
+			var encrypted, decrypted bytes.Buffer
+			Expect(encrypt.Encrypt(encrypt.MethodAge, identity.Recipient().String(), &encrypted, bytes.NewReader(plain))).To(Succeed())
+			Expect(encrypt.Decrypt(identityFile, &decrypted, &encrypted)).To(Succeed())
+			Expect(decrypted.Bytes()).To(Equal(plain))
+		})
+	})
+
+	It("fails to decrypt plain files", func() {
+		Expect(encrypt.Decrypt("/nonexisting", &bytes.Buffer{}, bytes.NewReader(plain))).To(MatchError(ContainSubstring("not an encrypted artifact")))
+	})
+})
@@ -0,0 +1,87 @@
+// Package espmerge lays out the ESP files of a UKI build as an overlay to copy into an existing
+// ESP, like the one of a Windows install, and tells how to add the firmware boot entry of the
+// copied boot loader, as nothing takes over the fallback path the firmware boots by default.
+package espmerge
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// Dir is the dir of the output dir the esp-overlay output is written to
+	Dir = "esp-overlay"
+	// InstructionsFile is the file of the output dir the instructions are written to
+	InstructionsFile = "esp-overlay.json"
+	// LoaderDir is the dir of the ESP the boot loader is moved to, out of the fallback path
+	LoaderDir = "EFI/kairos"
+	// fallbackDir is the fallback path of removable media, which Windows or another OS may own
+	fallbackDir = "EFI/BOOT"
+)
+
+// Instructions tells how to boot the overlay once copied into the ESP, from Linux with
+// efibootmgr or from Windows with bcdedit. DISK and PART stand for the disk and the partition
+// number of the ESP, and {ID} for the identifier bcdedit /copy prints.
+type Instructions struct {
+	// Label is the name of the firmware boot entry
+	Label string `json:"label"`
+	// Loader is the path of the boot loader in the ESP, as firmware boot entries take it
+	Loader string `json:"loader"`
+	// Files are the files the overlay adds to the ESP, the ones not to remove along with it
+	Files      []string   `json:"files"`
+	Efibootmgr []string   `json:"efibootmgr"`
+	Bcdedit    [][]string `json:"bcdedit"`
+}
+
+// Overlay returns the files of filesMap, keyed by the dir they go to, with the ones of the
+// fallback path moved to LoaderDir, so copying them into an ESP doesn't clobber the boot
+// loader of the OS already there. Empty dirs are left out.
+func Overlay(filesMap map[string][]string) map[string][]string {
+	overlay := map[string][]string{}
+	dirs := make([]string, 0, len(filesMap))
+	for dir := range filesMap {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		files := filesMap[dir]
+		if len(files) == 0 {
+			continue
+		}
+		if dir == fallbackDir {
+			dir = LoaderDir
+		}
+		overlay[dir] = append(overlay[dir], files...)
+	}
+	return overlay
+}
+
+// NewInstructions returns the instructions to boot the loader, a path relative to the ESP
+// root like EFI/kairos/BOOTX64.EFI, from a boot entry with the given label. files are the
+// ESP paths the overlay adds.
+func NewInstructions(label, loader string, files []string) Instructions {
+	path := `\` + strings.ReplaceAll(loader, "/", `\`)
+	sort.Strings(files)
+	return Instructions{
+		Label:      label,
+		Loader:     path,
+		Files:      files,
+		Efibootmgr: []string{"efibootmgr", "--create", "--disk", "DISK", "--part", "PART", "--label", label, "--loader", path},
+		Bcdedit: [][]string{
+			{"bcdedit", "/copy", "{bootmgr}", "/d", label},
+			{"bcdedit", "/set", "{ID}", "path", path},
+			{"bcdedit", "/set", "{fwbootmgr}", "displayorder", "{ID}", "/addlast"},
+		},
+	}
+}
+
+// Write writes the instructions as JSON to path
+func (i Instructions) Write(path string) error {
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
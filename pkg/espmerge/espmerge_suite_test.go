@@ -0,0 +1,13 @@
+package espmerge_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestEspmerge(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Espmerge test suite")
+}
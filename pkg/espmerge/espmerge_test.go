@@ -0,0 +1,44 @@
+package espmerge_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/espmerge"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Espmerge", Label("espmerge"), func() {
+	It("moves the boot loader out of the fallback path", func() {
+		overlay := espmerge.Overlay(map[string][]string{
+			"EFI":            {},
+			"EFI/BOOT":       {"/src/BOOTX64.EFI"},
+			"EFI/kairos":     {"/src/norole.efi"},
+			"loader":         {"/src/loader.conf"},
+			"loader/entries": {"/src/norole.conf"},
+		})
+		Expect(overlay).To(Equal(map[string][]string{
+			"EFI/kairos":     {"/src/BOOTX64.EFI", "/src/norole.efi"},
+			"loader":         {"/src/loader.conf"},
+			"loader/entries": {"/src/norole.conf"},
+		}))
+	})
+
+	It("tells how to add the boot entry from Linux and Windows", func() {
+		instructions := espmerge.NewInstructions("Kairos", "EFI/kairos/BOOTX64.EFI", []string{"loader/loader.conf", "EFI/kairos/BOOTX64.EFI"})
+		Expect(instructions.Loader).To(Equal(`\EFI\kairos\BOOTX64.EFI`))
+		Expect(instructions.Files).To(Equal([]string{"EFI/kairos/BOOTX64.EFI", "loader/loader.conf"}))
+		Expect(instructions.Efibootmgr).To(ContainElements("--label", "Kairos", "--loader", `\EFI\kairos\BOOTX64.EFI`))
+		Expect(instructions.Bcdedit).To(ContainElement([]string{"bcdedit", "/set", "{ID}", "path", `\EFI\kairos\BOOTX64.EFI`}))
+
+		path := filepath.Join(GinkgoT().TempDir(), espmerge.InstructionsFile)
+		Expect(instructions.Write(path)).To(Succeed())
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		var written espmerge.Instructions
+		Expect(json.Unmarshal(data, &written)).To(Succeed())
+		Expect(written).To(Equal(instructions))
+	})
+})
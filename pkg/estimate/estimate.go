@@ -0,0 +1,163 @@
+// Package estimate guesses how well a rootfs compresses before building anything from it, by
+// compressing a sample of its files the way mksquashfs and the UKI initrd do, so the size of the
+// artifacts and of the space needed to build them is known upfront.
+package estimate
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/klauspost/compress/zstd"
+	"github.com/twpayne/go-vfs"
+	"github.com/ulikunitz/xz"
+)
+
+// The compressions estimated, by their mksquashfs names
+const (
+	Gzip = "gzip"
+	Xz   = "xz"
+	Zstd = "zstd"
+)
+
+// Compressions returns the compressions estimated, gzip being the one of mksquashfs by default
+func Compressions() []string {
+	return []string{Gzip, Xz, Zstd}
+}
+
+// BlockSize is the squashfs block size of the ISOs, see constants.GetDefaultSquashfsOptions.
+// mksquashfs compresses each block on its own.
+const BlockSize = 1024 * 1024
+
+// Ratios are the compressed size of the rootfs with each compression, as a fraction of its size
+type Ratios map[string]float64
+
+// Compress returns the ratios of the files of root, sized size, compressing about sample bytes of
+// them in squashfs blocks spread evenly across the rootfs. The whole rootfs is compressed if
+// sample is 0 or bigger than it.
+func Compress(fs v1.FS, root string, size, sample int64) (Ratios, error) {
+	stride := int64(1)
+	if sample > 0 && size > sample {
+		stride = size / sample
+	}
+	var files []string
+	sizes := map[string]int64{}
+	err := vfs.Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			files = append(files, path)
+			sizes[path] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	s := sampler{compressed: map[string]int64{}, block: make([]byte, BlockSize)}
+	// n numbers the blocks of the whole rootfs, the last one of a file being as big as its tail
+	var n int64
+	for _, path := range files {
+		var offsets []int64
+		for offset := int64(0); offset < sizes[path]; offset, n = offset+BlockSize, n+1 {
+			if n%stride == 0 {
+				offsets = append(offsets, offset)
+			}
+		}
+		if len(offsets) == 0 {
+			continue
+		}
+		if err := s.compress(fs, path, offsets); err != nil {
+			return nil, err
+		}
+	}
+
+	ratios := Ratios{}
+	for _, compression := range Compressions() {
+		ratios[compression] = 1
+		if s.raw > 0 {
+			ratios[compression] = float64(s.compressed[compression]) / float64(s.raw)
+		}
+	}
+	return ratios, nil
+}
+
+// sampler adds up the sizes of the sampled blocks
+type sampler struct {
+	raw        int64
+	compressed map[string]int64
+	block      []byte
+}
+
+// compress compresses the blocks of the file at path starting at offsets
+func (s *sampler) compress(fs v1.FS, path string, offsets []int64) error {
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, offset := range offsets {
+		read, err := f.ReadAt(s.block, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		s.raw += int64(read)
+		for _, compression := range Compressions() {
+			size, err := compressedSize(compression, s.block[:read])
+			if err != nil {
+				return err
+			}
+			s.compressed[compression] += size
+		}
+	}
+	return nil
+}
+
+// Of returns the size of size bytes compressed with the given compression
+func (r Ratios) Of(compression string, size int64) int64 {
+	return int64(float64(size) * r[compression])
+}
+
+// compressedSize returns the size of the block compressed with the given compression, at the
+// levels mksquashfs compresses with by default. mksquashfs keeps the blocks that don't shrink
+// uncompressed.
+func compressedSize(compression string, block []byte) (int64, error) {
+	var counter countWriter
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case Gzip:
+		w, err = gzip.NewWriterLevel(&counter, gzip.BestCompression)
+	case Xz:
+		w, err = xz.WriterConfig{DictCap: BlockSize}.NewWriter(&counter)
+	case Zstd:
+		w, err = zstd.NewWriter(&counter, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithWindowSize(BlockSize))
+	default:
+		return 0, fmt.Errorf("unknown compression %q", compression)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.Write(block); err != nil {
+		return 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	return min(int64(counter), int64(len(block))), nil
+}
+
+// countWriter counts the bytes written to it
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,53 @@
+package estimate_test
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/kairos-io/enki/pkg/estimate"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Compress", Label("estimate"), func() {
+	It("estimates how well the rootfs compresses", func() {
+		random := make([]byte, 4*estimate.BlockSize)
+		rand.New(rand.NewSource(1)).Read(random)
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/rootfs/usr/lib/random.bin": string(random),
+			"/rootfs/usr/share/zeros":    string(make([]byte, 4*estimate.BlockSize)),
+			"/rootfs/etc/empty":          "",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		size := int64(8 * estimate.BlockSize)
+		ratios, err := estimate.Compress(fs, "/rootfs", size, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ratios).To(HaveLen(len(estimate.Compressions())))
+		for _, compression := range estimate.Compressions() {
+			// The random blocks are kept uncompressed, the zeros shrink to nothing
+			Expect(ratios[compression]).To(BeNumerically("~", 0.5, 0.01), compression)
+			Expect(ratios.Of(compression, size)).To(BeNumerically("~", size/2, size/100), compression)
+		}
+
+		// Every other block of the rootfs
+		sampled, err := estimate.Compress(fs, "/rootfs", size, size/2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sampled[estimate.Gzip]).To(BeNumerically("~", 0.5, 0.01))
+	})
+
+	It("compresses text better with xz than with gzip", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/rootfs/usr/share/doc/README": string(bytes.Repeat([]byte("Kairos is the immutable Linux meta-distribution for edge Kubernetes.\n"), 20000)),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		ratios, err := estimate.Compress(fs, "/rootfs", 20000*69, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ratios[estimate.Gzip]).To(BeNumerically("<", 0.1))
+		Expect(ratios[estimate.Xz]).To(BeNumerically("<", ratios[estimate.Gzip]))
+	})
+})
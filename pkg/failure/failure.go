@@ -0,0 +1,153 @@
+// Package failure classifies the errors enki can fail with, so they carry a hint on how to fix
+// them and map to a process exit code automation can act on.
+//
+// Exit codes:
+//
+//	0  success
+//	1  any other error
+//	2  invalid configuration, flags or arguments (ErrInvalidConfig)
+//	3  a required tool or file is missing on the host (ErrMissingDependency)
+//	4  not enough disk space to build (ErrInsufficientSpace)
+//	5  the artifact doesn't fit in the configured max-size (ErrSizeBudget)
+//	6  the secure boot keys are missing (ErrMissingKeys)
+//	7  an EFI binary could not be signed (ErrUnsignedStub)
+//	8  the command requires root privileges (ErrPermission)
+//	9  the build failed for any other reason (ErrBuild)
+//	10 an artifact failed its integrity or authenticity check (ErrVerification)
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// exitGeneric is the exit code of errors of no known kind
+const exitGeneric = 1
+
+var (
+	ErrInvalidConfig     = errors.New("invalid configuration")
+	ErrMissingDependency = errors.New("missing dependency")
+	ErrInsufficientSpace = errors.New("insufficient disk space")
+	ErrSizeBudget        = errors.New("size budget exceeded")
+	ErrMissingKeys       = errors.New("missing secure boot keys")
+	ErrUnsignedStub      = errors.New("EFI binary could not be signed")
+	ErrPermission        = errors.New("insufficient privileges")
+	ErrBuild             = errors.New("build failed")
+	ErrVerification      = errors.New("verification failed")
+
+	exitCodes = []struct {
+		kind error
+		code int
+	}{
+		{ErrInvalidConfig, 2},
+		{ErrMissingDependency, 3},
+		{ErrInsufficientSpace, 4},
+		{ErrSizeBudget, 5},
+		{ErrMissingKeys, 6},
+		{ErrUnsignedStub, 7},
+		{ErrPermission, 8},
+		{ErrBuild, 9},
+		{ErrVerification, 10},
+	}
+)
+
+// Error is an error of a known kind along with how to fix it
+type Error struct {
+	// Kind is one of the Err sentinels of this package
+	Kind error
+	// Err is the underlying error, if any
+	Err error
+	// Hint tells the user how to fix the error
+	Hint string
+}
+
+// New returns an error of the given kind wrapping err, which may be nil
+func New(kind error, err error, hint string) *Error {
+	return &Error{Kind: kind, Err: err, Hint: hint}
+}
+
+// Errorf returns an error of the given kind with a formatted message
+func Errorf(kind error, hint string, format string, args ...any) *Error {
+	return New(kind, fmt.Errorf(format, args...), hint)
+}
+
+// Classify returns err as an error of the given kind, unless it is nil or already has a more
+// specific kind
+func Classify(kind error, err error) error {
+	if err == nil || ExitCode(err) != exitGeneric {
+		return err
+	}
+	return New(kind, err, "")
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns both the kind and the underlying error, so errors.Is matches either
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Hint returns the remediation hint of the outermost Error in the chain of err, if any
+func Hint(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Hint
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return "install the missing tool and make sure it is in the PATH"
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return "free some space in the output and temporary directories, or point TMPDIR to a larger filesystem"
+	}
+	return ""
+}
+
+// ExitCode returns the process exit code for err, 0 if err is nil
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return exitCode(e.Kind)
+	}
+	// Missing tools and running out of space surface as plain errors from wherever the command
+	// ran or the write happened
+	if errors.Is(err, exec.ErrNotFound) {
+		return exitCode(ErrMissingDependency)
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return exitCode(ErrInsufficientSpace)
+	}
+	return exitGeneric
+}
+
+func exitCode(kind error) int {
+	for _, c := range exitCodes {
+		if errors.Is(kind, c.kind) {
+			return c.code
+		}
+	}
+	return exitGeneric
+}
+
+// Kind returns the kind of error the exit code of an enki process stands for, nil for 0 and the
+// codes of no known kind
+func Kind(code int) error {
+	for _, c := range exitCodes {
+		if c.code == code {
+			return c.kind
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package failure_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Failure", Label("failure"), func() {
+	It("matches both the kind and the underlying error", func() {
+		err := failure.New(failure.ErrMissingDependency, os.ErrNotExist, "install it")
+		Expect(err).To(MatchError(failure.ErrMissingDependency))
+		Expect(err).To(MatchError(os.ErrNotExist))
+		Expect(err.Error()).To(Equal(os.ErrNotExist.Error()))
+	})
+	It("uses the kind as message without an underlying error", func() {
+		err := failure.New(failure.ErrMissingKeys, nil, "")
+		Expect(err.Error()).To(Equal("missing secure boot keys"))
+	})
+	It("keeps the hint and the kind through wrapping", func() {
+		err := fmt.Errorf("building: %w", failure.Errorf(failure.ErrUnsignedStub, "check the keys", "running sbsign: %s", "exit status 1"))
+		Expect(err.Error()).To(Equal("building: running sbsign: exit status 1"))
+		Expect(failure.Hint(err)).To(Equal("check the keys"))
+		Expect(failure.ExitCode(err)).To(Equal(7))
+	})
+	It("maps each kind to its own exit code", func() {
+		codes := map[int]bool{}
+		for _, kind := range []error{
+			failure.ErrInvalidConfig,
+			failure.ErrMissingDependency,
+			failure.ErrInsufficientSpace,
+			failure.ErrSizeBudget,
+			failure.ErrMissingKeys,
+			failure.ErrUnsignedStub,
+			failure.ErrPermission,
+			failure.ErrBuild,
+			failure.ErrVerification,
+		} {
+			code := failure.ExitCode(failure.New(kind, nil, ""))
+			Expect(code).To(BeNumerically(">", 1))
+			Expect(codes).NotTo(HaveKey(code))
+			Expect(failure.Kind(code)).To(BeIdenticalTo(kind))
+			codes[code] = true
+		}
+		Expect(failure.Kind(0)).To(BeNil())
+		Expect(failure.Kind(1)).To(BeNil())
+	})
+	It("returns the generic exit code for unknown errors", func() {
+		Expect(failure.ExitCode(nil)).To(Equal(0))
+		Expect(failure.ExitCode(errors.New("boom"))).To(Equal(1))
+		Expect(failure.Hint(errors.New("boom"))).To(BeEmpty())
+	})
+	It("keeps the most specific kind when classifying", func() {
+		Expect(failure.Classify(failure.ErrBuild, nil)).To(BeNil())
+		err := failure.Classify(failure.ErrBuild, errors.New("boom"))
+		Expect(err).To(MatchError(failure.ErrBuild))
+		Expect(failure.ExitCode(err)).To(Equal(9))
+		signing := failure.New(failure.ErrUnsignedStub, errors.New("sbsign"), "")
+		Expect(failure.Classify(failure.ErrBuild, signing)).To(BeIdenticalTo(signing))
+		missing := fmt.Errorf("running xorriso: %w", exec.ErrNotFound)
+		Expect(failure.ExitCode(failure.Classify(failure.ErrBuild, missing))).To(Equal(3))
+	})
+	It("classifies running out of space", func() {
+		err := &os.PathError{Op: "write", Path: "/tmp/rootfs.squashfs", Err: syscall.ENOSPC}
+		Expect(failure.ExitCode(err)).To(Equal(4))
+		Expect(failure.Hint(err)).NotTo(BeEmpty())
+	})
+})
@@ -0,0 +1,135 @@
+// Package firmware bundles LVFS firmware capsules into installer media and configures the
+// installed system to apply them with fwupd on its first boot, so the machines get the firmware
+// baseline shipped along with the OS.
+package firmware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Dir is the dir at the root of the ISO holding the capsules
+const Dir = "firmware"
+
+// FileName is the cloud-config written to the root of the ISO, read by kairos-agent like the
+// one of the unattended install. The installed system keeps it along with the install config.
+const FileName = "firmware.yaml"
+
+const (
+	// liveDir is where the ISO is mounted on the live system
+	liveDir = "/run/initramfs/live"
+	// installDir is where the capsules are copied to during the install, the OEM partition
+	installDir = "/run/cos/oem/firmware"
+	// installedDir is where the installed system finds the capsules, the OEM partition
+	installedDir = "/oem/firmware"
+	// appliedFile marks the capsules as applied, so they are only applied on the first boot
+	appliedFile = installedDir + "/.applied"
+)
+
+// cabinetMagic starts the Microsoft Cabinet archives LVFS distributes the capsules as
+var cabinetMagic = []byte("MSCF")
+
+// Options are the firmware capsules baked into the media
+type Options struct {
+	// Capsules are the .cab files of the capsules, as downloaded from LVFS
+	Capsules []string
+	// Reboot reboots the installed system once the updates are scheduled, to apply them right away
+	// rather than on its next reboot
+	Reboot bool
+}
+
+// Enabled returns true if any capsule is bundled
+func (o Options) Enabled() bool {
+	return len(o.Capsules) > 0
+}
+
+// Validate checks the capsules are cabinet archives with distinct names
+func (o Options) Validate(fs v1.FS) error {
+	if o.Reboot && !o.Enabled() {
+		return fmt.Errorf("firmware-reboot requires firmware capsules")
+	}
+	names := map[string]string{}
+	for _, capsule := range o.Capsules {
+		name := filepath.Base(capsule)
+		if !strings.EqualFold(filepath.Ext(name), ".cab") {
+			return fmt.Errorf("invalid firmware capsule %s, expected a .cab file as distributed by LVFS", capsule)
+		}
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("firmware capsules %s and %s have the same name", other, capsule)
+		}
+		names[name] = capsule
+		f, err := fs.Open(capsule)
+		if err != nil {
+			return fmt.Errorf("reading firmware capsule: %w", err)
+		}
+		magic := make([]byte, len(cabinetMagic))
+		_, err = io.ReadFull(f, magic)
+		f.Close()
+		if err != nil || !bytes.Equal(magic, cabinetMagic) {
+			return fmt.Errorf("invalid firmware capsule %s, it is not a cabinet archive", capsule)
+		}
+	}
+	return nil
+}
+
+// CloudConfig returns the cloud-config copying the capsules to the installed system and applying
+// them with fwupdmgr on its first boot
+func (o Options) CloudConfig() ([]byte, error) {
+	commands := []string{}
+	for _, capsule := range o.Capsules {
+		commands = append(commands, fmt.Sprintf("fwupdmgr install --assume-yes --no-reboot-check --allow-older --allow-reinstall %s", path.Join(installedDir, filepath.Base(capsule))))
+	}
+	commands = append(commands, "touch "+appliedFile)
+	if o.Reboot {
+		commands = append(commands, "reboot")
+	}
+	cfg := map[string]any{
+		"stages": map[string]any{
+			"after-install": []map[string]any{{
+				"name":     "Copy the firmware capsules to the installed system",
+				"commands": []string{"mkdir -p " + installDir, fmt.Sprintf("cp %s/*.cab %s/", path.Join(liveDir, Dir), installDir)},
+			}},
+			"boot": []map[string]any{{
+				"name":     "Apply the firmware capsules of the installer media",
+				"if":       fmt.Sprintf("[ -d %s ] && [ ! -e %s ]", installedDir, appliedFile),
+				"commands": commands,
+			}},
+		},
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), data...), nil
+}
+
+// Write copies the capsules into the ISO tree in dir and writes the cloud-config applying them to
+// its root, returning its path
+func Write(fs v1.FS, dir string, o Options) (string, error) {
+	if err := o.Validate(fs); err != nil {
+		return "", err
+	}
+	if err := utils.MkdirAll(fs, filepath.Join(dir, Dir), constants.DirPerm); err != nil {
+		return "", err
+	}
+	for _, capsule := range o.Capsules {
+		if err := utils.CopyFile(fs, capsule, filepath.Join(dir, Dir, filepath.Base(capsule))); err != nil {
+			return "", fmt.Errorf("copying %s: %w", capsule, err)
+		}
+	}
+	data, err := o.CloudConfig()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, FileName)
+	return path, fs.WriteFile(path, data, constants.FilePerm)
+}
@@ -0,0 +1,67 @@
+package firmware_test
+
+import (
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/firmware"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Firmware", Label("firmware"), func() {
+	It("copies the capsules and applies them on the first boot of the installed system", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/lvfs/bios.cab": "MSCF bios",
+			"/lvfs/nic.CAB":  "MSCF nic",
+			"/iso":           &vfst.Dir{Perm: 0o755},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		opts := firmware.Options{Capsules: []string{"/lvfs/bios.cab", "/lvfs/nic.CAB"}, Reboot: true}
+		path, err := firmware.Write(fs, "/iso", opts)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(path).To(Equal("/iso/" + firmware.FileName))
+		data, err := fs.ReadFile("/iso/firmware/nic.CAB")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("MSCF nic"))
+
+		data, err = fs.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.HasPrefix(string(data), "#cloud-config\n")).To(BeTrue())
+		var cfg struct {
+			Stages map[string][]struct {
+				If       string   `yaml:"if"`
+				Commands []string `yaml:"commands"`
+			} `yaml:"stages"`
+		}
+		Expect(yaml.Unmarshal(data, &cfg)).To(Succeed())
+		Expect(cfg.Stages["after-install"][0].Commands).To(ContainElement("cp /run/initramfs/live/firmware/*.cab /run/cos/oem/firmware/"))
+		boot := cfg.Stages["boot"][0]
+		Expect(boot.If).To(ContainSubstring("[ ! -e /oem/firmware/.applied ]"))
+		Expect(boot.Commands).To(HaveLen(4))
+		Expect(boot.Commands[0]).To(HavePrefix("fwupdmgr install "))
+		Expect(boot.Commands[0]).To(HaveSuffix(" /oem/firmware/bios.cab"))
+		Expect(boot.Commands[3]).To(Equal("reboot"))
+	})
+
+	It("only takes cabinet archives with distinct names", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/lvfs/bios.cab":    "MSCF bios",
+			"/other/bios.cab":   "MSCF other",
+			"/lvfs/bios.bin":    "MSCF bios",
+			"/lvfs/corrupt.cab": "<html>",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		Expect(firmware.Options{Capsules: []string{"/lvfs/bios.cab"}}.Validate(fs)).To(Succeed())
+		Expect(firmware.Options{Capsules: []string{"/lvfs/bios.bin"}}.Validate(fs)).To(MatchError(ContainSubstring("expected a .cab file")))
+		Expect(firmware.Options{Capsules: []string{"/lvfs/corrupt.cab"}}.Validate(fs)).To(MatchError(ContainSubstring("not a cabinet archive")))
+		Expect(firmware.Options{Capsules: []string{"/lvfs/bios.cab", "/other/bios.cab"}}.Validate(fs)).To(MatchError(ContainSubstring("have the same name")))
+		Expect(firmware.Options{Capsules: []string{"/lvfs/missing.cab"}}.Validate(fs)).To(HaveOccurred())
+		Expect(firmware.Options{Reboot: true}.Validate(fs)).To(MatchError(ContainSubstring("requires firmware capsules")))
+	})
+})
@@ -0,0 +1,366 @@
+// Package fixture generates tiny but valid artifacts for the tests of the projects consuming the
+// ones of enki: a live ISO, a signed toy UKI and a rootfs squashfs. They are created in pure Go,
+// without the tools of the build commands, and are the same bytes on every run, so they can be
+// generated on the fly instead of running full builds or checking large binaries in.
+//
+// The UKI is signed with a test key shipped in this package, never enroll its certificate. The
+// kernel and the initrd of the artifacts are placeholders, none of them boots.
+package fixture
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	_ "embed"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/iso"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// The fixtures, by their names in the output dir
+const (
+	ISO      = "kairos.iso"
+	UKI      = "kairos.efi"
+	Squashfs = "rootfs.squashfs"
+	// Cert is the certificate of the key signing the UKI, to trust it in tests
+	Cert = "db.pem"
+)
+
+// Names returns the fixtures Write can create
+func Names() []string {
+	return []string{ISO, UKI, Squashfs}
+}
+
+// Epoch is the date of every file and signature of the fixtures
+var Epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Cmdline is the cmdline of the UKI
+const Cmdline = "console=ttyS0 rd.immucore.uki install-mode"
+
+// OSRelease is the os-release of the rootfs and of the UKI
+const OSRelease = `NAME="Kairos"
+ID="kairos"
+VERSION="v0.0.0-fixture"
+KAIROS_RELEASE="v0.0.0-fixture"
+KAIROS_FLAVOR="fixture"
+`
+
+// uname is the kernel release of the placeholder kernel
+const uname = "6.1.0-fixture"
+
+// RootfsSize is about the size of the files of the rootfs, which don't compress so the squashfs
+// is as big
+const RootfsSize = 1024 * 1024
+
+//go:embed db.key
+var keyPEM []byte
+
+// KeyPair returns the test key signing the UKI along with its self-signed certificate
+func KeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("decoding the fixture key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("the fixture key is not an RSA key")
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "enki fixture db, do not trust"},
+		NotBefore:             Epoch,
+		NotAfter:              Epoch.AddDate(100, 0, 0),
+		BasicConstraintsValid: true,
+	}
+	// The PKCS #1 v1.5 signature of the certificate doesn't read from rand
+	der, err := x509.CreateCertificate(nil, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return key, cert, err
+}
+
+// Write creates the given fixtures in dir, all of them if none is given, along with the
+// certificate of the UKI. It returns their paths.
+func Write(dir string, names ...string) ([]string, error) {
+	if len(names) == 0 {
+		names = Names()
+	}
+	if err := os.MkdirAll(dir, constants.DirPerm); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		var err error
+		switch name {
+		case ISO:
+			err = WriteISO(path)
+		case UKI:
+			err = WriteUKI(path)
+			if err == nil {
+				paths = append(paths, filepath.Join(dir, Cert))
+				err = writeCert(filepath.Join(dir, Cert))
+			}
+		case Squashfs:
+			err = WriteSquashfs(path)
+		default:
+			err = fmt.Errorf("unknown fixture %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("creating %s: %w", name, err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// writeCert writes the certificate of the test key to path
+func writeCert(path string) error {
+	_, cert, err := KeyPair()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+}
+
+// kernel returns the placeholder kernel, a few bytes named after it
+func kernel() []byte {
+	return []byte("enki fixture kernel " + uname + "\n")
+}
+
+// initrd returns the placeholder initrd
+func initrd() []byte {
+	return []byte("enki fixture initrd\n")
+}
+
+// rootfs returns the files of the rootfs by their paths, a Kairos like tree with RootfsSize bytes
+// of data that doesn't compress
+func rootfs() map[string][]byte {
+	data := make([]byte, RootfsSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	return map[string][]byte{
+		"etc/os-release":                      []byte(OSRelease),
+		"etc/kairos-release":                  []byte(OSRelease),
+		"boot/vmlinuz-" + uname:               kernel(),
+		"boot/initrd-" + uname:                initrd(),
+		"usr/lib/modules/" + uname + "/.keep": nil,
+		"usr/share/enki/fixture.bin":          data,
+	}
+}
+
+// writeTree writes files into dir, dated Epoch like the dirs holding them
+func writeTree(dir string, files map[string][]byte) error {
+	for path, data := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		// Regardless of the umask
+		if err := os.Chmod(path, 0644); err != nil {
+			return err
+		}
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err = os.Chmod(path, 0755); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(path, Epoch, Epoch)
+	})
+}
+
+// WriteSquashfs writes the rootfs as a gzip compressed squashfs to path
+func WriteSquashfs(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fs, err := squashfs.Create(f, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(fs.Workspace())
+	if err = writeTree(fs.Workspace(), rootfs()); err != nil {
+		return err
+	}
+	root := uint32(0)
+	if err = fs.Finalize(squashfs.FinalizeOptions{Compression: &squashfs.CompressorGzip{}, FileUID: &root, FileGID: &root}); err != nil {
+		return err
+	}
+	// The superblock is dated when it's written, its modification time follows its magic,
+	// inode count and compression
+	date := make([]byte, 4)
+	binary.LittleEndian.PutUint32(date, uint32(Epoch.Unix()))
+	if _, err = f.WriteAt(date, 8); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// WriteUKI writes the signed toy UKI to path, with the sections ukify adds
+func WriteUKI(path string) error {
+	key, cert, err := KeyPair()
+	if err != nil {
+		return err
+	}
+	data, err := sign(buildPE([]section{
+		{".osrel", []byte(OSRelease)},
+		{".cmdline", []byte(Cmdline)},
+		{".uname", []byte(uname)},
+		{".linux", kernel()},
+		{".initrd", initrd()},
+	}), key, cert)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// WriteISO writes the live ISO to path, with the kernel, the initrd and the rootfs squashfs at the
+// paths of the ISOs of build-iso. It has no bootloader.
+func WriteISO(path string) error {
+	root, err := os.MkdirTemp("", "enki-fixture-iso-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	files := map[string][]byte{
+		constants.IsoKernelPath: kernel(),
+		constants.IsoInitrdPath: initrd(),
+	}
+	if err = writeTree(root, files); err != nil {
+		return err
+	}
+	if err = WriteSquashfs(filepath.Join(root, constants.IsoRootFile)); err != nil {
+		return err
+	}
+	if err = writeTree(root, nil); err != nil {
+		return err
+	}
+	engine, err := iso.NewEngine(iso.EngineNative, &v1.RealRunner{Logger: v1.NewNullLogger()})
+	if err != nil {
+		return err
+	}
+	if err = engine.Create(iso.Options{Root: root, Output: path, VolumeID: constants.ISOLabel, RockRidge: true}); err != nil {
+		return err
+	}
+	if err = datePVD(path); err != nil {
+		return err
+	}
+	return dateRockRidge(path)
+}
+
+// The dates of the primary volume descriptor, which the ISO9660 writer sets to the time it's
+// written: creation, modification, expiration and effective
+const (
+	pvdOffset = 16 * 2048
+	pvdDates  = 813
+	pvdDate   = 17
+)
+
+// datePVD dates the volume of the ISO at path Epoch
+func datePVD(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Digits of the date and its hundredths of seconds, and its offset from GMT
+	date := append([]byte(Epoch.Format("20060102150405")+"00"), 0)
+	dates := bytes.Repeat(date, 4)
+	if _, err = f.WriteAt(dates, pvdOffset+pvdDates); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// The directory records of ISO9660, and the Rock Ridge TF entries of their system use areas
+const (
+	sectorSize     = 2048
+	pvdRootRecord  = 156
+	recordExtent   = 2
+	recordLength   = 10
+	recordFlags    = 25
+	recordNameLen  = 32
+	recordName     = 33
+	flagDirectory  = 2
+	rrTimestampLen = 7
+)
+
+// dateRockRidge dates the Rock Ridge timestamps of the ISO at path Epoch. The writer takes them
+// from the files it packs, and their access and attribute change times can't be set back.
+func dateRockRidge(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	date := []byte{byte(Epoch.Year() - 1900), byte(Epoch.Month()), byte(Epoch.Day()), byte(Epoch.Hour()), byte(Epoch.Minute()), byte(Epoch.Second()), 0}
+	root := data[pvdOffset+pvdRootRecord:]
+	pending := []uint32{binary.LittleEndian.Uint32(root[recordExtent:])}
+	sizes := []uint32{binary.LittleEndian.Uint32(root[recordLength:])}
+	visited := map[uint32]bool{}
+	for len(pending) > 0 {
+		extent, size := pending[0], sizes[0]
+		pending, sizes = pending[1:], sizes[1:]
+		if visited[extent] {
+			continue
+		}
+		visited[extent] = true
+		dir := data[int(extent)*sectorSize : int(extent)*sectorSize+int(size)]
+		for offset := 0; offset < len(dir); {
+			length := int(dir[offset])
+			if length == 0 {
+				// Records don't cross sectors, the rest of the sector is padding
+				offset = (offset/sectorSize + 1) * sectorSize
+				continue
+			}
+			record := dir[offset : offset+length]
+			nameLen := int(record[recordNameLen])
+			// The system use area follows the name, padded to an even offset
+			use := record[recordName+nameLen+(nameLen+1)%2:]
+			for len(use) >= 4 && use[2] >= 4 && int(use[2]) <= len(use) {
+				entry := use[:use[2]]
+				if string(entry[:2]) == "TF" {
+					for stamp := 5; stamp+rrTimestampLen <= len(entry); stamp += rrTimestampLen {
+						copy(entry[stamp:], date)
+					}
+				}
+				use = use[len(entry):]
+			}
+			// . and .. are named 0 and 1
+			if record[recordFlags]&flagDirectory != 0 && !(nameLen == 1 && record[recordName] <= 1) {
+				pending = append(pending, binary.LittleEndian.Uint32(record[recordExtent:]))
+				sizes = append(sizes, binary.LittleEndian.Uint32(record[recordLength:]))
+			}
+			offset += length
+		}
+	}
+	return os.WriteFile(path, data, 0644)
+}
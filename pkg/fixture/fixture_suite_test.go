@@ -0,0 +1,13 @@
+package fixture_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestFixture(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fixture test suite")
+}
@@ -0,0 +1,121 @@
+package fixture_test
+
+import (
+	"crypto/x509"
+	"debug/pe"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/fixture"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write", Label("fixture"), func() {
+	var dir string
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("creates the same bytes on every run", func() {
+		first, err := fixture.Write(filepath.Join(dir, "first"))
+		Expect(err).ToNot(HaveOccurred())
+		// In another second, the dates of the files packed don't leak into the fixtures
+		time.Sleep(time.Second)
+		second, err := fixture.Write(filepath.Join(dir, "second"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first).To(HaveLen(len(fixture.Names()) + 1))
+		for i := range first {
+			Expect(filepath.Base(first[i])).To(Equal(filepath.Base(second[i])))
+			a, err := os.ReadFile(first[i])
+			Expect(err).ToNot(HaveOccurred())
+			b, err := os.ReadFile(second[i])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a).To(Equal(b), filepath.Base(first[i]))
+		}
+	})
+
+	It("creates only the given fixtures", func() {
+		paths, err := fixture.Write(dir, fixture.Squashfs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(paths).To(Equal([]string{filepath.Join(dir, fixture.Squashfs)}))
+		_, err = fixture.Write(dir, "disk.raw")
+		Expect(err).To(MatchError(ContainSubstring(`unknown fixture "disk.raw"`)))
+	})
+
+	It("creates a squashfs of the rootfs", func() {
+		path := filepath.Join(dir, fixture.Squashfs)
+		Expect(fixture.WriteSquashfs(path)).To(Succeed())
+		info, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically(">=", fixture.RootfsSize))
+
+		f, err := os.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		fs, err := squashfs.Read(f, info.Size(), 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		release, err := fs.OpenFile("/etc/os-release", os.O_RDONLY)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := io.ReadAll(release)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(fixture.OSRelease))
+	})
+
+	It("creates a UKI signed with the fixture key", func() {
+		paths, err := fixture.Write(dir, fixture.UKI)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(paths).To(ConsistOf(filepath.Join(dir, fixture.UKI), filepath.Join(dir, fixture.Cert)))
+		uki := filepath.Join(dir, fixture.UKI)
+
+		bin, err := pe.Open(uki)
+		Expect(err).ToNot(HaveOccurred())
+		defer bin.Close()
+		cmdline := bin.Section(".cmdline")
+		Expect(cmdline).ToNot(BeNil())
+		data, err := cmdline.Data()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data[:cmdline.VirtualSize])).To(Equal(fixture.Cmdline))
+		for _, name := range []string{".osrel", ".uname", ".linux", ".initrd"} {
+			Expect(bin.Section(name)).ToNot(BeNil(), name)
+		}
+
+		data, err = os.ReadFile(filepath.Join(dir, fixture.Cert))
+		Expect(err).ToNot(HaveOccurred())
+		block, _ := pem.Decode(data)
+		Expect(block).ToNot(BeNil())
+		cert, err := x509.ParseCertificate(block.Bytes)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cert.NotBefore).To(Equal(fixture.Epoch))
+		sigs, err := secureboot.Signatures(uki, map[string]*x509.Certificate{"db": cert})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sigs).To(HaveLen(1))
+		Expect(sigs[0].Key).To(Equal("db"))
+	})
+
+	It("creates an ISO with the artifacts of build-iso", func() {
+		path := filepath.Join(dir, fixture.ISO)
+		Expect(fixture.WriteISO(path)).To(Succeed())
+		disk, err := diskfs.Open(path, diskfs.WithOpenMode(diskfs.ReadOnly))
+		Expect(err).ToNot(HaveOccurred())
+		fs, err := disk.GetFilesystem(0)
+		Expect(err).ToNot(HaveOccurred())
+		// The volume ID is padded with spaces
+		Expect(strings.TrimSpace(fs.Label())).To(Equal(constants.ISOLabel))
+		files, err := fs.ReadDir("/")
+		Expect(err).ToNot(HaveOccurred())
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		Expect(names).To(ContainElements("boot", constants.IsoRootFile))
+	})
+})
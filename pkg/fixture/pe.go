@@ -0,0 +1,184 @@
+package fixture
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+const (
+	fileAlignment    = 0x200
+	sectionAlignment = 0x1000
+	// sectionData is an initialized read-only data section, like the ones ukify adds
+	sectionData = pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ
+)
+
+// section is a named section of a PE binary
+type section struct {
+	name string
+	data []byte
+}
+
+// buildPE returns an x86_64 EFI application with the given sections, readable by debug/pe and
+// the Authenticode tools. It has no code, so it doesn't boot.
+func buildPE(sections []section) []byte {
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], uint32(len(dos)))
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	opt := pe.OptionalHeader64{
+		Magic:                 0x20b,
+		ImageBase:             0x10000000,
+		SectionAlignment:      sectionAlignment,
+		FileAlignment:         fileAlignment,
+		MajorSubsystemVersion: 1,
+		Subsystem:             pe.IMAGE_SUBSYSTEM_EFI_APPLICATION,
+		NumberOfRvaAndSizes:   16,
+	}
+	headers := buf.Len() + binary.Size(pe.FileHeader{}) + binary.Size(opt) + binary.Size(pe.SectionHeader32{})*len(sections)
+	opt.SizeOfHeaders = align(uint32(headers), fileAlignment)
+
+	var table []pe.SectionHeader32
+	offset, address := opt.SizeOfHeaders, align(opt.SizeOfHeaders, sectionAlignment)
+	for _, s := range sections {
+		header := pe.SectionHeader32{
+			VirtualSize:      uint32(len(s.data)),
+			VirtualAddress:   address,
+			SizeOfRawData:    align(uint32(len(s.data)), fileAlignment),
+			PointerToRawData: offset,
+			Characteristics:  sectionData,
+		}
+		copy(header.Name[:], s.name)
+		table = append(table, header)
+		opt.SizeOfInitializedData += header.SizeOfRawData
+		offset += header.SizeOfRawData
+		address += align(header.VirtualSize, sectionAlignment)
+	}
+	opt.SizeOfImage = address
+
+	_ = binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections:     uint16(len(sections)),
+		SizeOfOptionalHeader: uint16(binary.Size(opt)),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE | pe.IMAGE_FILE_LARGE_ADDRESS_AWARE,
+	})
+	_ = binary.Write(&buf, binary.LittleEndian, opt)
+	_ = binary.Write(&buf, binary.LittleEndian, table)
+	buf.Write(make([]byte, int(opt.SizeOfHeaders)-buf.Len()))
+	for i, s := range sections {
+		buf.Write(s.data)
+		buf.Write(make([]byte, int(table[i].SizeOfRawData)-len(s.data)))
+	}
+	return buf.Bytes()
+}
+
+// align rounds size up to a multiple of alignment
+func align(size, alignment uint32) uint32 {
+	return (size + alignment - 1) / alignment * alignment
+}
+
+// sign returns the PE binary with an Authenticode signature made with the key pair. Unlike sbsign
+// and go-uefi, which record when it was signed, the signature is dated Epoch so it's the same on
+// every run.
+func sign(data []byte, key *rsa.PrivateKey, cert *x509.Certificate) ([]byte, error) {
+	bin, err := authenticode.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing the binary: %w", err)
+	}
+	digest := sha256.Sum256(bin.HashContent.Bytes())
+	content, err := authenticode.CreateSpcIndirectDataContent(digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signedData(key, cert, content)
+	if err != nil {
+		return nil, err
+	}
+	if err = bin.AppendSignature(sig); err != nil {
+		return nil, err
+	}
+	return bin.Bytes(), nil
+}
+
+// signedData returns the PKCS #7 SignedData of the Authenticode content, as pkcs7.SignPKCS7 does
+// but dated Epoch. PKCS #1 v1.5 signatures are deterministic.
+func signedData(key *rsa.PrivateKey, cert *x509.Certificate, content []byte) ([]byte, error) {
+	contentDigest := sha256.Sum256(content)
+	attributes := (&pkcs7.Attributes{
+		ContentType:   authenticode.OIDSpcIndirectDataContent,
+		MessageDigest: contentDigest[:],
+		SigningTime:   Epoch,
+	}).Marshal()
+	attributesDigest := sha256.Sum256(attributes)
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, attributesDigest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algorithm := func(b *cryptobyte.Builder) {
+		b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+			b.AddASN1ObjectIdentifier(pkcs7.OIDDigestAlgorithmSHA256)
+			b.AddASN1NULL()
+		})
+	}
+	var b cryptobyte.Builder
+	// ContentInfo
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(pkcs7.OIDSignedData)
+		b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+			// SignedData
+			b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1Int64(1)
+				b.AddASN1(asn1.SET, sha256Algorithm)
+				b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(authenticode.OIDSpcIndirectDataContent)
+					b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddBytes(content)
+						})
+					})
+				})
+				b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+					b.AddBytes(cert.Raw)
+				})
+				// SignerInfos, a single one in Authenticode
+				b.AddASN1(asn1.SET, func(b *cryptobyte.Builder) {
+					b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+						b.AddASN1Int64(1)
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddBytes(cert.RawIssuer)
+							b.AddASN1BigInt(cert.SerialNumber)
+						})
+						sha256Algorithm(b)
+						// The authenticated attributes, as an IMPLICIT [0] instead of a SET
+						b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+							outer := cryptobyte.String(attributes)
+							var inner cryptobyte.String
+							outer.ReadASN1(&inner, asn1.SET)
+							b.AddBytes(inner)
+						})
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddASN1ObjectIdentifier(pkcs7.OIDEncryptionAlgorithmRSA)
+							b.AddASN1NULL()
+						})
+						b.AddASN1OctetString(sig)
+					})
+				})
+			})
+		})
+	})
+	return b.Bytes()
+}
@@ -0,0 +1,72 @@
+// Package flavor reads the build defaults a flavor ships in its image, so its maintainers can set
+// the branding, the cmdline and the prune rules of the artifacts built from it without every user
+// passing flags.
+package flavor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultsFile is the file of the source image with its build defaults, relative to its root
+const DefaultsFile = "etc/kairos/enki-defaults.yaml"
+
+// Defaults are the build-uki settings of the source image, used for the ones not given with flags
+// or the config file. They are expanded like the flags, so they can use the release values.
+type Defaults struct {
+	BootBranding  string   `yaml:"boot-branding,omitempty"`
+	ExtendCmdline string   `yaml:"extend-cmdline,omitempty"`
+	ExtraCmdline  []string `yaml:"extra-cmdline,omitempty"`
+	Prune         []string `yaml:"prune,omitempty"`
+}
+
+// Read returns the defaults of the rootfs at root, nil if it ships none. It fails on unknown keys,
+// so a typo of the flavor maintainers doesn't go unnoticed.
+func Read(fsys v1.FS, root string) (*Defaults, error) {
+	data, err := fsys.ReadFile(filepath.Join(root, DefaultsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d Defaults
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&d); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid %s: %w", DefaultsFile, err)
+	}
+	if _, err := utils.GetPruneRules(d.Prune); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", DefaultsFile, err)
+	}
+	return &d, nil
+}
+
+// Settings returns the settings the defaults set, by their flag names
+func (d *Defaults) Settings() map[string]any {
+	settings := map[string]any{}
+	if d == nil {
+		return settings
+	}
+	if d.BootBranding != "" {
+		settings["boot-branding"] = d.BootBranding
+	}
+	if d.ExtendCmdline != "" {
+		settings["extend-cmdline"] = d.ExtendCmdline
+	}
+	if len(d.ExtraCmdline) > 0 {
+		settings["extra-cmdline"] = d.ExtraCmdline
+	}
+	if len(d.Prune) > 0 {
+		settings["prune"] = d.Prune
+	}
+	return settings
+}
@@ -0,0 +1,51 @@
+package flavor_test
+
+import (
+	"github.com/kairos-io/enki/pkg/flavor"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Defaults", Label("flavor"), func() {
+	It("reads the defaults of the source image", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/rootfs/" + flavor.DefaultsFile: "boot-branding: Kairos {{.flavor}}\nextra-cmdline:\n  - rd.debug\nprune:\n  - docs\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		defaults, err := flavor.Read(fs, "/rootfs")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(defaults.Settings()).To(Equal(map[string]any{
+			"boot-branding": "Kairos {{.flavor}}",
+			"extra-cmdline": []string{"rd.debug"},
+			"prune":         []string{"docs"},
+		}))
+	})
+
+	It("is empty without defaults", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{"/rootfs/etc/kairos": &vfst.Dir{Perm: 0o755}})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		defaults, err := flavor.Read(fs, "/rootfs")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(defaults).To(BeNil())
+		Expect(defaults.Settings()).To(BeEmpty())
+	})
+
+	It("rejects unknown settings and prune profiles", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/typo/" + flavor.DefaultsFile:  "boot-brandng: Kairos\n",
+			"/prune/" + flavor.DefaultsFile: "prune: [nothing]\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		_, err = flavor.Read(fs, "/typo")
+		Expect(err).To(MatchError(ContainSubstring("field boot-brandng not found")))
+		_, err = flavor.Read(fs, "/prune")
+		Expect(err).To(MatchError(ContainSubstring(`unknown prune profile "nothing"`)))
+	})
+})
@@ -0,0 +1,13 @@
+package flavor_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestFlavor(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Flavor test suite")
+}
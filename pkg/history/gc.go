@@ -0,0 +1,156 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// leftoverPrefixes are the names of the temporary files and dirs enki leaves in the temp dir
+// when it is interrupted
+var leftoverPrefixes = []string{"enki-", "sbctl-custom-certs-"}
+
+// GCOptions tell what enki gc prunes
+type GCOptions struct {
+	// TempDirs are where the leftovers are looked for, the temp dir and the dirs of the work
+	// areas on tmpfs and disk
+	TempDirs []string
+	// OlderThan is the age of the leftovers of unknown builds to prune, as they could belong to
+	// a command still running
+	OlderThan time.Duration
+	// MaxSize prunes the oldest leftovers until they take less than it, 0 keeps them all
+	MaxSize int64
+	// DryRun only returns what would be pruned
+	DryRun bool
+}
+
+// Leftover is a workdir or temporary file found by GC
+type Leftover struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Build is the id of the build it belongs to, empty if it is not in the history
+	Build string
+}
+
+// GC removes the workdirs and work areas of the builds that were interrupted, and the temporary files of enki
+// older than opts.OlderThan or beyond opts.MaxSize. The builds still running are never
+// touched. Without a history, db is nil, only the temporary files are pruned. It returns what it
+// removed, the oldest first.
+func GC(fs v1.FS, db *DB, opts GCOptions) ([]Leftover, error) {
+	var entries []Entry
+	if db != nil {
+		var err error
+		if entries, err = db.Entries(); err != nil {
+			return nil, err
+		}
+	}
+	running := map[string]bool{}
+	owner := map[string]Entry{}
+	for _, e := range entries {
+		dirs := e.WorkAreas
+		if e.Workdir != "" {
+			dirs = append([]string{e.Workdir}, dirs...)
+		}
+		for _, dir := range dirs {
+			if e.Running() {
+				running[dir] = true
+			} else {
+				owner[dir] = e
+			}
+		}
+	}
+
+	now := time.Now()
+	var candidates, removed []Leftover
+	var total int64
+	seen := map[string]bool{}
+	for _, dir := range opts.TempDirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		files, err := fs.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, info := range files {
+			path := filepath.Join(dir, info.Name())
+			if running[path] || !hasLeftoverPrefix(info.Name()) {
+				continue
+			}
+			l := Leftover{Path: path, Size: info.Size(), ModTime: info.ModTime(), Build: owner[path].ID}
+			if info.IsDir() {
+				var err error
+				if l.Size, err = utils.DirSize(fs, path); err != nil {
+					continue
+				}
+			}
+			// The workdirs of interrupted builds are known to be unused whatever their age
+			if l.Build != "" || now.Sub(l.ModTime) > opts.OlderThan {
+				removed = append(removed, l)
+				continue
+			}
+			candidates = append(candidates, l)
+			total += l.Size
+		}
+	}
+	if opts.MaxSize > 0 {
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].ModTime.Before(candidates[j].ModTime) })
+		for _, l := range candidates {
+			if total <= opts.MaxSize {
+				break
+			}
+			removed = append(removed, l)
+			total -= l.Size
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].ModTime.Before(removed[j].ModTime) })
+	if opts.DryRun {
+		return removed, nil
+	}
+
+	pruned := map[string]bool{}
+	for _, l := range removed {
+		if err := fs.RemoveAll(l.Path); err != nil {
+			return nil, err
+		}
+		pruned[l.Path] = true
+	}
+	if db == nil {
+		return removed, nil
+	}
+	// Record the interrupted builds as such, without the workdirs and work areas that are gone
+	return removed, db.Update(func(entries []Entry) []Entry {
+		for i, e := range entries {
+			if e.Status == StatusRunning && !e.Running() {
+				entries[i].Status = StatusInterrupted
+			}
+			if pruned[e.Workdir] {
+				entries[i].Workdir = ""
+			}
+			var left []string
+			for _, area := range e.WorkAreas {
+				if !pruned[area] {
+					left = append(left, area)
+				}
+			}
+			entries[i].WorkAreas = left
+		}
+		return entries
+	})
+}
+
+func hasLeftoverPrefix(name string) bool {
+	for _, prefix := range leftoverPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+// Package history keeps a small local record of the builds, what they built from, when, and
+// where their artifacts and workdirs are, so the leftovers of interrupted builds can be found
+// and pruned later with enki gc.
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/workdir"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultPath is where the history is kept unless set with --history-file
+	DefaultPath = "/var/lib/enki/history.json"
+	// MaxEntries is how many builds the history keeps, the oldest ones are dropped first
+	MaxEntries = 200
+	// WorkdirPrefix is the prefix of the workdirs of the builds in the temp dir, and of their work
+	// areas on tmpfs and disk
+	WorkdirPrefix = "enki-build-"
+)
+
+// Status of a build
+const (
+	StatusRunning     = "running"
+	StatusSucceeded   = "succeeded"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted"
+)
+
+// Entry is a build of the history
+type Entry struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	Source  string `json:"source"`
+	// OutputDir is where the artifacts were written, and Artifacts their paths
+	OutputDir string   `json:"output_dir"`
+	Artifacts []string `json:"artifacts,omitempty"`
+	// Workdir holds the temporary files of the build, empty once removed
+	Workdir string `json:"workdir,omitempty"`
+	// WorkAreas hold the work areas of the stages placed on tmpfs or disk, the ones not removed yet
+	WorkAreas []string  `json:"work_areas,omitempty"`
+	PID       int       `json:"pid"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+}
+
+// Running tells if the build is still going on, as builds killed before finishing are left
+// as running in the history
+func (e Entry) Running() bool {
+	if e.Status != StatusRunning {
+		return false
+	}
+	return unix.Kill(e.PID, 0) == nil
+}
+
+// DB is the history file. Concurrent builds update it under a lock.
+type DB struct {
+	fs   v1.FS
+	path string
+}
+
+// Open returns the history kept in path
+func Open(fs v1.FS, path string) *DB {
+	return &DB{fs: fs, path: path}
+}
+
+// Entries returns the builds of the history, the oldest first
+func (db *DB) Entries() ([]Entry, error) {
+	data, err := db.fs.ReadFile(db.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid build history %s: %w", db.path, err)
+	}
+	return entries, nil
+}
+
+// Update replaces the builds of the history with the ones fn returns, keeping the last
+// MaxEntries
+func (db *DB) Update(fn func([]Entry) []Entry) error {
+	if err := utils.MkdirAll(db.fs, filepath.Dir(db.path), 0755); err != nil {
+		return err
+	}
+	lock, err := db.fs.OpenFile(db.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN) //nolint:errcheck
+
+	entries, err := db.Entries()
+	if err != nil {
+		return err
+	}
+	entries = fn(entries)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Started.Before(entries[j].Started) })
+	if len(entries) > MaxEntries {
+		entries = entries[len(entries)-MaxEntries:]
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Readers don't take the lock, the history is replaced at once for them
+	tmp := db.path + ".tmp"
+	if err := db.fs.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	rawTmp, err := db.fs.RawPath(tmp)
+	if err != nil {
+		return err
+	}
+	rawPath, err := db.fs.RawPath(db.path)
+	if err != nil {
+		return err
+	}
+	return os.Rename(rawTmp, rawPath)
+}
+
+// Outputs collects the paths of the artifacts a build writes, as the build writes them. A nil
+// Outputs is valid and collects nothing.
+type Outputs struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// Add records the given artifacts, once each
+func (o *Outputs) Add(paths ...string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, p := range paths {
+		if !slices.Contains(o.paths, p) {
+			o.paths = append(o.paths, p)
+		}
+	}
+}
+
+// Paths returns the recorded artifacts, in the order they were written
+func (o *Outputs) Paths() []string {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.paths)
+}
+
+// Build is a build being recorded in the history
+type Build struct {
+	db      *DB
+	entry   Entry
+	outputs *Outputs
+	tmpDir  string
+	hadTemp bool
+}
+
+// Begin records the start of a build and moves the temp dir into a workdir of its own, so
+// everything the build and the tools it runs leave behind can be found if it is interrupted.
+func Begin(db *DB, command, source, outputDir string) (*Build, error) {
+	now := time.Now()
+	entry := Entry{
+		ID:        strconv.FormatInt(now.UnixNano(), 36),
+		Command:   command,
+		Source:    source,
+		OutputDir: outputDir,
+		PID:       os.Getpid(),
+		Status:    StatusRunning,
+		Started:   now,
+	}
+	b := &Build{db: db, entry: entry, outputs: &Outputs{}}
+	b.tmpDir, b.hadTemp = os.LookupEnv("TMPDIR")
+	workdir := filepath.Join(os.TempDir(), WorkdirPrefix+entry.ID)
+	if err := os.MkdirAll(workdir, 0700); err != nil {
+		return nil, err
+	}
+	b.entry.Workdir = workdir
+	if err := db.Update(func(entries []Entry) []Entry { return append(entries, b.entry) }); err != nil {
+		_ = os.RemoveAll(workdir)
+		return nil, err
+	}
+	_ = os.Setenv("TMPDIR", workdir)
+	return b, nil
+}
+
+// Place creates a work area of the build in each parent dir of placement and returns the
+// placement of the stages in them, so the work areas of the running build are known to GC.
+// The stages in the temp dir are kept there, it already is the workdir of the build.
+func (b *Build) Place(placement workdir.Placement) (workdir.Placement, error) {
+	placed := workdir.Placement{}
+	for stage, dir := range placement {
+		if dir == "" {
+			placed[stage] = dir
+			continue
+		}
+		area := filepath.Join(dir, WorkdirPrefix+b.entry.ID)
+		if !slices.Contains(b.entry.WorkAreas, area) {
+			if err := os.MkdirAll(area, 0700); err != nil {
+				return nil, err
+			}
+			b.entry.WorkAreas = append(b.entry.WorkAreas, area)
+		}
+		placed[stage] = area
+	}
+	return placed, b.db.Update(func(entries []Entry) []Entry {
+		for i := range entries {
+			if entries[i].ID == b.entry.ID {
+				entries[i].WorkAreas = b.entry.WorkAreas
+			}
+		}
+		return entries
+	})
+}
+
+// Outputs returns where the build records the artifacts it writes
+func (b *Build) Outputs() *Outputs {
+	return b.outputs
+}
+
+// Finish records the outcome of the build and the artifacts it wrote, and removes its workdir
+// and work areas
+func (b *Build) Finish(buildErr error) error {
+	if b.hadTemp {
+		_ = os.Setenv("TMPDIR", b.tmpDir)
+	} else {
+		_ = os.Unsetenv("TMPDIR")
+	}
+	b.entry.Finished = time.Now()
+	b.entry.Status = StatusSucceeded
+	if buildErr != nil {
+		b.entry.Status = StatusFailed
+		b.entry.Error = buildErr.Error()
+	}
+	b.entry.Artifacts = b.outputs.Paths()
+	if err := os.RemoveAll(b.entry.Workdir); err == nil {
+		b.entry.Workdir = ""
+	}
+	var left []string
+	for _, area := range b.entry.WorkAreas {
+		if err := os.RemoveAll(area); err != nil {
+			left = append(left, area)
+		}
+	}
+	b.entry.WorkAreas = left
+	return b.db.Update(func(entries []Entry) []Entry {
+		for i := range entries {
+			if entries[i].ID == b.entry.ID {
+				entries[i] = b.entry
+				return entries
+			}
+		}
+		return append(entries, b.entry)
+	})
+}
@@ -0,0 +1,157 @@
+package history_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/history"
+	"github.com/kairos-io/enki/pkg/workdir"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs"
+)
+
+var _ = Describe("History", Label("history"), func() {
+	var tmpDir, outputDir string
+	var db *history.DB
+
+	BeforeEach(func() {
+		tmpDir = GinkgoT().TempDir()
+		outputDir = GinkgoT().TempDir()
+		previous, had := os.LookupEnv("TMPDIR")
+		Expect(os.Setenv("TMPDIR", tmpDir)).To(Succeed())
+		DeferCleanup(func() {
+			if had {
+				os.Setenv("TMPDIR", previous)
+			} else {
+				os.Unsetenv("TMPDIR")
+			}
+		})
+		db = history.Open(vfs.OSFS, filepath.Join(GinkgoT().TempDir(), "enki", "history.json"))
+	})
+
+	It("records the builds with their artifacts, in a workdir of their own", func() {
+		build, err := history.Begin(db, "build-iso", "docker://quay.io/kairos/ubuntu:24.04", outputDir)
+		Expect(err).ToNot(HaveOccurred())
+		workdir, err := os.MkdirTemp("", "enki-iso")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Dir(workdir)).To(HavePrefix(filepath.Join(tmpDir, history.WorkdirPrefix)))
+		Expect(os.WriteFile(filepath.Join(outputDir, "kairos.iso"), []byte("iso"), 0644)).To(Succeed())
+		build.Outputs().Add(filepath.Join(outputDir, "kairos.iso"))
+		build.Outputs().Add(filepath.Join(outputDir, "kairos.iso"))
+		// Files written to the output dir by anything else are not artifacts of the build
+		Expect(os.WriteFile(filepath.Join(outputDir, "notes.txt"), []byte("notes"), 0644)).To(Succeed())
+
+		entries, err := db.Entries()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Status).To(Equal(history.StatusRunning))
+		Expect(entries[0].Running()).To(BeTrue())
+
+		Expect(build.Finish(errors.New("xorriso failed"))).To(Succeed())
+		Expect(os.TempDir()).To(Equal(tmpDir))
+		Expect(filepath.Dir(workdir)).ToNot(BeADirectory())
+		entries, err = db.Entries()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].Status).To(Equal(history.StatusFailed))
+		Expect(entries[0].Error).To(Equal("xorriso failed"))
+		Expect(entries[0].Workdir).To(BeEmpty())
+		Expect(entries[0].Artifacts).To(Equal([]string{filepath.Join(outputDir, "kairos.iso")}))
+	})
+
+	It("places the work areas on tmpfs and disk in dirs of the build, spared by GC while it runs", func() {
+		diskDir := GinkgoT().TempDir()
+		build, err := history.Begin(db, "build-uki", "docker://quay.io/kairos/ubuntu:24.04", outputDir)
+		Expect(err).ToNot(HaveOccurred())
+		placed, err := build.Place(workdir.Placement{workdir.Rootfs: diskDir, workdir.Artifacts: diskDir, workdir.Media: ""})
+		Expect(err).ToNot(HaveOccurred())
+		area := placed[workdir.Rootfs]
+		Expect(filepath.Dir(area)).To(Equal(diskDir))
+		Expect(placed[workdir.Artifacts]).To(Equal(area))
+		Expect(placed[workdir.Media]).To(BeEmpty())
+		rootfs, err := os.MkdirTemp(area, "enki-build-uki-")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(rootfs, "vmlinuz"), make([]byte, 4096), 0644)).To(Succeed())
+		old := time.Now().Add(-48 * time.Hour)
+		Expect(os.Chtimes(area, old, old)).To(Succeed())
+
+		entries, err := db.Entries()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].WorkAreas).To(Equal([]string{area}))
+		removed, err := history.GC(vfs.OSFS, db, history.GCOptions{TempDirs: []string{tmpDir, diskDir}, MaxSize: 1})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(BeEmpty())
+		Expect(filepath.Join(rootfs, "vmlinuz")).To(BeARegularFile())
+
+		Expect(build.Finish(nil)).To(Succeed())
+		Expect(area).ToNot(BeADirectory())
+		entries, err = db.Entries()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].WorkAreas).To(BeEmpty())
+	})
+
+	It("prunes the work areas of interrupted builds", func() {
+		diskDir := GinkgoT().TempDir()
+		area := filepath.Join(diskDir, history.WorkdirPrefix+"killed")
+		Expect(os.MkdirAll(filepath.Join(area, "enki-build-uki-1234"), 0755)).To(Succeed())
+		Expect(db.Update(func(entries []history.Entry) []history.Entry {
+			return append(entries, history.Entry{ID: "killed", WorkAreas: []string{area}, PID: 1 << 22, Status: history.StatusRunning, Started: time.Now()})
+		})).To(Succeed())
+
+		removed, err := history.GC(vfs.OSFS, db, history.GCOptions{TempDirs: []string{tmpDir, diskDir}, OlderThan: 24 * time.Hour})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(HaveLen(1))
+		Expect(removed[0].Build).To(Equal("killed"))
+		Expect(area).ToNot(BeADirectory())
+		entries, err := db.Entries()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].WorkAreas).To(BeEmpty())
+	})
+
+	It("prunes the workdirs of interrupted builds and the old temporary files", func() {
+		interrupted := filepath.Join(tmpDir, history.WorkdirPrefix+"killed")
+		Expect(os.MkdirAll(filepath.Join(interrupted, "enki-iso1234"), 0755)).To(Succeed())
+		Expect(db.Update(func(entries []history.Entry) []history.Entry {
+			// No process gets the max pid, the build is not running anymore
+			return append(entries, history.Entry{ID: "killed", Workdir: interrupted, PID: 1 << 22, Status: history.StatusRunning, Started: time.Now()})
+		})).To(Succeed())
+		old := filepath.Join(tmpDir, "enki-resign-old")
+		Expect(os.MkdirAll(old, 0755)).To(Succeed())
+		Expect(os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))).To(Succeed())
+		recent := filepath.Join(tmpDir, "enki-signatures-recent")
+		Expect(os.MkdirAll(recent, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpDir, "unrelated"), []byte("keep"), 0644)).To(Succeed())
+
+		removed, err := history.GC(vfs.OSFS, db, history.GCOptions{TempDirs: []string{tmpDir}, OlderThan: 24 * time.Hour, DryRun: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(HaveLen(2))
+		Expect(interrupted).To(BeADirectory())
+
+		removed, err = history.GC(vfs.OSFS, db, history.GCOptions{TempDirs: []string{tmpDir}, OlderThan: 24 * time.Hour})
+		Expect(err).ToNot(HaveOccurred())
+		Expect([]string{removed[0].Path, removed[1].Path}).To(Equal([]string{old, interrupted}))
+		Expect(interrupted).ToNot(BeADirectory())
+		Expect(recent).To(BeADirectory())
+		Expect(filepath.Join(tmpDir, "unrelated")).To(BeARegularFile())
+		entries, err := db.Entries()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].Status).To(Equal(history.StatusInterrupted))
+		Expect(entries[0].Workdir).To(BeEmpty())
+	})
+
+	It("prunes the oldest temporary files beyond the size budget", func() {
+		for i, name := range []string{"enki-a", "enki-b", "enki-c"} {
+			path := filepath.Join(tmpDir, name)
+			Expect(os.WriteFile(path, make([]byte, 1024), 0644)).To(Succeed())
+			age := time.Now().Add(-time.Duration(3-i) * time.Hour)
+			Expect(os.Chtimes(path, age, age)).To(Succeed())
+		}
+		removed, err := history.GC(vfs.OSFS, nil, history.GCOptions{TempDirs: []string{tmpDir}, OlderThan: 24 * time.Hour, MaxSize: 1500})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(HaveLen(2))
+		Expect(removed[0].Path).To(Equal(filepath.Join(tmpDir, "enki-a")))
+		Expect(filepath.Join(tmpDir, "enki-c")).To(BeARegularFile())
+	})
+})
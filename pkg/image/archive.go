@@ -0,0 +1,146 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kairos-io/enki/pkg/mirror"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdk "github.com/kairos-io/kairos-sdk/utils"
+)
+
+const (
+	// Stdin is the source argument reading a docker save archive from stdin
+	Stdin = "-"
+	// untaggedRef is the reference of archive images saved by id, without a tag
+	untaggedRef = "stdin/image:latest"
+)
+
+// Archive is a docker save archive spooled to disk, as loading its image needs random access
+// to find the manifest, which docker writes last
+type Archive struct {
+	Path string
+	// Ref is the reference the image of the archive is used as, its first tag if it has any
+	Ref string
+	tag *name.Tag
+}
+
+// SpoolArchive writes the docker save archive read from r into a temporary file. Its first image
+// is used, which must be tagged if the archive holds several.
+func SpoolArchive(r io.Reader) (*Archive, error) {
+	f, err := os.CreateTemp("", "enki-source-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	archive := &Archive{Path: f.Name(), Ref: untaggedRef}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		archive.Remove()
+		return nil, fmt.Errorf("reading the source archive: %w", err)
+	}
+	manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return os.Open(archive.Path) })
+	if err == nil && len(manifest) == 0 {
+		err = fmt.Errorf("it has no images")
+	}
+	if err != nil {
+		archive.Remove()
+		return nil, fmt.Errorf("invalid docker save archive: %w", err)
+	}
+	if len(manifest[0].RepoTags) > 0 {
+		tag, err := name.NewTag(manifest[0].RepoTags[0])
+		if err != nil {
+			archive.Remove()
+			return nil, fmt.Errorf("invalid tag in the source archive: %w", err)
+		}
+		archive.tag = &tag
+		archive.Ref = manifest[0].RepoTags[0]
+	}
+	return archive, nil
+}
+
+// Image returns the image of the archive
+func (a *Archive) Image() (gcrv1.Image, error) {
+	return tarball.ImageFromPath(a.Path, a.tag)
+}
+
+// Digest returns the digest of the image of the archive
+func (a *Archive) Digest() (string, error) {
+	img, err := a.Image()
+	if err != nil {
+		return "", err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// Remove removes the spooled archive
+func (a *Archive) Remove() {
+	_ = os.Remove(a.Path)
+}
+
+// ArchiveExtractor extracts the image of the archive in place of its reference, and any other
+// image with the wrapped extractor
+type ArchiveExtractor struct {
+	Archive *Archive
+	Next    v1.ImageExtractor
+}
+
+var _ v1.ImageExtractor = ArchiveExtractor{}
+
+func (e ArchiveExtractor) ExtractImage(imageRef, destination, platformRef string) error {
+	if imageRef != e.Archive.Ref {
+		return e.Next.ExtractImage(imageRef, destination, platformRef)
+	}
+	img, err := e.Archive.Image()
+	if err != nil {
+		return err
+	}
+	return extract(img, destination)
+}
+
+func (e ArchiveExtractor) GetOCIImageSize(imageRef, platformRef string) (int64, error) {
+	if imageRef != e.Archive.Ref {
+		return e.Next.GetOCIImageSize(imageRef, platformRef)
+	}
+	img, err := e.Archive.Image()
+	if err != nil {
+		return 0, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, layer := range layers {
+		layerSize, err := layer.Size()
+		if err != nil {
+			return 0, err
+		}
+		size += layerSize
+	}
+	return size, nil
+}
+
+// GetImage returns the image of the archive in place of its reference, and any other image from
+// its registry, or its mirror
+func (e ArchiveExtractor) GetImage(imageRef, platformRef string) (gcrv1.Image, error) {
+	if imageRef != e.Archive.Ref {
+		return GetImage(imageRef, platformRef)
+	}
+	return e.Archive.Image()
+}
+
+// GetImage returns the image from its registry, or from its mirror
+func GetImage(imageRef, platformRef string) (gcrv1.Image, error) {
+	return sdk.GetImage(mirror.Image(imageRef), platformRef)
+}
@@ -0,0 +1,63 @@
+package image_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kairos-io/enki/pkg/image"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Archive", Label("archive"), func() {
+	var saved bytes.Buffer
+
+	BeforeEach(func() {
+		saved.Reset()
+		img, err := mutate.AppendLayers(empty.Image, layer(
+			&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "etc/kairos-release", Mode: 0644},
+		))
+		Expect(err).ToNot(HaveOccurred())
+		tag, err := name.NewTag("quay.io/kairos/ubuntu:24.04")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tarball.Write(tag, img, &saved)).To(Succeed())
+	})
+
+	It("extracts the image of the archive by its tag", func() {
+		archive, err := image.SpoolArchive(&saved)
+		Expect(err).ToNot(HaveOccurred())
+		defer archive.Remove()
+		Expect(archive.Ref).To(Equal("quay.io/kairos/ubuntu:24.04"))
+		digest, err := archive.Digest()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(digest).To(HavePrefix("sha256:"))
+
+		extractor := image.ArchiveExtractor{Archive: archive}
+		size, err := extractor.GetOCIImageSize(archive.Ref, "linux/amd64")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(size).To(BeNumerically(">", 0))
+		dest := GinkgoT().TempDir()
+		Expect(extractor.ExtractImage(archive.Ref, dest, "linux/amd64")).To(Succeed())
+		Expect(filepath.Join(dest, "etc", "kairos-release")).To(BeARegularFile())
+	})
+
+	It("removes the spooled archive", func() {
+		archive, err := image.SpoolArchive(&saved)
+		Expect(err).ToNot(HaveOccurred())
+		archive.Remove()
+		_, err = os.Stat(archive.Path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("rejects streams that are not docker save archives", func() {
+		_, err := image.SpoolArchive(bytes.NewReader([]byte("not an archive")))
+		Expect(err).To(MatchError(ContainSubstring("invalid docker save archive")))
+	})
+})
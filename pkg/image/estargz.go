@@ -0,0 +1,80 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containerd/containerd/archive"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdk "github.com/kairos-io/kairos-sdk/utils"
+)
+
+// estargzEntries are the entries eStargz layers hold at their root along with the files of the
+// image, their table of contents and the landmarks of the files to prefetch. Lazy pulling
+// snapshotters hide them, the plain tar readers extracting the layers don't.
+var estargzEntries = []string{"stargz.index.json", ".prefetch.landmark", ".no.prefetch.landmark"}
+
+// isEstargzEntry tells if the cleaned tar entry name is eStargz metadata rather than a file of
+// the image
+func isEstargzEntry(name string) bool {
+	return slices.Contains(estargzEntries, name)
+}
+
+// StripEstargz removes the eStargz metadata extracted into the root of dir, if any
+func StripEstargz(dir string) error {
+	for _, entry := range estargzEntries {
+		err := os.Remove(filepath.Join(dir, entry))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract extracts the layers of img into destination, zstd compressed ones as well, leaving out
+// the eStargz metadata
+func extract(img gcrv1.Image, destination string) error {
+	if err := sdk.ExtractOCIImage(img, destination); err != nil {
+		return err
+	}
+	return StripEstargz(destination)
+}
+
+// ExtractWithout extracts the layers of img into destination like extract, leaving out the paths,
+// relative to /, selected by skip. The files left out are never written, so they take neither
+// time nor scratch space.
+func ExtractWithout(img gcrv1.Image, destination string, skip func(path string) bool) error {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	_, err := archive.Apply(context.Background(), destination, rc, archive.WithFilter(func(hdr *tar.Header) (bool, error) {
+		name := cleanName(hdr.Name)
+		return !isEstargzEntry(name) && (name == "" || !skip(name)), nil
+	}))
+	return err
+}
+
+// EstargzExtractor is an image extractor leaving out the eStargz metadata of the images
+// extracted with Next
+type EstargzExtractor struct {
+	Next v1.ImageExtractor
+}
+
+var _ v1.ImageExtractor = EstargzExtractor{}
+
+func (e EstargzExtractor) ExtractImage(imageRef, destination, platformRef string) error {
+	if err := e.Next.ExtractImage(imageRef, destination, platformRef); err != nil {
+		return err
+	}
+	return StripEstargz(destination)
+}
+
+func (e EstargzExtractor) GetOCIImageSize(imageRef, platformRef string) (int64, error) {
+	return e.Next.GetOCIImageSize(imageRef, platformRef)
+}
@@ -0,0 +1,80 @@
+package image_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/kairos-io/enki/pkg/image"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Layer formats", Label("estargz", "zstd"), func() {
+	var img gcrv1.Image
+	BeforeEach(func() {
+		var err error
+		img, err = mutate.AppendLayers(empty.Image,
+			layerWith([]tarball.LayerOption{tarball.WithCompression(compression.ZStd), tarball.WithMediaType(types.OCILayerZStd)},
+				&tar.Header{Typeflag: tar.TypeDir, Name: "boot/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "boot/vmlinuz", Mode: 0644},
+			),
+			// Laid out like eStargz layers, the landmark first and the table of contents last
+			layer(
+				&tar.Header{Typeflag: tar.TypeReg, Name: ".no.prefetch.landmark", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeDir, Name: "usr/lib/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/os-release", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "stargz.index.json", Mode: 0644},
+			),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		layers, err := img.Layers()
+		Expect(err).ToNot(HaveOccurred())
+		mt, err := layers[0].MediaType()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mt).To(Equal(types.OCILayerZStd))
+	})
+
+	It("streams zstd and eStargz layers without the eStargz metadata", func() {
+		var out bytes.Buffer
+		Expect(image.Flatten(img, &out, image.StreamOptions{})).To(Succeed())
+		result := entries(out.Bytes())
+		Expect(result).To(HaveKey("boot/vmlinuz"))
+		Expect(result).To(HaveKey("usr/lib/os-release"))
+		Expect(result).ToNot(HaveKey("stargz.index.json"))
+		Expect(result).ToNot(HaveKey(".no.prefetch.landmark"))
+	})
+
+	It("extracts zstd and eStargz layers without the eStargz metadata", func() {
+		var saved bytes.Buffer
+		tag, err := name.NewTag("quay.io/kairos/ubuntu:24.04")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tarball.Write(tag, img, &saved)).To(Succeed())
+		archive, err := image.SpoolArchive(&saved)
+		Expect(err).ToNot(HaveOccurred())
+		defer archive.Remove()
+
+		dest := GinkgoT().TempDir()
+		Expect(image.ArchiveExtractor{Archive: archive}.ExtractImage(archive.Ref, dest, "linux/amd64")).To(Succeed())
+		Expect(filepath.Join(dest, "boot", "vmlinuz")).To(BeARegularFile())
+		Expect(filepath.Join(dest, "usr", "lib", "os-release")).To(BeARegularFile())
+		Expect(filepath.Join(dest, "stargz.index.json")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(dest, ".no.prefetch.landmark")).ToNot(BeAnExistingFile())
+	})
+
+	It("extracts the layers without the skipped paths", func() {
+		dest := GinkgoT().TempDir()
+		Expect(image.ExtractWithout(img, dest, image.PathFilter("boot"))).To(Succeed())
+		Expect(filepath.Join(dest, "boot")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(dest, "usr", "lib", "os-release")).To(BeARegularFile())
+		Expect(filepath.Join(dest, "stargz.index.json")).ToNot(BeAnExistingFile())
+	})
+})
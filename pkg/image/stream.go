@@ -0,0 +1,292 @@
+// Package image streams container images into their final artifacts without
+// materializing the rootfs on disk first.
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/kairos-io/enki/pkg/logging"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// tarSticky is the sticky bit in a tar header mode
+const tarSticky = 01000
+
+// Dir is a directory that must exist in the resulting rootfs
+type Dir struct {
+	Path string
+	Mode os.FileMode
+}
+
+// Fallback provides a host file for the rootfs when the image has none of the given Paths
+type Fallback struct {
+	// Paths are the rootfs paths, any of them being present in the image satisfies the fallback.
+	// Without Paths the fallback is always added, replacing the image file at Dest if any.
+	Paths []string
+	// Source is the host file to add when none of the Paths is in the image
+	Source string
+	// Dest is the rootfs path where Source is added
+	Dest string
+}
+
+// StreamOptions tunes how the flattened image is rewritten into the output stream
+type StreamOptions struct {
+	// CaptureDir receives a copy of the entries selected by Capture, so later build steps
+	// can read the few files they need (kernel, initrd, EFI binaries) from a real directory
+	CaptureDir string
+	// Capture selects which rootfs paths, relative to /, are copied into CaptureDir
+	Capture func(path string) bool
+	// Dirs are created at the end of the stream if the image didn't provide them
+	Dirs []Dir
+	// Fallbacks are added at the end of the stream, and into CaptureDir, if the image lacks them
+	Fallbacks []Fallback
+}
+
+// StreamToSquashFS flattens the layers of img and pipes them as a single tar stream into
+// mksquashfs, so the rootfs is never written to disk. It requires squashfs-tools 4.6 or newer
+// for the -tar option.
+func StreamToSquashFS(runner v1.Runner, img gcrv1.Image, dest string, squashOptions []string, opts StreamOptions) error {
+	args := []string{"-", dest, "-tar"}
+	for _, op := range squashOptions {
+		args = append(args, strings.Split(op, " ")...)
+	}
+	cmd := runner.InitCmd("mksquashfs", args...)
+	if cmd == nil {
+		return fmt.Errorf("could not initialize mksquashfs command")
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	logging.Module(runner.GetLogger(), logging.Squashfs).Debugf("Streaming image layers into mksquashfs %s", strings.Join(args, " "))
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	flattenErr := Flatten(img, stdin, opts)
+	closeErr := stdin.Close()
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return fmt.Errorf("mksquashfs failed: %w\n%s", waitErr, out.String())
+	}
+	if flattenErr != nil {
+		return fmt.Errorf("streaming image layers: %w", flattenErr)
+	}
+	return closeErr
+}
+
+// Flatten writes the merged filesystem of all the layers of img as a tar stream into w
+func Flatten(img gcrv1.Image, w io.Writer, opts StreamOptions) error {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	tw := tar.NewWriter(w)
+	seenDirs := map[string]bool{}
+	seenFallbacks := map[string]bool{}
+	fallbackPaths := map[string]bool{}
+	overrides := map[string]bool{}
+	for _, f := range opts.Fallbacks {
+		if len(f.Paths) == 0 {
+			overrides[cleanName(f.Dest)] = true
+		}
+		for _, p := range f.Paths {
+			fallbackPaths[cleanName(p)] = true
+		}
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		if name == "" || isEstargzEntry(name) || (overrides[name] && hdr.Typeflag != tar.TypeDir) {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			seenDirs[name] = true
+		} else if fallbackPaths[name] {
+			seenFallbacks[name] = true
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		var captured *os.File
+		if opts.Capture != nil && opts.Capture(name) {
+			captured, err = capture(opts.CaptureDir, name, hdr)
+			if err != nil {
+				return fmt.Errorf("capturing %s: %w", name, err)
+			}
+		}
+		if captured != nil {
+			_, err = io.Copy(tw, io.TeeReader(tr, captured))
+			if closeErr := captured.Close(); err == nil {
+				err = closeErr
+			}
+		} else {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, d := range opts.Dirs {
+		if err := addDir(tw, cleanName(d.Path), d.Mode, seenDirs); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range opts.Fallbacks {
+		satisfied := false
+		for _, p := range f.Paths {
+			if seenFallbacks[cleanName(p)] {
+				satisfied = true
+				break
+			}
+		}
+		if satisfied {
+			continue
+		}
+		if err := addFallback(tw, f, opts.CaptureDir, seenDirs); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// capture recreates the tar entry under dir. For regular files the returned file must receive
+// the entry contents.
+func capture(dir, name string, hdr *tar.Header) (*os.File, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	target := filepath.Join(dir, name)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return nil, os.MkdirAll(target, 0755)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		link := hdr.Linkname
+		// Absolute links would point to the host once captured, make them relative to the capture dir
+		if filepath.IsAbs(link) {
+			rel, err := filepath.Rel(filepath.Dir("/"+name), link)
+			if err != nil {
+				return nil, err
+			}
+			link = rel
+		}
+		_ = os.Remove(target)
+		return nil, os.Symlink(link, target)
+	case tar.TypeLink:
+		// Hardlinks can only be captured if their target was captured too
+		src := filepath.Join(dir, cleanName(hdr.Linkname))
+		if _, err := os.Lstat(src); err != nil {
+			return nil, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		_ = os.Remove(target)
+		return nil, os.Link(src, target)
+	}
+	return nil, nil
+}
+
+// addDir appends a directory entry, and its missing parents, unless the image already had it
+func addDir(tw *tar.Writer, name string, mode os.FileMode, seen map[string]bool) error {
+	if name == "" || name == "." || seen[name] {
+		return nil
+	}
+	if parent := filepath.Dir(name); parent != "." {
+		if err := addDir(tw, parent, 0755, seen); err != nil {
+			return err
+		}
+	}
+	seen[name] = true
+	perm := int64(mode.Perm())
+	if mode&os.ModeSticky != 0 {
+		perm |= tarSticky
+	}
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     perm,
+	})
+}
+
+// addFallback appends the fallback host file to the stream and to the capture dir
+func addFallback(tw *tar.Writer, f Fallback, captureDir string, seenDirs map[string]bool) error {
+	data, err := os.ReadFile(f.Source)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	name := cleanName(f.Dest)
+	if err = addDir(tw, filepath.Dir(name), 0755, seenDirs); err != nil {
+		return err
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data))}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err = tw.Write(data); err != nil {
+		return err
+	}
+	if captureDir == "" {
+		return nil
+	}
+	target := filepath.Join(captureDir, name)
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, 0644)
+}
+
+// cleanName normalizes tar entry names to paths relative to the rootfs root
+func cleanName(name string) string {
+	name = filepath.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// PathFilter returns a capture function selecting the given paths and anything below them
+func PathFilter(paths ...string) func(string) bool {
+	var clean []string
+	for _, p := range paths {
+		clean = append(clean, cleanName(p))
+	}
+	return func(name string) bool {
+		for _, p := range clean {
+			if name == p || strings.HasPrefix(name, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,159 @@
+package image_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kairos-io/enki/pkg/image"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// layer builds an image layer out of the given tar headers, regular files get their name as content
+func layer(hdrs ...*tar.Header) gcrv1.Layer {
+	return layerWith(nil, hdrs...)
+}
+
+// layerWith builds an image layer like layer does, with the given layer options
+func layerWith(opts []tarball.LayerOption, hdrs ...*tar.Header) gcrv1.Layer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range hdrs {
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		Expect(tw.WriteHeader(h)).To(Succeed())
+		if h.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(h.Name))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+	Expect(tw.Close()).To(Succeed())
+	data := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, opts...)
+	Expect(err).ToNot(HaveOccurred())
+	return l
+}
+
+// entries returns the headers of the tar stream, keyed by name
+func entries(data []byte) map[string]*tar.Header {
+	result := map[string]*tar.Header{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return result
+		}
+		Expect(err).ToNot(HaveOccurred())
+		result[hdr.Name] = hdr
+	}
+}
+
+var _ = Describe("Flatten", Label("stream"), func() {
+	var img gcrv1.Image
+	var captureDir string
+
+	BeforeEach(func() {
+		var err error
+		img, err = mutate.AppendLayers(empty.Image,
+			layer(
+				&tar.Header{Typeflag: tar.TypeDir, Name: "boot/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "boot/vmlinuz-6.1", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeSymlink, Name: "boot/vmlinuz", Linkname: "/boot/vmlinuz-6.1"},
+				&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0644},
+			),
+			layer(
+				// whiteout of etc/motd from the previous layer
+				&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.motd", Mode: 0644},
+			),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		captureDir = GinkgoT().TempDir()
+	})
+
+	It("merges the layers and captures the selected files", func() {
+		var out bytes.Buffer
+		err := image.Flatten(img, &out, image.StreamOptions{
+			CaptureDir: captureDir,
+			Capture:    image.PathFilter("/boot"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		tarEntries := entries(out.Bytes())
+		Expect(tarEntries).To(HaveKey("etc/hostname"))
+		Expect(tarEntries).ToNot(HaveKey("etc/motd"))
+		Expect(tarEntries).ToNot(HaveKey("etc/.wh.motd"))
+
+		data, err := os.ReadFile(filepath.Join(captureDir, "boot/vmlinuz"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("boot/vmlinuz-6.1"))
+		Expect(filepath.Join(captureDir, "etc/hostname")).ToNot(BeAnExistingFile())
+	})
+
+	It("adds missing directories and fallback files", func() {
+		fallback := filepath.Join(GinkgoT().TempDir(), "shim.efi")
+		Expect(os.WriteFile(fallback, []byte("shim"), 0644)).To(Succeed())
+
+		var out bytes.Buffer
+		err := image.Flatten(img, &out, image.StreamOptions{
+			CaptureDir: captureDir,
+			Capture:    image.PathFilter("/boot"),
+			Dirs:       []image.Dir{{Path: "/tmp", Mode: os.ModeDir | os.ModeSticky | 0777}, {Path: "/boot", Mode: 0755}},
+			Fallbacks: []image.Fallback{
+				{Paths: []string{"/usr/share/efi/shim.efi"}, Source: fallback, Dest: "/usr/share/efi/shim.efi"},
+				{Paths: []string{"/boot/vmlinuz"}, Source: fallback, Dest: "/boot/vmlinuz"},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		tarEntries := entries(out.Bytes())
+		Expect(tarEntries).To(HaveKey("tmp/"))
+		Expect(tarEntries["tmp/"].Mode).To(Equal(int64(01777)))
+		Expect(tarEntries).To(HaveKey("usr/share/efi/"))
+		Expect(tarEntries).To(HaveKey("usr/share/efi/shim.efi"))
+		data, err := os.ReadFile(filepath.Join(captureDir, "usr/share/efi/shim.efi"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("shim"))
+		// The image already provides a kernel, so that fallback must not be used
+		Expect(tarEntries["boot/vmlinuz"].Typeflag).To(Equal(byte(tar.TypeSymlink)))
+	})
+
+	It("replaces image files with fallbacks without paths", func() {
+		override := filepath.Join(GinkgoT().TempDir(), "hostname")
+		Expect(os.WriteFile(override, []byte("enki"), 0644)).To(Succeed())
+
+		var out bytes.Buffer
+		err := image.Flatten(img, &out, image.StreamOptions{
+			Fallbacks: []image.Fallback{{Source: override, Dest: "/etc/hostname"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		count := 0
+		tr := tar.NewReader(bytes.NewReader(out.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).ToNot(HaveOccurred())
+			if hdr.Name == "etc/hostname" {
+				count++
+				data, err := io.ReadAll(tr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("enki"))
+			}
+		}
+		Expect(count).To(Equal(1))
+	})
+})
@@ -0,0 +1,78 @@
+// Package iso creates ISO9660 images out of a directory tree, either with xorriso or with a
+// pure Go writer for hosts where xorriso is not available.
+package iso
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// EngineXorriso creates the ISO by running xorriso
+	EngineXorriso = "xorriso"
+	// EngineNative creates the ISO with the embedded ISO9660 writer
+	EngineNative = "native"
+)
+
+// Engines returns the names of the available ISO engines
+func Engines() []string {
+	return []string{EngineXorriso, EngineNative}
+}
+
+// Options describe the ISO to create. All the boot related paths are relative to Root.
+type Options struct {
+	// Root is the directory tree to pack
+	Root string
+	// Output is the path of the ISO file
+	Output string
+	// VolumeID is the label of the ISO volume
+	VolumeID string
+	// BIOSBootImage is the grub El Torito image used to boot in legacy BIOS mode
+	BIOSBootImage string
+	// HybridMBR is the grub MBR that makes the ISO bootable from USB drives in BIOS mode
+	HybridMBR string
+	// Isolinux tells the BIOSBootImage is isolinux.bin and the HybridMBR the isohybrid MBR of
+	// syslinux, for legacy only media
+	Isolinux bool
+	// BootCatalog is where the El Torito boot catalog is stored
+	BootCatalog string
+	// EFIImage is the FAT image booted in UEFI mode
+	EFIImage string
+	// RockRidge adds POSIX permissions, ownership, symlinks and long names
+	RockRidge bool
+	// Joliet adds the Windows long filename extension
+	Joliet bool
+	// RelocateDeepDirs moves directories nested deeper than the 8 levels plain ISO9660 allows
+	// into a relocation directory, which some old firmware and installers need
+	RelocateDeepDirs bool
+}
+
+// validate checks the options can be honored together
+func (o Options) validate() error {
+	if o.Isolinux && o.EFIImage != "" {
+		return fmt.Errorf("isolinux ISOs only boot in legacy BIOS mode, they can't have an EFI image")
+	}
+	if o.RelocateDeepDirs && !o.RockRidge {
+		return fmt.Errorf("relocating deep directories requires Rock Ridge, relocated directories would be lost otherwise")
+	}
+	return nil
+}
+
+// Engine creates ISO images
+type Engine interface {
+	// Create writes the ISO described by opts
+	Create(opts Options) error
+}
+
+// NewEngine returns the ISO engine with the given name
+func NewEngine(name string, runner v1.Runner) (Engine, error) {
+	switch name {
+	case EngineXorriso, "":
+		return Xorriso{runner: runner}, nil
+	case EngineNative:
+		return Native{logger: runner.GetLogger()}, nil
+	}
+	return nil, fmt.Errorf("unknown iso engine %q, available engines: %s", name, strings.Join(Engines(), ", "))
+}
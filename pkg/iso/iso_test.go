@@ -0,0 +1,117 @@
+package iso_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/kairos-io/enki/pkg/iso"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ISO engines", Label("iso"), func() {
+	var root, output string
+	var runner *v1mock.FakeRunner
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+		output = filepath.Join(GinkgoT().TempDir(), "test.iso")
+		runner = v1mock.NewFakeRunner()
+		runner.SetLogger(v1.NewNullLogger())
+		Expect(os.MkdirAll(filepath.Join(root, "boot"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(root, "boot", "uefi.img"), make([]byte, 64*1024), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(root, "rootfs.squashfs"), []byte("squashfs"), 0644)).To(Succeed())
+	})
+
+	It("fails on unknown engines", func() {
+		_, err := iso.NewEngine("mkisofs", runner)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("runs xorriso with the hybrid grub layout when there is a BIOS boot image", func() {
+		engine, err := iso.NewEngine(iso.EngineXorriso, runner)
+		Expect(err).ToNot(HaveOccurred())
+		err = engine.Create(iso.Options{Root: root, Output: output, VolumeID: "LIVE", BIOSBootImage: "boot/eltorito.img", Joliet: true, RockRidge: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{{"xorriso", "-volid", "LIVE", "-joliet", "on"}})).To(Succeed())
+	})
+
+	It("runs xorriso in mkisofs mode for EFI only images", func() {
+		engine, err := iso.NewEngine(iso.EngineXorriso, runner)
+		Expect(err).ToNot(HaveOccurred())
+		err = engine.Create(iso.Options{Root: root, Output: output, VolumeID: "UKI", EFIImage: "efiboot.img"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{{"xorriso", "-as", "mkisofs", "-V", "UKI", "-isohybrid-gpt-basdat", "-e"}})).To(Succeed())
+	})
+
+	It("passes the extension options to xorriso", func() {
+		engine, err := iso.NewEngine(iso.EngineXorriso, runner)
+		Expect(err).ToNot(HaveOccurred())
+		err = engine.Create(iso.Options{Root: root, Output: output, VolumeID: "UKI", EFIImage: "efiboot.img", Joliet: true, RockRidge: true, RelocateDeepDirs: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{{
+			"xorriso", "-as", "mkisofs", "-V", "UKI", "-isohybrid-gpt-basdat", "-J", "-e", "efiboot.img", "-no-emul-boot", "-o", output, root, "--",
+			"-rockridge", "on", "-compliance", "deep_paths_off:long_paths_off", "-rr_reloc_dir", "rr_moved",
+		}})).To(Succeed())
+	})
+
+	It("runs xorriso with the isolinux layout for legacy only images", func() {
+		engine, err := iso.NewEngine(iso.EngineXorriso, runner)
+		Expect(err).ToNot(HaveOccurred())
+		err = engine.Create(iso.Options{
+			Root: root, Output: output, VolumeID: "LIVE", Isolinux: true,
+			BIOSBootImage: "isolinux/isolinux.bin", BootCatalog: "isolinux/boot.cat", HybridMBR: "isolinux/isohdpfx.bin",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{{
+			"xorriso", "-as", "mkisofs", "-V", "LIVE", "-b", "isolinux/isolinux.bin", "-c", "isolinux/boot.cat",
+			"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table", "-isohybrid-mbr", filepath.Join(root, "isolinux/isohdpfx.bin"),
+			"-o", output, root, "--",
+		}})).To(Succeed())
+
+		err = engine.Create(iso.Options{Root: root, Output: output, Isolinux: true, BIOSBootImage: "isolinux/isolinux.bin", EFIImage: "boot/uefi.img"})
+		Expect(err).To(MatchError(ContainSubstring("only boot in legacy BIOS mode")))
+	})
+
+	It("refuses to relocate deep directories without Rock Ridge", func() {
+		for _, name := range iso.Engines() {
+			engine, err := iso.NewEngine(name, runner)
+			Expect(err).ToNot(HaveOccurred())
+			err = engine.Create(iso.Options{Root: root, Output: output, EFIImage: "boot/uefi.img", RelocateDeepDirs: true})
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("writes a bootable ISO without external tools", func() {
+		engine, err := iso.NewEngine(iso.EngineNative, runner)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(root, "boot", "eltorito.img"), make([]byte, 4096), 0644)).To(Succeed())
+		err = engine.Create(iso.Options{
+			Root: root, Output: output, VolumeID: "LIVE",
+			BIOSBootImage: "boot/eltorito.img", BootCatalog: "boot/boot.catalog", EFIImage: "boot/uefi.img",
+			RockRidge: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+
+		f, err := os.Open(output)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		info, err := f.Stat()
+		Expect(err).ToNot(HaveOccurred())
+		fs, err := iso9660.Read(f, info.Size(), 0, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.TrimSpace(fs.Label())).To(Equal("LIVE"))
+		files, err := fs.ReadDir("/")
+		Expect(err).ToNot(HaveOccurred())
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		Expect(names).To(ContainElements("boot", "rootfs.squashfs"))
+	})
+})
@@ -0,0 +1,51 @@
+package iso
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+)
+
+var (
+	menuEntry   = regexp.MustCompile(`^\s*menuentry\s+["']([^"']+)["']`)
+	linuxKernel = regexp.MustCompile(`^\s*\$?(linux|linuxefi|linux16)\s+\S+\s*(.*)$`)
+)
+
+// isolinuxEntry is a boot entry of the isolinux config
+type isolinuxEntry struct {
+	title   string
+	cmdline string
+}
+
+// IsolinuxConfig returns the isolinux.cfg booting the kernel and initrd of the ISO with the
+// cmdlines of the menu entries of the live grub.cfg, so legacy only media boot the same way as
+// the grub ones. Without any, it boots the live system from the ISO labeled label. The first
+// entry is booted after 5 seconds, the others by typing their number at the boot prompt.
+func IsolinuxConfig(grubCfg, label string) string {
+	var entries []isolinuxEntry
+	title := constants.GrubDefEntry
+	for _, line := range strings.Split(grubCfg, "\n") {
+		if match := menuEntry.FindStringSubmatch(line); match != nil {
+			title = match[1]
+			continue
+		}
+		if match := linuxKernel.FindStringSubmatch(line); match != nil {
+			entries = append(entries, isolinuxEntry{title: title, cmdline: strings.TrimSpace(match[2])})
+		}
+	}
+	if len(entries) == 0 {
+		entries = append(entries, isolinuxEntry{title: constants.GrubDefEntry, cmdline: fmt.Sprintf(constants.IsolinuxCmdline, label)})
+	}
+
+	var b strings.Builder
+	b.WriteString("DEFAULT 1\nPROMPT 1\nTIMEOUT 50\n")
+	for i, entry := range entries {
+		fmt.Fprintf(&b, "SAY %d: %s\n", i+1, entry.title)
+	}
+	for i, entry := range entries {
+		fmt.Fprintf(&b, "\nLABEL %d\n  KERNEL %s\n  INITRD %s\n  APPEND %s\n", i+1, constants.IsoKernelPath, constants.IsoInitrdPath, entry.cmdline)
+	}
+	return b.String()
+}
@@ -0,0 +1,127 @@
+package iso
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/kairos-io/enki/pkg/constants"
+)
+
+// LoopbackCfg is where multi-ISO boot tools, like Ventoy in GRUB2 mode, GLIM or the ISO boot
+// entries of GRUB itself, look for the grub config to source once they loop mounted the ISO
+// file. They set iso_path to the path of the ISO file within its filesystem before sourcing it.
+const LoopbackCfg = "/boot/grub/loopback.cfg"
+
+// isoScanArg tells the dracut iso-scan module which ISO file to loop mount before looking for
+// the live root by its label, as the ISO isn't a block device of its own when booted this way
+const isoScanArg = "iso-scan/filename=${iso_path}"
+
+// maxVolumeID is the length of the ISO9660 volume identifier, longer labels are truncated
+const maxVolumeID = 32
+
+var (
+	volumeIDChars = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	cdLabelArg    = regexp.MustCompile(`CDLABEL=([^\s"']+)`)
+	linuxCmd      = regexp.MustCompile(`^\s*(linux|linuxefi|linux16)\s`)
+	setRootCmd    = regexp.MustCompile(`^\s*(search\s.*--set(=|\s+)root\b|set\s+root=)`)
+)
+
+// CheckVolumeID fails if the label can't be matched reliably by the live root=live:CDLABEL=
+// argument or by the grub search command: too long labels are truncated and spaces or other
+// symbols get mangled by the cmdline, by udev or by the multi-boot tools.
+func CheckVolumeID(label string) error {
+	if len(label) > maxVolumeID {
+		return fmt.Errorf("the ISO label %q is longer than %d characters, it would be truncated", label, maxVolumeID)
+	}
+	if label != "" && !volumeIDChars.MatchString(label) {
+		return fmt.Errorf("the ISO label %q can only have letters, digits, dashes, dots and underscores to be found by its label", label)
+	}
+	return nil
+}
+
+// LoopbackConfig returns the loopback.cfg for the given live grub.cfg: the same menu, with the
+// kernel told which ISO file to loop mount and without changing the grub root, which already
+// is the loop mounted ISO and could be searched elsewhere on a multi-boot drive.
+func LoopbackConfig(grubCfg string) string {
+	var b strings.Builder
+	b.WriteString("# Sourced by multi-ISO boot tools with iso_path set to the ISO file\n")
+	for _, line := range strings.Split(strings.TrimRight(grubCfg, "\n"), "\n") {
+		switch {
+		case setRootCmd.MatchString(line):
+			b.WriteString("# root is the loop mounted ISO: " + strings.TrimSpace(line))
+		case linuxCmd.MatchString(line) && !strings.Contains(line, "iso-scan/filename="):
+			b.WriteString(strings.TrimRight(line, " ") + " " + isoScanArg)
+		default:
+			b.WriteString(line)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// VerifyMultiboot checks the ISO at path boots from multi-ISO boot tools like Ventoy, which boot
+// the ISO file from the filesystem of a USB drive holding several ones. It returns the problems
+// found, none if the ISO is compatible. ISOs without a grub config, like the UKI ones, boot their
+// EFI image as is, so only their label is checked.
+func VerifyMultiboot(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := iso9660.Read(f, info.Size(), 0, sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	var problems []string
+	label := strings.TrimSpace(fs.Label())
+	if label == "" {
+		problems = append(problems, "the ISO has no label, the live root can't be found by its label")
+	} else if err := CheckVolumeID(label); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	grubCfg, err := readISOFile(fs, constants.GrubPrefixDir+"/"+constants.GrubCfg)
+	if err != nil {
+		return problems, nil
+	}
+	for _, match := range cdLabelArg.FindAllStringSubmatch(grubCfg, -1) {
+		if match[1] != label {
+			problems = append(problems, fmt.Sprintf("%s looks for the live root with CDLABEL=%s, but the ISO label is %q", constants.GrubCfg, match[1], label))
+		}
+	}
+
+	loopbackCfg, err := readISOFile(fs, LoopbackCfg)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s is missing, multi-ISO boot tools can only boot the ISO in emulation modes", LoopbackCfg)), nil
+	}
+	for _, line := range strings.Split(loopbackCfg, "\n") {
+		if linuxCmd.MatchString(line) && !strings.Contains(line, "iso-scan/filename=") {
+			problems = append(problems, fmt.Sprintf("%s boots a kernel without iso-scan/filename, it won't find the ISO file: %s", LoopbackCfg, strings.TrimSpace(line)))
+		}
+		if setRootCmd.MatchString(line) {
+			problems = append(problems, fmt.Sprintf("%s changes the grub root, it may boot the files of another ISO: %s", LoopbackCfg, strings.TrimSpace(line)))
+		}
+	}
+	return problems, nil
+}
+
+// readISOFile returns the contents of the file at path in the ISO
+func readISOFile(fs *iso9660.FileSystem, path string) (string, error) {
+	f, err := fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
@@ -0,0 +1,93 @@
+package iso_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/iso"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const liveGrubCfg = `search --no-floppy --file --set=root /boot/kernel
+set default=0
+menuentry "Kairos" --class os {
+  linux ($root)/boot/kernel cdroot root=live:CDLABEL=COS_LIVE rd.live.dir=/ rd.live.squashimg=rootfs.squashfs
+  initrd ($root)/boot/initrd
+}
+`
+
+var _ = Describe("Multi-ISO boot", Label("iso", "multiboot"), func() {
+	It("rejects labels that can't be found by their label", func() {
+		Expect(iso.CheckVolumeID("COS_LIVE")).To(Succeed())
+		Expect(iso.CheckVolumeID("kairos-v3.0.0")).To(Succeed())
+		Expect(iso.CheckVolumeID("")).To(Succeed())
+		Expect(iso.CheckVolumeID("KAIROS LIVE")).To(MatchError(ContainSubstring("can only have letters")))
+		Expect(iso.CheckVolumeID("KAIROS_LIVE_WITH_A_VERY_LONG_LABEL")).To(MatchError(ContainSubstring("longer than 32")))
+	})
+
+	It("derives the loopback config from the live grub config", func() {
+		cfg := iso.LoopbackConfig(liveGrubCfg)
+		Expect(cfg).To(ContainSubstring("# root is the loop mounted ISO: search --no-floppy --file --set=root /boot/kernel\n"))
+		Expect(cfg).To(ContainSubstring("rd.live.squashimg=rootfs.squashfs iso-scan/filename=${iso_path}\n"))
+		Expect(cfg).To(ContainSubstring("  initrd ($root)/boot/initrd\n"))
+		Expect(iso.LoopbackConfig(cfg)).To(Equal("# Sourced by multi-ISO boot tools with iso_path set to the ISO file\n" + cfg))
+	})
+
+	It("derives the isolinux config from the live grub config", func() {
+		cfg := iso.IsolinuxConfig(liveGrubCfg+`menuentry "Kairos (debug)" {
+  $linux ($root)/boot/kernel cdroot root=live:CDLABEL=COS_LIVE rd.debug
+}
+`, "COS_LIVE")
+		Expect(cfg).To(HavePrefix("DEFAULT 1\n"))
+		Expect(cfg).To(ContainSubstring("SAY 1: Kairos\nSAY 2: Kairos (debug)\n"))
+		Expect(cfg).To(ContainSubstring("LABEL 1\n  KERNEL /boot/kernel\n  INITRD /boot/initrd\n  APPEND cdroot root=live:CDLABEL=COS_LIVE rd.live.dir=/ rd.live.squashimg=rootfs.squashfs\n"))
+		Expect(cfg).To(ContainSubstring("LABEL 2\n  KERNEL /boot/kernel\n  INITRD /boot/initrd\n  APPEND cdroot root=live:CDLABEL=COS_LIVE rd.debug\n"))
+
+		cfg = iso.IsolinuxConfig("", "KAIROS")
+		Expect(cfg).To(ContainSubstring("SAY 1: Kairos\n"))
+		Expect(cfg).To(ContainSubstring("APPEND cdroot root=live:CDLABEL=KAIROS "))
+	})
+
+	Describe("VerifyMultiboot", func() {
+		var root, output string
+		BeforeEach(func() {
+			root = GinkgoT().TempDir()
+			output = filepath.Join(GinkgoT().TempDir(), "test.iso")
+			Expect(os.MkdirAll(filepath.Join(root, "boot", "grub2"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "boot", "uefi.img"), make([]byte, 64*1024), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "boot", "grub2", "grub.cfg"), []byte(liveGrubCfg), 0644)).To(Succeed())
+		})
+		create := func(label string) {
+			err := iso.Native{}.Create(iso.Options{Root: root, Output: output, VolumeID: label, EFIImage: "boot/uefi.img", RockRidge: true})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("accepts ISOs with a loopback config", func() {
+			Expect(os.MkdirAll(filepath.Join(root, "boot", "grub"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "boot", "grub", "loopback.cfg"), []byte(iso.LoopbackConfig(liveGrubCfg)), 0644)).To(Succeed())
+			create("COS_LIVE")
+			problems, err := iso.VerifyMultiboot(output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(BeEmpty())
+		})
+
+		It("finds the problems of ISOs for a single boot device", func() {
+			create("LIVE")
+			problems, err := iso.VerifyMultiboot(output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(ConsistOf(
+				ContainSubstring(`CDLABEL=COS_LIVE, but the ISO label is "LIVE"`),
+				ContainSubstring("/boot/grub/loopback.cfg is missing"),
+			))
+		})
+
+		It("only checks the label of ISOs without grub", func() {
+			Expect(os.RemoveAll(filepath.Join(root, "boot", "grub2"))).To(Succeed())
+			create("UKI")
+			problems, err := iso.VerifyMultiboot(output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(BeEmpty())
+		})
+	})
+})
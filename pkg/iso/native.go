@@ -0,0 +1,99 @@
+package iso
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// sectorSize is the ISO9660 logical block size
+const sectorSize = 2048
+
+// Native creates the ISO with the pure Go ISO9660 writer, with optional Rock Ridge extensions
+// and El Torito boot entries. It can't write a hybrid MBR nor Joliet names, so the resulting
+// ISOs boot from optical media or virtual machines but not from USB drives in BIOS mode.
+type Native struct {
+	logger v1.Logger
+}
+
+// Create writes the ISO. The root tree is used as the writer workspace, so the boot catalog
+// is added to it and nothing is copied.
+func (n Native) Create(opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if opts.Joliet {
+		n.logger.Warnf("The %s iso engine doesn't support Joliet, the ISO will only have ISO9660 and Rock Ridge names", EngineNative)
+	}
+	if opts.HybridMBR != "" {
+		n.logger.Warnf("The %s iso engine can't write a hybrid MBR, the ISO won't boot from USB drives in BIOS mode", EngineNative)
+	}
+
+	f, err := os.Create(opts.Output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fs, err := iso9660.Create(f, 0, 0, sectorSize, opts.Root)
+	if err != nil {
+		return fmt.Errorf("error creating iso file: %w", err)
+	}
+
+	var elTorito *iso9660.ElTorito
+	if opts.BIOSBootImage != "" || opts.EFIImage != "" {
+		elTorito = &iso9660.ElTorito{
+			BootCatalog:     isoPath(opts.BootCatalog),
+			HideBootCatalog: true,
+			Platform:        iso9660.BIOS,
+		}
+		if opts.BIOSBootImage != "" {
+			// Same as grub-mkrescue: load 4 virtual sectors and patch in the boot info table
+			elTorito.Entries = append(elTorito.Entries, &iso9660.ElToritoEntry{
+				Platform:  iso9660.BIOS,
+				Emulation: iso9660.NoEmulation,
+				BootFile:  isoPath(opts.BIOSBootImage),
+				BootTable: true,
+				LoadSize:  4,
+			})
+		}
+		if opts.EFIImage != "" {
+			elTorito.Entries = append(elTorito.Entries, &iso9660.ElToritoEntry{
+				Platform:  iso9660.EFI,
+				Emulation: iso9660.NoEmulation,
+				BootFile:  isoPath(opts.EFIImage),
+			})
+		}
+		if opts.BIOSBootImage == "" {
+			elTorito.Platform = iso9660.EFI
+		}
+	}
+
+	err = fs.Finalize(iso9660.FinalizeOptions{
+		RockRidge:        opts.RockRidge,
+		DeepDirectories:  !opts.RelocateDeepDirs,
+		ElTorito:         elTorito,
+		VolumeIdentifier: volumeID(opts.VolumeID),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating iso file: %w", err)
+	}
+	return f.Close()
+}
+
+// volumeID pads the label with spaces as ISO9660 mandates, the writer would pad it with zeroes
+// which blkid and the grub search command don't strip
+func volumeID(label string) string {
+	return fmt.Sprintf("%-32s", label)
+}
+
+// isoPath returns the absolute path inside the ISO for a path relative to the root tree
+func isoPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Join("/", path)
+}
@@ -0,0 +1,72 @@
+package iso
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/logging"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// Xorriso creates the ISO by running xorriso
+type Xorriso struct {
+	runner v1.Runner
+}
+
+// Create runs xorriso. With a BIOS boot image the ISO gets the hybrid grub layout used for
+// live media, or the isolinux one for legacy only media, otherwise the ISO only boots the EFI
+// image in UEFI mode.
+func (x Xorriso) Create(opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	var args []string
+	if opts.Isolinux {
+		args = []string{
+			"-as", "mkisofs", "-V", opts.VolumeID, "-b", opts.BIOSBootImage, "-c", opts.BootCatalog,
+			"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table",
+		}
+		if opts.HybridMBR != "" {
+			args = append(args, "-isohybrid-mbr", filepath.Join(opts.Root, opts.HybridMBR))
+		}
+		if opts.Joliet {
+			args = append(args, "-J")
+		}
+		args = append(args, "-o", opts.Output, opts.Root, "--")
+	} else if opts.BIOSBootImage != "" {
+		args = []string{
+			"-volid", opts.VolumeID, "-joliet", onOff(opts.Joliet), "-padding", "0",
+			"-outdev", opts.Output, "-map", opts.Root, "/", "-chmod", "0755", "--",
+		}
+		args = append(args, constants.GetXorrisoBooloaderArgs(opts.Root)...)
+	} else {
+		args = []string{"-as", "mkisofs", "-V", opts.VolumeID, "-isohybrid-gpt-basdat"}
+		if opts.Joliet {
+			args = append(args, "-J")
+		}
+		args = append(args, "-e", opts.EFIImage, "-no-emul-boot", "-o", opts.Output, opts.Root, "--")
+	}
+	// Native xorriso commands are valid after the mkisofs emulation ends too, they only need
+	// to come before the image is written at the end of the run
+	args = append(args, "-rockridge", onOff(opts.RockRidge))
+	if opts.RelocateDeepDirs {
+		args = append(args, "-compliance", "deep_paths_off:long_paths_off", "-rr_reloc_dir", "rr_moved")
+	} else {
+		args = append(args, "-compliance", "deep_paths:long_paths")
+	}
+
+	out, err := x.runner.Run("xorriso", args...)
+	logging.Module(x.runner.GetLogger(), logging.ISO).Debugf("Xorriso: %s", string(out))
+	if err != nil {
+		return fmt.Errorf("error creating iso file: %w\n%s", err, string(out))
+	}
+	return nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
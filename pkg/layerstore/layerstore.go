@@ -0,0 +1,195 @@
+// Package layerstore keeps the extracted layers of the source images in a store shared by the
+// builds, addressed by their content, so the builds of images sharing a base, like the flavors of
+// a release, extract its layers once. The stored layers are materialized into the workdir of each
+// build as reflinks, hardlinks or copies of their files.
+package layerstore
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/archive"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/kairos-io/enki/pkg/report"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdk "github.com/kairos-io/kairos-sdk/utils"
+)
+
+// How the files of the stored layers are materialized into the workdirs
+const (
+	// LinkReflink shares the extents of the stored files on the filesystems supporting it, like
+	// btrfs and xfs, and copies them on the others
+	LinkReflink = "reflink"
+	// LinkHardlink hardlinks the stored files, so the builds must not modify the files of the
+	// image in place
+	LinkHardlink = "hardlink"
+	// LinkCopy copies the stored files
+	LinkCopy = "copy"
+)
+
+// CacheName is the name of the layer store in the build report
+const CacheName = "layers"
+
+// Links returns how the stored files can be materialized
+func Links() []string {
+	return []string{LinkReflink, LinkHardlink, LinkCopy}
+}
+
+// Store is a dir of extracted layers, named after the digest of their uncompressed contents
+type Store struct {
+	Dir  string
+	Link string
+
+	mu    sync.Mutex
+	usage report.Cache
+}
+
+// store is the store in use, see Use
+var store *Store
+
+// Use sets the store the images are extracted through, none if dir is empty
+func Use(dir, link string) error {
+	if link == "" {
+		link = LinkReflink
+	}
+	if !slices.Contains(Links(), link) {
+		return fmt.Errorf("invalid layer store link %q, use one of %s", link, strings.Join(Links(), ", "))
+	}
+	store = nil
+	if dir != "" {
+		store = &Store{Dir: dir, Link: link}
+	}
+	return nil
+}
+
+// Enabled tells if the images are extracted through a store
+func Enabled() bool {
+	return store != nil
+}
+
+// Usage returns how many layers of the builds of this run were found in the store in use
+func Usage() report.Cache {
+	if store == nil {
+		return report.Cache{Name: CacheName}
+	}
+	return store.Usage()
+}
+
+// Usage returns how many layers were found in the store, and how many had to be extracted
+func (s *Store) Usage() report.Cache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usage
+	usage.Name = CacheName
+	return usage
+}
+
+// Extract materializes the layers of img into destination, extracting the ones missing from the
+// store first
+func (s *Store) Extract(img gcrv1.Image, destination string) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		dir, err := s.add(layer)
+		if err != nil {
+			return err
+		}
+		if err = materialize(dir, destination, s.Link); err != nil {
+			return fmt.Errorf("materializing layer %s: %w", filepath.Base(dir), err)
+		}
+	}
+	return nil
+}
+
+// add extracts the layer into the store unless it is already there, returning its dir. The whiteouts
+// are kept as they are, they are only applied when the layer is materialized over the lower ones.
+func (s *Store) add(layer gcrv1.Layer) (string, error) {
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return "", err
+	}
+	// The size is the one of the layer in the registry, the extracted one is only known once
+	// it's extracted
+	size, _ := layer.Size()
+	dir := filepath.Join(s.Dir, diffID.Algorithm, diffID.Hex)
+	if _, err := os.Stat(dir); err == nil {
+		s.record(true, size)
+		return dir, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return "", err
+	}
+	// Extracted next to its final place and renamed once complete, so builds running at the same
+	// time never see a partial layer
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".extract-"+diffID.Hex+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	_, err = archive.Apply(context.Background(), tmp, rc, archive.WithConvertWhiteout(func(*tar.Header, string) (bool, error) {
+		return true, nil
+	}))
+	if err != nil {
+		return "", fmt.Errorf("extracting layer %s: %w", diffID, err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// Another build stored it first
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return "", err
+		}
+	}
+	s.record(false, size)
+	return dir, nil
+}
+
+func (s *Store) record(hit bool, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hit {
+		s.usage.Hits++
+		s.usage.HitBytes += size
+	} else {
+		s.usage.Misses++
+		s.usage.MissBytes += size
+	}
+}
+
+// Extractor is an image extractor going through the store in use, or Next if there is none
+type Extractor struct {
+	Next v1.ImageExtractor
+}
+
+var _ v1.ImageExtractor = Extractor{}
+
+func (e Extractor) ExtractImage(imageRef, destination, platformRef string) error {
+	if store == nil {
+		return e.Next.ExtractImage(imageRef, destination, platformRef)
+	}
+	img, err := sdk.GetImage(imageRef, platformRef)
+	if err != nil {
+		return err
+	}
+	// Images applied over others, like the several sources of a rootfs, are materialized into
+	// the overlay of the first one
+	if overlay && empty(destination) {
+		return store.Mount(img, destination)
+	}
+	return store.Extract(img, destination)
+}
+
+func (e Extractor) GetOCIImageSize(imageRef, platformRef string) (int64, error) {
+	return e.Next.GetOCIImageSize(imageRef, platformRef)
+}
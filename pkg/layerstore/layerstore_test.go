@@ -0,0 +1,163 @@
+package layerstore_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kairos-io/enki/pkg/layerstore"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// layer builds an image layer out of the headers, the regular files holding their own name
+func layer(hdrs ...*tar.Header) gcrv1.Layer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range hdrs {
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		Expect(tw.WriteHeader(h)).To(Succeed())
+		if h.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(h.Name))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+	Expect(tw.Close()).To(Succeed())
+	data := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	Expect(err).ToNot(HaveOccurred())
+	return l
+}
+
+func inode(path string) uint64 {
+	info, err := os.Stat(path)
+	Expect(err).ToNot(HaveOccurred())
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+var _ = Describe("Store", Label("layerstore"), func() {
+	var base gcrv1.Layer
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		base = layer(
+			&tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755},
+			&tar.Header{Typeflag: tar.TypeDir, Name: "usr/lib/", Mode: 0755},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/os-release", Mode: 0644},
+			&tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib"},
+			&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0644},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644},
+			&tar.Header{Typeflag: tar.TypeLink, Name: "etc/hostname.link", Linkname: "etc/hostname"},
+			&tar.Header{Typeflag: tar.TypeDir, Name: "opt/", Mode: 0755},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "opt/old", Mode: 0644},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin", Mode: 04755},
+		)
+	})
+
+	It("applies the layers over each other", func() {
+		img, err := mutate.AppendLayers(empty.Image, base, layer(
+			&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.motd", Mode: 0644},
+			&tar.Header{Typeflag: tar.TypeDir, Name: "opt/", Mode: 0755},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "opt/.wh..wh..opq", Mode: 0644},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "opt/new", Mode: 0644},
+		))
+		Expect(err).ToNot(HaveOccurred())
+		s := &layerstore.Store{Dir: filepath.Join(dir, "store"), Link: layerstore.LinkCopy}
+		dest := filepath.Join(dir, "rootfs")
+		Expect(os.Mkdir(dest, 0755)).To(Succeed())
+		Expect(s.Extract(img, dest)).To(Succeed())
+
+		Expect(filepath.Join(dest, "usr", "lib", "os-release")).To(BeARegularFile())
+		Expect(os.Readlink(filepath.Join(dest, "lib"))).To(Equal("usr/lib"))
+		Expect(filepath.Join(dest, "etc", "motd")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(dest, "etc", "hostname")).To(BeARegularFile())
+		Expect(inode(filepath.Join(dest, "etc", "hostname.link"))).To(Equal(inode(filepath.Join(dest, "etc", "hostname"))))
+		Expect(filepath.Join(dest, "opt", "old")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(dest, "opt", "new")).To(BeARegularFile())
+		Expect(filepath.Join(dest, "opt", ".wh..wh..opq")).ToNot(BeAnExistingFile())
+		info, err := os.Stat(filepath.Join(dest, "usr", "bin"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode() & os.ModeSetuid).ToNot(BeZero())
+		data, err := os.ReadFile(filepath.Join(dest, "etc", "hostname"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("etc/hostname"))
+
+		Expect(s.Usage().Misses).To(Equal(2))
+		Expect(s.Usage().Hits).To(Equal(0))
+	})
+
+	It("extracts the layers shared by the images once", func() {
+		first, err := mutate.AppendLayers(empty.Image, base, layer(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/flavor-a", Mode: 0644}))
+		Expect(err).ToNot(HaveOccurred())
+		second, err := mutate.AppendLayers(empty.Image, base, layer(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/flavor-b", Mode: 0644}))
+		Expect(err).ToNot(HaveOccurred())
+		s := &layerstore.Store{Dir: filepath.Join(dir, "store"), Link: layerstore.LinkReflink}
+		for _, img := range []gcrv1.Image{first, second} {
+			Expect(s.Extract(img, GinkgoT().TempDir())).To(Succeed())
+		}
+		usage := s.Usage()
+		Expect(usage.Name).To(Equal(layerstore.CacheName))
+		Expect(usage.Hits).To(Equal(1))
+		Expect(usage.Misses).To(Equal(3))
+		size, err := base.Size()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(usage.HitBytes).To(Equal(size))
+	})
+
+	It("hardlinks the stored files", func() {
+		img, err := mutate.AppendLayers(empty.Image, base)
+		Expect(err).ToNot(HaveOccurred())
+		s := &layerstore.Store{Dir: filepath.Join(dir, "store"), Link: layerstore.LinkHardlink}
+		dest := GinkgoT().TempDir()
+		Expect(s.Extract(img, dest)).To(Succeed())
+		diffID, err := base.DiffID()
+		Expect(err).ToNot(HaveOccurred())
+		stored := filepath.Join(s.Dir, diffID.Algorithm, diffID.Hex, "etc", "motd")
+		Expect(inode(filepath.Join(dest, "etc", "motd"))).To(Equal(inode(stored)))
+	})
+
+	It("only takes the known links", func() {
+		Expect(layerstore.Use("", "symlink")).ToNot(Succeed())
+		Expect(layerstore.Use(dir, "")).To(Succeed())
+		Expect(layerstore.Enabled()).To(BeTrue())
+		Expect(layerstore.Use("", layerstore.LinkCopy)).To(Succeed())
+		Expect(layerstore.Enabled()).To(BeFalse())
+	})
+
+	It("mounts the rootfs of the images over the store", func() {
+		img, err := mutate.AppendLayers(empty.Image, base)
+		Expect(err).ToNot(HaveOccurred())
+		s := &layerstore.Store{Dir: filepath.Join(dir, "store"), Link: layerstore.LinkReflink}
+		for i := 0; i < 2; i++ {
+			target := filepath.Join(dir, fmt.Sprintf("rootfs-%d", i))
+			Expect(os.Mkdir(target, 0755)).To(Succeed())
+			Expect(s.Mount(img, target)).To(Succeed())
+			Expect(filepath.Join(target, "etc", "motd")).To(BeARegularFile())
+			// The changes of a build don't reach the store, nor the other builds
+			Expect(os.Remove(filepath.Join(target, "etc", "motd"))).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(target, "etc", "hostname"), []byte("changed"), 0644)).To(Succeed())
+			Expect(layerstore.Release(target)).To(Succeed())
+			Expect(os.RemoveAll(target)).To(Succeed())
+		}
+		usage := s.Usage()
+		Expect(usage.Misses).To(Equal(1))
+		Expect(usage.Hits).To(Equal(1))
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1), "only the store is left")
+	})
+})
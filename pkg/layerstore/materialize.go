@@ -0,0 +1,195 @@
+package layerstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	continuity "github.com/containerd/continuity/fs"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+)
+
+// Whiteouts hide the files of the lower layers, see
+// https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// materialize applies the stored layer in dir over the lower layers already in destination. The
+// paths are resolved within destination, so the symlinks of the lower layers, like /lib pointing
+// to /usr/lib, are followed as they would be in the rootfs.
+func materialize(dir, destination, link string) error {
+	// The whiteouts only hide the files of the lower layers, so they go first
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !strings.HasPrefix(d.Name(), whiteoutPrefix) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		parent, err := continuity.RootPath(destination, rel)
+		if err != nil {
+			return err
+		}
+		if d.Name() != whiteoutOpaque {
+			return os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(d.Name(), whiteoutPrefix)))
+		}
+		entries, err := os.ReadDir(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		for _, entry := range entries {
+			if err == nil {
+				err = os.RemoveAll(filepath.Join(parent, entry.Name()))
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Hardlinked files of the layer are hardlinked in destination too
+	links := map[uint64]string{}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir || strings.HasPrefix(d.Name(), whiteoutPrefix) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		parent, err := continuity.RootPath(destination, rel)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return place(path, filepath.Join(parent, d.Name()), info, link, links)
+	})
+}
+
+// place puts the stored file src at dst, replacing whatever the lower layers had there unless
+// both are directories
+func place(src, dst string, info fs.FileInfo, link string, links map[uint64]string) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("can't read the metadata of %s", src)
+	}
+	if info.IsDir() {
+		if current, err := os.Lstat(dst); err != nil || !current.IsDir() {
+			_ = os.RemoveAll(dst)
+			if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		return setMetadata(src, dst, info, st)
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	mode := info.Mode()
+	switch {
+	case mode.IsRegular():
+		if st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				return os.Link(first, dst)
+			}
+			links[st.Ino] = dst
+		}
+		if link == LinkHardlink {
+			if err := os.Link(src, dst); err == nil || !errors.Is(err, syscall.EXDEV) {
+				return err
+			}
+		}
+		if err := copyFile(src, dst, mode.Perm(), link == LinkReflink); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err = os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe) != 0:
+		if err := unix.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+			return &os.PathError{Op: "mknod", Path: dst, Err: err}
+		}
+	default:
+		return nil
+	}
+	if err := setMetadata(src, dst, info, st); err != nil {
+		return err
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyFile copies src into a new dst, sharing its extents if reflink is set and the filesystem
+// supports it
+func copyFile(src, dst string, perm os.FileMode, reflink bool) error {
+	if reflink {
+		return utils.CloneFile(src, dst, perm)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// setMetadata sets the ownership, permissions and extended attributes of src on dst
+func setMetadata(src, dst string, info fs.FileInfo, st *syscall.Stat_t) error {
+	// Only root can give files away, building as a regular user keeps the files as their own
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		// Chown clears the setuid and setgid bits
+		if err := os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	// Chown drops file capabilities, so xattrs must come last
+	names, err := xattr.LList(src)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		value, err := xattr.LGet(src, name)
+		if err != nil {
+			return err
+		}
+		if err = xattr.LSet(dst, name, value); err != nil && !errors.Is(err, syscall.ENOTSUP) {
+			return err
+		}
+	}
+	return nil
+}
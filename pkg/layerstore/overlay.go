@@ -0,0 +1,145 @@
+package layerstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/twpayne/go-vfs"
+)
+
+var (
+	// overlay tells if the images are mounted as overlays over their rootfs in the store rather
+	// than materialized, see UseOverlay
+	overlay bool
+
+	overlaysMu sync.Mutex
+	// overlays are the dirs holding the writable layer of the overlays mounted by Mount, by the
+	// dir they are mounted at
+	overlays = map[string]string{}
+)
+
+// UseOverlay sets whether the images are mounted as overlays over their rootfs in the store, so
+// the hooks and prunes only write their changes instead of the whole rootfs being materialized
+func UseOverlay(enabled bool) {
+	overlay = enabled
+}
+
+// rootfs returns the dir holding the whole rootfs of img in the store, materializing it from its
+// layers the first time
+func (s *Store) rootfs(img gcrv1.Image) (string, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(s.Dir, "rootfs", digest.Algorithm, digest.Hex)
+	if _, err := os.Stat(dir); err == nil {
+		layers, err := img.Layers()
+		if err != nil {
+			return "", err
+		}
+		for _, layer := range layers {
+			size, _ := layer.Size()
+			s.record(true, size)
+		}
+		return dir, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".extract-"+digest.Hex+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	if err = s.Extract(img, tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Mount mounts the rootfs of img in the store at target as an overlay, writable through a layer
+// next to target that only holds the changes. Without overlayfs, like in rootless builds, the
+// rootfs is copied into target instead, with reflinks on the filesystems supporting them.
+func (s *Store) Mount(img gcrv1.Image, target string) error {
+	lower, err := s.rootfs(img)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(target), ".overlay-"+filepath.Base(target)+"-")
+	if err != nil {
+		return err
+	}
+	upper, work := filepath.Join(dir, "upper"), filepath.Join(dir, "work")
+	for _, d := range []string{upper, work} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			_ = os.RemoveAll(dir)
+			return err
+		}
+	}
+	// The mount options can't hold the separators of the dirs
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if strings.ContainsAny(lower+upper+work, ",:") || syscall.Mount("overlay", target, "overlay", 0, options) != nil {
+		_ = os.RemoveAll(dir)
+		return utils.CopyTree(vfs.OSFS, lower, target, utils.CopyOptions{})
+	}
+	overlaysMu.Lock()
+	overlays[target] = dir
+	overlaysMu.Unlock()
+	return nil
+}
+
+// Release unmounts the overlay mounted at target by Mount, if any, dropping its writable layer.
+// It must be called before removing target, which would otherwise go through the overlay.
+func Release(target string) error {
+	overlaysMu.Lock()
+	dir, ok := overlays[target]
+	delete(overlays, target)
+	overlaysMu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := syscall.Unmount(target, 0); err != nil {
+		// Still busy, like with a hook left running in the background
+		if err = syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+			return &os.PathError{Op: "unmount", Path: target, Err: err}
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// ReleaseAll unmounts all the overlays mounted by Mount
+func ReleaseAll() error {
+	overlaysMu.Lock()
+	var targets []string
+	for target := range overlays {
+		targets = append(targets, target)
+	}
+	overlaysMu.Unlock()
+	var err error
+	for _, target := range targets {
+		if releaseErr := Release(target); err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+// empty tells if dir has no entries
+func empty(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) == 0
+}
@@ -0,0 +1,173 @@
+// Package limits keeps builds from starving the other tenants of shared machines, running the
+// heavy external tools with a lower CPU and IO priority and fewer threads, and capping the
+// memory of enki itself.
+package limits
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// IOIdle only gets disk time when no other process needs it
+	IOIdle = "idle"
+	// IOBestEffort shares the disk by priority, from 0, the highest, to 7
+	IOBestEffort = "best-effort"
+)
+
+// heavyTools are the tools that keep every CPU and the disk busy for the length of a build
+var heavyTools = []string{"mksquashfs", "xorriso"}
+
+// IOClasses returns the ionice classes the heavy tools can run with
+func IOClasses() []string {
+	return []string{IOIdle, IOBestEffort}
+}
+
+// Limits tell how much of the machine a build can take, their zero value takes it all
+type Limits struct {
+	// Nice is the niceness of the heavy tools, from 1 to 19, 0 leaves it unchanged
+	Nice int
+	// IOClass is the ionice class of the heavy tools, empty leaves it unchanged
+	IOClass string
+	// IOLevel is the priority within the best-effort class
+	IOLevel int
+	// Processors caps the threads of mksquashfs, 0 uses every CPU
+	Processors int
+	// Memory is the soft memory limit of enki in bytes, 0 leaves it unlimited
+	Memory int64
+	// LowMemory keeps the memory of the build down, for small machines like 2GB CI runners
+	LowMemory bool
+}
+
+// The defaults of the low memory mode, unless the limits are given
+const (
+	// lowMemoryLimit is the soft memory limit of enki
+	lowMemoryLimit = 512 << 20
+	// lowMemorySquashfs is the memory mksquashfs caches and buffers the data with
+	lowMemorySquashfs = "256M"
+)
+
+// Parse returns the limits of the given settings, as given with --nice, --ionice, --processors
+// and --memory-limit. The ionice setting is a class, with an optional level for best-effort
+// like best-effort:7.
+func Parse(nice int, ionice string, processors int, memory string) (Limits, error) {
+	l := Limits{Nice: nice, Processors: processors}
+	if nice < 0 || nice > 19 {
+		return l, fmt.Errorf("invalid nice %d, it must be between 0 and 19", nice)
+	}
+	if processors < 0 {
+		return l, fmt.Errorf("invalid processors %d, it must be positive", processors)
+	}
+	if ionice != "" {
+		class, level, hasLevel := strings.Cut(ionice, ":")
+		if !slices.Contains(IOClasses(), class) {
+			return l, fmt.Errorf("invalid ionice class %q, available classes: %s", class, strings.Join(IOClasses(), ", "))
+		}
+		l.IOClass, l.IOLevel = class, 4
+		if hasLevel {
+			n, err := strconv.Atoi(level)
+			if class != IOBestEffort || err != nil || n < 0 || n > 7 {
+				return l, fmt.Errorf("invalid ionice %q, only best-effort takes a level, from 0 to 7", ionice)
+			}
+			l.IOLevel = n
+		}
+	}
+	if memory != "" {
+		size, err := utils.ParseSize(memory)
+		if err != nil {
+			return l, fmt.Errorf("invalid memory-limit: %w", err)
+		}
+		l.Memory = size
+	}
+	return l, nil
+}
+
+// ForLowMemory returns the limits tuned for small machines: mksquashfs runs single threaded
+// with a small cache and the stages run one after the other. The processors and memory limit
+// given are kept.
+func (l Limits) ForLowMemory() Limits {
+	l.LowMemory = true
+	if l.Processors == 0 {
+		l.Processors = 1
+	}
+	if l.Memory == 0 {
+		l.Memory = lowMemoryLimit
+	}
+	return l
+}
+
+// Workers returns how many files or builds can be processed at the same time, 0 for as many as
+// there are CPUs
+func (l Limits) Workers() int {
+	if l.LowMemory {
+		return 1
+	}
+	return 0
+}
+
+// SetMemoryLimit caps the memory of enki, making the garbage collector run harder as it gets
+// close. It is a soft limit, enki doesn't fail if it needs more.
+func (l Limits) SetMemoryLimit() {
+	if l.Memory > 0 {
+		debug.SetMemoryLimit(l.Memory)
+	}
+}
+
+// Wrap returns runner running the heavy tools within the limits, runner itself if there are no
+// limits to apply to them
+func Wrap(runner v1.Runner, l Limits) v1.Runner {
+	if l.Nice == 0 && l.IOClass == "" && l.Processors == 0 && !l.LowMemory {
+		return runner
+	}
+	return &limitedRunner{Runner: runner, limits: l}
+}
+
+// limitedRunner runs the heavy tools under nice and ionice, and any other command as is
+type limitedRunner struct {
+	v1.Runner
+	limits Limits
+}
+
+func (r *limitedRunner) Run(command string, args ...string) ([]byte, error) {
+	command, args = r.command(command, args)
+	return r.Runner.Run(command, args...)
+}
+
+func (r *limitedRunner) InitCmd(command string, args ...string) *exec.Cmd {
+	command, args = r.command(command, args)
+	return r.Runner.InitCmd(command, args...)
+}
+
+// command returns the command running the given one within the limits
+func (r *limitedRunner) command(command string, args []string) (string, []string) {
+	if !slices.Contains(heavyTools, command) {
+		return command, args
+	}
+	if command == "mksquashfs" && r.limits.Processors > 0 && !slices.Contains(args, "-processors") {
+		args = append(slices.Clone(args), "-processors", strconv.Itoa(r.limits.Processors))
+	}
+	if command == "mksquashfs" && r.limits.LowMemory && !slices.Contains(args, "-mem") {
+		args = append(slices.Clone(args), "-mem", lowMemorySquashfs)
+	}
+	var wrapper []string
+	if r.limits.Nice > 0 {
+		wrapper = append(wrapper, "nice", "-n", strconv.Itoa(r.limits.Nice))
+	}
+	switch r.limits.IOClass {
+	case IOIdle:
+		wrapper = append(wrapper, "ionice", "-c", "3")
+	case IOBestEffort:
+		wrapper = append(wrapper, "ionice", "-c", "2", "-n", strconv.Itoa(r.limits.IOLevel))
+	}
+	if len(wrapper) == 0 {
+		return command, args
+	}
+	return wrapper[0], append(append(wrapper[1:], command), args...)
+}
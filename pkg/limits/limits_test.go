@@ -0,0 +1,73 @@
+package limits_test
+
+import (
+	"github.com/kairos-io/enki/pkg/limits"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits", Label("limits"), func() {
+	It("runs the heavy tools with a lower priority and fewer threads", func() {
+		l, err := limits.Parse(10, "best-effort:7", 2, "")
+		Expect(err).ToNot(HaveOccurred())
+		runner := v1mock.NewFakeRunner()
+		limited := limits.Wrap(runner, l)
+		_, err = limited.Run("mksquashfs", "rootfs", "rootfs.squashfs", "-comp", "xz")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = limited.Run("xorriso", "-as", "mkisofs")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = limited.Run("mkfs.fat", "efiboot.img")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{
+			{"nice", "-n", "10", "ionice", "-c", "2", "-n", "7", "mksquashfs", "rootfs", "rootfs.squashfs", "-comp", "xz", "-processors", "2"},
+			{"nice", "-n", "10", "ionice", "-c", "2", "-n", "7", "xorriso", "-as", "mkisofs"},
+			{"mkfs.fat", "efiboot.img"},
+		})).To(Succeed())
+	})
+
+	It("leaves the runner as is without limits", func() {
+		l, err := limits.Parse(0, "", 0, "2GiB")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(l.Memory).To(Equal(int64(2 << 30)))
+		runner := v1mock.NewFakeRunner()
+		Expect(limits.Wrap(runner, l)).To(BeIdenticalTo(runner))
+	})
+
+	It("tunes mksquashfs and the stages for low memory machines", func() {
+		l, err := limits.Parse(0, "", 0, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(l.Workers()).To(Equal(0))
+		l = l.ForLowMemory()
+		Expect(l.Processors).To(Equal(1))
+		Expect(l.Memory).To(Equal(int64(512 << 20)))
+		Expect(l.Workers()).To(Equal(1))
+		runner := v1mock.NewFakeRunner()
+		_, err = limits.Wrap(runner, l).Run("mksquashfs", "rootfs", "rootfs.squashfs", "-mem", "1G")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = limits.Wrap(runner, l).Run("mksquashfs", "rootfs", "rootfs.squashfs")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{
+			{"mksquashfs", "rootfs", "rootfs.squashfs", "-mem", "1G", "-processors", "1"},
+			{"mksquashfs", "rootfs", "rootfs.squashfs", "-processors", "1", "-mem", "256M"},
+		})).To(Succeed())
+
+		// The given limits are kept
+		l, err = limits.Parse(0, "", 4, "1GiB")
+		Expect(err).ToNot(HaveOccurred())
+		l = l.ForLowMemory()
+		Expect(l.Processors).To(Equal(4))
+		Expect(l.Memory).To(Equal(int64(1 << 30)))
+	})
+
+	It("rejects invalid limits", func() {
+		_, err := limits.Parse(20, "", 0, "")
+		Expect(err).To(MatchError(ContainSubstring("invalid nice 20")))
+		_, err = limits.Parse(0, "idle:3", 0, "")
+		Expect(err).To(MatchError(ContainSubstring("only best-effort takes a level")))
+		_, err = limits.Parse(0, "realtime", 0, "")
+		Expect(err).To(MatchError(ContainSubstring("invalid ionice class")))
+		_, err = limits.Parse(0, "", 0, "lots")
+		Expect(err).To(MatchError(ContainSubstring("invalid memory-limit")))
+	})
+})
@@ -0,0 +1,221 @@
+// Package lock pins the digests of the external inputs of a build, the source images and the
+// host files like shim or the EFI shell, in a lockfile. A manifest along with its lockfile
+// builds from the same inputs months later, or fails if any of them changed.
+package lock
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	container "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/mirror"
+	"github.com/kairos-io/enki/pkg/registry"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// FileName is the name of the lockfile in the config dir
+	FileName = "enki.lock"
+
+	version = 1
+	hint    = "run enki lock to update the lockfile if the change is expected"
+)
+
+// Image pins a container image reference to the digest of its manifest, or of its index for
+// multi-arch images
+type Image struct {
+	Ref    string `yaml:"ref"`
+	Digest string `yaml:"digest"`
+}
+
+// File pins a host file to the sha256 digest of its contents
+type File struct {
+	Path   string `yaml:"path"`
+	Digest string `yaml:"digest"`
+}
+
+// Lockfile holds the pinned inputs, sorted so updates produce small diffs
+type Lockfile struct {
+	Version int     `yaml:"version"`
+	Images  []Image `yaml:"images,omitempty"`
+	Files   []File  `yaml:"files,omitempty"`
+}
+
+// Read returns the lockfile in path
+func Read(fs v1.FS, path string) (*Lockfile, error) {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var l Lockfile
+	if err := yaml.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("invalid lockfile %s: %w", path, err)
+	}
+	if l.Version != version {
+		return nil, fmt.Errorf("unsupported lockfile version %d in %s", l.Version, path)
+	}
+	return &l, nil
+}
+
+// Write writes the lockfile into path
+func (l *Lockfile) Write(fs v1.FS, path string) error {
+	l.Version = version
+	sort.Slice(l.Images, func(i, j int) bool { return l.Images[i].Ref < l.Images[j].Ref })
+	sort.Slice(l.Files, func(i, j int) bool { return l.Files[i].Path < l.Files[j].Path })
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(path, append([]byte("# Generated by enki lock, do not edit\n"), data...), 0644)
+}
+
+// Resolver returns the digest of an image reference
+type Resolver func(ref string) (string, error)
+
+// ResolveRemote returns the digest of the manifest of ref in its registry
+func ResolveRemote(ref string) (string, error) {
+	r, err := registry.ParseReference(mirror.Image(ref))
+	if err != nil {
+		return "", err
+	}
+	desc, err := remote.Head(r, registry.Options()...)
+	if err != nil {
+		return "", fmt.Errorf("resolving the digest of %s: %w", ref, err)
+	}
+	return desc.Digest.String(), nil
+}
+
+// FileDigest returns the digest of the file in path, as pinned in lockfiles
+func FileDigest(fs v1.FS, path string) (string, error) {
+	sum, err := utils.CalcFileChecksum(fs, path)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + sum, nil
+}
+
+// Update pins the given images and files, along with the ones already pinned, to their current
+// digests. Pinned files that don't exist anymore are dropped.
+func (l *Lockfile) Update(fs v1.FS, resolve Resolver, images, files []string) error {
+	refs := map[string]bool{}
+	for _, ref := range images {
+		refs[ref] = true
+	}
+	for _, img := range l.Images {
+		refs[img.Ref] = true
+	}
+	paths := map[string]bool{}
+	for _, path := range files {
+		paths[path] = true
+	}
+	l.Images, l.Files = nil, nil
+	for ref := range refs {
+		digest, err := resolve(ref)
+		if err != nil {
+			return err
+		}
+		l.Images = append(l.Images, Image{Ref: ref, Digest: digest})
+	}
+	for path := range paths {
+		digest, err := FileDigest(fs, path)
+		if err != nil {
+			return err
+		}
+		l.Files = append(l.Files, File{Path: path, Digest: digest})
+	}
+	return nil
+}
+
+// Pin returns src pinned to the digest of the lockfile, src itself if it is not a container
+// image. Unpinned images fail in strict mode, they are left as they are otherwise.
+func (l *Lockfile) Pin(logger v1.Logger, src *v1.ImageSource, strict bool) (*v1.ImageSource, error) {
+	if !src.IsDocker() {
+		return src, nil
+	}
+	for _, img := range l.Images {
+		if img.Ref != src.Value() {
+			continue
+		}
+		r, err := name.ParseReference(img.Ref)
+		if err != nil {
+			return nil, err
+		}
+		pinned := r.Context().Digest(img.Digest).String()
+		logger.Infof("Using %s pinned by the lockfile as %s", img.Ref, pinned)
+		return v1.NewDockerSrc(pinned), nil
+	}
+	if strict {
+		return nil, failure.Errorf(failure.ErrVerification, hint, "%s is not pinned by the lockfile", src.Value())
+	}
+	logger.Warnf("%s is not pinned by the lockfile, building from its current digest", src.Value())
+	return src, nil
+}
+
+// PinDigest returns the container image src pinned to digest. It fails if the reference of src
+// resolves to another digest, like a tag moved to another image since the digest was taken, so
+// release builds don't silently build from another image than the reviewed one.
+func PinDigest(logger v1.Logger, resolve Resolver, src *v1.ImageSource, digest string) (*v1.ImageSource, error) {
+	if _, err := container.NewHash(digest); err != nil {
+		return nil, failure.New(failure.ErrInvalidConfig, fmt.Errorf("invalid digest %s: %w", digest, err), "pass it like sha256:HEX, as printed by crane digest")
+	}
+	if !src.IsDocker() {
+		return nil, failure.Errorf(failure.ErrInvalidConfig, "", "only container images can be pinned to a digest, not %s", src.String())
+	}
+	r, err := name.ParseReference(src.Value())
+	if err != nil {
+		return nil, err
+	}
+	current, err := resolve(src.Value())
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckDigest(src.Value(), current, digest); err != nil {
+		return nil, err
+	}
+	pinned := r.Context().Digest(digest).String()
+	logger.Infof("Using %s pinned as %s", src.Value(), pinned)
+	return v1.NewDockerSrc(pinned), nil
+}
+
+// CheckDigest fails if the digest of the named input isn't the pinned one
+func CheckDigest(input, digest, pinned string) error {
+	if digest != pinned {
+		return failure.Errorf(failure.ErrVerification, "check why it changed and pin the new digest if the change is expected", "%s is %s instead of the pinned %s", input, digest, pinned)
+	}
+	return nil
+}
+
+// Verify fails if the file in path doesn't match the digest of the lockfile. Unpinned files fail
+// in strict mode, they are only reported otherwise.
+func (l *Lockfile) Verify(fs v1.FS, logger v1.Logger, path string, strict bool) error {
+	for _, f := range l.Files {
+		if f.Path != path {
+			continue
+		}
+		digest, err := FileDigest(fs, path)
+		if err != nil {
+			return err
+		}
+		if digest != f.Digest {
+			return failure.Errorf(failure.ErrVerification, hint, "%s doesn't match the lockfile, it is %s instead of %s", path, digest, f.Digest)
+		}
+		return nil
+	}
+	if strict {
+		return failure.Errorf(failure.ErrVerification, hint, "%s is not pinned by the lockfile", path)
+	}
+	logger.Warnf("%s is not pinned by the lockfile", path)
+	return nil
+}
+
+// Exists tells if there is a lockfile in path
+func Exists(fs v1.FS, path string) bool {
+	_, err := fs.Stat(path)
+	return err == nil || !os.IsNotExist(err)
+}
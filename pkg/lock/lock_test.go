@@ -0,0 +1,90 @@
+package lock_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	"github.com/kairos-io/enki/pkg/lock"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs"
+)
+
+const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+var _ = Describe("Lockfile", Label("lock"), func() {
+	var dir, shim string
+	var logger v1.Logger
+	resolve := func(ref string) (string, error) { return digest, nil }
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		shim = filepath.Join(dir, "shimx64.efi")
+		Expect(os.WriteFile(shim, []byte("shim"), 0644)).To(Succeed())
+		logger = v1.NewNullLogger()
+	})
+
+	It("pins the images and files and reads them back", func() {
+		l := &lock.Lockfile{}
+		Expect(l.Update(vfs.OSFS, resolve, []string{"quay.io/kairos/ubuntu:24.04"}, []string{shim})).To(Succeed())
+		path := filepath.Join(dir, lock.FileName)
+		Expect(l.Write(vfs.OSFS, path)).To(Succeed())
+
+		read, err := lock.Read(vfs.OSFS, path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read.Images).To(Equal([]lock.Image{{Ref: "quay.io/kairos/ubuntu:24.04", Digest: digest}}))
+		Expect(read.Files).To(HaveLen(1))
+		Expect(read.Files[0].Digest).To(HavePrefix("sha256:"))
+
+		// Pinned images are kept on updates
+		Expect(read.Update(vfs.OSFS, resolve, nil, nil)).To(Succeed())
+		Expect(read.Images).To(HaveLen(1))
+	})
+
+	It("pins the container image sources to their digests", func() {
+		l := &lock.Lockfile{Images: []lock.Image{{Ref: "quay.io/kairos/ubuntu:24.04", Digest: digest}}}
+		src, err := l.Pin(logger, v1.NewDockerSrc("quay.io/kairos/ubuntu:24.04"), true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src.Value()).To(Equal("quay.io/kairos/ubuntu@" + digest))
+
+		dirSrc := v1.NewDirSrc(dir)
+		Expect(l.Pin(logger, dirSrc, true)).To(BeIdenticalTo(dirSrc))
+
+		_, err = l.Pin(logger, v1.NewDockerSrc("quay.io/kairos/fedora:40"), true)
+		Expect(err).To(MatchError(failure.ErrVerification))
+		src, err = l.Pin(logger, v1.NewDockerSrc("quay.io/kairos/fedora:40"), false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src.Value()).To(Equal("quay.io/kairos/fedora:40"))
+	})
+
+	It("fails when a pinned file changed", func() {
+		l := &lock.Lockfile{}
+		Expect(l.Update(vfs.OSFS, resolve, nil, []string{shim})).To(Succeed())
+		Expect(l.Verify(vfs.OSFS, logger, shim, true)).To(Succeed())
+
+		Expect(os.WriteFile(shim, []byte("another shim"), 0644)).To(Succeed())
+		err := l.Verify(vfs.OSFS, logger, shim, false)
+		Expect(err).To(MatchError(failure.ErrVerification))
+		Expect(err.Error()).To(ContainSubstring("doesn't match the lockfile"))
+		Expect(l.Verify(vfs.OSFS, logger, filepath.Join(dir, "memtest.efi"), true)).To(MatchError(ContainSubstring("not pinned")))
+	})
+
+	It("pins the source image to a given digest", func() {
+		src, err := lock.PinDigest(logger, resolve, v1.NewDockerSrc("quay.io/kairos/ubuntu:24.04"), digest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src.Value()).To(Equal("quay.io/kairos/ubuntu@" + digest))
+
+		moved := "sha256:" + strings.Repeat("f", 64)
+		_, err = lock.PinDigest(logger, resolve, v1.NewDockerSrc("quay.io/kairos/ubuntu:24.04"), moved)
+		Expect(err).To(MatchError(failure.ErrVerification))
+		Expect(err.Error()).To(ContainSubstring("instead of the pinned " + moved))
+
+		_, err = lock.PinDigest(logger, resolve, v1.NewDockerSrc("quay.io/kairos/ubuntu:24.04"), "latest")
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+		_, err = lock.PinDigest(logger, resolve, v1.NewDirSrc(dir), digest)
+		Expect(err).To(MatchError(failure.ErrInvalidConfig))
+	})
+})
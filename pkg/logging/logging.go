@@ -0,0 +1,198 @@
+// Package logging filters and redacts the logs of the builds. The debug logs can be limited to
+// the modules being debugged, like the signing of the EFI binaries without the extraction of the
+// image, and the secrets of the build never make it to the logs nor to the log files.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// The modules the debug logs can be limited to
+const (
+	// Image is the extraction and streaming of the source images
+	Image = "image"
+	// EFI are the EFI binaries, bootloaders and images, like the UKIs and the ESPs
+	EFI = "efi"
+	// Sign is the signing and verification of the EFI binaries and of the source images
+	Sign = "sign"
+	// ISO is the ISO filesystem and its boot records
+	ISO = "iso"
+	// Squashfs is the creation of the squashfs images
+	Squashfs = "squashfs"
+	// Config is the loading of the config, manifests and flags
+	Config = "config"
+)
+
+// moduleField is the field of the log entries naming their module
+const moduleField = "module"
+
+// runCmd is the debug log of the runners for every command they run
+const runCmd = "Running cmd: '"
+
+// redacted replaces the secrets in the logs
+const redacted = "[REDACTED]"
+
+// toolModules are the modules of the commands run, told by the debug log of the runner
+var toolModules = map[string]string{
+	"skopeo": Image, "umoci": Image, "luet": Image, "docker": Image, "podman": Image, "unsquashfs": Image,
+	"mkfs.fat": EFI, "mkfs.msdos": EFI, "mmd": EFI, "mcopy": EFI, "objcopy": EFI, "/usr/lib/systemd/ukify": EFI,
+	"grub-mkstandalone": EFI, "grub2-mkstandalone": EFI, "grub2-mkimage": EFI, "grub-mkimage": EFI,
+	"sbsign": Sign, "sbattach": Sign, "sbverify": Sign, "cosign": Sign, "notation": Sign,
+	"/usr/lib/systemd/systemd-measure": Sign, "openssl": Sign, "osslsigncode": Sign, "sign-efi-sig-list": Sign, "cert-to-efi-sig-list": Sign,
+	"xorriso": ISO, "mksquashfs": Squashfs,
+}
+
+// secretPatterns match the secrets in the logs that weren't given through a secret reference,
+// like the passwords of the URLs, keeping what precedes them
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(://[^:/\s@]+:)[^@\s]+(@)`),
+	regexp.MustCompile(`(?i)(\b(?:password|passwd|token|secret|api[-_]?key)["']?\s*[=:]\s*["']?)[^\s"',]+()`),
+	regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic)\s+)\S+()`),
+}
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// Modules returns the modules the debug logs can be limited to
+func Modules() []string {
+	return []string{Image, EFI, Sign, ISO, Squashfs, Config}
+}
+
+// Levels returns the log levels, from the most verbose
+func Levels() []string {
+	return []string{"trace", "debug", "info", "warn", "error"}
+}
+
+// Options tell which logs are written
+type Options struct {
+	// Level is the lowest level written
+	Level logrus.Level
+	// Modules are the modules the debug and trace logs are written of, all of them if empty
+	Modules []string
+}
+
+// Parse returns the options of the given settings, as given with --log-level, --debug and
+// --debug-modules. The level is info, or debug if debugging, unless given.
+func Parse(level string, debug bool, modules []string) (Options, error) {
+	opts := Options{Level: logrus.InfoLevel}
+	if debug || len(modules) > 0 {
+		opts.Level = logrus.DebugLevel
+	}
+	if level != "" {
+		if !slices.Contains(Levels(), level) {
+			return opts, fmt.Errorf("invalid log-level %q, available levels: %s", level, strings.Join(Levels(), ", "))
+		}
+		opts.Level, _ = logrus.ParseLevel(level)
+	}
+	for _, m := range modules {
+		if !slices.Contains(Modules(), m) {
+			return opts, fmt.Errorf("invalid debug module %q, available modules: %s", m, strings.Join(Modules(), ", "))
+		}
+	}
+	opts.Modules = modules
+	return opts, nil
+}
+
+// Apply sets the level of the logger, and the formatter writing the debug logs of the modules
+// only, with the secrets redacted, through the given one
+func (o Options) Apply(log v1.Logger, formatter logrus.Formatter) {
+	log.SetLevel(o.Level)
+	log.SetFormatter(&filterFormatter{Formatter: formatter, modules: o.Modules})
+}
+
+// AddSecret makes the value redacted from every log from now on. The values too short to tell
+// apart from the rest of the logs are not.
+func AddSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < 4 {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if !slices.Contains(secrets, value) {
+		secrets = append(secrets, value)
+	}
+}
+
+// Redact returns the text with the secrets replaced
+func Redact(text string) string {
+	secretsMu.RLock()
+	for _, s := range secrets {
+		text = strings.ReplaceAll(text, s, redacted)
+	}
+	secretsMu.RUnlock()
+	for _, p := range secretPatterns {
+		text = p.ReplaceAllString(text, "${1}"+redacted+"${2}")
+	}
+	return text
+}
+
+// Module returns the logger tagging its logs with the module, for them to be filtered by it.
+// Loggers other than the logrus ones are returned as they are.
+func Module(log v1.Logger, module string) v1.Logger {
+	switch l := log.(type) {
+	case *logrus.Logger:
+		return &moduleLogger{Entry: l.WithField(moduleField, module)}
+	case *moduleLogger:
+		return &moduleLogger{Entry: l.Logger.WithField(moduleField, module)}
+	}
+	return log
+}
+
+// moduleLogger is a logrus logger with the module field set
+type moduleLogger struct {
+	*logrus.Entry
+}
+
+func (m *moduleLogger) SetLevel(level logrus.Level)             { m.Logger.SetLevel(level) }
+func (m *moduleLogger) GetLevel() logrus.Level                  { return m.Logger.GetLevel() }
+func (m *moduleLogger) SetFormatter(formatter logrus.Formatter) { m.Logger.SetFormatter(formatter) }
+func (m *moduleLogger) SetOutput(output io.Writer)              { m.Logger.SetOutput(output) }
+
+// filterFormatter drops the debug and trace logs of the modules not selected and redacts the
+// secrets of the others
+type filterFormatter struct {
+	logrus.Formatter
+	modules []string
+}
+
+func (f *filterFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if len(f.modules) > 0 && entry.Level >= logrus.DebugLevel && !slices.Contains(f.modules, module(entry)) {
+		return nil, nil
+	}
+	entry.Message = Redact(entry.Message)
+	for k, v := range entry.Data {
+		if s, ok := v.(string); ok {
+			entry.Data[k] = Redact(s)
+		}
+	}
+	return f.Formatter.Format(entry)
+}
+
+// module returns the module of the entry, from its field or from the command it runs
+func module(entry *logrus.Entry) string {
+	if m, ok := entry.Data[moduleField].(string); ok {
+		return m
+	}
+	cmd, ok := strings.CutPrefix(entry.Message, runCmd)
+	if !ok {
+		return ""
+	}
+	// The tools may be wrapped, like by nice and ionice
+	for _, tool := range strings.Fields(strings.TrimSuffix(cmd, "'")) {
+		if m, ok := toolModules[tool]; ok {
+			return m
+		}
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExtendsKey is the setting naming the manifests a manifest extends
+const ExtendsKey = "extends"
+
+// Load returns the settings of the manifest at path merged on top of the ones of the manifests it
+// extends, recursively. The extended manifests are given relative to the dir of the manifest
+// extending them, each one overriding the previous ones. Sections are merged key by key, lists
+// are replaced.
+func Load(path string) (map[string]any, error) {
+	return load(path, nil)
+}
+
+// load loads the manifest at path, extended from the chain of manifests
+func load(path string, chain []string) (map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(chain, abs) {
+		return nil, fmt.Errorf("%s extends itself through %s", abs, strings.Join(chain, " -> "))
+	}
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return nil, err
+	}
+	manifest := map[string]any{}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", abs, err)
+	}
+	manifest = lowerKeys(manifest)
+
+	bases, err := extends(manifest[ExtendsKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", abs, err)
+	}
+	delete(manifest, ExtendsKey)
+	merged := map[string]any{}
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(abs), base)
+		}
+		settings, err := load(base, append(chain, abs))
+		if err != nil {
+			return nil, err
+		}
+		merged = Merge(merged, settings)
+	}
+	return Merge(merged, manifest), nil
+}
+
+// Files returns the absolute paths of the manifest at path and of the ones it extends,
+// recursively. Missing manifests are returned too, as they may be created later.
+func Files(path string) []string {
+	return files(path, nil)
+}
+
+func files(path string, seen []string) []string {
+	abs, err := filepath.Abs(path)
+	if err != nil || slices.Contains(seen, abs) {
+		return seen
+	}
+	seen = append(seen, abs)
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return seen
+	}
+	manifest := map[string]any{}
+	if yaml.Unmarshal(data, &manifest) != nil {
+		return seen
+	}
+	bases, _ := extends(lowerKeys(manifest)[ExtendsKey])
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(abs), base)
+		}
+		seen = files(base, seen)
+	}
+	return seen
+}
+
+// extends returns the manifests named by the extends setting, a path or a list of them
+func extends(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []any:
+		var paths []string
+		for _, item := range v {
+			path, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s takes paths, not %v", ExtendsKey, item)
+			}
+			paths = append(paths, path)
+		}
+		return paths, nil
+	}
+	return nil, fmt.Errorf("%s takes a path or a list of them, not %v", ExtendsKey, value)
+}
+
+// Merge returns the settings of base overridden by the ones of overlay. The sections in both are
+// merged the same way, any other value of overlay replaces the one of base.
+func Merge(base, overlay map[string]any) map[string]any {
+	merged := make(map[string]any, len(base)+len(overlay))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		baseSection, ok := merged[key].(map[string]any)
+		section, isSection := value.(map[string]any)
+		if ok && isSection {
+			merged[key] = Merge(baseSection, section)
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// lowerKeys returns the settings with their keys lowercased, as viper reads them, so the
+// manifests override each other regardless of the case of the keys
+func lowerKeys(settings map[string]any) map[string]any {
+	lowered := make(map[string]any, len(settings))
+	for key, value := range settings {
+		if section, ok := value.(map[string]any); ok {
+			value = lowerKeys(section)
+		}
+		lowered[strings.ToLower(key)] = value
+	}
+	return lowered
+}
+
+// Lookup returns the value of the setting at the given path, like iso.label, and if it is set
+type Lookup func(path string) (string, bool)
+
+// Settings returns the settings of the schema set by lookup, typed like the manifest holds them.
+// The lists are comma separated.
+func (s *Schema) Settings(lookup Lookup) (map[string]any, error) {
+	return s.settings("", lookup)
+}
+
+// settings returns the settings of the properties of s under the path prefix set by lookup
+func (s *Schema) settings(prefix string, lookup Lookup) (map[string]any, error) {
+	settings := map[string]any{}
+	for key, p := range s.Properties {
+		if key == ExtendsKey || strings.HasPrefix(key, "$") {
+			continue
+		}
+		if len(p.Properties) > 0 {
+			section, err := p.settings(prefix+key+".", lookup)
+			if err != nil {
+				return nil, err
+			}
+			if len(section) > 0 {
+				settings[key] = section
+			}
+			continue
+		}
+		raw, ok := lookup(prefix + key)
+		if !ok {
+			continue
+		}
+		value, err := p.parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %w", prefix+key, err)
+		}
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+// parse returns the raw value typed like the schema
+func (s *Schema) parse(raw string) (any, error) {
+	switch s.Type {
+	case "boolean":
+		return strconv.ParseBool(raw)
+	case "integer":
+		return strconv.Atoi(raw)
+	case "array":
+		var items []any
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	}
+	return raw, nil
+}
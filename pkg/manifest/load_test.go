@@ -0,0 +1,101 @@
+package manifest_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/manifest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load", Label("manifest"), func() {
+	var dir string
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		return path
+	}
+
+	It("merges the manifests on top of the ones they extend", func() {
+		write("profiles/base.yaml", "keys: /keys\nname: base\nSet: [brand=kairos]\niso:\n  label: BASE\n  checksum: [sha256, sha512]\n")
+		write("profiles/registry.yaml", "extends: base.yaml\npush: registry.example.com/kairos\n")
+		path := write("manifest.yaml", "extends: [profiles/registry.yaml]\nname: product\niso:\n  Label: PRODUCT\n  checksum: [blake3]\n")
+
+		settings, err := manifest.Load(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(settings).To(Equal(map[string]any{
+			"keys": "/keys",
+			"name": "product",
+			"set":  []any{"brand=kairos"},
+			"push": "registry.example.com/kairos",
+			"iso": map[string]any{
+				"label":    "PRODUCT",
+				"checksum": []any{"blake3"},
+			},
+		}))
+	})
+
+	It("lists the manifests along with the ones they extend", func() {
+		base := write("profiles/base.yaml", "extends: ../manifest.yaml\n")
+		path := write("manifest.yaml", "extends: [profiles/base.yaml, missing.yaml]\n")
+		Expect(manifest.Files(path)).To(Equal([]string{path, base, filepath.Join(dir, "missing.yaml")}))
+	})
+
+	It("fails on missing and circular manifests", func() {
+		_, err := manifest.Load(filepath.Join(dir, "manifest.yaml"))
+		Expect(err).To(MatchError(os.ErrNotExist))
+
+		path := write("manifest.yaml", "extends: missing.yaml\n")
+		_, err = manifest.Load(path)
+		Expect(err).To(MatchError(os.ErrNotExist))
+
+		write("a.yaml", "extends: manifest.yaml\n")
+		write("manifest.yaml", "extends: a.yaml\n")
+		_, err = manifest.Load(path)
+		Expect(err).To(MatchError(ContainSubstring("extends itself")))
+
+		write("manifest.yaml", "extends: {name: a.yaml}\n")
+		_, err = manifest.Load(path)
+		Expect(err).To(MatchError(ContainSubstring("takes a path or a list of them")))
+
+		write("manifest.yaml", "name: [kairos\n")
+		_, err = manifest.Load(path)
+		Expect(err).To(MatchError(ContainSubstring("parsing")))
+	})
+
+	It("types the settings given as strings like the schema", func() {
+		schema := manifest.New()
+		schema.Properties["quiet"] = &manifest.Schema{Type: "boolean"}
+		schema.Properties["nice"] = &manifest.Schema{Type: "integer"}
+		schema.Properties["set"] = &manifest.Schema{Type: "array", Items: &manifest.Schema{Type: "string"}}
+		schema.Properties["name"] = &manifest.Schema{Type: "string"}
+		iso := manifest.Object("")
+		iso.Properties["label"] = &manifest.Schema{Type: "string"}
+		schema.Properties["iso"] = iso
+
+		given := map[string]string{"quiet": "true", "nice": "5", "set": "a=1, b=2", "iso.label": "KAIROS"}
+		settings, err := schema.Settings(func(path string) (string, bool) {
+			value, ok := given[path]
+			return value, ok
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(settings).To(Equal(map[string]any{
+			"quiet": true,
+			"nice":  5,
+			"set":   []any{"a=1", "b=2"},
+			"iso":   map[string]any{"label": "KAIROS"},
+		}))
+
+		given["nice"] = "lots"
+		_, err = schema.Settings(func(path string) (string, bool) {
+			value, ok := given[path]
+			return value, ok
+		})
+		Expect(err).To(MatchError(ContainSubstring("invalid value of nice")))
+	})
+})
@@ -0,0 +1,189 @@
+// Package manifest describes the build manifest, the manifest.yaml of the config dir holding the
+// settings of the builds, with a JSON Schema editors and other tools can validate manifests with.
+// The settings are the flags of the build commands and the fields of their config, so the schema
+// is made out of them and can't drift from what enki reads.
+package manifest
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// FileName is the name of the manifest within the config dir
+	FileName = "manifest.yaml"
+	// Version is the version of the manifest schema, raised on incompatible changes only
+	Version = 1
+	// Draft is the JSON Schema dialect of the schema
+	Draft = "https://json-schema.org/draft/2020-12/schema"
+)
+
+// ID returns where the schema of the version is published
+func ID() string {
+	return fmt.Sprintf("https://raw.githubusercontent.com/kairos-io/enki/main/schema/manifest.v%d.json", Version)
+}
+
+// Schema is a JSON Schema, with the keywords the manifest needs only
+type Schema struct {
+	Draft                string             `json:"$schema,omitempty"`
+	ID                   string             `json:"$id,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+}
+
+// New returns the schema of the manifest, without any setting yet
+func New() *Schema {
+	s := Object("Settings of the enki builds, the " + FileName + " of the config dir")
+	s.Draft = Draft
+	s.ID = ID()
+	s.Title = fmt.Sprintf("enki build manifest v%d", Version)
+	// Lets editors tell the schema of the manifest from the manifest itself
+	s.Properties["$schema"] = &Schema{Type: "string", Description: "The schema of the manifest, " + ID()}
+	s.Properties[ExtendsKey] = &Schema{
+		Description: "Manifests this one extends, relative to its dir. Its settings override theirs, sections are merged key by key",
+		AnyOf:       []*Schema{{Type: "string"}, {Type: "array", Items: &Schema{Type: "string"}}},
+	}
+	return s
+}
+
+// Object returns the schema of an object with no other properties than the ones added to it
+func Object(description string) *Schema {
+	closed := false
+	return &Schema{Type: "object", Description: description, Properties: map[string]*Schema{}, AdditionalProperties: &closed}
+}
+
+// Allowed is implemented by the flag values with a fixed set of values
+type Allowed interface {
+	AllowedValues() []string
+}
+
+// AddFlags adds the flags of the set as properties, but the skipped ones
+func (s *Schema) AddFlags(flags *pflag.FlagSet, skip ...string) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "help" || f.Hidden || slices.Contains(skip, f.Name) {
+			return
+		}
+		p := flagSchema(f)
+		if existing, ok := s.Properties[f.Name]; ok && existing.Description != "" {
+			p.Description = existing.Description
+		}
+		s.Properties[f.Name] = p
+	})
+}
+
+// flagSchema returns the schema of the values of the flag
+func flagSchema(f *pflag.Flag) *Schema {
+	p := &Schema{Description: f.Usage}
+	switch f.Value.Type() {
+	case "bool":
+		p.Type = "boolean"
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "count":
+		p.Type = "integer"
+	case "stringSlice", "stringArray":
+		p.Type = "array"
+		p.Items = &Schema{Type: "string"}
+	default:
+		p.Type = "string"
+	}
+	if a, ok := f.Value.(Allowed); ok {
+		p.Enum = a.AllowedValues()
+	}
+	return p
+}
+
+// AddStruct adds the fields of v with a mapstructure tag as properties, described by the flags of
+// the same name if any. The fields squashed into v are added as its own.
+func (s *Schema) AddStruct(v any, flags *pflag.FlagSet) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if options == "squash" {
+			s.AddStruct(reflect.New(field.Type).Interface(), flags)
+			continue
+		}
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		p := typeSchema(field.Type)
+		if flags != nil {
+			if f := flags.Lookup(name); f != nil {
+				p.Description = f.Usage
+				if a, ok := f.Value.(Allowed); ok {
+					p.Enum = a.AllowedValues()
+				}
+			}
+		}
+		s.Properties[name] = p
+	}
+}
+
+// typeSchema returns the schema of the values of the Go type, the image sources are given as
+// their URIs
+func typeSchema(t reflect.Type) *Schema {
+	if t == reflect.TypeOf(&v1.ImageSource{}) {
+		return &Schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice:
+		return &Schema{Type: "array", Items: typeSchema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	}
+	// Decoded by their own hooks, any value is left to them
+	return &Schema{}
+}
+
+// Check fails on the settings of the manifest the schema doesn't know, listing all of them
+func (s *Schema) Check(manifest map[string]any) error {
+	unknown := s.unknown("", manifest)
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	if len(unknown) == 1 {
+		return fmt.Errorf("unknown field %q in the manifest", unknown[0])
+	}
+	return fmt.Errorf("unknown fields in the manifest: %s", strings.Join(unknown, ", "))
+}
+
+// unknown returns the paths of the keys of value not known by the schema
+func (s *Schema) unknown(prefix string, value any) []string {
+	m, ok := value.(map[string]any)
+	if !ok || s.AdditionalProperties == nil || *s.AdditionalProperties {
+		return nil
+	}
+	var unknown []string
+	for key, item := range m {
+		// Viper reads the keys case insensitively
+		p, ok := s.Properties[strings.ToLower(key)]
+		if !ok {
+			unknown = append(unknown, prefix+key)
+			continue
+		}
+		unknown = append(unknown, p.unknown(prefix+key+".", item)...)
+	}
+	return unknown
+}
@@ -0,0 +1,70 @@
+package manifest_test
+
+import (
+	"github.com/kairos-io/enki/pkg/manifest"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+)
+
+type base struct {
+	Arch string `mapstructure:"arch"`
+}
+
+type config struct {
+	Name     string            `mapstructure:"name"`
+	Sources  []*v1.ImageSource `mapstructure:"rootfs"`
+	Sizes    map[string]int    `mapstructure:"sizes"`
+	Skipped  string            `mapstructure:"-"`
+	Untagged string
+	base     `mapstructure:",squash"`
+}
+
+var _ = Describe("Manifest", Label("manifest"), func() {
+	var schema *manifest.Schema
+	BeforeEach(func() {
+		flags := pflag.NewFlagSet("build", pflag.ContinueOnError)
+		flags.Bool("debug", false, "Enable debug output")
+		flags.Int("nice", 0, "Niceness")
+		flags.StringSlice("set", nil, "Template values")
+		flags.String("name", "", "Name of the artifacts")
+		flags.String("containerized", "", "Host only")
+		schema = manifest.New()
+		schema.AddStruct(config{}, flags)
+		schema.AddFlags(flags, "containerized")
+		iso := manifest.Object("Settings of build-iso")
+		iso.AddStruct(config{}, nil)
+		schema.Properties["iso"] = iso
+	})
+
+	It("describes the settings with their types", func() {
+		Expect(schema.ID).To(Equal(manifest.ID()))
+		Expect(schema.Properties["debug"]).To(Equal(&manifest.Schema{Type: "boolean", Description: "Enable debug output"}))
+		Expect(schema.Properties["nice"].Type).To(Equal("integer"))
+		Expect(schema.Properties["set"]).To(Equal(&manifest.Schema{Type: "array", Description: "Template values", Items: &manifest.Schema{Type: "string"}}))
+		Expect(schema.Properties["name"]).To(Equal(&manifest.Schema{Type: "string", Description: "Name of the artifacts"}))
+		Expect(schema.Properties["rootfs"]).To(Equal(&manifest.Schema{Type: "array", Items: &manifest.Schema{Type: "string"}}))
+		Expect(schema.Properties["sizes"].Type).To(Equal("object"))
+		Expect(schema.Properties).To(HaveKey("arch"))
+		Expect(schema.Properties).To(HaveKey("$schema"))
+		Expect(schema.Properties).ToNot(HaveKey("containerized"))
+		Expect(schema.Properties).ToNot(HaveKey("-"))
+		Expect(schema.Properties).ToNot(HaveKey("untagged"))
+	})
+
+	It("fails on the settings it doesn't know", func() {
+		Expect(schema.Check(map[string]any{
+			"name":  "kairos",
+			"Nice":  10,
+			"sizes": map[string]any{"anything": 1},
+			"iso":   map[string]any{"rootfs": []any{"oci:kairos"}},
+		})).To(Succeed())
+		Expect(schema.Check(map[string]any{"nmae": "kairos"})).To(MatchError(`unknown field "nmae" in the manifest`))
+		Expect(schema.Check(map[string]any{
+			"nmae": "kairos",
+			"iso":  map[string]any{"rootfs": []any{}, "debug": true},
+		})).To(MatchError("unknown fields in the manifest: iso.debug, nmae"))
+		Expect(schema.Properties).To(HaveKey(manifest.ExtendsKey))
+	})
+})
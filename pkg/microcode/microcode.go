@@ -0,0 +1,227 @@
+// Package microcode builds the early cpio archive loading the CPU microcode updates shipped in a
+// rootfs, which the kernel only picks up from an uncompressed archive at the start of the initrd.
+package microcode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/klauspost/compress/zstd"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/ulikunitz/xz"
+)
+
+// The microcode modes
+const (
+	// Auto loads the microcode of the vendors the rootfs ships it for
+	Auto = "auto"
+	// AMD only loads the AMD microcode, failing if the rootfs lacks it
+	AMD = "amd"
+	// Intel only loads the Intel microcode, failing if the rootfs lacks it
+	Intel = "intel"
+	// None leaves the initrd alone
+	None = "none"
+)
+
+// Modes returns the available microcode modes
+func Modes() []string {
+	return []string{Auto, AMD, Intel, None}
+}
+
+// earlyDir is where the kernel looks for the microcode in the early cpio archive
+const earlyDir = "kernel/x86/microcode"
+
+// firmwareDirs are the dirs of the rootfs the microcode is found in, by their precedence
+var firmwareDirs = []string{"usr/lib/firmware", "lib/firmware"}
+
+// vendor is a CPU vendor the kernel loads the microcode of
+type vendor struct {
+	mode string
+	// dir is the dir of the firmware dirs with its microcode
+	dir string
+	// pattern matches the microcode files of dir, which may be compressed
+	pattern *regexp.Regexp
+	// file is the name of its microcode in the early cpio archive, the CPUID vendor string
+	file string
+}
+
+var vendors = []vendor{
+	{mode: AMD, dir: "amd-ucode", pattern: regexp.MustCompile(`^microcode_amd.*\.bin(\.xz|\.zst)?$`), file: "AuthenticAMD.bin"},
+	{mode: Intel, dir: "intel-ucode", pattern: regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{2}-[0-9a-f]{2}(\.xz|\.zst)?$`), file: "GenuineIntel.bin"},
+}
+
+// Check fails on unknown modes, and on the ones loading the microcode of a vendor on an arch
+// other than x86_64
+func Check(mode, arch string) error {
+	switch mode {
+	case Auto, None:
+		return nil
+	case AMD, Intel:
+		if !utils.IsAmd64(arch) {
+			return fmt.Errorf("microcode %s is only supported for %s", mode, constants.ArchAmd64)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid microcode %q, available modes: %s", mode, strings.Join(Modes(), ", "))
+}
+
+// Archive returns the early cpio archive with the microcode of the rootfs at root for mode, along
+// with the vendors it loads the microcode of. It's empty with no microcode to load, as on arches
+// other than x86_64 with the auto mode.
+func Archive(fs v1.FS, root, mode, arch string) ([]byte, []string, error) {
+	if err := Check(mode, arch); err != nil {
+		return nil, nil, err
+	}
+	if mode == None || !utils.IsAmd64(arch) {
+		return nil, nil, nil
+	}
+	var records []cpio.Record
+	var found []string
+	for _, v := range vendors {
+		if mode != Auto && mode != v.mode {
+			continue
+		}
+		data, err := v.microcode(fs, root)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(data) == 0 {
+			if mode == v.mode {
+				return nil, nil, fmt.Errorf("the rootfs has no %s microcode in %s", v.mode, filepath.Join(firmwareDirs[0], v.dir))
+			}
+			continue
+		}
+		records = append(records, cpio.StaticRecord(data, cpio.Info{Name: filepath.Join(earlyDir, v.file), Mode: cpio.S_IFREG | 0o644}))
+		found = append(found, v.mode)
+	}
+	if len(records) == 0 {
+		return nil, nil, nil
+	}
+
+	var buf bytes.Buffer
+	w := cpio.Newc.Writer(&buf)
+	dirs := []cpio.Record{cpio.Directory("kernel", 0o755), cpio.Directory("kernel/x86", 0o755), cpio.Directory(earlyDir, 0o755)}
+	if err := cpio.WriteRecords(w, append(dirs, records...)); err != nil {
+		return nil, nil, fmt.Errorf("writing the microcode archive: %w", err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		return nil, nil, fmt.Errorf("writing the microcode archive: %w", err)
+	}
+	return buf.Bytes(), found, nil
+}
+
+// microcode returns the microcode files of the vendor in the rootfs at root concatenated, as the
+// kernel expects them, from the first firmware dir having any
+func (v vendor) microcode(fs v1.FS, root string) ([]byte, error) {
+	for _, dir := range firmwareDirs {
+		entries, err := fs.ReadDir(filepath.Join(root, dir, v.dir))
+		if err != nil {
+			continue
+		}
+		var names []string
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && v.pattern.MatchString(entry.Name()) {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+		var data []byte
+		for _, name := range names {
+			content, err := readFile(fs, filepath.Join(root, dir, v.dir, name))
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, content...)
+		}
+		if len(data) > 0 {
+			return data, nil
+		}
+	}
+	return nil, nil
+}
+
+// readFile returns the contents of the file at path, decompressed if it's xz or zstd compressed
+// as some distros ship their firmware
+func readFile(fs v1.FS, path string) ([]byte, error) {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	switch filepath.Ext(path) {
+	case ".xz":
+		r, err = xz.NewReader(bytes.NewReader(data))
+	case ".zst":
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(bytes.NewReader(data)); err == nil {
+			defer d.Close()
+			r = d
+		}
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", filepath.Base(path), err)
+	}
+	if data, err = io.ReadAll(r); err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", filepath.Base(path), err)
+	}
+	return data, nil
+}
+
+// Loaded tells if the initrd at path already starts with an early cpio archive loading microcode,
+// as the ones of dracut with early_microcode
+func Loaded(fs v1.FS, path string) (bool, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := cpio.Newc.Reader(f)
+	for {
+		rec, err := r.ReadRecord()
+		if err != nil {
+			// The end of the early archive, or a compressed one
+			return false, nil
+		}
+		if strings.HasPrefix(cpio.Normalize(rec.Name), earlyDir+"/") {
+			return true, nil
+		}
+	}
+}
+
+// Prepend writes the initrd at path to target, starting with the archive
+func Prepend(fs v1.FS, path, target string, archive []byte) (err error) {
+	initrd, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer initrd.Close()
+	info, err := initrd.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := fs.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode()&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if _, err = out.Write(archive); err != nil {
+		return err
+	}
+	_, err = io.Copy(out, initrd)
+	return err
+}
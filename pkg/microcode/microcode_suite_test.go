@@ -0,0 +1,13 @@
+package microcode_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestMicrocode(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Microcode test suite")
+}
@@ -0,0 +1,106 @@
+package microcode_test
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/microcode"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/ulikunitz/xz"
+)
+
+// records returns the files of the early cpio archive at the start of data by their name
+func records(data []byte) map[string]string {
+	files := map[string]string{}
+	r := cpio.Newc.Reader(bytes.NewReader(data))
+	Expect(cpio.ForEachRecord(r, func(rec cpio.Record) error {
+		if rec.Mode&cpio.S_IFMT == cpio.S_IFREG {
+			content, err := io.ReadAll(io.NewSectionReader(rec.ReaderAt, 0, int64(rec.FileSize)))
+			files[rec.Name] = string(content)
+			return err
+		}
+		return nil
+	})).To(Succeed())
+	return files
+}
+
+var _ = Describe("Microcode", Label("microcode"), func() {
+	var rootfs map[string]interface{}
+	BeforeEach(func() {
+		var compressed bytes.Buffer
+		w, err := xz.NewWriter(&compressed)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = w.Write([]byte("amd-fam17h;"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+		rootfs = map[string]interface{}{
+			"/rootfs/usr/lib/firmware/amd-ucode/microcode_amd.bin":           "amd;",
+			"/rootfs/usr/lib/firmware/amd-ucode/microcode_amd_fam17h.bin.xz": compressed.String(),
+			"/rootfs/usr/lib/firmware/amd-ucode/microcode_amd.bin.asc":       "signature",
+			"/rootfs/usr/lib/firmware/intel-ucode/06-8e-09":                  "intel-8e;",
+			"/rootfs/usr/lib/firmware/intel-ucode/06-55-04":                  "intel-55;",
+			"/rootfs/usr/lib/firmware/intel-ucode/README":                    "readme",
+			"/rootfs/boot/initrd": "compressed initrd",
+		}
+	})
+
+	It("archives the microcode of the vendors the rootfs ships it for", func() {
+		fs, cleanup, err := vfst.NewTestFS(rootfs)
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		archive, vendors, err := microcode.Archive(fs, "/rootfs", microcode.Auto, constants.ArchAmd64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vendors).To(Equal([]string{microcode.AMD, microcode.Intel}))
+		Expect(records(archive)).To(Equal(map[string]string{
+			"kernel/x86/microcode/AuthenticAMD.bin": "amd;amd-fam17h;",
+			"kernel/x86/microcode/GenuineIntel.bin": "intel-55;intel-8e;",
+		}))
+
+		archive, vendors, err = microcode.Archive(fs, "/rootfs", microcode.Intel, constants.ArchAmd64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vendors).To(Equal([]string{microcode.Intel}))
+		Expect(records(archive)).To(HaveKey("kernel/x86/microcode/GenuineIntel.bin"))
+		Expect(records(archive)).ToNot(HaveKey("kernel/x86/microcode/AuthenticAMD.bin"))
+
+		archive, _, err = microcode.Archive(fs, "/rootfs", microcode.Auto, constants.ArchArm64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(archive).To(BeEmpty())
+		archive, _, err = microcode.Archive(fs, "/rootfs", microcode.None, constants.ArchAmd64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(archive).To(BeEmpty())
+	})
+
+	It("fails on the microcode the rootfs lacks and on other arches", func() {
+		delete(rootfs, "/rootfs/usr/lib/firmware/intel-ucode/06-8e-09")
+		delete(rootfs, "/rootfs/usr/lib/firmware/intel-ucode/06-55-04")
+		fs, cleanup, err := vfst.NewTestFS(rootfs)
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		_, _, err = microcode.Archive(fs, "/rootfs", microcode.Intel, constants.ArchAmd64)
+		Expect(err).To(MatchError(ContainSubstring("no intel microcode")))
+		_, _, err = microcode.Archive(fs, "/rootfs", microcode.AMD, constants.ArchArm64)
+		Expect(err).To(MatchError(ContainSubstring("only supported for")))
+		Expect(microcode.Check("both", constants.ArchAmd64)).To(MatchError(ContainSubstring(`invalid microcode "both"`)))
+	})
+
+	It("prepends the archive to initrds not loading microcode yet", func() {
+		fs, cleanup, err := vfst.NewTestFS(rootfs)
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		Expect(microcode.Loaded(fs, "/rootfs/boot/initrd")).To(BeFalse())
+		archive, _, err := microcode.Archive(fs, "/rootfs", microcode.Auto, constants.ArchAmd64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(microcode.Prepend(fs, "/rootfs/boot/initrd", "/initrd", archive)).To(Succeed())
+		data, err := fs.ReadFile("/initrd")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal(append(archive, []byte("compressed initrd")...)))
+		Expect(microcode.Loaded(fs, "/initrd")).To(BeTrue())
+	})
+})
@@ -0,0 +1,114 @@
+// Package mirror points the downloads of enki to mirrors of their sources, so air-gapped builds
+// and the ones far from the upstream registries and release sites work without changing the
+// manifests. Mirrors are given as FROM=TO, with FROM the prefix of the image references or
+// download URLs to replace with TO, like quay.io/kairos=registry.internal/kairos or
+// https://github.com=https://artifacts.internal/github. The longest matching prefix wins.
+package mirror
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// Mirror replaces the prefix From of the image references or download URLs with To
+type Mirror struct {
+	From string
+	To   string
+}
+
+// mirrors are the mirrors in use, see Use
+var mirrors []Mirror
+
+// Parse parses mirrors given as FROM=TO
+func Parse(entries []string) ([]Mirror, error) {
+	var parsed []Mirror
+	for _, entry := range entries {
+		from, to, ok := strings.Cut(entry, "=")
+		from, to = strings.TrimSuffix(strings.TrimSpace(from), "/"), strings.TrimSuffix(strings.TrimSpace(to), "/")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid mirror %q, give FROM=TO like quay.io/kairos=registry.internal/kairos", entry)
+		}
+		parsed = append(parsed, Mirror{From: from, To: to})
+	}
+	return parsed, nil
+}
+
+// Use sets the mirrors the downloads go to
+func Use(m []Mirror) {
+	mirrors = m
+}
+
+// rewrite returns s with its longest mirrored prefix replaced, the prefix matching up to one of
+// the separators
+func rewrite(s, separators string) (string, bool) {
+	var best *Mirror
+	for i, m := range mirrors {
+		if !strings.HasPrefix(s, m.From) {
+			continue
+		}
+		if len(s) > len(m.From) && !strings.ContainsRune(separators, rune(s[len(m.From)])) {
+			continue
+		}
+		if best == nil || len(m.From) > len(best.From) {
+			best = &mirrors[i]
+		}
+	}
+	if best == nil {
+		return s, false
+	}
+	return best.To + strings.TrimPrefix(s, best.From), true
+}
+
+// URL returns the download URL on its mirror, or as it is if none mirrors it
+func URL(url string) string {
+	rewritten, _ := rewrite(url, "/?#")
+	return rewritten
+}
+
+// Image returns the image reference on its mirror, or as it is if none mirrors it. The images of
+// the docker hub are matched by their short names, like ubuntu, as well as by their full ones,
+// like docker.io/library/ubuntu or index.docker.io/library/ubuntu.
+func Image(ref string) string {
+	candidates := []string{ref}
+	if r, err := name.ParseReference(ref); err == nil {
+		full := r.Name()
+		candidates = append(candidates, full)
+		if r.Context().RegistryStr() == name.DefaultRegistry {
+			candidates = append(candidates, "docker.io"+strings.TrimPrefix(full, name.DefaultRegistry))
+		}
+	}
+	for _, candidate := range candidates {
+		if rewritten, ok := rewrite(candidate, "/:@"); ok {
+			return rewritten
+		}
+	}
+	return ref
+}
+
+// Extractor is an image extractor pulling the images from their mirrors with Next
+type Extractor struct {
+	Next   v1.ImageExtractor
+	Logger v1.Logger
+}
+
+var _ v1.ImageExtractor = Extractor{}
+
+func (e Extractor) ExtractImage(imageRef, destination, platformRef string) error {
+	return e.Next.ExtractImage(e.image(imageRef), destination, platformRef)
+}
+
+func (e Extractor) GetOCIImageSize(imageRef, platformRef string) (int64, error) {
+	return e.Next.GetOCIImageSize(e.image(imageRef), platformRef)
+}
+
+// image returns the image reference on its mirror, logging it
+func (e Extractor) image(ref string) string {
+	mirrored := Image(ref)
+	if mirrored != ref && e.Logger != nil {
+		e.Logger.Infof("Pulling %s from its mirror %s", ref, mirrored)
+	}
+	return mirrored
+}
@@ -0,0 +1,61 @@
+package mirror_test
+
+import (
+	"github.com/kairos-io/enki/pkg/mirror"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// recordingExtractor records the images it is asked to extract
+type recordingExtractor struct {
+	v1mock.FakeImageExtractor
+	refs *[]string
+}
+
+func (r recordingExtractor) ExtractImage(imageRef, destination, platformRef string) error {
+	*r.refs = append(*r.refs, imageRef)
+	return nil
+}
+
+var _ = Describe("Mirror", Label("mirror"), func() {
+	BeforeEach(func() {
+		mirrors, err := mirror.Parse([]string{
+			"quay.io=registry.internal/quay",
+			"quay.io/kairos/=registry.internal/kairos",
+			"docker.io/library=registry.internal/hub",
+			"https://github.com=https://artifacts.internal/github",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		mirror.Use(mirrors)
+		DeferCleanup(mirror.Use, []mirror.Mirror(nil))
+	})
+
+	It("rejects malformed mirrors", func() {
+		_, err := mirror.Parse([]string{"registry.internal"})
+		Expect(err).To(MatchError(ContainSubstring("invalid mirror")))
+		_, err = mirror.Parse([]string{"quay.io="})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rewrites the images by their longest mirrored prefix", func() {
+		Expect(mirror.Image("quay.io/kairos/opensuse:leap-15.5")).To(Equal("registry.internal/kairos/opensuse:leap-15.5"))
+		Expect(mirror.Image("quay.io/other/image@sha256:abc")).To(Equal("registry.internal/quay/other/image@sha256:abc"))
+		Expect(mirror.Image("quay.io.example.com/image")).To(Equal("quay.io.example.com/image"))
+		Expect(mirror.Image("ubuntu:22.04")).To(Equal("registry.internal/hub/ubuntu:22.04"))
+		Expect(mirror.Image("ghcr.io/kairos-io/image")).To(Equal("ghcr.io/kairos-io/image"))
+	})
+
+	It("rewrites the download URLs", func() {
+		Expect(mirror.URL("https://github.com/sigstore/cosign/releases/download/v2.2.3/cosign-linux-amd64")).To(Equal("https://artifacts.internal/github/sigstore/cosign/releases/download/v2.2.3/cosign-linux-amd64"))
+		Expect(mirror.URL("https://github.company.com/release")).To(Equal("https://github.company.com/release"))
+	})
+
+	It("pulls the images from their mirrors", func() {
+		var refs []string
+		var extractor v1.ImageExtractor = mirror.Extractor{Next: recordingExtractor{refs: &refs}}
+		Expect(extractor.ExtractImage("quay.io/kairos/alpine:3.19", "/tmp/rootfs", "linux/amd64")).To(Succeed())
+		Expect(refs).To(Equal([]string{"registry.internal/kairos/alpine:3.19"}))
+	})
+})
@@ -0,0 +1,138 @@
+// Package naming derives the file names of the artifacts of every command from the release values
+// of the source image, so they identify the flavor, version and arch they were built from the
+// same way whatever built them.
+package naming
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/templating"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// TemplateKey is the setting overriding the derived names with a template
+	TemplateKey = "name-template"
+	// DefaultName is the first part of the derived names
+	DefaultName = "kairos"
+
+	dateFormat = "20060102"
+)
+
+// Types of the artifacts, the last part of their names
+const (
+	TypeUKI      = "uki"
+	TypeRecovery = "recovery"
+)
+
+// fields are the values of the derived names, in order. Empty values are left out.
+var fields = []string{"flavor", "flavor_release", "variant", "arch", "model", "version"}
+
+// Options tell how to name the artifacts of a build
+type Options struct {
+	// Name replaces the values of the image in the names if set
+	Name string
+	Arch string
+	// Date is added to the names unless it is zero
+	Date time.Time
+	// Template overrides the derived names, see Vars for its values
+	Template string
+	// Set are the values overriding the release values of the image, as given with --set
+	Set templating.Vars
+}
+
+// Namer names the artifacts of a build
+type Namer struct {
+	vars     templating.Vars
+	template string
+	// named tells if the name replaces the values of the image
+	named bool
+}
+
+// New returns the namer of the image in rootDir. Images without release values, like plain
+// distro images, are named after their arch only.
+func New(logger v1.Logger, fs v1.FS, rootDir string, opts Options) *Namer {
+	vars, err := templating.FromRelease(fs, rootDir)
+	if err != nil {
+		logger.Debugf("Naming the artifacts without the release values of the image: %s", err)
+		vars = templating.Vars{}
+	}
+	return newNamer(vars, opts)
+}
+
+// FromRelease returns the namer of an image with the given release values, like the ones given
+// before the image is pulled
+func FromRelease(release templating.Vars, opts Options) *Namer {
+	return newNamer(release, opts)
+}
+
+func newNamer(release templating.Vars, opts Options) *Namer {
+	vars := templating.Vars{"name": DefaultName, "date": "", "type": ""}
+	for _, field := range fields {
+		vars[field] = ""
+	}
+	// The release values name the arch like the Kairos releases do, the build arch is only used
+	// for images without them
+	if opts.Arch != "" {
+		vars["arch"] = opts.Arch
+	}
+	vars = vars.Merge(release, opts.Set)
+	if opts.Name != "" {
+		vars["name"] = opts.Name
+	}
+	if !opts.Date.IsZero() {
+		vars["date"] = opts.Date.UTC().Format(dateFormat)
+	}
+	return &Namer{vars: vars, template: opts.Template, named: opts.Name != ""}
+}
+
+// Vars returns the values names are made of, each one available to templates as {{.name}}: the
+// release values of the image, like flavor, flavor_release, variant, model and version, along
+// with name, arch, date and the type of the artifact.
+func (n *Namer) Vars(artifactType string) templating.Vars {
+	return n.vars.Merge(templating.Vars{"type": artifactType})
+}
+
+// Name returns the file name of the artifact of the given type, an empty one for the main
+// artifact of a command, with the given extension. Without a template the name is made of the
+// name, the values of the image if no name was given, the date and the type, like
+// kairos-ubuntu-24.04-core-amd64-generic-v3.0.0-uki.iso
+func (n *Namer) Name(artifactType, ext string) (string, error) {
+	vars := n.Vars(artifactType)
+	var base string
+	if n.template != "" {
+		var err error
+		if base, err = templating.Expand(n.template, vars); err != nil {
+			return "", fmt.Errorf("%s: %w", TemplateKey, err)
+		}
+	} else {
+		parts := []string{vars["name"]}
+		if !n.named {
+			for _, field := range fields {
+				parts = append(parts, vars[field])
+			}
+		}
+		parts = append(parts, vars["date"], artifactType)
+		var kept []string
+		for _, part := range parts {
+			if part = strings.TrimSpace(part); part != "" {
+				kept = append(kept, strings.ReplaceAll(part, "/", "-"))
+			}
+		}
+		base = strings.Join(kept, "-")
+	}
+	if err := CheckName(base); err != nil {
+		return "", err
+	}
+	return base + "." + ext, nil
+}
+
+// CheckName fails if name can't be the base name of a file
+func CheckName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid artifact name %q, it must be a non empty file name", name)
+	}
+	return nil
+}
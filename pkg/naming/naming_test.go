@@ -0,0 +1,59 @@
+package naming_test
+
+import (
+	"time"
+
+	"github.com/kairos-io/enki/pkg/naming"
+	"github.com/kairos-io/enki/pkg/templating"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Naming", Label("naming"), func() {
+	var fs *vfst.TestFS
+	var logger v1.Logger
+	BeforeEach(func() {
+		var cleanup func()
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/rootfs/etc/kairos-release": "KAIROS_FLAVOR=\"ubuntu\"\nKAIROS_FLAVOR_RELEASE=\"24.04\"\nKAIROS_VARIANT=\"core\"\nKAIROS_ARCH=\"amd64\"\nKAIROS_MODEL=\"generic\"\nKAIROS_VERSION=\"v3.0.0\"\n",
+			"/plain/etc/os-release":      "ID=alpine\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(cleanup)
+		logger = v1.NewNullLogger()
+	})
+
+	It("derives the names from the release values of the image", func() {
+		namer := naming.New(logger, fs, "/rootfs", naming.Options{Arch: "x86_64"})
+		Expect(namer.Name("", "iso")).To(Equal("kairos-ubuntu-24.04-core-amd64-generic-v3.0.0.iso"))
+		Expect(namer.Name(naming.TypeUKI, "tar")).To(Equal("kairos-ubuntu-24.04-core-amd64-generic-v3.0.0-uki.tar"))
+
+		namer = naming.New(logger, fs, "/plain", naming.Options{Arch: "x86_64", Date: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)})
+		Expect(namer.Name(naming.TypeRecovery, "squashfs")).To(Equal("kairos-x86_64-20240501-recovery.squashfs"))
+	})
+
+	It("replaces the values of the image with the given name", func() {
+		namer := naming.New(logger, fs, "/rootfs", naming.Options{Name: "edge-appliance"})
+		Expect(namer.Name("", "iso")).To(Equal("edge-appliance.iso"))
+		Expect(namer.Name(naming.TypeRecovery, "squashfs")).To(Equal("edge-appliance-recovery.squashfs"))
+	})
+
+	It("names the artifacts with the template", func() {
+		namer := naming.New(logger, fs, "/rootfs", naming.Options{
+			Template: "{{.flavor}}{{.flavor_release}}_{{.version | trimPrefix \"v\"}}{{if .type}}_{{.type}}{{end}}",
+			Set:      templating.Vars{"flavor": "kubuntu"},
+		})
+		Expect(namer.Name("", "iso")).To(Equal("kubuntu24.04_3.0.0.iso"))
+		Expect(namer.Name(naming.TypeUKI, "iso")).To(Equal("kubuntu24.04_3.0.0_uki.iso"))
+
+		namer = naming.New(logger, fs, "/rootfs", naming.Options{Template: "{{.flavor}}/{{.version}}"})
+		_, err := namer.Name("", "iso")
+		Expect(err).To(MatchError(ContainSubstring("invalid artifact name")))
+		namer = naming.New(logger, fs, "/rootfs", naming.Options{Template: "{{.codename}}"})
+		_, err = namer.Name("", "iso")
+		Expect(err).To(MatchError(ContainSubstring(naming.TemplateKey)))
+	})
+})
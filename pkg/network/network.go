@@ -0,0 +1,196 @@
+// Package network configures the HTTP clients of enki, for the registries, the downloads and the
+// publishing APIs alike. They go through the proxies of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables, trust the given CAs on top of the ones of the system, like the ones of
+// TLS intercepting proxies, and skip the verification of the certificates of the insecure hosts.
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ProxyEnv are the environment variables naming the proxies, honored by enki and the tools it runs
+var ProxyEnv = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"}
+
+// CABundleEnv is the variable naming the CA bundle of the tools enki runs, read by the ones built
+// with Go or OpenSSL
+const CABundleEnv = "SSL_CERT_FILE"
+
+// systemBundles are the CA bundles of the distros, as Go looks them up
+var systemBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// Config is how the HTTP clients reach the network
+type Config struct {
+	// CACerts are PEM files of the CAs trusted on top of the ones of the system
+	CACerts []string
+	// InsecureHosts are the hosts, with an optional port, whose certificates are not verified
+	InsecureHosts []string
+}
+
+// Check fails on CA files that can't be read or hold no certificate
+func (c Config) Check() error {
+	for _, path := range c.CACerts {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s holds no PEM certificate", path)
+		}
+	}
+	for _, host := range c.InsecureHosts {
+		if host == "" || hostname(host) == "" {
+			return fmt.Errorf("invalid insecure host %q, give a host with an optional port like registry.local:5000", host)
+		}
+	}
+	return nil
+}
+
+// hostname returns the host without its port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Use configures the HTTP clients of enki and the tools it runs with c. The returned function
+// restores them as they were.
+func Use(c Config) (func(), error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	if len(c.CACerts) == 0 && len(c.InsecureHosts) == 0 {
+		return func() {}, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	var extra []byte
+	for _, path := range c.CACerts {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pool.AppendCertsFromPEM(data)
+		extra = append(append(extra, data...), '\n')
+	}
+	var hosts []string
+	for _, host := range c.InsecureHosts {
+		hosts = append(hosts, hostname(host))
+	}
+
+	restore := []func(){}
+	restoreAll := func() {
+		for i := len(restore) - 1; i >= 0; i-- {
+			restore[i]()
+		}
+	}
+	for _, t := range []*http.RoundTripper{&http.DefaultTransport, &remote.DefaultTransport} {
+		t, previous := t, *t
+		base, ok := previous.(*http.Transport)
+		if !ok {
+			continue
+		}
+		var transport http.RoundTripper = withTLS(base, &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+		if len(hosts) > 0 {
+			transport = &hostTransport{
+				secure:   transport,
+				insecure: withTLS(base, &tls.Config{InsecureSkipVerify: true}),
+				hosts:    hosts,
+			}
+		}
+		*t = transport
+		restore = append(restore, func() { *t = previous })
+	}
+	if len(extra) > 0 {
+		bundle, err := writeBundle(extra)
+		if err != nil {
+			restoreAll()
+			return nil, err
+		}
+		previous, had := os.LookupEnv(CABundleEnv)
+		_ = os.Setenv(CABundleEnv, bundle)
+		restore = append(restore, func() {
+			if had {
+				_ = os.Setenv(CABundleEnv, previous)
+			} else {
+				_ = os.Unsetenv(CABundleEnv)
+			}
+			_ = os.RemoveAll(filepath.Dir(bundle))
+		})
+	}
+	return restoreAll, nil
+}
+
+// withTLS returns a copy of base with the TLS config, going through the proxies of the environment
+func withTLS(base *http.Transport, config *tls.Config) *http.Transport {
+	t := base.Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	t.TLSClientConfig = config
+	return t
+}
+
+// hostTransport sends the requests to the insecure hosts without verifying their certificates
+type hostTransport struct {
+	secure, insecure http.RoundTripper
+	hosts            []string
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if slices.Contains(t.hosts, req.URL.Hostname()) {
+		return t.insecure.RoundTrip(req)
+	}
+	return t.secure.RoundTrip(req)
+}
+
+// writeBundle writes the system CA bundle along with the extra CAs, for the tools enki runs
+func writeBundle(extra []byte) (string, error) {
+	var system []byte
+	for _, path := range append([]string{os.Getenv(CABundleEnv)}, systemBundles...) {
+		if path == "" {
+			continue
+		}
+		if data, err := os.ReadFile(path); err == nil {
+			system = append(data, '\n')
+			break
+		}
+	}
+	dir, err := os.MkdirTemp("", "enki-ca")
+	if err != nil {
+		return "", err
+	}
+	bundle := filepath.Join(dir, "ca-bundle.pem")
+	if err := os.WriteFile(bundle, append(system, extra...), 0644); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	return bundle, nil
+}
+
+// ProxyVariables returns the names of the proxy variables set in the environment
+func ProxyVariables() []string {
+	var names []string
+	for _, name := range ProxyEnv {
+		if _, ok := os.LookupEnv(name); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,71 @@
+package network_test
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/network"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Network", Label("network"), func() {
+	var server *httptest.Server
+	var dir string
+	// get fetches the test server with the client the default transport makes at the time
+	get := func() error {
+		resp, err := (&http.Client{}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}))
+		DeferCleanup(server.Close)
+	})
+
+	It("rejects the CA files holding no certificate", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "ca.pem"), []byte("not a certificate"), 0644)).To(Succeed())
+		Expect(network.Config{CACerts: []string{filepath.Join(dir, "ca.pem")}}.Check()).To(MatchError(ContainSubstring("no PEM certificate")))
+		Expect(network.Config{CACerts: []string{filepath.Join(dir, "missing.pem")}}.Check()).ToNot(Succeed())
+		Expect(network.Config{InsecureHosts: []string{""}}.Check()).To(MatchError(ContainSubstring("invalid insecure host")))
+	})
+
+	It("trusts the given CAs until restored", func() {
+		ca := filepath.Join(dir, "ca.pem")
+		Expect(os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)).To(Succeed())
+		Expect(get()).ToNot(Succeed())
+
+		restore, err := network.Use(network.Config{CACerts: []string{ca}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(get()).To(Succeed())
+		bundle := os.Getenv(network.CABundleEnv)
+		data, err := os.ReadFile(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))))
+
+		restore()
+		Expect(get()).ToNot(Succeed())
+		Expect(bundle).ToNot(BeAnExistingFile())
+	})
+
+	It("skips the verification of the insecure hosts only", func() {
+		restore, err := network.Use(network.Config{InsecureHosts: []string{"127.0.0.1:5000"}})
+		Expect(err).ToNot(HaveOccurred())
+		defer restore()
+		Expect(get()).To(Succeed())
+
+		restore()
+		restore, err = network.Use(network.Config{InsecureHosts: []string{"registry.local"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(get()).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,235 @@
+// Package publish uploads the artifacts of a build to release hosting services
+package publish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// DefaultGitHubAPI is the API endpoint of github.com, GitHub Enterprise servers use their own
+const DefaultGitHubAPI = "https://api.github.com"
+
+// artifactPatterns select the files of a workdir that get published
+var artifactPatterns = []string{
+	"*.iso", "*.squashfs", "*.efi", "*.img", "*.tar", "*.enc",
+	"*.sha256", "*.sha512", "*.blake3", "*.zsync", "*.torrent",
+	"*.spdx.json", "*.cdx.json", "*sbom*",
+}
+
+// GitHub publishes artifacts to GitHub releases
+type GitHub struct {
+	// APIURL is the REST API endpoint, DefaultGitHubAPI if empty
+	APIURL string
+	Token  string
+	Client *http.Client
+	Logger v1.Logger
+}
+
+// Release is the subset of the GitHub release object we use
+type Release struct {
+	ID        int64   `json:"id"`
+	TagName   string  `json:"tag_name"`
+	HTMLURL   string  `json:"html_url"`
+	UploadURL string  `json:"upload_url"`
+	Draft     bool    `json:"draft"`
+	Assets    []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a release
+type Asset struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// ReleaseOptions are used when the release has to be created
+type ReleaseOptions struct {
+	Draft      bool
+	Prerelease bool
+}
+
+// Artifacts returns the files in dir that are published, sorted by name
+func Artifacts(dir string) ([]string, error) {
+	seen := map[string]bool{}
+	var files []string
+	for _, pattern := range artifactPatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err != nil || !fi.Mode().IsRegular() || seen[m] {
+				continue
+			}
+			seen[m] = true
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Publish uploads the files to the release of tag in repo, creating the release if missing.
+// Assets with the same name are replaced.
+func (g GitHub) Publish(repo, tag string, files []string, opts ReleaseOptions) (*Release, error) {
+	release, err := g.GetRelease(repo, tag)
+	if err != nil {
+		return nil, err
+	}
+	if release == nil {
+		g.Logger.Infof("Creating release %s in %s", tag, repo)
+		release, err = g.CreateRelease(repo, tag, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range files {
+		name := filepath.Base(f)
+		for _, asset := range release.Assets {
+			if asset.Name == name {
+				g.Logger.Infof("Replacing existing asset %s", name)
+				if err := g.deleteAsset(repo, asset.ID); err != nil {
+					return nil, err
+				}
+			}
+		}
+		g.Logger.Infof("Uploading %s to release %s", name, tag)
+		if err := g.UploadAsset(release, f); err != nil {
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// GetRelease returns the release of the given tag, or nil if there is none. Drafts are not
+// returned by tag, they are looked up in the list of releases.
+func (g GitHub) GetRelease(repo, tag string) (*Release, error) {
+	var release Release
+	status, err := g.do(http.MethodGet, fmt.Sprintf("%s/repos/%s/releases/tags/%s", g.api(), repo, url.PathEscape(tag)), nil, "", -1, &release)
+	if status == http.StatusNotFound {
+		return g.findDraft(repo, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// releasesPage is how many releases are listed per request, the most the API allows
+const releasesPage = 100
+
+// findDraft returns the draft release of tag in the list of releases of repo, nil if there is none
+func (g GitHub) findDraft(repo, tag string) (*Release, error) {
+	for page := 1; ; page++ {
+		var releases []Release
+		_, err := g.do(http.MethodGet, fmt.Sprintf("%s/repos/%s/releases?per_page=%d&page=%d", g.api(), repo, releasesPage, page), nil, "", -1, &releases)
+		if err != nil {
+			return nil, err
+		}
+		for _, release := range releases {
+			if release.TagName == tag {
+				return &release, nil
+			}
+		}
+		if len(releases) < releasesPage {
+			return nil, nil
+		}
+	}
+}
+
+// CreateRelease creates the release of tag, the tag is created from the default branch if missing
+func (g GitHub) CreateRelease(repo, tag string, opts ReleaseOptions) (*Release, error) {
+	body, err := json.Marshal(map[string]any{
+		"tag_name":   tag,
+		"name":       tag,
+		"draft":      opts.Draft,
+		"prerelease": opts.Prerelease,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var release Release
+	_, err = g.do(http.MethodPost, fmt.Sprintf("%s/repos/%s/releases", g.api(), repo), bytes.NewReader(body), "application/json", int64(len(body)), &release)
+	if err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// UploadAsset streams the file to the release
+func (g GitHub) UploadAsset(release *Release, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// The upload URL is a template like https://uploads.github.com/repos/o/r/releases/1/assets{?name,label}
+	uploadURL, _, _ := strings.Cut(release.UploadURL, "{")
+	uploadURL = fmt.Sprintf("%s?name=%s", uploadURL, url.QueryEscape(filepath.Base(file)))
+	_, err = g.do(http.MethodPost, uploadURL, f, "application/octet-stream", fi.Size(), nil)
+	return err
+}
+
+func (g GitHub) deleteAsset(repo string, id int64) error {
+	_, err := g.do(http.MethodDelete, fmt.Sprintf("%s/repos/%s/releases/assets/%d", g.api(), repo, id), nil, "", -1, nil)
+	return err
+}
+
+func (g GitHub) api() string {
+	if g.APIURL == "" {
+		return DefaultGitHubAPI
+	}
+	return strings.TrimSuffix(g.APIURL, "/")
+}
+
+// do runs an API request and decodes the JSON response into out, if given. It returns the
+// response status code.
+func (g GitHub) do(method, uri string, body io.Reader, contentType string, length int64, out any) (int, error) {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return 0, err
+	}
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if g.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.Token)
+	}
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, uri, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding response of %s %s: %w", method, uri, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,148 @@
+package publish_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kairos-io/enki/pkg/publish"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeGitHub serves the release endpoints used by the publisher, keeping the state in memory
+type fakeGitHub struct {
+	mu       sync.Mutex
+	url      string
+	release  *publish.Release
+	uploads  map[string]string
+	deleted  []int64
+	requests []string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	Expect(r.Header.Get("Authorization")).To(Equal("Bearer secret"))
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/kairos-io/kairos/releases/tags/v1.0.0":
+		// Like GitHub, drafts are only listed
+		if f.release == nil || f.release.Draft {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(f.release)
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/kairos-io/kairos/releases":
+		releases := []publish.Release{{ID: 7, TagName: "v0.9.0"}}
+		if f.release != nil {
+			releases = append(releases, *f.release)
+		}
+		_ = json.NewEncoder(w).Encode(releases)
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/kairos-io/kairos/releases":
+		var body map[string]any
+		Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+		Expect(body["tag_name"]).To(Equal("v1.0.0"))
+		f.release = &publish.Release{ID: 1, TagName: "v1.0.0", UploadURL: f.url + "/uploads/1/assets{?name,label}", Draft: body["draft"] == true}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(f.release)
+	case r.Method == http.MethodPost && r.URL.Path == "/uploads/1/assets":
+		data, _ := io.ReadAll(r.Body)
+		f.uploads[r.URL.Query().Get("name")] = string(data)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		var id int64
+		_, _ = fmt.Sscanf(r.URL.Path, "/repos/kairos-io/kairos/releases/assets/%d", &id)
+		f.deleted = append(f.deleted, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+var _ = Describe("GitHub", Label("publish"), func() {
+	var fake *fakeGitHub
+	var server *httptest.Server
+	var gh publish.GitHub
+	var dir string
+
+	BeforeEach(func() {
+		fake = &fakeGitHub{uploads: map[string]string{}}
+		server = httptest.NewServer(fake)
+		fake.url = server.URL
+		gh = publish.GitHub{APIURL: server.URL, Token: "secret", Logger: v1.NewNullLogger()}
+
+		dir = GinkgoT().TempDir()
+		for name, data := range map[string]string{
+			"kairos.iso":            "iso",
+			"kairos.iso.sha256":     "sum",
+			"kairos.sbom.spdx.json": "{}",
+			"build.log":             "not published",
+		} {
+			Expect(os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)).To(Succeed())
+		}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("selects the artifacts, checksums and SBOMs of a workdir", func() {
+		files, err := publish.Artifacts(dir)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(files).To(Equal([]string{
+			filepath.Join(dir, "kairos.iso"),
+			filepath.Join(dir, "kairos.iso.sha256"),
+			filepath.Join(dir, "kairos.sbom.spdx.json"),
+		}))
+	})
+	It("creates the release if missing and uploads the artifacts", func() {
+		files, err := publish.Artifacts(dir)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = gh.Publish("kairos-io/kairos", "v1.0.0", files, publish.ReleaseOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fake.requests).To(ContainElement("POST /repos/kairos-io/kairos/releases"))
+		Expect(fake.uploads).To(Equal(map[string]string{
+			"kairos.iso":            "iso",
+			"kairos.iso.sha256":     "sum",
+			"kairos.sbom.spdx.json": "{}",
+		}))
+	})
+	It("replaces the assets of an existing release", func() {
+		fake.release = &publish.Release{ID: 1, TagName: "v1.0.0", UploadURL: server.URL + "/uploads/1/assets{?name,label}",
+			Assets: []publish.Asset{{ID: 42, Name: "kairos.iso"}}}
+		_, err := gh.Publish("kairos-io/kairos", "v1.0.0", []string{filepath.Join(dir, "kairos.iso")}, publish.ReleaseOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fake.requests).ToNot(ContainElement("POST /repos/kairos-io/kairos/releases"))
+		Expect(fake.deleted).To(Equal([]int64{42}))
+		Expect(fake.uploads).To(HaveKeyWithValue("kairos.iso", "iso"))
+	})
+	It("adds the assets to an existing draft release", func() {
+		fake.release = &publish.Release{ID: 1, TagName: "v1.0.0", UploadURL: server.URL + "/uploads/1/assets{?name,label}", Draft: true}
+		_, err := gh.Publish("kairos-io/kairos", "v1.0.0", []string{filepath.Join(dir, "kairos.iso")}, publish.ReleaseOptions{Draft: true})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fake.requests).To(ContainElement("GET /repos/kairos-io/kairos/releases"))
+		Expect(fake.requests).ToNot(ContainElement("POST /repos/kairos-io/kairos/releases"))
+		Expect(fake.uploads).To(HaveKeyWithValue("kairos.iso", "iso"))
+	})
+	It("publishes again into the draft it created", func() {
+		files := []string{filepath.Join(dir, "kairos.iso")}
+		_, err := gh.Publish("kairos-io/kairos", "v1.0.0", files, publish.ReleaseOptions{Draft: true})
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = gh.Publish("kairos-io/kairos", "v1.0.0", files, publish.ReleaseOptions{Draft: true})
+		Expect(err).ShouldNot(HaveOccurred())
+		created := 0
+		for _, r := range fake.requests {
+			if r == "POST /repos/kairos-io/kairos/releases" {
+				created++
+			}
+		}
+		Expect(created).To(Equal(1))
+	})
+})
@@ -0,0 +1,224 @@
+// Package registry configures how enki authenticates to the container registries, for the images
+// it pulls, resolves and pushes, and how it retries the requests the registries rate limit. The
+// credentials end up in a private docker config, so the container engines and the signing tools
+// enki runs use the same ones.
+package registry
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/kairos-io/enki/pkg/secret"
+)
+
+// DefaultRegistry is the registry logged in to when none is given, as docker login does
+const DefaultRegistry = name.DefaultRegistry
+
+// insecure are the registries reached over plain HTTP, see UseInsecure
+var insecure []string
+
+// UseInsecure sets the registries reached over plain HTTP when they don't answer over HTTPS,
+// with an optional port like registry.local:5000
+func UseInsecure(registries []string) {
+	insecure = registries
+}
+
+// ParseReference parses the image reference, allowing plain HTTP for the insecure registries
+func ParseReference(ref string) (name.Reference, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil || !slices.Contains(insecure, r.Context().RegistryStr()) {
+		return r, err
+	}
+	return name.ParseReference(ref, name.Insecure)
+}
+
+// helpers are the docker credential helpers of the cloud registries, by their short name
+var helpers = map[string]string{
+	"ecr": "ecr-login",
+	"gcr": "gcr",
+	"acr": "acr-env",
+}
+
+// Helpers returns the short names of the credential helpers of the cloud registries
+func Helpers() []string {
+	return []string{"ecr", "gcr", "acr"}
+}
+
+// HelperBinary returns the binary of the docker credential helper, given by its short name or as
+// the suffix of its docker-credential- binary
+func HelperBinary(helper string) string {
+	if h, ok := helpers[helper]; ok {
+		helper = h
+	}
+	return "docker-credential-" + helper
+}
+
+// Login are the credentials of a registry, like docker login takes them
+type Login struct {
+	// Registry is the host of the registry, DefaultRegistry if empty
+	Registry string
+	Username string
+	// Password and Token are either the plain value or a secret reference
+	Password string
+	// Token is a bearer token sent as is, in place of a username and password
+	Token string
+}
+
+// Empty tells if no credentials are given
+func (l Login) Empty() bool {
+	return l.Username == "" && l.Password == "" && l.Token == ""
+}
+
+// Check fails on incomplete credentials
+func (l Login) Check() error {
+	switch {
+	case l.Empty():
+		return nil
+	case l.Token != "" && (l.Username != "" || l.Password != ""):
+		return errors.New("give either a registry token or a registry username and password, not both")
+	case l.Token == "" && (l.Username == "" || l.Password == ""):
+		return errors.New("the registry username and password must be given together")
+	}
+	if err := secret.Check(l.Password); err != nil {
+		return err
+	}
+	return secret.Check(l.Token)
+}
+
+// host returns the key of the registry the credentials are for in the docker config, which
+// keeps the ones of Docker Hub under its legacy address
+func (l Login) host() string {
+	host := l.Registry
+	if host == "" {
+		host = DefaultRegistry
+	}
+	if r, err := name.NewRegistry(host); err == nil && r.RegistryStr() == name.DefaultRegistry {
+		return authn.DefaultAuthKey
+	}
+	return host
+}
+
+// auth returns the docker config auth of the credentials
+func (l Login) auth() (map[string]any, error) {
+	if l.Token != "" {
+		token, err := value(l.Token)
+		if err != nil {
+			return nil, fmt.Errorf("the registry token: %w", err)
+		}
+		return map[string]any{"registrytoken": token}, nil
+	}
+	password, err := value(l.Password)
+	if err != nil {
+		return nil, fmt.Errorf("the registry password: %w", err)
+	}
+	return map[string]any{"auth": base64.StdEncoding.EncodeToString([]byte(l.Username + ":" + password))}, nil
+}
+
+// value returns the secret v refers to, or v itself if it is a plain value
+func value(v string) (string, error) {
+	if !secret.IsRef(v) {
+		return v, nil
+	}
+	data, err := secret.Resolve(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Auth tells how to authenticate to the registries
+type Auth struct {
+	// Credentials are the registry credentials of secret.CheckRegistryCredentials
+	Credentials []string
+	// Login are the credentials of a single registry
+	Login Login
+	// Helpers are the credential helpers as HOST=HELPER, with HELPER one of Helpers or the suffix
+	// of any docker-credential- binary
+	Helpers []string
+	// Anonymous ignores the docker login credentials of the host, to pull public images without them
+	Anonymous bool
+}
+
+// Empty tells if the auth leaves the docker login credentials of the host as they are
+func (a Auth) Empty() bool {
+	return len(a.Credentials) == 0 && a.Login.Empty() && len(a.Helpers) == 0 && !a.Anonymous
+}
+
+// Check fails on malformed or conflicting options
+func (a Auth) Check() error {
+	if a.Anonymous && (len(a.Credentials) > 0 || !a.Login.Empty() || len(a.Helpers) > 0) {
+		return errors.New("anonymous pulls can't be combined with registry credentials")
+	}
+	if err := secret.CheckRegistryCredentials(a.Credentials); err != nil {
+		return err
+	}
+	if err := a.Login.Check(); err != nil {
+		return err
+	}
+	for _, entry := range a.Helpers {
+		host, helper, ok := strings.Cut(entry, "=")
+		if !ok || host == "" || helper == "" {
+			return fmt.Errorf("invalid credential helper %q, give HOST=HELPER with HELPER one of %s or the suffix of a docker-credential- binary", entry, strings.Join(Helpers(), ", "))
+		}
+	}
+	return nil
+}
+
+// MissingHelpers returns the binaries of the credential helpers not found in the PATH
+func (a Auth) MissingHelpers() []string {
+	var missing []string
+	for _, entry := range a.Helpers {
+		_, helper, _ := strings.Cut(entry, "=")
+		binary := HelperBinary(helper)
+		if _, err := exec.LookPath(binary); err != nil && !slices.Contains(missing, binary) {
+			missing = append(missing, binary)
+		}
+	}
+	return missing
+}
+
+// DockerConfig writes the docker config of the auth into a private dir, to set as
+// secret.DockerConfigEnv. It holds the ones of the host config with the given ones on top, or
+// nothing but the given ones for anonymous pulls. The dir must be removed with the returned
+// function once done.
+func (a Auth) DockerConfig() (string, func(), error) {
+	if err := a.Check(); err != nil {
+		return "", nil, err
+	}
+	config := map[string]any{}
+	if !a.Anonymous {
+		host, err := secret.HostDockerConfig()
+		if err != nil {
+			return "", nil, err
+		}
+		config = host
+	}
+	if err := secret.AddRegistryCredentials(config, a.Credentials); err != nil {
+		return "", nil, err
+	}
+	if !a.Login.Empty() {
+		auth, err := a.Login.auth()
+		if err != nil {
+			return "", nil, err
+		}
+		secret.Auths(config)[a.Login.host()] = auth
+	}
+	if len(a.Helpers) > 0 {
+		credHelpers, _ := config["credHelpers"].(map[string]any)
+		if credHelpers == nil {
+			credHelpers = map[string]any{}
+		}
+		for _, entry := range a.Helpers {
+			host, helper, _ := strings.Cut(entry, "=")
+			credHelpers[host] = strings.TrimPrefix(HelperBinary(helper), "docker-credential-")
+		}
+		config["credHelpers"] = credHelpers
+	}
+	return secret.WriteDockerConfig(config)
+}
@@ -0,0 +1,136 @@
+package registry_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/kairos-io/enki/pkg/registry"
+	"github.com/kairos-io/enki/pkg/secret"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// setenv sets an environment variable for the rest of the spec
+func setenv(key, value string) {
+	previous, had := os.LookupEnv(key)
+	Expect(os.Setenv(key, value)).To(Succeed())
+	DeferCleanup(func() {
+		if had {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// readConfig returns the docker config in dir
+func readConfig(dir string) map[string]any {
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	Expect(err).ToNot(HaveOccurred())
+	var config map[string]any
+	Expect(json.Unmarshal(data, &config)).To(Succeed())
+	return config
+}
+
+var _ = Describe("Registry", Label("registry"), func() {
+	BeforeEach(func() {
+		host := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(host, "config.json"), []byte(`{"auths": {"ghcr.io": {"auth": "aG9zdA=="}}}`), 0600)).To(Succeed())
+		setenv(secret.DockerConfigEnv, host)
+	})
+
+	It("rejects incomplete or conflicting credentials", func() {
+		Expect(registry.Auth{Login: registry.Login{Username: "robot"}}.Check()).To(MatchError(ContainSubstring("must be given together")))
+		Expect(registry.Auth{Login: registry.Login{Username: "robot", Password: "pass", Token: "token"}}.Check()).To(MatchError(ContainSubstring("not both")))
+		Expect(registry.Auth{Login: registry.Login{Token: "vault://kv"}}.Check()).To(MatchError(ContainSubstring("vault://PATH#FIELD")))
+		Expect(registry.Auth{Helpers: []string{"ecr"}}.Check()).To(MatchError(ContainSubstring("invalid credential helper")))
+		Expect(registry.Auth{Anonymous: true, Login: registry.Login{Token: "token"}}.Check()).To(MatchError(ContainSubstring("anonymous")))
+		Expect(registry.Auth{Login: registry.Login{Username: "robot", Password: "env://ENKI_TEST_PASSWORD"}}.Check()).To(Succeed())
+	})
+
+	It("logs in to Docker Hub by default, resolving the secret references", func() {
+		setenv("ENKI_TEST_PASSWORD", "s3cret\n")
+		auth := registry.Auth{Login: registry.Login{Username: "robot", Password: "env://ENKI_TEST_PASSWORD"}}
+		dir, cleanup, err := auth.DockerConfig()
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		Expect(readConfig(dir)["auths"]).To(Equal(map[string]any{
+			"ghcr.io":            map[string]any{"auth": "aG9zdA=="},
+			authn.DefaultAuthKey: map[string]any{"auth": base64.StdEncoding.EncodeToString([]byte("robot:s3cret"))},
+		}))
+	})
+
+	It("logs in to the given registry with a token and sets the credential helpers", func() {
+		bin := GinkgoT().TempDir()
+		setenv("PATH", bin)
+		auth := registry.Auth{
+			Login:   registry.Login{Registry: "quay.io", Token: "t0ken"},
+			Helpers: []string{"123456789012.dkr.ecr.eu-west-1.amazonaws.com=ecr", "europe-docker.pkg.dev=gcr", "registry.example.com=enki-test-missing"},
+		}
+		dir, cleanup, err := auth.DockerConfig()
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		config := readConfig(dir)
+		Expect(config["auths"]).To(HaveKeyWithValue("quay.io", map[string]any{"registrytoken": "t0ken"}))
+		Expect(config["credHelpers"]).To(Equal(map[string]any{
+			"123456789012.dkr.ecr.eu-west-1.amazonaws.com": "ecr-login",
+			"europe-docker.pkg.dev":                        "gcr",
+			"registry.example.com":                         "enki-test-missing",
+		}))
+		Expect(os.WriteFile(filepath.Join(bin, "docker-credential-ecr-login"), []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(bin, "docker-credential-gcr"), []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+		Expect(auth.MissingHelpers()).To(Equal([]string{"docker-credential-enki-test-missing"}))
+	})
+
+	It("leaves the credentials of the host out of anonymous pulls", func() {
+		dir, cleanup, err := registry.Auth{Anonymous: true}.DockerConfig()
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		Expect(readConfig(dir)["auths"]).To(BeEmpty())
+	})
+
+	It("retries the rate limited requests", func() {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests < 3 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		}))
+		defer server.Close()
+		client := &http.Client{Transport: registry.Transport(http.DefaultTransport)}
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader("body"))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(requests).To(Equal(3))
+
+		registry.UseRetries(0)
+		DeferCleanup(registry.UseRetries, registry.DefaultRetries)
+		requests = 0
+		resp, err = client.Get(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+	})
+
+	It("tells the rate limit errors apart", func() {
+		Expect(registry.IsRateLimited(&transport.Error{StatusCode: http.StatusTooManyRequests})).To(BeTrue())
+		Expect(registry.IsRateLimited(fmt.Errorf("pulling: %w", &transport.Error{Errors: []transport.Diagnostic{{Code: transport.TooManyRequestsErrorCode}}}))).To(BeTrue())
+		Expect(registry.IsRateLimited(errors.New("GET https://index.docker.io/v2/: TOOMANYREQUESTS: You have reached your pull rate limit"))).To(BeTrue())
+		Expect(registry.IsRateLimited(&transport.Error{StatusCode: http.StatusUnauthorized})).To(BeFalse())
+		Expect(registry.IsRateLimited(nil)).To(BeFalse())
+	})
+})
@@ -0,0 +1,160 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// DefaultRetries is how many times the rate limited requests are retried
+const DefaultRetries = 5
+
+// Bounds of the wait before retrying a rate limited request, doubled on every retry unless the
+// registry tells how long to wait
+const (
+	minWait = 2 * time.Second
+	maxWait = 5 * time.Minute
+)
+
+// retries is how many times the rate limited requests are retried, see UseRetries
+var retries = DefaultRetries
+
+// sleep waits before retrying unless ctx is done first, replaced in tests
+var sleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// UseRetries sets how many times the requests rate limited by the registries are retried
+func UseRetries(n int) {
+	retries = max(n, 0)
+}
+
+// Options returns the options of the registry clients of enki, authenticating with the docker
+// config and retrying the rate limited requests
+func Options() []remote.Option {
+	return []remote.Option{
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithTransport(Transport(remote.DefaultTransport)),
+	}
+}
+
+// Transport returns inner retrying the requests the registries answer with 429 Too Many Requests,
+// after the wait they tell in Retry-After or else an exponential backoff
+func Transport(inner http.RoundTripper) http.RoundTripper {
+	return &retryTransport{inner: inner}
+}
+
+type retryTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.inner.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= retries {
+			return resp, err
+		}
+		// Requests with a body can only be sent again if it can be read again
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return resp, nil
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		_ = resp.Body.Close()
+		if err := sleep(req.Context(), retryAfter(resp.Header.Get("Retry-After"), attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryAfter returns the wait before the retry after the given attempt, the one of the Retry-After
+// header if any, in seconds or as a date
+func retryAfter(header string, attempt int) time.Duration {
+	wait := maxWait
+	if attempt < 8 {
+		wait = minWait << attempt
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
+	}
+	return min(max(wait, 0), maxWait)
+}
+
+// IsRateLimited tells if the error is a registry refusing a request for exceeding its rate limit
+func IsRateLimited(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		if terr.StatusCode == http.StatusTooManyRequests {
+			return true
+		}
+		for _, d := range terr.Errors {
+			if d.Code == transport.TooManyRequestsErrorCode {
+				return true
+			}
+		}
+	}
+	// The image extractors don't always wrap the errors of the registry clients
+	return err != nil && strings.Contains(err.Error(), string(transport.TooManyRequestsErrorCode))
+}
+
+// Extractor is an image extractor retrying the pulls rate limited by the registries with Next,
+// after an exponential backoff
+type Extractor struct {
+	Next   v1.ImageExtractor
+	Logger v1.Logger
+}
+
+var _ v1.ImageExtractor = Extractor{}
+
+func (e Extractor) ExtractImage(imageRef, destination, platformRef string) error {
+	return e.retry(imageRef, func() error {
+		return e.Next.ExtractImage(imageRef, destination, platformRef)
+	})
+}
+
+func (e Extractor) GetOCIImageSize(imageRef, platformRef string) (int64, error) {
+	var size int64
+	err := e.retry(imageRef, func() (err error) {
+		size, err = e.Next.GetOCIImageSize(imageRef, platformRef)
+		return err
+	})
+	return size, err
+}
+
+// retry runs fn until it is not rate limited, up to the configured retries
+func (e Extractor) retry(imageRef string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !IsRateLimited(err) || attempt >= retries {
+			return err
+		}
+		wait := retryAfter("", attempt)
+		if e.Logger != nil {
+			e.Logger.Warnf("Pulling %s is rate limited by its registry, retrying in %s", imageRef, wait)
+		}
+		_ = sleep(context.Background(), wait)
+	}
+}
@@ -0,0 +1,180 @@
+// Package remote delegates the heavy or sensitive steps of the builds to other hosts, like the
+// signing to a secured host holding the keys or the squashfs compression to a bigger builder,
+// over SSH or through a privileged sidecar. The files the tools read and write are passed by
+// path, so the paths of the build must be the same on the remote side, like with a shared volume.
+package remote
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// The steps that can run remotely
+const (
+	// Squashfs is the creation of the squashfs images
+	Squashfs = "squashfs"
+	// ISO is the creation of the ISO filesystem
+	ISO = "iso"
+	// Sign is the signing of the EFI binaries, along with ukify as it signs the UKIs
+	Sign = "sign"
+)
+
+// The schemes of the targets
+const (
+	// SchemeSSH runs the tools over ssh, as ssh://[USER@]HOST[:PORT]
+	SchemeSSH = "ssh"
+	// SchemeExec runs the tools through a command, like exec:docker exec -i signer for a sidecar
+	SchemeExec = "exec"
+)
+
+// stepTools are the tools run by each step
+var stepTools = map[string][]string{
+	Squashfs: {"mksquashfs"},
+	ISO:      {"xorriso"},
+	Sign:     {"sbsign", "sbattach", "/usr/lib/systemd/ukify", "/usr/lib/systemd/systemd-measure", "osslsigncode", "sign-efi-sig-list"},
+}
+
+// Steps returns the steps that can run remotely
+func Steps() []string {
+	return []string{Squashfs, ISO, Sign}
+}
+
+// Schemes returns the schemes of the targets
+func Schemes() []string {
+	return []string{SchemeSSH, SchemeExec}
+}
+
+// Target is where the tools of a step run
+type Target struct {
+	// Prefix is the command the tools run through
+	Prefix []string
+	// ssh is set for the targets over ssh, which run their command through a remote shell
+	ssh bool
+}
+
+// Targets are where the steps run, by step. The steps missing run locally.
+type Targets map[string]Target
+
+// Parse returns the targets of the given specs, as STEP=TARGET like sign=ssh://signer or
+// squashfs=exec:docker exec -i builder
+func Parse(specs []string) (Targets, error) {
+	targets := Targets{}
+	for _, spec := range specs {
+		step, target, ok := strings.Cut(spec, "=")
+		if !ok || !slices.Contains(Steps(), step) {
+			return nil, fmt.Errorf("invalid remote %q, it must be STEP=TARGET with the steps %s", spec, strings.Join(Steps(), ", "))
+		}
+		t, err := parseTarget(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote target of %s: %w", step, err)
+		}
+		targets[step] = t
+	}
+	return targets, nil
+}
+
+func parseTarget(target string) (Target, error) {
+	if command, ok := strings.CutPrefix(target, SchemeExec+":"); ok {
+		prefix := strings.Fields(command)
+		if len(prefix) == 0 {
+			return Target{}, fmt.Errorf("%s has no command", target)
+		}
+		return Target{Prefix: prefix}, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != SchemeSSH || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return Target{}, fmt.Errorf("%q is neither ssh://[USER@]HOST[:PORT] nor exec:COMMAND", target)
+	}
+	prefix := []string{"ssh", "-o", "BatchMode=yes"}
+	if u.Port() != "" {
+		prefix = append(prefix, "-p", u.Port())
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	return Target{Prefix: append(prefix, host, "--"), ssh: true}, nil
+}
+
+// Wrap returns runner running the tools of the remote steps on their targets, runner itself if
+// every step runs locally
+func Wrap(runner v1.Runner, targets Targets) v1.Runner {
+	if len(targets) == 0 {
+		return runner
+	}
+	return &remoteRunner{Runner: runner, targets: targets}
+}
+
+// remoteRunner runs the tools of the remote steps through their targets, and the others as is
+type remoteRunner struct {
+	v1.Runner
+	targets Targets
+}
+
+func (r *remoteRunner) Run(command string, args ...string) ([]byte, error) {
+	command, args = r.command(command, args, "")
+	return r.Runner.Run(command, args...)
+}
+
+func (r *remoteRunner) InitCmd(command string, args ...string) *exec.Cmd {
+	command, args = r.command(command, args, "")
+	return r.Runner.InitCmd(command, args...)
+}
+
+// RunCmd runs the command on the target of its step, from its dir if it has one
+func (r *remoteRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	if cmd == nil || len(cmd.Args) == 0 {
+		return r.Runner.RunCmd(cmd)
+	}
+	command, args := r.command(cmd.Args[0], cmd.Args[1:], cmd.Dir)
+	if command == cmd.Args[0] {
+		return r.Runner.RunCmd(cmd)
+	}
+	remote := r.Runner.InitCmd(command, args...)
+	if remote != nil {
+		remote.Env = cmd.Env
+	}
+	return r.Runner.RunCmd(remote)
+}
+
+// command returns the command running the given one on the target of its step, from dir if set
+func (r *remoteRunner) command(command string, args []string, dir string) (string, []string) {
+	target, ok := r.targets[step(command)]
+	if !ok {
+		return command, args
+	}
+	argv := append([]string{command}, args...)
+	if dir != "" {
+		argv = append([]string{"sh", "-c", `cd "$1" && shift && exec "$@"`, "sh", dir}, argv...)
+	}
+	if target.ssh {
+		// ssh joins the arguments into a single command line for the remote shell
+		argv = []string{quote(argv)}
+	}
+	argv = append(slices.Clone(target.Prefix), argv...)
+	return argv[0], argv[1:]
+}
+
+// step returns the step running the tool, empty if it is not a step that can run remotely
+func step(tool string) string {
+	for s, tools := range stepTools {
+		if slices.Contains(tools, tool) {
+			return s
+		}
+	}
+	return ""
+}
+
+// quote returns the arguments as a shell command line
+func quote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
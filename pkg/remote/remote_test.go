@@ -0,0 +1,57 @@
+package remote_test
+
+import (
+	"os/exec"
+
+	"github.com/kairos-io/enki/pkg/remote"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Remote", Label("remote"), func() {
+	It("runs the tools of the remote steps on their targets", func() {
+		targets, err := remote.Parse([]string{"sign=ssh://builder@signer:2222", "squashfs=exec:docker exec -i builder"})
+		Expect(err).ToNot(HaveOccurred())
+		runner := v1mock.NewFakeRunner()
+		r := remote.Wrap(runner, targets)
+		_, err = r.Run("sbsign", "--key", "/keys/db.key", "--output", "/build/it's.efi", "/build/uki.efi")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = r.Run("mksquashfs", "rootfs", "rootfs.squashfs")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = r.Run("xorriso", "-as", "mkisofs")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{
+			{"ssh", "-o", "BatchMode=yes", "-p", "2222", "builder@signer", "--", `'sbsign' '--key' '/keys/db.key' '--output' '/build/it'\''s.efi' '/build/uki.efi'`},
+			{"docker", "exec", "-i", "builder", "mksquashfs", "rootfs", "rootfs.squashfs"},
+			{"xorriso", "-as", "mkisofs"},
+		})).To(Succeed())
+	})
+
+	It("runs the commands from their dir on the targets", func() {
+		targets, err := remote.Parse([]string{"sign=exec:signer"})
+		Expect(err).ToNot(HaveOccurred())
+		runner := v1mock.NewFakeRunner()
+		cmd := exec.Command("/usr/lib/systemd/ukify", "build")
+		cmd.Dir = "/build/rootfs"
+		_, err = remote.Wrap(runner, targets).RunCmd(cmd)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.CmdsMatch([][]string{
+			{"signer", "sh", "-c", `cd "$1" && shift && exec "$@"`, "sh", "/build/rootfs", "/usr/lib/systemd/ukify", "build"},
+		})).To(Succeed())
+	})
+
+	It("leaves the runner as is without remote steps", func() {
+		targets, err := remote.Parse(nil)
+		Expect(err).ToNot(HaveOccurred())
+		runner := v1mock.NewFakeRunner()
+		Expect(remote.Wrap(runner, targets)).To(BeIdenticalTo(runner))
+	})
+
+	It("fails on invalid remotes", func() {
+		for _, spec := range []string{"sign", "compress=ssh://host", "sign=ftp://host", "sign=ssh://host/path", "iso=exec:", "iso=ssh://"} {
+			_, err := remote.Parse([]string{spec})
+			Expect(err).To(HaveOccurred(), spec)
+		}
+	})
+})
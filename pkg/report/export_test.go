@@ -0,0 +1,4 @@
+package report
+
+// Filesystems exposes filesystems to the tests
+var Filesystems = filesystems
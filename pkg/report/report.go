@@ -0,0 +1,278 @@
+// Package report collects the resource usage of each stage of a build, so users can
+// see whether pulling, extracting or compressing dominates and tune accordingly.
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/transcript"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// sampleInterval is how often the scratch space usage is sampled while a stage runs
+const sampleInterval = 250 * time.Millisecond
+
+// Stage is the resource usage of a single build stage
+type Stage struct {
+	Name string
+	// Wall is the elapsed time of the stage
+	Wall time.Duration
+	// CPU is the user and system time spent by enki and the tools it ran during the stage
+	CPU time.Duration
+	// PeakScratch is the maximum amount of scratch space the stage used on top of what
+	// was already used when it started
+	PeakScratch uint64
+}
+
+// MarshalJSON renders durations as seconds, which is easier to consume than nanoseconds
+func (s Stage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name             string  `json:"name"`
+		WallSeconds      float64 `json:"wall_seconds"`
+		CPUSeconds       float64 `json:"cpu_seconds"`
+		PeakScratchBytes uint64  `json:"peak_scratch_bytes"`
+	}{s.Name, s.Wall.Seconds(), s.CPU.Seconds(), s.PeakScratch})
+}
+
+// Cache is how many of the items a build looked up in a cache were found in it
+type Cache struct {
+	Name   string `json:"name"`
+	Hits   int    `json:"hits"`
+	Misses int    `json:"misses"`
+	// HitBytes and MissBytes are the sizes of the items found in the cache and of the ones
+	// missing from it
+	HitBytes  int64 `json:"hit_bytes"`
+	MissBytes int64 `json:"miss_bytes"`
+}
+
+// Result is the machine readable summary of a build
+type Result struct {
+	Success     bool    `json:"success"`
+	Error       string  `json:"error,omitempty"`
+	WallSeconds float64 `json:"wall_seconds"`
+	Stages      []Stage `json:"stages"`
+	Caches      []Cache `json:"caches,omitempty"`
+	// Commands are the external commands run, when recording a transcript
+	Commands []transcript.Command `json:"commands,omitempty"`
+}
+
+// Report tracks the stages of a build. A nil Report is valid and records nothing.
+type Report struct {
+	scratchDirs []string
+	start       time.Time
+	mu          sync.Mutex
+	stages      []Stage
+	caches      []Cache
+	commands    []transcript.Command
+}
+
+// New returns a Report which measures scratch space usage on the filesystems holding the
+// scratch dirs, like the work areas of the build stages. Empty dirs stand for the temp dir.
+func New(scratchDirs ...string) *Report {
+	return &Report{scratchDirs: filesystems(scratchDirs), start: time.Now()}
+}
+
+// Start begins measuring the named stage, the returned function ends it
+func (r *Report) Start(name string) func() {
+	if r == nil {
+		return func() {}
+	}
+	start := time.Now()
+	cpuStart := cpuTime()
+	base := scratchUsed(r.scratchDirs)
+	peak := base
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var peakMu sync.Mutex
+	sample := func() {
+		used := scratchUsed(r.scratchDirs)
+		peakMu.Lock()
+		if used > peak {
+			peak = used
+		}
+		peakMu.Unlock()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sample()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+			sample()
+			stage := Stage{
+				Name: name,
+				Wall: time.Since(start),
+				CPU:  cpuTime() - cpuStart,
+			}
+			if peak > base {
+				stage.PeakScratch = peak - base
+			}
+			r.mu.Lock()
+			r.stages = append(r.stages, stage)
+			r.mu.Unlock()
+		})
+	}
+}
+
+// Stages returns the stages recorded so far
+func (r *Report) Stages() []Stage {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Stage{}, r.stages...)
+}
+
+// AddCache records how the build used a cache
+func (r *Report) AddCache(c Cache) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.caches = append(r.caches, c)
+}
+
+// Caches returns the caches recorded so far
+func (r *Report) Caches() []Cache {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Cache{}, r.caches...)
+}
+
+// AddCommands records the external commands run by the build
+func (r *Report) AddCommands(commands ...transcript.Command) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, commands...)
+}
+
+// Result returns the summary of the build, buildErr being the error the build ended with
+func (r *Report) Result(buildErr error) Result {
+	res := Result{Success: buildErr == nil, Stages: r.Stages(), Caches: r.Caches()}
+	if buildErr != nil {
+		res.Error = buildErr.Error()
+	}
+	if r != nil {
+		res.WallSeconds = time.Since(r.start).Seconds()
+		r.mu.Lock()
+		res.Commands = append(res.Commands, r.commands...)
+		r.mu.Unlock()
+	}
+	if res.Stages == nil {
+		res.Stages = []Stage{}
+	}
+	return res
+}
+
+// Log prints the stages breakdown as a table
+func (r *Report) Log(logger v1.Logger) {
+	stages := r.Stages()
+	if len(stages) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tWALL\tCPU\tPEAK SCRATCH")
+	for _, s := range stages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Wall.Round(time.Millisecond), s.CPU.Round(time.Millisecond), utils.FormatSize(int64(s.PeakScratch)))
+	}
+	_ = w.Flush()
+	logger.Info("Build stages summary:")
+	for _, line := range bytes.Split(bytes.TrimRight(buf.Bytes(), "\n"), []byte("\n")) {
+		logger.Info(string(line))
+	}
+	for _, c := range r.Caches() {
+		logger.Infof("Cache %s: %d hits (%s), %d misses (%s)", c.Name, c.Hits, utils.FormatSize(c.HitBytes), c.Misses, utils.FormatSize(c.MissBytes))
+	}
+}
+
+// WriteJSON writes the build result as JSON into path
+func (r *Report) WriteJSON(fs v1.FS, path string, buildErr error) error {
+	data, err := json.MarshalIndent(r.Result(buildErr), "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// cpuTime returns the CPU time used by this process and its terminated children
+func cpuTime() time.Duration {
+	var total time.Duration
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(who, &ru); err != nil {
+			continue
+		}
+		total += time.Duration(ru.Utime.Nano()) + time.Duration(ru.Stime.Nano())
+	}
+	return total
+}
+
+// filesystems returns one of the dirs per filesystem holding them, the temp dir standing for the
+// empty ones, so the space used on each filesystem is only counted once
+func filesystems(dirs []string) []string {
+	if len(dirs) == 0 {
+		dirs = []string{""}
+	}
+	var result []string
+	seen := map[uint64]bool{}
+	for _, dir := range dirs {
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil {
+			continue
+		}
+		if seen[st.Dev] {
+			continue
+		}
+		seen[st.Dev] = true
+		result = append(result, dir)
+	}
+	return result
+}
+
+// scratchUsed returns the used bytes of the filesystems holding the dirs
+func scratchUsed(dirs []string) uint64 {
+	var used uint64
+	for _, dir := range dirs {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			continue
+		}
+		used += (st.Blocks - st.Bfree) * uint64(st.Bsize)
+	}
+	return used
+}
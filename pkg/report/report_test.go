@@ -0,0 +1,85 @@
+package report_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/report"
+	"github.com/kairos-io/enki/pkg/transcript"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs"
+)
+
+var _ = Describe("Report", Label("report"), func() {
+	It("records the stages once they are stopped", func() {
+		r := report.New(GinkgoT().TempDir())
+		stop := r.Start("extract")
+		Expect(r.Stages()).To(BeEmpty())
+		time.Sleep(10 * time.Millisecond)
+		stop()
+		// Stopping again doesn't record the stage twice
+		stop()
+		r.Start("sign")()
+
+		stages := r.Stages()
+		Expect(stages).To(HaveLen(2))
+		Expect(stages[0].Name).To(Equal("extract"))
+		Expect(stages[0].Wall).To(BeNumerically(">=", 10*time.Millisecond))
+		Expect(stages[1].Name).To(Equal("sign"))
+	})
+
+	It("records nothing when nil", func() {
+		var r *report.Report
+		r.Start("extract")()
+		r.AddCache(report.Cache{Name: "layers"})
+		Expect(r.Stages()).To(BeNil())
+		res := r.Result(nil)
+		Expect(res.Success).To(BeTrue())
+		Expect(res.Stages).To(BeEmpty())
+		Expect(res.Stages).ToNot(BeNil())
+	})
+
+	It("writes the result as JSON", func() {
+		r := report.New()
+		r.Start("extract")()
+		r.AddCache(report.Cache{Name: "layers", Hits: 2, Misses: 1, HitBytes: 2048, MissBytes: 1024})
+		r.AddCommands(transcript.Command{Argv: []string{"mksquashfs"}})
+		path := filepath.Join(GinkgoT().TempDir(), "result.json")
+		Expect(r.WriteJSON(vfs.OSFS, path, errors.New("no space left"))).To(Succeed())
+
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		var res map[string]any
+		Expect(json.Unmarshal(data, &res)).To(Succeed())
+		Expect(res["success"]).To(BeFalse())
+		Expect(res["error"]).To(Equal("no space left"))
+		Expect(res).To(HaveKey("wall_seconds"))
+		Expect(res["stages"]).To(ConsistOf(And(
+			HaveKeyWithValue("name", "extract"),
+			HaveKey("wall_seconds"),
+			HaveKey("cpu_seconds"),
+			HaveKey("peak_scratch_bytes"),
+		)))
+		Expect(res["caches"]).To(ConsistOf(HaveKeyWithValue("hits", BeNumerically("==", 2))))
+		Expect(res["commands"]).To(HaveLen(1))
+	})
+
+	It("measures each filesystem of the scratch dirs once", func() {
+		dir := GinkgoT().TempDir()
+		Expect(report.Filesystems([]string{dir, filepath.Join(dir, "."), dir})).To(Equal([]string{dir}))
+		Expect(report.Filesystems([]string{""})).To(Equal([]string{os.TempDir()}))
+		Expect(report.Filesystems(nil)).To(Equal([]string{os.TempDir()}))
+		Expect(report.Filesystems([]string{"/proc", "/nonexisting", "/proc/self"})).To(Equal([]string{"/proc"}))
+	})
+
+	It("logs the stages", func() {
+		r := report.New()
+		r.Start("extract")()
+		r.Log(v1.NewNullLogger())
+	})
+})
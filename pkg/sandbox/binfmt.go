@@ -0,0 +1,145 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// binfmtDir is where the kernel exposes the binfmt_misc handlers
+var binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuBinfmt are the binfmt_misc registrations of qemu-user for the arches Kairos is built
+// for, as qemu-binfmt-conf.sh does them
+var qemuBinfmt = map[string]struct{ magic, mask string }{
+	"x86_64": {
+		magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00`,
+		mask:  `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"aarch64": {
+		magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`,
+		mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+}
+
+// binfmtHint tells how to get foreign binaries running on the host
+const binfmtHint = "install qemu-user-static and register it with binfmt_misc, e.g. with your distribution's " +
+	"qemu-user-static or binfmt-support package, or with docker run --privileged --rm tonistiigi/binfmt --install all"
+
+// Emulator runs the binaries of a foreign arch through qemu-user
+type Emulator struct {
+	// Name is the binfmt_misc handler, like qemu-aarch64
+	Name string
+	// Interpreter is the host path of the qemu-user binary
+	Interpreter string
+	// FixBinary is set if the kernel opened the interpreter on registration, so it doesn't
+	// need to be visible inside the sandbox
+	FixBinary bool
+}
+
+// qemuArch returns the qemu name of the given arch, or an empty string for unknown ones
+func qemuArch(arch string) string {
+	switch arch {
+	case "x86_64", "amd64":
+		return "x86_64"
+	case "arm64", "aarch64":
+		return "aarch64"
+	}
+	return ""
+}
+
+// SetupEmulation makes sure the binaries of arch can run on this host. For foreign arches it
+// returns the qemu-user emulator registered with binfmt_misc, registering it first if qemu-user
+// is installed and we are root. It returns nil for the arch of the host.
+func SetupEmulation(logger v1.Logger, arch string) (*Emulator, error) {
+	target := qemuArch(arch)
+	if target == "" {
+		return nil, failure.Errorf(failure.ErrInvalidConfig, "", "unsupported arch %q", arch)
+	}
+	if target == qemuArch(runtime.GOARCH) {
+		return nil, nil
+	}
+
+	name := "qemu-" + target
+	if _, err := os.Stat(filepath.Join(binfmtDir, "register")); err != nil {
+		return nil, failure.Errorf(failure.ErrMissingDependency, "mount it with mount -t binfmt_misc binfmt_misc "+binfmtDir+", then "+binfmtHint,
+			"running %s binaries on this %s host needs binfmt_misc, which is not mounted", arch, runtime.GOARCH)
+	}
+	emulator, err := readBinfmt(name)
+	if os.IsNotExist(err) {
+		logger.Infof("Registering %s with binfmt_misc to run %s binaries", name, arch)
+		if err = registerQemu(target); err != nil {
+			return nil, err
+		}
+		emulator, err = readBinfmt(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !emulator.FixBinary {
+		if _, err = os.Stat(emulator.Interpreter); err != nil {
+			return nil, failure.Errorf(failure.ErrMissingDependency, binfmtHint,
+				"%s is registered with binfmt_misc but its interpreter %s is missing", name, emulator.Interpreter)
+		}
+	}
+	logger.Debugf("Running %s binaries with %s", arch, emulator.Interpreter)
+	return emulator, nil
+}
+
+// readBinfmt reads the binfmt_misc handler name, which must be enabled
+func readBinfmt(name string) (*Emulator, error) {
+	data, err := os.ReadFile(filepath.Join(binfmtDir, name))
+	if err != nil {
+		return nil, err
+	}
+	emulator := &Emulator{Name: name}
+	enabled := false
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch key {
+		case "enabled":
+			enabled = true
+		case "interpreter":
+			emulator.Interpreter = value
+		case "flags:":
+			emulator.FixBinary = strings.Contains(value, "F")
+		}
+	}
+	if !enabled {
+		return nil, failure.Errorf(failure.ErrMissingDependency, "enable it with echo 1 > "+filepath.Join(binfmtDir, name),
+			"the %s binfmt_misc handler is disabled", name)
+	}
+	return emulator, nil
+}
+
+// registerQemu registers the qemu-user binary of the target arch found in the PATH. The F flag
+// makes the kernel open it right away, so it works from within the sandboxed rootfs.
+func registerQemu(target string) error {
+	var interpreter string
+	for _, bin := range []string{"qemu-" + target + "-static", "qemu-" + target} {
+		if path, err := exec.LookPath(bin); err == nil {
+			interpreter = path
+			break
+		}
+	}
+	if interpreter == "" {
+		return failure.Errorf(failure.ErrMissingDependency, binfmtHint,
+			"running %s binaries needs qemu-%s-static, which is neither registered with binfmt_misc nor installed", target, target)
+	}
+	if os.Geteuid() != 0 {
+		return failure.Errorf(failure.ErrPermission, "run enki as root, or "+binfmtHint,
+			"registering %s with binfmt_misc requires root privileges", interpreter)
+	}
+	b := qemuBinfmt[target]
+	rule := fmt.Sprintf(":qemu-%s:M::%s:%s:%s:F", target, b.magic, b.mask, interpreter)
+	if err := os.WriteFile(filepath.Join(binfmtDir, "register"), []byte(rule), 0200); err != nil {
+		return fmt.Errorf("registering %s with binfmt_misc: %w", interpreter, err)
+	}
+	return nil
+}
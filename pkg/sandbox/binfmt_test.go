@@ -0,0 +1,85 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/kairos-io/enki/pkg/failure"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetupEmulation", Label("binfmt"), func() {
+	var foreign, handler string
+	logger := v1.NewNullLogger()
+	BeforeEach(func() {
+		foreign, handler = "arm64", "qemu-aarch64"
+		if qemuArch(runtime.GOARCH) == "aarch64" {
+			foreign, handler = "x86_64", "qemu-x86_64"
+		}
+		orig := binfmtDir
+		binfmtDir = GinkgoT().TempDir()
+		DeferCleanup(func() { binfmtDir = orig })
+	})
+	writeHandler := func(content string) {
+		Expect(os.WriteFile(filepath.Join(binfmtDir, handler), []byte(content), 0644)).To(Succeed())
+	}
+	mountBinfmt := func() {
+		Expect(os.WriteFile(filepath.Join(binfmtDir, "register"), nil, 0200)).To(Succeed())
+	}
+
+	It("needs nothing for the arch of the host", func() {
+		emulator, err := SetupEmulation(logger, runtime.GOARCH)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(emulator).To(BeNil())
+	})
+
+	It("explains binfmt_misc has to be mounted", func() {
+		_, err := SetupEmulation(logger, foreign)
+		Expect(err).To(MatchError(failure.ErrMissingDependency))
+		Expect(err.Error()).To(ContainSubstring("binfmt_misc, which is not mounted"))
+	})
+
+	It("uses the registered handler", func() {
+		mountBinfmt()
+		writeHandler("enabled\ninterpreter /usr/bin/" + handler + "-static\nflags: POCF\noffset 0\n")
+		emulator, err := SetupEmulation(logger, foreign)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(emulator.Interpreter).To(Equal("/usr/bin/" + handler + "-static"))
+		Expect(emulator.FixBinary).To(BeTrue())
+	})
+
+	It("needs the interpreter of handlers without the fix binary flag", func() {
+		mountBinfmt()
+		writeHandler("enabled\ninterpreter /nonexisting/" + handler + "\nflags: \n")
+		_, err := SetupEmulation(logger, foreign)
+		Expect(err).To(MatchError(failure.ErrMissingDependency))
+		Expect(err.Error()).To(ContainSubstring("interpreter /nonexisting/" + handler + " is missing"))
+
+		interpreter := filepath.Join(GinkgoT().TempDir(), handler)
+		Expect(os.WriteFile(interpreter, nil, 0755)).To(Succeed())
+		writeHandler("enabled\ninterpreter " + interpreter + "\nflags: \n")
+		emulator, err := SetupEmulation(logger, foreign)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(emulator.FixBinary).To(BeFalse())
+	})
+
+	It("rejects disabled handlers", func() {
+		mountBinfmt()
+		writeHandler("disabled\ninterpreter /usr/bin/" + handler + "\nflags: F\n")
+		_, err := SetupEmulation(logger, foreign)
+		Expect(err).To(MatchError(ContainSubstring("handler is disabled")))
+	})
+
+	It("tells what to install when qemu-user is missing", func() {
+		mountBinfmt()
+		origPath := os.Getenv("PATH")
+		Expect(os.Setenv("PATH", GinkgoT().TempDir())).To(Succeed())
+		DeferCleanup(os.Setenv, "PATH", origPath)
+		_, err := SetupEmulation(logger, foreign)
+		Expect(err).To(MatchError(failure.ErrMissingDependency))
+		Expect(failure.Hint(err)).To(ContainSubstring("qemu-user-static"))
+	})
+})
@@ -0,0 +1,324 @@
+// Package sandbox runs commands against an extracted rootfs inside an unprivileged
+// user namespace, in the spirit of bubblewrap. The rootfs becomes the new root of a
+// private mount namespace and the only host path visible to the command is a
+// working directory bind mounted at WorkdirMount.
+//
+// The namespace setup is done by re-executing the current binary, so any program
+// using this package must call Init as early as possible in its main function.
+package sandbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// WorkdirMount is the path inside the sandbox where the workdir is bind mounted
+	WorkdirMount = "/run/enki"
+	// initEnv carries the serialized sandbox spec to the re-executed helper process
+	initEnv = "_ENKI_SANDBOX_INIT"
+)
+
+// mountPoints are the dirs of the rootfs the sandbox mounts over, created if missing
+var mountPoints = []string{"/proc", "/dev", "/tmp", WorkdirMount}
+
+// run runs the sandboxed commands of the hooks, replaced in tests which can't create namespaces
+var run = func(cmd *exec.Cmd) error { return cmd.Run() }
+
+// Sandbox describes a confined execution environment over a rootfs
+type Sandbox struct {
+	// Root is the host directory that becomes / inside the sandbox
+	Root string `json:"root"`
+	// Workdir is the only host directory, besides Root, visible inside the sandbox
+	Workdir string `json:"workdir"`
+	// Env is the environment of the sandboxed command
+	Env []string `json:"env"`
+	// Args is the command to run inside the sandbox
+	Args []string `json:"args"`
+	// Interpreter is the host path of the qemu-user binary running foreign binaries. It is bind
+	// mounted at the same path inside the sandbox, as binfmt_misc looks it up from there.
+	Interpreter string `json:"interpreter,omitempty"`
+}
+
+// Command returns an *exec.Cmd that runs args inside the sandbox. The returned command
+// re-executes the current binary which sets up the namespaces and mounts before
+// executing args.
+func (s Sandbox) Command(args ...string) (*exec.Cmd, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command given to run in the sandbox")
+	}
+	s.Args = args
+	if s.Env == nil {
+		s.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root", "TERM=xterm"}
+	}
+	spec, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = []string{fmt.Sprintf("%s=%s", initEnv, spec)}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings:                idMappings(os.Geteuid()),
+		GidMappings:                idMappings(os.Getegid()),
+		GidMappingsEnableSetgroups: os.Geteuid() == 0,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+	return cmd, nil
+}
+
+// idMappings maps the sandbox root to the calling user. When we are already root on the host
+// we map the full id range, otherwise files owned by other users in the rootfs could not be
+// modified from within the sandbox.
+func idMappings(id int) []syscall.SysProcIDMap {
+	if id == 0 {
+		return []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}}
+	}
+	return []syscall.SysProcIDMap{{ContainerID: 0, HostID: id, Size: 1}}
+}
+
+// Init sets up the sandbox when the current process is the re-executed helper and
+// then replaces itself with the sandboxed command. It returns immediately otherwise.
+func Init() {
+	spec := os.Getenv(initEnv)
+	if spec == "" {
+		return
+	}
+	var s Sandbox
+	if err := json.Unmarshal([]byte(spec), &s); err != nil {
+		fail(fmt.Errorf("decoding sandbox spec: %w", err))
+	}
+	if err := s.setup(); err != nil {
+		fail(err)
+	}
+	path, err := lookPath(s.Args[0], s.Env)
+	if err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(path, s.Args, s.Env))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+	os.Exit(127)
+}
+
+// setup runs in the helper process, inside the new namespaces, and pivots into the rootfs
+func (s Sandbox) setup() error {
+	// Make sure none of our mounts propagate back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	// pivot_root requires the new root to be a mount point
+	if err := syscall.Mount(s.Root, s.Root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mounting rootfs: %w", err)
+	}
+
+	if s.Workdir != "" {
+		target := filepath.Join(s.Root, WorkdirMount)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("creating workdir mount point: %w", err)
+		}
+		if err := syscall.Mount(s.Workdir, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mounting workdir: %w", err)
+		}
+	}
+
+	if s.Interpreter != "" {
+		target := filepath.Join(s.Root, s.Interpreter)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE, 0755)
+		if err != nil {
+			return fmt.Errorf("creating interpreter mount point: %w", err)
+		}
+		_ = f.Close()
+		if err := syscall.Mount(s.Interpreter, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind mounting interpreter %s: %w", s.Interpreter, err)
+		}
+	}
+
+	if err := s.mountPseudoFs(); err != nil {
+		return err
+	}
+
+	if err := os.Chdir(s.Root); err != nil {
+		return err
+	}
+	// Stack the old root under the new one and lazily detach it, so nothing from the
+	// host filesystem is reachable anymore
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivoting into rootfs: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching host root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if s.Workdir != "" {
+		return os.Chdir(WorkdirMount)
+	}
+	return nil
+}
+
+// mountPseudoFs provides a minimal /proc, /dev and /tmp inside the rootfs
+func (s Sandbox) mountPseudoFs() error {
+	proc := filepath.Join(s.Root, "proc")
+	dev := filepath.Join(s.Root, "dev")
+	tmp := filepath.Join(s.Root, "tmp")
+	for _, d := range []string{proc, dev, tmp} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting proc: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mounting tmp: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting dev: %w", err)
+	}
+	// Device nodes can't be created in a user namespace, so bind the harmless ones from the host
+	for _, node := range []string{"null", "zero", "full", "random", "urandom", "tty"} {
+		target := filepath.Join(dev, node)
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_ = f.Close()
+		if err := syscall.Mount(filepath.Join("/dev", node), target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind mounting /dev/%s: %w", node, err)
+		}
+	}
+	return nil
+}
+
+// lookPath resolves cmd against the PATH of the sandbox environment. exec.LookPath can't be
+// used as it looks at the PATH of the helper process.
+func lookPath(cmd string, env []string) (string, error) {
+	if filepath.IsAbs(cmd) {
+		return cmd, nil
+	}
+	path := "/usr/sbin:/usr/bin:/sbin:/bin"
+	for _, e := range env {
+		if len(e) > 5 && e[:5] == "PATH=" {
+			path = e[5:]
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		candidate := filepath.Join(dir, cmd)
+		if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in sandbox $PATH", cmd)
+}
+
+// RunHooks runs each of the given host scripts inside a sandbox over rootfs. Each script is
+// copied into a private workdir which is the only host directory the script can see. The
+// binaries of a rootfs of a foreign arch run through qemu-user, see SetupEmulation.
+func RunHooks(logger v1.Logger, rootfs, arch string, hooks []string) error {
+	var interpreter string
+	if arch != "" {
+		emulator, err := SetupEmulation(logger, arch)
+		if err != nil {
+			return err
+		}
+		if emulator != nil && !emulator.FixBinary {
+			interpreter = emulator.Interpreter
+			// Don't leave the mount point of the interpreter behind in the rootfs
+			if _, err := os.Lstat(filepath.Join(rootfs, interpreter)); os.IsNotExist(err) {
+				defer os.Remove(filepath.Join(rootfs, interpreter))
+			}
+		}
+	}
+	// Nor the mount points the sandbox creates, removed once its mounts are gone with it, the
+	// deepest ones first
+	dirs := mountPoints
+	if interpreter != "" {
+		dirs = append(slices.Clone(dirs), filepath.Dir(interpreter))
+	}
+	for _, dir := range missingDirs(rootfs, dirs...) {
+		defer os.Remove(dir)
+	}
+	for _, hook := range hooks {
+		if err := runHook(logger, rootfs, interpreter, hook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingDirs returns the dirs of rootfs missing to create the given ones, the parents first
+func missingDirs(rootfs string, dirs ...string) []string {
+	rootfs = filepath.Clean(rootfs)
+	var missing []string
+	for _, dir := range dirs {
+		var created []string
+		for dir = filepath.Join(rootfs, dir); dir != rootfs && !slices.Contains(missing, dir); dir = filepath.Dir(dir) {
+			if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+				break
+			}
+			created = append([]string{dir}, created...)
+		}
+		missing = append(missing, created...)
+	}
+	return missing
+}
+
+func runHook(logger v1.Logger, rootfs, interpreter, hook string) error {
+	workdir, err := os.MkdirTemp("", "enki-hook-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workdir)
+
+	src, err := os.Open(hook)
+	if err != nil {
+		return fmt.Errorf("opening hook %s: %w", hook, err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(filepath.Join(workdir, filepath.Base(hook)), os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	s := Sandbox{Root: rootfs, Workdir: workdir, Interpreter: interpreter}
+	cmd, err := s.Command("/bin/sh", filepath.Join(WorkdirMount, filepath.Base(hook)))
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	logger.Infof("Running hook %s in a sandbox over %s", hook, rootfs)
+	err = run(cmd)
+	logger.Debugf("Hook %s output: %s", hook, out.String())
+	if err != nil {
+		return fmt.Errorf("running hook %s: %w\n%s", hook, err, out.String())
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// spec returns the sandbox serialized into the environment of the helper command
+func spec(cmd *exec.Cmd) Sandbox {
+	var s Sandbox
+	for _, e := range cmd.Env {
+		if value, ok := strings.CutPrefix(e, initEnv+"="); ok {
+			Expect(json.Unmarshal([]byte(value), &s)).To(Succeed())
+			return s
+		}
+	}
+	Fail("no sandbox spec in the environment of the command")
+	return s
+}
+
+var _ = Describe("Sandbox", Label("sandbox"), func() {
+	Describe("Command", func() {
+		It("re-executes the binary with the serialized spec", func() {
+			cmd, err := Sandbox{Root: "/rootfs", Workdir: "/work", Interpreter: "/usr/bin/qemu-aarch64"}.Command("/bin/sh", "-c", "true")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cmd.Path).To(Equal("/proc/self/exe"))
+			Expect(cmd.Env).To(HaveLen(1))
+			s := spec(cmd)
+			Expect(s.Root).To(Equal("/rootfs"))
+			Expect(s.Workdir).To(Equal("/work"))
+			Expect(s.Interpreter).To(Equal("/usr/bin/qemu-aarch64"))
+			Expect(s.Args).To(Equal([]string{"/bin/sh", "-c", "true"}))
+			Expect(s.Env).To(ContainElement(HavePrefix("PATH=")))
+		})
+
+		It("keeps the given environment", func() {
+			cmd, err := Sandbox{Root: "/rootfs", Env: []string{"PATH=/opt/bin"}}.Command("true")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(spec(cmd).Env).To(Equal([]string{"PATH=/opt/bin"}))
+		})
+
+		It("creates the namespaces and dies along with the caller", func() {
+			cmd, err := Sandbox{Root: "/rootfs"}.Command("true")
+			Expect(err).ToNot(HaveOccurred())
+			flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+			Expect(cmd.SysProcAttr.Cloneflags).To(Equal(flags))
+			Expect(cmd.SysProcAttr.Pdeathsig).To(Equal(syscall.SIGKILL))
+			Expect(cmd.SysProcAttr.UidMappings).To(Equal(idMappings(os.Geteuid())))
+			Expect(cmd.SysProcAttr.GidMappings).To(Equal(idMappings(os.Getegid())))
+		})
+
+		It("needs a command", func() {
+			_, err := Sandbox{Root: "/rootfs"}.Command()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("idMappings", func() {
+		It("maps the whole id range for root", func() {
+			Expect(idMappings(0)).To(Equal([]syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}}))
+		})
+		It("maps the sandbox root to other users", func() {
+			Expect(idMappings(1000)).To(Equal([]syscall.SysProcIDMap{{ContainerID: 0, HostID: 1000, Size: 1}}))
+		})
+	})
+
+	Describe("lookPath", func() {
+		var dir string
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "tool"), nil, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "data"), nil, 0644)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(dir, "sub"), 0755)).To(Succeed())
+		})
+
+		It("keeps absolute paths", func() {
+			Expect(lookPath("/nonexisting/tool", nil)).To(Equal("/nonexisting/tool"))
+		})
+		It("looks in the PATH of the sandbox environment", func() {
+			Expect(lookPath("tool", []string{"HOME=/root", "PATH=/nonexisting:" + dir})).To(Equal(filepath.Join(dir, "tool")))
+		})
+		It("skips non executable files and dirs", func() {
+			for _, name := range []string{"data", "sub"} {
+				_, err := lookPath(name, []string{"PATH=" + dir})
+				Expect(err).To(MatchError(ContainSubstring("not found in sandbox $PATH")))
+			}
+		})
+	})
+
+	Describe("RunHooks", func() {
+		var rootfs, hook string
+		var ran []*exec.Cmd
+		logger := v1.NewNullLogger()
+		BeforeEach(func() {
+			rootfs = GinkgoT().TempDir()
+			hook = filepath.Join(GinkgoT().TempDir(), "hook.sh")
+			Expect(os.WriteFile(hook, []byte("echo hook\n"), 0644)).To(Succeed())
+			ran = nil
+			orig := run
+			run = func(cmd *exec.Cmd) error {
+				ran = append(ran, cmd)
+				s := spec(cmd)
+				// The hook is copied into the workdir, executable, while it runs
+				info, err := os.Stat(filepath.Join(s.Workdir, "hook.sh"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode().Perm() & 0100).ToNot(BeZero())
+				fmt.Fprint(cmd.Stdout, "hook output")
+				return nil
+			}
+			DeferCleanup(func() { run = orig })
+		})
+
+		It("runs each hook from its workdir in the sandbox", func() {
+			Expect(RunHooks(logger, rootfs, runtime.GOARCH, []string{hook, hook})).To(Succeed())
+			Expect(ran).To(HaveLen(2))
+			s := spec(ran[0])
+			Expect(s.Root).To(Equal(rootfs))
+			Expect(s.Interpreter).To(BeEmpty())
+			Expect(s.Args).To(Equal([]string{"/bin/sh", filepath.Join(WorkdirMount, "hook.sh")}))
+			Expect(spec(ran[1]).Workdir).ToNot(Equal(s.Workdir))
+			// The workdirs are removed once the hooks are done
+			Expect(s.Workdir).ToNot(BeADirectory())
+		})
+
+		It("removes the mount points it created in the rootfs", func() {
+			Expect(os.Mkdir(filepath.Join(rootfs, "tmp"), 01777)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(rootfs, "tmp", "keep"), nil, 0644)).To(Succeed())
+			run = func(cmd *exec.Cmd) error {
+				// Like the sandbox setup does
+				for _, dir := range mountPoints {
+					Expect(os.MkdirAll(filepath.Join(rootfs, dir), 0755)).To(Succeed())
+				}
+				return nil
+			}
+			Expect(RunHooks(logger, rootfs, "", []string{hook})).To(Succeed())
+			entries, err := os.ReadDir(rootfs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(filepath.Join(rootfs, "tmp", "keep")).To(BeARegularFile())
+		})
+
+		It("fails with the output of the failed hook", func() {
+			run = func(cmd *exec.Cmd) error {
+				ran = append(ran, cmd)
+				fmt.Fprint(cmd.Stderr, "no space left")
+				return errors.New("exit status 1")
+			}
+			err := RunHooks(logger, rootfs, "", []string{hook, hook})
+			Expect(err).To(MatchError(ContainSubstring("running hook " + hook)))
+			Expect(err).To(MatchError(ContainSubstring("no space left")))
+			// The hooks after the failed one don't run
+			Expect(ran).To(HaveLen(1))
+			Expect(spec(ran[0]).Workdir).ToNot(BeADirectory())
+		})
+
+		It("fails on missing hooks", func() {
+			err := RunHooks(logger, rootfs, "", []string{filepath.Join(rootfs, "missing.sh")})
+			Expect(err).To(MatchError(ContainSubstring("opening hook")))
+			Expect(ran).To(BeEmpty())
+		})
+	})
+})
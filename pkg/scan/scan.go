@@ -0,0 +1,104 @@
+// Package scan runs a malware scanner over the rootfs of a build, for users who must prove the
+// media they ship was scanned at build time. The result is recorded in the build info.
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// ClamAV scans with clamscan, using the signatures installed with freshclam
+	ClamAV = "clamav"
+	// PolicyFail fails the build when the scanner finds anything
+	PolicyFail = "fail"
+	// PolicyWarn only logs what the scanner finds
+	PolicyWarn = "warn"
+
+	// exitFindings is the exit code of clamscan, and of scanner commands, when they find
+	// something. Any other non zero exit code is a failure to scan.
+	exitFindings = 1
+)
+
+// Policies returns what can be done with the findings of a scan
+func Policies() []string {
+	return []string{PolicyFail, PolicyWarn}
+}
+
+// Result of scanning a rootfs
+type Result struct {
+	Scanner string `yaml:"scanner" json:"scanner"`
+	// Version of the scanner, along with the version of its signatures if it tells
+	Version string    `yaml:"version,omitempty" json:"version,omitempty"`
+	Date    time.Time `yaml:"date" json:"date"`
+	// Findings are the lines the scanner printed about infected files, empty if the rootfs is clean
+	Findings []string `yaml:"findings,omitempty" json:"findings,omitempty"`
+}
+
+// Clean tells if the scanner found nothing
+func (r *Result) Clean() bool {
+	return len(r.Findings) == 0
+}
+
+// Scanner is the command scanning a dir
+type Scanner struct {
+	name    string
+	command []string
+	version []string
+}
+
+// New returns the scanner of spec, clamav or a command the dir to scan is appended to. Scanner
+// commands exit with 0 if the dir is clean, and with 1 printing one line per finding otherwise.
+func New(spec string) (*Scanner, error) {
+	if spec == ClamAV {
+		return &Scanner{
+			name:    ClamAV,
+			command: []string{"clamscan", "--recursive", "--infected", "--no-summary", "--cross-fs=no"},
+			version: []string{"clamscan", "--version"},
+		}, nil
+	}
+	command := strings.Fields(spec)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("no scanner command given")
+	}
+	return &Scanner{name: spec, command: command}, nil
+}
+
+// Binary returns the executable the scanner runs
+func (s *Scanner) Binary() string {
+	return s.command[0]
+}
+
+// Run scans dir, failing only if the scanner couldn't scan it
+func (s *Scanner) Run(dir string) (*Result, error) {
+	result := &Result{Scanner: s.name, Date: time.Now().UTC()}
+	if len(s.version) > 0 {
+		if out, err := exec.Command(s.version[0], s.version[1:]...).Output(); err == nil {
+			result.Version = strings.TrimSpace(string(out))
+		}
+	}
+	cmd := exec.Command(s.command[0], append(s.command[1:], dir)...)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == exitFindings {
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				result.Findings = append(result.Findings, strings.TrimPrefix(line, dir))
+			}
+		}
+		if len(result.Findings) == 0 {
+			result.Findings = []string{"the scanner reported findings without details"}
+		}
+		return result, nil
+	}
+	if err != nil {
+		if exitErr != nil {
+			return nil, fmt.Errorf("running %s: %w\n%s", s.name, err, string(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("running %s: %w", s.name, err)
+	}
+	return result, nil
+}
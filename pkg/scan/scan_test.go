@@ -0,0 +1,54 @@
+package scan_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/scan"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scan", Label("scan"), func() {
+	var rootfs, scanner string
+	BeforeEach(func() {
+		rootfs = GinkgoT().TempDir()
+		Expect(os.MkdirAll(filepath.Join(rootfs, "usr", "bin"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(rootfs, "usr", "bin", "tool"), []byte("clean"), 0755)).To(Succeed())
+		// The scanner flags the files holding "infected", like clamscan --infected does
+		scanner = filepath.Join(GinkgoT().TempDir(), "scanner")
+		Expect(os.WriteFile(scanner, []byte("#!/bin/sh\n[ -d \"$2\" ] || exit 2\nfound=$(grep -rl infected \"$2\") || exit 0\necho \"$found: Test-Signature FOUND\"\nexit 1\n"), 0755)).To(Succeed())
+	})
+
+	It("scans the rootfs with a scanner command", func() {
+		s, err := scan.New(scanner + " --quiet")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Binary()).To(Equal(scanner))
+		result, err := s.Run(rootfs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Clean()).To(BeTrue())
+		Expect(result.Scanner).To(Equal(scanner + " --quiet"))
+
+		Expect(os.WriteFile(filepath.Join(rootfs, "usr", "bin", "tool"), []byte("infected"), 0755)).To(Succeed())
+		result, err = s.Run(rootfs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Clean()).To(BeFalse())
+		Expect(result.Findings).To(Equal([]string{"/usr/bin/tool: Test-Signature FOUND"}))
+	})
+
+	It("fails when the scanner can't scan", func() {
+		s, err := scan.New(scanner + " --quiet")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s.Run(filepath.Join(rootfs, "missing"))
+		Expect(err).To(MatchError(ContainSubstring("running " + scanner)))
+
+		_, err = scan.New("  ")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("scans with clamscan", func() {
+		s, err := scan.New(scan.ClamAV)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Binary()).To(Equal("clamscan"))
+	})
+})
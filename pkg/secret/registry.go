@@ -0,0 +1,149 @@
+package secret
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/logging"
+)
+
+// DockerConfigEnv is the variable naming the dir of the docker config, read by the registry
+// clients of enki, the container engines and the signing tools alike
+const DockerConfigEnv = "DOCKER_CONFIG"
+
+// CheckRegistryCredentials fails on malformed registry credentials, given either as a reference
+// to a docker config.json or as HOST=REF, a reference to the USER:PASSWORD of the registry
+func CheckRegistryCredentials(entries []string) error {
+	for _, entry := range entries {
+		if IsRef(entry) {
+			if err := Check(entry); err != nil {
+				return err
+			}
+			continue
+		}
+		host, ref, ok := strings.Cut(entry, "=")
+		if !ok || host == "" || !IsRef(ref) {
+			return fmt.Errorf("invalid registry credentials %q, give a reference to a docker config.json or HOST=REF with REF a reference to USER:PASSWORD, the schemes are %s", entry, strings.Join(Schemes(), ", "))
+		}
+		if err := Check(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DockerConfig writes a docker config with the registry credentials on top of the ones of the
+// host config into a private dir, to set as DockerConfigEnv. The dir must be removed with the
+// returned function once done.
+func DockerConfig(entries []string) (string, func(), error) {
+	config, err := HostDockerConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := AddRegistryCredentials(config, entries); err != nil {
+		return "", nil, err
+	}
+	return WriteDockerConfig(config)
+}
+
+// AddRegistryCredentials sets the registry credentials in the docker config, over the ones it has
+func AddRegistryCredentials(config map[string]any, entries []string) error {
+	if err := CheckRegistryCredentials(entries); err != nil {
+		return err
+	}
+	auths := Auths(config)
+	for _, entry := range entries {
+		if IsRef(entry) {
+			data, err := Resolve(entry)
+			if err != nil {
+				return err
+			}
+			var given map[string]any
+			if err := json.Unmarshal(data, &given); err != nil {
+				return fmt.Errorf("%s is not a docker config.json: %w", entry, err)
+			}
+			givenAuths, _ := given["auths"].(map[string]any)
+			for host, auth := range givenAuths {
+				auths[host] = auth
+			}
+			delete(given, "auths")
+			for key, value := range given {
+				config[key] = value
+			}
+			continue
+		}
+		host, ref, _ := strings.Cut(entry, "=")
+		data, err := Resolve(ref)
+		if err != nil {
+			return err
+		}
+		_, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+		if !ok {
+			return fmt.Errorf("the registry credentials of %s must be USER:PASSWORD", host)
+		}
+		logging.AddSecret(password)
+		auth := base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(string(data))))
+		logging.AddSecret(auth)
+		auths[host] = map[string]any{"auth": auth}
+	}
+	return nil
+}
+
+// Auths returns the auths of the docker config by registry, added to it if it has none
+func Auths(config map[string]any) map[string]any {
+	auths, _ := config["auths"].(map[string]any)
+	if auths == nil {
+		auths = map[string]any{}
+		config["auths"] = auths
+	}
+	return auths
+}
+
+// WriteDockerConfig writes the docker config into a private dir, to set as DockerConfigEnv. The
+// dir must be removed with the returned function once done.
+func WriteDockerConfig(config map[string]any) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "enki-docker")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	data, err := json.Marshal(config)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "config.json"), data, 0600)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// HostDockerConfig returns the docker config of the host, empty if there is none
+func HostDockerConfig() (map[string]any, error) {
+	dir := os.Getenv(DockerConfigEnv)
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return map[string]any{}, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]any{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]any{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing the docker config of the host: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,217 @@
+// Package secret resolves the references to the secrets of the builds, like the private keys or
+// the registry credentials, so they don't have to be given in flags visible to any user with ps.
+// A reference names where the secret is read from at runtime:
+//
+//	env://NAME          the environment variable NAME
+//	file://PATH         the file at PATH
+//	vault://PATH#FIELD  the FIELD of the HashiCorp Vault secret at PATH, like secret/data/enki#db.key
+//
+// Vault is reached at VAULT_ADDR with the VAULT_TOKEN, or the token of ~/.vault-token. The values
+// of the secrets are never logged, and are redacted from the logs of the tools too.
+package secret
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/logging"
+)
+
+// Schemes of the references
+const (
+	SchemeEnv   = "env"
+	SchemeFile  = "file"
+	SchemeVault = "vault"
+)
+
+// Schemes returns the schemes of the references
+func Schemes() []string {
+	return []string{SchemeEnv, SchemeFile, SchemeVault}
+}
+
+// Environment variables configuring the Vault client
+const (
+	VaultAddrEnv      = "VAULT_ADDR"
+	VaultTokenEnv     = "VAULT_TOKEN"
+	VaultNamespaceEnv = "VAULT_NAMESPACE"
+)
+
+// parse splits the reference into its scheme and location, ok is false for plain values
+func parse(value string) (scheme, location string, ok bool) {
+	scheme, location, ok = strings.Cut(value, "://")
+	if !ok || !slices.Contains(Schemes(), scheme) {
+		return "", "", false
+	}
+	return scheme, location, true
+}
+
+// IsRef tells if the value is a reference to a secret, rather than a plain value or path
+func IsRef(value string) bool {
+	_, _, ok := parse(value)
+	return ok
+}
+
+// Check fails on malformed references, plain values are fine
+func Check(value string) error {
+	scheme, location, ok := parse(value)
+	if !ok {
+		return nil
+	}
+	if location == "" {
+		return fmt.Errorf("the secret reference %s names no %s", value, map[string]string{SchemeEnv: "variable", SchemeFile: "file", SchemeVault: "secret"}[scheme])
+	}
+	if scheme == SchemeVault {
+		path, field, _ := strings.Cut(location, "#")
+		if path == "" || field == "" {
+			return fmt.Errorf("the vault secret reference %s must be like vault://PATH#FIELD", value)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the secret the reference points to, redacted from the logs from then on
+func Resolve(ref string) ([]byte, error) {
+	value, err := resolve(ref)
+	if err == nil {
+		logging.AddSecret(string(value))
+	}
+	return value, err
+}
+
+func resolve(ref string) ([]byte, error) {
+	if err := Check(ref); err != nil {
+		return nil, err
+	}
+	scheme, location, ok := parse(ref)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a secret reference, available schemes: %s", ref, strings.Join(Schemes(), ", "))
+	}
+	switch scheme {
+	case SchemeEnv:
+		value, ok := os.LookupEnv(location)
+		if !ok {
+			return nil, fmt.Errorf("the environment variable %s of %s is not set", location, ref)
+		}
+		return []byte(value), nil
+	case SchemeFile:
+		return os.ReadFile(location)
+	}
+	path, field, _ := strings.Cut(location, "#")
+	return vault(path, field)
+}
+
+// Read returns the secret the value refers to, or else the contents of the file at the path
+// given as value
+func Read(value string) ([]byte, error) {
+	if IsRef(value) {
+		return Resolve(value)
+	}
+	return os.ReadFile(value)
+}
+
+// vault returns the field of the secret at path, of either version of the KV secrets engine
+func vault(path, field string) ([]byte, error) {
+	addr := os.Getenv(VaultAddrEnv)
+	if addr == "" {
+		return nil, fmt.Errorf("%s is not set, it must be the address of the Vault server", VaultAddrEnv)
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv(VaultNamespaceEnv); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading the vault secret %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading the vault secret %s: %s", path, resp.Status)
+	}
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("reading the vault secret %s: %w", path, err)
+	}
+	data := secret.Data
+	// The KV version 2 engine nests the fields of the secret along with its metadata
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("the vault secret %s has no %s field", path, field)
+	}
+	return []byte(value), nil
+}
+
+// vaultToken returns the token from the environment, or the one the vault CLI logged in with
+func vaultToken() (string, error) {
+	if token := os.Getenv(VaultTokenEnv); token != "" {
+		return token, nil
+	}
+	home, err := os.UserHomeDir()
+	if err == nil {
+		if data, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+	return "", errors.New("no vault token, set " + VaultTokenEnv + " or log in with vault login")
+}
+
+// Overlay returns a private copy of dir with the files given as name to value replaced by the
+// secrets the values refer to, or by the files at the paths given as values. The other files are
+// linked from dir. The copy must be removed with the returned function once done.
+func Overlay(dir string, files map[string]string) (string, func(), error) {
+	overlay, err := os.MkdirTemp("", "enki-secrets")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(overlay) }
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for _, e := range entries {
+		if _, ok := files[e.Name()]; ok {
+			continue
+		}
+		target, err := filepath.Abs(filepath.Join(dir, e.Name()))
+		if err == nil {
+			err = os.Symlink(target, filepath.Join(overlay, e.Name()))
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	for name, value := range files {
+		data, err := Read(value)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(overlay, name), data, 0600)
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+	return overlay, cleanup, nil
+}
@@ -0,0 +1,142 @@
+package secret_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/secret"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// setenv sets an environment variable for the rest of the spec
+func setenv(key, value string) {
+	previous, had := os.LookupEnv(key)
+	Expect(os.Setenv(key, value)).To(Succeed())
+	DeferCleanup(func() {
+		if had {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+var _ = Describe("Secret", Label("secret"), func() {
+	var dir string
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("tells the references from plain values", func() {
+		Expect(secret.IsRef("env://DB_KEY")).To(BeTrue())
+		Expect(secret.IsRef("vault://secret/data/enki#db.key")).To(BeTrue())
+		Expect(secret.IsRef("/keys/db.key")).To(BeFalse())
+		Expect(secret.IsRef("https://example.com")).To(BeFalse())
+
+		Expect(secret.Check("/keys/db.key")).To(Succeed())
+		Expect(secret.Check("env://")).To(MatchError(ContainSubstring("names no variable")))
+		Expect(secret.Check("vault://secret/data/enki")).To(MatchError(ContainSubstring("vault://PATH#FIELD")))
+	})
+
+	It("resolves the environment and file references", func() {
+		setenv("ENKI_TEST_SECRET", "s3cr3t")
+		Expect(secret.Resolve("env://ENKI_TEST_SECRET")).To(Equal([]byte("s3cr3t")))
+		_, err := secret.Resolve("env://ENKI_TEST_MISSING")
+		Expect(err).To(MatchError(ContainSubstring("is not set")))
+		_, err = secret.Resolve("/keys/db.key")
+		Expect(err).To(MatchError(ContainSubstring("not a secret reference")))
+
+		path := filepath.Join(dir, "token")
+		Expect(os.WriteFile(path, []byte("from-file"), 0600)).To(Succeed())
+		Expect(secret.Resolve("file://" + path)).To(Equal([]byte("from-file")))
+		Expect(secret.Read(path)).To(Equal([]byte("from-file")))
+		Expect(secret.Read("env://ENKI_TEST_SECRET")).To(Equal([]byte("s3cr3t")))
+	})
+
+	It("resolves the vault references of both KV engine versions", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "root" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			switch r.URL.Path {
+			case "/v1/secret/data/enki":
+				_, _ = w.Write([]byte(`{"data": {"data": {"db.key": "kv2"}, "metadata": {"version": 1}}}`))
+			case "/v1/kv/enki":
+				_, _ = w.Write([]byte(`{"data": {"db.key": "kv1"}}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+		setenv(secret.VaultAddrEnv, server.URL)
+		setenv(secret.VaultTokenEnv, "root")
+
+		Expect(secret.Resolve("vault://secret/data/enki#db.key")).To(Equal([]byte("kv2")))
+		Expect(secret.Resolve("vault://kv/enki#db.key")).To(Equal([]byte("kv1")))
+		_, err := secret.Resolve("vault://kv/enki#pcr.key")
+		Expect(err).To(MatchError(ContainSubstring("has no pcr.key field")))
+		_, err = secret.Resolve("vault://kv/missing#db.key")
+		Expect(err).To(MatchError(ContainSubstring("404")))
+
+		setenv(secret.VaultTokenEnv, "wrong")
+		_, err = secret.Resolve("vault://kv/enki#db.key")
+		Expect(err).To(MatchError(ContainSubstring("403")))
+	})
+
+	It("overlays the secrets on a private copy of a dir", func() {
+		keys := filepath.Join(dir, "keys")
+		Expect(os.MkdirAll(keys, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(keys, "db.pem"), []byte("cert"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(keys, "db.key"), []byte("on disk"), 0600)).To(Succeed())
+		setenv("ENKI_TEST_DB_KEY", "from env")
+
+		overlay, cleanup, err := secret.Overlay(keys, map[string]string{"db.key": "env://ENKI_TEST_DB_KEY"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(filepath.Join(overlay, "db.key"))).To(Equal([]byte("from env")))
+		Expect(os.ReadFile(filepath.Join(overlay, "db.pem"))).To(Equal([]byte("cert")))
+		info, err := os.Stat(filepath.Join(overlay, "db.key"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		cleanup()
+		Expect(overlay).ToNot(BeADirectory())
+		Expect(filepath.Join(keys, "db.key")).To(BeAnExistingFile())
+
+		_, _, err = secret.Overlay(keys, map[string]string{"db.key": "env://ENKI_TEST_MISSING"})
+		Expect(err).To(MatchError(ContainSubstring("reading db.key")))
+	})
+
+	It("writes the registry credentials on top of the ones of the host", func() {
+		host := filepath.Join(dir, "docker")
+		Expect(os.MkdirAll(host, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(host, "config.json"), []byte(`{"auths": {"docker.io": {"auth": "aG9zdA=="}}, "credHelpers": {"gcr.io": "gcloud"}}`), 0600)).To(Succeed())
+		setenv(secret.DockerConfigEnv, host)
+		setenv("ENKI_TEST_QUAY", "robot:token")
+		setenv("ENKI_TEST_CONFIG", `{"auths": {"ghcr.io": {"auth": "Z2hjcg=="}}}`)
+
+		Expect(secret.CheckRegistryCredentials([]string{"quay.io=robot:token"})).To(MatchError(ContainSubstring("invalid registry credentials")))
+		Expect(secret.CheckRegistryCredentials([]string{"/root/.docker/config.json"})).ToNot(Succeed())
+
+		configDir, cleanup, err := secret.DockerConfig([]string{"quay.io=env://ENKI_TEST_QUAY", "env://ENKI_TEST_CONFIG"})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		data, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+		Expect(err).ToNot(HaveOccurred())
+		var config map[string]any
+		Expect(json.Unmarshal(data, &config)).To(Succeed())
+		Expect(config["credHelpers"]).To(Equal(map[string]any{"gcr.io": "gcloud"}))
+		Expect(config["auths"]).To(Equal(map[string]any{
+			"docker.io": map[string]any{"auth": "aG9zdA=="},
+			"ghcr.io":   map[string]any{"auth": "Z2hjcg=="},
+			"quay.io":   map[string]any{"auth": base64.StdEncoding.EncodeToString([]byte("robot:token"))},
+		}))
+		info, err := os.Stat(filepath.Join(configDir, "config.json"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+})
@@ -0,0 +1,157 @@
+package secureboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// MeasureTool is the systemd tool calculating the PCR values the UKIs boot with
+const MeasureTool = "/usr/lib/systemd/systemd-measure"
+
+// pcrKernelBoot is the PCR systemd-stub measures the sections of the UKI and the boot phases into
+const pcrKernelBoot = 11
+
+// The TPM2 constants of the PCR policies
+const (
+	// tpmCCPolicyPCR is the command code of TPM2_PolicyPCR
+	tpmCCPolicyPCR = 0x17f
+	// tpmAlgSHA256 is the id of the sha256 bank
+	tpmAlgSHA256 = 0x0b
+	// pcrSelectSize is the size of the PCR bitmaps, for the 24 PCRs of the PC client TPMs
+	pcrSelectSize = 3
+)
+
+// MeasuredSections are the sections of the UKIs systemd-stub measures, in the order it does.
+// .pcrsig is not, so it can be added once the values are known.
+var MeasuredSections = []string{".linux", ".osrel", ".cmdline", ".initrd", ".ucode", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey"}
+
+// Phases are the boot phases ukify signs the PCR policies of by default, from entering the
+// initrd to the system being up
+var Phases = []string{
+	"enter-initrd",
+	"enter-initrd:leave-initrd",
+	"enter-initrd:leave-initrd:sysinit",
+	"enter-initrd:leave-initrd:sysinit:ready",
+}
+
+// PCRPolicy is the TPM2 policy binding the PCR of the UKIs to its value once booted up to Phase
+type PCRPolicy struct {
+	Phase string
+	// Digest is the policy digest, the one the signature is made over
+	Digest []byte
+}
+
+// PCRPolicies returns the policies of the UKI with the given sections, files by section name,
+// after each of the phases, out of the PCR values calculated by systemd-measure
+func PCRPolicies(runner v1.Runner, sections map[string]string, phases []string) ([]PCRPolicy, error) {
+	args := []string{"calculate", "--bank=sha256", "--json=short"}
+	for _, name := range MeasuredSections {
+		if file, ok := sections[name]; ok {
+			args = append(args, fmt.Sprintf("--%s=%s", strings.TrimPrefix(name, "."), file))
+		}
+	}
+	for _, phase := range phases {
+		args = append(args, "--phase="+phase)
+	}
+	out, err := runner.Run(MeasureTool, args...)
+	if err != nil {
+		return nil, fmt.Errorf("calculating the PCR values: %w\n%s", err, strings.TrimSpace(string(out)))
+	}
+	var banks map[string][]struct {
+		Phase string `json:"phase"`
+		PCR   int    `json:"pcr"`
+		Hash  string `json:"hash"`
+	}
+	// The warnings of systemd-measure come along with the values
+	if start := bytes.IndexByte(out, '{'); start >= 0 {
+		err = json.NewDecoder(bytes.NewReader(out[start:])).Decode(&banks)
+	} else {
+		err = fmt.Errorf("no JSON in %q", strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid PCR values of %s: %w", MeasureTool, err)
+	}
+
+	policies := make([]PCRPolicy, 0, len(phases))
+	for _, phase := range phases {
+		var value []byte
+		for _, v := range banks["sha256"] {
+			if v.Phase == phase && v.PCR == pcrKernelBoot {
+				value, err = hex.DecodeString(v.Hash)
+				if err != nil || len(value) != sha256.Size {
+					return nil, fmt.Errorf("invalid sha256 value %q of PCR %d after %s", v.Hash, pcrKernelBoot, phase)
+				}
+			}
+		}
+		if value == nil {
+			return nil, fmt.Errorf("%s calculated no sha256 value of PCR %d after %s", MeasureTool, pcrKernelBoot, phase)
+		}
+		policies = append(policies, PCRPolicy{Phase: phase, Digest: PolicyDigest(value)})
+	}
+	return policies, nil
+}
+
+// PolicyDigest returns the digest of the TPM2_PolicyPCR policy binding the sha256 bank PCR of
+// the UKIs to value, the one systemd-stub has the TPM check the signatures of .pcrsig against
+func PolicyDigest(value []byte) []byte {
+	selection := make([]byte, pcrSelectSize)
+	selection[pcrKernelBoot/8] |= 1 << (pcrKernelBoot % 8)
+	pcrDigest := sha256.Sum256(value)
+
+	h := sha256.New()
+	// Extending the empty policy
+	h.Write(make([]byte, sha256.Size))
+	_ = binary.Write(h, binary.BigEndian, uint32(tpmCCPolicyPCR))
+	// The TPML_PCR_SELECTION of a single bank
+	_ = binary.Write(h, binary.BigEndian, uint32(1))
+	_ = binary.Write(h, binary.BigEndian, uint16(tpmAlgSHA256))
+	h.Write([]byte{pcrSelectSize})
+	h.Write(selection)
+	h.Write(pcrDigest[:])
+	return h.Sum(nil)
+}
+
+// pcrSignature is a signed policy of the .pcrsig section
+type pcrSignature struct {
+	PCRs []int `json:"pcrs"`
+	// Fingerprint is the sha256 of the DER public key the signature verifies with
+	Fingerprint string `json:"pkfp"`
+	Policy      string `json:"pol"`
+	Signature   []byte `json:"sig"`
+}
+
+// PCRSig returns the .pcrsig section of a UKI, as systemd-measure sign writes it, with the
+// signatures of the policies, in their order, made with the key of the PEM public key.
+// The signatures are the PKCS#1 v1.5 ones of the policy digests as sha256 digests.
+func PCRSig(publicKey []byte, policies []PCRPolicy, signatures [][]byte) ([]byte, error) {
+	if len(signatures) != len(policies) {
+		return nil, fmt.Errorf("%d signatures for %d PCR policies", len(signatures), len(policies))
+	}
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM public key")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("parsing the public key: %w", err)
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+	entries := make([]pcrSignature, len(policies))
+	for i, policy := range policies {
+		entries[i] = pcrSignature{
+			PCRs:        []int{pcrKernelBoot},
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			Policy:      hex.EncodeToString(policy.Digest),
+			Signature:   signatures[i],
+		}
+	}
+	return json.Marshal(map[string][]pcrSignature{"sha256": entries})
+}
@@ -0,0 +1,254 @@
+package secureboot
+
+import (
+	"bytes"
+	"crypto"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+)
+
+const (
+	// efiTimeSize is the size of the EFI_TIME starting an authenticated variable
+	efiTimeSize = 16
+	// winCertTypeEFIGUID is the WIN_CERTIFICATE type of the signature of authenticated variables
+	winCertTypeEFIGUID = 0x0EF1
+)
+
+// ReadDBX reads a dbx update, an authenticated variable like the ones published by the UEFI
+// forum or signed with the KEK of enki genkey keys, and returns the signature list it holds
+func ReadDBX(path string) (signature.SignatureDatabase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Authenticated variables are the EFI_TIME and the WIN_CERTIFICATE signing the
+	// signature list which follows them. Firmware only takes dbx updates signed that way.
+	if len(data) <= efiTimeSize+8 || binary.LittleEndian.Uint16(data[efiTimeSize+6:]) != winCertTypeEFIGUID {
+		return nil, fmt.Errorf("%s is not an authenticated variable, sign it with a KEK first, e.g. with sign-efi-sig-list", path)
+	}
+	length := binary.LittleEndian.Uint32(data[efiTimeSize:])
+	if int(length) > len(data)-efiTimeSize {
+		return nil, fmt.Errorf("%s is a truncated authenticated variable", path)
+	}
+	data = data[efiTimeSize+int(length):]
+	dbx, err := signature.ReadSignatureDatabase(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading the dbx update %s: %w", path, err)
+	}
+	if len(dbx) == 0 {
+		return nil, fmt.Errorf("%s holds no signatures", path)
+	}
+	return dbx, nil
+}
+
+// SbatLevel is the minimum generation of each component an SBAT revocation policy, like the
+// SbatLevel shim applies, lets boot
+type SbatLevel map[string]int
+
+// ReadSbatLevel reads an SBAT revocation policy: a CSV with a component and its minimum
+// generation per line, starting with the sbat one
+func ReadSbatLevel(path string) (SbatLevel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	level, err := parseSbat(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading the SBAT revocations %s: %w", path, err)
+	}
+	if _, ok := level["sbat"]; !ok {
+		return nil, fmt.Errorf("%s is not an SBAT revocation policy, it lacks the sbat line", path)
+	}
+	return level, nil
+}
+
+// ReadSbatEntries reads SBAT entries to add to the .sbat section of a binary: a CSV with the
+// component, generation, vendor, package name, version and URL of each component
+func ReadSbatEntries(path string) (SbatLevel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading the SBAT entries %s: %w", path, err)
+	}
+	for _, record := range records {
+		if len(record) != 6 {
+			return nil, fmt.Errorf("SBAT entry %q of %s should have 6 fields: component, generation, vendor, package, version and URL", strings.Join(record, ","), path)
+		}
+	}
+	entries, err := parseSbat(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading the SBAT entries %s: %w", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s holds no SBAT entries", path)
+	}
+	return entries, nil
+}
+
+// PatchSbat returns the .sbat section data with the entries added, each one replacing the
+// entry of the same component if there is one
+func PatchSbat(sbat, entries []byte) []byte {
+	lines := strings.Split(strings.TrimRight(string(bytes.TrimRight(sbat, "\x00")), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+	for _, entry := range strings.Split(strings.TrimSpace(string(entries)), "\n") {
+		component, _, _ := strings.Cut(entry, ",")
+		replaced := false
+		for i, line := range lines {
+			if existing, _, _ := strings.Cut(line, ","); existing == component {
+				lines[i] = entry
+				replaced = true
+			}
+		}
+		if !replaced {
+			lines = append(lines, entry)
+		}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// Merge returns the level requiring the highest generation of each component of both levels
+func (l SbatLevel) Merge(other SbatLevel) SbatLevel {
+	merged := SbatLevel{}
+	for _, level := range []SbatLevel{l, other} {
+		for component, generation := range level {
+			if current, ok := merged[component]; !ok || generation > current {
+				merged[component] = generation
+			}
+		}
+	}
+	return merged
+}
+
+// CheckRevoked returns why the EFI binary at path is revoked by the dbx or the SBAT level,
+// if it is. Either can be nil.
+func CheckRevoked(path string, dbx signature.SignatureDatabase, level SbatLevel) ([]string, error) {
+	var reasons []string
+	if len(dbx) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		binary, err := authenticode.Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		digest := binary.Hash(crypto.SHA256)
+		var certs [][]byte
+		sigs, err := binary.Signatures()
+		if err != nil {
+			return nil, fmt.Errorf("reading the signatures of %s: %w", path, err)
+		}
+		for _, sig := range sigs {
+			auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+			if err != nil {
+				return nil, fmt.Errorf("reading the signatures of %s: %w", path, err)
+			}
+			for _, cert := range auth.Pkcs.Certs {
+				certs = append(certs, cert.Raw)
+			}
+		}
+		for _, list := range dbx {
+			for _, sig := range list.Signatures {
+				switch list.SignatureType {
+				case signature.CERT_SHA256_GUID:
+					if bytes.Equal(sig.Data, digest) {
+						reasons = append(reasons, fmt.Sprintf("its hash %s is in the dbx", hex.EncodeToString(digest)))
+					}
+				case signature.CERT_X509_GUID:
+					for _, cert := range certs {
+						if bytes.Equal(sig.Data, cert) {
+							reasons = append(reasons, "it is signed with a certificate in the dbx")
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if len(level) > 0 {
+		sbat, err := binarySbat(path)
+		if err != nil {
+			return nil, err
+		}
+		components := make([]string, 0, len(sbat))
+		for component := range sbat {
+			components = append(components, component)
+		}
+		sort.Strings(components)
+		for _, component := range components {
+			if minimum, ok := level[component]; ok && sbat[component] < minimum {
+				reasons = append(reasons, fmt.Sprintf("its %s component is generation %d, the SBAT revocations require %d", component, sbat[component], minimum))
+			}
+		}
+	}
+	return reasons, nil
+}
+
+// binarySbat returns the generation of the components in the .sbat section of the EFI binary
+// at path, nothing if it has none
+func binarySbat(path string) (SbatLevel, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	defer f.Close()
+	section := f.Section(".sbat")
+	if section == nil {
+		return nil, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("reading the .sbat section of %s: %w", path, err)
+	}
+	if section.VirtualSize > 0 && int(section.VirtualSize) < len(data) {
+		data = data[:section.VirtualSize]
+	}
+	sbat, err := parseSbat(bytes.TrimRight(data, "\x00"))
+	if err != nil {
+		return nil, fmt.Errorf("reading the .sbat section of %s: %w", path, err)
+	}
+	return sbat, nil
+}
+
+// parseSbat reads the component and generation of each line of SBAT data
+func parseSbat(data []byte) (SbatLevel, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	level := SbatLevel{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %q lacks a generation", strings.Join(record, ","))
+		}
+		generation, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %q has an invalid generation: %w", strings.Join(record, ","), err)
+		}
+		level[strings.TrimSpace(record[0])] = generation
+	}
+	return level, nil
+}
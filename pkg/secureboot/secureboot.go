@@ -0,0 +1,238 @@
+// Package secureboot handles the Secure Boot keys generated by enki genkey when rotating them:
+// signing EFI binaries with several keys, building the db updates trusting both the previous
+// and the new keys, and telling which keys signed a binary. It also checks binaries against
+// the dbx and SBAT revocations shipped along with them.
+package secureboot
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi"
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	efiutil "github.com/foxboron/go-uefi/efi/util"
+)
+
+// RotationFiles are the files of a keys dir needed to rotate from or to its keys
+var RotationFiles = []string{"db.key", "db.pem", "db.esl", "KEK.key", "KEK.pem", "tpm2-pcr-private.pem"}
+
+// KeyPair is a signing key along with its certificate
+type KeyPair struct {
+	Key  crypto.Signer
+	Cert *x509.Certificate
+}
+
+// LoadKeyPair reads the NAME.key and NAME.pem files of the keys dir, like db or KEK
+func LoadKeyPair(keysDir, name string) (*KeyPair, error) {
+	key, err := efiutil.ReadKeyFromFile(filepath.Join(keysDir, name+".key"))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s.key: %w", name, err)
+	}
+	cert, err := efiutil.ReadCertFromFile(filepath.Join(keysDir, name+".pem"))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s.pem: %w", name, err)
+	}
+	return &KeyPair{Key: key, Cert: cert}, nil
+}
+
+// AppendSignature adds a signature made with the key pair to the EFI binary at path, keeping
+// the ones it already has, so firmware trusting either key boots it
+func AppendSignature(path string, kp *KeyPair) error {
+	// The parsed binary keeps reading from data until it's written back
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	binary, err := authenticode.Parse(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if _, err = binary.Sign(kp.Key, kp.Cert); err != nil {
+		return fmt.Errorf("signing %s: %w", path, err)
+	}
+	return os.WriteFile(path, binary.Bytes(), 0644)
+}
+
+// Signature is one of the Authenticode signatures of an EFI binary
+type Signature struct {
+	// Subject is the subject of the certificate embedded in the signature
+	Subject string `json:"subject"`
+	// Key is the name of the known certificate the signature verifies with, empty if none does
+	Key string `json:"key,omitempty"`
+}
+
+// Signatures returns the signatures of the EFI binary at path, each one naming the known
+// certificate it verifies with, if any
+func Signatures(path string, known map[string]*x509.Certificate) ([]Signature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	binary, err := authenticode.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	signatures, err := BinarySignatures(binary, known)
+	if err != nil {
+		return nil, fmt.Errorf("reading the signatures of %s: %w", path, err)
+	}
+	return signatures, nil
+}
+
+// BinarySignatures returns the signatures of the parsed EFI binary, like Signatures
+func BinarySignatures(binary *authenticode.PECOFFBinary, known map[string]*x509.Certificate) ([]Signature, error) {
+	sigs, err := binary.Signatures()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var signatures []Signature
+	for _, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		s := Signature{}
+		if len(auth.Pkcs.Certs) > 0 {
+			s.Subject = auth.Pkcs.Certs[0].Subject.String()
+		}
+		// Verify fails on a digest mismatch too, which leaves the signature without a key
+		for _, name := range names {
+			if ok, _ := auth.Verify(known[name], binary.HashContent.Bytes()); ok {
+				s.Key = name
+				break
+			}
+		}
+		signatures = append(signatures, s)
+	}
+	return signatures, nil
+}
+
+// TransitionDB returns the db trusting the certificates of the db of both keys dirs, signed
+// by the KEK of keysDir, as an authenticated variable along with its signature list. It
+// replaces the db enrolled on new machines while artifacts signed with the previous keys
+// are still around.
+func TransitionDB(previousKeysDir, keysDir string) (auth, esl []byte, err error) {
+	db, err := readDB(keysDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous, err := readDB(previousKeysDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, list := range *previous {
+		if !contains(db, list) {
+			db.AppendList(list)
+		}
+	}
+	kek, err := LoadKeyPair(keysDir, "KEK")
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err = efi.SignEFIVariable(kek.Key, kek.Cert, "db", db.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing the db: %w", err)
+	}
+	return auth, db.Bytes(), nil
+}
+
+// DBAppend returns the authenticated variable adding the certificates of the db of keysDir
+// missing from the one of previousKeysDir to the db of machines enrolled with the previous
+// keys. It is signed with the previous KEK, which those machines trust, and is nil if there
+// is nothing to add.
+func DBAppend(previousKeysDir, keysDir string) ([]byte, error) {
+	db, err := readDB(keysDir)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := readDB(previousKeysDir)
+	if err != nil {
+		return nil, err
+	}
+	missing := signature.NewSignatureDatabase()
+	for _, list := range *db {
+		if !contains(previous, list) {
+			missing.AppendList(list)
+		}
+	}
+	if len(*missing) == 0 {
+		return nil, nil
+	}
+	kek, err := LoadKeyPair(previousKeysDir, "KEK")
+	if err != nil {
+		return nil, err
+	}
+	auth, err := efi.SignEFIVariableWithAttr(kek.Key, kek.Cert, "db", missing.Bytes(), attributes.EFI_VARIABLE_APPEND_WRITE)
+	if err != nil {
+		return nil, fmt.Errorf("signing the db update: %w", err)
+	}
+	return auth, nil
+}
+
+// PublicKeyPEM returns the public key of the PEM private key at path, PKCS#1 or PKCS#8, as
+// PEM
+func PublicKeyPEM(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM private key", path)
+	}
+	var public crypto.PublicKey
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s holds an unsupported private key", path)
+		}
+		public = signer.Public()
+	} else if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		public = key.Public()
+	} else {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// contains tells if every signature of the list is in some list of the db
+func contains(db *signature.SignatureDatabase, list *signature.SignatureList) bool {
+	for _, sig := range list.Signatures {
+		if !db.SigDataExists(list.SignatureType, &sig) {
+			return false
+		}
+	}
+	return true
+}
+
+// readDB reads the signature list of the db of the keys dir
+func readDB(keysDir string) (*signature.SignatureDatabase, error) {
+	data, err := os.ReadFile(filepath.Join(keysDir, "db.esl"))
+	if err != nil {
+		return nil, err
+	}
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading the db of %s: %w", keysDir, err)
+	}
+	return &db, nil
+}
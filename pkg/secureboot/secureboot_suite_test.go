@@ -0,0 +1,13 @@
+package secureboot_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSecureboot(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Secureboot test suite")
+}
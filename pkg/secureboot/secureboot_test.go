@@ -0,0 +1,411 @@
+package secureboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var owner = util.EFIGUID{Data1: 0x12345678}
+
+// writeKeys writes the db and KEK keys and certificates of a keys dir like enki genkey does,
+// along with the db signature list holding the db certificate
+func writeKeys(dir, name string) {
+	for _, keyType := range []string{"db", "KEK"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: name + "-" + keyType},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, keyType+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, keyType+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)).To(Succeed())
+		if keyType == "db" {
+			db := signature.NewSignatureDatabase()
+			Expect(db.Append(signature.CERT_X509_GUID, owner, der)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "db.esl"), db.Bytes(), 0644)).To(Succeed())
+		}
+	}
+}
+
+// writePE writes a minimal PE32+ binary to path, with a .text section and a .sbat one if sbat
+// is set
+func writePE(path, sbat string) {
+	names := []string{".text"}
+	contents := map[string]string{".text": "bootcode"}
+	if sbat != "" {
+		names = append(names, ".sbat")
+		contents[".sbat"] = sbat
+	}
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	opt := pe.OptionalHeader64{Magic: 0x20b, FileAlignment: 0x200, SectionAlignment: 0x1000, NumberOfRvaAndSizes: 16}
+	offset := uint32(buf.Len() + binary.Size(pe.FileHeader{}) + binary.Size(opt) + binary.Size(pe.SectionHeader32{})*len(names))
+	opt.SizeOfHeaders = offset
+	_ = binary.Write(&buf, binary.LittleEndian, pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_AMD64, NumberOfSections: uint16(len(names)), SizeOfOptionalHeader: uint16(binary.Size(opt))})
+	_ = binary.Write(&buf, binary.LittleEndian, opt)
+	for _, name := range names {
+		size := uint32(len(contents[name]))
+		header := pe.SectionHeader32{VirtualSize: size, SizeOfRawData: size, PointerToRawData: offset}
+		copy(header.Name[:], name)
+		_ = binary.Write(&buf, binary.LittleEndian, header)
+		offset += size
+	}
+	for _, name := range names {
+		buf.WriteString(contents[name])
+	}
+	Expect(os.WriteFile(path, buf.Bytes(), 0644)).To(Succeed())
+}
+
+var _ = Describe("Secureboot", Label("secureboot"), func() {
+	var previousKeys, keys, dir string
+	BeforeEach(func() {
+		previousKeys = GinkgoT().TempDir()
+		keys = GinkgoT().TempDir()
+		dir = GinkgoT().TempDir()
+		writeKeys(previousKeys, "previous")
+		writeKeys(keys, "new")
+	})
+
+	It("signs binaries with several keys and tells which ones signed them", func() {
+		binary := filepath.Join(dir, "BOOTX64.EFI")
+		writePE(binary, "")
+		known := map[string]*x509.Certificate{}
+		for _, dir := range []string{previousKeys, keys} {
+			kp, err := secureboot.LoadKeyPair(dir, "db")
+			Expect(err).ToNot(HaveOccurred())
+			known[dir] = kp.Cert
+		}
+		Expect(secureboot.Signatures(binary, known)).To(BeEmpty())
+
+		for _, dir := range []string{keys, previousKeys} {
+			kp, err := secureboot.LoadKeyPair(dir, "db")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secureboot.AppendSignature(binary, kp)).To(Succeed())
+		}
+		Expect(secureboot.Signatures(binary, known)).To(Equal([]secureboot.Signature{
+			{Subject: "CN=new-db", Key: keys},
+			{Subject: "CN=previous-db", Key: previousKeys},
+		}))
+		// Signatures from keys not passed are still listed
+		Expect(secureboot.Signatures(binary, map[string]*x509.Certificate{keys: known[keys]})).To(Equal([]secureboot.Signature{
+			{Subject: "CN=new-db", Key: keys},
+			{Subject: "CN=previous-db"},
+		}))
+	})
+
+	It("builds a db trusting both keys, signed by the new KEK", func() {
+		auth, esl, err := secureboot.TransitionDB(previousKeys, keys)
+		Expect(err).ToNot(HaveOccurred())
+		db, err := signature.ReadSignatureDatabase(bytes.NewReader(esl))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db).To(HaveLen(2))
+		Expect(auth).To(HaveSuffix(string(esl)))
+
+		kek, err := secureboot.LoadKeyPair(keys, "KEK")
+		Expect(err).ToNot(HaveOccurred())
+		variable, err := signature.ReadEFIVariableAuthencation2(bytes.NewBuffer(auth))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(variable.Verify(kek.Cert)).To(BeTrue())
+	})
+
+	It("builds the db update for the machines enrolled with the previous keys", func() {
+		update, err := secureboot.DBAppend(previousKeys, keys)
+		Expect(err).ToNot(HaveOccurred())
+		newDB, err := os.ReadFile(filepath.Join(keys, "db.esl"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(update).To(HaveSuffix(string(newDB)))
+
+		kek, err := secureboot.LoadKeyPair(previousKeys, "KEK")
+		Expect(err).ToNot(HaveOccurred())
+		variable, err := signature.ReadEFIVariableAuthencation2(bytes.NewBuffer(update))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(variable.Verify(kek.Cert)).To(BeTrue())
+
+		Expect(secureboot.DBAppend(keys, keys)).To(BeNil())
+	})
+
+	Describe("Revocations", func() {
+		var binary string
+		var kp *secureboot.KeyPair
+		BeforeEach(func() {
+			binary = filepath.Join(dir, "BOOTX64.EFI")
+			writePE(binary, "sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\nsystemd-boot,1,The systemd Developers,systemd,255,https://systemd.io/\n")
+			var err error
+			kp, err = secureboot.LoadKeyPair(keys, "db")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secureboot.AppendSignature(binary, kp)).To(Succeed())
+		})
+
+		// writeDBX writes a dbx update signed with the KEK holding the given signatures
+		writeDBX := func(certType util.EFIGUID, data []byte) string {
+			list := signature.NewSignatureDatabase()
+			Expect(list.Append(certType, owner, data)).To(Succeed())
+			kek, err := secureboot.LoadKeyPair(keys, "KEK")
+			Expect(err).ToNot(HaveOccurred())
+			auth, err := efi.SignEFIVariable(kek.Key, kek.Cert, "dbx", list.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+			path := filepath.Join(dir, "dbx.auth")
+			Expect(os.WriteFile(path, auth, 0644)).To(Succeed())
+			return path
+		}
+
+		It("tells binaries revoked by the dbx", func() {
+			other := sha256.Sum256([]byte("another binary"))
+			dbx, err := secureboot.ReadDBX(writeDBX(signature.CERT_SHA256_GUID, other[:]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secureboot.CheckRevoked(binary, dbx, nil)).To(BeEmpty())
+
+			f, err := os.Open(binary)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			parsed, err := authenticode.Parse(f)
+			Expect(err).ToNot(HaveOccurred())
+			dbx, err = secureboot.ReadDBX(writeDBX(signature.CERT_SHA256_GUID, parsed.Hash(crypto.SHA256)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secureboot.CheckRevoked(binary, dbx, nil)).To(ConsistOf(ContainSubstring("is in the dbx")))
+
+			dbx, err = secureboot.ReadDBX(writeDBX(signature.CERT_X509_GUID, kp.Cert.Raw))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secureboot.CheckRevoked(binary, dbx, nil)).To(ConsistOf("it is signed with a certificate in the dbx"))
+		})
+
+		It("tells binaries revoked by the SBAT level", func() {
+			path := filepath.Join(dir, "sbat-level.csv")
+			Expect(os.WriteFile(path, []byte("sbat,1,2024010900\nshim,4\ngrub,3\nsystemd-boot,1\n"), 0644)).To(Succeed())
+			level, err := secureboot.ReadSbatLevel(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secureboot.CheckRevoked(binary, nil, level)).To(BeEmpty())
+
+			Expect(os.WriteFile(path, []byte("sbat,1,2024010900\nsystemd-boot,2\n"), 0644)).To(Succeed())
+			level, err = secureboot.ReadSbatLevel(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secureboot.CheckRevoked(binary, nil, level)).To(ConsistOf("its systemd-boot component is generation 1, the SBAT revocations require 2"))
+		})
+
+		It("refuses revocations firmware and shim can't apply", func() {
+			path := filepath.Join(dir, "dbx.esl")
+			Expect(os.WriteFile(path, []byte("not signed"), 0644)).To(Succeed())
+			_, err := secureboot.ReadDBX(path)
+			Expect(err).To(MatchError(ContainSubstring("not an authenticated variable")))
+
+			path = filepath.Join(dir, "sbat-level.csv")
+			Expect(os.WriteFile(path, []byte("shim,4\n"), 0644)).To(Succeed())
+			_, err = secureboot.ReadSbatLevel(path)
+			Expect(err).To(MatchError(ContainSubstring("lacks the sbat line")))
+		})
+
+		It("merges SBAT policies keeping the highest generation", func() {
+			level := secureboot.SbatLevel{"sbat": 1, "shim": 4, "systemd-boot": 1}
+			Expect(level.Merge(secureboot.SbatLevel{"shim": 2, "systemd-boot": 2, "grub": 3})).To(Equal(secureboot.SbatLevel{
+				"sbat": 1, "shim": 4, "systemd-boot": 2, "grub": 3,
+			}))
+		})
+	})
+
+	Describe("SBAT entries", func() {
+		It("reads entries with every field", func() {
+			path := filepath.Join(dir, "sbat.csv")
+			Expect(os.WriteFile(path, []byte("kairos,2,Kairos,kairos,v3.0.0,https://kairos.io\n"), 0644)).To(Succeed())
+			Expect(secureboot.ReadSbatEntries(path)).To(Equal(secureboot.SbatLevel{"kairos": 2}))
+
+			Expect(os.WriteFile(path, []byte("kairos,2\n"), 0644)).To(Succeed())
+			_, err := secureboot.ReadSbatEntries(path)
+			Expect(err).To(MatchError(ContainSubstring("should have 6 fields")))
+
+			Expect(os.WriteFile(path, nil, 0644)).To(Succeed())
+			_, err = secureboot.ReadSbatEntries(path)
+			Expect(err).To(MatchError(ContainSubstring("holds no SBAT entries")))
+		})
+
+		It("patches entries replacing the ones of the same component", func() {
+			sbat := []byte("sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\nkairos,1,Kairos,kairos,v2.0.0,https://kairos.io\n\x00\x00")
+			Expect(string(secureboot.PatchSbat(sbat, []byte("kairos,2,Kairos,kairos,v3.0.0,https://kairos.io\nextra,1,Extra,extra,1,https://example.com\n")))).To(Equal(
+				"sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\nkairos,2,Kairos,kairos,v3.0.0,https://kairos.io\nextra,1,Extra,extra,1,https://example.com\n",
+			))
+			Expect(string(secureboot.PatchSbat(nil, []byte("kairos,2,Kairos,kairos,v3.0.0,https://kairos.io")))).To(Equal("kairos,2,Kairos,kairos,v3.0.0,https://kairos.io\n"))
+		})
+	})
+
+	Describe("Timestamps", func() {
+		It("timestamps binaries in place with the time-stamping authority", func() {
+			binary := filepath.Join(dir, "BOOTX64.EFI")
+			Expect(os.WriteFile(binary, []byte("signed"), 0644)).To(Succeed())
+			runner := v1mock.NewFakeRunner()
+			runner.SetLogger(v1.NewNullLogger())
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				return nil, os.WriteFile(args[len(args)-1], []byte("timestamped"), 0644)
+			}
+			Expect(secureboot.Timestamp(runner, "http://timestamp.example.com", binary)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"osslsigncode", "add", "-ts", "http://timestamp.example.com", "-in", binary, "-out", binary + ".timestamped"}})).To(Succeed())
+			Expect(os.ReadFile(binary)).To(Equal([]byte("timestamped")))
+			Expect(binary + ".timestamped").ToNot(BeAnExistingFile())
+		})
+
+		It("refuses URLs other than http and https ones", func() {
+			Expect(secureboot.CheckTSA("https://timestamp.example.com/tsa")).To(Succeed())
+			Expect(secureboot.CheckTSA("ftp://timestamp.example.com")).ToNot(Succeed())
+			Expect(secureboot.CheckTSA("timestamp.example.com")).ToNot(Succeed())
+		})
+	})
+
+	Describe("Sign requests", func() {
+		var root, requestsDir string
+		var runner *v1mock.FakeRunner
+		BeforeEach(func() {
+			root = filepath.Join(dir, "tree")
+			requestsDir = filepath.Join(dir, "requests")
+			Expect(os.MkdirAll(filepath.Join(root, "EFI", "BOOT"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "EFI", "BOOT", "BOOTX64.EFI"), []byte("unsigned"), 0644)).To(Succeed())
+			runner = v1mock.NewFakeRunner()
+			runner.SetLogger(v1.NewNullLogger())
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				return nil, os.WriteFile(args[len(args)-1], []byte(args[0]), 0644)
+			}
+		})
+
+		It("requests the signatures of the binaries and attaches them", func() {
+			requests, err := secureboot.NewSignRequests(requestsDir, "docker:quay.io/kairos/fedora:40")
+			Expect(err).ToNot(HaveOccurred())
+			binary := filepath.Join(root, "EFI", "BOOT", "BOOTX64.EFI")
+			Expect(requests.Add(runner, root, binary)).To(Succeed())
+			Expect(requests.Write()).To(Succeed())
+			request := filepath.Join(requestsDir, "requests", "EFI_BOOT_BOOTX64.EFI.req")
+			Expect(runner.IncludesCmds([][]string{{"osslsigncode", "extract-data", "-h", "sha256", "-in", binary, "-out", request}})).To(Succeed())
+			_, err = secureboot.NewSignRequests(requestsDir, "docker:quay.io/kairos/fedora:40")
+			Expect(err).To(MatchError(ContainSubstring("already has sign requests")))
+
+			read, err := secureboot.ReadSignRequests(requestsDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(read.Source).To(Equal("docker:quay.io/kairos/fedora:40"))
+			Expect(read.Requests).To(HaveLen(1))
+			Expect(read.Requests[0].File).To(Equal("EFI/BOOT/BOOTX64.EFI"))
+			Expect(read.Requests[0].SignCommand("db.key", "db.pem")).To(Equal([]string{
+				"osslsigncode", "sign", "-certs", "db.pem", "-key", "db.key", "-h", "sha256", "-in", "requests/EFI_BOOT_BOOTX64.EFI.req", "-out", "requests/EFI_BOOT_BOOTX64.EFI.sig",
+			}))
+			Expect(read.Attach(runner, root)).To(MatchError(ContainSubstring("the signature of EFI/BOOT/BOOTX64.EFI is missing")))
+
+			Expect(os.WriteFile(filepath.Join(requestsDir, "requests", "EFI_BOOT_BOOTX64.EFI.sig"), []byte("signature"), 0644)).To(Succeed())
+			Expect(read.Attach(runner, root)).To(Succeed())
+			Expect(os.ReadFile(binary)).To(Equal([]byte("attach-signature")))
+			Expect(binary + ".signed").ToNot(BeAnExistingFile())
+		})
+
+		It("writes the signatures made by a signer", func() {
+			requests, err := secureboot.NewSignRequests(requestsDir, "dir:rootfs")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requests.Add(runner, root, filepath.Join(root, "EFI", "BOOT", "BOOTX64.EFI"))).To(Succeed())
+			Expect(requests.SignWith(func(data [][]byte) ([][]byte, error) {
+				Expect(data).To(Equal([][]byte{[]byte("extract-data")}))
+				return [][]byte{[]byte("signature")}, nil
+			})).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(requestsDir, "requests", "EFI_BOOT_BOOTX64.EFI.sig"))).To(Equal([]byte("signature")))
+			Expect(requests.SignWith(func([][]byte) ([][]byte, error) { return nil, nil })).To(MatchError(ContainSubstring("got 0 signatures for 1 sign requests")))
+		})
+
+		It("refuses altered requests", func() {
+			requests, err := secureboot.NewSignRequests(requestsDir, "dir:rootfs")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requests.Add(runner, root, filepath.Join(root, "EFI", "BOOT", "BOOTX64.EFI"))).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(requestsDir, "requests", "EFI_BOOT_BOOTX64.EFI.req"), []byte("altered"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(requestsDir, "requests", "EFI_BOOT_BOOTX64.EFI.sig"), []byte("signature"), 0644)).To(Succeed())
+			Expect(requests.Attach(runner, root)).To(MatchError(ContainSubstring("was altered")))
+		})
+	})
+
+	Describe("PCR policies", func() {
+		value := bytes.Repeat([]byte{0x11}, sha256.Size)
+
+		It("binds PCR 11 of the sha256 bank to its value", func() {
+			Expect(hex.EncodeToString(secureboot.PolicyDigest(value))).To(Equal("76375bd117789ab232eb4657886f1f50e7735879e1327ecf988b703311a07ab9"))
+		})
+
+		It("calculates the policies of the measured sections after each phase", func() {
+			runner := v1mock.NewFakeRunner()
+			runner.SetLogger(v1.NewNullLogger())
+			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+				return []byte("Warning: no .ucode section\n" +
+					`{"sha256":[{"phase":"enter-initrd","pcr":11,"hash":"` + hex.EncodeToString(value) + `"},` +
+					`{"phase":"enter-initrd:leave-initrd","pcr":11,"hash":"` + strings.Repeat("22", sha256.Size) + `"}]}`), nil
+			}
+			sections := map[string]string{".linux": "/tmp/linux", ".custom": "/tmp/custom", ".pcrpkey": "/tmp/pcrpkey"}
+			policies, err := secureboot.PCRPolicies(runner, sections, secureboot.Phases[:2])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(runner.CmdsMatch([][]string{{
+				secureboot.MeasureTool, "calculate", "--bank=sha256", "--json=short", "--linux=/tmp/linux", "--pcrpkey=/tmp/pcrpkey",
+				"--phase=enter-initrd", "--phase=enter-initrd:leave-initrd",
+			}})).To(Succeed())
+			Expect(policies).To(HaveLen(2))
+			Expect(policies[0]).To(Equal(secureboot.PCRPolicy{Phase: "enter-initrd", Digest: secureboot.PolicyDigest(value)}))
+			Expect(policies[1].Phase).To(Equal("enter-initrd:leave-initrd"))
+
+			_, err = secureboot.PCRPolicies(runner, sections, secureboot.Phases)
+			Expect(err).To(MatchError(ContainSubstring("no sha256 value of PCR 11 after enter-initrd:leave-initrd:sysinit")))
+		})
+
+		It("writes the signatures the key of the public key made", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			der, err := x509.MarshalPKIXPublicKey(key.Public())
+			Expect(err).ToNot(HaveOccurred())
+			policy := secureboot.PCRPolicy{Phase: "enter-initrd", Digest: secureboot.PolicyDigest(value)}
+			signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, policy.Digest)
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := secureboot.PCRSig(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), []secureboot.PCRPolicy{policy}, [][]byte{signature})
+			Expect(err).ToNot(HaveOccurred())
+			var pcrsig map[string][]struct {
+				PCRs []int  `json:"pcrs"`
+				Pkfp string `json:"pkfp"`
+				Pol  string `json:"pol"`
+				Sig  []byte `json:"sig"`
+			}
+			Expect(json.Unmarshal(data, &pcrsig)).To(Succeed())
+			Expect(pcrsig).To(HaveKey("sha256"))
+			Expect(pcrsig["sha256"]).To(HaveLen(1))
+			entry := pcrsig["sha256"][0]
+			fingerprint := sha256.Sum256(der)
+			Expect(entry.PCRs).To(Equal([]int{11}))
+			Expect(entry.Pkfp).To(Equal(hex.EncodeToString(fingerprint[:])))
+			Expect(entry.Pol).To(Equal(hex.EncodeToString(policy.Digest)))
+			Expect(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, policy.Digest, entry.Sig)).To(Succeed())
+
+			_, err = secureboot.PCRSig(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), []secureboot.PCRPolicy{policy}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
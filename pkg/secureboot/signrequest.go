@@ -0,0 +1,183 @@
+package secureboot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// The layout of the dirs of the sign requests
+const (
+	// SignRequestsFile is the manifest listing the requests
+	SignRequestsFile = "sign-requests.json"
+	// SignRequestsTree is the dir keeping the build, with the EFI binaries unsigned, to finish it
+	// once the requests are signed
+	SignRequestsTree = "tree"
+	// signRequestsDir is the dir of the requests and their signatures, the only one to take to the
+	// signing machine
+	signRequestsDir = "requests"
+	// requestExt and signatureExt are the extensions of the requests and their signatures
+	requestExt   = ".req"
+	signatureExt = ".sig"
+)
+
+// DetachedSignTool is the binary creating the sign requests and attaching their signatures
+const DetachedSignTool = "osslsigncode"
+
+// SignRequest is the Authenticode signature requested for an EFI binary
+type SignRequest struct {
+	// File is the path of the EFI binary in the tree
+	File string `json:"file"`
+	// Request is the data to sign, with the Authenticode digest of the binary, relative to the
+	// dir of the requests
+	Request string `json:"request"`
+	// Signature is where the signature of the request is expected, relative to the dir of the
+	// requests
+	Signature string `json:"signature"`
+	// Digest is the SHA256 of the request, to check it was not altered on its way
+	Digest string `json:"sha256"`
+}
+
+// SignRequests are the signatures requested by a build, to sign the EFI binaries on a machine
+// holding the db key, like an offline one, and finish the build with them. The requests are
+// created and the signatures attached with osslsigncode, the requests are signed with
+// osslsigncode sign too.
+type SignRequests struct {
+	// Source is the source image of the build, the signatures are only applied to its builds
+	Source   string        `json:"source"`
+	Requests []SignRequest `json:"requests"`
+	dir      string
+}
+
+// NewSignRequests returns the requests of the build of source, written to dir. dir must not have
+// any requests already.
+func NewSignRequests(dir, source string) (*SignRequests, error) {
+	if _, err := os.Stat(filepath.Join(dir, SignRequestsFile)); err == nil {
+		return nil, fmt.Errorf("%s already has sign requests", dir)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, signRequestsDir), 0755); err != nil {
+		return nil, err
+	}
+	return &SignRequests{Source: source, dir: dir}, nil
+}
+
+// ReadSignRequests returns the requests written to dir
+func ReadSignRequests(dir string) (*SignRequests, error) {
+	data, err := os.ReadFile(filepath.Join(dir, SignRequestsFile))
+	if err != nil {
+		return nil, fmt.Errorf("reading the sign requests: %w", err)
+	}
+	s := &SignRequests{dir: dir}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid sign requests %s: %w", filepath.Join(dir, SignRequestsFile), err)
+	}
+	return s, nil
+}
+
+// Add requests the signature of the EFI binary at file of the tree at root
+func (s *SignRequests) Add(runner v1.Runner, root, file string) error {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return err
+	}
+	name := strings.ReplaceAll(filepath.ToSlash(rel), "/", "_")
+	r := SignRequest{
+		File:      filepath.ToSlash(rel),
+		Request:   filepath.Join(signRequestsDir, name+requestExt),
+		Signature: filepath.Join(signRequestsDir, name+signatureExt),
+	}
+	request := filepath.Join(s.dir, r.Request)
+	out, err := runner.Run(DetachedSignTool, "extract-data", "-h", "sha256", "-in", file, "-out", request)
+	if err != nil {
+		return fmt.Errorf("creating the sign request of %s: %w\n%s", rel, err, strings.TrimSpace(string(out)))
+	}
+	if r.Digest, err = digest(request); err != nil {
+		return err
+	}
+	s.Requests = append(s.Requests, r)
+	return nil
+}
+
+// Write writes the manifest of the requests
+func (s *SignRequests) Write() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, SignRequestsFile), append(data, '\n'), 0644)
+}
+
+// SignCommand returns the command signing the request on the machine holding the db key and
+// certificate
+func (r SignRequest) SignCommand(key, cert string) []string {
+	return []string{DetachedSignTool, "sign", "-certs", cert, "-key", key, "-h", "sha256", "-in", r.Request, "-out", r.Signature}
+}
+
+// SignWith writes the signatures of the requests, returned by sign for their data in their order
+func (s *SignRequests) SignWith(sign func(requests [][]byte) ([][]byte, error)) error {
+	data := make([][]byte, len(s.Requests))
+	for i, r := range s.Requests {
+		var err error
+		if data[i], err = os.ReadFile(filepath.Join(s.dir, r.Request)); err != nil {
+			return err
+		}
+	}
+	signatures, err := sign(data)
+	if err != nil {
+		return err
+	}
+	if len(signatures) != len(s.Requests) {
+		return fmt.Errorf("got %d signatures for %d sign requests", len(signatures), len(s.Requests))
+	}
+	for i, r := range s.Requests {
+		if err = os.WriteFile(filepath.Join(s.dir, r.Signature), signatures[i], 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attach attaches the signatures of the requests to the EFI binaries of the tree at root, in
+// place. It fails if any is missing or if its request was altered.
+func (s *SignRequests) Attach(runner v1.Runner, root string) error {
+	for _, r := range s.Requests {
+		signature := filepath.Join(s.dir, r.Signature)
+		if _, err := os.Stat(signature); err != nil {
+			return fmt.Errorf("the signature of %s is missing, sign %s into %s", r.File, r.Request, r.Signature)
+		}
+		sum, err := digest(filepath.Join(s.dir, r.Request))
+		if err != nil {
+			return err
+		}
+		if sum != r.Digest {
+			return fmt.Errorf("the sign request of %s was altered, its sha256 is %s rather than %s", r.File, sum, r.Digest)
+		}
+		file := filepath.Join(root, filepath.FromSlash(r.File))
+		signed := file + ".signed"
+		out, err := runner.Run(DetachedSignTool, "attach-signature", "-sigin", signature, "-in", file, "-out", signed)
+		if err != nil {
+			_ = os.Remove(signed)
+			return fmt.Errorf("attaching the signature of %s: %w\n%s", r.File, err, strings.TrimSpace(string(out)))
+		}
+		if err = os.Rename(signed, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digest returns the hex SHA256 of the file at path
+func digest(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,40 @@
+package secureboot
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// TimestampTool is the binary adding RFC 3161 timestamps to Authenticode signatures, as
+// sbsign and ukify can't
+const TimestampTool = "osslsigncode"
+
+// CheckTSA fails if tsa is not the http or https URL of a time-stamping authority
+func CheckTSA(tsa string) error {
+	u, err := url.Parse(tsa)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp URL %s: %w", tsa, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid timestamp URL %s, it must be the http or https URL of an RFC 3161 time-stamping authority", tsa)
+	}
+	return nil
+}
+
+// Timestamp adds an RFC 3161 timestamp from the time-stamping authority at tsa to the signature
+// of the signed EFI binary at path, in place. Firmware and verifiers honoring it keep trusting
+// the signature once the signing certificate expires. Only the first signature of binaries
+// signed with several keys is timestamped.
+func Timestamp(runner v1.Runner, tsa, path string) error {
+	stamped := path + ".timestamped"
+	out, err := runner.Run(TimestampTool, "add", "-ts", tsa, "-in", path, "-out", stamped)
+	if err != nil {
+		_ = os.Remove(stamped)
+		return fmt.Errorf("timestamping %s with %s: %w\n%s", path, tsa, err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(stamped, path)
+}
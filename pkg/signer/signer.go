@@ -0,0 +1,173 @@
+// Package signer is the client of the signing services holding the keys away from the builds,
+// like the ones run by central security teams for the CI runners to sign without ever seeing the
+// keys. The builds send what they need signed in batches and get the signatures back, over
+// mutual TLS. They sign both the EFI binaries and the PCR policies of the UKIs.
+//
+// The protocol is a single endpoint, POST /v1/sign, taking the JSON
+//
+//	{"requests": [{"kind": "authenticode", "key": "db", "data": "<base64>"},
+//	              {"kind": "pcr-policy", "key": "tpm2-pcr", "data": "<base64>"}, ...]}
+//
+// and answering the signatures in the order of the requests, each one with either its data or
+// the reason it was refused
+//
+//	{"signatures": [{"data": "<base64>"}, {"error": "..."}, ...]}
+package signer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/secret"
+)
+
+// signPath is the endpoint of the signing services
+const signPath = "/v1/sign"
+
+// timeout is how long a batch may take, signing on HSMs is slow
+const timeout = 5 * time.Minute
+
+// maxResponse is the size of the largest response read, far beyond the signatures of a build
+const maxResponse = 32 << 20
+
+// The kinds of signatures
+const (
+	// KindAuthenticode is the Authenticode signature of a PE binary, the data being the request
+	// created by osslsigncode extract-data, with the digest of the binary, and the signature the
+	// PKCS#7 one osslsigncode attaches
+	KindAuthenticode = "authenticode"
+	// KindPCRPolicy is the signature of a TPM2 PCR policy, the data being the policy digest and
+	// the signature the PKCS#1 v1.5 one of it as a sha256 digest, as systemd-stub expects it in
+	// the .pcrsig section
+	KindPCRPolicy = "pcr-policy"
+)
+
+// The keys the services sign with, named after the files of the keys dir
+const (
+	// KeyDB is the db key, signing the EFI binaries
+	KeyDB = "db"
+	// KeyPCR is the key signing the PCR policies, tpm2-pcr-private.pem in the keys dir
+	KeyPCR = "tpm2-pcr"
+)
+
+// Request is something to sign
+type Request struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+	Data []byte `json:"data"`
+}
+
+type signRequest struct {
+	Requests []Request `json:"requests"`
+}
+
+type signature struct {
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type signResponse struct {
+	Signatures []signature `json:"signatures"`
+}
+
+// Client signs with a signing service
+type Client struct {
+	url    string
+	client *http.Client
+}
+
+// Check fails if uri is not the https URL of a signing service
+func Check(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid signer URL %s: %w", uri, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid signer URL %s, it must be the https URL of a signing service", uri)
+	}
+	return nil
+}
+
+// New returns the client of the signing service at uri, authenticating with the client
+// certificate and key, given as PEM files or secret references. The service is trusted like any
+// other host, along with the CAs given to enki.
+func New(uri, cert, key string) (*Client, error) {
+	if err := Check(uri); err != nil {
+		return nil, err
+	}
+	certPEM, err := secret.Read(cert)
+	if err != nil {
+		return nil, fmt.Errorf("reading the signer client certificate: %w", err)
+	}
+	keyPEM, err := secret.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("reading the signer client key: %w", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer client certificate: %w", err)
+	}
+
+	// Cloned from the default one, with the proxies and CAs of enki
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		base = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	transport := base.Clone()
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if transport.TLSClientConfig != nil {
+		config = transport.TLSClientConfig.Clone()
+	}
+	config.Certificates = []tls.Certificate{pair}
+	transport.TLSClientConfig = config
+	return &Client{url: strings.TrimSuffix(uri, "/"), client: &http.Client{Transport: transport, Timeout: timeout}}, nil
+}
+
+// Sign returns the signatures of the requests, in their order. It fails if the service refuses
+// any of them.
+func (c *Client) Sign(requests []Request) ([][]byte, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	body, err := json.Marshal(signRequest{Requests: requests})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Post(c.url+signPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("reaching the signer: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, fmt.Errorf("reading the signatures: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the signer answered %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var response signResponse
+	if err = json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("invalid answer of the signer: %w", err)
+	}
+	if len(response.Signatures) != len(requests) {
+		return nil, fmt.Errorf("the signer answered %d signatures for %d requests", len(response.Signatures), len(requests))
+	}
+	signatures := make([][]byte, len(requests))
+	for i, s := range response.Signatures {
+		if s.Error != "" {
+			return nil, fmt.Errorf("the signer refused the %s signature %d with the %s key: %s", requests[i].Kind, i+1, requests[i].Key, s.Error)
+		}
+		if len(s.Data) == 0 {
+			return nil, fmt.Errorf("the signer answered an empty %s signature %d", requests[i].Kind, i+1)
+		}
+		signatures[i] = s.Data
+	}
+	return signatures, nil
+}
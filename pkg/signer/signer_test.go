@@ -0,0 +1,115 @@
+package signer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/network"
+	"github.com/kairos-io/enki/pkg/signer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writeClientCert writes a self signed client certificate and its key to dir
+func writeClientCert(dir string) (cert, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ci"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	Expect(err).ToNot(HaveOccurred())
+	cert, key = filepath.Join(dir, "ci.pem"), filepath.Join(dir, "ci.key")
+	Expect(os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)).To(Succeed())
+	Expect(os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	return cert, key
+}
+
+var _ = Describe("Signer", Label("signer"), func() {
+	var server *httptest.Server
+	var cert, key string
+	var restore func()
+	var answer func(requests []signer.Request) any
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		cert, key = writeClientCert(dir)
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/sign" || r.Method != http.MethodPost || len(r.TLS.PeerCertificates) == 0 {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			var body struct {
+				Requests []signer.Request `json:"requests"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(answer(body.Requests))
+		}))
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		server.StartTLS()
+		DeferCleanup(server.Close)
+		ca := filepath.Join(dir, "ca.pem")
+		Expect(os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)).To(Succeed())
+		var err error
+		restore, err = network.Use(network.Config{CACerts: []string{ca}})
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(func() { restore() })
+		answer = func(requests []signer.Request) any {
+			var signatures []map[string]any
+			for _, r := range requests {
+				signatures = append(signatures, map[string]any{"data": append([]byte(r.Kind+":"+r.Key+":"), r.Data...)})
+			}
+			return map[string]any{"signatures": signatures}
+		}
+	})
+
+	It("signs batches over mutual TLS", func() {
+		client, err := signer.New(server.URL+"/", cert, key)
+		Expect(err).ToNot(HaveOccurred())
+		signatures, err := client.Sign([]signer.Request{
+			{Kind: signer.KindAuthenticode, Key: signer.KeyDB, Data: []byte("BOOTX64.EFI")},
+			{Kind: signer.KindPCRPolicy, Key: signer.KeyPCR, Data: []byte("policy")},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signatures).To(Equal([][]byte{[]byte("authenticode:db:BOOTX64.EFI"), []byte("pcr-policy:tpm2-pcr:policy")}))
+	})
+
+	It("fails on refused and missing signatures", func() {
+		client, err := signer.New(server.URL, cert, key)
+		Expect(err).ToNot(HaveOccurred())
+		answer = func([]signer.Request) any {
+			return map[string]any{"signatures": []map[string]any{{"error": "unknown key"}}}
+		}
+		_, err = client.Sign([]signer.Request{{Kind: signer.KindAuthenticode, Key: "kek", Data: []byte("x")}})
+		Expect(err).To(MatchError(ContainSubstring("refused the authenticode signature 1 with the kek key: unknown key")))
+		_, err = client.Sign([]signer.Request{{Kind: signer.KindAuthenticode, Key: signer.KeyDB, Data: []byte("x")}, {Kind: signer.KindAuthenticode, Key: signer.KeyDB, Data: []byte("y")}})
+		Expect(err).To(MatchError(ContainSubstring("1 signatures for 2 requests")))
+	})
+
+	It("refuses signers other than https ones and invalid client certificates", func() {
+		Expect(signer.Check("http://signer.internal")).ToNot(Succeed())
+		Expect(signer.Check("https://signer.internal")).To(Succeed())
+		_, err := signer.New(server.URL, key, cert)
+		Expect(err).To(MatchError(ContainSubstring("invalid signer client certificate")))
+	})
+})
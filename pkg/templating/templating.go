@@ -0,0 +1,124 @@
+// Package templating expands the Go templates in cmdlines, boot entry titles and config values,
+// so a single manifest can build every flavor and version of an image.
+package templating
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// releasePrefix is the prefix of the Kairos values in the release files of an image
+const releasePrefix = "KAIROS_"
+
+// Vars are the values templates are expanded with, each one is available as {{.name}}
+type Vars map[string]string
+
+// funcs are the functions templates can use besides the builtin ones
+var funcs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+}
+
+// ParseSet parses the key=value pairs given with --set
+func ParseSet(values []string) (Vars, error) {
+	vars := Vars{}
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid set value %q, expected key=value", value)
+		}
+		vars[key] = val
+	}
+	return vars, nil
+}
+
+// Merge returns a copy of vars with the values of others on top, in order
+func (v Vars) Merge(others ...Vars) Vars {
+	merged := Vars{}
+	for _, vars := range append([]Vars{v}, others...) {
+		for key, val := range vars {
+			merged[key] = val
+		}
+	}
+	return merged
+}
+
+// Expand expands the template in s. Strings without actions are returned as they are, and
+// using a variable that isn't set is an error.
+func Expand(s string, vars Vars) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(funcs).Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid template %q: %w", s, err)
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, map[string]string(vars)); err != nil {
+		return "", fmt.Errorf("expanding %q: %w", s, err)
+	}
+	return out.String(), nil
+}
+
+// ExpandValue expands the templates of a setting, which is either a string or a list of them.
+// Other values are returned as they are.
+func ExpandValue(value any, vars Vars) (any, error) {
+	switch v := value.(type) {
+	case string:
+		return Expand(v, vars)
+	case []string:
+		expanded := make([]string, len(v))
+		for i, s := range v {
+			var err error
+			if expanded[i], err = Expand(s, vars); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	case []any:
+		expanded := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if expanded[i], err = ExpandValue(item, vars); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	default:
+		return value, nil
+	}
+}
+
+// FromRelease returns the values of the Kairos image in rootDir, read from its kairos-release
+// or, for older images, its os-release. Each KAIROS_ value is available in lower case without
+// the prefix, so KAIROS_FLAVOR is {{.flavor}}.
+func FromRelease(fs v1.FS, rootDir string) (Vars, error) {
+	var data []byte
+	var err error
+	for _, name := range []string{"etc/kairos-release", "etc/os-release"} {
+		if data, err = fs.ReadFile(filepath.Join(rootDir, name)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the release values of the image: %w", err)
+	}
+	vars := Vars{}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, val, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !strings.HasPrefix(key, releasePrefix) {
+			continue
+		}
+		vars[strings.ToLower(strings.TrimPrefix(key, releasePrefix))] = strings.Trim(val, `"'`)
+	}
+	return vars, nil
+}
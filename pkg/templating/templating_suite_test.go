@@ -0,0 +1,13 @@
+package templating_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTemplating(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Templating test suite")
+}
@@ -0,0 +1,73 @@
+package templating_test
+
+import (
+	"github.com/kairos-io/enki/pkg/templating"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Templating", Label("templating"), func() {
+	vars := templating.Vars{"flavor": "ubuntu", "version": "v3.0.0", "arch": "amd64"}
+
+	It("expands the variables and functions in the templates", func() {
+		out, err := templating.Expand("Kairos {{.flavor | upper}} {{.version}}-{{.arch}}", vars)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("Kairos UBUNTU v3.0.0-amd64"))
+
+		out, err = templating.Expand(`{{if eq .flavor "ubuntu"}}console=tty1{{end}} {{trimPrefix "v" .version}}`, vars)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("console=tty1 3.0.0"))
+	})
+
+	It("keeps strings without templates as they are", func() {
+		out, err := templating.Expand("console=ttyS0 {not a template}", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("console=ttyS0 {not a template}"))
+	})
+
+	It("fails on unknown variables and invalid templates", func() {
+		_, err := templating.Expand("{{.model}}", vars)
+		Expect(err).To(HaveOccurred())
+		_, err = templating.Expand("{{.flavor", vars)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("expands lists of strings", func() {
+		out, err := templating.ExpandValue([]any{"{{.flavor}}", 3}, vars)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal([]any{"ubuntu", 3}))
+
+		out, err = templating.ExpandValue([]string{"a={{.arch}}"}, vars)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal([]string{"a=amd64"}))
+	})
+
+	It("parses the set values and merges them on top", func() {
+		set, err := templating.ParseSet([]string{"flavor=debian", "extra=a=b"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(set).To(Equal(templating.Vars{"flavor": "debian", "extra": "a=b"}))
+		Expect(vars.Merge(set)).To(HaveKeyWithValue("flavor", "debian"))
+		Expect(vars).To(HaveKeyWithValue("flavor", "ubuntu"))
+
+		_, err = templating.ParseSet([]string{"flavor"})
+		Expect(err).To(HaveOccurred())
+		_, err = templating.ParseSet([]string{"=debian"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reads the Kairos values of the image", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/rootfs/etc/os-release": "NAME=\"Ubuntu\"\nKAIROS_FLAVOR=\"ubuntu\"\nKAIROS_VERSION=v3.0.0\nKAIROS_FLAVOR_RELEASE='22.04'\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		release, err := templating.FromRelease(fs, "/rootfs")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(release).To(Equal(templating.Vars{"flavor": "ubuntu", "version": "v3.0.0", "flavor_release": "22.04"}))
+
+		_, err = templating.FromRelease(fs, "/missing")
+		Expect(err).To(HaveOccurred())
+	})
+})
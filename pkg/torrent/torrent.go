@@ -0,0 +1,223 @@
+// Package torrent generates BitTorrent v1 metainfo files and magnet links for single file
+// artifacts, with optional trackers and web seeds (BEP 19) so HTTP mirrors can seed them.
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"time"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// Extension is appended to the artifact name to get the torrent file name
+	Extension = ".torrent"
+	// minPieceLength and maxPieceLength bound the automatic piece length
+	minPieceLength = 256 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// targetPieces is the amount of pieces the automatic piece length aims for, keeping the
+	// torrent file small without making pieces too big to verify early
+	targetPieces = 1500
+)
+
+// Options of the generated torrent
+type Options struct {
+	// Name is the file name clients save the artifact as
+	Name string
+	// Trackers are the announce URLs, the first one is the main tracker
+	Trackers []string
+	// WebSeeds are HTTP URLs serving the artifact. URLs ending in / get the Name appended.
+	WebSeeds []string
+	// CreatedBy is the program creating the torrent
+	CreatedBy string
+	// CreationDate of the torrent, not written if zero
+	CreationDate time.Time
+	// PieceLength of the torrent, 0 picks one from the artifact length
+	PieceLength int64
+}
+
+// Torrent is the result of hashing an artifact
+type Torrent struct {
+	// InfoHash identifies the torrent, it is the SHA-1 of the bencoded info dictionary
+	InfoHash [sha1.Size]byte
+	opts     Options
+	info     map[string]any
+}
+
+// New hashes the artifact read from r
+func New(r io.Reader, length int64, opts Options) (*Torrent, error) {
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = PieceLength(length)
+	}
+
+	var pieces bytes.Buffer
+	var total int64
+	buf := make([]byte, pieceLength)
+	reader := bufio.NewReaderSize(r, int(min(pieceLength, 1024*1024)))
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			total += int64(n)
+			sum := sha1.Sum(buf[:n])
+			pieces.Write(sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := map[string]any{
+		"name":         opts.Name,
+		"length":       total,
+		"piece length": pieceLength,
+		"pieces":       pieces.String(),
+	}
+	var encoded bytes.Buffer
+	if err := bencode(&encoded, info); err != nil {
+		return nil, err
+	}
+	return &Torrent{InfoHash: sha1.Sum(encoded.Bytes()), opts: opts, info: info}, nil
+}
+
+// PieceLength returns a power of two piece length for an artifact of the given length
+func PieceLength(length int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Write writes the bencoded metainfo into w
+func (t *Torrent) Write(w io.Writer) error {
+	meta := map[string]any{"info": t.info}
+	if len(t.opts.Trackers) > 0 {
+		meta["announce"] = t.opts.Trackers[0]
+		var tiers []any
+		for _, tracker := range t.opts.Trackers {
+			tiers = append(tiers, []any{tracker})
+		}
+		meta["announce-list"] = tiers
+	}
+	if len(t.opts.WebSeeds) > 0 {
+		var seeds []any
+		for _, seed := range t.opts.WebSeeds {
+			seeds = append(seeds, seed)
+		}
+		meta["url-list"] = seeds
+	}
+	if t.opts.CreatedBy != "" {
+		meta["created by"] = t.opts.CreatedBy
+	}
+	if !t.opts.CreationDate.IsZero() {
+		meta["creation date"] = t.opts.CreationDate.Unix()
+	}
+	bw := bufio.NewWriter(w)
+	if err := bencode(bw, meta); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Magnet returns the magnet link of the torrent, including its trackers and web seeds
+func (t *Torrent) Magnet() string {
+	params := url.Values{}
+	params.Set("dn", t.opts.Name)
+	for _, tracker := range t.opts.Trackers {
+		params.Add("tr", tracker)
+	}
+	for _, seed := range t.opts.WebSeeds {
+		params.Add("ws", seed)
+	}
+	// The xt value must not be escaped, so it's added by hand
+	return fmt.Sprintf("magnet:?xt=urn:btih:%s&%s", hex.EncodeToString(t.InfoHash[:]), params.Encode())
+}
+
+// WriteFile generates the torrent of the given artifact next to it. It returns the torrent path
+// and its magnet link.
+func WriteFile(fs v1.FS, artifact string, opts Options) (string, string, error) {
+	f, err := fs.Open(artifact)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if opts.Name == "" {
+		opts.Name = filepath.Base(artifact)
+	}
+	t, err := New(f, info.Size(), opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	torrentFile := artifact + Extension
+	out, err := fs.Create(torrentFile)
+	if err != nil {
+		return "", "", err
+	}
+	err = t.Write(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return torrentFile, t.Magnet(), err
+}
+
+// bencode writes v in the bencoding format. Only the types used in metainfo files are supported.
+func bencode(w io.Writer, v any) error {
+	var err error
+	switch val := v.(type) {
+	case string:
+		_, err = fmt.Fprintf(w, "%d:%s", len(val), val)
+	case int64:
+		_, err = fmt.Fprintf(w, "i%de", val)
+	case int:
+		_, err = fmt.Fprintf(w, "i%de", val)
+	case []any:
+		if _, err = io.WriteString(w, "l"); err != nil {
+			return err
+		}
+		for _, item := range val {
+			if err = bencode(w, item); err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(w, "e")
+	case map[string]any:
+		// Dictionary keys must be sorted as raw strings
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if _, err = io.WriteString(w, "d"); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = bencode(w, k); err != nil {
+				return err
+			}
+			if err = bencode(w, val[k]); err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(w, "e")
+	default:
+		return fmt.Errorf("can't bencode %T", v)
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+package torrent_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTorrent(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Torrent test suite")
+}
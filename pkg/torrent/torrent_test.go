@@ -0,0 +1,55 @@
+package torrent_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/torrent"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Torrent", Label("torrent"), func() {
+	It("writes the bencoded metainfo", func() {
+		data := []byte("profound thoughts")
+		t, err := torrent.New(bytes.NewReader(data), int64(len(data)), torrent.Options{
+			Name:     "kairos.iso",
+			Trackers: []string{"udp://tracker.example.org:1337/announce"},
+			WebSeeds: []string{"https://mirror.example.org/releases/"},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		piece := sha1.Sum(data)
+		info := "d6:lengthi17e4:name10:kairos.iso12:piece lengthi262144e6:pieces20:" + string(piece[:]) + "e"
+		Expect(t.InfoHash).To(Equal(sha1.Sum([]byte(info))))
+
+		var out bytes.Buffer
+		Expect(t.Write(&out)).To(Succeed())
+		Expect(out.String()).To(Equal("d8:announce39:udp://tracker.example.org:1337/announce" +
+			"13:announce-listll39:udp://tracker.example.org:1337/announceee" +
+			"4:info" + info +
+			"8:url-listl36:https://mirror.example.org/releases/ee"))
+
+		magnet := t.Magnet()
+		Expect(magnet).To(HavePrefix("magnet:?xt=urn:btih:" + hex.EncodeToString(t.InfoHash[:]) + "&"))
+		Expect(magnet).To(ContainSubstring("dn=kairos.iso"))
+		Expect(magnet).To(ContainSubstring("ws=https%3A%2F%2Fmirror.example.org%2Freleases%2F"))
+	})
+	It("hashes every piece", func() {
+		data := []byte(strings.Repeat("a", 256*1024) + "b")
+		t, err := torrent.New(bytes.NewReader(data), int64(len(data)), torrent.Options{Name: "a"})
+		Expect(err).ShouldNot(HaveOccurred())
+		var out bytes.Buffer
+		Expect(t.Write(&out)).To(Succeed())
+		first := sha1.Sum(data[:256*1024])
+		last := sha1.Sum(data[256*1024:])
+		Expect(out.String()).To(ContainSubstring("6:pieces40:" + string(first[:]) + string(last[:]) + "e"))
+	})
+	It("picks power of two piece lengths", func() {
+		Expect(torrent.PieceLength(10)).To(Equal(int64(256 * 1024)))
+		Expect(torrent.PieceLength(2 * 1024 * 1024 * 1024)).To(Equal(int64(2 * 1024 * 1024)))
+		Expect(torrent.PieceLength(1 << 40)).To(Equal(int64(16 * 1024 * 1024)))
+	})
+})
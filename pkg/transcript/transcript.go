@@ -0,0 +1,206 @@
+// Package transcript records every external command a build runs, with its arguments, part of
+// its environment, how long it took, how it exited and the end of its output, so failed builds
+// can be reproduced and audited step by step.
+package transcript
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/logging"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// maxOutput is how much of the end of the output of the commands is kept, where their errors are
+const maxOutput = 4096
+
+// envSubset are the environment variables recorded, the ones changing what the tools do
+var envSubset = []string{"PATH", "TMPDIR", "HOME", "LANG", "LC_ALL", "SOURCE_DATE_EPOCH", "DOCKER_CONFIG"}
+
+// Command is an external command run by the build
+type Command struct {
+	Argv []string          `json:"argv"`
+	Env  map[string]string `json:"env,omitempty"`
+	Dir  string            `json:"dir,omitempty"`
+	// Start is when it was run, or created for the commands started by enki itself, which
+	// duration is unknown
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// ExitCode is -1 for the commands that couldn't be run or which outcome is unknown
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+	// Output is the end of the combined output, truncated to its last 4KiB
+	Output          string `json:"output,omitempty"`
+	OutputTruncated bool   `json:"output_truncated,omitempty"`
+}
+
+// Recorder keeps the commands run, appending them to its file as JSON lines as they finish so
+// the ones of interrupted builds are kept too. The commands enki starts itself, like mksquashfs
+// packing the streamed image, are recorded once they exit when the commands are listed. A nil
+// Recorder is valid and records nothing.
+type Recorder struct {
+	mu       sync.Mutex
+	file     *os.File
+	commands []Command
+	// started are the commands created for enki to start them, recorded once they exit
+	started []startedCmd
+}
+
+type startedCmd struct {
+	cmd   *exec.Cmd
+	start time.Time
+}
+
+// New returns a Recorder appending the commands to the file at path
+func New(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: f}, nil
+}
+
+// Wrap returns runner recording the commands it runs, runner itself if r is nil
+func Wrap(runner v1.Runner, r *Recorder) v1.Runner {
+	if r == nil {
+		return runner
+	}
+	return &recordingRunner{Runner: runner, recorder: r}
+}
+
+// Commands returns the commands recorded so far, recording the ones started by enki that exited
+func (r *Recorder) Commands() []Command {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushStarted()
+	return append([]Command{}, r.commands...)
+}
+
+// record adds the command run from start on, which exited with err after printing out
+func (r *Recorder) record(argv []string, env []string, dir string, start time.Time, out []byte, err error) {
+	c := Command{Argv: redact(argv), Env: environment(env), Dir: dir, Start: start, DurationSeconds: time.Since(start).Seconds(), ExitCode: exitCode(err)}
+	if err != nil {
+		c.Error = logging.Redact(err.Error())
+	}
+	if len(out) > maxOutput {
+		out = out[len(out)-maxOutput:]
+		c.OutputTruncated = true
+	}
+	c.Output = logging.Redact(string(out))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(c)
+}
+
+// add keeps the command and appends it to the file
+func (r *Recorder) add(c Command) {
+	r.commands = append(r.commands, c)
+	if data, err := json.Marshal(c); err == nil {
+		_, _ = r.file.Write(append(data, '\n'))
+	}
+}
+
+// flushStarted records the commands started by enki that exited. Their duration is unknown.
+func (r *Recorder) flushStarted() {
+	var left []startedCmd
+	for _, s := range r.started {
+		if s.cmd.ProcessState == nil {
+			left = append(left, s)
+			continue
+		}
+		r.add(Command{Argv: redact(s.cmd.Args), Env: environment(s.cmd.Env), Dir: s.cmd.Dir, Start: s.start, ExitCode: s.cmd.ProcessState.ExitCode()})
+	}
+	r.started = left
+}
+
+// recordingRunner records the commands run through it
+type recordingRunner struct {
+	v1.Runner
+	recorder *Recorder
+}
+
+func (r *recordingRunner) Run(command string, args ...string) ([]byte, error) {
+	start := time.Now()
+	out, err := r.Runner.Run(command, args...)
+	r.recorder.record(append([]string{command}, args...), nil, "", start, out, err)
+	return out, err
+}
+
+func (r *recordingRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := r.Runner.RunCmd(cmd)
+	if cmd != nil {
+		r.recorder.forget(cmd)
+		r.recorder.record(cmd.Args, cmd.Env, cmd.Dir, start, out, err)
+	}
+	return out, err
+}
+
+// InitCmd keeps the command created to record it once it exits, as enki may start it itself
+// rather than running it with RunCmd
+func (r *recordingRunner) InitCmd(command string, args ...string) *exec.Cmd {
+	cmd := r.Runner.InitCmd(command, args...)
+	if cmd != nil {
+		r.recorder.mu.Lock()
+		r.recorder.started = append(r.recorder.started, startedCmd{cmd: cmd, start: time.Now()})
+		r.recorder.mu.Unlock()
+	}
+	return cmd
+}
+
+// forget drops the command created with InitCmd, as it is recorded by RunCmd
+func (r *Recorder) forget(cmd *exec.Cmd) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, s := range r.started {
+		if s.cmd == cmd {
+			r.started = append(r.started[:i], r.started[i+1:]...)
+			return
+		}
+	}
+}
+
+// environment returns the recorded subset of env, or of the environment of enki if nil
+func environment(env []string) map[string]string {
+	if env == nil {
+		env = os.Environ()
+	}
+	subset := map[string]string{}
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		for _, n := range envSubset {
+			if name == n {
+				subset[name] = logging.Redact(value)
+			}
+		}
+	}
+	return subset
+}
+
+// exitCode returns the exit code of the command that ended with err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+func redact(argv []string) []string {
+	redacted := make([]string, len(argv))
+	for i, arg := range argv {
+		redacted[i] = logging.Redact(arg)
+	}
+	return redacted
+}
@@ -0,0 +1,90 @@
+package transcript_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/transcript"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transcript", Label("transcript"), func() {
+	var path string
+	var recorder *transcript.Recorder
+	var runner v1.Runner
+
+	BeforeEach(func() {
+		var err error
+		path = filepath.Join(GinkgoT().TempDir(), "transcript.jsonl")
+		recorder, err = transcript.New(path)
+		Expect(err).ToNot(HaveOccurred())
+		runner = transcript.Wrap(&v1.RealRunner{Logger: v1.NewNullLogger()}, recorder)
+	})
+
+	It("records the commands run along with how they exited", func() {
+		_, err := runner.Run("sh", "-c", "echo built")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = runner.Run("sh", "-c", "echo broken >&2; exit 3")
+		Expect(err).To(HaveOccurred())
+		_, err = runner.Run("/nonexistent/tool")
+		Expect(err).To(HaveOccurred())
+
+		commands := recorder.Commands()
+		Expect(commands).To(HaveLen(3))
+		Expect(commands[0].Argv).To(Equal([]string{"sh", "-c", "echo built"}))
+		Expect(commands[0].ExitCode).To(Equal(0))
+		Expect(commands[0].Output).To(Equal("built\n"))
+		Expect(commands[0].Env).To(HaveKey("PATH"))
+		Expect(commands[1].ExitCode).To(Equal(3))
+		Expect(commands[1].Output).To(Equal("broken\n"))
+		Expect(commands[1].Error).To(ContainSubstring("exit status 3"))
+		Expect(commands[2].ExitCode).To(Equal(-1))
+
+		// Appended to the file as JSON lines as they finish
+		f, err := os.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		var lines []transcript.Command
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var c transcript.Command
+			Expect(json.Unmarshal(scanner.Bytes(), &c)).To(Succeed())
+			lines = append(lines, c)
+		}
+		Expect(lines).To(HaveLen(3))
+		Expect(lines[1].ExitCode).To(Equal(3))
+	})
+
+	It("records the commands started by enki once they exit", func() {
+		cmd := runner.InitCmd("sh", "-c", "exit 2")
+		Expect(recorder.Commands()).To(BeEmpty())
+		Expect(cmd.Run()).ToNot(Succeed())
+		commands := recorder.Commands()
+		Expect(commands).To(HaveLen(1))
+		Expect(commands[0].ExitCode).To(Equal(2))
+
+		// Not twice if run with RunCmd
+		cmd = runner.InitCmd("true")
+		_, err := runner.RunCmd(cmd)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recorder.Commands()).To(HaveLen(2))
+	})
+
+	It("truncates the output and redacts the secrets", func() {
+		logging.AddSecret("transcript-secret")
+		_, err := runner.Run("sh", "-c", "head -c 10000 /dev/zero | tr '\\0' a; echo transcript-secret")
+		Expect(err).ToNot(HaveOccurred())
+		commands := recorder.Commands()
+		Expect(commands).To(HaveLen(1))
+		Expect(commands[0].OutputTruncated).To(BeTrue())
+		Expect(len(commands[0].Output)).To(BeNumerically("<=", 4096))
+		Expect(commands[0].Output).ToNot(ContainSubstring("transcript-secret"))
+		Expect(strings.Join(commands[0].Argv, " ")).ToNot(ContainSubstring("transcript-secret"))
+	})
+})
@@ -0,0 +1,287 @@
+// Package trust verifies the signatures of the source images against a trust policy before
+// building anything from them, with cosign or notation, so media are only built from images
+// signed by the expected keys or identities.
+package trust
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Cosign verifies sigstore signatures
+	Cosign = "cosign"
+	// Notation verifies notary project signatures
+	Notation = "notation"
+
+	// UnmatchedReject refuses the images no rule matches, the default
+	UnmatchedReject = "reject"
+	// UnmatchedAllow builds from the images no rule matches without verifying them
+	UnmatchedAllow = "allow"
+)
+
+// Policy tells which signatures the source images must have, like
+//
+//	unmatched: reject
+//	rules:
+//	  - images: ["quay.io/kairos/*"]
+//	    cosign:
+//	      identity: https://github.com/kairos-io/kairos/.github/workflows/release.yaml@refs/heads/master
+//	      issuer: https://token.actions.githubusercontent.com
+//	      provenance: slsaprovenance1
+//	  - images: ["registry.example.com/**"]
+//	    cosign:
+//	      key: /etc/enki/cosign.pub
+type Policy struct {
+	// Unmatched is what to do with the images no rule matches
+	Unmatched string `yaml:"unmatched"`
+	Rules     []Rule `yaml:"rules"`
+}
+
+// Rule is how the images matching any of its patterns are verified. The first matching rule
+// of a policy applies.
+type Rule struct {
+	// Images are glob patterns of repositories, like quay.io/kairos/*. Images of the docker hub
+	// are named like index.docker.io/library/ubuntu. A trailing /** matches any number of path
+	// segments.
+	Images   []string      `yaml:"images"`
+	Cosign   *CosignRule   `yaml:"cosign,omitempty"`
+	Notation *NotationRule `yaml:"notation,omitempty"`
+}
+
+// CosignRule verifies the images with a public key, or keyless with the identity and the OIDC
+// issuer of the signing certificate
+type CosignRule struct {
+	Key      string `yaml:"key,omitempty"`
+	Identity string `yaml:"identity,omitempty"`
+	Issuer   string `yaml:"issuer,omitempty"`
+	// Provenance is the cosign type of the SLSA provenance attestation the images must have too,
+	// signed like the images, see ProvenanceTypes. The attestation is chained into the build info.
+	Provenance string `yaml:"provenance,omitempty"`
+}
+
+// ProvenanceTypes returns the cosign types of the SLSA provenance attestations, v0.2 and v1
+func ProvenanceTypes() []string {
+	return []string{"slsaprovenance", "slsaprovenance02", "slsaprovenance1"}
+}
+
+// Provenance is the verified provenance attestation of an image, as chained into the build info
+type Provenance struct {
+	PredicateType string `yaml:"predicate-type"`
+	// Builder is the id of the builder of the image, like the workflow of a CI
+	Builder string `yaml:"builder,omitempty"`
+	// Digest is the sha256 digest of the in-toto statement of the attestation
+	Digest string `yaml:"digest"`
+}
+
+// Result is how an image was verified
+type Result struct {
+	// Verifier is the tool its signature was verified with, empty for images allowed without
+	// verification
+	Verifier   string
+	Provenance *Provenance
+}
+
+// NotationRule verifies the images with the trust policy and trust store configured in notation
+type NotationRule struct{}
+
+// Load reads the policy in path and checks it is valid
+func Load(fs v1.FS, path string) (*Policy, error) {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid trust policy %s: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid trust policy %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	switch p.Unmatched {
+	case "":
+		p.Unmatched = UnmatchedReject
+	case UnmatchedReject, UnmatchedAllow:
+	default:
+		return fmt.Errorf("unmatched must be %s or %s, not %q", UnmatchedReject, UnmatchedAllow, p.Unmatched)
+	}
+	for i, r := range p.Rules {
+		if len(r.Images) == 0 {
+			return fmt.Errorf("rule %d has no images", i+1)
+		}
+		for _, pattern := range r.Images {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d has an invalid image pattern %q", i+1, pattern)
+			}
+		}
+		if (r.Cosign == nil) == (r.Notation == nil) {
+			return fmt.Errorf("rule %d must verify with either cosign or notation", i+1)
+		}
+		if c := r.Cosign; c != nil {
+			keyless := c.Identity != "" || c.Issuer != ""
+			if c.Key != "" && keyless {
+				return fmt.Errorf("rule %d must verify cosign signatures with either a key or an identity", i+1)
+			}
+			if c.Key == "" && (c.Identity == "" || c.Issuer == "") {
+				return fmt.Errorf("rule %d must set the key, or the identity and issuer, of cosign signatures", i+1)
+			}
+			if c.Provenance != "" && !slices.Contains(ProvenanceTypes(), c.Provenance) {
+				return fmt.Errorf("rule %d has an unknown provenance type %q, available types: %s", i+1, c.Provenance, strings.Join(ProvenanceTypes(), ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// Binaries returns the executables the policy verifies signatures with
+func (p *Policy) Binaries() []string {
+	var binaries []string
+	for _, r := range p.Rules {
+		binary := Cosign
+		if r.Notation != nil {
+			binary = Notation
+		}
+		if !slices.Contains(binaries, binary) {
+			binaries = append(binaries, binary)
+		}
+	}
+	return binaries
+}
+
+// Verify fails if the image ref is not signed as the policy requires, or lacks the provenance
+// attestation the policy requires
+func (p *Policy) Verify(runner v1.Runner, ref string) (Result, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return Result{}, err
+	}
+	rule := p.match(r.Context().Name())
+	if rule == nil {
+		if p.Unmatched == UnmatchedAllow {
+			return Result{}, nil
+		}
+		return Result{}, fmt.Errorf("%s matches no rule of the trust policy", ref)
+	}
+	c := rule.Cosign
+	if c == nil {
+		return Result{Verifier: Notation}, run(runner, Notation, "signature", ref, "verify", ref)
+	}
+	identity := []string{"--key", c.Key}
+	if c.Key == "" {
+		identity = []string{"--certificate-identity", c.Identity, "--certificate-oidc-issuer", c.Issuer}
+	}
+	result := Result{Verifier: Cosign}
+	if err := run(runner, Cosign, "signature", ref, append(append([]string{"verify"}, identity...), ref)...); err != nil {
+		return result, err
+	}
+	if c.Provenance == "" {
+		return result, nil
+	}
+	args := append(append([]string{"verify-attestation", "--type", c.Provenance}, identity...), ref)
+	out, err := runner.Run(Cosign, args...)
+	if err != nil {
+		return result, fmt.Errorf("cosign provenance attestation of %s: %w\n%s", ref, err, strings.TrimSpace(string(out)))
+	}
+	if result.Provenance, err = parseProvenance(out); err != nil {
+		return result, fmt.Errorf("cosign provenance attestation of %s: %w", ref, err)
+	}
+	return result, nil
+}
+
+// run runs a verification, failing with its output
+func run(runner v1.Runner, verifier, what, ref string, args ...string) error {
+	if out, err := runner.Run(verifier, args...); err != nil {
+		return fmt.Errorf("%s %s of %s: %w\n%s", verifier, what, ref, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// parseProvenance returns the provenance of the first attestation cosign verify-attestation
+// printed, as a DSSE envelope per line along with its logs
+func parseProvenance(out []byte) (*Provenance, error) {
+	for _, line := range strings.Split(string(out), "\n") {
+		var envelope struct {
+			PayloadType string `json:"payloadType"`
+			Payload     string `json:"payload"`
+		}
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &envelope) != nil || envelope.Payload == "" {
+			continue
+		}
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attestation payload: %w", err)
+		}
+		var statement struct {
+			PredicateType string `json:"predicateType"`
+			Predicate     struct {
+				// SLSA v0.2
+				Builder struct {
+					ID string `json:"id"`
+				} `json:"builder"`
+				// SLSA v1
+				RunDetails struct {
+					Builder struct {
+						ID string `json:"id"`
+					} `json:"builder"`
+				} `json:"runDetails"`
+			} `json:"predicate"`
+		}
+		if err := json.Unmarshal(payload, &statement); err != nil {
+			return nil, fmt.Errorf("invalid in-toto statement: %w", err)
+		}
+		builder := statement.Predicate.Builder.ID
+		if builder == "" {
+			builder = statement.Predicate.RunDetails.Builder.ID
+		}
+		return &Provenance{
+			PredicateType: statement.PredicateType,
+			Builder:       builder,
+			Digest:        fmt.Sprintf("sha256:%x", sha256.Sum256(payload)),
+		}, nil
+	}
+	return nil, fmt.Errorf("no attestation found in the cosign output")
+}
+
+// match returns the first rule matching repo
+func (p *Policy) match(repo string) *Rule {
+	for i, r := range p.Rules {
+		for _, pattern := range r.Images {
+			if matchRepo(pattern, repo) {
+				return &p.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// matchRepo matches repo against the glob pattern, where a trailing /** matches any number of
+// path segments
+func matchRepo(pattern, repo string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		if matched, _ := path.Match(prefix, repo); matched {
+			return true
+		}
+		parts := strings.Split(repo, "/")
+		for i := 1; i < len(parts); i++ {
+			if matched, _ := path.Match(prefix, strings.Join(parts[:i], "/")); matched {
+				return true
+			}
+		}
+		return false
+	}
+	matched, _ := path.Match(pattern, repo)
+	return matched
+}
@@ -0,0 +1,13 @@
+package trust_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTrust(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Trust test suite")
+}
@@ -0,0 +1,124 @@
+package trust_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/trust"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs"
+)
+
+var _ = Describe("Trust policy", Label("trust"), func() {
+	var dir string
+	var runner *v1mock.FakeRunner
+
+	load := func(policy string) (*trust.Policy, error) {
+		path := filepath.Join(dir, "policy.yaml")
+		Expect(os.WriteFile(path, []byte(policy), 0644)).To(Succeed())
+		return trust.Load(vfs.OSFS, path)
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		runner = v1mock.NewFakeRunner()
+	})
+
+	It("verifies the images with the first rule matching their repository", func() {
+		policy, err := load(`rules:
+  - images: ["quay.io/kairos/*"]
+    cosign:
+      identity: https://github.com/kairos-io/kairos/.github/workflows/release.yaml@refs/heads/master
+      issuer: https://token.actions.githubusercontent.com
+  - images: ["registry.example.com/**"]
+    cosign:
+      key: /etc/enki/cosign.pub
+  - images: ["index.docker.io/library/*"]
+    notation: {}
+`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(policy.Binaries()).To(Equal([]string{trust.Cosign, trust.Notation}))
+
+		for _, ref := range []string{"quay.io/kairos/ubuntu:24.04", "registry.example.com/team/os/fedora:40", "ubuntu:24.04"} {
+			_, err := policy.Verify(runner, ref)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(runner.CmdsMatch([][]string{
+			{"cosign", "verify", "--certificate-identity", "https://github.com/kairos-io/kairos/.github/workflows/release.yaml@refs/heads/master", "--certificate-oidc-issuer", "https://token.actions.githubusercontent.com", "quay.io/kairos/ubuntu:24.04"},
+			{"cosign", "verify", "--key", "/etc/enki/cosign.pub", "registry.example.com/team/os/fedora:40"},
+			{"notation", "verify", "ubuntu:24.04"},
+		})).To(Succeed())
+	})
+
+	It("refuses unsigned and unmatched images", func() {
+		policy, err := load(`rules:
+  - images: ["quay.io/kairos/*"]
+    cosign:
+      key: cosign.pub
+`)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = policy.Verify(runner, "quay.io/other/ubuntu:24.04")
+		Expect(err).To(MatchError(ContainSubstring("matches no rule of the trust policy")))
+
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			return []byte("no matching signatures"), errors.New("exit status 1")
+		}
+		_, err = policy.Verify(runner, "quay.io/kairos/ubuntu:24.04")
+		Expect(err).To(MatchError(ContainSubstring("no matching signatures")))
+
+		policy.Unmatched = trust.UnmatchedAllow
+		result, err := policy.Verify(runner, "quay.io/other/ubuntu:24.04")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Verifier).To(BeEmpty())
+	})
+
+	It("verifies the provenance attestation of the images", func() {
+		policy, err := load(`rules:
+  - images: ["quay.io/kairos/*"]
+    cosign:
+      key: cosign.pub
+      provenance: slsaprovenance1
+`)
+		Expect(err).ToNot(HaveOccurred())
+		statement := `{"_type":"https://in-toto.io/Statement/v1","predicateType":"https://slsa.dev/provenance/v1","predicate":{"runDetails":{"builder":{"id":"https://github.com/kairos-io/kairos/.github/workflows/release.yaml"}}}}`
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			if args[0] != "verify-attestation" {
+				return nil, nil
+			}
+			return []byte("Verification for quay.io/kairos/ubuntu:24.04 --\n" +
+				`{"payloadType":"application/vnd.in-toto+json","payload":"` + base64.StdEncoding.EncodeToString([]byte(statement)) + `","signatures":[]}` + "\n"), nil
+		}
+		result, err := policy.Verify(runner, "quay.io/kairos/ubuntu:24.04")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runner.IncludesCmds([][]string{{"cosign", "verify-attestation", "--type", "slsaprovenance1", "--key", "cosign.pub", "quay.io/kairos/ubuntu:24.04"}})).To(Succeed())
+		Expect(result.Provenance).To(Equal(&trust.Provenance{
+			PredicateType: "https://slsa.dev/provenance/v1",
+			Builder:       "https://github.com/kairos-io/kairos/.github/workflows/release.yaml",
+			Digest:        fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(statement))),
+		}))
+	})
+
+	It("rejects invalid policies", func() {
+		_, err := load(`rules:
+  - images: ["quay.io/kairos/*"]
+    cosign:
+      key: cosign.pub
+    notation: {}
+`)
+		Expect(err).To(MatchError(ContainSubstring("rule 1 must verify with either cosign or notation")))
+		_, err = load(`rules:
+  - images: ["quay.io/kairos/*"]
+    cosign:
+      identity: someone@example.com
+`)
+		Expect(err).To(MatchError(ContainSubstring("the identity and issuer")))
+		_, err = load("unmatched: maybe\n")
+		Expect(err).To(MatchError(ContainSubstring("unmatched must be reject or allow")))
+	})
+})
@@ -2,9 +2,29 @@ package types
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
+	"github.com/kairos-io/enki/pkg/autoinstall"
+	"github.com/kairos-io/enki/pkg/buildinfo"
+	"github.com/kairos-io/enki/pkg/encrypt"
+	"github.com/kairos-io/enki/pkg/firmware"
+	"github.com/kairos-io/enki/pkg/history"
+	"github.com/kairos-io/enki/pkg/iso"
+	"github.com/kairos-io/enki/pkg/limits"
+	"github.com/kairos-io/enki/pkg/microcode"
+	"github.com/kairos-io/enki/pkg/secret"
+	"github.com/kairos-io/enki/pkg/secureboot"
+	"github.com/kairos-io/enki/pkg/transcript"
+	"github.com/kairos-io/enki/pkg/upload"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/kairos-io/enki/pkg/vulnscan"
+	"github.com/kairos-io/enki/pkg/workdir"
 	cfg "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
 )
 
 type LiveISO struct {
@@ -14,13 +34,70 @@ type LiveISO struct {
 	Label              string            `yaml:"label,omitempty" mapstructure:"label"`
 	GrubEntry          string            `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
 	BootloaderInRootFs bool              `yaml:"bootloader-in-rootfs" mapstructure:"bootloader-in-rootfs"`
+	Hooks              []string          `yaml:"rootfs-hook,omitempty" mapstructure:"rootfs-hook"`
+	MaxSize            string            `yaml:"max-size,omitempty" mapstructure:"max-size"`
+	Prune              []string          `yaml:"prune,omitempty" mapstructure:"prune"`
+	PruneDryRun        bool              `yaml:"prune-dry-run,omitempty" mapstructure:"prune-dry-run"`
+	VulnScan           string            `yaml:"vuln-scan,omitempty" mapstructure:"vuln-scan"`
+	FailOnSeverity     string            `yaml:"fail-on-severity,omitempty" mapstructure:"fail-on-severity"`
+	VerifySourcePolicy string            `yaml:"verify-source-policy,omitempty" mapstructure:"verify-source-policy"`
+	StreamRootfs       bool              `yaml:"stream-rootfs,omitempty" mapstructure:"stream-rootfs"`
+	HTTPBoot           bool              `yaml:"http-boot,omitempty" mapstructure:"http-boot"`
+	Progress           bool              `yaml:"progress,omitempty" mapstructure:"progress"`
+	Zsync              bool              `yaml:"zsync,omitempty" mapstructure:"zsync"`
+	Checksums          []string          `yaml:"checksum,omitempty" mapstructure:"checksum"`
+	ChecksumFormat     string            `yaml:"checksum-format,omitempty" mapstructure:"checksum-format"`
+	Recovery           bool              `yaml:"recovery,omitempty" mapstructure:"recovery"`
+	Encrypt            string            `yaml:"encrypt,omitempty" mapstructure:"encrypt"`
+	EncryptKey         string            `yaml:"encrypt-key,omitempty" mapstructure:"encrypt-key"`
+	Torrent            bool              `yaml:"torrent,omitempty" mapstructure:"torrent"`
+	TorrentTrackers    []string          `yaml:"torrent-tracker,omitempty" mapstructure:"torrent-tracker"`
+	TorrentWebSeeds    []string          `yaml:"torrent-webseed,omitempty" mapstructure:"torrent-webseed"`
+	Upload             string            `yaml:"upload,omitempty" mapstructure:"upload"`
+	EFIShell           string            `yaml:"efi-shell,omitempty" mapstructure:"efi-shell"`
+	Memtest            string            `yaml:"memtest,omitempty" mapstructure:"memtest"`
+	ISOEngine          string            `yaml:"iso-engine,omitempty" mapstructure:"iso-engine"`
+	RockRidge          bool              `yaml:"iso-rockridge" mapstructure:"iso-rockridge"`
+	Joliet             bool              `yaml:"iso-joliet" mapstructure:"iso-joliet"`
+	RelocateDeepDirs   bool              `yaml:"iso-relocate-deep-dirs,omitempty" mapstructure:"iso-relocate-deep-dirs"`
+	EspHeadroom        int               `yaml:"esp-headroom" mapstructure:"esp-headroom"`
+	EspAlign           string            `yaml:"esp-align,omitempty" mapstructure:"esp-align"`
+	EspSize            string            `yaml:"esp-size,omitempty" mapstructure:"esp-size"`
+	EspFat             string            `yaml:"esp-fat,omitempty" mapstructure:"esp-fat"`
+	EspClusterSize     string            `yaml:"esp-cluster-size,omitempty" mapstructure:"esp-cluster-size"`
+	EspLabel           string            `yaml:"esp-label,omitempty" mapstructure:"esp-label"`
+	InstallDevice      string            `yaml:"install-device,omitempty" mapstructure:"install-device"`
+	InstallReboot      bool              `yaml:"install-reboot,omitempty" mapstructure:"install-reboot"`
+	InstallConfig      string            `yaml:"install-config,omitempty" mapstructure:"install-config"`
+	FirmwareCapsules   []string          `yaml:"firmware-capsule,omitempty" mapstructure:"firmware-capsule"`
+	FirmwareReboot     bool              `yaml:"firmware-reboot,omitempty" mapstructure:"firmware-reboot"`
+	Microcode          string            `yaml:"microcode,omitempty" mapstructure:"microcode"`
+	LegacyOnly         bool              `yaml:"legacy-only,omitempty" mapstructure:"legacy-only"`
+	GrubStandalone     bool              `yaml:"grub-standalone,omitempty" mapstructure:"grub-standalone"`
+	GrubKeys           string            `yaml:"grub-keys,omitempty" mapstructure:"grub-keys"`
+	GrubSbat           string            `yaml:"grub-sbat,omitempty" mapstructure:"grub-sbat"`
 }
 
 // BuildConfig represents the config we need for building isos, raw images, artifacts
 type BuildConfig struct {
-	Date   bool   `yaml:"date,omitempty" mapstructure:"date"`
-	Name   string `yaml:"name,omitempty" mapstructure:"name"`
-	OutDir string `yaml:"output,omitempty" mapstructure:"output"`
+	Date bool `yaml:"date,omitempty" mapstructure:"date"`
+	// Name of the artifacts, derived from the release values of the image if empty
+	Name string `yaml:"name,omitempty" mapstructure:"name"`
+	// NameTemplate overrides the derived artifact names
+	NameTemplate string `yaml:"name-template,omitempty" mapstructure:"name-template"`
+	OutDir       string `yaml:"output,omitempty" mapstructure:"output"`
+	// JSONResult is the path where the machine readable result of the build is written
+	JSONResult string `yaml:"json-result,omitempty" mapstructure:"json-result"`
+	// BuildInfo is the provenance embedded into the artifacts, none is embedded if nil
+	BuildInfo *buildinfo.Info `yaml:"-" mapstructure:"-"`
+	// Workdirs is where the work area of each stage of the build lives
+	Workdirs workdir.Placement `yaml:"-" mapstructure:"-"`
+	// Limits tell how much of the machine the build can take
+	Limits limits.Limits `yaml:"-" mapstructure:"-"`
+	// Transcript records the external commands of the build, none are recorded if nil
+	Transcript *transcript.Recorder `yaml:"-" mapstructure:"-"`
+	// Outputs records the artifacts the build writes for the build history, none are recorded if nil
+	Outputs *history.Outputs `yaml:"-" mapstructure:"-"`
 
 	// 'inline' and 'squash' labels ensure config fields
 	// are embedded from a yaml and map PoV
@@ -45,6 +122,108 @@ func (i *LiveISO) Sanitize() error {
 			return fmt.Errorf("wrong name of source package for image")
 		}
 	}
+	if !slices.Contains(iso.Engines(), i.ISOEngine) {
+		return fmt.Errorf("invalid iso-engine %q, available engines: %s", i.ISOEngine, strings.Join(iso.Engines(), ", "))
+	}
+	if i.RelocateDeepDirs && !i.RockRidge {
+		return fmt.Errorf("iso-relocate-deep-dirs requires iso-rockridge")
+	}
+	for _, algorithm := range i.Checksums {
+		if _, err := utils.NewChecksumHash(algorithm); err != nil {
+			return err
+		}
+	}
+	if !slices.Contains(utils.ChecksumFormats(), i.ChecksumFormat) {
+		return fmt.Errorf("invalid checksum-format %q, available formats: %s", i.ChecksumFormat, strings.Join(utils.ChecksumFormats(), ", "))
+	}
+	if i.Encrypt != "" {
+		if !slices.Contains(encrypt.Methods(), i.Encrypt) {
+			return fmt.Errorf("invalid encryption method %q, available methods: %s", i.Encrypt, strings.Join(encrypt.Methods(), ", "))
+		}
+		if i.EncryptKey == "" {
+			return fmt.Errorf("encrypt requires an encrypt-key")
+		}
+		if err := secret.Check(i.EncryptKey); err != nil {
+			return err
+		}
+		// Every build encrypts differently, clients would always download everything
+		if i.Zsync {
+			return fmt.Errorf("zsync can't be used with encrypted artifacts")
+		}
+	}
+	if i.Upload != "" {
+		if _, err := upload.ParseTarget(i.Upload); err != nil {
+			return err
+		}
+	}
+	if _, err := utils.GetPruneRules(i.Prune); err != nil {
+		return err
+	}
+	if i.VulnScan != "" {
+		if _, err := vulnscan.New(i.VulnScan, nil); err != nil {
+			return err
+		}
+	}
+	if i.FailOnSeverity != "" {
+		if _, err := vulnscan.ParseSeverity(i.FailOnSeverity); err != nil {
+			return fmt.Errorf("invalid fail-on-severity: %w", err)
+		}
+		if i.VulnScan == "" {
+			return fmt.Errorf("fail-on-severity requires a vuln-scan scanner")
+		}
+	}
+	if i.MaxSize != "" {
+		if _, err := utils.ParseSize(i.MaxSize); err != nil {
+			return fmt.Errorf("invalid max-size: %w", err)
+		}
+	}
+	if _, err := utils.NewEspSizing(i.EspHeadroom, i.EspAlign, i.EspSize); err != nil {
+		return err
+	}
+	if err := iso.CheckVolumeID(i.Label); err != nil {
+		return err
+	}
+	if _, err := utils.NewFatOptions(i.EspFat, i.EspClusterSize, i.EspLabel); err != nil {
+		return err
+	}
+	if err := i.AutoInstall().Validate(vfs.OSFS); err != nil {
+		return err
+	}
+	if err := i.Firmware().Validate(vfs.OSFS); err != nil {
+		return err
+	}
+	if !slices.Contains(microcode.Modes(), i.Microcode) {
+		return fmt.Errorf("invalid microcode %q, available modes: %s", i.Microcode, strings.Join(microcode.Modes(), ", "))
+	}
+	if i.LegacyOnly && (i.GrubStandalone || i.EFIShell != "" || i.Memtest != "") {
+		return fmt.Errorf("legacy-only media don't boot in UEFI mode, grub-standalone, efi-shell and memtest can't be used with it")
+	}
+	if (i.GrubKeys != "" || i.GrubSbat != "") && !i.GrubStandalone {
+		return fmt.Errorf("grub-keys and grub-sbat require grub-standalone")
+	}
+	if i.GrubKeys != "" {
+		for _, file := range []string{"db.key", "db.pem"} {
+			if _, err := os.Stat(filepath.Join(i.GrubKeys, file)); err != nil {
+				return fmt.Errorf("grub-keys directory does not contain %s", file)
+			}
+		}
+	}
+	if i.GrubSbat != "" {
+		if _, err := secureboot.ReadSbatEntries(i.GrubSbat); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+// AutoInstall returns the options of the unattended install baked into the ISO
+func (i *LiveISO) AutoInstall() autoinstall.Options {
+	return autoinstall.Options{Device: i.InstallDevice, Reboot: i.InstallReboot, Config: i.InstallConfig}
+}
+
+// Firmware returns the firmware capsules baked into the ISO, applied on the first boot of the
+// installed system
+func (i *LiveISO) Firmware() firmware.Options {
+	return firmware.Options{Capsules: i.FirmwareCapsules, Reboot: i.FirmwareReboot}
+}
@@ -0,0 +1,114 @@
+// Package upload copies the built artifacts to object storage. It drives the official cloud
+// CLIs, so credentials come from their standard chains (environment, config files, instance
+// metadata, workload identity) and big artifacts get multipart or resumable uploads.
+package upload
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// SchemeS3 uploads to AWS S3, or any S3 compatible storage through the AWS CLI config
+	SchemeS3 = "s3"
+	// SchemeGCS uploads to Google Cloud Storage
+	SchemeGCS = "gs"
+	// SchemeAzure uploads to Azure Blob Storage, the URL host is the storage account
+	SchemeAzure = "az"
+)
+
+// Schemes returns the supported upload URL formats
+func Schemes() []string {
+	return []string{"s3://bucket/prefix", "gs://bucket/prefix", "az://account/container/prefix"}
+}
+
+// Artifact is a local file and its name under the target prefix
+type Artifact struct {
+	Path string
+	Name string
+}
+
+// Target is where the artifacts are uploaded to
+type Target struct {
+	Scheme string
+	// Account is the Azure storage account, unused by the other schemes
+	Account string
+	// Bucket is the bucket, or the Azure container
+	Bucket string
+	Prefix string
+}
+
+// ParseTarget parses an upload URL like s3://bucket/prefix
+func ParseTarget(uri string) (Target, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid upload URL %s: %w", uri, err)
+	}
+	t := Target{Scheme: u.Scheme, Bucket: u.Host, Prefix: strings.Trim(u.Path, "/")}
+	switch u.Scheme {
+	case SchemeS3, SchemeGCS:
+	case SchemeAzure:
+		t.Account = u.Host
+		t.Bucket, t.Prefix, _ = strings.Cut(t.Prefix, "/")
+	default:
+		return Target{}, fmt.Errorf("unsupported upload URL %s, expected one of: %s", uri, strings.Join(Schemes(), ", "))
+	}
+	if t.Bucket == "" {
+		return Target{}, fmt.Errorf("upload URL %s has no bucket", uri)
+	}
+	return t, nil
+}
+
+// Command returns the CLI needed to upload to the target
+func (t Target) Command() string {
+	switch t.Scheme {
+	case SchemeS3:
+		return "aws"
+	case SchemeGCS:
+		return "gcloud"
+	}
+	return "az"
+}
+
+// Key returns the object name of an artifact in the target
+func (t Target) Key(name string) string {
+	return path.Join(t.Prefix, name)
+}
+
+// URL returns the full URL of an artifact in the target
+func (t Target) URL(name string) string {
+	if t.Scheme == SchemeAzure {
+		return fmt.Sprintf("%s://%s/%s/%s", t.Scheme, t.Account, t.Bucket, t.Key(name))
+	}
+	return fmt.Sprintf("%s://%s/%s", t.Scheme, t.Bucket, t.Key(name))
+}
+
+// args returns the CLI arguments uploading a single artifact
+func (t Target) args(a Artifact) []string {
+	switch t.Scheme {
+	case SchemeS3:
+		return []string{"s3", "cp", "--only-show-errors", a.Path, t.URL(a.Name)}
+	case SchemeGCS:
+		return []string{"storage", "cp", a.Path, t.URL(a.Name)}
+	}
+	return []string{
+		"storage", "blob", "upload", "--only-show-errors", "--overwrite", "--auth-mode", "login",
+		"--account-name", t.Account, "--container-name", t.Bucket, "--name", t.Key(a.Name), "--file", a.Path,
+	}
+}
+
+// Upload copies each artifact to the target
+func Upload(runner v1.Runner, t Target, artifacts []Artifact) error {
+	for _, a := range artifacts {
+		runner.GetLogger().Infof("Uploading %s to %s", a.Path, t.URL(a.Name))
+		out, err := runner.Run(t.Command(), t.args(a)...)
+		if err != nil {
+			return fmt.Errorf("uploading %s to %s: %w\n%s", a.Path, t.URL(a.Name), err, string(out))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package upload_test
+
+import (
+	"github.com/kairos-io/enki/pkg/upload"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upload", Label("upload"), func() {
+	var runner *v1mock.FakeRunner
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		runner.SetLogger(v1.NewNullLogger())
+	})
+
+	Describe("ParseTarget", func() {
+		It("parses the supported URLs", func() {
+			Expect(upload.ParseTarget("s3://releases/kairos/v3/")).To(Equal(upload.Target{Scheme: "s3", Bucket: "releases", Prefix: "kairos/v3"}))
+			Expect(upload.ParseTarget("gs://releases")).To(Equal(upload.Target{Scheme: "gs", Bucket: "releases"}))
+			Expect(upload.ParseTarget("az://account/releases/kairos")).To(Equal(upload.Target{Scheme: "az", Account: "account", Bucket: "releases", Prefix: "kairos"}))
+		})
+		It("fails on unsupported URLs", func() {
+			for _, uri := range []string{"ftp://host/path", "/some/path", "s3:///prefix", "az://account"} {
+				_, err := upload.ParseTarget(uri)
+				Expect(err).Should(HaveOccurred(), uri)
+			}
+		})
+	})
+
+	It("uploads each artifact with the cloud CLI", func() {
+		artifacts := []upload.Artifact{
+			{Path: "/build/kairos.iso", Name: "kairos.iso"},
+			{Path: "/build/EFI/kairos/active.efi", Name: "EFI/kairos/active.efi"},
+		}
+		for _, uri := range []string{"s3://bucket/prefix", "gs://bucket/prefix", "az://account/container/prefix"} {
+			runner.ClearCmds()
+			target, err := upload.ParseTarget(uri)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(upload.Upload(runner, target, artifacts)).To(Succeed())
+			switch target.Scheme {
+			case upload.SchemeS3:
+				Expect(runner.CmdsMatch([][]string{
+					{"aws", "s3", "cp", "--only-show-errors", "/build/kairos.iso", "s3://bucket/prefix/kairos.iso"},
+					{"aws", "s3", "cp", "--only-show-errors", "/build/EFI/kairos/active.efi", "s3://bucket/prefix/EFI/kairos/active.efi"},
+				})).To(Succeed())
+			case upload.SchemeGCS:
+				Expect(runner.CmdsMatch([][]string{
+					{"gcloud", "storage", "cp", "/build/kairos.iso", "gs://bucket/prefix/kairos.iso"},
+					{"gcloud", "storage", "cp", "/build/EFI/kairos/active.efi", "gs://bucket/prefix/EFI/kairos/active.efi"},
+				})).To(Succeed())
+			case upload.SchemeAzure:
+				Expect(runner.CmdsMatch([][]string{
+					{"az", "storage", "blob", "upload", "--only-show-errors", "--overwrite", "--auth-mode", "login",
+						"--account-name", "account", "--container-name", "container", "--name", "prefix/kairos.iso", "--file", "/build/kairos.iso"},
+					{"az", "storage", "blob", "upload", "--only-show-errors", "--overwrite", "--auth-mode", "login",
+						"--account-name", "account", "--container-name", "container", "--name", "prefix/EFI/kairos/active.efi"},
+				})).To(Succeed())
+			}
+		}
+	})
+})
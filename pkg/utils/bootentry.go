@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/spf13/viper"
+)
+
+// BootEntry is a UKI to build along with its loader entry
+type BootEntry struct {
+	// FileName names the UKI and its loader entry, without extension
+	FileName string
+	// Cmdline is the whole kernel cmdline of the UKI
+	Cmdline string
+	// Title is the boot menu title
+	Title string
+	// Extra is what the entry adds to the base Kairos cmdline, empty for the default cmdline of
+	// the media-type. It is what include-cmdline-in-config stores in the loader entry.
+	Extra string
+	// Default is set for the entry booted by default, unless default-entry picks another one
+	Default bool
+	// Install is set for the entries booting the installer
+	Install bool
+	// overrides are the parameters of the cmdline overridden by a later part of it
+	overrides []string
+}
+
+// EfiName returns the file name of the UKI
+func (e BootEntry) EfiName() string {
+	return e.FileName + ".efi"
+}
+
+// ConfName returns the file name of the loader entry
+func (e BootEntry) ConfName() string {
+	return e.FileName + ".conf"
+}
+
+// entrySettings reads the build-uki settings the boot entries are made of from vp, so builds
+// running at the same time can use their own
+type entrySettings struct {
+	vp *viper.Viper
+}
+
+// newBootEntry returns the entry of the UKI booting the cmdline made of parts, deduplicated with
+// the later parts taking precedence. Without a name, it is named after what the parts add to the
+// default cmdline of the media-type.
+func (s entrySettings) newBootEntry(name, title string, parts ...string) BootEntry {
+	cmdline := strings.Join(parts, " ")
+	extra := s.cmdlineExtra(cmdline)
+	if name == "" {
+		name = entryName(constants.ArtifactBaseName, extra)
+	}
+	// A cmdline that can't be parsed is left as is for CheckCmdline to reject
+	canonical, overrides, err := CanonicalCmdline(parts...)
+	if err == nil {
+		cmdline = canonical
+	}
+	return BootEntry{
+		FileName:  name,
+		Cmdline:   cmdline,
+		Title:     title,
+		Extra:     extra,
+		Install:   slices.Contains(strings.Fields(cmdline), constants.UkiCmdlineInstall),
+		overrides: overrides,
+	}
+}
+
+// MediaCmdline returns what the given media type adds to the default cmdline, the live one
+// if empty
+func MediaCmdline(mediaType string) string {
+	return entrySettings{viper.GetViper()}.mediaCmdline(mediaType)
+}
+
+func (s entrySettings) mediaCmdline(mediaType string) string {
+	switch mediaType {
+	case constants.MediaInstaller:
+		return constants.UkiCmdlineInstall + " " + constants.UkiCmdlineAutoInstall
+	case constants.MediaRecovery:
+		if cmdline := s.vp.GetString("recovery-cmdline"); cmdline != "" {
+			return cmdline
+		}
+		return constants.UkiCmdlineRecovery
+	default:
+		return constants.UkiCmdlineInstall
+	}
+}
+
+// DefaultUkiCmdline returns the cmdline of the default entry for the media-type being built
+func DefaultUkiCmdline() string {
+	return entrySettings{viper.GetViper()}.defaultUkiCmdline()
+}
+
+func (s entrySettings) defaultUkiCmdline() string {
+	return strings.Join(s.defaultUkiParts(), " ")
+}
+
+// defaultUkiParts returns the base Kairos cmdline and what the media-type adds to it
+func (s entrySettings) defaultUkiParts() []string {
+	return []string{constants.UkiCmdline, s.mediaCmdline(s.vp.GetString("media-type"))}
+}
+
+// defaultUkiTitle returns the boot menu title of the default entry for the media-type being built
+func (s entrySettings) defaultUkiTitle() string {
+	if s.vp.GetString("media-type") == constants.MediaRecovery {
+		return fmt.Sprintf("%s recovery", s.vp.GetString("boot-branding"))
+	}
+	return s.vp.GetString("boot-branding")
+}
+
+// GetUkiBootEntries returns all the UKIs to build with the build-uki settings of vp: the norole
+// ones, the single-efi-cmdline ones and the recovery one, in that order. The first one is the
+// default entry.
+func GetUkiBootEntries(vp *viper.Viper, logger v1.Logger) []BootEntry {
+	s := entrySettings{vp}
+	entries := append(s.ukiCmdline(), s.ukiSingleCmdlines()...)
+	return append(entries, s.ukiRecoveryCmdline()...)
+}
+
+// CheckBootEntries fails if two entries have the same name, one would overwrite the other
+func CheckBootEntries(entries []BootEntry) error {
+	seen := map[string]BootEntry{}
+	for _, entry := range entries {
+		if other, ok := seen[entry.FileName]; ok {
+			return fmt.Errorf("the boot entries with cmdline %q and %q are both named %s", other.Cmdline, entry.Cmdline, entry.FileName)
+		}
+		seen[entry.FileName] = entry
+	}
+	return nil
+}
+
+// GetUkiCmdline returns the norole entries, booting the default cmdline.
+// The cmdline can be overridden by the user using the cmdline flag.
+// For each cmdline passed, we generate a uki file with that cmdline
+// extend-cmdline will just extend the default cmdline so we only create one efi file
+// extra-cmdline will create a new efi file for each cmdline passed
+func GetUkiCmdline() []BootEntry {
+	return entrySettings{viper.GetViper()}.ukiCmdline()
+}
+
+func (s entrySettings) ukiCmdline() []BootEntry {
+	defaultParts := s.defaultUkiParts()
+	title := s.defaultUkiTitle()
+
+	// Extend only
+	cmdlineExtend := s.vp.GetString("extend-cmdline")
+	if cmdlineExtend != "" {
+		entry := s.newBootEntry("", title, append(defaultParts, cmdlineExtend)...)
+		entry.Default = true
+		return []BootEntry{entry}
+	}
+
+	// default entry
+	entry := s.newBootEntry("", title, defaultParts...)
+	entry.Default = true
+	result := []BootEntry{entry}
+
+	// extra
+	for _, extra := range s.vp.GetStringSlice("extra-cmdline") {
+		result = append(result, s.newBootEntry("", title, append(defaultParts, extra)...))
+	}
+
+	return result
+}
+
+// GetUkiSingleCmdlines returns the single-efi-cmdline as passed by the user.
+func GetUkiSingleCmdlines(logger v1.Logger) []BootEntry {
+	return entrySettings{viper.GetViper()}.ukiSingleCmdlines()
+}
+
+func (s entrySettings) ukiSingleCmdlines() []BootEntry {
+	result := []BootEntry{}
+	// extra
+	defaultParts := s.defaultUkiParts()
+
+	cmdlines := s.vp.GetStringSlice("single-efi-cmdline")
+	for _, userValue := range cmdlines {
+		before, after, hasTitle := strings.Cut(userValue, ":")
+		if hasTitle {
+			title := fmt.Sprintf("%s (%s)", s.vp.GetString("boot-branding"), before)
+			result = append(result, s.newBootEntry(strings.ReplaceAll(before, " ", "_"), title, append(defaultParts, after)...))
+		} else {
+			result = append(result, s.newBootEntry(entryName("single_entry", s.cmdlineExtra(before)), s.vp.GetString("boot-branding"), append(defaultParts, before)...))
+		}
+	}
+
+	return result
+}
+
+// GetUkiRecoveryCmdline returns the entry of the recovery UKI, if requested. It boots the same
+// image as the other entries but with the recovery cmdline instead of the install one.
+func GetUkiRecoveryCmdline() []BootEntry {
+	return entrySettings{viper.GetViper()}.ukiRecoveryCmdline()
+}
+
+func (s entrySettings) ukiRecoveryCmdline() []BootEntry {
+	if !s.vp.GetBool("recovery") {
+		return []BootEntry{}
+	}
+	title := fmt.Sprintf("%s recovery", s.vp.GetString("boot-branding"))
+	return []BootEntry{s.newBootEntry(constants.RecoveryRole, title, constants.UkiCmdline, s.vp.GetString("recovery-cmdline"))}
+}
+
+// NameFromCmdline returns the name of the efi/conf file based on the cmdline
+// we want to have at least 1 efi file that its the default, that is the one we ship with the iso/media/whatever install medium
+// that one has the default cmdline + the install cmdline
+// For that one, we use it as the BASE one, configs will only trigger for that install stanza if we are on install media
+// so we dont have to worry about it, but we want to provide a clean name for it
+// so in that case we dont add anything to the efi name/conf name/cmdline inside the config
+// For the other ones, we add the cmdline to the efi name and the cmdline to the conf file
+// so you get
+// - norole.efi
+// - norole.conf
+// - norole_interactive-install.efi
+// - norole_interactive-install.conf
+// This is mostly for convenience in generating the names as the real data is stored in the config file
+// but it can easily be used to identify the efi file and the conf file.
+func NameFromCmdline(basename, cmdline string) string {
+	return entryName(basename, entrySettings{viper.GetViper()}.cmdlineExtra(cmdline))
+}
+
+// cmdlineExtra returns what cmdline adds to the base Kairos one, nothing for the default
+// cmdline of the media-type
+func (s entrySettings) cmdlineExtra(cmdline string) string {
+	extra := strings.TrimSpace(strings.TrimPrefix(cmdline, constants.UkiCmdline))
+	if extra == s.mediaCmdline(s.vp.GetString("media-type")) {
+		return ""
+	}
+	return extra
+}
+
+// entryName returns basename with the extra cmdline appended, spaces changed to underscores
+func entryName(basename, extra string) string {
+	// If the extra cmdline is empty, we remove the underscore as to not get a dangling one
+	return strings.TrimSuffix(basename+"_"+strings.ReplaceAll(extra, " ", "_"), "_")
+}
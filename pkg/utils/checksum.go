@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"lukechampine.com/blake3"
+)
+
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+	ChecksumBLAKE3 = "blake3"
+
+	// ChecksumFormatHex is the plain hex digest, as written by sha256sum and friends
+	ChecksumFormatHex = "hex"
+	// ChecksumFormatMultihash is the hex encoded multihash, which carries the algorithm
+	// along with the digest
+	ChecksumFormatMultihash = "multihash"
+)
+
+// multihashCodes are the multicodec table codes of the supported algorithms
+var multihashCodes = map[string]uint64{
+	ChecksumSHA256: 0x12,
+	ChecksumSHA512: 0x13,
+	ChecksumBLAKE3: 0x1e,
+}
+
+// ChecksumAlgorithms returns the supported checksum algorithms
+func ChecksumAlgorithms() []string {
+	return []string{ChecksumSHA256, ChecksumSHA512, ChecksumBLAKE3}
+}
+
+// ChecksumFormats returns the supported checksum output formats
+func ChecksumFormats() []string {
+	return []string{ChecksumFormatHex, ChecksumFormatMultihash}
+}
+
+// NewChecksumHash returns a hash of the given algorithm
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumSHA512:
+		return sha512.New(), nil
+	case ChecksumBLAKE3:
+		return blake3.New(32, nil), nil
+	}
+	return nil, fmt.Errorf("invalid checksum algorithm %q, available algorithms: %s", algorithm, strings.Join(ChecksumAlgorithms(), ", "))
+}
+
+// ChecksumWriter computes the checksums of everything written through it, so artifacts can be
+// hashed while they are written instead of reading them again afterwards
+type ChecksumWriter struct {
+	w      io.Writer
+	hashes map[string]hash.Hash
+}
+
+// NewChecksumWriter returns a writer forwarding to w, which may be nil, and hashing the data
+// with each of the algorithms
+func NewChecksumWriter(w io.Writer, algorithms ...string) (*ChecksumWriter, error) {
+	c := &ChecksumWriter{hashes: map[string]hash.Hash{}}
+	writers := []io.Writer{}
+	if w != nil {
+		writers = append(writers, w)
+	}
+	for _, algorithm := range algorithms {
+		if _, ok := c.hashes[algorithm]; ok {
+			continue
+		}
+		h, err := NewChecksumHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		c.hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+	c.w = io.MultiWriter(writers...)
+	return c, nil
+}
+
+func (c *ChecksumWriter) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Sum returns the checksum of the data written so far in the given format
+func (c *ChecksumWriter) Sum(algorithm, format string) (string, error) {
+	h, ok := c.hashes[algorithm]
+	if !ok {
+		return "", fmt.Errorf("checksum %s was not computed", algorithm)
+	}
+	digest := h.Sum(nil)
+	switch format {
+	case ChecksumFormatHex, "":
+		return hex.EncodeToString(digest), nil
+	case ChecksumFormatMultihash:
+		return hex.EncodeToString(Multihash(multihashCodes[algorithm], digest)), nil
+	}
+	return "", fmt.Errorf("invalid checksum format %q, available formats: %s", format, strings.Join(ChecksumFormats(), ", "))
+}
+
+// Multihash prefixes the digest with the varint encoded multicodec code and digest length
+func Multihash(code uint64, digest []byte) []byte {
+	mh := binary.AppendUvarint(nil, code)
+	mh = binary.AppendUvarint(mh, uint64(len(digest)))
+	return append(mh, digest...)
+}
+
+// CalcFileChecksums reads the given file once computing all the given checksums
+func CalcFileChecksums(fs v1.FS, fileName string, algorithms ...string) (*ChecksumWriter, error) {
+	c, err := NewChecksumWriter(nil, algorithms...)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(c, f); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CalcFileChecksum opens the given file and returns the sha256 checksum of it.
+func CalcFileChecksum(fs v1.FS, fileName string) (string, error) {
+	c, err := CalcFileChecksums(fs, fileName, ChecksumSHA256)
+	if err != nil {
+		return "", err
+	}
+	return c.Sum(ChecksumSHA256, ChecksumFormatHex)
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+)
+
+// cmdlineRepeatable are the parameters the kernel and dracut read every occurrence of
+var cmdlineRepeatable = []string{"console", "rd.driver.pre", "rd.driver.blacklist", "modprobe.blacklist"}
+
+// CmdlineParam is a parameter of a kernel cmdline, like key=value or a flag without a value
+type CmdlineParam struct {
+	Key   string
+	Value string
+	// HasValue tells key= apart from key
+	HasValue bool
+}
+
+func (p CmdlineParam) String() string {
+	if !p.HasValue {
+		return p.Key
+	}
+	if strings.Contains(p.Value, " ") {
+		return p.Key + `="` + p.Value + `"`
+	}
+	return p.Key + "=" + p.Value
+}
+
+// ParseCmdline splits cmdline into its parameters as the kernel does, on spaces outside double
+// quotes. It fails on characters that break the loader entries or the cmdline itself.
+func ParseCmdline(cmdline string) ([]CmdlineParam, error) {
+	for _, r := range cmdline {
+		if r < 0x20 || r == 0x7f {
+			return nil, fmt.Errorf("the cmdline %q has the control character %U, it can't be part of a loader entry", cmdline, r)
+		}
+	}
+	var params []CmdlineParam
+	var current strings.Builder
+	quoted := false
+	flush := func() {
+		if current.Len() == 0 {
+			return
+		}
+		key, value, hasValue := strings.Cut(current.String(), "=")
+		params = append(params, CmdlineParam{Key: key, Value: strings.Trim(value, `"`), HasValue: hasValue})
+		current.Reset()
+	}
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case r == ' ' && !quoted:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("the cmdline %q has an unterminated quote", cmdline)
+	}
+	flush()
+	return params, nil
+}
+
+// CanonicalCmdline joins the parts of a cmdline, as the base one and the ones added by the
+// media type and the flags, the later ones taking precedence. A parameter set again replaces its
+// earlier occurrences, unless the kernel reads every occurrence of it and they come from the same
+// part, like the consoles of the base cmdline. It returns the cmdline with single spaces and no
+// duplicates, along with the parameters overridden with another value.
+func CanonicalCmdline(parts ...string) (string, []string, error) {
+	type sourced struct {
+		CmdlineParam
+		part int
+	}
+	var params []sourced
+	var overridden []string
+	for i, part := range parts {
+		parsed, err := ParseCmdline(part)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, param := range parsed {
+			repeatable := slices.Contains(cmdlineRepeatable, param.Key)
+			var replaced []string
+			params = slices.DeleteFunc(params, func(prev sourced) bool {
+				if prev.Key != param.Key || (repeatable && prev.part == i && prev.CmdlineParam != param) {
+					return false
+				}
+				if prev.CmdlineParam != param {
+					replaced = append(replaced, prev.String())
+				}
+				return true
+			})
+			if len(replaced) > 0 {
+				overridden = append(overridden, fmt.Sprintf("%s overrides %s", param, strings.Join(replaced, " ")))
+			}
+			params = append(params, sourced{param, i})
+		}
+	}
+	result := make([]string, 0, len(params))
+	for _, param := range params {
+		result = append(result, param.String())
+	}
+	return strings.Join(result, " "), overridden, nil
+}
+
+// cmdlineEssentials returns the parameters the cmdline of entry needs to boot as intended on
+// the given media type
+func cmdlineEssentials(entry BootEntry, mediaType string) []string {
+	// immucore mounts the system from the UKI itself, there is no root= to look for
+	essentials := []string{"rd.immucore.uki"}
+	switch {
+	case entry.FileName == constants.RecoveryRole, entry.Default && mediaType == constants.MediaRecovery:
+		essentials = append(essentials, constants.UkiCmdlineRecovery)
+	case entry.Default && mediaType == constants.MediaInstaller:
+		essentials = append(essentials, constants.UkiCmdlineInstall, constants.UkiCmdlineAutoInstall)
+	case entry.Default:
+		essentials = append(essentials, constants.UkiCmdlineInstall)
+	}
+	return essentials
+}
+
+// CheckCmdline validates the cmdline of entry for the media type. It fails if the cmdline can't
+// be used at all, and returns warnings for the parameters its parts override, for duplicated
+// parameters, where only the last one is usually honored, and for missing parameters the media
+// type needs to boot as intended.
+func CheckCmdline(entry BootEntry, mediaType string) ([]string, error) {
+	params, err := ParseCmdline(entry.Cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("boot entry %s: %w", entry.FileName, err)
+	}
+	var warnings []string
+	for _, override := range entry.overrides {
+		warnings = append(warnings, fmt.Sprintf("boot entry %s: %s", entry.FileName, override))
+	}
+	seen := map[string]CmdlineParam{}
+	for _, param := range params {
+		if prev, ok := seen[param.Key]; ok && !slices.Contains(cmdlineRepeatable, param.Key) {
+			warnings = append(warnings, fmt.Sprintf("boot entry %s sets %s more than once: %s and %s", entry.FileName, param.Key, prev, param))
+		}
+		seen[param.Key] = param
+	}
+	for _, essential := range cmdlineEssentials(entry, mediaType) {
+		key, value, hasValue := strings.Cut(essential, "=")
+		if param, ok := seen[key]; !ok || (hasValue && param.Value != value) {
+			warnings = append(warnings, fmt.Sprintf("boot entry %s lacks %s, it may not boot as intended", entry.FileName, essential))
+		}
+	}
+	return warnings, nil
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,16 +17,94 @@ import (
 	container "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/logging"
+	"github.com/kairos-io/enki/pkg/mirror"
+	"github.com/kairos-io/enki/pkg/registry"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
-	"github.com/spf13/viper"
 )
 
-type BootEntry struct {
+// EfiTool is an optional EFI payload, like a UEFI shell or memtest86+, added as an extra boot entry
+type EfiTool struct {
+	// FileName is the name of the payload in the EFI tools dir
 	FileName string
-	Cmdline  string
-	Title    string
+	// Title is the title of its boot entry, it has none if empty
+	Title string
+	// Source is the path of the payload on the host
+	Source string
+	// Presigned is set for the payloads already signed, like by their vendor, which are shipped
+	// as they are instead of signed with the db key
+	Presigned bool
+}
+
+// GetEfiTools returns the EFI payloads for the given UEFI shell and memtest86+ binaries,
+// empty paths are skipped
+func GetEfiTools(shell, memtest, arch string) []EfiTool {
+	var tools []EfiTool
+	if shell != "" {
+		// systemd-boot and most firmware recognize the shell by these names
+		name := "shellx64.efi"
+		if IsArm64(arch) {
+			name = "shellaa64.efi"
+		}
+		tools = append(tools, EfiTool{FileName: name, Title: "UEFI Shell", Source: shell})
+	}
+	if memtest != "" {
+		tools = append(tools, EfiTool{FileName: "memtest86+.efi", Title: "Memtest86+", Source: memtest})
+	}
+	return tools
+}
+
+// ParseEfiBinary parses an extra EFI binary given as PATH[,title=TITLE][,sign=false], like
+// vendor diagnostics or KeyTool.efi. It gets a boot entry only with a title, and is signed with
+// the db key unless sign is false, for the binaries already signed by their vendor.
+func ParseEfiBinary(value string) (EfiTool, error) {
+	fields := strings.Split(value, ",")
+	tool := EfiTool{Source: strings.TrimSpace(fields[0])}
+	tool.FileName = filepath.Base(tool.Source)
+	if tool.Source == "" || !strings.EqualFold(filepath.Ext(tool.Source), ".efi") {
+		return EfiTool{}, fmt.Errorf("invalid EFI binary %q, expected the path of an .efi file as PATH[,title=TITLE][,sign=false]", value)
+	}
+	for _, field := range fields[1:] {
+		key, val, _ := strings.Cut(field, "=")
+		switch strings.TrimSpace(key) {
+		case "title":
+			tool.Title = strings.TrimSpace(val)
+		case "sign":
+			sign, err := strconv.ParseBool(strings.TrimSpace(val))
+			if err != nil {
+				return EfiTool{}, fmt.Errorf("invalid sign option of the EFI binary %s: %w", tool.Source, err)
+			}
+			tool.Presigned = !sign
+		default:
+			return EfiTool{}, fmt.Errorf("invalid option %q of the EFI binary %s, the options are title and sign", field, tool.Source)
+		}
+	}
+	return tool, nil
+}
+
+// ParseEfiBinaries parses the extra EFI binaries, see ParseEfiBinary, failing if any is named like
+// another one or like the given payloads
+func ParseEfiBinaries(values []string, payloads ...EfiTool) ([]EfiTool, error) {
+	names := map[string]bool{}
+	for _, payload := range payloads {
+		names[strings.ToLower(payload.FileName)] = true
+	}
+	var tools []EfiTool
+	for _, value := range values {
+		tool, err := ParseEfiBinary(value)
+		if err != nil {
+			return nil, err
+		}
+		if names[strings.ToLower(tool.FileName)] {
+			return nil, fmt.Errorf("the EFI binary %s is named like another EFI tool, rename it", tool.Source)
+		}
+		names[strings.ToLower(tool.FileName)] = true
+		tools = append(tools, tool)
+	}
+	return tools, nil
 }
 
 // CreateSquashFS creates a squash file at destination from a source, with options
@@ -41,7 +121,7 @@ func CreateSquashFS(runner v1.Runner, logger v1.Logger, source string, destinati
 	args = append(args, optionsExpanded...)
 	out, err := runner.Run("mksquashfs", args...)
 	if err != nil {
-		logger.Debugf("Error running squashfs creation, stdout: %s", out)
+		logging.Module(logger, logging.Squashfs).Debugf("Error running squashfs creation, stdout: %s", out)
 		logger.Errorf("Error while creating squashfs from %s to %s: %s", source, destination, err)
 		return err
 	}
@@ -59,71 +139,6 @@ func GolangArchToArch(arch string) (string, error) {
 	}
 }
 
-// GetUkiCmdline returns the cmdline to be used for the kernel.
-// The cmdline can be overridden by the user using the cmdline flag.
-// For each cmdline passed, we generate a uki file with that cmdline
-// extend-cmdline will just extend the default cmdline so we only create one efi file
-// extra-cmdline will create a new efi file for each cmdline passed
-func GetUkiCmdline() []BootEntry {
-	defaultCmdLine := constants.UkiCmdline + " " + constants.UkiCmdlineInstall
-
-	// Extend only
-	cmdlineExtend := viper.GetString("extend-cmdline")
-	if cmdlineExtend != "" {
-		cmdline := defaultCmdLine + " " + cmdlineExtend
-		return []BootEntry{{
-			Cmdline:  cmdline,
-			Title:    viper.GetString("boot-branding"),
-			FileName: NameFromCmdline(constants.ArtifactBaseName, cmdline),
-		}}
-	}
-
-	// default entry
-	result := []BootEntry{{
-		Cmdline:  defaultCmdLine,
-		Title:    viper.GetString("boot-branding"),
-		FileName: NameFromCmdline(constants.ArtifactBaseName, defaultCmdLine),
-	}}
-
-	// extra
-	for _, extra := range viper.GetStringSlice("extra-cmdline") {
-		cmdline := defaultCmdLine + " " + extra
-		result = append(result, BootEntry{
-			Cmdline:  cmdline,
-			Title:    viper.GetString("boot-branding"),
-			FileName: NameFromCmdline(constants.ArtifactBaseName, cmdline),
-		})
-	}
-
-	return result
-}
-
-// GetUkiSingleCmdlines returns the single-efi-cmdline as passed by the user.
-func GetUkiSingleCmdlines(logger v1.Logger) []BootEntry {
-	result := []BootEntry{}
-	// extra
-	defaultCmdLine := constants.UkiCmdline + " " + constants.UkiCmdlineInstall
-
-	cmdlines := viper.GetStringSlice("single-efi-cmdline")
-	for _, userValue := range cmdlines {
-		bootEntry := BootEntry{}
-
-		before, after, hasTitle := strings.Cut(userValue, ":")
-		if hasTitle {
-			bootEntry.Title = fmt.Sprintf("%s (%s)", viper.GetString("boot-branding"), before)
-			bootEntry.Cmdline = defaultCmdLine + " " + after
-			bootEntry.FileName = strings.ReplaceAll(before, " ", "_")
-		} else {
-			bootEntry.Title = viper.GetString("boot-branding")
-			bootEntry.Cmdline = defaultCmdLine + " " + before
-			bootEntry.FileName = NameFromCmdline("single_entry", before)
-		}
-		result = append(result, bootEntry)
-	}
-
-	return result
-}
-
 // Tar takes a source and variable writers and walks 'source' writing each file
 // found to the tar writer; the purpose for accepting multiple writers is to allow
 // for multiple outputs (for example a file, or md5 hash)
@@ -188,7 +203,7 @@ func Tar(src string, writers ...io.Writer) error {
 }
 
 // CreateTar a imagetarball from a standard tarball
-func CreateTar(log v1.Logger, srctar, dstimageTar, imagename, architecture, OS string) error {
+func CreateTar(log v1.Logger, srctar, dstimageTar, imagename, architecture, OS string, labels map[string]string) error {
 
 	dstFile, err := os.Create(dstimageTar)
 	if err != nil {
@@ -196,18 +211,7 @@ func CreateTar(log v1.Logger, srctar, dstimageTar, imagename, architecture, OS s
 	}
 	defer dstFile.Close()
 
-	newRef, img, err := imageFromTar(imagename, architecture, OS, func() (io.ReadCloser, error) {
-		f, err := os.Open(srctar)
-		if err != nil {
-			return nil, fmt.Errorf("cannot open %s: %s", srctar, err)
-		}
-		decompressed, err := containerdCompression.DecompressStream(f)
-		if err != nil {
-			return nil, fmt.Errorf("cannot open %s: %s", srctar, err)
-		}
-
-		return decompressed, nil
-	})
+	newRef, img, err := imageFromTar(imagename, architecture, OS, labels, tarOpener(srctar))
 	if err != nil {
 		return err
 	}
@@ -235,8 +239,82 @@ func CreateTar(log v1.Logger, srctar, dstimageTar, imagename, architecture, OS s
 
 }
 
-func imageFromTar(imagename, architecture, OS string, opener func() (io.ReadCloser, error)) (name.Reference, container.Image, error) {
-	newRef, err := name.ParseReference(imagename)
+// PushImage builds an image from a standard tarball like CreateTar does, and pushes it to the
+// registry of imagename. Credentials are read from the docker config, as docker login stores them.
+func PushImage(log v1.Logger, srctar, imagename, architecture, OS string, labels map[string]string) (string, error) {
+	newRef, img, err := imageFromTar(imagename, architecture, OS, labels, tarOpener(srctar))
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Pushing image %s", newRef.String())
+	if err = remote.Write(newRef, img, registry.Options()...); err != nil {
+		return "", fmt.Errorf("pushing %s: %w", newRef.String(), err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return newRef.Context().Digest(digest.String()).String(), nil
+}
+
+// ImagePlatforms returns the platforms of the image ref if it is a multi-arch manifest list,
+// or nothing for single platform images. Only the linux platforms Kairos can be built for
+// are returned, once per arch.
+func ImagePlatforms(ref string) ([]*v1.Platform, error) {
+	r, err := registry.ParseReference(mirror.Image(ref))
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(r, registry.Options()...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the manifest of %s: %w", ref, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		return nil, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var platforms []*v1.Platform
+	for _, m := range manifest.Manifests {
+		// Attestations and other artifacts have no platform or an unknown one
+		if m.Platform == nil || m.Platform.OS != "linux" {
+			continue
+		}
+		platform, err := v1.NewPlatform(m.Platform.OS, m.Platform.Architecture)
+		if err != nil {
+			continue
+		}
+		if !slices.ContainsFunc(platforms, func(p *v1.Platform) bool { return p.Arch == platform.Arch }) {
+			platforms = append(platforms, platform)
+		}
+	}
+	return platforms, nil
+}
+
+// tarOpener opens the possibly compressed srctar as the layer of an image
+func tarOpener(srctar string) tarball.Opener {
+	return func() (io.ReadCloser, error) {
+		f, err := os.Open(srctar)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s: %s", srctar, err)
+		}
+		decompressed, err := containerdCompression.DecompressStream(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s: %s", srctar, err)
+		}
+
+		return decompressed, nil
+	}
+}
+
+func imageFromTar(imagename, architecture, OS string, labels map[string]string, opener tarball.Opener) (name.Reference, container.Image, error) {
+	newRef, err := registry.ParseReference(imagename)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -254,6 +332,9 @@ func imageFromTar(imagename, architecture, OS string, opener func() (io.ReadClos
 
 	cfg.Architecture = architecture
 	cfg.OS = OS
+	if len(labels) > 0 {
+		cfg.Config.Labels = labels
+	}
 
 	baseImage, err = mutate.ConfigFile(baseImage, cfg)
 	if err != nil {
@@ -274,6 +355,18 @@ func imageFromTar(imagename, architecture, OS string, opener func() (io.ReadClos
 	return newRef, img, nil
 }
 
+// ArchToGolangArch returns the GOARCH name of arch, which container images use
+func ArchToGolangArch(arch string) (string, error) {
+	switch {
+	case IsAmd64(arch):
+		return constants.ArchAmd64, nil
+	case IsArm64(arch):
+		return constants.ArchArm64, nil
+	default:
+		return "", fmt.Errorf("invalid arch")
+	}
+}
+
 func IsAmd64(arch string) bool {
 	return arch == constants.ArchAmd64 || arch == constants.Archx86
 }
@@ -282,31 +375,58 @@ func IsArm64(arch string) bool {
 	return arch == constants.ArchArm64 || arch == constants.Archaarch64
 }
 
-// NameFromCmdline returns the name of the efi/conf file based on the cmdline
-// we want to have at least 1 efi file that its the default, that is the one we ship with the iso/media/whatever install medium
-// that one has the default cmdline + the install cmdline
-// For that one, we use it as the BASE one, configs will only trigger for that install stanza if we are on install media
-// so we dont have to worry about it, but we want to provide a clean name for it
-// so in that case we dont add anything to the efi name/conf name/cmdline inside the config
-// For the other ones, we add the cmdline to the efi name and the cmdline to the conf file
-// so you get
-// - norole.efi
-// - norole.conf
-// - norole_interactive-install.efi
-// - norole_interactive-install.conf
-// This is mostly for convenience in generating the names as the real data is stored in the config file
-// but it can easily be used to identify the efi file and the conf file.
-func NameFromCmdline(basename, cmdline string) string {
-	// Remove the default cmdline from the current cmdline
-	cmdlineForEfi := strings.TrimSpace(strings.TrimPrefix(cmdline, constants.UkiCmdline))
-	// For the default install entry, do not add anything on the efi name
-	if cmdlineForEfi == constants.UkiCmdlineInstall {
-		cmdlineForEfi = ""
-	}
-	// Change spaces to underscores
-	cleanCmdline := strings.ReplaceAll(cmdlineForEfi, " ", "_")
-	name := basename + "_" + cleanCmdline
-	// If the cmdline is empty, we remove the underscore as to not get a dangling one
-	finalName := strings.TrimSuffix(name, "_")
-	return finalName
+// ParseSize parses a human readable size like "700MiB", "4G" or "1048576" into bytes.
+// Both SI (KB, MB, GB) and binary (KiB, MiB, GiB) suffixes are understood, single letter
+// suffixes are treated as binary ones.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	idx := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	number, unit := s, ""
+	if idx >= 0 {
+		number, unit = s[:idx], strings.TrimSpace(s[idx:])
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", size, err)
+	}
+
+	multipliers := map[string]float64{
+		"":    1,
+		"B":   1,
+		"K":   1 << 10,
+		"KIB": 1 << 10,
+		"KB":  1e3,
+		"M":   1 << 20,
+		"MIB": 1 << 20,
+		"MB":  1e6,
+		"G":   1 << 30,
+		"GIB": 1 << 30,
+		"GB":  1e9,
+		"T":   1 << 40,
+		"TIB": 1 << 40,
+		"TB":  1e12,
+	}
+	m, ok := multipliers[strings.ToUpper(unit)]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q in %q", unit, size)
+	}
+	return int64(value * m), nil
+}
+
+// FormatSize returns a human readable representation of the given bytes using binary units
+func FormatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
 }
@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/pkg/xattr"
+	"golang.org/x/sync/errgroup"
+)
+
+// CopyOptions tunes how CopyTree copies a directory tree
+type CopyOptions struct {
+	// Include limits the copy to the entries matching any of these patterns, along with their
+	// contents and parent directories. Everything is copied if empty.
+	Include []string
+	// Exclude skips the entries matching any of these patterns, along with their contents
+	Exclude []string
+	// NoXattrs skips extended attributes. ACLs and file capabilities are stored as xattrs, so
+	// binaries like ping lose their capabilities without them.
+	NoXattrs bool
+	// Workers is the amount of files copied concurrently, the number of CPUs if 0
+	Workers int
+	// Progress receives the bytes copied so far. The total is the size of the whole source
+	// tree, so it is not reached if entries are filtered out.
+	Progress ProgressFunc
+}
+
+// inode identifies a file across the hardlinks pointing to it
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// treeCopier holds the state of a CopyTree run
+type treeCopier struct {
+	source string
+	target string
+	opts   CopyOptions
+	// links maps the inodes of hardlinked files to their first copy
+	links map[inode]string
+	// created are the relative directories already created in the target
+	created map[string]bool
+	// dirs are the copied directories, their times are set once their contents are written
+	dirs []string
+	// g runs the copies of file contents
+	g        *errgroup.Group
+	ctx      context.Context
+	progress *progressCounter
+}
+
+// CopyTree copies the source directory into target, preserving permissions, ownership, times,
+// extended attributes, hardlinks, symlinks and device nodes. Patterns are globs matched against
+// the path relative to source, or against the base name if they contain no slash, so
+// "*.pyc" skips every compiled python file while "/usr/share/doc" and "/tmp" only skip those
+// directories.
+// File contents are copied concurrently, as reflinks on the filesystems supporting them and with
+// copy_file_range on the others, so they copy in the kernel.
+func CopyTree(fs v1.FS, source, target string, opts CopyOptions) error {
+	src, err := fs.RawPath(source)
+	if err != nil {
+		return &os.PathError{Op: "copy", Path: source, Err: err}
+	}
+	dst, err := fs.RawPath(target)
+	if err != nil {
+		return &os.PathError{Op: "copy", Path: target, Err: err}
+	}
+	c := &treeCopier{
+		source:  filepath.Clean(src),
+		target:  filepath.Clean(dst),
+		opts:    opts,
+		links:   map[inode]string{},
+		created: map[string]bool{},
+	}
+	if opts.Progress != nil {
+		total, err := DirSize(fs, source)
+		if err != nil {
+			return err
+		}
+		c.progress = newProgressCounter(total, opts.Progress)
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	c.g, c.ctx = errgroup.WithContext(context.Background())
+	c.g.SetLimit(workers)
+	err = filepath.Walk(c.source, c.walk)
+	if waitErr := c.g.Wait(); waitErr != nil {
+		// A failed copy cancels the walk, report the copy error instead of the cancellation
+		err = waitErr
+	}
+	if err != nil {
+		return err
+	}
+	// Writing into a directory updates its mtime, so times are set children first
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		if err = c.setTimes(c.dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *treeCopier) walk(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if err = c.ctx.Err(); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(c.source, path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return c.copyDir(rel, info)
+	}
+	if matchAny(c.opts.Exclude, rel) {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if len(c.opts.Include) > 0 && !c.included(rel) {
+		// Directories are still walked, their contents may be included
+		return nil
+	}
+	if err = c.ensureParents(rel); err != nil {
+		return err
+	}
+	return c.copyEntry(rel, info)
+}
+
+// included returns true if rel or any of its parents matches the include patterns
+func (c *treeCopier) included(rel string) bool {
+	for p := rel; p != "."; p = filepath.Dir(p) {
+		if matchAny(c.opts.Include, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureParents creates the parent directories of rel not created yet, which only happens
+// when include patterns skipped them
+func (c *treeCopier) ensureParents(rel string) error {
+	var missing []string
+	for p := filepath.Dir(rel); p != "." && !c.created[p]; p = filepath.Dir(p) {
+		missing = append(missing, p)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(c.source, missing[i]))
+		if err != nil {
+			return err
+		}
+		if err = c.copyDir(missing[i], info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *treeCopier) copyEntry(rel string, info os.FileInfo) error {
+	src := filepath.Join(c.source, rel)
+	dst := filepath.Join(c.target, rel)
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		return c.copyDir(rel, info)
+	case mode.IsRegular():
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := c.links[key]; ok {
+				_ = os.Remove(dst)
+				return os.Link(first, dst)
+			}
+			c.links[key] = dst
+		}
+		// The file is created right away so later hardlinks to it can be made
+		out, err := createFile(dst, mode.Perm())
+		if err != nil {
+			return err
+		}
+		c.g.Go(func() error { return c.copyFile(rel, out, info) })
+		return nil
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(dst)
+		if err = os.Symlink(link, dst); err != nil {
+			return err
+		}
+	case mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe) != 0:
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("can't read the device numbers of %s", src)
+		}
+		_ = os.Remove(dst)
+		if err := syscall.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+			return &os.PathError{Op: "mknod", Path: dst, Err: err}
+		}
+	default:
+		// Sockets only make sense for the process listening on them
+		return nil
+	}
+	if err := c.copyMetadata(src, dst, info); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return c.setTimes(rel)
+}
+
+func (c *treeCopier) copyDir(rel string, info os.FileInfo) error {
+	dst := filepath.Join(c.target, rel)
+	if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := c.copyMetadata(filepath.Join(c.source, rel), dst, info); err != nil {
+		return err
+	}
+	c.created[rel] = true
+	c.dirs = append(c.dirs, rel)
+	return nil
+}
+
+// copyMetadata sets the ownership, permissions and extended attributes of src on dst
+func (c *treeCopier) copyMetadata(src, dst string, info os.FileInfo) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		// Only root can give files away, copying as a regular user keeps the files as their own
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, syscall.EPERM) {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		// Chown clears the setuid and setgid bits, and the umask may have masked others
+		if err := os.Chmod(dst, fileMode(info)); err != nil {
+			return err
+		}
+	}
+	if c.opts.NoXattrs {
+		return nil
+	}
+	// Chown drops file capabilities, so xattrs must come last
+	return copyXattrs(src, dst)
+}
+
+func (c *treeCopier) setTimes(rel string) error {
+	info, err := os.Lstat(filepath.Join(c.source, rel))
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(filepath.Join(c.target, rel), info.ModTime(), info.ModTime())
+}
+
+// fileMode returns the permissions of info including the setuid, setgid and sticky bits
+func fileMode(info os.FileInfo) os.FileMode {
+	return info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// copyFile writes the contents of rel into out, and then its metadata, as writing may clear
+// the setuid bits and changes the times
+func (c *treeCopier) copyFile(rel string, out *os.File, info os.FileInfo) error {
+	src := filepath.Join(c.source, rel)
+	err := copyContents(src, out, c.progress)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("copying %s: %w", src, err)
+	}
+	if err = c.copyMetadata(src, out.Name(), info); err != nil {
+		return err
+	}
+	return c.setTimes(rel)
+}
+
+// createFile creates an empty dst. Existing files are replaced instead of truncated, as they
+// could be hardlinks shared with other files.
+func createFile(dst string, perm os.FileMode) (*os.File, error) {
+	_ = os.Remove(dst)
+	return os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+}
+
+// copyContents copies src into out, with a reflink on the filesystems supporting them. Otherwise,
+// both being *os.File, io.Copy uses copy_file_range and only falls back to a read/write loop
+// when the kernel or the filesystems can't do it.
+func copyContents(src string, out *os.File, progress *progressCounter) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return cloneChunks(out, in, progress)
+}
+
+// copyXattrs copies the extended attributes of src to dst, without following symlinks. It's a
+// no-op on filesystems without xattrs support.
+func copyXattrs(src, dst string) error {
+	names, err := xattr.LList(src)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		value, err := xattr.LGet(src, name)
+		if err != nil {
+			return err
+		}
+		if err = xattr.LSet(dst, name, value); err != nil {
+			if errors.Is(err, syscall.ENOTSUP) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// matchAny returns true if the relative path matches any of the patterns. Patterns without a
+// slash, other than a trailing one, are matched against the base name.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		pattern = strings.TrimPrefix(pattern, "/")
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// fatSector is the smallest cluster mkfs.fat uses, the FAT tables are sized for it as it
+	// needs the most entries
+	fatSector = 512
+	// fatCluster is the cluster size files are rounded up to if it isn't known, the biggest
+	// mkfs.fat picks for the image sizes of an ESP
+	fatCluster = 4096
+	// fatReserved covers the boot sectors, FSInfo and their backups
+	fatReserved = 1 << 20
+)
+
+// EspSizing is the policy used to size the FAT images of the ESP
+type EspSizing struct {
+	// Headroom is the free space left in the image, as a percentage of its contents
+	Headroom int
+	// Align rounds the size of the image up to a multiple of it, in bytes
+	Align int64
+	// Size is a fixed size of the image in bytes, it is computed from the contents if 0
+	Size int64
+	// MinSize is the smallest size of the image, for filesystems that can't be smaller
+	MinSize int64
+	// MaxSize is the biggest size of the image, for filesystems that can't be bigger. There is
+	// no limit if 0.
+	MaxSize int64
+	// Cluster is the cluster size of the filesystem, files are rounded up to it
+	Cluster int64
+}
+
+// NewEspSizing parses the headroom, alignment and fixed size options of the ESP. Sizes are
+// human readable, like "4MiB". An empty align only aligns to sectors and an empty size is
+// computed from the contents.
+func NewEspSizing(headroom int, align, size string) (EspSizing, error) {
+	sizing := EspSizing{Headroom: headroom, Align: fatSector}
+	if headroom < 0 {
+		return sizing, fmt.Errorf("invalid esp-headroom %d, it can't be negative", headroom)
+	}
+	var err error
+	if align != "" {
+		sizing.Align, err = ParseSize(align)
+		if err != nil {
+			return sizing, fmt.Errorf("invalid esp-align: %w", err)
+		}
+		if sizing.Align <= 0 || sizing.Align%fatSector != 0 {
+			return sizing, fmt.Errorf("invalid esp-align %q, it must be a multiple of %d bytes", align, fatSector)
+		}
+	}
+	if size != "" {
+		sizing.Size, err = ParseSize(size)
+		if err != nil {
+			return sizing, fmt.Errorf("invalid esp-size: %w", err)
+		}
+		if sizing.Size <= 0 || sizing.Size%fatSector != 0 {
+			return sizing, fmt.Errorf("invalid esp-size %q, it must be a multiple of %d bytes", size, fatSector)
+		}
+	}
+	return sizing, nil
+}
+
+// EspSize returns the size of a FAT image holding dirs directories and files of the given
+// sizes. Files take whole clusters and the image has room for the FAT tables, then the
+// headroom is added and the size aligned. With a fixed size it fails only if the contents
+// can't fit in it.
+func EspSize(sizing EspSizing, dirs int, files ...int64) (int64, error) {
+	cluster := sizing.Cluster
+	if cluster <= 0 {
+		cluster = fatCluster
+	}
+	// The root dir is part of the reserved space, any other takes a cluster for its entries
+	used := int64(dirs) * cluster
+	for _, size := range files {
+		used += roundUp(size, cluster)
+	}
+	// Two FAT32 tables with an entry for every sector of the image
+	required := used + 2*4*roundUp(used, fatSector)/fatSector + fatReserved
+
+	if sizing.Size > 0 {
+		if required > sizing.Size {
+			return 0, failure.Errorf(failure.ErrSizeBudget, "raise --esp-size, or leave it unset to size the ESP from its contents",
+				"the ESP contents need %s but esp-size is %s", FormatSize(required), FormatSize(sizing.Size))
+		}
+		if sizing.Size < sizing.MinSize {
+			return 0, failure.Errorf(failure.ErrSizeBudget, "raise --esp-size, or use another FAT variant with --esp-fat",
+				"esp-size is %s but the filesystem can't be smaller than %s", FormatSize(sizing.Size), FormatSize(sizing.MinSize))
+		}
+		if sizing.MaxSize > 0 && sizing.Size > sizing.MaxSize {
+			return 0, failure.Errorf(failure.ErrSizeBudget, "lower --esp-size, or use FAT32 with --esp-fat",
+				"esp-size is %s but the filesystem can't be bigger than %s", FormatSize(sizing.Size), FormatSize(sizing.MaxSize))
+		}
+		return sizing.Size, nil
+	}
+
+	size := required + used*int64(sizing.Headroom)/100
+	if size < sizing.MinSize {
+		size = sizing.MinSize
+	}
+	if sizing.Align <= 0 {
+		sizing.Align = fatSector
+	}
+	size = roundUp(size, sizing.Align)
+	if sizing.MaxSize > 0 && size > sizing.MaxSize {
+		if required > sizing.MaxSize {
+			return 0, failure.Errorf(failure.ErrSizeBudget, "use FAT32 with --esp-fat, or a bigger --esp-cluster-size",
+				"the ESP contents need %s but the filesystem can't be bigger than %s", FormatSize(required), FormatSize(sizing.MaxSize))
+		}
+		// The contents fit, just without all the headroom
+		size = sizing.MaxSize / fatSector * fatSector
+	}
+	return size, nil
+}
+
+// DirEspSize is EspSize for the contents of dir
+func DirEspSize(fs v1.FS, dir string, sizing EspSizing) (int64, error) {
+	root, err := fs.RawPath(dir)
+	if err != nil {
+		return 0, err
+	}
+	dirs := 0
+	var files []int64
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case path == root:
+		case info.IsDir():
+			dirs++
+		case info.Mode().IsRegular():
+			files = append(files, info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return EspSize(sizing, dirs, files...)
+}
+
+func roundUp(size, align int64) int64 {
+	return (size + align - 1) / align * align
+}
+
+// xbootldrDirs are the ESP dirs holding the boot entries and what they boot, which the Boot
+// Loader Specification lets live in an XBOOTLDR partition instead
+var xbootldrDirs = []string{"EFI/kairos", constants.EfiToolsDir, "loader/entries"}
+
+// SplitXbootldr splits the files of the ESP, keyed by their target dir, into the ones that
+// stay in the ESP and the ones that go to the XBOOTLDR partition. systemd-boot, its config and
+// the Secure Boot keys stay in the ESP, the UKIs and their loader entries move, so the ESP
+// can be as small as the ones of some vendors.
+func SplitXbootldr(files map[string][]string) (esp, xbootldr map[string][]string) {
+	esp, xbootldr = map[string][]string{}, map[string][]string{}
+	for dir, sources := range files {
+		if slices.Contains(xbootldrDirs, dir) {
+			xbootldr[dir] = sources
+		} else {
+			esp[dir] = sources
+		}
+	}
+	return esp, xbootldr
+}
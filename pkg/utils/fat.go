@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// FatAuto lets mkfs.fat pick the FAT variant from the size of the image
+	FatAuto = "auto"
+
+	// fatLabelLen is the max length of a FAT volume label
+	fatLabelLen = 11
+	// fatMaxCluster is the biggest cluster mkfs.fat creates with 512 bytes sectors
+	fatMaxCluster = 64 * 1024
+)
+
+// fatClusters are the min and max amount of clusters of each FAT variant
+var fatClusters = map[int][2]int64{
+	12: {1, 4084},
+	16: {4085, 65524},
+	32: {65525, 0x0FFFFFF5},
+}
+
+// FatVariants returns the FAT variants the ESP can be formatted with
+func FatVariants() []string {
+	return []string{FatAuto, "12", "16", "32"}
+}
+
+// FatOptions are the filesystem parameters of the FAT images of the ESP
+type FatOptions struct {
+	// Bits is 12, 16 or 32, mkfs.fat picks it from the size of the image if 0
+	Bits int
+	// ClusterSize in bytes, mkfs.fat picks it from the size of the image if 0
+	ClusterSize int64
+	// Label is the volume label, none if empty
+	Label string
+}
+
+// NewFatOptions parses the FAT variant, cluster size and volume label options of the ESP. The
+// variant is one of FatVariants and the cluster size is human readable, like "4KiB", or empty
+// to let mkfs.fat pick them.
+func NewFatOptions(variant, clusterSize, label string) (FatOptions, error) {
+	opts := FatOptions{Label: label}
+	if variant != "" && variant != FatAuto {
+		bits, err := strconv.Atoi(variant)
+		if _, ok := fatClusters[bits]; err != nil || !ok {
+			return opts, fmt.Errorf("invalid esp-fat %q, available variants: %s", variant, strings.Join(FatVariants(), ", "))
+		}
+		opts.Bits = bits
+	}
+	if clusterSize != "" {
+		size, err := ParseSize(clusterSize)
+		if err != nil {
+			return opts, fmt.Errorf("invalid esp-cluster-size: %w", err)
+		}
+		// mkfs.fat takes the cluster size as a power of two amount of sectors
+		if size < fatSector || size > fatMaxCluster || size&(size-1) != 0 {
+			return opts, fmt.Errorf("invalid esp-cluster-size %q, it must be a power of two between %s and %s", clusterSize, FormatSize(fatSector), FormatSize(fatMaxCluster))
+		}
+		opts.ClusterSize = size
+	}
+	if len(label) > fatLabelLen {
+		return opts, fmt.Errorf("invalid esp-label %q, it can't be longer than %d characters", label, fatLabelLen)
+	}
+	return opts, nil
+}
+
+// MkfsArgs returns the mkfs.fat arguments creating the filesystem, without the image
+func (o FatOptions) MkfsArgs() []string {
+	var args []string
+	if o.Bits != 0 {
+		args = append(args, "-F", strconv.Itoa(o.Bits))
+	}
+	if o.ClusterSize != 0 {
+		args = append(args, "-s", strconv.FormatInt(o.ClusterSize/fatSector, 10))
+	}
+	if o.Label != "" {
+		args = append(args, "-n", o.Label)
+	}
+	return args
+}
+
+// ApplyTo sets the cluster size and the size limits of the FAT variant on sizing
+func (o FatOptions) ApplyTo(sizing *EspSizing) {
+	if o.ClusterSize != 0 {
+		sizing.Cluster = o.ClusterSize
+	}
+	limits, ok := fatClusters[o.Bits]
+	if !ok {
+		return
+	}
+	// Unless given, assume the smallest clusters for the min size, the biggest image is unknown
+	cluster := o.ClusterSize
+	if cluster == 0 {
+		cluster = fatSector
+	}
+	if minSize := limits[0]*cluster + 2*4*limits[0] + fatReserved; minSize > sizing.MinSize {
+		sizing.MinSize = minSize
+	}
+	if o.ClusterSize != 0 {
+		sizing.MaxSize = limits[1] * o.ClusterSize
+	}
+}
+
+// CreateFatImage creates the img file of the given size in bytes and formats it as FAT
+func CreateFatImage(fs v1.FS, runner v1.Runner, img string, size int64, opts FatOptions) error {
+	if err := MkdirAll(fs, filepath.Dir(img), constants.DirPerm); err != nil {
+		return err
+	}
+	f, err := fs.Create(img)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		var out []byte
+		out, err = runner.Run("mkfs.vfat", append(opts.MkfsArgs(), img)...)
+		if err != nil {
+			err = fmt.Errorf("formatting %s: %w\n%s", img, err, out)
+		}
+	}
+	if err != nil {
+		_ = fs.RemoveAll(img)
+	}
+	return err
+}
@@ -1,20 +1,26 @@
 package utils
 
 import (
-	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/twpayne/go-vfs"
 	"github.com/twpayne/go-vfs/vfst"
+	"golang.org/x/sync/errgroup"
 )
 
 // MkdirAll directory and all parents if not existing
@@ -123,8 +129,27 @@ func nextRandom() string {
 
 // CopyFile Copies source file to target file using Fs interface. If target
 // is  directory source is copied into that directory using source name file.
+// Extended attributes of source are kept, use CopyTree for whole directories.
+// The copy is a reflink on the filesystems supporting them.
 func CopyFile(fs v1.FS, source string, target string) (err error) {
-	return ConcatFiles(fs, []string{source}, target)
+	return CopyFileWithProgress(fs, source, target, nil)
+}
+
+// Stdout is the output path streaming the single artifact of a build to stdout, for piping it
+// into ssh, curl or an object store CLI
+const Stdout = "-"
+
+// StreamFile writes the contents of the file at path into w
+func StreamFile(fs v1.FS, path string, w io.Writer) error {
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(w, f); err != nil {
+		return fmt.Errorf("streaming %s: %w", filepath.Base(path), err)
+	}
+	return nil
 }
 
 // IsDir check if the path is a dir
@@ -179,19 +204,45 @@ func ConcatFiles(fs v1.FS, sources []string, target string) (err error) {
 	return err
 }
 
-// DirSize returns the accumulated size of all files in folder
+// DirSize returns the accumulated size of all files in folder. Subdirectories are walked
+// concurrently, which pays off on big trees stored on fast disks.
 func DirSize(fs v1.FS, path string) (int64, error) {
-	var size int64
-	err := vfs.Walk(fs, path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	info, err := fs.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	var size atomic.Int64
+	g := &errgroup.Group{}
+	g.SetLimit(runtime.NumCPU())
+	g.Go(func() error { return dirSize(fs, g, path, &size) })
+	err = g.Wait()
+	return size.Load(), err
+}
+
+// dirSize adds the size of the files in dir to size. Subdirectories are walked in a new
+// goroutine when the group has room for it, or inline otherwise.
+func dirSize(fs v1.FS, g *errgroup.Group, dir string, size *atomic.Int64) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			size.Add(entry.Size())
+			continue
 		}
-		if !info.IsDir() {
-			size += info.Size()
+		sub := filepath.Join(dir, entry.Name())
+		if g.TryGo(func() error { return dirSize(fs, g, sub, size) }) {
+			continue
 		}
-		return err
-	})
-	return size, err
+		if err = dirSize(fs, g, sub, size); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Check if a file or directory exists.
@@ -206,18 +257,90 @@ func Exists(fs v1.FS, path string) (bool, error) {
 	return false, err
 }
 
-// CalcFileChecksum opens the given file and returns the sha256 checksum of it.
-func CalcFileChecksum(fs v1.FS, fileName string) (string, error) {
-	f, err := fs.Open(fileName)
+// DirUsage is the accumulated size of a directory
+type DirUsage struct {
+	Path string
+	Size int64
+}
+
+// LargestDirs returns the n largest directories under root, looking at most depth levels deep.
+// Sizes are accumulated, so a directory always accounts for all of its descendants. Paths are
+// returned relative to root.
+func LargestDirs(fs v1.FS, root string, depth, n int) ([]DirUsage, error) {
+	sizes := map[string]int64{}
+	err := vfs.Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+		for i := 1; i <= len(parts) && i <= depth; i++ {
+			if parts[0] == "." {
+				break
+			}
+			sizes[filepath.Join(parts[:i]...)] += info.Size()
+		}
+		return nil
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer f.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+	var usage []DirUsage
+	for path, size := range sizes {
+		usage = append(usage, DirUsage{Path: path, Size: size})
 	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Size == usage[j].Size {
+			return usage[i].Path < usage[j].Path
+		}
+		return usage[i].Size > usage[j].Size
+	})
+	if len(usage) > n {
+		usage = usage[:n]
+	}
+	return usage, nil
+}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+// CheckArtifactSize returns an error if the size of artifact exceeds maxSize. The error carries
+// a breakdown of the largest directories in rootfs, if given, to help find what to trim.
+func CheckArtifactSize(fs v1.FS, artifact string, maxSize int64, rootfs string) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	fi, err := fs.Stat(artifact)
+	if err != nil {
+		return err
+	}
+	if fi.Size() <= maxSize {
+		return nil
+	}
+	return SizeBudgetError(fs, filepath.Base(artifact), fi.Size(), maxSize, rootfs)
+}
+
+// SizeBudgetError builds the error reported when an artifact, or its estimation, doesn't
+// fit in the given budget
+func SizeBudgetError(fs v1.FS, name string, size, maxSize int64, rootfs string) error {
+	msg := fmt.Sprintf("%s is %s which exceeds the max size of %s", name, FormatSize(size), FormatSize(maxSize))
+	hint := "trim the rootfs, for example with --prune, or raise --max-size"
+	if rootfs == "" {
+		return failure.New(failure.ErrSizeBudget, errors.New(msg), hint)
+	}
+	dirs, err := LargestDirs(fs, rootfs, 2, 10)
+	if err != nil || len(dirs) == 0 {
+		return failure.New(failure.ErrSizeBudget, errors.New(msg), hint)
+	}
+	var sb strings.Builder
+	sb.WriteString(msg)
+	sb.WriteString("\nLargest directories in the rootfs:")
+	for _, d := range dirs {
+		sb.WriteString(fmt.Sprintf("\n  %10s  /%s", FormatSize(d.Size), d.Path))
+	}
+	return failure.New(failure.ErrSizeBudget, errors.New(sb.String()), hint)
 }
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// kernelPrefixes are the names of the kernels in /boot, the ones elemental looks for
+var kernelPrefixes = []string{"vmlinuz", "Image", "zImage", "uImage", "image"}
+
+// KernelVersions returns the sorted versions of the kernels of the rootfs at rootDir, the ones
+// installed as /boot/vmlinuz-VERSION or /usr/lib/modules/VERSION/vmlinuz
+func KernelVersions(fs v1.FS, rootDir string) ([]string, error) {
+	found := map[string]bool{}
+	boot, err := fs.ReadDir(filepath.Join(rootDir, "boot"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range boot {
+		for _, prefix := range kernelPrefixes {
+			if version, ok := strings.CutPrefix(entry.Name(), prefix+"-"); ok && version != "" {
+				found[version] = true
+			}
+		}
+	}
+	modules, err := fs.ReadDir(filepath.Join(rootDir, "usr", "lib", "modules"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range modules {
+		if ok, _ := Exists(fs, filepath.Join(rootDir, "usr", "lib", "modules", entry.Name(), "vmlinuz")); ok {
+			found[entry.Name()] = true
+		}
+	}
+	versions := make([]string, 0, len(found))
+	for version := range found {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// FindVersionedKernelInitrd returns the kernel and the initrd of the given version in the rootfs
+// at rootDir. The initrd is looked up under the names of the distros, like initrd-VERSION of
+// openSUSE, initramfs-VERSION.img of Fedora or initrd.img-VERSION of Debian.
+func FindVersionedKernelInitrd(fs v1.FS, rootDir, version string) (kernel, initrd string, err error) {
+	var kernels []string
+	for _, prefix := range kernelPrefixes {
+		kernels = append(kernels, filepath.Join("boot", prefix+"-"+version))
+	}
+	kernels = append(kernels, filepath.Join("usr", "lib", "modules", version, "vmlinuz"))
+	initrds := []string{
+		filepath.Join("boot", "initrd-"+version),
+		filepath.Join("boot", "initramfs-"+version+".img"),
+		filepath.Join("boot", "initrd.img-"+version),
+		filepath.Join("usr", "lib", "modules", version, "initrd"),
+	}
+
+	if kernel = firstExisting(fs, rootDir, kernels); kernel == "" {
+		versions, err := KernelVersions(fs, rootDir)
+		if err != nil {
+			return "", "", err
+		}
+		if len(versions) == 0 {
+			return "", "", fmt.Errorf("no kernel %s found, the rootfs has no versioned kernels", version)
+		}
+		return "", "", fmt.Errorf("no kernel %s found, the rootfs has %s", version, strings.Join(versions, ", "))
+	}
+	if initrd = firstExisting(fs, rootDir, initrds); initrd == "" {
+		return "", "", fmt.Errorf("no initrd found for kernel %s", version)
+	}
+	return kernel, initrd, nil
+}
+
+// firstExisting returns the first of the paths relative to rootDir that exists, empty if none
+func firstExisting(fs v1.FS, rootDir string, paths []string) string {
+	for _, p := range paths {
+		p = filepath.Join(rootDir, p)
+		if ok, _ := Exists(fs, p); ok {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// progressChunk is how much is copied between progress reports. Copying in chunks instead of
+// wrapping the reader keeps the copy_file_range fast path of io.Copy.
+const progressChunk = 64 * 1024 * 1024
+
+// ProgressFunc is called as a long running operation advances with the work done so far and
+// the total work, in bytes or percent depending on the operation. Calls are never concurrent.
+type ProgressFunc func(done, total int64)
+
+// progressCounter accumulates the work done by concurrent workers and reports it
+type progressCounter struct {
+	mu    sync.Mutex
+	done  int64
+	total int64
+	fn    ProgressFunc
+}
+
+func newProgressCounter(total int64, fn ProgressFunc) *progressCounter {
+	return &progressCounter{total: total, fn: fn}
+}
+
+// add reports n more units of work done, it is a no-op for nil counters
+func (p *progressCounter) add(n int64) {
+	if p == nil || p.fn == nil || n == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	p.fn(p.done, p.total)
+}
+
+// progressWriter reports the bytes written through it
+type progressWriter struct {
+	w        io.Writer
+	progress *progressCounter
+}
+
+// NewProgressWriter returns a writer forwarding to w and reporting the bytes written to fn
+func NewProgressWriter(w io.Writer, total int64, fn ProgressFunc) io.Writer {
+	if fn == nil {
+		return w
+	}
+	return &progressWriter{w: w, progress: newProgressCounter(total, fn)}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.progress.add(int64(n))
+	return n, err
+}
+
+// LogProgress returns a ProgressFunc logging the progress of the named operation every 10%
+func LogProgress(logger v1.Logger, name string) ProgressFunc {
+	last := int64(-1)
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		step := done * 10 / total
+		if step == last {
+			return
+		}
+		last = step
+		logger.Infof("%s: %d%%", name, step*10)
+	}
+}
+
+// CopyFileWithProgress is CopyFile reporting the copied bytes to progress
+func CopyFileWithProgress(fs v1.FS, source string, target string, progress ProgressFunc) (err error) {
+	if dir, _ := IsDir(fs, target); dir {
+		target = filepath.Join(target, filepath.Base(source))
+	}
+	sourceFile, err := fs.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+	targetFile, err := fs.Create(target)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			err = targetFile.Close()
+		} else {
+			_ = targetFile.Close()
+			_ = fs.Remove(target)
+		}
+	}()
+
+	if err = cloneChunks(targetFile, sourceFile, newProgressCounter(info.Size(), progress)); err != nil {
+		return err
+	}
+	src, err := fs.RawPath(source)
+	if err != nil {
+		return err
+	}
+	dst, err := fs.RawPath(target)
+	if err != nil {
+		return err
+	}
+	return copyXattrs(src, dst)
+}
+
+// copyChunks copies in into out reporting to progress after every chunk
+func copyChunks(out *os.File, in *os.File, progress *progressCounter) error {
+	if progress == nil || progress.fn == nil {
+		_, err := io.Copy(out, in)
+		return err
+	}
+	for {
+		n, err := io.CopyN(out, in, progressChunk)
+		progress.add(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// squashfsPercentage matches the percentage at the end of the mksquashfs progress bar, or the
+// bare numbers printed with -percentage
+var squashfsPercentage = regexp.MustCompile(`^\s*(\d{1,3})\s*$|\s(\d{1,3})%\s*$`)
+
+// CreateSquashFSWithProgress is CreateSquashFS reporting the percentage done to progress. It
+// requires squashfs-tools 4.6 or newer for the -percentage option.
+func CreateSquashFSWithProgress(runner v1.Runner, logger v1.Logger, source string, destination string, options []string, progress ProgressFunc) error {
+	if progress == nil {
+		return CreateSquashFS(runner, logger, source, destination, options)
+	}
+	args := []string{source, destination}
+	for _, op := range options {
+		args = append(args, strings.Split(op, " ")...)
+	}
+	args = append(args, "-percentage")
+
+	cmd := runner.InitCmd("mksquashfs", args...)
+	if cmd == nil {
+		// Runners without real commands, like the test ones, can't report progress
+		_, err := runner.RunCmd(nil)
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	// The progress bar is redrawn with carriage returns rather than new lines
+	scanner.Split(scanProgressLines)
+	last := int64(-1)
+	for scanner.Scan() {
+		m := squashfsPercentage.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		pct, err := strconv.ParseInt(m[1]+m[2], 10, 64)
+		if err != nil || pct > 100 || pct <= last {
+			continue
+		}
+		last = pct
+		progress(pct, 100)
+	}
+	// Keep mksquashfs from blocking on a full pipe if scanning stopped early
+	_, _ = io.Copy(io.Discard, stdout)
+	if err = cmd.Wait(); err != nil {
+		logger.Errorf("Error while creating squashfs from %s to %s: %s", source, destination, err)
+		return fmt.Errorf("mksquashfs failed: %w\n%s", err, stderr.String())
+	}
+	return nil
+}
+
+// scanProgressLines is bufio.ScanLines also splitting on carriage returns
+func scanProgressLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
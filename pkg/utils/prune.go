@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+)
+
+// PruneRule describes a set of paths in the rootfs that can be removed to shrink the artifacts.
+// Patterns are globs relative to the rootfs root, a path is pruned when it or any of its parent
+// directories match one of the Patterns and none of the Keep patterns match the path itself.
+type PruneRule struct {
+	Name     string
+	Patterns []string
+	Keep     []string
+}
+
+// PruneResult is the outcome of applying a PruneRule
+type PruneResult struct {
+	Rule  string
+	Files int
+	Size  int64
+}
+
+var pruneProfiles = map[string]PruneRule{
+	"docs": {
+		Name:     "docs",
+		Patterns: []string{"usr/share/doc/*", "usr/share/man", "usr/share/info", "usr/share/gtk-doc", "usr/local/share/man"},
+		// Keep the license texts around, those are required for compliance
+		Keep: []string{"usr/share/doc/*/copyright", "usr/share/doc/*/LICENSE*", "usr/share/doc/*/COPYING*"},
+	},
+	"locales": {
+		Name:     "locales",
+		Patterns: []string{"usr/share/locale/*", "usr/share/i18n/locales/*"},
+		Keep:     []string{"usr/share/locale/locale.alias", "usr/share/locale/en*", "usr/share/i18n/locales/en_*", "usr/share/i18n/locales/C", "usr/share/i18n/locales/POSIX", "usr/share/i18n/locales/i18n*", "usr/share/i18n/locales/iso14651_t1*", "usr/share/i18n/locales/translit_*"},
+	},
+	"cache": {
+		Name: "cache",
+		Patterns: []string{
+			"var/cache/apt/*", "var/lib/apt/lists/*",
+			"var/cache/dnf/*", "var/cache/yum/*", "var/cache/zypp/*", "var/cache/apk/*",
+			"var/cache/man/*", "root/.cache/*",
+		},
+		Keep: []string{"var/lib/apt/lists/lock", "var/lib/apt/lists/partial"},
+	},
+	"logs": {
+		Name:     "logs",
+		Patterns: []string{"var/log/*"},
+	},
+}
+
+// PruneProfiles returns the names of the available prune profiles
+func PruneProfiles() []string {
+	var names []string
+	for name := range pruneProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetPruneRules returns the rules for the given profile names
+func GetPruneRules(profiles []string) ([]PruneRule, error) {
+	var rules []PruneRule
+	for _, p := range profiles {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		rule, ok := pruneProfiles[p]
+		if !ok {
+			return nil, fmt.Errorf("unknown prune profile %q, available profiles: %s", p, strings.Join(PruneProfiles(), ", "))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// PruneRootfs removes the files matching the given rules from rootfs. With dryRun set nothing
+// is removed and the results just report how much space would be reclaimed. The rootfs is walked
+// once, each file is accounted to the first rule matching it.
+func PruneRootfs(fs v1.FS, rootfs string, rules []PruneRule, dryRun bool) ([]PruneResult, error) {
+	results := make([]PruneResult, len(rules))
+	for i, rule := range rules {
+		results[i].Rule = rule.Name
+	}
+	var toRemove []string
+	err := vfs.Walk(fs, rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		for i, rule := range rules {
+			if rule.matches(rel) {
+				results[i].Files++
+				results[i].Size += info.Size()
+				toRemove = append(toRemove, path)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		for _, path := range toRemove {
+			if err := fs.Remove(path); err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// matches returns true if the relative path is selected by the rule
+func (r PruneRule) matches(rel string) bool {
+	for _, k := range r.Keep {
+		if ok, _ := filepath.Match(k, rel); ok {
+			return false
+		}
+		if ok, _ := filepath.Match(k, firstComponents(rel, strings.Count(k, "/")+1)); ok {
+			return false
+		}
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i := 1; i <= len(parts); i++ {
+		prefix := filepath.Join(parts[:i]...)
+		for _, p := range r.Patterns {
+			if ok, _ := filepath.Match(p, prefix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstComponents returns the first n components of the given relative path
+func firstComponents(rel string, n int) string {
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) > n {
+		parts = parts[:n]
+	}
+	return filepath.Join(parts...)
+}
+
+// LogPruneResults prints how much space each prune rule reclaimed
+func LogPruneResults(logger v1.Logger, results []PruneResult, dryRun bool) {
+	verb := "Pruned"
+	if dryRun {
+		verb = "Would prune"
+	}
+	var total int64
+	for _, r := range results {
+		logger.Infof("%s %d files (%s) with rule %s", verb, r.Files, FormatSize(r.Size), r.Rule)
+		total += r.Size
+	}
+	logger.Infof("%s %s in total", verb, FormatSize(total))
+}
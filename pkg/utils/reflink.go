@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes out share the extents of in, like cp --reflink does. It fails on filesystems
+// without reflinks, anything but btrfs, xfs and a few others, and across filesystems.
+func reflink(out, in *os.File) error {
+	return unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+}
+
+// cloneChunks copies in into the empty out with a reflink, so the copy is instant and takes no
+// space until either file is modified, falling back to copying the contents when it can't
+func cloneChunks(out, in *os.File, progress *progressCounter) error {
+	if reflink(out, in) == nil {
+		if info, err := in.Stat(); err == nil {
+			progress.add(info.Size())
+		}
+		return nil
+	}
+	return copyChunks(out, in, progress)
+}
+
+// CloneFile copies src into a new file at dst with the permissions perm, sharing the extents of
+// src on the filesystems supporting reflinks and copying them on the others
+func CloneFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	err = cloneChunks(out, in, nil)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
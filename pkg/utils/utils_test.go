@@ -17,17 +17,32 @@ limitations under the License.
 package utils_test
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	container "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/failure"
 	"github.com/kairos-io/enki/pkg/utils"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/xattr"
 	"github.com/spf13/viper"
 	"github.com/twpayne/go-vfs"
 	"github.com/twpayne/go-vfs/vfst"
@@ -96,6 +111,155 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).NotTo(BeNil())
 		})
 	})
+	Describe("StreamFile", Label("StreamFile"), func() {
+		It("Writes the file contents", func() {
+			Expect(fs.WriteFile("/tmp/kairos.iso", []byte("iso contents"), constants.FilePerm)).To(Succeed())
+			out := &bytes.Buffer{}
+			Expect(utils.StreamFile(fs, "/tmp/kairos.iso", out)).To(Succeed())
+			Expect(out.String()).To(Equal("iso contents"))
+			Expect(utils.StreamFile(fs, "/tmp/missing.iso", out)).ToNot(Succeed())
+		})
+	})
+	Describe("CopyTree", Label("CopyTree"), func() {
+		BeforeEach(func() {
+			for _, dir := range []string{"/src/etc/ssl", "/src/usr/bin", "/src/usr/share/doc/pkg"} {
+				Expect(utils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+			}
+			for _, file := range []string{"/src/etc/hostname", "/src/etc/ssl/cert.pem", "/src/usr/bin/ping", "/src/usr/share/doc/pkg/README"} {
+				Expect(fs.WriteFile(file, []byte(file), constants.FilePerm)).To(Succeed())
+			}
+			Expect(fs.Chmod("/src/usr/bin/ping", os.ModeSetuid|0755)).To(Succeed())
+			Expect(fs.Symlink("ping", "/src/usr/bin/ping6")).To(Succeed())
+			raw, err := fs.RawPath("/src/usr/bin")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.Link(filepath.Join(raw, "ping"), filepath.Join(raw, "ping4"))).To(Succeed())
+		})
+		It("Copies the whole tree keeping modes, symlinks and hardlinks", func() {
+			Expect(utils.CopyTree(fs, "/src", "/dst", utils.CopyOptions{})).To(Succeed())
+
+			data, err := fs.ReadFile("/dst/usr/share/doc/pkg/README")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("/src/usr/share/doc/pkg/README"))
+			fi, err := fs.Stat("/dst/usr/bin/ping")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fi.Mode()).To(Equal(os.ModeSetuid | 0755))
+			link, err := fs.Readlink("/dst/usr/bin/ping6")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(link).To(Equal("ping"))
+			hardlink, err := fs.Stat("/dst/usr/bin/ping4")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.SameFile(fi, hardlink)).To(BeTrue())
+		})
+		It("Skips excluded entries", func() {
+			Expect(utils.CopyTree(fs, "/src", "/dst", utils.CopyOptions{Exclude: []string{"/usr/share/doc", "*.pem"}})).To(Succeed())
+			Expect(utils.Exists(fs, "/dst/usr/share")).To(BeTrue())
+			Expect(utils.Exists(fs, "/dst/usr/share/doc")).To(BeFalse())
+			Expect(utils.Exists(fs, "/dst/etc/ssl/cert.pem")).To(BeFalse())
+			Expect(utils.Exists(fs, "/dst/etc/hostname")).To(BeTrue())
+		})
+		It("Anchors patterns starting with a slash to the source root", func() {
+			Expect(utils.MkdirAll(fs, "/src/usr/share/ssl", constants.DirPerm)).To(Succeed())
+			Expect(utils.CopyTree(fs, "/src", "/dst", utils.CopyOptions{Exclude: []string{"/ssl", "/usr/share/doc/"}})).To(Succeed())
+			Expect(utils.Exists(fs, "/dst/etc/ssl/cert.pem")).To(BeTrue())
+			Expect(utils.Exists(fs, "/dst/usr/share/ssl")).To(BeTrue())
+			Expect(utils.Exists(fs, "/dst/usr/share/doc")).To(BeFalse())
+		})
+		It("Only copies included entries and their parents", func() {
+			Expect(utils.CopyTree(fs, "/src", "/dst", utils.CopyOptions{Include: []string{"/etc/ssl", "ping"}})).To(Succeed())
+			Expect(utils.Exists(fs, "/dst/etc/ssl/cert.pem")).To(BeTrue())
+			Expect(utils.Exists(fs, "/dst/usr/bin/ping")).To(BeTrue())
+			Expect(utils.Exists(fs, "/dst/etc/hostname")).To(BeFalse())
+			Expect(utils.Exists(fs, "/dst/usr/bin/ping6")).To(BeFalse())
+			Expect(utils.Exists(fs, "/dst/usr/share")).To(BeFalse())
+		})
+		It("Keeps extended attributes", func() {
+			raw, err := fs.RawPath("/src/usr/bin/ping")
+			Expect(err).ToNot(HaveOccurred())
+			if err = xattr.Set(raw, "user.enki", []byte("test")); err != nil {
+				Skip(fmt.Sprintf("xattrs not supported: %v", err))
+			}
+			Expect(utils.CopyTree(fs, "/src", "/dst", utils.CopyOptions{})).To(Succeed())
+			Expect(utils.CopyFile(fs, "/src/usr/bin/ping", "/ping")).To(Succeed())
+			for _, file := range []string{"/dst/usr/bin/ping", "/ping"} {
+				raw, err = fs.RawPath(file)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(xattr.Get(raw, "user.enki")).To(Equal([]byte("test")), file)
+			}
+
+			Expect(utils.CopyTree(fs, "/src", "/noxattrs", utils.CopyOptions{NoXattrs: true})).To(Succeed())
+			raw, err = fs.RawPath("/noxattrs/usr/bin/ping")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = xattr.Get(raw, "user.enki")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("CloneFile", Label("CloneFile"), func() {
+		It("Copies the file with a reflink or else its contents", func() {
+			Expect(fs.WriteFile("/file", []byte("contents"), constants.FilePerm)).To(Succeed())
+			src, err := fs.RawPath("/file")
+			Expect(err).ToNot(HaveOccurred())
+			dst, err := fs.RawPath("/clone")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(utils.CloneFile(src, dst, 0600)).To(Succeed())
+			data, err := fs.ReadFile("/clone")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("contents"))
+			fi, err := fs.Stat("/clone")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			// The clone is a new file, it never replaces an existing one
+			Expect(utils.CloneFile(src, dst, 0600)).ToNot(Succeed())
+		})
+	})
+	Describe("Progress", Label("progress"), func() {
+		It("Reports the bytes copied by CopyFileWithProgress", func() {
+			Expect(fs.WriteFile("/file", make([]byte, 4096), constants.FilePerm)).To(Succeed())
+			var done, total int64
+			err := utils.CopyFileWithProgress(fs, "/file", "/tmp", func(d, t int64) { done, total = d, t })
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(done).To(Equal(int64(4096)))
+			Expect(total).To(Equal(int64(4096)))
+			Expect(utils.Exists(fs, "/tmp/file")).To(BeTrue())
+		})
+		It("Reports the bytes copied by CopyTree", func() {
+			Expect(utils.MkdirAll(fs, "/src/a/b", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/src/a/file", make([]byte, 100), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/src/a/b/file", make([]byte, 200), constants.FilePerm)).To(Succeed())
+			var done, total int64
+			err := utils.CopyTree(fs, "/src", "/dst", utils.CopyOptions{Progress: func(d, t int64) { done, total = d, t }})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(done).To(Equal(int64(300)))
+			Expect(total).To(Equal(int64(300)))
+		})
+		It("Logs every 10%", func() {
+			var buf bytes.Buffer
+			progress := utils.LogProgress(v1.NewBufferLogger(&buf), "copy")
+			for i := int64(0); i <= 100; i += 5 {
+				progress(i, 100)
+			}
+			Expect(strings.Count(buf.String(), "copy: ")).To(Equal(11))
+			Expect(buf.String()).To(ContainSubstring("copy: 100%"))
+		})
+		It("Parses the mksquashfs progress", func() {
+			bin := GinkgoT().TempDir()
+			script := "#!/bin/sh\nprintf 'Parallel mksquashfs: Using 8 processors\\n10\\n[==   ] 10/40  25%%\\r[=====] 40/40 100%%\\nNumber of uids 1\\n'\n"
+			Expect(os.WriteFile(filepath.Join(bin, "mksquashfs"), []byte(script), 0755)).To(Succeed())
+			GinkgoT().Setenv("PATH", bin)
+
+			var reported []int64
+			err := utils.CreateSquashFSWithProgress(&v1.RealRunner{Logger: logger}, logger, "source", "dest", []string{}, func(done, total int64) {
+				Expect(total).To(Equal(int64(100)))
+				reported = append(reported, done)
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(reported).To(Equal([]int64{10, 25, 100}))
+		})
+		It("Runs mksquashfs with -percentage", func() {
+			err := utils.CreateSquashFSWithProgress(runner, logger, "source", "dest", []string{}, func(_, _ int64) {})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{{"mksquashfs", "source", "dest", "-percentage"}})).To(Succeed())
+		})
+	})
 	Describe("CreateDirStructure", Label("CreateDirStructure"), func() {
 		It("Creates essential directories", func() {
 			dirList := []string{"sys", "proc", "dev", "tmp", "boot", "usr/local", "oem"}
@@ -139,6 +303,404 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(size).To(Equal(int64(3072)))
 		})
+		It("Walks deep trees concurrently", func() {
+			for i := 0; i < 20; i++ {
+				dir := fmt.Sprintf("/folder/subfolder/%d/a/b/c", i)
+				Expect(utils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(dir, "file"), make([]byte, 100), constants.FilePerm)).To(Succeed())
+			}
+			size, err := utils.DirSize(fs, "/folder")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(size).To(Equal(int64(3072 + 20*100)))
+		})
+		It("Returns the size of a single file", func() {
+			size, err := utils.DirSize(fs, "/folder/file")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(size).To(Equal(int64(1024)))
+		})
+		It("Fails on missing paths", func() {
+			_, err := utils.DirSize(fs, "/nonexistent")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("KernelVersions", Label("kernel"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/rootfs/boot", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/rootfs/usr/lib/modules/6.6.0-2/kernel", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/rootfs/usr/lib/modules/6.4.0-1/kernel", constants.DirPerm)).To(Succeed())
+			for _, f := range []string{
+				"/rootfs/boot/vmlinuz-6.5.0-1", "/rootfs/boot/initrd-6.5.0-1",
+				"/rootfs/boot/vmlinuz", "/rootfs/boot/initrd",
+				"/rootfs/usr/lib/modules/6.6.0-2/vmlinuz", "/rootfs/usr/lib/modules/6.6.0-2/initrd",
+			} {
+				Expect(fs.WriteFile(f, []byte(f), constants.FilePerm)).To(Succeed())
+			}
+		})
+		It("Lists the versioned kernels of /boot and of the modules", func() {
+			versions, err := utils.KernelVersions(fs, "/rootfs")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(versions).To(Equal([]string{"6.5.0-1", "6.6.0-2"}))
+		})
+		It("Lists nothing without kernels", func() {
+			versions, err := utils.KernelVersions(fs, "/nonexistent")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(versions).To(BeEmpty())
+		})
+		It("Finds the kernel and initrd of a version in /boot", func() {
+			kernel, initrd, err := utils.FindVersionedKernelInitrd(fs, "/rootfs", "6.5.0-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(kernel).To(Equal("/rootfs/boot/vmlinuz-6.5.0-1"))
+			Expect(initrd).To(Equal("/rootfs/boot/initrd-6.5.0-1"))
+		})
+		It("Finds the kernel and initrd of a version in its modules", func() {
+			kernel, initrd, err := utils.FindVersionedKernelInitrd(fs, "/rootfs", "6.6.0-2")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(kernel).To(Equal("/rootfs/usr/lib/modules/6.6.0-2/vmlinuz"))
+			Expect(initrd).To(Equal("/rootfs/usr/lib/modules/6.6.0-2/initrd"))
+		})
+		It("Finds the initrds named like Fedora and Debian do", func() {
+			Expect(fs.WriteFile("/rootfs/boot/vmlinuz-6.7.0-3", []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/boot/initramfs-6.7.0-3.img", []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/boot/vmlinuz-6.8.0-4", []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/boot/initrd.img-6.8.0-4", []byte{}, constants.FilePerm)).To(Succeed())
+			_, initrd, err := utils.FindVersionedKernelInitrd(fs, "/rootfs", "6.7.0-3")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(initrd).To(Equal("/rootfs/boot/initramfs-6.7.0-3.img"))
+			_, initrd, err = utils.FindVersionedKernelInitrd(fs, "/rootfs", "6.8.0-4")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(initrd).To(Equal("/rootfs/boot/initrd.img-6.8.0-4"))
+		})
+		It("Lists the available versions of missing kernels", func() {
+			_, _, err := utils.FindVersionedKernelInitrd(fs, "/rootfs", "6.4.0-1")
+			Expect(err).To(MatchError(ContainSubstring("the rootfs has 6.5.0-1, 6.6.0-2")))
+		})
+		It("Fails on kernels without initrd", func() {
+			Expect(fs.WriteFile("/rootfs/boot/vmlinuz-6.7.0-3", []byte{}, constants.FilePerm)).To(Succeed())
+			_, _, err := utils.FindVersionedKernelInitrd(fs, "/rootfs", "6.7.0-3")
+			Expect(err).To(MatchError(ContainSubstring("no initrd found")))
+		})
+	})
+	Describe("ParseSize", Label("size"), func() {
+		It("parses plain bytes and units", func() {
+			for in, expected := range map[string]int64{
+				"1048576": 1048576,
+				"700MiB":  700 * 1024 * 1024,
+				"4GiB":    4 * 1024 * 1024 * 1024,
+				"4G":      4 * 1024 * 1024 * 1024,
+				"1.5KiB":  1536,
+				"10MB":    10 * 1000 * 1000,
+			} {
+				size, err := utils.ParseSize(in)
+				Expect(err).ShouldNot(HaveOccurred(), in)
+				Expect(size).To(Equal(expected), in)
+			}
+		})
+		It("fails on unknown units", func() {
+			_, err := utils.ParseSize("10parsecs")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("LargestDirs", Label("size"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/rootfs/usr/share/doc", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/rootfs/etc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/usr/share/doc/big", make([]byte, 4096), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/etc/small", make([]byte, 16), constants.FilePerm)).To(Succeed())
+		})
+		It("returns the directories sorted by size", func() {
+			dirs, err := utils.LargestDirs(fs, "/rootfs", 2, 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dirs).To(Equal([]utils.DirUsage{
+				{Path: "usr", Size: 4096},
+				{Path: "usr/share", Size: 4096},
+				{Path: "etc", Size: 16},
+			}))
+		})
+		It("reports the largest dirs when an artifact is too big", func() {
+			Expect(fs.WriteFile("/artifact.iso", make([]byte, 2048), constants.FilePerm)).To(Succeed())
+			Expect(utils.CheckArtifactSize(fs, "/artifact.iso", 4096, "/rootfs")).To(Succeed())
+			err := utils.CheckArtifactSize(fs, "/artifact.iso", 1024, "/rootfs")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("exceeds the max size of 1.0KiB"))
+			Expect(err.Error()).To(ContainSubstring("/usr/share"))
+			Expect(err).To(MatchError(failure.ErrSizeBudget))
+			Expect(failure.ExitCode(err)).To(Equal(5))
+		})
+	})
+	Describe("PruneRootfs", Label("prune"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/rootfs/usr/share/doc/bash", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/rootfs/usr/share/locale/de/LC_MESSAGES", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/rootfs/usr/share/locale/en_GB/LC_MESSAGES", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/usr/share/doc/bash/README", make([]byte, 1024), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/usr/share/doc/bash/copyright", make([]byte, 16), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/usr/share/locale/de/LC_MESSAGES/bash.mo", make([]byte, 512), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/rootfs/usr/share/locale/en_GB/LC_MESSAGES/bash.mo", make([]byte, 512), constants.FilePerm)).To(Succeed())
+		})
+		It("reports the reclaimable space without removing anything on dry run", func() {
+			rules, err := utils.GetPruneRules([]string{"docs", "locales"})
+			Expect(err).ShouldNot(HaveOccurred())
+			results, err := utils.PruneRootfs(fs, "/rootfs", rules, true)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(results).To(Equal([]utils.PruneResult{
+				{Rule: "docs", Files: 1, Size: 1024},
+				{Rule: "locales", Files: 1, Size: 512},
+			}))
+			Expect(utils.Exists(fs, "/rootfs/usr/share/doc/bash/README")).To(BeTrue())
+			Expect(utils.Exists(fs, "/rootfs/usr/share/locale/de/LC_MESSAGES/bash.mo")).To(BeTrue())
+		})
+		It("removes the matching files and keeps the excluded ones", func() {
+			rules, err := utils.GetPruneRules([]string{"docs", "locales"})
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = utils.PruneRootfs(fs, "/rootfs", rules, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.Exists(fs, "/rootfs/usr/share/doc/bash/README")).To(BeFalse())
+			Expect(utils.Exists(fs, "/rootfs/usr/share/doc/bash/copyright")).To(BeTrue())
+			Expect(utils.Exists(fs, "/rootfs/usr/share/locale/de/LC_MESSAGES/bash.mo")).To(BeFalse())
+			Expect(utils.Exists(fs, "/rootfs/usr/share/locale/en_GB/LC_MESSAGES/bash.mo")).To(BeTrue())
+		})
+		It("accounts the files matched by several rules to the first one", func() {
+			rules := []utils.PruneRule{
+				{Name: "doc", Patterns: []string{"usr/share/doc/*"}},
+				{Name: "share", Patterns: []string{"usr/share/*"}},
+			}
+			results, err := utils.PruneRootfs(fs, "/rootfs", rules, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(results).To(Equal([]utils.PruneResult{
+				{Rule: "doc", Files: 2, Size: 1040},
+				{Rule: "share", Files: 2, Size: 1024},
+			}))
+			Expect(utils.Exists(fs, "/rootfs/usr/share/doc/bash/copyright")).To(BeFalse())
+		})
+		It("fails on unknown profiles", func() {
+			_, err := utils.GetPruneRules([]string{"docs", "kernels"})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("GetEfiTools", Label("GetEfiTools"), func() {
+		It("returns only the given payloads with the arch specific shell name", func() {
+			Expect(utils.GetEfiTools("", "", constants.ArchAmd64)).To(BeEmpty())
+			Expect(utils.GetEfiTools("/shell.efi", "", constants.ArchArm64)).To(Equal([]utils.EfiTool{
+				{FileName: "shellaa64.efi", Title: "UEFI Shell", Source: "/shell.efi"},
+			}))
+			tools := utils.GetEfiTools("/shell.efi", "/memtest.efi", constants.ArchAmd64)
+			Expect(tools).To(HaveLen(2))
+			Expect(tools[0].FileName).To(Equal("shellx64.efi"))
+			Expect(tools[1].FileName).To(Equal("memtest86+.efi"))
+		})
+		It("parses the extra EFI binaries with their options", func() {
+			tools, err := utils.ParseEfiBinaries([]string{"/usr/share/efitools/KeyTool.efi,title=Key Tool", "/vendor/diag.EFI,sign=false"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tools).To(Equal([]utils.EfiTool{
+				{FileName: "KeyTool.efi", Title: "Key Tool", Source: "/usr/share/efitools/KeyTool.efi"},
+				{FileName: "diag.EFI", Source: "/vendor/diag.EFI", Presigned: true},
+			}))
+		})
+		It("fails on invalid and duplicated EFI binaries", func() {
+			_, err := utils.ParseEfiBinaries([]string{"/vendor/diag.bin"})
+			Expect(err).To(MatchError(ContainSubstring("expected the path of an .efi file")))
+			_, err = utils.ParseEfiBinaries([]string{"/vendor/diag.efi,signed"})
+			Expect(err).To(MatchError(ContainSubstring(`invalid option "signed"`)))
+			_, err = utils.ParseEfiBinaries([]string{"/vendor/diag.efi,sign=maybe"})
+			Expect(err).To(HaveOccurred())
+			_, err = utils.ParseEfiBinaries([]string{"/vendor/shellx64.efi"}, utils.GetEfiTools("/shell.efi", "", constants.ArchAmd64)...)
+			Expect(err).To(MatchError(ContainSubstring("named like another EFI tool")))
+		})
+	})
+	Describe("CreateTar", Label("CreateTar"), func() {
+		It("creates an image of the tarball with the given arch and labels", func() {
+			dir := GinkgoT().TempDir()
+			esp := filepath.Join(dir, "esp")
+			Expect(os.MkdirAll(filepath.Join(esp, "EFI", "kairos"), constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(esp, "EFI", "kairos", "norole.efi"), []byte("efi"), constants.FilePerm)).To(Succeed())
+			layer, err := os.Create(filepath.Join(dir, "layer.tar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(utils.Tar(esp, layer)).To(Succeed())
+			Expect(layer.Close()).To(Succeed())
+
+			arch, err := utils.ArchToGolangArch(constants.Archx86)
+			Expect(err).ToNot(HaveOccurred())
+			image := filepath.Join(dir, "image.tar")
+			labels := map[string]string{"io.kairos.artifact": "uki"}
+			Expect(utils.CreateTar(logger, layer.Name(), image, "kairos_uki:v1", arch, "linux", labels)).To(Succeed())
+
+			img, err := tarball.ImageFromPath(image, nil)
+			Expect(err).ToNot(HaveOccurred())
+			cfg, err := img.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Architecture).To(Equal(constants.ArchAmd64))
+			Expect(cfg.OS).To(Equal("linux"))
+			Expect(cfg.Config.Labels).To(Equal(labels))
+			layers, err := img.Layers()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(layers).To(HaveLen(1))
+		})
+	})
+	Describe("ImagePlatforms", Label("platforms"), func() {
+		It("lists the platforms of multi-arch images", func() {
+			server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+			defer server.Close()
+			host := strings.TrimPrefix(server.URL, "http://")
+
+			var adds []mutate.IndexAddendum
+			for _, platform := range []container.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64", Variant: "v8"},
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "s390x"},
+				{OS: "unknown", Architecture: "unknown"},
+			} {
+				platform := platform
+				img, err := random.Image(64, 1)
+				Expect(err).ToNot(HaveOccurred())
+				adds = append(adds, mutate.IndexAddendum{Add: img, Descriptor: container.Descriptor{Platform: &platform}})
+			}
+			index := mutate.AppendManifests(empty.Index, adds...)
+			ref, err := name.ParseReference(host + "/kairos/ubuntu:multi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remote.WriteIndex(ref, index)).To(Succeed())
+
+			platforms, err := utils.ImagePlatforms(ref.String())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(platforms).To(HaveLen(2))
+			Expect(platforms[0].Arch).To(Equal(constants.Archx86))
+			Expect(platforms[1].Arch).To(Equal(constants.ArchArm64))
+
+			img, err := random.Image(64, 1)
+			Expect(err).ToNot(HaveOccurred())
+			single, err := name.ParseReference(host + "/kairos/ubuntu:single")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remote.Write(single, img)).To(Succeed())
+			platforms, err = utils.ImagePlatforms(single.String())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(platforms).To(BeEmpty())
+		})
+	})
+	Describe("EspSize", Label("esp"), func() {
+		It("sizes the image from the contents plus headroom, aligned", func() {
+			sizing, err := utils.NewEspSizing(10, "1MiB", "")
+			Expect(err).ToNot(HaveOccurred())
+			size, err := utils.EspSize(sizing, 2, 30<<20, 100)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size % (1 << 20)).To(BeZero())
+			Expect(size).To(BeNumerically(">=", int64(33<<20)))
+			Expect(size).To(BeNumerically("<", int64(36<<20)))
+
+			noHeadroom, err := utils.EspSize(utils.EspSizing{Align: 1 << 20}, 2, 30<<20, 100)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(noHeadroom).To(BeNumerically("<", size))
+		})
+		It("never goes below the min size", func() {
+			size, err := utils.EspSize(utils.EspSizing{Align: 1 << 20, MinSize: 34 << 20}, 1, 4096)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(int64(34 << 20)))
+		})
+		It("uses the fixed size if the contents fit", func() {
+			sizing, err := utils.NewEspSizing(10, "4MiB", "64MiB")
+			Expect(err).ToNot(HaveOccurred())
+			size, err := utils.EspSize(sizing, 1, 10<<20)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(int64(64 << 20)))
+		})
+		It("fails if the contents don't fit in the fixed size", func() {
+			sizing, err := utils.NewEspSizing(10, "4MiB", "16MiB")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = utils.EspSize(sizing, 1, 20<<20)
+			Expect(err).To(MatchError(failure.ErrSizeBudget))
+			Expect(err.Error()).To(ContainSubstring("esp-size is 16.0MiB"))
+		})
+		It("rejects invalid options", func() {
+			_, err := utils.NewEspSizing(-1, "1MiB", "")
+			Expect(err).To(HaveOccurred())
+			_, err = utils.NewEspSizing(10, "100", "")
+			Expect(err).To(MatchError(ContainSubstring("multiple of 512 bytes")))
+			_, err = utils.NewEspSizing(10, "1MiB", "lots")
+			Expect(err).To(MatchError(ContainSubstring("invalid esp-size")))
+		})
+		It("sizes the contents of a dir", func() {
+			Expect(utils.MkdirAll(fs, "/esp/EFI/BOOT", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/esp/EFI/BOOT/bootx64.efi", make([]byte, 5<<20), constants.FilePerm)).To(Succeed())
+			size, err := utils.DirEspSize(fs, "/esp", utils.EspSizing{Align: 1 << 20})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(int64(7 << 20)))
+		})
+	})
+	Describe("SplitXbootldr", Label("esp"), func() {
+		It("moves the UKIs and their entries out of the ESP", func() {
+			esp, xbootldr := utils.SplitXbootldr(map[string][]string{
+				"EFI/BOOT":            {"/src/BOOTX64.EFI"},
+				"EFI/kairos":          {"/src/norole.efi"},
+				constants.EfiToolsDir: {"/src/shellx64.efi"},
+				"loader":              {"/src/loader.conf"},
+				"loader/entries":      {"/src/norole.conf", "/src/shellx64.conf"},
+				"loader/keys/auto":    {"/src/PK.auth"},
+			})
+			Expect(esp).To(Equal(map[string][]string{
+				"EFI/BOOT":         {"/src/BOOTX64.EFI"},
+				"loader":           {"/src/loader.conf"},
+				"loader/keys/auto": {"/src/PK.auth"},
+			}))
+			Expect(xbootldr).To(Equal(map[string][]string{
+				"EFI/kairos":          {"/src/norole.efi"},
+				constants.EfiToolsDir: {"/src/shellx64.efi"},
+				"loader/entries":      {"/src/norole.conf", "/src/shellx64.conf"},
+			}))
+		})
+	})
+	Describe("FatOptions", Label("esp"), func() {
+		It("builds the mkfs.fat arguments", func() {
+			opts, err := utils.NewFatOptions("32", "4KiB", "KAIROS_ESP")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts.MkfsArgs()).To(Equal([]string{"-F", "32", "-s", "8", "-n", "KAIROS_ESP"}))
+			opts, err = utils.NewFatOptions(utils.FatAuto, "", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts.MkfsArgs()).To(BeEmpty())
+		})
+		It("rejects invalid options", func() {
+			_, err := utils.NewFatOptions("24", "", "")
+			Expect(err).To(MatchError(ContainSubstring("invalid esp-fat")))
+			_, err = utils.NewFatOptions("32", "3KiB", "")
+			Expect(err).To(MatchError(ContainSubstring("power of two")))
+			_, err = utils.NewFatOptions("32", "128KiB", "")
+			Expect(err).To(MatchError(ContainSubstring("power of two")))
+			_, err = utils.NewFatOptions("32", "", "A_VERY_LONG_LABEL")
+			Expect(err).To(MatchError(ContainSubstring("longer than 11")))
+		})
+		It("makes FAT32 images big enough for its min amount of clusters", func() {
+			opts, err := utils.NewFatOptions("32", "", "")
+			Expect(err).ToNot(HaveOccurred())
+			sizing := utils.EspSizing{Align: 1 << 20}
+			opts.ApplyTo(&sizing)
+			size, err := utils.EspSize(sizing, 1, 4096)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(BeNumerically(">=", int64(65525*512)))
+		})
+		It("fails if the contents don't fit in the FAT variant", func() {
+			opts, err := utils.NewFatOptions("12", "512", "")
+			Expect(err).ToNot(HaveOccurred())
+			sizing := utils.EspSizing{Align: 1 << 20}
+			opts.ApplyTo(&sizing)
+			_, err = utils.EspSize(sizing, 1, 10<<20)
+			Expect(err).To(MatchError(failure.ErrSizeBudget))
+			Expect(failure.Hint(err)).To(ContainSubstring("--esp-cluster-size"))
+
+			opts, err = utils.NewFatOptions("12", "64KiB", "")
+			Expect(err).ToNot(HaveOccurred())
+			sizing = utils.EspSizing{Align: 1 << 20}
+			opts.ApplyTo(&sizing)
+			size, err := utils.EspSize(sizing, 1, 10<<20)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(BeNumerically("<=", int64(4084*64*1024)))
+		})
+		It("creates and formats the image", func() {
+			opts, err := utils.NewFatOptions("16", "", "COS_GRUB")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(utils.CreateFatImage(fs, runner, "/iso/boot/uefi.img", 8<<20, opts)).To(Succeed())
+			info, err := fs.Stat("/iso/boot/uefi.img")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Size()).To(Equal(int64(8 << 20)))
+			Expect(runner.CmdsMatch([][]string{{"mkfs.vfat", "-F", "16", "-n", "COS_GRUB", "/iso/boot/uefi.img"}})).To(Succeed())
+		})
 	})
 	Describe("CalcFileChecksum", Label("checksum"), func() {
 		It("compute correct sha256 checksum", func() {
@@ -154,6 +716,33 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(checksum).To(Equal(testDataSHA256))
 		})
+		It("computes several checksums in a single pass", func() {
+			Expect(fs.WriteFile("/test.iso", []byte("abc"), 0644)).To(Succeed())
+
+			sums, err := utils.CalcFileChecksums(fs, "/test.iso", utils.ChecksumAlgorithms()...)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sums.Sum(utils.ChecksumSHA512, utils.ChecksumFormatHex)).To(Equal("ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"))
+			Expect(sums.Sum(utils.ChecksumBLAKE3, utils.ChecksumFormatHex)).To(Equal("6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"))
+			// sha2-256 code 0x12 and 32 bytes length
+			Expect(sums.Sum(utils.ChecksumSHA256, utils.ChecksumFormatMultihash)).To(Equal("1220ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"))
+			_, err = sums.Sum(utils.ChecksumSHA256, "base64")
+			Expect(err).Should(HaveOccurred())
+		})
+		It("hashes data while it is written", func() {
+			var buf strings.Builder
+			w, err := utils.NewChecksumWriter(&buf, utils.ChecksumSHA256)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = w.Write([]byte("abc"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(buf.String()).To(Equal("abc"))
+			Expect(w.Sum(utils.ChecksumSHA256, utils.ChecksumFormatHex)).To(Equal("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"))
+			_, err = w.Sum(utils.ChecksumBLAKE3, utils.ChecksumFormatHex)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("fails on unknown algorithms", func() {
+			_, err := utils.NewChecksumWriter(nil, "md5")
+			Expect(err).Should(HaveOccurred())
+		})
 	})
 	Describe("CreateSquashFS", Label("CreateSquashFS"), func() {
 		It("runs with no options if none given", func() {
@@ -225,6 +814,140 @@ var _ = Describe("Utils", Label("utils"), func() {
 				Expect(entry.Cmdline).To(MatchRegexp(".*key=value testkey"))
 			}
 		})
+
+		It("boots the default entry as the media-type says", func() {
+			DeferCleanup(viper.Set, "media-type", "")
+			DeferCleanup(viper.Set, "extend-cmdline", "")
+			viper.Set("extend-cmdline", "")
+			viper.Set("boot-branding", "Kairos")
+
+			viper.Set("media-type", constants.MediaInstaller)
+			entries := utils.GetUkiCmdline()
+			Expect(entries[0].Cmdline).To(Equal(constants.UkiCmdline + " install-mode install.auto=true"))
+			Expect(entries[0].FileName).To(Equal(constants.ArtifactBaseName))
+
+			viper.Set("media-type", constants.MediaRecovery)
+			entries = utils.GetUkiCmdline()
+			Expect(entries[0].Cmdline).To(Equal(constants.UkiCmdline + " " + constants.UkiCmdlineRecovery))
+			Expect(entries[0].Title).To(Equal("Kairos recovery"))
+			Expect(entries[0].FileName).To(Equal(constants.ArtifactBaseName))
+		})
+	})
+
+	Describe("GetUkiBootEntries", Label("GetUkiCmdline"), func() {
+		It("describes each entry", func() {
+			DeferCleanup(viper.Set, "extra-cmdline", []string{})
+			DeferCleanup(viper.Set, "recovery", false)
+			viper.Set("extra-cmdline", []string{"rd.debug rd.shell"})
+			viper.Set("recovery", true)
+			viper.Set("recovery-cmdline", constants.UkiCmdlineRecovery)
+
+			entries := utils.GetUkiBootEntries(viper.GetViper(), v1.NewNullLogger())
+			Expect(entries).To(HaveLen(3))
+			Expect(entries[0].FileName).To(Equal(constants.ArtifactBaseName))
+			Expect(entries[0].EfiName()).To(Equal(constants.ArtifactBaseName + ".efi"))
+			Expect(entries[0].Extra).To(BeEmpty())
+			Expect(entries[0].Default).To(BeTrue())
+			Expect(entries[0].Install).To(BeTrue())
+
+			Expect(entries[1].FileName).To(Equal(constants.ArtifactBaseName + "_install-mode_rd.debug_rd.shell"))
+			Expect(entries[1].Extra).To(Equal("install-mode rd.debug rd.shell"))
+			Expect(entries[1].Default).To(BeFalse())
+			Expect(entries[1].Install).To(BeTrue())
+
+			Expect(entries[2].FileName).To(Equal(constants.RecoveryRole))
+			Expect(entries[2].Extra).To(Equal(constants.UkiCmdlineRecovery))
+			Expect(entries[2].Install).To(BeFalse())
+			Expect(utils.CheckBootEntries(entries)).To(Succeed())
+		})
+
+		It("makes the extended entry the default one", func() {
+			DeferCleanup(viper.Set, "extend-cmdline", "")
+			viper.Set("extend-cmdline", "rd.debug")
+			entries := utils.GetUkiBootEntries(viper.GetViper(), v1.NewNullLogger())
+			Expect(entries[0].Default).To(BeTrue())
+			Expect(entries[0].ConfName()).To(Equal(constants.ArtifactBaseName + "_install-mode_rd.debug.conf"))
+		})
+
+		It("rejects entries with the same name", func() {
+			DeferCleanup(viper.Set, "single-efi-cmdline", []string{})
+			viper.Set("single-efi-cmdline", []string{"Debug: rd.debug", "Debug: rd.shell"})
+			err := utils.CheckBootEntries(utils.GetUkiBootEntries(viper.GetViper(), v1.NewNullLogger()))
+			Expect(err).To(MatchError(ContainSubstring("both named Debug")))
+		})
+	})
+
+	Describe("CheckCmdline", Label("cmdline"), func() {
+		It("parses the parameters as the kernel does", func() {
+			params, err := utils.ParseCmdline(`console=ttyS0  quiet dyndbg="file foo.c +p" rd.break=`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(params).To(Equal([]utils.CmdlineParam{
+				{Key: "console", Value: "ttyS0", HasValue: true},
+				{Key: "quiet"},
+				{Key: "dyndbg", Value: "file foo.c +p", HasValue: true},
+				{Key: "rd.break", HasValue: true},
+			}))
+		})
+
+		It("rejects characters that break the loader entries", func() {
+			_, err := utils.ParseCmdline("quiet\ntitle Evil")
+			Expect(err).To(MatchError(ContainSubstring("control character")))
+			_, err = utils.ParseCmdline(`dyndbg="file foo.c`)
+			Expect(err).To(MatchError(ContainSubstring("unterminated quote")))
+		})
+
+		It("warns on duplicated and missing parameters", func() {
+			entry := utils.BootEntry{FileName: "norole", Default: true, Cmdline: constants.UkiCmdline + " install-mode console=ttyS1 selinux=1"}
+			warnings, err := utils.CheckCmdline(entry, constants.MediaLive)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(warnings).To(ConsistOf(ContainSubstring("sets selinux more than once: selinux=0 and selinux=1")))
+
+			warnings, err = utils.CheckCmdline(entry, constants.MediaInstaller)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(warnings).To(ContainElement(ContainSubstring("lacks install.auto=true")))
+
+			recovery := utils.BootEntry{FileName: constants.RecoveryRole, Cmdline: "rd.immucore.uki rescue"}
+			warnings, err = utils.CheckCmdline(recovery, constants.MediaLive)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(warnings).To(ConsistOf(ContainSubstring("lacks recovery-mode")))
+		})
+
+		It("deduplicates the cmdline, the later parts taking precedence", func() {
+			cmdline, overridden, err := utils.CanonicalCmdline(constants.UkiCmdline, "install-mode  install-mode", `selinux=1 console=ttyS1,115200 console=tty0 dyndbg="file foo.c +p"`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cmdline).To(Equal(`net.ifnames=1 rd.immucore.oemlabel=COS_OEM rd.immucore.oemtimeout=2 rd.immucore.uki install-mode selinux=1 console=ttyS1,115200 console=tty0 dyndbg="file foo.c +p"`))
+			Expect(overridden).To(Equal([]string{"selinux=1 overrides selinux=0", "console=ttyS1,115200 overrides console=ttyS0 console=tty1"}))
+
+			cmdline, overridden, err = utils.CanonicalCmdline(constants.UkiCmdline, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cmdline).To(Equal(constants.UkiCmdline))
+			Expect(overridden).To(BeEmpty())
+
+			_, _, err = utils.CanonicalCmdline(constants.UkiCmdline, `dyndbg="file`)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("warns on the parameters the flags override", func() {
+			DeferCleanup(viper.Set, "extend-cmdline", "")
+			viper.Set("extend-cmdline", "rd.immucore.oemtimeout=10")
+			entry := utils.GetUkiCmdline()[0]
+			Expect(entry.Cmdline).To(Equal(strings.Replace(constants.UkiCmdline, " rd.immucore.oemtimeout=2", "", 1) + " install-mode rd.immucore.oemtimeout=10"))
+			Expect(entry.ConfName()).To(Equal(constants.ArtifactBaseName + "_install-mode_rd.immucore.oemtimeout=10.conf"))
+			warnings, err := utils.CheckCmdline(entry, constants.MediaLive)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(warnings).To(ConsistOf("boot entry norole_install-mode_rd.immucore.oemtimeout=10: rd.immucore.oemtimeout=10 overrides rd.immucore.oemtimeout=2"))
+		})
+
+		It("accepts the default entries", func() {
+			DeferCleanup(viper.Set, "media-type", "")
+			for _, mediaType := range constants.GetMediaTypes() {
+				viper.Set("media-type", mediaType)
+				entry := utils.GetUkiCmdline()[0]
+				warnings, err := utils.CheckCmdline(entry, mediaType)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(warnings).To(BeEmpty(), mediaType)
+			}
+		})
 	})
 
 	Describe("GetUkiSingleCmdlines", Label("GetUkiSingleCmdlines"), func() {
@@ -238,7 +961,7 @@ var _ = Describe("Utils", Label("utils"), func() {
 			viper.Set("boot-branding", "Kairos")
 
 			entries := utils.GetUkiSingleCmdlines(v1.NewNullLogger())
-			Expect(entries[0].Cmdline).To(MatchRegexp(defaultCmdline + "  key=value"))
+			Expect(entries[0].Cmdline).To(Equal(defaultCmdline + " key=value"))
 			Expect(entries[0].Title).To(ContainSubstring("Kairos (My Entry)"))
 			Expect(entries[0].FileName).To(Equal("My_Entry"))
 		})
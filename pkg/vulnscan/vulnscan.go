@@ -0,0 +1,236 @@
+// Package vulnscan scans the source images of a build for known vulnerabilities with an external
+// scanner, so images with vulnerable packages don't get turned into install media by accident.
+package vulnscan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// Grype scans with anchore's grype
+	Grype = "grype"
+	// Trivy scans with aquasecurity's trivy
+	Trivy = "trivy"
+)
+
+// Scanners returns the names of the supported scanners
+func Scanners() []string {
+	return []string{Grype, Trivy}
+}
+
+// Severity of a vulnerability, as rated by the vulnerability databases
+type Severity int
+
+const (
+	SeverityUnknown Severity = iota
+	SeverityNegligible
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = []string{"unknown", "negligible", "low", "medium", "high", "critical"}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+// Severities returns the names of the severities a build can fail on, from the lowest to the
+// highest
+func Severities() []string {
+	return append([]string{}, severityNames[SeverityNegligible:]...)
+}
+
+// ParseSeverity returns the severity of the given name, as written by grype or trivy
+func ParseSeverity(name string) (Severity, error) {
+	for i, n := range severityNames {
+		if strings.EqualFold(n, name) {
+			return Severity(i), nil
+		}
+	}
+	return SeverityUnknown, fmt.Errorf("unknown severity %q, available severities: %s", name, strings.Join(Severities(), ", "))
+}
+
+// Vulnerability is a vulnerable package found in an image
+type Vulnerability struct {
+	ID       string
+	Package  string
+	Version  string
+	Severity Severity
+	// FixedIn is the version of the package fixing the vulnerability, empty if there is no fix
+	FixedIn string
+}
+
+func (v Vulnerability) String() string {
+	fix := "no fix available"
+	if v.FixedIn != "" {
+		fix = "fixed in " + v.FixedIn
+	}
+	return fmt.Sprintf("%s [%s] in %s %s, %s", v.ID, v.Severity, v.Package, v.Version, fix)
+}
+
+// AtLeast returns the vulnerabilities of the given severity or higher, the most severe first
+func AtLeast(vulns []Vulnerability, severity Severity) []Vulnerability {
+	var result []Vulnerability
+	for _, v := range vulns {
+		if v.Severity >= severity {
+			result = append(result, v)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Severity > result[j].Severity
+	})
+	return result
+}
+
+// Scanner finds the vulnerable packages of an image source
+type Scanner interface {
+	// Binary returns the executable the scanner runs
+	Binary() string
+	// Scan returns the vulnerabilities of the packages in src, a container image or a rootfs dir
+	Scan(src *v1.ImageSource) ([]Vulnerability, error)
+}
+
+// New returns the scanner of the given name, running its commands with runner
+func New(name string, runner v1.Runner) (Scanner, error) {
+	switch name {
+	case Grype:
+		return &grype{runner: runner}, nil
+	case Trivy:
+		return &trivy{runner: runner}, nil
+	}
+	return nil, fmt.Errorf("unknown vulnerability scanner %q, available scanners: %s", name, strings.Join(Scanners(), ", "))
+}
+
+// runToFile runs a scanner writing its JSON report to a temporary file and returns the report,
+// as the scanners log to the same output otherwise
+func runToFile(runner v1.Runner, name string, args func(report string) []string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "enki-vulnscan-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.json")
+	if out, err := runner.Run(name, args(report)...); err != nil {
+		return nil, fmt.Errorf("running %s: %w\n%s", name, err, string(out))
+	}
+	return os.ReadFile(report)
+}
+
+type grype struct {
+	runner v1.Runner
+}
+
+func (g *grype) Binary() string {
+	return Grype
+}
+
+func (g *grype) Scan(src *v1.ImageSource) ([]Vulnerability, error) {
+	var target string
+	switch {
+	case src.IsDocker():
+		target = src.Value()
+	case src.IsDir():
+		target = "dir:" + src.Value()
+	default:
+		return nil, fmt.Errorf("can't scan %s, only container images and dirs can be scanned", src.String())
+	}
+	data, err := runToFile(g.runner, Grype, func(report string) []string {
+		return []string{"--quiet", "--output", "json", "--file", report, target}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var report struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+				Fix      struct {
+					Versions []string `json:"versions"`
+				} `json:"fix"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("parsing the grype report: %w", err)
+	}
+	var vulns []Vulnerability
+	for _, m := range report.Matches {
+		severity, _ := ParseSeverity(m.Vulnerability.Severity)
+		vulns = append(vulns, Vulnerability{
+			ID:       m.Vulnerability.ID,
+			Package:  m.Artifact.Name,
+			Version:  m.Artifact.Version,
+			Severity: severity,
+			FixedIn:  strings.Join(m.Vulnerability.Fix.Versions, ", "),
+		})
+	}
+	return vulns, nil
+}
+
+type trivy struct {
+	runner v1.Runner
+}
+
+func (t *trivy) Binary() string {
+	return Trivy
+}
+
+func (t *trivy) Scan(src *v1.ImageSource) ([]Vulnerability, error) {
+	var subcommand string
+	switch {
+	case src.IsDocker():
+		subcommand = "image"
+	case src.IsDir():
+		subcommand = "rootfs"
+	default:
+		return nil, fmt.Errorf("can't scan %s, only container images and dirs can be scanned", src.String())
+	}
+	data, err := runToFile(t.runner, Trivy, func(report string) []string {
+		return []string{subcommand, "--quiet", "--scanners", "vuln", "--format", "json", "--output", report, src.Value()}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var report struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string `json:"VulnerabilityID"`
+				PkgName          string `json:"PkgName"`
+				InstalledVersion string `json:"InstalledVersion"`
+				FixedVersion     string `json:"FixedVersion"`
+				Severity         string `json:"Severity"`
+			} `json:"Vulnerabilities"`
+		} `json:"Results"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("parsing the trivy report: %w", err)
+	}
+	var vulns []Vulnerability
+	for _, r := range report.Results {
+		for _, v := range r.Vulnerabilities {
+			severity, _ := ParseSeverity(v.Severity)
+			vulns = append(vulns, Vulnerability{
+				ID:       v.VulnerabilityID,
+				Package:  v.PkgName,
+				Version:  v.InstalledVersion,
+				Severity: severity,
+				FixedIn:  v.FixedVersion,
+			})
+		}
+	}
+	return vulns, nil
+}
@@ -0,0 +1,13 @@
+package vulnscan_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestVulnscan(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Vulnscan test suite")
+}
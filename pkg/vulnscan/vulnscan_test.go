@@ -0,0 +1,81 @@
+package vulnscan_test
+
+import (
+	"os"
+
+	"github.com/kairos-io/enki/pkg/vulnscan"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writeReport makes the fake runner write report to the file after the given flag
+func writeReport(runner *v1mock.FakeRunner, flag, report string) {
+	runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+		for i, arg := range args {
+			if arg == flag {
+				return nil, os.WriteFile(args[i+1], []byte(report), 0644)
+			}
+		}
+		return nil, nil
+	}
+}
+
+var _ = Describe("Vulnscan", Label("vulnscan"), func() {
+	var runner *v1mock.FakeRunner
+	var src *v1.ImageSource
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		runner.SetLogger(v1.NewNullLogger())
+		var err error
+		src, err = v1.NewSrcFromURI("quay.io/kairos/core:latest")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("scans images with grype", func() {
+		writeReport(runner, "--file", `{"matches": [
+			{"vulnerability": {"id": "CVE-2023-0001", "severity": "Medium", "fix": {"versions": []}}, "artifact": {"name": "bash", "version": "5.1"}},
+			{"vulnerability": {"id": "CVE-2023-0002", "severity": "Critical", "fix": {"versions": ["3.0.2"]}}, "artifact": {"name": "openssl", "version": "3.0.1"}}
+		]}`)
+		scanner, err := vulnscan.New(vulnscan.Grype, runner)
+		Expect(err).ToNot(HaveOccurred())
+		vulns, err := scanner.Scan(src)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vulns).To(HaveLen(2))
+		Expect(runner.IncludesCmds([][]string{{"grype", "--quiet", "--output", "json", "--file"}})).To(Succeed())
+
+		critical := vulnscan.AtLeast(vulns, vulnscan.SeverityHigh)
+		Expect(critical).To(Equal([]vulnscan.Vulnerability{
+			{ID: "CVE-2023-0002", Package: "openssl", Version: "3.0.1", Severity: vulnscan.SeverityCritical, FixedIn: "3.0.2"},
+		}))
+		Expect(critical[0].String()).To(Equal("CVE-2023-0002 [critical] in openssl 3.0.1, fixed in 3.0.2"))
+	})
+
+	It("scans rootfs dirs with trivy", func() {
+		writeReport(runner, "--output", `{"Results": [{"Vulnerabilities": [
+			{"VulnerabilityID": "CVE-2023-0003", "PkgName": "zlib", "InstalledVersion": "1.2", "Severity": "HIGH"}
+		]}]}`)
+		scanner, err := vulnscan.New(vulnscan.Trivy, runner)
+		Expect(err).ToNot(HaveOccurred())
+		vulns, err := scanner.Scan(v1.NewDirSrc("/rootfs"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vulns).To(Equal([]vulnscan.Vulnerability{
+			{ID: "CVE-2023-0003", Package: "zlib", Version: "1.2", Severity: vulnscan.SeverityHigh},
+		}))
+		Expect(runner.IncludesCmds([][]string{{"trivy", "rootfs"}})).To(Succeed())
+	})
+
+	It("rejects unknown scanners, severities and sources", func() {
+		_, err := vulnscan.New("clair", runner)
+		Expect(err).To(HaveOccurred())
+		_, err = vulnscan.ParseSeverity("severe")
+		Expect(err).To(HaveOccurred())
+
+		scanner, err := vulnscan.New(vulnscan.Grype, runner)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = scanner.Scan(v1.NewFileSrc("/rootfs.img"))
+		Expect(err).To(MatchError(ContainSubstring("only container images and dirs can be scanned")))
+	})
+})
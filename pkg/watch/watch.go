@@ -0,0 +1,168 @@
+// Package watch runs a build again every time its inputs change, so developers iterating on the
+// branding, cmdlines or configs of their artifacts see the result without running enki by hand.
+package watch
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// Debounce is how long the inputs must stay unchanged before building again, as editors and
+// copies write files in several steps
+var Debounce = 500 * time.Millisecond
+
+// file is the state of a watched file, a change of any field triggers a build
+type file struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+// Run runs build and then again every time any of the files or dirs of paths change, until ctx
+// is done. Paths that don't exist yet are built once they are created. build is given the files
+// changed since the previous build, or nil for the first build and the ones after a failed build,
+// which must build everything. The build errors are logged, not returned, as the next change may
+// fix them.
+func Run(ctx context.Context, logger v1.Logger, paths []string, build func(changed []string) error) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for _, path := range paths {
+		if err := add(w, path); err != nil {
+			return err
+		}
+	}
+
+	state := snapshot(paths)
+	failed := true
+	run := func(changed []string) {
+		// The artifacts a failed build didn't write are not up to date whatever changes
+		if failed {
+			changed = nil
+		}
+		if err := build(changed); err != nil {
+			failed = true
+			logger.Errorf("Build failed: %s", err)
+		} else {
+			failed = false
+			logger.Info("Build done")
+		}
+		logger.Infof("Watching %s for changes", strings.Join(paths, ", "))
+	}
+	run(nil)
+	var timer *time.Timer
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			// New dirs within the watched dirs are watched too
+			if event.Has(fsnotify.Create) && watched(paths, event.Name) {
+				_ = add(w, event.Name)
+			}
+			if timer == nil {
+				timer = time.NewTimer(Debounce)
+			} else {
+				timer.Reset(Debounce)
+			}
+			fire = timer.C
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Warnf("Watching for changes: %s", err)
+		case <-fire:
+			fire = nil
+			current := snapshot(paths)
+			// Events on the other files of the dirs of watched files, or files written again
+			// as they were, don't need a build
+			if maps.Equal(current, state) {
+				continue
+			}
+			changed := diff(state, current)
+			state = current
+			logger.Infof("Changes detected in %s, building again", strings.Join(changed, ", "))
+			run(changed)
+		}
+	}
+}
+
+// add watches path, along with all the dirs below it if it's a dir. Files are watched through
+// their dir, as editors replace them rather than writing them in place.
+func add(w *fsnotify.Watcher, path string) error {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		// Files are watched through their dir, which holds the ones to be created too
+		dir := filepath.Dir(path)
+		if _, statErr := os.Stat(dir); errors.Is(statErr, fs.ErrNotExist) {
+			return statErr
+		}
+		return w.Add(dir)
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return w.Add(p)
+	})
+}
+
+// watched tells if name is one of the paths or below them
+func watched(paths []string, name string) bool {
+	for _, path := range paths {
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns the state of the files of paths, the dirs walked
+func snapshot(paths []string) map[string]file {
+	state := map[string]file{}
+	for _, path := range paths {
+		_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				state[p] = file{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+			}
+			return nil
+		})
+	}
+	return state
+}
+
+// diff returns the sorted files added, removed or changed between the previous and current states
+func diff(previous, current map[string]file) []string {
+	var changed []string
+	for path, f := range current {
+		if old, ok := previous[path]; !ok || old != f {
+			changed = append(changed, path)
+		}
+	}
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
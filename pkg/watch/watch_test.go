@@ -0,0 +1,96 @@
+package watch_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/watch"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Run", func() {
+	var dir string
+	var builds atomic.Int32
+	var changes chan []string
+	var fail atomic.Bool
+	var cancel context.CancelFunc
+	var done chan error
+
+	start := func(paths ...string) {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() {
+			done <- watch.Run(ctx, v1.NewNullLogger(), paths, func(changed []string) error {
+				builds.Add(1)
+				changes <- changed
+				if fail.Load() {
+					return errors.New("missing kernel")
+				}
+				return nil
+			})
+		}()
+		Eventually(builds.Load).Should(Equal(int32(1)))
+		Expect(<-changes).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		builds.Store(0)
+		changes = make(chan []string, 10)
+		fail.Store(false)
+		watch.Debounce = 50 * time.Millisecond
+		Expect(os.MkdirAll(filepath.Join(dir, "overlay", "etc"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte("arch: x86_64\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("builds again when a watched file changes", func() {
+		start(filepath.Join(dir, "manifest.yaml"))
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte("arch: arm64\n"), 0644)).To(Succeed())
+		Eventually(builds.Load).Should(Equal(int32(2)))
+		Expect(<-changes).To(Equal([]string{filepath.Join(dir, "manifest.yaml")}))
+	})
+
+	It("builds everything again after a failed build", func() {
+		fail.Store(true)
+		start(filepath.Join(dir, "overlay"))
+		fail.Store(false)
+		Expect(os.WriteFile(filepath.Join(dir, "overlay", "etc", "motd"), []byte("hi"), 0644)).To(Succeed())
+		Eventually(builds.Load).Should(Equal(int32(2)))
+		Expect(<-changes).To(BeNil())
+		Expect(os.WriteFile(filepath.Join(dir, "overlay", "etc", "motd"), []byte("hello"), 0644)).To(Succeed())
+		Eventually(builds.Load).Should(Equal(int32(3)))
+		Expect(<-changes).To(ContainElement(filepath.Join(dir, "overlay", "etc", "motd")))
+	})
+
+	It("builds again when a file is created below a watched dir", func() {
+		start(filepath.Join(dir, "overlay"))
+		Expect(os.MkdirAll(filepath.Join(dir, "overlay", "etc", "new"), 0755)).To(Succeed())
+		Eventually(builds.Load).Should(Equal(int32(2)))
+		Expect(os.WriteFile(filepath.Join(dir, "overlay", "etc", "new", "motd"), []byte("hi"), 0644)).To(Succeed())
+		Eventually(builds.Load).Should(Equal(int32(3)))
+	})
+
+	It("doesn't build again for the other files of the dir of a watched file", func() {
+		start(filepath.Join(dir, "manifest.yaml"))
+		Expect(os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("unrelated"), 0644)).To(Succeed())
+		Consistently(builds.Load, 300*time.Millisecond).Should(Equal(int32(1)))
+	})
+
+	It("builds once the watched files are created", func() {
+		start(filepath.Join(dir, "install.yaml"))
+		Expect(os.WriteFile(filepath.Join(dir, "install.yaml"), []byte("#cloud-config\n"), 0644)).To(Succeed())
+		Eventually(builds.Load).Should(Equal(int32(2)))
+	})
+})
@@ -0,0 +1,40 @@
+package wizard
+
+import (
+	"fmt"
+
+	"github.com/pterm/pterm"
+)
+
+// Terminal is the interactive Prompter of the terminal
+type Terminal struct{}
+
+func (Terminal) Select(question string, options []string, def string) (string, error) {
+	return pterm.DefaultInteractiveSelect.WithOptions(options).WithDefaultOption(def).Show(question)
+}
+
+func (Terminal) Input(question string, def string, validate func(string) error) (string, error) {
+	if def != "" {
+		question = fmt.Sprintf("%s [%s]", question, def)
+	}
+	for {
+		answer, err := pterm.DefaultInteractiveTextInput.Show(question)
+		if err != nil {
+			return "", err
+		}
+		if answer == "" {
+			answer = def
+		}
+		if validate == nil {
+			return answer, nil
+		}
+		if err = validate(answer); err == nil {
+			return answer, nil
+		}
+		pterm.Warning.Println(err.Error())
+	}
+}
+
+func (Terminal) Confirm(question string, def bool) (bool, error) {
+	return pterm.DefaultInteractiveConfirm.WithDefaultValue(def).Show(question)
+}
@@ -0,0 +1,190 @@
+// Package wizard asks the questions of enki init and turns the answers into a build manifest
+// along with the commands that build it.
+package wizard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ManifestName is the file in the config dir enki reads the build config from
+	ManifestName = "manifest.yaml"
+
+	ArtifactISO = "iso"
+	ArtifactUKI = "uki"
+)
+
+// Prompter asks the user the questions of the wizard
+type Prompter interface {
+	// Select asks to pick one of the options
+	Select(question string, options []string, def string) (string, error)
+	// Input asks for a free text answer, def is returned for empty answers. validate, if given,
+	// rejects answers until a valid one is given.
+	Input(question string, def string, validate func(string) error) (string, error)
+	// Confirm asks a yes or no question
+	Confirm(question string, def bool) (bool, error)
+}
+
+// Answers are the choices made in the wizard
+type Answers struct {
+	// Artifact is ArtifactISO for installation media or ArtifactUKI for Trusted Boot
+	Artifact string
+	Source   string
+	Arch     string
+	// OutputType is the output-type of build-uki
+	OutputType string
+	OutputDir  string
+	// KeysDir is the directory with the Secure Boot keys, only for UKIs
+	KeysDir string
+	// KeysName is the name the keys are generated for if the keys dir doesn't exist yet
+	KeysName string
+	// Cmdline extends the default kernel cmdline of UKIs
+	Cmdline string
+}
+
+// Ask walks the user through the wizard
+func Ask(p Prompter) (*Answers, error) {
+	a := &Answers{}
+	artifacts := []string{
+		"iso - installation media booting with GRUB",
+		"uki - Trusted Boot with signed Unified Kernel Images",
+	}
+	artifact, err := p.Select("What do you want to build?", artifacts, artifacts[0])
+	if err != nil {
+		return nil, err
+	}
+	a.Artifact, _, _ = strings.Cut(artifact, " ")
+
+	a.Source, err = p.Input("Source image, e.g. quay.io/kairos/opensuse:leap-15.5-standard-amd64-generic-v3.0.0 or dir:/path/to/rootfs", "", validateSource)
+	if err != nil {
+		return nil, err
+	}
+
+	arch, err := utils.GolangArchToArch(runtime.GOARCH)
+	if err != nil {
+		arch = constants.Archx86
+	}
+	a.Arch, err = p.Select("Architecture", []string{constants.Archx86, constants.ArchArm64}, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	a.OutputDir, err = p.Input("Output directory", "build", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Artifact == ArtifactUKI {
+		if err = a.askUKI(p); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *Answers) askUKI(p Prompter) error {
+	var err error
+	a.OutputType, err = p.Select("UKI output type", constants.OutPutTypes(), string(constants.DefaultOutput))
+	if err != nil {
+		return err
+	}
+	a.KeysDir, err = p.Input("Secure Boot keys directory, new keys are generated if it doesn't exist", "keys", nil)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(a.KeysDir); err != nil {
+		a.KeysName, err = p.Input("Name to generate the keys for", "kairos", validateNotEmpty)
+		if err != nil {
+			return err
+		}
+	}
+	a.Cmdline, err = p.Input("Extra kernel cmdline, empty to keep the default one", "", nil)
+	return err
+}
+
+func validateSource(s string) error {
+	if err := validateNotEmpty(s); err != nil {
+		return err
+	}
+	_, err := v1.NewSrcFromURI(s)
+	return err
+}
+
+func validateNotEmpty(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return fmt.Errorf("a value is required")
+	}
+	return nil
+}
+
+// Manifest returns the manifest.yaml document with the answers
+func (a *Answers) Manifest() ([]byte, error) {
+	m := map[string]any{
+		"arch": a.Arch,
+	}
+	switch a.Artifact {
+	case ArtifactISO:
+		m["output"] = a.OutputDir
+		m["iso"] = map[string]any{
+			"rootfs": []string{a.Source},
+		}
+	case ArtifactUKI:
+		m["output-dir"] = a.OutputDir
+		m["output-type"] = a.OutputType
+		m["keys"] = a.KeysDir
+		if a.Cmdline != "" {
+			m["extend-cmdline"] = a.Cmdline
+		}
+	default:
+		return nil, fmt.Errorf("unknown artifact %q", a.Artifact)
+	}
+	return yaml.Marshal(m)
+}
+
+// WriteManifest writes the manifest into configDir, returning its path
+func (a *Answers) WriteManifest(fs v1.FS, configDir string) (string, error) {
+	data, err := a.Manifest()
+	if err != nil {
+		return "", err
+	}
+	if err = utils.MkdirAll(fs, configDir, constants.DirPerm); err != nil {
+		return "", err
+	}
+	path := filepath.Join(configDir, ManifestName)
+	return path, fs.WriteFile(path, data, constants.FilePerm)
+}
+
+// Commands returns the enki arguments that build the artifact with the manifest in configDir,
+// starting with the generation of the keys if needed
+func (a *Answers) Commands(configDir string) [][]string {
+	var cmds [][]string
+	switch a.Artifact {
+	case ArtifactISO:
+		// The source, output and arch come from the manifest
+		cmds = append(cmds, []string{"--config-dir", configDir, "build-iso"})
+	case ArtifactUKI:
+		if a.KeysName != "" {
+			cmds = append(cmds, []string{"genkey", a.KeysName, "--output", a.KeysDir})
+		}
+		build := []string{
+			"--config-dir", configDir, "build-uki", a.Source,
+			"--keys", a.KeysDir,
+			"--output-dir", a.OutputDir,
+			"--output-type", a.OutputType,
+		}
+		if a.Cmdline != "" {
+			build = append(build, "--extend-cmdline", a.Cmdline)
+		}
+		cmds = append(cmds, build)
+	}
+	return cmds
+}
@@ -0,0 +1,155 @@
+package wizard_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/wizard"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/twpayne/go-vfs"
+	"gopkg.in/yaml.v3"
+)
+
+// scripted answers the questions with the first answer whose key is contained in the question
+type scripted struct {
+	answers map[string]string
+	asked   []string
+}
+
+func (s *scripted) answer(question string) (string, error) {
+	s.asked = append(s.asked, question)
+	for key, answer := range s.answers {
+		if strings.Contains(question, key) {
+			return answer, nil
+		}
+	}
+	return "", fmt.Errorf("unexpected question %q", question)
+}
+
+func (s *scripted) Select(question string, options []string, def string) (string, error) {
+	answer, err := s.answer(question)
+	if err != nil {
+		return "", err
+	}
+	for _, o := range options {
+		if strings.HasPrefix(o, answer) {
+			return o, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not an option of %q", answer, question)
+}
+
+func (s *scripted) Input(question string, def string, validate func(string) error) (string, error) {
+	answer, err := s.answer(question)
+	if err != nil {
+		return "", err
+	}
+	if answer == "" {
+		answer = def
+	}
+	if validate != nil {
+		if err = validate(answer); err != nil {
+			return "", err
+		}
+	}
+	return answer, nil
+}
+
+func (s *scripted) Confirm(question string, def bool) (bool, error) {
+	answer, err := s.answer(question)
+	return answer == "yes", err
+}
+
+var _ = Describe("Wizard", Label("wizard"), func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "enki-wizard")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		viper.Reset()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+	It("writes an ISO manifest build-iso can read", func() {
+		p := &scripted{answers: map[string]string{
+			"build?":       "iso",
+			"Source image": "quay.io/kairos/opensuse:latest",
+			"Architecture": "arm64",
+			"Output":       "",
+		}}
+		answers, err := wizard.Ask(p)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p.asked).To(HaveLen(4))
+
+		_, err = answers.WriteManifest(vfs.OSFS, dir)
+		Expect(err).ToNot(HaveOccurred())
+		cfg, err := config.ReadConfigBuild(dir, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Arch).To(Equal("arm64"))
+		Expect(cfg.OutDir).To(Equal("build"))
+		spec, err := config.ReadBuildISO(cfg, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(spec.RootFS).To(HaveLen(1))
+		Expect(spec.RootFS[0].Value()).To(Equal("quay.io/kairos/opensuse:latest"))
+
+		Expect(answers.Commands(dir)).To(Equal([][]string{{"--config-dir", dir, "build-iso"}}))
+	})
+	It("generates the keys of UKIs if missing", func() {
+		keys := filepath.Join(dir, "keys")
+		p := &scripted{answers: map[string]string{
+			"build?":         "uki",
+			"Source image":   "dir:/rootfs",
+			"Architecture":   "x86_64",
+			"Output":         "out",
+			"output type":    "iso",
+			"keys directory": keys,
+			"Name":           "mykeys",
+			"cmdline":        "console=ttyS0",
+		}}
+		answers, err := wizard.Ask(p)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(answers.KeysName).To(Equal("mykeys"))
+
+		data, err := answers.Manifest()
+		Expect(err).ToNot(HaveOccurred())
+		manifest := map[string]any{}
+		Expect(yaml.Unmarshal(data, &manifest)).To(Succeed())
+		Expect(manifest).To(HaveKeyWithValue("output-type", "iso"))
+		Expect(manifest).To(HaveKeyWithValue("keys", keys))
+		Expect(manifest).To(HaveKeyWithValue("extend-cmdline", "console=ttyS0"))
+
+		Expect(answers.Commands(dir)).To(Equal([][]string{
+			{"genkey", "mykeys", "--output", keys},
+			{"--config-dir", dir, "build-uki", "dir:/rootfs", "--keys", keys, "--output-dir", "out", "--output-type", "iso", "--extend-cmdline", "console=ttyS0"},
+		}))
+	})
+	It("uses existing keys", func() {
+		p := &scripted{answers: map[string]string{
+			"build?":         "uki",
+			"Source image":   "dir:/rootfs",
+			"Architecture":   "x86_64",
+			"Output":         "",
+			"output type":    "uki",
+			"keys directory": dir,
+			"cmdline":        "",
+		}}
+		answers, err := wizard.Ask(p)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(answers.KeysName).To(BeEmpty())
+		Expect(answers.Commands(dir)).To(HaveLen(1))
+	})
+	It("rejects empty sources", func() {
+		p := &scripted{answers: map[string]string{
+			"build?":       "iso",
+			"Source image": "",
+		}}
+		_, err := wizard.Ask(p)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,198 @@
+// Package workdir places the work area of each stage of a build on tmpfs, fast but taking RAM,
+// or on disk, slower but only bound by its free space. Builds of large images thrash a small
+// /tmp tmpfs, while small ones waste the RAM of machines with /tmp on tmpfs.
+package workdir
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Temp keeps the work area in the temp dir, TMPDIR or /tmp, whatever it is on, the default
+	Temp = "temp"
+	// Tmpfs places the work area in the tmpfs dir
+	Tmpfs = "tmpfs"
+	// Disk places the work area in the disk dir
+	Disk = "disk"
+	// Auto places the work area on tmpfs if it fits in the available RAM, on disk otherwise
+	Auto = "auto"
+
+	// Rootfs is the stage holding the extracted source image
+	Rootfs = "rootfs"
+	// Artifacts is the stage holding the kernel, initrd and the files built out of them
+	Artifacts = "artifacts"
+	// Media is the stage holding the ISO and container layouts before they are written
+	Media = "media"
+
+	// DefaultTmpfsDir is where the tmpfs work areas live by default
+	DefaultTmpfsDir = "/dev/shm"
+	// DefaultDiskDir is where the disk work areas live by default, a temp dir not cleared on
+	// boot and usually not on tmpfs
+	DefaultDiskDir = "/var/tmp"
+)
+
+// estimates are the typical sizes of the work area of each stage for a Kairos image, auto only
+// places the stages fitting in half of the available RAM on tmpfs
+var estimates = map[string]int64{
+	Rootfs:    4 << 30,
+	Artifacts: 512 << 20,
+	Media:     2 << 30,
+}
+
+// Backends returns the backends the work areas can live on
+func Backends() []string {
+	return []string{Temp, Tmpfs, Disk, Auto}
+}
+
+// Stages returns the stages of a build with a work area of their own
+func Stages() []string {
+	return []string{Rootfs, Artifacts, Media}
+}
+
+// Config tells the backend of each stage, and where the backends live
+type Config struct {
+	Backends map[string]string
+	TmpfsDir string
+	DiskDir  string
+}
+
+// Parse returns the config of the given specs, each one either a backend for every stage or a
+// STAGE=BACKEND pair, later ones overriding earlier ones, like auto,rootfs=disk
+func Parse(specs []string, tmpfsDir, diskDir string) (Config, error) {
+	c := Config{Backends: map[string]string{}, TmpfsDir: tmpfsDir, DiskDir: diskDir}
+	if c.TmpfsDir == "" {
+		c.TmpfsDir = DefaultTmpfsDir
+	}
+	if c.DiskDir == "" {
+		c.DiskDir = DefaultDiskDir
+	}
+	for _, stage := range Stages() {
+		c.Backends[stage] = Temp
+	}
+	for _, spec := range specs {
+		stage, backend, perStage := strings.Cut(spec, "=")
+		if !perStage {
+			backend = stage
+		}
+		if !slices.Contains(Backends(), backend) {
+			return c, fmt.Errorf("invalid workdir backend %q, available backends: %s", backend, strings.Join(Backends(), ", "))
+		}
+		if !perStage {
+			for _, stage := range Stages() {
+				c.Backends[stage] = backend
+			}
+			continue
+		}
+		if !slices.Contains(Stages(), stage) {
+			return c, fmt.Errorf("invalid workdir stage %q, available stages: %s", stage, strings.Join(Stages(), ", "))
+		}
+		c.Backends[stage] = backend
+	}
+	return c, nil
+}
+
+// Resources are the room auto places the work areas in
+type Resources struct {
+	// Memory is the available RAM in bytes
+	Memory int64
+	// Free returns the free bytes of the filesystem holding dir
+	Free func(dir string) (int64, error)
+}
+
+// Detect returns the resources of the machine, out of /proc/meminfo
+func Detect() (Resources, error) {
+	res := Resources{Free: free}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return res, fmt.Errorf("invalid MemAvailable in /proc/meminfo: %w", err)
+			}
+			res.Memory = kb << 10
+			return res, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return res, err
+	}
+	return res, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
+
+// free returns the free bytes of the filesystem holding dir
+func free(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * st.Bsize, nil
+}
+
+// Placement is the parent dir of the work area of each stage, for os.MkdirTemp. The stages in
+// the temp dir, and the ones missing, have an empty dir.
+type Placement map[string]string
+
+// Place resolves the backend of each stage to its dir. The auto stages go on tmpfs as long as
+// they fit, together with the other tmpfs stages, in half of the available memory and in the
+// free space of the tmpfs dir, the smallest stages first, and on disk otherwise.
+func (c Config) Place(res Resources) Placement {
+	p := Placement{}
+	var auto []string
+	var tmpfs int64
+	for stage, backend := range c.Backends {
+		switch backend {
+		case Tmpfs:
+			p[stage] = c.TmpfsDir
+			tmpfs += estimates[stage]
+		case Disk:
+			p[stage] = c.DiskDir
+		case Auto:
+			auto = append(auto, stage)
+		}
+	}
+	if len(auto) == 0 {
+		return p
+	}
+	room := res.Memory / 2
+	if res.Free != nil {
+		if free, err := res.Free(c.TmpfsDir); err != nil {
+			room = 0
+		} else if free < room {
+			room = free
+		}
+	}
+	room -= tmpfs
+	sort.Slice(auto, func(i, j int) bool { return estimates[auto[i]] < estimates[auto[j]] })
+	for _, stage := range auto {
+		if estimates[stage] <= room {
+			p[stage] = c.TmpfsDir
+			room -= estimates[stage]
+			continue
+		}
+		p[stage] = c.DiskDir
+	}
+	return p
+}
+
+// Dirs returns the parent dir of the work area of each stage, in the order of Stages, empty for
+// the ones in the temp dir
+func (p Placement) Dirs() []string {
+	dirs := make([]string, 0, len(Stages()))
+	for _, stage := range Stages() {
+		dirs = append(dirs, p[stage])
+	}
+	return dirs
+}
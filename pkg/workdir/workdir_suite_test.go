@@ -0,0 +1,13 @@
+package workdir_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestWorkdir(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Workdir test suite")
+}
@@ -0,0 +1,78 @@
+package workdir_test
+
+import (
+	"github.com/kairos-io/enki/pkg/workdir"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// freeSpace makes every dir have the given free bytes
+func freeSpace(size int64) func(string) (int64, error) {
+	return func(string) (int64, error) { return size, nil }
+}
+
+var _ = Describe("Workdir", Label("workdir"), func() {
+	It("keeps every work area in the temp dir by default", func() {
+		c, err := workdir.Parse(nil, "", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.TmpfsDir).To(Equal(workdir.DefaultTmpfsDir))
+		Expect(c.DiskDir).To(Equal(workdir.DefaultDiskDir))
+		Expect(c.Place(workdir.Resources{Memory: 64 << 30})).To(BeEmpty())
+	})
+
+	It("places each stage on its own backend", func() {
+		c, err := workdir.Parse([]string{"disk", "artifacts=tmpfs", "media=temp"}, "/run/enki", "/srv/enki")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Place(workdir.Resources{})).To(Equal(workdir.Placement{
+			workdir.Rootfs:    "/srv/enki",
+			workdir.Artifacts: "/run/enki",
+		}))
+	})
+
+	It("lists the dirs of the stages", func() {
+		p := workdir.Placement{workdir.Rootfs: "/srv/enki", workdir.Media: "/run/enki"}
+		Expect(p.Dirs()).To(Equal([]string{"/srv/enki", "", "/run/enki"}))
+		Expect(workdir.Placement(nil).Dirs()).To(Equal([]string{"", "", ""}))
+	})
+
+	It("places the auto stages on tmpfs while they fit in half of the available memory", func() {
+		c, err := workdir.Parse([]string{"auto"}, "", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Place(workdir.Resources{Memory: 32 << 30, Free: freeSpace(16 << 30)})).To(Equal(workdir.Placement{
+			workdir.Rootfs:    workdir.DefaultTmpfsDir,
+			workdir.Artifacts: workdir.DefaultTmpfsDir,
+			workdir.Media:     workdir.DefaultTmpfsDir,
+		}))
+		// The smallest stages go first
+		Expect(c.Place(workdir.Resources{Memory: 8 << 30, Free: freeSpace(16 << 30)})).To(Equal(workdir.Placement{
+			workdir.Rootfs:    workdir.DefaultDiskDir,
+			workdir.Artifacts: workdir.DefaultTmpfsDir,
+			workdir.Media:     workdir.DefaultTmpfsDir,
+		}))
+		// A small tmpfs is not thrashed whatever the memory
+		Expect(c.Place(workdir.Resources{Memory: 32 << 30, Free: freeSpace(1 << 30)})).To(Equal(workdir.Placement{
+			workdir.Rootfs:    workdir.DefaultDiskDir,
+			workdir.Artifacts: workdir.DefaultTmpfsDir,
+			workdir.Media:     workdir.DefaultDiskDir,
+		}))
+		// Without knowing the memory everything goes on disk
+		Expect(c.Place(workdir.Resources{})).To(HaveEach(workdir.DefaultDiskDir))
+	})
+
+	It("counts the tmpfs stages in the room of the auto ones", func() {
+		c, err := workdir.Parse([]string{"auto", "rootfs=tmpfs"}, "", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Place(workdir.Resources{Memory: 10 << 30, Free: freeSpace(16 << 30)})).To(Equal(workdir.Placement{
+			workdir.Rootfs:    workdir.DefaultTmpfsDir,
+			workdir.Artifacts: workdir.DefaultTmpfsDir,
+			workdir.Media:     workdir.DefaultDiskDir,
+		}))
+	})
+
+	It("rejects unknown backends and stages", func() {
+		_, err := workdir.Parse([]string{"ramdisk"}, "", "")
+		Expect(err).To(MatchError(ContainSubstring(`invalid workdir backend "ramdisk"`)))
+		_, err = workdir.Parse([]string{"squashfs=disk"}, "", "")
+		Expect(err).To(MatchError(ContainSubstring(`invalid workdir stage "squashfs"`)))
+	})
+})
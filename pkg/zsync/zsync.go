@@ -0,0 +1,172 @@
+// Package zsync generates zsync control files, which let clients fetch over HTTP range
+// requests only the blocks of an artifact that changed since the copy they already have.
+package zsync
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	// Version is the zsync control file format version we generate
+	Version = "0.6.2"
+	// Extension is appended to the artifact name to get the control file name
+	Extension = ".zsync"
+	// smallBlocksize is used for artifacts smaller than largeFile, same as zsyncmake does
+	smallBlocksize = 2048
+	largeBlocksize = 4096
+	largeFile      = 100 * 1024 * 1024
+)
+
+// Options of the generated control file
+type Options struct {
+	// Filename is the name clients save the artifact as
+	Filename string
+	// URL where the artifact is downloaded from, relative to the control file URL
+	URL string
+	// MTime of the artifact
+	MTime time.Time
+	// Blocksize of the chunks, 0 picks the zsyncmake default for the artifact length
+	Blocksize int
+}
+
+// blockSum holds the full length checksums of a block, truncated when written
+type blockSum struct {
+	rsum     [4]byte
+	checksum [md4.Size]byte
+}
+
+// Write reads the artifact from r and writes its zsync control file into w. The blocksize
+// must be known upfront, so when Options.Blocksize is 0 the length of the artifact is needed.
+func Write(w io.Writer, r io.Reader, length int64, opts Options) error {
+	blocksize := opts.Blocksize
+	if blocksize == 0 {
+		blocksize = smallBlocksize
+		if length >= largeFile {
+			blocksize = largeBlocksize
+		}
+	}
+
+	sha := sha1.New()
+	reader := bufio.NewReaderSize(io.TeeReader(r, sha), blocksize*16)
+	block := make([]byte, blocksize)
+	var sums []blockSum
+	var total int64
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			total += int64(n)
+			// The last block is zero padded
+			for i := n; i < blocksize; i++ {
+				block[i] = 0
+			}
+			sums = append(sums, sumBlock(block))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	seqMatches, rsumLen, checksumLen := hashLengths(total, blocksize)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "zsync: %s\n", Version)
+	fmt.Fprintf(bw, "Filename: %s\n", opts.Filename)
+	if !opts.MTime.IsZero() {
+		fmt.Fprintf(bw, "MTime: %s\n", opts.MTime.UTC().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	}
+	fmt.Fprintf(bw, "Blocksize: %d\n", blocksize)
+	fmt.Fprintf(bw, "Length: %d\n", total)
+	fmt.Fprintf(bw, "Hash-Lengths: %d,%d,%d\n", seqMatches, rsumLen, checksumLen)
+	url := opts.URL
+	if url == "" {
+		url = opts.Filename
+	}
+	fmt.Fprintf(bw, "URL: %s\n", url)
+	fmt.Fprintf(bw, "SHA-1: %s\n\n", hex.EncodeToString(sha.Sum(nil)))
+	for _, s := range sums {
+		if _, err := bw.Write(s.rsum[4-rsumLen:]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(s.checksum[:checksumLen]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteFile generates the control file for the given artifact next to it and returns its path
+func WriteFile(fs v1.FS, artifact string) (string, error) {
+	f, err := fs.Open(artifact)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	controlFile := artifact + Extension
+	out, err := fs.Create(controlFile)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(artifact)
+	err = Write(out, f, info.Size(), Options{Filename: name, URL: name, MTime: info.ModTime()})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return controlFile, err
+}
+
+// sumBlock computes the rolling checksum and the MD4 of a block. The rolling checksum is
+// stored big endian as a 16 bits sum of the bytes followed by the 16 bits weighted sum.
+func sumBlock(block []byte) blockSum {
+	var a, b uint16
+	l := uint16(len(block))
+	for i, c := range block {
+		a += uint16(c)
+		b += (l - uint16(i)) * uint16(c)
+	}
+	var s blockSum
+	binary.BigEndian.PutUint16(s.rsum[0:2], a)
+	binary.BigEndian.PutUint16(s.rsum[2:4], b)
+	h := md4.New()
+	h.Write(block)
+	copy(s.checksum[:], h.Sum(nil))
+	return s
+}
+
+// hashLengths returns how many bytes of each checksum are needed so clients don't get false
+// block matches, using the same heuristic as zsyncmake
+func hashLengths(length int64, blocksize int) (seqMatches, rsumLen, checksumLen int) {
+	seqMatches = 1
+	if length > int64(blocksize) {
+		seqMatches = 2
+	}
+	l := math.Max(float64(length), 1)
+	bs := float64(blocksize)
+	blocks := float64(length / int64(blocksize))
+
+	rsumLen = int(math.Ceil(((math.Log(l)+math.Log(bs))/math.Log(2) - 8.6) / float64(seqMatches) / 8))
+	rsumLen = min(max(rsumLen, 2), 4)
+
+	checksumLen = int(math.Ceil((20 + (math.Log(l)+math.Log(1+blocks))/math.Log(2)) / float64(seqMatches) / 8))
+	checksumLen2 := int((7.9 + (20 + math.Log(1+blocks)/math.Log(2))) / 8)
+	checksumLen = min(max(checksumLen, checksumLen2), md4.Size)
+	return seqMatches, rsumLen, checksumLen
+}
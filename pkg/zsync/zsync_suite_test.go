@@ -0,0 +1,13 @@
+package zsync_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestZsync(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Zsync test suite")
+}
@@ -0,0 +1,50 @@
+package zsync_test
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/zsync"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Zsync", Label("zsync"), func() {
+	It("writes the header and the block checksums", func() {
+		data := bytes.Repeat([]byte{1}, 2048+10)
+		var out bytes.Buffer
+		err := zsync.Write(&out, bytes.NewReader(data), int64(len(data)), zsync.Options{Filename: "kairos.iso"})
+		Expect(err).ToNot(HaveOccurred())
+
+		parts := strings.SplitN(out.String(), "\n\n", 2)
+		Expect(parts).To(HaveLen(2))
+		Expect(parts[0]).To(ContainSubstring("zsync: 0.6.2\n"))
+		Expect(parts[0]).To(ContainSubstring("Filename: kairos.iso\n"))
+		Expect(parts[0]).To(ContainSubstring("URL: kairos.iso\n"))
+		Expect(parts[0]).To(ContainSubstring("Blocksize: 2048\n"))
+		Expect(parts[0]).To(ContainSubstring("Length: 2058\n"))
+		Expect(parts[0]).To(ContainSubstring("Hash-Lengths: 2,2,3\n"))
+		Expect(parts[0]).To(ContainSubstring("SHA-1: "))
+
+		// Two blocks, each with 2 bytes of rolling checksum and 3 bytes of MD4
+		sums := []byte(parts[1])
+		Expect(sums).To(HaveLen(2 * (2 + 3)))
+		// A block full of ones has a = 2048 and b = 2048*2049/2 mod 2^16 = 1024, only b is kept
+		Expect(sums[0:2]).To(Equal([]byte{0x04, 0x00}))
+	})
+
+	It("writes the control file next to the artifact", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{"/out/kairos.iso": "some iso"})
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		controlFile, err := zsync.WriteFile(fs, "/out/kairos.iso")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(controlFile).To(Equal("/out/kairos.iso.zsync"))
+		data, err := fs.ReadFile(controlFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("Length: 8\n"))
+		Expect(string(data)).To(ContainSubstring("MTime: "))
+	})
+})